@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/provisioner"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func runBackup(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("backup", pflag.ContinueOnError)
+	poolNames := flags.StringSlice("pool", nil, "IPPools to back up, defaults to all")
+	output := flags.StringP("output", "o", "-", "File or gs://bucket/object to write the backup to, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	allocator, err := buildAllocator()
+	if err != nil {
+		return err
+	}
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list IPPools: %w", err)
+	}
+	if len(*poolNames) > 0 {
+		pools = slices.DeleteFunc(pools, func(pool v1alpha1.IPPool) bool {
+			return !slices.Contains(*poolNames, pool.Name)
+		})
+	}
+
+	data, err := json.MarshalIndent(ipam.NewBackup(pools, time.Now().UTC()), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode backup: %w", err)
+	}
+	data = append(data, '\n')
+
+	switch {
+	case *output == "-":
+		_, err = out.Write(data)
+	case strings.HasPrefix(*output, "gs://"):
+		err = writeObject(ctx, *output, data)
+	default:
+		err = os.WriteFile(*output, data, 0o600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write backup to %s: %w", *output, err)
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "Backed up %d IPPools to %s\n", len(pools), *output)
+	}
+	return nil
+}
+
+func runRestore(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("restore", pflag.ContinueOnError)
+	input := flags.StringP("input", "i", "", "File or gs://bucket/object to read the backup from, - for stdin")
+	poolNames := flags.StringSlice("pool", nil, "IPPools to restore, defaults to all in the backup")
+	project := flags.String("project", "", "GCP project of the cluster instances, defaults to the project of the metadata server")
+	output := flags.String("output", "text", "Plan format: json or text")
+	dryRun := flags.Bool("dry-run", false, "Print the allocations that would be restored without writing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return fmt.Errorf("--input is required")
+	}
+	if *output != "json" && *output != "text" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	backup, err := readBackup(ctx, *input)
+	if err != nil {
+		return err
+	}
+
+	if *project == "" {
+		projectID, err := identity.ProjectID(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get project ID from metadata, pass --project: %w", err)
+		}
+		*project = projectID
+	}
+
+	p, err := provisioner.NewProvisioner(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create clients: %w", err)
+	}
+	plans, err := p.PlanRestore(ctx, *project, backup, *poolNames)
+	if err != nil {
+		return fmt.Errorf("failed to plan restore: %w", err)
+	}
+
+	if *output == "text" {
+		writeTextRestorePlans(out, backup, plans)
+	} else {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(plans); err != nil {
+			return fmt.Errorf("failed to write plan: %w", err)
+		}
+	}
+	if *dryRun {
+		return nil
+	}
+
+	if err := p.Restore(ctx, plans); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Restored %d IPPools from the backup of %s\n", len(plans), backup.CreatedAt.Format(time.RFC3339))
+	return nil
+}
+
+func writeTextRestorePlans(out io.Writer, backup *ipam.Backup, plans []*ipam.RestorePlan) {
+	fmt.Fprintf(out, "Backup of %s\n", backup.CreatedAt.Format(time.RFC3339))
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, plan := range plans {
+		action := "merge into the live pool"
+		if plan.Create {
+			action = "create"
+		}
+		fmt.Fprintf(w, "\nIPPool %s: %s, %d allocations to restore, %d conflicts\n", plan.Pool, action, len(plan.Allocations), len(plan.Conflicts))
+		if len(plan.Conflicts) > 0 {
+			fmt.Fprintln(w, "CONFLICT\tNODE\tINSTANCE\tOWNER\tREASON")
+			for _, c := range plan.Conflicts {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.IP, c.Node, c.Instance, c.Owner, c.Reason)
+			}
+		}
+	}
+	w.Flush()
+}
+
+// readBackup reads a backup from a file, a gs://bucket/object or stdin for -
+func readBackup(ctx context.Context, input string) (*ipam.Backup, error) {
+	var data []byte
+	var err error
+	switch {
+	case input == "-":
+		data, err = io.ReadAll(os.Stdin)
+	case strings.HasPrefix(input, "gs://"):
+		data, err = readObject(ctx, input)
+	default:
+		data, err = os.ReadFile(input)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup from %s: %w", input, err)
+	}
+	var backup ipam.Backup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, fmt.Errorf("failed to decode backup %s: %w", input, err)
+	}
+	return &backup, nil
+}
+
+// splitObjectURL splits gs://bucket/object
+func splitObjectURL(url string) (string, string, error) {
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(url, "gs://"), "/")
+	if !ok || bucket == "" || object == "" {
+		return "", "", fmt.Errorf("invalid object URL %q, expected gs://bucket/object", url)
+	}
+	return bucket, object, nil
+}
+
+func writeObject(ctx context.Context, url string, data []byte) error {
+	bucket, object, err := splitObjectURL(url)
+	if err != nil {
+		return err
+	}
+	service, err := storage.NewService(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+	_, err = service.Objects.Insert(bucket, &storage.Object{Name: object, ContentType: "application/json"}).
+		Media(bytes.NewReader(data)).Context(ctx).Do()
+	return err
+}
+
+func readObject(ctx context.Context, url string) ([]byte, error) {
+	bucket, object, err := splitObjectURL(url)
+	if err != nil {
+		return nil, err
+	}
+	service, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	resp, err := service.Objects.Get(bucket, object).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/provisioner"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func runCapacity(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("capacity", pflag.ContinueOnError)
+	project := flags.String("project", "", "GCP project of the cluster instances, defaults to the project of the metadata server")
+	output := flags.String("output", "text", "Report format: json or text")
+	top := flags.Int("top", 10, "Namespaces holding the most IPs to list, 0 lists all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output != "json" && *output != "text" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	if *project == "" {
+		projectID, err := identity.ProjectID(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get project ID from metadata, pass --project: %w", err)
+		}
+		*project = projectID
+	}
+
+	p, err := provisioner.NewProvisioner(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create clients: %w", err)
+	}
+	report, err := p.Capacity(ctx, *project, *top)
+	if err != nil {
+		return fmt.Errorf("failed to report capacity: %w", err)
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+		return nil
+	}
+	writeTextCapacity(out, report)
+	return nil
+}
+
+func writeTextCapacity(out io.Writer, report *ipam.CapacityReport) {
+	fmt.Fprintf(out, "Capacity at %s: %d IPs, %d allocated, %d free\n\n",
+		report.GeneratedAt.Format(time.RFC3339), report.Capacity, report.Allocated, report.Free)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POOL\tCAPACITY\tALLOCATED\tFREE\tBUFFERED")
+	for _, pool := range report.Pools {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", pool.Pool, pool.Capacity, pool.Allocated, pool.Free, pool.Buffered)
+	}
+	if len(report.Nodes) > 0 {
+		fmt.Fprintf(w, "\nNODE\tALLOCATED\tALIAS RANGES\tHEADROOM (OF %d)\n", ipam.MaxAliasRanges)
+		for _, node := range report.Nodes {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", node.Node, node.Allocated, node.AliasRanges, node.Headroom)
+		}
+	}
+	if len(report.Namespaces) > 0 {
+		fmt.Fprintln(w, "\nNAMESPACE\tIPS")
+		for _, namespace := range report.Namespaces {
+			fmt.Fprintf(w, "%s\t%d\n", namespace.Namespace, namespace.IPs)
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// liveSnapshot names the current IPPools of the cluster as a snapshot to diff
+const liveSnapshot = "live"
+
+func runDiff(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("diff", pflag.ContinueOnError)
+	from := flags.String("from", "", "Backup to diff from: file, gs://bucket/object, - for stdin or live for the current IPPools")
+	to := flags.String("to", liveSnapshot, "Backup to diff to: file, gs://bucket/object, - for stdin or live for the current IPPools")
+	poolNames := flags.StringSlice("pool", nil, "IPPools to diff, defaults to all")
+	output := flags.String("output", "text", "Report format: json or text")
+	top := flags.Int("top", 10, "Namespaces and nodes with the most churn to list in the text report, 0 lists all")
+	changes := flags.Bool("changes", false, "List every added and removed allocation in the text report")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("--from is required")
+	}
+	if *from == "-" && *to == "-" {
+		return fmt.Errorf("only one of --from and --to can be read from stdin")
+	}
+	if *output != "json" && *output != "text" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	ctx := context.Background()
+	before, err := readSnapshot(ctx, *from)
+	if err != nil {
+		return err
+	}
+	after, err := readSnapshot(ctx, *to)
+	if err != nil {
+		return err
+	}
+	if len(*poolNames) > 0 {
+		for _, snapshot := range []*ipam.Backup{before, after} {
+			snapshot.Pools = slices.DeleteFunc(snapshot.Pools, func(pool v1alpha1.IPPool) bool {
+				return !slices.Contains(*poolNames, pool.Name)
+			})
+		}
+	}
+
+	diff := ipam.DiffSnapshots(before, after)
+	if *output == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(diff); err != nil {
+			return fmt.Errorf("failed to write diff: %w", err)
+		}
+		return nil
+	}
+	writeTextDiff(out, diff, *top, *changes)
+	return nil
+}
+
+// readSnapshot reads a backup, or snapshots the current IPPools for live
+func readSnapshot(ctx context.Context, input string) (*ipam.Backup, error) {
+	if input != liveSnapshot {
+		return readBackup(ctx, input)
+	}
+	allocator, err := buildAllocator()
+	if err != nil {
+		return nil, err
+	}
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IPPools: %w", err)
+	}
+	return ipam.NewBackup(pools, time.Now().UTC()), nil
+}
+
+func writeTextDiff(out io.Writer, diff *ipam.SnapshotDiff, top int, changes bool) {
+	fmt.Fprintf(out, "From %s to %s (%s)\n\n", diff.From.Format(time.RFC3339), diff.To.Format(time.RFC3339), diff.To.Sub(diff.From).Round(time.Second))
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POOL\tCAPACITY\tBEFORE\tAFTER\tADDED\tREMOVED")
+	for _, pool := range diff.Pools {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", pool.Pool, pool.Capacity, pool.Before, pool.After, len(pool.Added), len(pool.Removed))
+	}
+	for _, churn := range []struct {
+		header string
+		rows   []ipam.Churn
+	}{
+		{"NAMESPACE", diff.ByNamespace},
+		{"NODE", diff.ByNode},
+	} {
+		rows := churn.rows
+		if top > 0 && len(rows) > top {
+			rows = rows[:top]
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s\tADDED\tREMOVED\n", churn.header)
+		for _, row := range rows {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", row.Name, row.Added, row.Removed)
+		}
+	}
+	if changes {
+		fmt.Fprintln(w, "\nCHANGE\tPOOL\tIP\tNODE\tOWNER")
+		for _, pool := range diff.Pools {
+			for _, c := range pool.Removed {
+				fmt.Fprintf(w, "removed\t%s\t%s\t%s\t%s\n", c.Pool, c.IP, c.Node, c.Owner)
+			}
+			for _, c := range pool.Added {
+				fmt.Fprintf(w, "added\t%s\t%s\t%s\t%s\n", c.Pool, c.IP, c.Node, c.Owner)
+			}
+		}
+	}
+	w.Flush()
+}
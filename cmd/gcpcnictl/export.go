@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/samber/lo"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func runExport(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("export", pflag.ContinueOnError)
+	format := flags.String("format", "csv", "Export format: hosts, csv or netbox")
+	poolNames := flags.StringSlice("pool", nil, "IPPools to export, all pools when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	allocator, err := buildAllocator()
+	if err != nil {
+		return err
+	}
+	pools, err := allocator.ListPools(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(*poolNames) > 0 {
+		pools = lo.Filter(pools, func(pool v1alpha1.IPPool, _ int) bool {
+			return lo.Contains(*poolNames, pool.Name)
+		})
+	}
+
+	return ipam.Export(out, pools, ipam.ExportFormat(*format))
+}
+
+// buildAllocator reads IPPools with the kubeconfig of the environment, or the
+// in-cluster config when there is none
+func buildAllocator() (*ipam.Allocator, error) {
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+	return ipam.NewAllocator(client), nil
+}
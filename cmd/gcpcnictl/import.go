@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/provisioner"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func runImport(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("import", pflag.ContinueOnError)
+	poolName := flags.String("pool", "", "IPPool to seed with the IPs in use")
+	project := flags.String("project", "", "GCP project of the cluster instances, defaults to the project of the metadata server")
+	rangeNames := flags.StringSlice("secondary-range", nil, "Secondary ranges whose alias IP ranges are imported, defaults to the ranges of the pool")
+	output := flags.String("output", "text", "Plan format: json or text")
+	dryRun := flags.Bool("dry-run", false, "Print the allocations that would be imported without recording them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *poolName == "" {
+		return fmt.Errorf("--pool is required")
+	}
+	if *output != "json" && *output != "text" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	if *project == "" {
+		projectID, err := identity.ProjectID(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get project ID from metadata, pass --project: %w", err)
+		}
+		*project = projectID
+	}
+
+	p, err := provisioner.NewProvisioner(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create clients: %w", err)
+	}
+	plan, err := p.PlanImport(ctx, *project, *poolName, *rangeNames)
+	if err != nil {
+		return fmt.Errorf("failed to plan import: %w", err)
+	}
+
+	if *output == "text" {
+		writeTextPlan(out, plan)
+	} else {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(plan); err != nil {
+			return fmt.Errorf("failed to write plan: %w", err)
+		}
+	}
+	if *dryRun {
+		return nil
+	}
+
+	added, err := p.Import(ctx, plan)
+	if err != nil {
+		return fmt.Errorf("failed to import into IPPool %s: %w", plan.Pool, err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d allocations into IPPool %s\n", added, plan.Pool)
+	return nil
+}
+
+func writeTextPlan(out io.Writer, plan *ipam.ImportPlan) {
+	fmt.Fprintf(out, "IPPool %s: %d allocations to import, %d IPs skipped\n", plan.Pool, len(plan.Allocations), len(plan.Skipped))
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if len(plan.Allocations) > 0 {
+		fmt.Fprintln(w, "\nIP\tNODE\tPOD")
+		for _, entry := range plan.Allocations {
+			pod := ipam.ConflictPlaceholder
+			if entry.PodUID != "" {
+				pod = entry.PodNamespace + "/" + entry.PodName
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", entry.IP, entry.Node, pod)
+		}
+	}
+	if len(plan.Skipped) > 0 {
+		fmt.Fprintln(w, "\nSKIPPED\tNODE\tPOD\tREASON")
+		for _, skip := range plan.Skipped {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", skip.IP, skip.Node, skip.Pod, skip.Reason)
+		}
+	}
+	w.Flush()
+}
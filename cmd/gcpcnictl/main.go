@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/provisioner"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// exitDrift is the exit code of a verify run that found drift, so scripts
+// can tell it apart from a failed run
+const exitDrift = 2
+
+const usage = `Usage: gcpcnictl <command> [flags]
+
+Commands:
+  verify   Cross-check IPPool allocations, GCE alias IPs and pod IPs and report drift
+  export   Write the IPPool allocations as hosts file, CSV or NetBox JSON
+  import   Seed an IPPool with the alias IPs and pod IPs already in use
+  backup   Snapshot the IPPools to a file or GCS object
+  restore  Restore IPPools from a backup, checking it against the attached alias IPs
+  diff     Summarize the allocations added and removed between two backups
+  protect  Keep GC and repairs from reclaiming allocations, or lift the protection
+  validate Check the conflist, plugin configuration, IPPools and subnetworks for consistency
+  capacity Report IP usage across pools, alias headroom of nodes and the namespaces holding the most IPs
+  vacate   Stop allocating from a slice of a pool, evict the pods holding its IPs and confirm it is free
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "verify":
+		err = runVerify(os.Args[2:], os.Stdout)
+	case "export":
+		err = runExport(os.Args[2:], os.Stdout)
+	case "import":
+		err = runImport(os.Args[2:], os.Stdout)
+	case "backup":
+		err = runBackup(os.Args[2:], os.Stdout)
+	case "restore":
+		err = runRestore(os.Args[2:], os.Stdout)
+	case "diff":
+		err = runDiff(os.Args[2:], os.Stdout)
+	case "protect":
+		err = runProtect(os.Args[2:], os.Stdout)
+	case "validate":
+		err = runValidate(os.Args[2:], os.Stdout)
+	case "capacity":
+		err = runCapacity(os.Args[2:], os.Stdout)
+	case "vacate":
+		err = runVacate(os.Args[2:], os.Stdout)
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		err = fmt.Errorf("unknown command %q\n\n%s", os.Args[1], usage)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func runVerify(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("verify", pflag.ContinueOnError)
+	project := flags.String("project", "", "GCP project of the cluster instances, defaults to the project of the metadata server")
+	output := flags.String("output", "json", "Report format: json or text")
+	repairLimit := flags.Int("repair-limit", 0, "Maximum number of orphaned allocations, orphaned aliases and unallocated pod IPs to repair, 0 only reports them")
+	dryRun := flags.Bool("dry-run", false, "Mark the drifts that would be repaired without repairing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output != "json" && *output != "text" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	if *project == "" {
+		projectID, err := identity.ProjectID(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get project ID from metadata, pass --project: %w", err)
+		}
+		*project = projectID
+	}
+
+	p, err := provisioner.NewProvisioner(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create clients: %w", err)
+	}
+	report, err := p.Verify(ctx, *project)
+	if err != nil {
+		return fmt.Errorf("failed to verify: %w", err)
+	}
+	if *repairLimit > 0 {
+		p.Repair(ctx, *project, report, *repairLimit, *dryRun)
+	}
+
+	if *output == "text" {
+		writeTextReport(out, report)
+	} else {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+	}
+
+	if len(report.Drifts) > 0 {
+		os.Exit(exitDrift)
+	}
+	return nil
+}
+
+func writeTextReport(out io.Writer, report *ipam.DriftReport) {
+	fmt.Fprintf(out, "Checked %d pools, %d attached IPs and %d pods: %d drifts\n",
+		report.Pools, report.Attached, report.Pods, len(report.Drifts))
+	if len(report.Drifts) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nKIND\tPOOL\tIP\tNODE\tINSTANCE\tPOD\tREPAIR\tOUTCOME\tDETAIL")
+	for _, d := range report.Drifts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.Kind, d.Pool, d.IP, d.Node, d.Instance, d.Pod, d.Repair, d.Outcome, d.Detail)
+	}
+	w.Flush()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/spf13/pflag"
+)
+
+func runProtect(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("protect", pflag.ContinueOnError)
+	pool := flags.String("pool", "", "IPPool allocating the IPs")
+	ips := flags.StringSlice("ip", nil, "Allocated IPs to protect")
+	remove := flags.Bool("remove", false, "Lift the protection instead, so GC and repairs may reclaim the allocations again")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *pool == "" || len(*ips) == 0 {
+		return fmt.Errorf("--pool and --ip are required")
+	}
+
+	allocator, err := buildAllocator()
+	if err != nil {
+		return err
+	}
+	for _, ip := range *ips {
+		if err := allocator.SetProtected(context.Background(), *pool, ip, !*remove); err != nil {
+			return fmt.Errorf("failed to change protection of IP %s: %w", ip, err)
+		}
+		if *remove {
+			fmt.Fprintf(out, "Lifted protection of %s in IPPool %s\n", ip, *pool)
+		} else {
+			fmt.Fprintf(out, "Protected %s in IPPool %s\n", ip, *pool)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/castai/gcp-cni/internal/provisioner"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// vacatePollInterval is how often --wait checks the slice again
+const vacatePollInterval = 10 * time.Second
+
+func runVacate(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("vacate", pflag.ContinueOnError)
+	pool := flags.String("pool", "", "IPPool the slice belongs to")
+	cidr := flags.String("cidr", "", "Slice of the ranges of the pool to vacate")
+	evict := flags.Bool("evict", false, "Evict the pods holding IPs of the slice through the Eviction API")
+	maxUnavailable := flags.Int("max-unavailable", 1, "Maximum number of pods holding IPs of the slice terminating at once")
+	wait := flags.Duration("wait", 0, "How long to keep evicting and checking until the slice is free, 0 checks once")
+	remove := flags.Bool("remove", false, "Let allocations from the slice resume instead")
+	output := flags.String("output", "text", "Report format: json or text")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *pool == "" || *cidr == "" {
+		return fmt.Errorf("--pool and --cidr are required")
+	}
+	if *output != "json" && *output != "text" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	ctx := context.Background()
+	if *remove {
+		allocator, err := buildAllocator()
+		if err != nil {
+			return err
+		}
+		if _, err := allocator.SetVacating(ctx, *pool, *cidr, false); err != nil {
+			return fmt.Errorf("failed to lift vacating of %s: %w", *cidr, err)
+		}
+		fmt.Fprintf(out, "Allocations from %s of IPPool %s resume\n", *cidr, *pool)
+		return nil
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	p, err := provisioner.NewProvisioner(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create clients: %w", err)
+	}
+
+	deadline := time.Now().Add(*wait)
+	var report *ipam.VacateReport
+	for {
+		report, err = p.Vacate(ctx, *pool, *cidr, *evict, *maxUnavailable)
+		if err != nil {
+			return fmt.Errorf("failed to vacate %s: %w", *cidr, err)
+		}
+		if report.Free || time.Now().Add(vacatePollInterval).After(deadline) {
+			break
+		}
+		time.Sleep(vacatePollInterval)
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+	} else {
+		writeTextVacate(out, report)
+	}
+
+	if !report.Free {
+		return fmt.Errorf("%d IPs of %s are still held", len(report.Holders), report.CIDR)
+	}
+	return nil
+}
+
+func writeTextVacate(out io.Writer, report *ipam.VacateReport) {
+	if report.Free {
+		fmt.Fprintf(out, "%s of IPPool %s is free, the range can be shrunk or removed\n", report.CIDR, report.Pool)
+		return
+	}
+	fmt.Fprintf(out, "%s of IPPool %s is vacating, %d IPs still held\n", report.CIDR, report.Pool, len(report.Holders))
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nIP\tOWNER\tNODE\tOUTCOME")
+	for _, h := range report.Holders {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", h.IP, h.Owner, h.Node, h.Outcome)
+	}
+	w.Flush()
+}
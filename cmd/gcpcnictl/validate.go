@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/provisioner"
+	"github.com/castai/gcp-cni/internal/validation"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// exitInvalid is the exit code of a validate run that found errors
+const exitInvalid = 2
+
+func runValidate(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("validate", pflag.ContinueOnError)
+	confList := flags.String("conflist", "", "CNI conflist of the nodes to check")
+	pluginConfig := flags.String("plugin-config", "", "Plugin configuration to check, as YAML or the manifest of its ConfigMap")
+	poolFiles := flags.StringSlice("pools", nil, "Manifests of the IPPools to check the configuration against, such as the output of helm template")
+	live := flags.Bool("live", false, "Check against the IPPools of the cluster and the secondary ranges of their subnetworks, and the ConfigMap when --plugin-config is not set")
+	project := flags.String("project", "", "GCP project of the cluster with --live, defaults to the project of the metadata server")
+	pluginConfigPath := flags.String("plugin-config-path", config.DefaultPath, "--plugin-config-path of the installer")
+	secondaryRangeName := flags.String("secondary-range-name", "", "--secondary-range-name of the provisioner, unchecked when empty")
+	output := flags.String("output", "text", "Report format: json or text")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output != "json" && *output != "text" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	stack := validation.Stack{
+		PluginConfigPath:   *pluginConfigPath,
+		SecondaryRangeName: *secondaryRangeName,
+	}
+	if *confList != "" {
+		data, err := os.ReadFile(*confList)
+		if err != nil {
+			return fmt.Errorf("failed to read conflist: %w", err)
+		}
+		stack.ConfList = data
+	}
+	if *pluginConfig != "" {
+		cfg, err := readPluginConfig(*pluginConfig)
+		if err != nil {
+			return err
+		}
+		stack.PluginConfig = cfg
+	}
+	for _, path := range *poolFiles {
+		pools, err := readPools(path)
+		if err != nil {
+			return err
+		}
+		stack.Pools = append(stack.Pools, pools...)
+	}
+	if len(*poolFiles) > 0 && stack.Pools == nil {
+		// Files without pools check the names against none
+		stack.Pools = []v1alpha1.IPPool{}
+	}
+
+	var findings []validation.Finding
+	if !*live {
+		findings = validation.Validate(stack)
+	} else {
+		ctx := context.Background()
+		logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+		if *project == "" {
+			projectID, err := identity.ProjectID(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get project ID from metadata, pass --project: %w", err)
+			}
+			*project = projectID
+		}
+		p, err := provisioner.NewProvisioner(ctx, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create clients: %w", err)
+		}
+		// The pools of the cluster replace those of the files
+		findings, err = p.Validate(ctx, *project, stack)
+		if err != nil {
+			return fmt.Errorf("failed to validate: %w", err)
+		}
+	}
+
+	if *output == "text" {
+		writeTextFindings(out, findings)
+	} else {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(findings); err != nil {
+			return fmt.Errorf("failed to write findings: %w", err)
+		}
+	}
+
+	if validation.HasErrors(findings) {
+		os.Exit(exitInvalid)
+	}
+	return nil
+}
+
+func writeTextFindings(out io.Writer, findings []validation.Finding) {
+	fmt.Fprintf(out, "%d findings\n", len(findings))
+	if len(findings) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nSEVERITY\tSOURCE\tMESSAGE")
+	for _, f := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.Severity, f.Source, f.Message)
+	}
+	w.Flush()
+}
+
+// readPluginConfig reads the plugin configuration from path, either the
+// configuration itself or a manifest holding its ConfigMap
+func readPluginConfig(path string) (*config.Config, error) {
+	docs, err := readManifests(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		var cm corev1.ConfigMap
+		if err := yaml.Unmarshal(doc, &cm); err != nil || cm.Kind != "ConfigMap" {
+			continue
+		}
+		if data, ok := cm.Data[config.ConfigMapKey]; ok {
+			cfg, err := config.Parse([]byte(data))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse plugin configuration of ConfigMap %s: %w", cm.Name, err)
+			}
+			return cfg, nil
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plugin configuration: %w", err)
+	}
+	cfg, err := config.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse plugin configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// readPools reads the IPPools of the manifests in path, other kinds are
+// skipped
+func readPools(path string) ([]v1alpha1.IPPool, error) {
+	docs, err := readManifests(path)
+	if err != nil {
+		return nil, err
+	}
+	var pools []v1alpha1.IPPool
+	for _, doc := range docs {
+		var meta metav1.TypeMeta
+		if err := yaml.Unmarshal(doc, &meta); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		switch meta.Kind {
+		case "IPPool":
+			var pool v1alpha1.IPPool
+			if err := yaml.Unmarshal(doc, &pool); err != nil {
+				return nil, fmt.Errorf("failed to parse IPPool in %s: %w", path, err)
+			}
+			pools = append(pools, pool)
+		case "IPPoolList", "List":
+			var list v1alpha1.IPPoolList
+			if err := yaml.Unmarshal(doc, &list); err != nil {
+				return nil, fmt.Errorf("failed to parse list in %s: %w", path, err)
+			}
+			for _, pool := range list.Items {
+				if pool.Kind == "" || pool.Kind == "IPPool" {
+					pools = append(pools, pool)
+				}
+			}
+		}
+	}
+	return pools, nil
+}
+
+// readManifests splits the YAML or JSON manifests in path into documents
+func readManifests(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var docs [][]byte
+	for _, doc := range bytes.Split(data, []byte("\n---")) {
+		if len(bytes.TrimSpace(doc)) > 0 {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
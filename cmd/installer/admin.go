@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/quota"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const (
+	adminRequestTimeout = 30 * time.Second
+	// adminTokenPath holds the bearer token of the mutating admin API
+	// endpoints, readable by root on the host only
+	adminTokenPath = "/var/run/gcp-cni-admin-token"
+)
+
+// adminServer exposes node-local state over a local HTTP API, so it can be
+// inspected without grepping logs:
+//
+//	GET  /allocations  allocations held by pods on this node, across all pools
+//	GET  /operations   plugin invocations queued for the node mutation lock, GCE call pacing and a live migration holding them
+//	GET  /attachments  container attachments from the node-local allocation database
+//	GET  /history      outcomes of recent plugin invocations with per-phase timings, ?limit=N
+//	GET  /quota        GCE quota consumption of the plugin on this node with per-minute estimates
+//	GET  /metrics      the same consumption in the Prometheus text format, ADD latency SLO burn rates, pool update retries, CNI config changes and binary integrity failures
+//	POST /resync       rerun the installation (binaries, self-test, CNI config)
+//
+// The API listens on the host network, so any process or host network pod on
+// the node can reach it. Reads are open, mutating endpoints require the token
+// written to adminTokenPath at startup as a bearer token.
+type adminServer struct {
+	logger    *slog.Logger
+	allocator *ipam.Allocator
+	token     string
+	install   func(logger *slog.Logger) error
+}
+
+// nodeAllocation is an allocation held on this node
+type nodeAllocation struct {
+	Pool string `json:"pool"`
+	IP   string `json:"ip"`
+	v1alpha1.IPAllocation
+}
+
+func serveAdminAPI(ctx context.Context, logger *slog.Logger, addr string) error {
+	_, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+
+	token, err := writeAdminToken(filepath.Join(*hostRoot, adminTokenPath))
+	if err != nil {
+		return err
+	}
+
+	s := &adminServer{
+		logger:    logger,
+		allocator: ipam.NewAllocator(dynamicClient),
+		token:     token,
+		install:   runInstallation,
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	go func() {
+		logger.Info("Serving admin API", slog.String("address", addr))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Admin API stopped", slog.String("error", err.Error()))
+		}
+	}()
+	return nil
+}
+
+func (s *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /allocations", s.handleAllocations)
+	mux.HandleFunc("GET /operations", s.handleOperations)
+	mux.HandleFunc("GET /attachments", s.handleAttachments)
+	mux.HandleFunc("GET /history", s.handleHistory)
+	mux.HandleFunc("GET /quota", s.handleQuota)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("POST /resync", s.authorized(s.handleResync))
+	return mux
+}
+
+// writeAdminToken writes a new random token to path, replacing the token of a
+// previous run, and returns it
+func writeAdminToken(path string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate admin API token: %w", err)
+	}
+	token := hex.EncodeToString(b)
+
+	// Recreated rather than truncated, so a file left readable by others is not reused
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to remove admin API token: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create admin API token: %w", err)
+	}
+	if _, err := f.WriteString(token); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to write admin API token: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to write admin API token: %w", err)
+	}
+	return token, nil
+}
+
+// authorized rejects requests without the admin API token as a bearer token
+func (s *adminServer) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			s.logger.Warn("Rejected unauthorized admin API request", slog.String("method", r.Method), slog.String("path", r.URL.Path))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			s.writeError(w, http.StatusUnauthorized, errors.New("missing or invalid admin API token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *adminServer) handleAllocations(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminRequestTimeout)
+	defer cancel()
+
+	pools, err := s.allocator.ListPools(ctx)
+	if err != nil {
+		s.writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	allocations := []nodeAllocation{}
+	for _, pool := range pools {
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.NodeName != *nodeName {
+				continue
+			}
+			allocations = append(allocations, nodeAllocation{Pool: pool.Name, IP: ip, IPAllocation: allocation})
+		}
+	}
+	sort.Slice(allocations, func(i, j int) bool {
+		return allocations[i].AllocatedAt.Before(&allocations[j].AllocatedAt)
+	})
+
+	s.writeJSON(w, allocations)
+}
+
+func (s *adminServer) handleOperations(w http.ResponseWriter, _ *http.Request) {
+	queued, err := mutation.Pending(filepath.Join(*hostRoot, mutation.DefaultQueueDir))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if queued == nil {
+		queued = []mutation.Ticket{}
+	}
+
+	pacing, err := mutation.ReadPacerState(filepath.Join(*hostRoot, mutation.DefaultPacerPath))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	maintenance, err := mutation.ReadMaintenance(filepath.Join(*hostRoot, mutation.DefaultMaintenancePath))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.writeJSON(w, map[string]interface{}{
+		"queued":      queued,
+		"pacing":      pacing,
+		"maintenance": maintenance,
+	})
+}
+
+func (s *adminServer) handleAttachments(w http.ResponseWriter, _ *http.Request) {
+	path := filepath.Join(*hostRoot, store.DefaultPath)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		s.writeJSON(w, []store.Attachment{})
+		return
+	}
+
+	db, err := store.OpenReadOnly(path)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer db.Close()
+
+	attachments, err := db.List()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if attachments == nil {
+		attachments = []store.Attachment{}
+	}
+	sort.Slice(attachments, func(i, j int) bool {
+		return attachments[i].CreatedAt.Before(attachments[j].CreatedAt)
+	})
+
+	s.writeJSON(w, attachments)
+}
+
+func (s *adminServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		limit = n
+	}
+
+	records, err := telemetry.List(filepath.Join(*hostRoot, telemetry.DefaultDir), limit)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeJSON(w, records)
+}
+
+func (s *adminServer) handleQuota(w http.ResponseWriter, _ *http.Request) {
+	usage, err := quota.Load(filepath.Join(*hostRoot, quota.DefaultPath))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.writeJSON(w, map[string]interface{}{
+		"since":     usage.Since,
+		"totals":    usage.Totals,
+		"estimates": usage.Estimates(time.Now()),
+	})
+}
+
+func (s *adminServer) handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	usage, err := quota.Load(filepath.Join(*hostRoot, quota.DefaultPath))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := quota.WriteMetrics(w, usage, time.Now()); err != nil {
+		s.logger.Error("Failed to write admin API response", slog.String("error", err.Error()))
+		return
+	}
+
+	if *cniConfInterval > 0 {
+		if err := writeConfChangeMetrics(w); err != nil {
+			s.logger.Error("Failed to write admin API response", slog.String("error", err.Error()))
+			return
+		}
+	}
+
+	if *integrityInterval > 0 {
+		if err := writeIntegrityMetrics(w); err != nil {
+			s.logger.Error("Failed to write admin API response", slog.String("error", err.Error()))
+			return
+		}
+	}
+
+	records, err := telemetry.List(filepath.Join(*hostRoot, telemetry.DefaultDir), 0)
+	if err != nil {
+		s.logger.Error("Failed to list operation records", slog.String("error", err.Error()))
+		return
+	}
+	if err := telemetry.WriteRetryMetrics(w, records); err != nil {
+		s.logger.Error("Failed to write admin API response", slog.String("error", err.Error()))
+		return
+	}
+
+	if *addLatency <= 0 {
+		return
+	}
+	burns, violating, err := addLatencyBurns(time.Now())
+	if err != nil {
+		s.logger.Error("Failed to evaluate ADD latency SLO", slog.String("error", err.Error()))
+		return
+	}
+	if err := telemetry.WriteBurnMetrics(w, addLatencySLO(), burns, violating); err != nil {
+		s.logger.Error("Failed to write admin API response", slog.String("error", err.Error()))
+	}
+}
+
+func (s *adminServer) handleResync(w http.ResponseWriter, _ *http.Request) {
+	s.logger.Info("Resync requested through admin API")
+	if err := s.install(s.logger); err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (s *adminServer) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Error("Failed to write admin API response", slog.String("error", err.Error()))
+	}
+}
+
+func (s *adminServer) writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestAdminAPIResync(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		installErr    error
+		wantStatus    int
+		wantInstalled bool
+	}{
+		{name: "no token", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", authorization: "Bearer other", wantStatus: http.StatusUnauthorized},
+		{name: "token without the bearer scheme", authorization: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "token", authorization: "Bearer secret", wantStatus: http.StatusOK, wantInstalled: true},
+		{name: "failed installation", authorization: "Bearer secret", installErr: errors.New("self-test failed"), wantStatus: http.StatusInternalServerError, wantInstalled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installed := false
+			s := &adminServer{
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+				token:  "secret",
+				install: func(*slog.Logger) error {
+					installed = true
+					return tt.installErr
+				},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/resync", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			s.handler().ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if installed != tt.wantInstalled {
+				t.Errorf("installation ran = %v, want %v", installed, tt.wantInstalled)
+			}
+		})
+	}
+}
+
+// An installer that failed to write its token must not accept an empty one
+func TestAdminAPIResyncWithoutToken(t *testing.T) {
+	s := &adminServer{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		install: func(*slog.Logger) error { t.Error("installation ran"); return nil },
+	}
+	req := httptest.NewRequest(http.MethodPost, "/resync", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAdminAPIReadsWithoutToken(t *testing.T) {
+	allocator, _ := newNodeAllocator(t, map[string]v1alpha1.IPAllocation{
+		"10.8.0.5": {PodName: "web", PodNamespace: "default", NodeName: "node-1"},
+		"10.8.0.6": {PodName: "db", PodNamespace: "default", NodeName: "node-2"},
+	})
+	s := &adminServer{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), allocator: allocator, token: "secret"}
+
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/allocations", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var allocations []nodeAllocation
+	if err := json.Unmarshal(rec.Body.Bytes(), &allocations); err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 1 || allocations[0].IP != "10.8.0.5" {
+		t.Errorf("allocations = %+v, want only 10.8.0.5 of node-1", allocations)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/resync", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /resync status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWriteAdminToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gcp-cni-admin-token")
+	// A token of a previous run left readable by others
+	if err := os.WriteFile(path, []byte("previous"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := writeAdminToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == "" || string(data) != token {
+		t.Errorf("token file = %q, want %q", data, token)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	next, err := writeAdminToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == token {
+		t.Error("token reused across runs")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/gofrs/flock"
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/hooks"
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// attachPendingAliases attaches the aliases ADD left to attach asynchronously
+// every interval until ctx is done. The pods wait for them through the
+// ipam.AliasAttachedCondition readiness gate, which is set once GCE finished
+// the network interface update and the afterAttach hooks ran.
+func attachPendingAliases(ctx context.Context, logger *slog.Logger, interval time.Duration) error {
+	clientset, _, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Attaching aliases of pods started ahead of them", slog.Duration("interval", interval))
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := attachPendingOnce(ctx, logger, clientset); err != nil {
+				logger.Error("Failed to attach pending aliases", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func attachPendingOnce(ctx context.Context, logger *slog.Logger, clientset kubernetes.Interface) error {
+	pending, err := pendingAttachments()
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	lock := flock.New(filepath.Join(*hostRoot, mutation.DefaultLockPath))
+	if _, err := lock.TryLockContext(ctx, 50*time.Millisecond); err != nil {
+		return fmt.Errorf("failed to acquire node mutation lock: %w", err)
+	}
+	defer lock.Unlock()
+
+	// Read again under the lock, DEL may have released some meanwhile
+	pending, err = pendingAttachments()
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	cfg, err := config.Load(filepath.Join(*hostRoot, *pluginConfigPath))
+	if err != nil {
+		return err
+	}
+	attachErr := attachAliases(ctx, logger, pending, "pending pod IPs")
+	if attachErr == nil {
+		return finishAttach(ctx, logger, clientset, cfg, pending, nil)
+	}
+	if len(pending) == 1 {
+		return finishAttach(ctx, logger, clientset, cfg, pending, attachErr)
+	}
+	// One IP GCE rejects must not hold back the others
+	for _, a := range pending {
+		single := []store.Attachment{a}
+		if err := finishAttach(ctx, logger, clientset, cfg, single, attachAliases(ctx, logger, single, "pending pod IP")); err != nil {
+			attachErr = err
+		}
+	}
+	return attachErr
+}
+
+// finishAttach runs the afterAttach hooks of the attachments whose aliases
+// are attached, records the outcome and reports it to their pods. A failed
+// Fail hook holds its pod back like a failed attach, the attachment stays
+// pending and its hooks run again on the next interval. It returns attachErr
+// or the last hook failure.
+func finishAttach(ctx context.Context, logger *slog.Logger, clientset kubernetes.Interface, cfg *config.Config, attachments []store.Attachment, attachErr error) error {
+	var instanceName string
+	if attachErr == nil && slices.ContainsFunc(cfg.Hooks, func(hook config.Hook) bool { return hook.Subscribed(config.HookAfterAttach) }) {
+		var err error
+		if instanceName, err = metadata.InstanceNameWithContext(ctx); err != nil {
+			return fmt.Errorf("failed to get instance name from metadata: %w", err)
+		}
+	}
+
+	finishErr := attachErr
+	for _, a := range attachments {
+		err := attachErr
+		if err == nil {
+			if err = runAttachHooks(ctx, logger, cfg.Hooks, a, instanceName); err == nil {
+				if err := markAttached([]store.Attachment{a}); err != nil {
+					return err
+				}
+			} else {
+				finishErr = err
+			}
+		}
+		if err := setAliasAttachedCondition(ctx, clientset, a, err); err != nil {
+			logger.Error("Failed to set alias readiness condition",
+				slog.String("pod", a.PodNamespace+"/"+a.PodName),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	return finishErr
+}
+
+// runAttachHooks runs the afterAttach hooks ADD left to the asynchronous
+// attach of a. Only failures of hooks with the Fail policy are returned.
+func runAttachHooks(ctx context.Context, logger *slog.Logger, hookList []config.Hook, a store.Attachment, instanceName string) error {
+	if len(hookList) == 0 {
+		return nil
+	}
+	return hooks.Run(ctx, hookList, hooks.Event{
+		Type:           config.HookAfterAttach,
+		Time:           time.Now(),
+		IP:             a.IP,
+		Pool:           a.Pool,
+		SecondaryRange: a.SecondaryRange,
+		Instance:       instanceName,
+		PodNamespace:   a.PodNamespace,
+		PodName:        a.PodName,
+		PodUID:         a.PodUID,
+		ContainerID:    a.ContainerID,
+		IfName:         a.IfName,
+	}, func(hook string, err error) {
+		logger.Warn("Hook failed, ignoring",
+			slog.String("hook", hook),
+			slog.String("ip", a.IP),
+			slog.String("pod", a.PodNamespace+"/"+a.PodName),
+			slog.String("error", err.Error()),
+		)
+	})
+}
+
+// pendingAttachments returns the attachments whose alias ADD left to attach
+func pendingAttachments() ([]store.Attachment, error) {
+	live, err := liveAttachments()
+	if err != nil {
+		return nil, err
+	}
+	return lo.Filter(live, func(a store.Attachment, _ int) bool {
+		return a.AttachPending && a.State == store.StateAllocated
+	}), nil
+}
+
+func markAttached(attachments []store.Attachment) error {
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	for _, a := range attachments {
+		err := s.Update(a.ContainerID, a.IfName, func(current *store.Attachment) {
+			// Left alone when DEL started in between
+			if current.AttachPending && current.State == store.StateAllocated {
+				current.AttachPending = false
+				current.State = store.StateAttached
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record attachment of %s/%s: %w", a.ContainerID, a.IfName, err)
+		}
+	}
+	return nil
+}
+
+// setAliasAttachedCondition sets the readiness condition of the pod of a, true
+// once its alias is attached and false with the error while attaching fails
+func setAliasAttachedCondition(ctx context.Context, clientset kubernetes.Interface, a store.Attachment, attachErr error) error {
+	condition := corev1.PodCondition{
+		Type:               ipam.AliasAttachedCondition,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+		Reason:             "AliasAttached",
+		Message:            fmt.Sprintf("alias IP %s attached", ipam.HostPrefix(a.IP)),
+	}
+	if attachErr != nil {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "AttachFailed"
+		condition.Message = attachErr.Error()
+	}
+
+	// Conditions are merged by type, the others of the pod stay
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{"uid": a.PodUID},
+		"status":   map[string]any{"conditions": []corev1.PodCondition{condition}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().Pods(a.PodNamespace).Patch(ctx, a.PodName, k8stypes.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status")
+	if err != nil {
+		return fmt.Errorf("failed to patch status of pod %s/%s: %w", a.PodNamespace, a.PodName, err)
+	}
+	return nil
+}
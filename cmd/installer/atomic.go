@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// selinuxXattr holds the SELinux security context of a file
+const selinuxXattr = "security.selinux"
+
+// writeFileAtomic replaces path with data. The temporary file is created with
+// mode 0600 in the directory of path, so it is never readable by others while
+// incomplete and the rename cannot cross a filesystem. It gets the mode and
+// SELinux context of the file it replaces, or 0644 and the context of the
+// directory for new files, and is synced before the rename.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if err := copySecurityContext(tmpPath, path, dir); err != nil {
+		return err
+	}
+
+	return replaceFile(tmpPath, path, data)
+}
+
+// replaceFile renames tmpPath over path and syncs the directory. A path that
+// is a mount point of its own, e.g. a file bind mounted into the host root,
+// cannot be renamed over and is rewritten in place instead.
+func replaceFile(tmpPath, path string, data []byte) error {
+	err := os.Rename(tmpPath, path)
+	if errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EBUSY) {
+		return rewriteInPlace(path, data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func rewriteInPlace(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for rewrite: %w", path, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to rewrite %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// copySecurityContext gives path the SELinux context of the first reference
+// that has one, like chcon --reference. Files created from the installer
+// container are otherwise labelled for the container, and the container
+// runtime on enforcing nodes may not read them. Without SELinux there is
+// nothing to copy.
+func copySecurityContext(path string, references ...string) error {
+	for _, reference := range references {
+		label, err := getxattr(reference, selinuxXattr)
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		if errors.Is(err, unix.ENODATA) || errors.Is(err, unix.ENOENT) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read SELinux context of %s: %w", reference, err)
+		}
+
+		if err := unix.Lsetxattr(path, selinuxXattr, label, 0); err != nil {
+			return fmt.Errorf("failed to set SELinux context of %s: %w", path, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+func getxattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
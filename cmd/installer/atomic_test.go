@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		existing os.FileMode
+		wantMode os.FileMode
+	}{
+		{name: "new file", wantMode: 0o644},
+		{name: "keeps the mode of the replaced file", existing: 0o600, wantMode: 0o600},
+		{name: "keeps a wider mode", existing: 0o755, wantMode: 0o755},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")+".conflist")
+			if tt.existing != 0 {
+				if err := os.WriteFile(path, []byte("old"), tt.existing); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(path, tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := writeFileAtomic(path, []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "new" {
+				t.Errorf("content = %q, want %q", data, "new")
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != tt.wantMode {
+				t.Errorf("mode = %v, want %v", info.Mode().Perm(), tt.wantMode)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp-") {
+			t.Errorf("temporary file %s left behind", entry.Name())
+		}
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "file"), []byte("new")); err == nil {
+		t.Error("writeFileAtomic() into a missing directory succeeded")
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "10-gcp-cni.conflist")
+	tmpPath := filepath.Join(dir, ".10-gcp-cni.conflist.tmp-1")
+	for p, data := range map[string]string{path: "old", tmpPath: "new"} {
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := replaceFile(tmpPath, path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new" {
+		t.Errorf("content = %q, %v, want %q", data, err, "new")
+	}
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("temporary file kept after the rename: %v", err)
+	}
+}
+
+// A rename across filesystems fails with EXDEV like one over a bind mounted
+// file, so a temporary file on another filesystem exercises the rewrite in
+// place.
+func TestReplaceFileInPlace(t *testing.T) {
+	other, err := os.MkdirTemp("/dev/shm", "gcp-cni-test-")
+	if err != nil {
+		t.Skipf("no tmpfs to rename from: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(other) })
+
+	path := filepath.Join(t.TempDir(), "10-gcp-cni.conflist")
+	tmpPath := filepath.Join(other, ".10-gcp-cni.conflist.tmp-1")
+	if err := os.WriteFile(path, []byte("old content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmpPath, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpInfo, err := os.Stat(tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Sys().(*syscall.Stat_t).Dev == tmpInfo.Sys().(*syscall.Stat_t).Dev {
+		t.Skip("/dev/shm is on the filesystem of the test directory")
+	}
+
+	if err := replaceFile(tmpPath, path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new" {
+		t.Errorf("content = %q, %v, want %q truncated to the new data", data, err, "new")
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("file replaced, want it rewritten in place")
+	}
+}
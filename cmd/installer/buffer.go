@@ -0,0 +1,303 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// bufferIPs keeps IPs of every pool the node allocates from buffered for it,
+// its warm pool, every interval until ctx is done. ADDs take warm IPs before
+// allocating from the pool and fall back to them while the IPPool is
+// unavailable; the buffered IPs such ADDs took are handed over to their pods
+// once the pool is reachable. The size is the ipam.WarmIPsAnnotation of the
+// node set by the provisioner, or size without it. With attach the warm IPs
+// are attached to the instance ahead of the pods taking them.
+func bufferIPs(ctx context.Context, logger *slog.Logger, interval time.Duration, size int, attach bool) error {
+	clientset, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	allocator := ipam.NewAllocator(dynamicClient)
+
+	logger.Info("Buffering warm IPs",
+		slog.String("node", *nodeName),
+		slog.Int("size", size),
+		slog.Bool("attach", attach),
+		slog.Duration("interval", interval),
+	)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := bufferIPsOnce(ctx, logger, clientset, allocator, size, attach); err != nil {
+				logger.Error("Failed to buffer IPs", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func bufferIPsOnce(ctx context.Context, logger *slog.Logger, clientset kubernetes.Interface, allocator *ipam.Allocator, size int, attach bool) error {
+	size = warmPoolSize(ctx, logger, clientset, size)
+	cfg, err := config.Load(filepath.Join(*hostRoot, *pluginConfigPath))
+	if err != nil {
+		return err
+	}
+	attachments, reservations, err := bufferState()
+	if err != nil {
+		return err
+	}
+
+	pools := make(map[string]bool)
+	for _, a := range attachments {
+		if a.Pool == "" {
+			continue
+		}
+		pools[a.Pool] = true
+		if a.Buffered && a.IP != "" && (a.State == store.StateAllocated || a.State == store.StateAttached) {
+			claimBuffered(ctx, logger, allocator, a)
+		}
+	}
+	held := make(map[string][]store.Reservation)
+	for _, r := range reservations {
+		pools[r.Pool] = true
+		held[r.Pool] = append(held[r.Pool], r)
+	}
+
+	var dropped, extra []store.Reservation
+	for pool := range pools {
+		d, e, err := bufferPool(ctx, logger, allocator, pool, size, held[pool], cfg.SecondaryRangeName)
+		if err != nil {
+			logger.Error("Failed to buffer IPs of pool", slog.String("pool", pool), slog.String("error", err.Error()))
+		}
+		dropped, extra = append(dropped, d...), append(extra, e...)
+	}
+
+	// Aliases go before the IPs return to the pool, which may hand them to another node right away
+	if attach && len(dropped) > 0 {
+		if err := detachWarmAliases(ctx, logger, dropped); err != nil {
+			// Buffered again, the next pass retries
+			if _, addErr := addReservations(dropped); addErr != nil {
+				logger.Error("Failed to buffer IPs left attached again", slog.String("error", addErr.Error()))
+			}
+			return fmt.Errorf("failed to detach warm IPs: %w", err)
+		}
+	}
+	for _, r := range extra {
+		if err := allocator.ReleaseBuffered(ctx, r.Pool, r.IP, *nodeName); err != nil {
+			logger.Error("Failed to return buffered IP to the pool", slog.String("pool", r.Pool), slog.String("ip", r.IP), slog.String("error", err.Error()))
+			continue
+		}
+		logger.Info("Returned buffered IP to the pool", slog.String("pool", r.Pool), slog.String("ip", r.IP))
+	}
+
+	if attach {
+		if _, reservations, err = bufferState(); err != nil {
+			return err
+		}
+		if err := attachWarmAliases(ctx, logger, reservations); err != nil {
+			return fmt.Errorf("failed to attach warm IPs: %w", err)
+		}
+	}
+	return nil
+}
+
+// warmPoolSize returns the warm pool size the provisioner set on the node,
+// fallback when it set none
+func warmPoolSize(ctx context.Context, logger *slog.Logger, clientset kubernetes.Interface, fallback int) int {
+	node, err := clientset.CoreV1().Nodes().Get(ctx, *nodeName, metav1.GetOptions{})
+	if err != nil {
+		logger.Error("Failed to get node, using the default warm pool size", slog.String("error", err.Error()))
+		return fallback
+	}
+	value, ok := node.Annotations[ipam.WarmIPsAnnotation]
+	if !ok {
+		return fallback
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		logger.Error("Invalid warm pool size on node, using the default", slog.String("annotation", ipam.WarmIPsAnnotation), slog.String("value", value))
+		return fallback
+	}
+	return size
+}
+
+// claimBuffered hands the buffered IP an ADD took over to its pod
+func claimBuffered(ctx context.Context, logger *slog.Logger, allocator *ipam.Allocator, a store.Attachment) {
+	attrs := []any{
+		slog.String("container", a.ContainerID),
+		slog.String("ip", a.IP),
+		slog.String("pool", a.Pool),
+		slog.String("pod", a.PodNamespace+"/"+a.PodName),
+	}
+
+	req := &ipam.AllocationRequest{
+		PoolName:     a.Pool,
+		PodName:      a.PodName,
+		PodNamespace: a.PodNamespace,
+		PodUID:       a.PodUID,
+		NodeName:     *nodeName,
+		Protected:    a.Protected,
+	}
+	claimed, err := allocator.ClaimBuffered(ctx, a.Pool, a.IP, req)
+	if err != nil {
+		logger.Error("Failed to hand buffered IP over to its pod", append(attrs, slog.String("error", err.Error()))...)
+		return
+	}
+	if !claimed {
+		// The pool no longer buffers the IP for the node, e.g. its lease
+		// expired. The pod keeps using it, so it is recorded for the pod as
+		// long as it is free; the attachment stays buffered until then and
+		// the next pass retries.
+		req.RequestedIP = a.IP
+		if _, err := allocator.Allocate(ctx, req); err != nil {
+			logger.Error("Buffered IP of the pod is no longer buffered for the node and cannot be allocated to it", append(attrs, slog.String("error", err.Error()))...)
+			return
+		}
+	}
+	if err := updateAttachment(a, func(a *store.Attachment) { a.Buffered = false }); err != nil {
+		logger.Error("Failed to record buffered IP handover", append(attrs, slog.String("error", err.Error()))...)
+		return
+	}
+	logger.Info("Handed buffered IP over to its pod", attrs...)
+}
+
+// bufferPool brings the IPs of the pool buffered for the node to size. It
+// returns the reservations dropped from the node-local buffer, whose aliases
+// have to go, and among them the extra ones to return to the pool. Only
+// reservations no ADD took in the meantime are dropped. IPs of a pool naming
+// no secondary range are reserved with defaultRange of the plugin configuration.
+func bufferPool(ctx context.Context, logger *slog.Logger, allocator *ipam.Allocator, pool string, size int, held []store.Reservation, defaultRange string) ([]store.Reservation, []store.Reservation, error) {
+	var dropped, extra []store.Reservation
+	drop := func(r store.Reservation) (bool, error) {
+		removed, err := removeReservation(r.Pool, r.IP)
+		if removed {
+			dropped = append(dropped, r)
+		}
+		return removed, err
+	}
+
+	buffered, err := allocator.ReserveBuffer(ctx, pool, *nodeName, size)
+	if apierrors.IsNotFound(err) {
+		for _, r := range held {
+			if _, err := drop(r); err != nil {
+				return dropped, extra, err
+			}
+		}
+		return dropped, extra, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reservations := make([]store.Reservation, 0, len(buffered))
+	for _, result := range buffered {
+		reservations = append(reservations, store.Reservation{
+			IP:             result.IP,
+			Pool:           pool,
+			CIDR:           result.CIDR,
+			SecondaryRange: cmp.Or(result.SecondaryRangeName, defaultRange),
+			ReservedAt:     time.Now(),
+		})
+	}
+	keep := reservations[:min(size, len(reservations))]
+	for _, r := range reservations[len(keep):] {
+		removed, err := drop(r)
+		if err != nil {
+			return dropped, extra, err
+		}
+		if removed {
+			extra = append(extra, r)
+		}
+	}
+
+	// Reservations the pool no longer buffers for the node, e.g. expired leases
+	wanted := make(map[string]bool)
+	for _, r := range keep {
+		wanted[r.IP] = true
+	}
+	for _, r := range held {
+		if !wanted[r.IP] {
+			if _, err := drop(r); err != nil {
+				return dropped, extra, err
+			}
+		}
+	}
+
+	added, err := addReservations(keep)
+	if err != nil {
+		return dropped, extra, err
+	}
+	if added > 0 {
+		logger.Info("Buffered IPs for the node", slog.String("pool", pool), slog.Int("added", added), slog.Int("size", size))
+	}
+	return dropped, extra, nil
+}
+
+// bufferState returns the attachments and reservations of the node. The
+// database is opened only for the read since the plugin shares its lock.
+func bufferState() ([]store.Attachment, []store.Reservation, error) {
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.Close()
+
+	attachments, err := s.List()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list attachments: %w", err)
+	}
+	reservations, err := s.Reservations()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list reservations: %w", err)
+	}
+	return attachments, reservations, nil
+}
+
+func updateAttachment(a store.Attachment, fn func(a *store.Attachment)) error {
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Update(a.ContainerID, a.IfName, fn)
+}
+
+func removeReservation(pool, ip string) (bool, error) {
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+	return s.RemoveReservation(pool, ip)
+}
+
+func addReservations(reservations []store.Reservation) (int, error) {
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	return s.AddReservations(reservations)
+}
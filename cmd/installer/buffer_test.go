@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestClaimBuffered(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	const ip = "10.8.0.5"
+
+	tests := []struct {
+		name         string
+		allocation   *v1alpha1.IPAllocation
+		wantBuffered bool
+		wantPod      string
+	}{
+		{
+			name:       "buffered for the node",
+			allocation: &v1alpha1.IPAllocation{NodeName: "node-1", Buffered: true},
+			wantPod:    "pod-uid",
+		},
+		{
+			name:    "no longer buffered but free",
+			wantPod: "pod-uid",
+		},
+		{
+			name:         "allocated to another pod",
+			allocation:   &v1alpha1.IPAllocation{PodUID: "other-uid", NodeName: "node-2"},
+			wantBuffered: true,
+			wantPod:      "other-uid",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*hostRoot, *nodeName = t.TempDir(), "node-1"
+
+			pool := &v1alpha1.IPPool{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+				ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+				Spec:       v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/24", Allocations: map[string]v1alpha1.IPAllocation{}},
+			}
+			if tt.allocation != nil {
+				pool.Spec.Allocations[ip] = *tt.allocation
+			}
+			obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allocator := ipam.NewAllocator(dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{ipam.IPPoolGVR: "IPPoolList"},
+				&unstructured.Unstructured{Object: obj}))
+
+			s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Update("container", "eth0", func(a *store.Attachment) {
+				a.IP, a.Pool, a.State, a.Buffered = ip, "pool", store.StateAttached, true
+				a.PodNamespace, a.PodName, a.PodUID = "default", "pod", "pod-uid"
+			})
+			s.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			attachments, _, err := bufferState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			claimBuffered(ctx, logger, allocator, attachments[0])
+
+			if attachments, _, err = bufferState(); err != nil {
+				t.Fatal(err)
+			}
+			if attachments[0].Buffered != tt.wantBuffered {
+				t.Errorf("attachment buffered = %v, want %v", attachments[0].Buffered, tt.wantBuffered)
+			}
+			allocation, ok, err := allocator.AllocationOf(ctx, "pool", ip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok || allocation.PodUID != tt.wantPod || allocation.Buffered {
+				t.Errorf("allocation = %+v, %v, want held by %s", allocation, ok, tt.wantPod)
+			}
+		})
+	}
+}
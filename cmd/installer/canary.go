@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+const (
+	// canaryPreviousPath is where a canary node records the release it rolls
+	// back to
+	canaryPreviousPath = "/var/lib/gcp-cni/canary-previous"
+	// canaryRolledBackAnnotation records the release rolled back on a node,
+	// which is not activated there again until the annotation is removed
+	canaryRolledBackAnnotation = "gcp-cni.cast.ai/canary-rolled-back"
+	// canaryWindow is how far back the ADDs of the canary release are checked
+	canaryWindow = 10 * time.Minute
+	// canaryMinOperations keeps a single failed pod on a quiet node from
+	// rolling it back
+	canaryMinOperations = 5
+)
+
+// activeVersion is the gcp-ipam release the node runs when canary mode held
+// the installer's own release back or rolled it back
+var activeVersion atomic.Value
+
+// activatedAt is when the installer's own release was activated on a canary node
+var activatedAt atomic.Value
+
+// runningVersion returns the gcp-ipam release the conflist is switched to
+func runningVersion() string {
+	if v, ok := activeVersion.Load().(string); ok {
+		return v
+	}
+	return version
+}
+
+// errHeldBack is returned by canaryNode for nodes the release is not
+// activated on
+var errHeldBack = errors.New("release held back")
+
+// canaryNode checks whether this release is activated on the node: it needs
+// to carry the canary label and must not have rolled this release back
+func canaryNode(ctx context.Context) error {
+	key, value, hasValue := strings.Cut(*canaryLabel, "=")
+	clientset, _, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	node, err := clientset.CoreV1().Nodes().Get(ctx, *nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", *nodeName, err)
+	}
+
+	label, ok := node.Labels[key]
+	if !ok || (hasValue && label != value) {
+		return fmt.Errorf("%w, node has no %s label", errHeldBack, *canaryLabel)
+	}
+	if node.Annotations[canaryRolledBackAnnotation] == version {
+		return fmt.Errorf("%w, it was rolled back on the node", errHeldBack)
+	}
+	return nil
+}
+
+// previousVersion returns the release the node ran before this one: the one
+// the binary link points at, or the one recorded when the link was switched
+// to this release. It is empty on nodes that never ran another release.
+func previousVersion() string {
+	if target, err := os.Readlink(filepath.Join(*hostRoot, *cniBinDir, "gcp-ipam")); err == nil {
+		if v, ok := strings.CutPrefix(target, "gcp-ipam-"); ok && v != version {
+			return v
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(*hostRoot, canaryPreviousPath))
+	if err != nil {
+		return ""
+	}
+	if v := string(bytes.TrimSpace(data)); v != version {
+		return v
+	}
+	return ""
+}
+
+// activatePrevious switches the node to release, which has to be installed
+// already. The binary of this release is kept for a later activation.
+func activatePrevious(logger *slog.Logger, release string) error {
+	destDir := filepath.Join(*hostRoot, *cniBinDir)
+	for _, binaryName := range *binaries {
+		versionedName := versionedBinaryName(binaryName, release)
+		if _, err := os.Stat(filepath.Join(destDir, versionedName)); err != nil {
+			return fmt.Errorf("failed to find %s: %w", versionedName, err)
+		}
+		if err := switchBinaryLink(logger, destDir, binaryName, versionedName, true); err != nil {
+			return err
+		}
+	}
+	if err := reconfigureCNIIPAMConf(logger, "gcp-ipam", release); err != nil {
+		return fmt.Errorf("failed to reconfigure CNI: %w", err)
+	}
+	if err := verifyInstalledVersion(logger, "gcp-ipam", release); err != nil {
+		return fmt.Errorf("installed version handshake failed: %w", err)
+	}
+	activeVersion.Store(release)
+	reportOnboarding(logger, func(status *v1alpha1.NodeOnboardingStatus) {
+		status.InstalledVersion = release
+	})
+	return nil
+}
+
+// holdBack keeps the node on the release it runs, or on host-local on nodes
+// that never ran gcp-ipam
+func holdBack(logger *slog.Logger, reason error) error {
+	previous := previousVersion()
+	if previous == "" {
+		logger.Info("Not activating gcp-ipam, no earlier release to keep running", slog.String("reason", reason.Error()))
+		return nil
+	}
+	logger.Info("Keeping the node on an earlier gcp-ipam release",
+		slog.String("release", previous),
+		slog.String("reason", reason.Error()),
+	)
+	if err := activatePrevious(logger, previous); err != nil {
+		return err
+	}
+	installed.Store(true)
+	return nil
+}
+
+// runCanaryInstallation activates this release on a canary node and rolls
+// back to the previous release when the activation fails
+func runCanaryInstallation(logger *slog.Logger) error {
+	ctx := context.Background()
+	if err := canaryNode(ctx); errors.Is(err, errHeldBack) {
+		return holdBack(logger, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to check canary node: %w", err)
+	}
+
+	previous := previousVersion()
+	if previous != "" {
+		if err := writeFileAtomic(filepath.Join(*hostRoot, canaryPreviousPath), []byte(previous+"\n")); err != nil {
+			return fmt.Errorf("failed to record previous release: %w", err)
+		}
+	}
+
+	err := activateRelease(logger)
+	if err == nil {
+		activeVersion.Store(version)
+		activatedAt.Store(time.Now())
+		return nil
+	}
+	if previous == "" {
+		return err
+	}
+	if rerr := rollBack(ctx, logger, previous, err.Error()); rerr != nil {
+		return fmt.Errorf("failed to roll back to %s after %v: %w", previous, err, rerr)
+	}
+	return fmt.Errorf("rolled back to %s: %w", previous, err)
+}
+
+// rollBack switches the node back to the previous release and records the
+// rollback on the node, so the release is not activated there again
+func rollBack(ctx context.Context, logger *slog.Logger, previous, reason string) error {
+	logger.Error("Canary release failed, rolling back",
+		slog.String("release", version),
+		slog.String("previous", previous),
+		slog.String("reason", reason),
+	)
+	if err := activatePrevious(logger, previous); err != nil {
+		return err
+	}
+	installed.Store(true)
+
+	clientset, _, err := buildKubeClients()
+	if err != nil {
+		logger.Warn("No Kubernetes client, the rollback is not recorded on the node", slog.String("error", err.Error()))
+		return nil
+	}
+	patch, _ := json.Marshal(map[string]any{
+		"metadata": map[string]any{"annotations": map[string]string{canaryRolledBackAnnotation: version}},
+	})
+	if _, err := clientset.CoreV1().Nodes().Patch(ctx, *nodeName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		logger.Error("Failed to record the rollback on the node", slog.String("error", err.Error()))
+	}
+	if err := emitNodeEvent(ctx, clientset, corev1.EventTypeWarning, "CanaryRolledBack",
+		fmt.Sprintf("gcp-ipam %s rolled back to %s: %s", version, previous, reason)); err != nil {
+		logger.Error("Failed to emit node event", slog.String("reason", "CanaryRolledBack"), slog.String("error", err.Error()))
+	}
+	return nil
+}
+
+// forgetPrevious removes the release a canary node kept to roll back to once
+// the release is activated outside of canary mode
+func forgetPrevious(logger *slog.Logger) {
+	path := filepath.Join(*hostRoot, canaryPreviousPath)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if previous := string(bytes.TrimSpace(data)); previous != "" && previous != version {
+		for _, binaryName := range *binaries {
+			versionedName := versionedBinaryName(binaryName, previous)
+			if err := os.Remove(filepath.Join(*hostRoot, *cniBinDir, versionedName)); err != nil && !os.IsNotExist(err) {
+				logger.Warn("Failed to remove previous binary", slog.String("binary", versionedName), slog.String("error", err.Error()))
+			}
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		logger.Warn("Failed to remove previous release record", slog.String("error", err.Error()))
+	}
+}
+
+// watchCanary checks the ADDs of this release every interval until ctx is
+// done while it is activated on a canary node, and rolls the node back when
+// more than --canary-max-add-error-ratio of them failed
+func watchCanary(ctx context.Context, logger *slog.Logger, interval time.Duration) {
+	logger.Info("Checking canary release",
+		slog.String("label", *canaryLabel),
+		slog.Duration("interval", interval),
+		slog.Float64("max_error_ratio", *canaryMaxErrors),
+	)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				since, ok := activatedAt.Load().(time.Time)
+				if !ok || runningVersion() != version {
+					continue
+				}
+				failed, total, err := canaryAdds(since, now)
+				if err != nil {
+					logger.Error("Failed to check canary release", slog.String("error", err.Error()))
+					continue
+				}
+				if total < canaryMinOperations || float64(failed)/float64(total) <= *canaryMaxErrors {
+					continue
+				}
+				previous := previousVersion()
+				if previous == "" {
+					logger.Warn("Canary release fails ADDs, no earlier release to roll back to",
+						slog.Int("failed", failed), slog.Int("total", total))
+					continue
+				}
+
+				installMu.Lock()
+				err = rollBack(ctx, logger, previous, fmt.Sprintf("%d of %d ADDs failed", failed, total))
+				installMu.Unlock()
+				if err != nil {
+					logger.Error("Failed to roll back canary release", slog.String("error", err.Error()))
+				}
+			}
+		}
+	}()
+}
+
+// canaryAdds counts the ADDs of this release started in the canary window
+// before now, and after since. ADDs that failed for lack of IPs or GCE quota
+// are left out, they say nothing about the release.
+func canaryAdds(since, now time.Time) (failed, total int, err error) {
+	records, err := telemetry.List(filepath.Join(*hostRoot, telemetry.DefaultDir), 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	cutoff := now.Add(-canaryWindow)
+	if since.After(cutoff) {
+		cutoff = since
+	}
+	for _, r := range records {
+		if r.Operation != "ADD" || r.PluginVersion != version || r.Start.Before(cutoff) {
+			continue
+		}
+		if r.Cause != "" {
+			// Out of IPs or GCE quota, the previous release would have failed the same
+			continue
+		}
+		total++
+		if r.Error != "" {
+			failed++
+		}
+	}
+	return failed, total, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/castai/gcp-cni/internal/telemetry"
+)
+
+func TestCanaryAdds(t *testing.T) {
+	*hostRoot = t.TempDir()
+	dir := filepath.Join(*hostRoot, telemetry.DefaultDir)
+	now := time.Now()
+	since := now.Add(-time.Hour)
+
+	records := []struct {
+		operation string
+		version   string
+		age       time.Duration
+		err       error
+		cause     string
+	}{
+		{operation: "ADD", version: version, age: time.Minute},
+		{operation: "ADD", version: version, age: 2 * time.Minute, err: errors.New("failed to attach alias IP")},
+		{operation: "ADD", version: version, age: 3 * time.Minute, err: errors.New("no available IPs"), cause: telemetry.CauseCapacity},
+		{operation: "ADD", version: version, age: 4 * time.Minute, err: errors.New("GCE quota exceeded"), cause: telemetry.CauseQuota},
+		{operation: "DEL", version: version, age: 5 * time.Minute, err: errors.New("failed to release IP")},
+		{operation: "ADD", version: "previous", age: 6 * time.Minute, err: errors.New("failed to attach alias IP")},
+		{operation: "ADD", version: version, age: canaryWindow + time.Minute, err: errors.New("failed to attach alias IP")},
+	}
+	for i, r := range records {
+		record := telemetry.NewRecord(r.operation, fmt.Sprintf("container-%d", i), "eth0")
+		record.PluginVersion = r.version
+		record.Start = now.Add(-r.age)
+		record.Finish(r.err)
+		record.Cause = r.cause
+		if err := record.Write(dir, telemetry.DefaultMaxRecords); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failed, total, err := canaryAdds(since, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Out of IPs and quota failures are no fault of the release
+	if failed != 1 || total != 2 {
+		t.Errorf("canaryAdds() = %d of %d failed, want 1 of 2", failed, total)
+	}
+
+	// ADDs before the release was activated do not count
+	if failed, total, err = canaryAdds(now.Add(-90*time.Second), now); err != nil || failed != 0 || total != 1 {
+		t.Errorf("canaryAdds() since activation = %d of %d failed, %v, want 0 of 1", failed, total, err)
+	}
+}
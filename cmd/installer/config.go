@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/validation"
+)
+
+// watchPluginConfig renders the plugin config ConfigMap to the host whenever
+// it changes, until ctx is done. The plugin reads the rendered file on every
+// invocation, so no restarts are needed for changes to apply.
+func watchPluginConfig(ctx context.Context, logger *slog.Logger) error {
+	clientset, _, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(*configMapNamespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", *configMapName).String()
+		}),
+	)
+
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	_, err = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			renderPluginConfig(logger, obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			renderPluginConfig(logger, obj.(*corev1.ConfigMap))
+		},
+		DeleteFunc: func(_ interface{}) {
+			removePluginConfig(logger)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register config map handler: %w", err)
+	}
+
+	logger.Info("Watching plugin configuration",
+		slog.String("namespace", *configMapNamespace),
+		slog.String("name", *configMapName),
+	)
+
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	return nil
+}
+
+func renderPluginConfig(logger *slog.Logger, cm *corev1.ConfigMap) {
+	path := filepath.Join(*hostRoot, *pluginConfigPath)
+
+	// Keep the previously rendered file when the new config is broken
+	cfg, err := config.Parse([]byte(cm.Data[config.ConfigMapKey]))
+	if err != nil {
+		logger.Error("Invalid plugin configuration, keeping previous config",
+			slog.String("config_map", cm.Name),
+			slog.String("resource_version", cm.ResourceVersion),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	validatePluginConfig(logger, cfg)
+
+	data, err := cfg.Render()
+	if err != nil {
+		logger.Error("Failed to render plugin configuration", slog.String("error", err.Error()))
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		logger.Error("Failed to create plugin configuration directory", slog.String("error", err.Error()))
+		return
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		logger.Error("Failed to write plugin configuration", slog.String("error", err.Error()))
+		return
+	}
+
+	logger.Info("Plugin configuration rendered",
+		slog.String("path", path),
+		slog.String("resource_version", cm.ResourceVersion),
+	)
+	if installed.Load() {
+		annotateVersions(logger)
+	}
+}
+
+// validatePluginConfig logs the inconsistencies between cfg and the conflist
+// of the node. They are not fatal, the plugin may still serve most pods.
+func validatePluginConfig(logger *slog.Logger, cfg *config.Config) {
+	stack := validation.Stack{PluginConfig: cfg, PluginConfigPath: *pluginConfigPath}
+	if data, err := os.ReadFile(filepath.Join(*hostRoot, *cniConfDir, *cniConfName)); err == nil {
+		stack.ConfList = data
+	}
+	for _, f := range validation.Validate(stack) {
+		logger.Warn("Inconsistent plugin configuration",
+			slog.String("severity", f.Severity),
+			slog.String("source", f.Source),
+			slog.String("finding", f.Message),
+		)
+	}
+}
+
+func removePluginConfig(logger *slog.Logger) {
+	path := filepath.Join(*hostRoot, *pluginConfigPath)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Error("Failed to remove plugin configuration", slog.String("error", err.Error()))
+		return
+	}
+	logger.Info("Plugin configuration removed, plugin falls back to defaults", slog.String("path", path))
+}
+
+// buildKubeClients creates in-cluster clients for the installer's own Kubernetes API calls
+func buildKubeClients() (*kubernetes.Clientset, dynamic.Interface, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get in-cluster config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+	return clientset, dynamicClient, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/installer"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// programEgress keeps the egress SNAT rules of this node in sync with the
+// egress IPs the provisioner attached to it, every interval until ctx is done.
+// Pods of an egress namespace running on its gateway node leave the cluster
+// with the namespace's egress IP.
+func programEgress(ctx context.Context, logger *slog.Logger, interval time.Duration) error {
+	clientset, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	allocator := ipam.NewAllocator(dynamicClient)
+
+	logger.Info("Programming egress SNAT rules",
+		slog.String("node", *nodeName),
+		slog.Duration("interval", interval),
+	)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := programEgressOnce(ctx, logger, clientset, allocator); err != nil {
+				logger.Error("Failed to program egress SNAT rules", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func programEgressOnce(ctx context.Context, logger *slog.Logger, clientset kubernetes.Interface, allocator *ipam.Allocator) error {
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Egress IPs attached to this node, by namespace
+	egressIPs := make(map[string]string)
+	for _, pool := range pools {
+		if pool.Spec.Class != v1alpha1.PoolClassEgress {
+			continue
+		}
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.NodeName == *nodeName {
+				egressIPs[allocation.EgressNamespace] = ip
+			}
+		}
+	}
+
+	var rules []installer.EgressRule
+	if len(egressIPs) > 0 {
+		pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("spec.nodeName", *nodeName).String(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list pods on node %s: %w", *nodeName, err)
+		}
+
+		for _, pod := range pods.Items {
+			egressIP, ok := egressIPs[pod.Namespace]
+			if !ok || pod.Spec.HostNetwork || pod.Status.PodIP == "" || pod.Status.Phase != corev1.PodRunning {
+				continue
+			}
+			rules = append(rules, installer.EgressRule{PodIP: pod.Status.PodIP, EgressIP: egressIP})
+		}
+	}
+
+	if err := applyEgressRules(ctx, rules); err != nil {
+		return err
+	}
+	logger.Debug("Egress SNAT rules programmed", slog.Int("rules", len(rules)))
+	return nil
+}
+
+// applyEgressRules atomically replaces the egress chain on the host and makes
+// sure POSTROUTING jumps to it ahead of the node's masquerading rules
+func applyEgressRules(ctx context.Context, rules []installer.EgressRule) error {
+	restore := hostCommand(ctx, "iptables-restore", "--noflush")
+	restore.Stdin = bytes.NewReader(installer.RenderEgressRules(rules, *egressExcludedCIDRs))
+	if output, err := restore.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restore egress rules: %w: %s", err, output)
+	}
+
+	check := hostCommand(ctx, "iptables", "-t", "nat", "-C", "POSTROUTING", "-j", installer.EgressChain)
+	if err := check.Run(); err == nil {
+		return nil
+	}
+
+	insert := hostCommand(ctx, "iptables", "-t", "nat", "-I", "POSTROUTING", "1", "-j", installer.EgressChain)
+	if output, err := insert.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to insert egress chain jump: %w: %s", err, output)
+	}
+	return nil
+}
+
+// hostCommand runs a binary of the host, chrooted into the host root
+func hostCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: *hostRoot}
+	cmd.Dir = "/"
+	return cmd
+}
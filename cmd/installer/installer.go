@@ -1,25 +1,60 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+const selfTestTimeout = time.Minute
+
+// installHostBinaries installs every binary in the list, stopping at the first failure.
+func installHostBinaries(logger *slog.Logger, binaryNames []string) error {
+	for _, binaryName := range binaryNames {
+		if err := installHostBinary(logger, binaryName); err != nil {
+			return fmt.Errorf("failed to install %s binary: %w", binaryName, err)
+		}
+	}
+	return nil
+}
+
 func installHostBinary(logger *slog.Logger, binaryName string) error {
-	srcPath := filepath.Join("/app", binaryName)
+	srcPath, err := sourceBinaryPath(binaryName, *arch)
+	if err != nil {
+		return err
+	}
 	destDir := filepath.Join(*hostRoot, *cniBinDir)
-	destPath := filepath.Join(destDir, binaryName)
+	versionedName := versionedBinaryName(binaryName, version)
+	destPath := filepath.Join(destDir, versionedName)
 
-	if filesMatch(srcPath, destPath) {
-		logger.Debug("Binary already up to date", slog.String("binary", binaryName))
-		return nil
+	srcHash, err := fileSHA256(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to hash source file %s: %w", srcPath, err)
+	}
+
+	if err := verifyExpectedHash(srcPath, srcHash); err != nil {
+		return err
+	}
+	if err := verifyEmbeddedHash(binaryName, srcHash); err != nil {
+		return err
+	}
+
+	if destHash, err := fileSHA256(destPath); err == nil && destHash == srcHash {
+		logger.Debug("Binary already up to date", slog.String("binary", versionedName), slog.String("sha256", srcHash))
+		return switchBinaryLink(logger, destDir, binaryName, versionedName, *canaryLabel != "")
 	}
 
 	logger.Info("Installing CNI binary",
 		slog.String("binary", binaryName),
+		slog.String("arch", *arch),
 		slog.String("source", srcPath),
 		slog.String("destination", destPath),
 	)
@@ -39,20 +74,137 @@ func installHostBinary(logger *slog.Logger, binaryName string) error {
 		return fmt.Errorf("failed to copy file: %w", err)
 	}
 
+	tmpHash, err := fileSHA256(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to hash copied file: %w", err)
+	}
+	if tmpHash != srcHash {
+		os.Remove(tmpPath)
+		return fmt.Errorf("copied binary hash mismatch: got %s, want %s", tmpHash, srcHash)
+	}
+
 	if err := os.Chmod(tmpPath, 0o755); err != nil {
+		os.Remove(tmpPath)
 		return fmt.Errorf("failed to set permissions: %w", err)
 	}
+	if err := copySecurityContext(tmpPath, destPath, destDir); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
 
 	if err := os.Rename(tmpPath, destPath); err != nil {
+		os.Remove(tmpPath)
 		return fmt.Errorf("failed to rename file: %w", err)
 	}
+	if err := syncDir(destDir); err != nil {
+		return err
+	}
+
+	logger.Info("Binary installed successfully", slog.String("binary", versionedName), slog.String("sha256", srcHash))
+	return switchBinaryLink(logger, destDir, binaryName, versionedName, *canaryLabel != "")
+}
+
+func versionedBinaryName(binaryName, version string) string {
+	return fmt.Sprintf("%s-%s", binaryName, version)
+}
+
+// switchBinaryLink atomically points the unversioned binary name at the given
+// versioned binary and removes the binary it previously pointed at, unless
+// keepPrevious is set for a canary node that may have to roll back to it.
+func switchBinaryLink(logger *slog.Logger, destDir, binaryName, versionedName string, keepPrevious bool) error {
+	linkPath := filepath.Join(destDir, binaryName)
+
+	previous, err := os.Readlink(linkPath)
+	if err == nil && previous == versionedName {
+		return nil
+	}
+
+	tmpLink := linkPath + ".tmp"
+	if err := os.Remove(tmpLink); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale link %s: %w", tmpLink, err)
+	}
+	if err := os.Symlink(versionedName, tmpLink); err != nil {
+		return fmt.Errorf("failed to create link %s: %w", tmpLink, err)
+	}
+	if err := os.Rename(tmpLink, linkPath); err != nil {
+		return fmt.Errorf("failed to switch link %s: %w", linkPath, err)
+	}
+
+	logger.Info("Switched binary link",
+		slog.String("link", linkPath),
+		slog.String("target", versionedName),
+		slog.String("previous", previous),
+	)
 
-	logger.Info("Binary installed successfully", slog.String("binary", binaryName))
+	// Running plugin processes keep their image, so the old binary can go right away
+	if previous != "" && filepath.Base(previous) == previous && !keepPrevious {
+		if err := os.Remove(filepath.Join(destDir, previous)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Failed to remove previous binary", slog.String("binary", previous), slog.String("error", err.Error()))
+		}
+	}
 	return nil
 }
 
+// sourceBinaryPath looks the binary up under /app/<arch>/ first and falls back
+// to the flat /app/ layout used by single-architecture images.
+func sourceBinaryPath(binaryName, arch string) (string, error) {
+	candidates := []string{
+		filepath.Join(*appDir, arch, binaryName),
+		filepath.Join(*appDir, binaryName),
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("binary %s for architecture %s not found in %s", binaryName, arch, *appDir)
+}
+
+// verifyExpectedHash checks the binary against the <binary>.sha256 file shipped
+// next to it. Binaries without a checksum file are accepted as-is.
+func verifyExpectedHash(path, actual string) error {
+	data, err := os.ReadFile(path + ".sha256")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read checksum for %s: %w", path, err)
+	}
+
+	// Accept both a bare digest and sha256sum output ("<digest>  <file>")
+	fields := strings.Fields(string(bytes.TrimSpace(data)))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty checksum file for %s", path)
+	}
+	if !strings.EqualFold(fields[0], actual) {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", path, actual, fields[0])
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFile writes source to targetPath with mode 0600 and syncs it, the caller
+// sets the final mode once the copy is verified
 func copyFile(source io.Reader, targetPath string) error {
-	outFile, err := os.Create(targetPath)
+	// A leftover from an interrupted copy would keep its mode
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale file: %w", err)
+	}
+	outFile, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
@@ -72,19 +224,26 @@ func copyFile(source io.Reader, targetPath string) error {
 		return fmt.Errorf("reached uncompressed file size limit %d bytes", maxCopyBytes)
 	}
 
-	return nil
+	if err := outFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	return outFile.Close()
 }
 
-func filesMatch(src, dest string) bool {
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return false
+// runPluginSelfTest runs "<binary> self-test" chrooted into the host root, so
+// the plugin sees the same kubeconfig, credentials and paths as when kubelet's
+// container runtime executes it.
+func runPluginSelfTest(logger *slog.Logger, binaryName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	cmd := hostCommand(ctx, filepath.Join(*cniBinDir, binaryName), "self-test")
+	output, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		logger.Info("Plugin self-test", slog.String("binary", binaryName), slog.String("result", line))
 	}
-
-	destInfo, err := os.Stat(dest)
 	if err != nil {
-		return false
+		return fmt.Errorf("%s self-test failed: %w", binaryName, err)
 	}
-
-	return srcInfo.Size() == destInfo.Size() && srcInfo.ModTime().Equal(destInfo.ModTime())
+	return nil
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// pluginSHA256 is the SHA-256 of the gcp-ipam binary built together with the
+// installer, set at build time via ldflags. It is only checked for the
+// architecture the installer itself was built for.
+var pluginSHA256 = ""
+
+// integrityFailures counts the installed binaries found modified or missing
+// by binary name
+var integrityFailures = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: map[string]int{}}
+
+// verifyEmbeddedHash checks gcp-ipam against the hash the installer was built
+// with, which unlike the .sha256 file can't be swapped next to the binary
+func verifyEmbeddedHash(binaryName, actual string) error {
+	if binaryName != "gcp-ipam" || pluginSHA256 == "" || *arch != runtime.GOARCH {
+		return nil
+	}
+	if !strings.EqualFold(pluginSHA256, actual) {
+		return fmt.Errorf("%s does not match the build of this installer: got %s, want %s", binaryName, actual, pluginSHA256)
+	}
+	return nil
+}
+
+// checkBinaryIntegrity hashes the installed binaries every interval until ctx
+// is done and compares them with the verified binaries in the image. A binary
+// that was truncated, tampered with or removed is reported with a warning
+// node event and installed again.
+func checkBinaryIntegrity(ctx context.Context, logger *slog.Logger, interval time.Duration) {
+	clientset, _, err := buildKubeClients()
+	if err != nil {
+		logger.Warn("No Kubernetes client, binary integrity failures are only logged", slog.String("error", err.Error()))
+	}
+	emit := func(eventType, reason, message string) {
+		if clientset == nil || *nodeName == "" {
+			return
+		}
+		if err := emitNodeEvent(ctx, clientset, eventType, reason, message); err != nil {
+			logger.Error("Failed to emit node event", slog.String("reason", reason), slog.String("error", err.Error()))
+		}
+	}
+
+	logger.Info("Checking integrity of installed binaries", slog.Duration("interval", interval))
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// A release kept by canary mode is not in the image to compare with
+			if !installed.Load() || runningVersion() != version {
+				continue
+			}
+			checkInstalledBinaries(logger, emit)
+		}
+	}()
+}
+
+// checkInstalledBinaries verifies every installed binary and installs the
+// ones that do not match the image again, reporting each through emit
+func checkInstalledBinaries(logger *slog.Logger, emit func(eventType, reason, message string)) {
+	for _, binaryName := range *binaries {
+		mismatch, err := verifyInstalledBinary(binaryName)
+		if err != nil {
+			logger.Error("Failed to check binary integrity", slog.String("binary", binaryName), slog.String("error", err.Error()))
+			continue
+		}
+		if mismatch == "" {
+			continue
+		}
+
+		integrityFailures.Lock()
+		integrityFailures.counts[binaryName]++
+		integrityFailures.Unlock()
+
+		logger.Error("Installed binary failed integrity check, reinstalling",
+			slog.String("binary", binaryName),
+			slog.String("reason", mismatch),
+		)
+		emit(corev1.EventTypeWarning, "PluginBinaryIntegrityViolated",
+			fmt.Sprintf("Installed %s binary %s, reinstalling it", binaryName, mismatch))
+
+		installMu.Lock()
+		err = installHostBinary(logger, binaryName)
+		installMu.Unlock()
+		if err != nil {
+			logger.Error("Failed to reinstall binary", slog.String("binary", binaryName), slog.String("error", err.Error()))
+			continue
+		}
+		emit(corev1.EventTypeNormal, "PluginBinaryReinstalled",
+			fmt.Sprintf("Reinstalled %s binary %s", binaryName, versionedBinaryName(binaryName, version)))
+	}
+}
+
+// verifyInstalledBinary compares the installed binary with its source in the
+// image and describes the mismatch, or returns an empty string if they match
+func verifyInstalledBinary(binaryName string) (string, error) {
+	srcPath, err := sourceBinaryPath(binaryName, *arch)
+	if err != nil {
+		return "", err
+	}
+	srcHash, err := fileSHA256(srcPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash source file %s: %w", srcPath, err)
+	}
+	if err := verifyExpectedHash(srcPath, srcHash); err != nil {
+		return "", err
+	}
+	if err := verifyEmbeddedHash(binaryName, srcHash); err != nil {
+		return "", err
+	}
+
+	destPath := filepath.Join(*hostRoot, *cniBinDir, versionedBinaryName(binaryName, version))
+	destHash, err := fileSHA256(destPath)
+	if err != nil {
+		return fmt.Sprintf("could not be read: %v", err), nil
+	}
+	if destHash != srcHash {
+		return fmt.Sprintf("has SHA-256 %s, want %s", destHash, srcHash), nil
+	}
+	return "", nil
+}
+
+// writeIntegrityMetrics writes the integrity failure counters in the
+// Prometheus text format
+func writeIntegrityMetrics(w io.Writer) error {
+	var b strings.Builder
+	name := "gcp_cni_binary_integrity_failures_total"
+	fmt.Fprintf(&b, "# HELP %s Installed binaries found modified or missing by the integrity check\n# TYPE %s counter\n", name, name)
+	integrityFailures.Lock()
+	for _, binaryName := range *binaries {
+		fmt.Fprintf(&b, "%s{binary=%q} %d\n", name, binaryName, integrityFailures.counts[binaryName])
+	}
+	integrityFailures.Unlock()
+	_, err := io.WriteString(w, b.String())
+	return err
+}
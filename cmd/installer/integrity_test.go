@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestCheckInstalledBinaries(t *testing.T) {
+	image := []byte("gcp-ipam release binary")
+	sum := sha256.Sum256(image)
+	imageHash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name string
+		// tamper changes the installed binary at path
+		tamper func(t *testing.T, path string)
+		// checksum is the .sha256 file shipped next to the image binary, none if empty
+		checksum string
+		embedded string
+		// wantMismatch is set for an installed binary the check reports and repairs
+		wantMismatch bool
+		// wantInstalled is the installed binary after the check
+		wantInstalled []byte
+	}{
+		{
+			name:          "intact",
+			wantInstalled: image,
+		},
+		{
+			name: "modified",
+			tamper: func(t *testing.T, path string) {
+				writeFile(t, path, []byte("gcp-ipam patched binary"))
+			},
+			wantMismatch:  true,
+			wantInstalled: image,
+		},
+		{
+			name: "truncated",
+			tamper: func(t *testing.T, path string) {
+				if err := os.Truncate(path, 4); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantMismatch:  true,
+			wantInstalled: image,
+		},
+		{
+			name: "removed",
+			tamper: func(t *testing.T, path string) {
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantMismatch:  true,
+			wantInstalled: image,
+		},
+		{
+			name: "replaced by a link to another binary",
+			tamper: func(t *testing.T, path string) {
+				other := filepath.Join(filepath.Dir(path), "other")
+				writeFile(t, other, []byte("another plugin"))
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(other, path); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantMismatch:  true,
+			wantInstalled: image,
+		},
+		{
+			// The image can't be trusted to repair from, the tampered binary is left for the operator
+			name: "image binary not matching its checksum file",
+			tamper: func(t *testing.T, path string) {
+				writeFile(t, path, []byte("gcp-ipam patched binary"))
+			},
+			checksum:      "0000000000000000000000000000000000000000000000000000000000000000",
+			wantInstalled: []byte("gcp-ipam patched binary"),
+		},
+		{
+			name: "image binary not matching the installer build",
+			tamper: func(t *testing.T, path string) {
+				writeFile(t, path, []byte("gcp-ipam patched binary"))
+			},
+			checksum:      imageHash + "  gcp-ipam",
+			embedded:      "0000000000000000000000000000000000000000000000000000000000000000",
+			wantInstalled: []byte("gcp-ipam patched binary"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*hostRoot, *appDir, *cniBinDir, *arch, *binaries = t.TempDir(), t.TempDir(), "/opt/cni/bin", runtime.GOARCH, []string{"gcp-ipam"}
+			previousHash := pluginSHA256
+			pluginSHA256 = tt.embedded
+			t.Cleanup(func() { pluginSHA256 = previousHash })
+
+			writeFile(t, filepath.Join(*appDir, "gcp-ipam"), image)
+			if tt.checksum != "" {
+				writeFile(t, filepath.Join(*appDir, "gcp-ipam.sha256"), []byte(tt.checksum))
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			if err := installHostBinary(logger, "gcp-ipam"); err != nil && tt.checksum == "" {
+				t.Fatal(err)
+			}
+			installedPath := filepath.Join(*hostRoot, *cniBinDir, versionedBinaryName("gcp-ipam", version))
+			if tt.checksum != "" {
+				// The image is rejected, install what a previous run left behind
+				if err := os.MkdirAll(filepath.Dir(installedPath), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				writeFile(t, installedPath, image)
+			}
+			if tt.tamper != nil {
+				tt.tamper(t, installedPath)
+			}
+
+			integrityFailures.Lock()
+			failures := integrityFailures.counts["gcp-ipam"]
+			integrityFailures.Unlock()
+
+			var reasons []string
+			checkInstalledBinaries(logger, func(_, reason, _ string) {
+				reasons = append(reasons, reason)
+			})
+
+			integrityFailures.Lock()
+			counted := integrityFailures.counts["gcp-ipam"] - failures
+			integrityFailures.Unlock()
+			if wantCounted := map[bool]int{true: 1}[tt.wantMismatch]; counted != wantCounted {
+				t.Errorf("integrity failures counted = %d, want %d", counted, wantCounted)
+			}
+			var wantReasons []string
+			if tt.wantMismatch {
+				wantReasons = []string{"PluginBinaryIntegrityViolated", "PluginBinaryReinstalled"}
+			}
+			if !slices.Equal(reasons, wantReasons) {
+				t.Errorf("events = %v, want %v", reasons, wantReasons)
+			}
+
+			data, err := os.ReadFile(installedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(tt.wantInstalled) {
+				t.Errorf("installed binary = %q, want %q", data, tt.wantInstalled)
+			}
+			if info, err := os.Lstat(installedPath); err != nil || !info.Mode().IsRegular() {
+				t.Errorf("installed binary is not a regular file: %v, %v", info, err)
+			}
+			if mismatch, err := verifyInstalledBinary("gcp-ipam"); tt.wantMismatch && (err != nil || mismatch != "") {
+				t.Errorf("verifyInstalledBinary() after the repair = %q, %v, want a match", mismatch, err)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// renewLeases renews the allocation leases of pods running on this node every
+// interval until ctx is done. Pools without a lease duration are left alone.
+func renewLeases(ctx context.Context, logger *slog.Logger, interval time.Duration) error {
+	clientset, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	allocator := ipam.NewAllocator(dynamicClient)
+
+	logger.Info("Renewing allocation leases",
+		slog.String("node", *nodeName),
+		slog.Duration("interval", interval),
+	)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := renewLeasesOnce(ctx, logger, clientset, allocator); err != nil {
+				logger.Error("Failed to renew allocation leases", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func renewLeasesOnce(ctx context.Context, logger *slog.Logger, clientset kubernetes.Interface, allocator *ipam.Allocator) error {
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", *nodeName).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list pods on node %s: %w", *nodeName, err)
+	}
+
+	alive := make(map[string]bool, len(pods.Items))
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		alive[string(pod.UID)] = true
+	}
+
+	for _, pool := range pools {
+		if pool.Spec.LeaseDuration == nil {
+			continue
+		}
+
+		renewed, err := allocator.RenewLeases(ctx, pool.Name, *nodeName, alive)
+		if err != nil {
+			logger.Error("Failed to renew leases", slog.String("pool", pool.Name), slog.String("error", err.Error()))
+			continue
+		}
+		if renewed > 0 {
+			logger.Debug("Renewed allocation leases", slog.String("pool", pool.Name), slog.Int("count", renewed))
+		}
+	}
+	return nil
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/spf13/pflag"
 
+	"github.com/castai/gcp-cni/internal/config"
 	"github.com/castai/gcp-cni/internal/installer"
+	"github.com/castai/gcp-cni/internal/instance"
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
 )
 
 const (
@@ -18,18 +27,67 @@ const (
 	defaultCNIConfDir    = "/etc/cni/net.d"
 	gcpCNIConfName       = "10-containerd-net.conflist"
 	defaultHostRoot      = "/host"
+	defaultAppDir        = "/app"
 	maxCopyBytes         = 100 * 1024 * 1024
 	checkIntervalSeconds = 30
 )
 
+var (
+	// Set at build time via ldflags
+	version = "dev"
+	commit  = "unknown"
+)
+
 var (
 	cniBinDir   = pflag.String("cni-bin-dir", defaultCNIBinDir, "CNI binary directory on the host")
 	cniConfDir  = pflag.String("cni-conf-dir", defaultCNIConfDir, "CNI configuration directory on the host")
 	cniConfName = pflag.String("cni-conf-name", gcpCNIConfName, "GCP CNI configuration file name")
+	profile     = pflag.String("profile", "", "Cluster profile (gke, kubeadm, k3s) supplying the CNI directories and configuration name not set by flags")
 	hostRoot    = pflag.String("host-root", defaultHostRoot, "Host root mount point")
 	logLevel    = pflag.String("log-level", "info", "Log level (debug, info, warn, error)")
+	appDir      = pflag.String("app-dir", defaultAppDir, "Directory containing the binaries shipped in the image")
+	arch        = pflag.String("arch", runtime.GOARCH, "Architecture of the binaries to install (amd64, arm64)")
+	binaries    = pflag.StringSlice("binaries", []string{"gcp-ipam"}, "Binaries to install into the CNI binary directory")
+	selfTest    = pflag.Bool("plugin-self-test", true, "Run gcp-ipam self-test on the host before switching the CNI configuration to it")
+	validateCNI = pflag.Bool("validate-cni", true, "Validate the rewritten CNI configuration before writing it, keeping the current one if it fails")
+	strictConf  = pflag.Bool("strict-conflist", true, "Refuse to switch a CNI configuration whose shape would break pod networking with gcp-ipam, only warn otherwise")
+
+	configMapName      = pflag.String("config-map-name", "", "ConfigMap holding the plugin configuration, empty disables rendering")
+	configMapNamespace = pflag.String("config-map-namespace", "kube-system", "Namespace of the plugin configuration ConfigMap")
+	pluginConfigPath   = pflag.String("plugin-config-path", config.DefaultPath, "Host path the plugin configuration is rendered to")
+
+	nodeName           = pflag.String("node-name", os.Getenv("NODE_NAME"), "Name of the node the installer runs on")
+	leaseRenewInterval = pflag.Duration("lease-renew-interval", 0, "Interval for renewing allocation leases of pods on this node, 0 disables renewal")
+	pendingRelease     = pflag.Duration("pending-release-interval", 0, "Interval for completing pool releases deferred by CNI DEL, 0 disables it")
+	ipBufferInterval   = pflag.Duration("ip-buffer-interval", 0, "Interval for keeping the warm pool of IPs buffered for this node, which ADDs take first and fall back to while the IPPool is unavailable, 0 disables buffering")
+	ipBufferSize       = pflag.Int("ip-buffer-size", 2, "IPs of each pool buffered on this node unless the provisioner sizes its warm pool, 0 returns the buffer to the pools")
+	ipBufferAttach     = pflag.Bool("ip-buffer-attach", false, "Attach buffered IPs to the instance ahead of the pods taking them")
+	adminAddress       = pflag.String("admin-address", "127.0.0.1:9765", "Listen address of the node admin API, empty disables it")
+	cniConfInterval    = pflag.Duration("cni-conf-check-interval", 0, "Interval for switching the CNI configuration back to gcp-ipam after other agents such as netd rewrote it, 0 disables it")
+	instanceEvents     = pflag.Bool("instance-events", false, "Evacuate pod IPs on preemption and host maintenance notices, hold GCE mutations during live migrations and resync after suspend")
+	rebootRecovery     = pflag.Bool("reboot-recovery", false, "Once per boot, attach missing aliases of surviving sandboxes and release the IPs of sandboxes lost with the reboot")
+	addLatency         = pflag.Duration("add-latency-slo", 0, "Latency objective of CNI ADD on this node, 0 disables SLO tracking")
+	addObjective       = pflag.Float64("add-latency-objective", 0.99, "Fraction of CNI ADDs that have to finish within the latency objective")
+	integrityInterval  = pflag.Duration("binary-check-interval", 0, "Interval for checking the installed binaries against the image and reinstalling modified ones, 0 disables it")
+	podNICInterval     = pflag.Duration("pod-nic-route-interval", 0, "Interval for routing pod traffic through the pod network interface in the secondary NIC mode, 0 disables it")
+	asyncAttach        = pflag.Duration("async-attach-interval", 0, "Interval for attaching the aliases of pods ADD returned before attaching them, with the AsyncAttach feature gate, 0 disables it")
+	createMissingPool  = pflag.Bool("create-missing-pool", false, "At startup, create the IPPool of the node subnetwork from its secondary range when it does not exist")
+	staleAliases       = pflag.Bool("remove-stale-aliases", false, "At startup, remove aliases in secondary ranges of the cluster's IPPools no allocation accounts for, left from a previous life of a reused instance")
+
+	canaryLabel     = pflag.String("canary-label", "", "Node label, key or key=value, of the nodes this release is activated on, the others keep the gcp-ipam release they run, empty activates it on every node")
+	canaryInterval  = pflag.Duration("canary-check-interval", 0, "Interval for checking the ADDs of this release on canary nodes and rolling back to the previous release when too many fail, 0 disables it")
+	canaryMaxErrors = pflag.Float64("canary-max-add-error-ratio", 0.2, "Fraction of failed ADDs of this release on a canary node that rolls it back")
+
+	egressInterval      = pflag.Duration("egress-interval", 0, "Interval for programming SNAT rules of egress IPs attached to this node, 0 disables egress")
+	egressExcludedCIDRs = pflag.StringSlice("egress-excluded-cidrs", []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}, "Destinations egress traffic keeps the pod IP for")
+
+	uninstall        = pflag.Bool("uninstall", false, "Uninstall gcp-ipam from the node instead of installing it: refuse new pods, wait for the pods holding IPs to leave, release the IPs left behind, then revert the CNI configuration to host-local and remove the binaries")
+	uninstallTimeout = pflag.Duration("uninstall-timeout", 10*time.Minute, "Time the uninstall waits for the pods holding IPs to leave the node before failing, their IPs stay allocated")
 )
 
+// installMu serializes installation runs triggered at startup and through the admin API
+var installMu sync.Mutex
+
 func main() {
 	pflag.Parse()
 
@@ -37,12 +95,137 @@ func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
 	slog.SetDefault(logger)
 
+	if err := applyProfile(*profile); err != nil {
+		logger.Error("Invalid cluster profile", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
 	logger.Info("Starting GCP CNI installer daemon",
+		slog.String("version", version),
+		slog.String("commit", commit),
+		slog.String("profile", *profile),
 		slog.String("cni_bin_dir", *cniBinDir),
 		slog.String("cni_conf_dir", *cniConfDir),
+		slog.String("cni_conf_name", *cniConfName),
 		slog.String("host_root", *hostRoot),
+		slog.String("arch", *arch),
+		slog.Any("binaries", *binaries),
 	)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// No background loop may switch the configuration back or reinstall the binaries
+	if *uninstall {
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := runUninstall(ctx, logger, *uninstallTimeout); err != nil {
+			logger.Error("Uninstall failed", slog.String("error", err.Error()))
+		}
+		<-ctx.Done()
+		logger.Info("Received termination signal, exiting")
+		return
+	}
+
+	// The node mutation lock of a live migration held by a previous installer process went with it,
+	// its marker did not
+	if err := mutation.ClearMaintenance(filepath.Join(*hostRoot, mutation.DefaultMaintenancePath)); err != nil {
+		logger.Error("Failed to clear maintenance state of previous run", slog.String("error", err.Error()))
+	}
+
+	// Render the plugin config before the plugin is switched on so the first pods already use it
+	if *configMapName != "" {
+		if err := watchPluginConfig(ctx, logger); err != nil {
+			logger.Error("Failed to watch plugin configuration", slog.String("error", err.Error()))
+		}
+	}
+
+	// Needs the rendered plugin config for the pool name and secondary range
+	if *createMissingPool {
+		if err := ensureNodePool(ctx, logger); err != nil {
+			logger.Error("Failed to create the IPPool of the node subnetwork", slog.String("error", err.Error()))
+		}
+	}
+
+	// Before anything else touches the attachments of the previous boot
+	if *rebootRecovery {
+		if err := recoverFromReboot(ctx, logger); err != nil {
+			logger.Error("Failed to recover attachments after boot", slog.String("error", err.Error()))
+		}
+	}
+
+	if *staleAliases {
+		if err := removeStaleAliases(ctx, logger); err != nil {
+			logger.Error("Failed to remove stale aliases", slog.String("error", err.Error()))
+		}
+	}
+
+	if *leaseRenewInterval > 0 {
+		if err := renewLeases(ctx, logger, *leaseRenewInterval); err != nil {
+			logger.Error("Failed to start lease renewal", slog.String("error", err.Error()))
+		}
+	}
+
+	if *pendingRelease > 0 {
+		if err := releasePending(ctx, logger, *pendingRelease); err != nil {
+			logger.Error("Failed to start deferred IP releases", slog.String("error", err.Error()))
+		}
+	}
+
+	if *ipBufferInterval > 0 {
+		if err := bufferIPs(ctx, logger, *ipBufferInterval, *ipBufferSize, *ipBufferAttach); err != nil {
+			logger.Error("Failed to start IP buffering", slog.String("error", err.Error()))
+		}
+	}
+
+	if *cniConfInterval > 0 {
+		guardCNIConfig(ctx, logger, *cniConfInterval)
+	}
+
+	if *integrityInterval > 0 {
+		checkBinaryIntegrity(ctx, logger, *integrityInterval)
+	}
+
+	if *instanceEvents {
+		if err := watchInstanceEvents(ctx, logger); err != nil {
+			logger.Error("Failed to watch instance events", slog.String("error", err.Error()))
+		}
+	}
+
+	if *podNICInterval > 0 {
+		if err := routePodNIC(ctx, logger, *podNICInterval); err != nil {
+			logger.Error("Failed to start pod network interface routing", slog.String("error", err.Error()))
+		}
+	}
+
+	if *asyncAttach > 0 {
+		if err := attachPendingAliases(ctx, logger, *asyncAttach); err != nil {
+			logger.Error("Failed to start attaching pending aliases", slog.String("error", err.Error()))
+		}
+	}
+
+	if *addLatency > 0 {
+		if err := trackAddLatency(ctx, logger); err != nil {
+			logger.Error("Failed to start ADD latency SLO tracking", slog.String("error", err.Error()))
+		}
+	}
+
+	if *canaryLabel != "" && *canaryInterval > 0 {
+		watchCanary(ctx, logger, *canaryInterval)
+	}
+
+	if *egressInterval > 0 {
+		if err := programEgress(ctx, logger, *egressInterval); err != nil {
+			logger.Error("Failed to start egress programming", slog.String("error", err.Error()))
+		}
+	}
+
+	if *adminAddress != "" {
+		if err := serveAdminAPI(ctx, logger, *adminAddress); err != nil {
+			logger.Error("Failed to start admin API", slog.String("error", err.Error()))
+		}
+	}
+
 	if err := runInstallation(logger); err != nil {
 		logger.Error("Installation check failed", slog.String("error", err.Error()))
 	}
@@ -53,23 +236,154 @@ func main() {
 	sig := <-signals
 	logger.Info("Received termination signal, exiting", slog.String("signal", sig.String()))
 
+	// Stop the background loops first, the guard would switch the configuration back
+	cancel()
+	installMu.Lock()
+	defer installMu.Unlock()
+
 	logger.Info("Reverting CNI configuration to use host-local IPAM")
-	reconfigureCNIIPAMConf(logger, "host-local")
+	reconfigureCNIIPAMConf(logger, "host-local", "")
 }
 
 func runInstallation(logger *slog.Logger) error {
-	if err := installHostBinary(logger, "gcp-ipam"); err != nil {
-		return fmt.Errorf("failed to install gcp-ipam binary: %w", err)
+	installMu.Lock()
+	defer installMu.Unlock()
+
+	if *canaryLabel != "" {
+		if err := runCanaryInstallation(logger); err != nil {
+			return err
+		}
+	} else {
+		if err := activateRelease(logger); err != nil {
+			return err
+		}
+		activeVersion.Store(version)
+		forgetPrevious(logger)
+	}
+	if installed.Load() {
+		annotateVersions(logger)
+	}
+	return nil
+}
+
+// activateRelease installs the binaries of this release and switches the
+// conflist to them
+func activateRelease(logger *slog.Logger) error {
+	if err := installHostBinaries(logger, *binaries); err != nil {
+		return err
+	}
+	reportOnboarding(logger, func(status *v1alpha1.NodeOnboardingStatus) {
+		status.InstalledVersion = version
+	})
+
+	// A new plugin binary starts from a clean instance cache
+	if err := instance.Invalidate(filepath.Join(*hostRoot, instance.DefaultCachePath)); err != nil {
+		logger.Warn("Failed to invalidate plugin instance cache", slog.String("error", err.Error()))
+	}
+
+	if *selfTest {
+		if err := runPluginSelfTest(logger, "gcp-ipam"); err != nil {
+			reportOnboarding(logger, func(status *v1alpha1.NodeOnboardingStatus) {
+				status.SelfTestError = err.Error()
+			})
+			return fmt.Errorf("refusing to switch CNI configuration: %w", err)
+		}
+	}
+	reportOnboarding(logger, func(status *v1alpha1.NodeOnboardingStatus) {
+		// Only a self-test that ran vouches for the release
+		status.SelfTestVersion, status.SelfTestSkipped = version, false
+		if !*selfTest {
+			status.SelfTestVersion, status.SelfTestSkipped = "", true
+		}
+		status.SelfTestError = ""
+	})
+
+	if err := checkConfShape(logger); err != nil {
+		return fmt.Errorf("refusing to switch CNI configuration: %w", err)
 	}
 
-	if err := reconfigureCNIIPAMConf(logger, "gcp-ipam"); err != nil {
+	if err := reconfigureCNIIPAMConf(logger, "gcp-ipam", version); err != nil {
 		return fmt.Errorf("failed to reconfigure CNI: %w", err)
 	}
 
+	if err := verifyInstalledVersion(logger, "gcp-ipam", version); err != nil {
+		return fmt.Errorf("installed version handshake failed: %w", err)
+	}
+
+	installed.Store(true)
 	return nil
 }
 
-func reconfigureCNIIPAMConf(logger *slog.Logger, ipamType string) error {
+// checkConfShape reports the problems of the CNI configuration that would
+// leave pods without a working network once it delegates to gcp-ipam, and
+// fails on them with --strict-conflist
+func checkConfShape(logger *slog.Logger) error {
+	confPath := filepath.Join(*hostRoot, *cniConfDir, *cniConfName)
+	data, err := os.ReadFile(confPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read CNI config: %w", err)
+	}
+
+	problems, err := installer.CheckConfShape(data, []string{filepath.Join(*hostRoot, *cniBinDir)})
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	report := make([]string, 0, len(problems))
+	for _, p := range problems {
+		report = append(report, p.String())
+	}
+	logger.Warn("CNI configuration not supported by gcp-ipam",
+		slog.String("path", confPath),
+		slog.Any("problems", report),
+		slog.Bool("strict", *strictConf),
+	)
+	if !*strictConf {
+		return nil
+	}
+	return fmt.Errorf("unsupported CNI configuration %s: %s", confPath, strings.Join(report, "; "))
+}
+
+// verifyInstalledVersion checks that the conflist and the binary link on the
+// host both point at release, so a partially upgraded node never runs a
+// plugin version the conflist was not written for.
+func verifyInstalledVersion(logger *slog.Logger, binaryName, release string) error {
+	confPath := filepath.Join(*hostRoot, *cniConfDir, *cniConfName)
+	data, err := os.ReadFile(confPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read CNI config: %w", err)
+	}
+
+	confVersion, err := installer.ConfiguredPluginVersion(data)
+	if err != nil {
+		return err
+	}
+	if confVersion != release {
+		return fmt.Errorf("CNI config records %s version %q, want %q", binaryName, confVersion, release)
+	}
+
+	linkPath := filepath.Join(*hostRoot, *cniBinDir, binaryName)
+	target, err := os.Readlink(linkPath)
+	if err != nil {
+		return fmt.Errorf("failed to read binary link %s: %w", linkPath, err)
+	}
+	if want := versionedBinaryName(binaryName, release); target != want {
+		return fmt.Errorf("binary link %s points at %s, want %s", linkPath, target, want)
+	}
+
+	logger.Info("Installed version verified", slog.String("binary", binaryName), slog.String("version", release))
+	return nil
+}
+
+func reconfigureCNIIPAMConf(logger *slog.Logger, ipamType, pluginVersion string) error {
 	confDir := filepath.Join(*hostRoot, *cniConfDir)
 	confPath := filepath.Join(confDir, *cniConfName)
 
@@ -86,24 +400,88 @@ func reconfigureCNIIPAMConf(logger *slog.Logger, ipamType string) error {
 		return fmt.Errorf("failed to read CNI config: %w", err)
 	}
 
-	updatedData, err := installer.UpdateCNIIPAM(data, ipamType, logger)
+	updatedData, err := installer.UpdateCNIIPAM(data, ipamType, pluginVersion, logger)
 	if err != nil {
 		return err
 	}
+	if updatedData == nil {
+		return nil
+	}
 
-	tmpPath := confPath + ".tmp"
-	if err := os.WriteFile(tmpPath, updatedData, 0o644); err != nil {
-		return fmt.Errorf("failed to write temporary config: %w", err)
+	// The runtime reads a .conflist file as a list, a .conf stays a single plugin
+	if filepath.Ext(confPath) == ".conflist" {
+		list, err := installer.IsConfList(updatedData)
+		if err != nil {
+			return err
+		}
+		if !list {
+			logger.Warn("CNI configuration holds a single plugin but is named .conflist, converting it to a conflist",
+				slog.String("path", confPath))
+			if updatedData, err = installer.ConvertToConfList(updatedData); err != nil {
+				return err
+			}
+		}
 	}
 
-	if err := os.Rename(tmpPath, confPath); err != nil {
-		return fmt.Errorf("failed to rename config file: %w", err)
+	// Validated before it is written, the container runtime picks up every
+	// change of the directory and must never load a broken configuration
+	if *validateCNI {
+		binDir := filepath.Join(*hostRoot, *cniBinDir)
+		if err := installer.ValidateCNIConfig(context.Background(), updatedData, []string{binDir}); err != nil {
+			logger.Error("CNI configuration validation failed, keeping the current configuration",
+				slog.String("path", confPath),
+				slog.String("error", err.Error()),
+			)
+			return fmt.Errorf("CNI config validation failed: %w", err)
+		}
+		logger.Info("CNI configuration validated", slog.String("path", confPath))
+	}
+
+	// The backup keeps the configuration from before the first rewrite, later
+	// upgrades and config renders must not replace it with their own
+	backupPath := confPath + ".bak"
+	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+		if err := writeFileAtomic(backupPath, data); err != nil {
+			return fmt.Errorf("failed to back up CNI config: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to back up CNI config: %w", err)
+	}
+
+	if err := writeFileAtomic(confPath, updatedData); err != nil {
+		return err
 	}
 
 	logger.Info("CNI configuration updated successfully", slog.String("path", confPath))
 	return nil
 }
 
+// applyProfile fills the CNI directories and configuration name from the
+// cluster profile, flags set on the command line win
+func applyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	p, err := config.LookupProfile(name)
+	if err != nil {
+		return err
+	}
+	defaults := map[string]string{
+		"cni-bin-dir":   p.CNIBinDir,
+		"cni-conf-dir":  p.CNIConfDir,
+		"cni-conf-name": p.CNIConfName,
+	}
+	for flag, value := range defaults {
+		if pflag.CommandLine.Changed(flag) {
+			continue
+		}
+		if err := pflag.Set(flag, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func parseLogLevel(level string) slog.Level {
 	switch level {
 	case "debug":
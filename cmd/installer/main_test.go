@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReconfigureCNIIPAMConfBackup(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	*hostRoot, *cniConfDir, *cniConfName, *validateCNI = t.TempDir(), "/etc/cni/net.d", "10-containerd-net.conflist", false
+	t.Cleanup(func() { *validateCNI = true })
+	confPath := filepath.Join(*hostRoot, *cniConfDir, *cniConfName)
+	if err := os.MkdirAll(filepath.Dir(confPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	original := `{"cniVersion":"0.4.0","name":"k8s-pod-network","plugins":[{"type":"ptp","ipam":{"type":"host-local"}}]}`
+	if err := os.WriteFile(confPath, []byte(original), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An upgrade rewrites the configuration again, the backup stays the one from before gcp-ipam
+	for _, release := range []string{"v1.0.0", "v1.1.0"} {
+		if err := reconfigureCNIIPAMConf(logger, "gcp-ipam", release); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup, err := os.ReadFile(confPath + ".bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != original {
+		t.Errorf("backup = %s, want the original configuration", backup)
+	}
+}
+
+func TestReconfigureCNIIPAMConfValidation(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	// No plugin binaries on the host, the rewritten configuration cannot validate
+	*hostRoot, *cniConfDir, *cniConfName, *cniBinDir, *validateCNI = t.TempDir(), "/etc/cni/net.d", "10-containerd-net.conflist", "/opt/cni/bin", true
+	confPath := filepath.Join(*hostRoot, *cniConfDir, *cniConfName)
+	if err := os.MkdirAll(filepath.Dir(confPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	original := `{"cniVersion":"0.4.0","name":"k8s-pod-network","plugins":[{"type":"ptp","ipam":{"type":"host-local"}}]}`
+	if err := os.WriteFile(confPath, []byte(original), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reconfigureCNIIPAMConf(logger, "gcp-ipam", "v1.0.0"); err == nil {
+		t.Fatal("reconfigureCNIIPAMConf() of an invalid configuration succeeded")
+	}
+	after, err := os.Stat(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replaced and reverted would leave the content but not the file
+	if !os.SameFile(before, after) || string(data) != original {
+		t.Errorf("configuration = %s, replaced = %v, want the original never touched", data, !os.SameFile(before, after))
+	}
+	if _, err := os.Stat(confPath + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("backup written for a configuration that was not: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/instance"
+	"github.com/castai/gcp-cni/internal/mutation"
+)
+
+const (
+	// migrateOnHostMaintenance is the maintenance event announcing a live
+	// migration, 60 seconds ahead
+	migrateOnHostMaintenance = "MIGRATE_ON_HOST_MAINTENANCE"
+	// quiesceLockTimeout bounds the wait for plugin invocations in flight
+	// before the live migration
+	quiesceLockTimeout = 30 * time.Second
+	// maxQuiesce lets the node mutations resume should the end of a live
+	// migration never be announced
+	maxQuiesce = 10 * time.Minute
+)
+
+// quiescer holds GCE mutations of this instance while it is live-migrated.
+// Network interface updates racing a migration fail on fingerprints that
+// changed under them, so the node mutation lock is taken exclusively for the
+// duration: plugin invocations stay queued in priority order and run once it
+// is over, against a fresh fingerprint.
+type quiescer struct {
+	logger    *slog.Logger
+	clientset kubernetes.Interface
+	lock      *flock.Flock
+	since     time.Time
+}
+
+// hold takes the node mutation lock for the maintenance event
+func (q *quiescer) hold(ctx context.Context, event string) {
+	if q.lock != nil {
+		return
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, quiesceLockTimeout)
+	defer cancel()
+
+	lock := flock.New(filepath.Join(*hostRoot, mutation.DefaultLockPath))
+	if _, err := lock.TryLockContext(lockCtx, 50*time.Millisecond); err != nil {
+		q.logger.Error("Failed to hold node mutations for live migration", slog.String("error", err.Error()))
+		return
+	}
+	q.lock, q.since = lock, time.Now()
+
+	if err := mutation.WriteMaintenance(filepath.Join(*hostRoot, mutation.DefaultMaintenancePath), mutation.Maintenance{Event: event, Since: q.since}); err != nil {
+		q.logger.Error("Failed to record held node mutations", slog.String("error", err.Error()))
+	}
+	q.logger.Warn("Holding node mutations during live migration", slog.String("event", event))
+}
+
+// resume releases the node mutation lock and retries the aliases left to
+// attach meanwhile
+func (q *quiescer) resume(ctx context.Context, reason string) {
+	if q.lock == nil {
+		return
+	}
+	// The network interfaces may come back with new fingerprints
+	if err := instance.Invalidate(filepath.Join(*hostRoot, instance.DefaultCachePath)); err != nil {
+		q.logger.Error("Failed to invalidate instance cache", slog.String("error", err.Error()))
+	}
+	if err := mutation.ClearMaintenance(filepath.Join(*hostRoot, mutation.DefaultMaintenancePath)); err != nil {
+		q.logger.Error("Failed to record resumed node mutations", slog.String("error", err.Error()))
+	}
+	if err := q.lock.Unlock(); err != nil {
+		q.logger.Error("Failed to release node mutation lock", slog.String("error", err.Error()))
+	}
+	q.lock = nil
+	q.logger.Info("Resuming node mutations after live migration",
+		slog.String("reason", reason),
+		slog.Duration("held", time.Since(q.since)),
+	)
+
+	if err := attachPendingOnce(ctx, q.logger, q.clientset); err != nil {
+		q.logger.Error("Failed to attach pending aliases", slog.String("error", err.Error()))
+	}
+}
+
+// overdue reports whether the mutations have been held longer than maxQuiesce
+func (q *quiescer) overdue(now time.Time) bool {
+	return q.lock != nil && now.Sub(q.since) > maxQuiesce
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/castai/gcp-cni/internal/instance"
+	"github.com/castai/gcp-cni/internal/mutation"
+)
+
+func TestQuiescer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	*hostRoot, *nodeName = t.TempDir(), "node-1"
+	lockPath := filepath.Join(*hostRoot, mutation.DefaultLockPath)
+	maintenancePath := filepath.Join(*hostRoot, mutation.DefaultMaintenancePath)
+	cachePath := filepath.Join(*hostRoot, instance.DefaultCachePath)
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cachePath, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	locked := func() bool {
+		other := flock.New(lockPath)
+		ok, err := other.TryLock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			other.Unlock()
+		}
+		return !ok
+	}
+
+	q := &quiescer{logger: logger, clientset: kubefake.NewSimpleClientset()}
+
+	// A plugin invocation in flight keeps the lock past the wait
+	inFlight := flock.New(lockPath)
+	if err := inFlight.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	q.hold(shortCtx, migrateOnHostMaintenance)
+	cancel()
+	if q.lock != nil {
+		t.Fatal("mutations held while a plugin invocation holds the lock")
+	}
+	if m, err := mutation.ReadMaintenance(maintenancePath); m != nil || err != nil {
+		t.Fatalf("maintenance = %+v, %v, want none recorded when the lock was not taken", m, err)
+	}
+	inFlight.Unlock()
+
+	q.hold(ctx, migrateOnHostMaintenance)
+	if !locked() {
+		t.Fatal("node mutation lock not held during live migration")
+	}
+	m, err := mutation.ReadMaintenance(maintenancePath)
+	if err != nil || m == nil || m.Event != migrateOnHostMaintenance || !m.Since.Equal(q.since) {
+		t.Fatalf("maintenance = %+v, %v, want %s since the hold", m, err, migrateOnHostMaintenance)
+	}
+	since := q.since
+	q.hold(ctx, migrateOnHostMaintenance)
+	if !q.since.Equal(since) {
+		t.Error("repeated event restarted the hold")
+	}
+
+	if q.overdue(since.Add(maxQuiesce)) {
+		t.Error("overdue at maxQuiesce, want only past it")
+	}
+	if !q.overdue(since.Add(maxQuiesce + time.Second)) {
+		t.Error("not overdue past maxQuiesce")
+	}
+
+	for range 2 {
+		q.resume(ctx, "live migration finished")
+	}
+	if locked() {
+		t.Error("node mutation lock still held after resuming")
+	}
+	if m, err := mutation.ReadMaintenance(maintenancePath); m != nil || err != nil {
+		t.Errorf("maintenance = %+v, %v, want cleared after resuming", m, err)
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Errorf("instance cache kept after live migration: %v", err)
+	}
+	if q.overdue(since.Add(maxQuiesce + time.Second)) {
+		t.Error("overdue after resuming")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/castai/gcp-cni/internal/installer"
+)
+
+// installed is set once an installation switched the conflist to gcp-ipam,
+// before that there is nothing to guard
+var installed atomic.Bool
+
+// confChanges counts the changes of the conflist seen by the guard by class
+var confChanges = map[installer.ConfChange]*atomic.Int64{
+	installer.ConfChangeOwn:         {},
+	installer.ConfChangeBenign:      {},
+	installer.ConfChangeConflicting: {},
+}
+
+// guardCNIConfig keeps the conflist on gcp-ipam every interval until ctx is
+// done. GKE's netd renders the conflist from its own template, e.g. when it
+// restarts, which silently switches new pods back to host-local. Every change
+// of the file is classified: our own writes, benign changes by other agents
+// that keep gcp-ipam, and conflicting ones after which the gcp-ipam IPAM
+// section is written again. Other agents' changes get a node event.
+func guardCNIConfig(ctx context.Context, logger *slog.Logger, interval time.Duration) {
+	confPath := filepath.Join(*hostRoot, *cniConfDir, *cniConfName)
+	logger.Info("Guarding CNI configuration against other agents",
+		slog.String("path", confPath),
+		slog.Duration("interval", interval),
+	)
+
+	clientset, _, err := buildKubeClients()
+	if err != nil {
+		logger.Warn("No Kubernetes client, CNI configuration changes are only logged", slog.String("error", err.Error()))
+	}
+	emit := func(eventType, reason, message string) {
+		if clientset == nil || *nodeName == "" {
+			return
+		}
+		if err := emitNodeEvent(ctx, clientset, eventType, reason, message); err != nil {
+			logger.Error("Failed to emit node event", slog.String("reason", reason), slog.String("error", err.Error()))
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var lastSeen [sha256.Size]byte
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if !installed.Load() {
+				continue
+			}
+			data, err := os.ReadFile(confPath)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				logger.Error("Failed to read CNI configuration", slog.String("error", err.Error()))
+				continue
+			}
+			digest := sha256.Sum256(data)
+			if digest == lastSeen {
+				continue
+			}
+			lastSeen = digest
+
+			release := runningVersion()
+			change, err := installer.ClassifyConfChange(data, "gcp-ipam", release)
+			if err != nil {
+				logger.Error("Failed to parse CNI configuration", slog.String("error", err.Error()))
+				continue
+			}
+			count := confChanges[change].Add(1)
+
+			switch change {
+			case installer.ConfChangeOwn:
+				logger.Debug("CNI configuration is as written by the installer")
+
+			case installer.ConfChangeBenign:
+				logger.Info("CNI configuration was changed by another agent, IPAM is still gcp-ipam",
+					slog.Int64("changes", count))
+				emit(corev1.EventTypeNormal, "CNIConfigChanged",
+					fmt.Sprintf("CNI configuration %s was changed by another agent, IPAM is still gcp-ipam %s", *cniConfName, release))
+
+			case installer.ConfChangeConflicting:
+				recorded, _ := installer.ConfiguredPluginVersion(data)
+				logger.Warn("CNI configuration was rewritten by another agent, switching it back to gcp-ipam",
+					slog.String("recorded_version", recorded),
+					slog.Int64("rewrites", count),
+				)
+				emit(corev1.EventTypeWarning, "CNIConfigConflict",
+					fmt.Sprintf("CNI configuration %s was switched away from gcp-ipam %s by another agent, switching it back", *cniConfName, release))
+
+				installMu.Lock()
+				if err = checkConfShape(logger); err == nil {
+					err = reconfigureCNIIPAMConf(logger, "gcp-ipam", release)
+				}
+				installMu.Unlock()
+				if err != nil {
+					logger.Error("Failed to switch CNI configuration back", slog.String("error", err.Error()))
+				}
+			}
+		}
+	}()
+}
+
+// writeConfChangeMetrics writes the conflist change counters in the
+// Prometheus text format
+func writeConfChangeMetrics(w io.Writer) error {
+	var b strings.Builder
+	name := "gcp_cni_conf_changes_total"
+	fmt.Fprintf(&b, "# HELP %s Changes of the CNI configuration seen by the installer by class\n# TYPE %s counter\n", name, name)
+	for _, change := range []installer.ConfChange{installer.ConfChangeOwn, installer.ConfChangeBenign, installer.ConfChangeConflicting} {
+		fmt.Fprintf(&b, "%s{class=%q} %d\n", name, change, confChanges[change].Load())
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
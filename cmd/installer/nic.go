@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// podNICTable is the routing table pod traffic of the secondary NIC mode
+// leaves through, also used as the priority of its rules
+const podNICTable = "2100"
+
+// routePodNIC keeps pod traffic on the pod network interface every interval
+// until ctx is done, while the plugin configuration selects the secondary NIC
+// mode. Without it replies of pods with IPs from the dedicated subnetwork
+// would leave through the primary interface, whose anti-spoofing drops them.
+func routePodNIC(ctx context.Context, logger *slog.Logger, interval time.Duration) error {
+	_, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	allocator := ipam.NewAllocator(dynamicClient)
+
+	logger.Info("Routing pod traffic of the secondary NIC mode", slog.Duration("interval", interval))
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := routePodNICOnce(ctx, logger, allocator); err != nil {
+				logger.Error("Failed to route pod network interface", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func routePodNICOnce(ctx context.Context, logger *slog.Logger, allocator *ipam.Allocator) error {
+	cfg, err := config.Load(filepath.Join(*hostRoot, *pluginConfigPath))
+	if err != nil {
+		return err
+	}
+	subnetwork := cfg.NetworkInterface.Subnetwork
+	if subnetwork == "" {
+		return nil
+	}
+
+	computeService, projectID, zone, instanceName, err := thisInstance(ctx)
+	if err != nil {
+		return err
+	}
+	inst, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get instance %s: %w", instanceName, err)
+	}
+
+	// GCE names interfaces nicN after their index in the metadata server
+	index := -1
+	for i, nic := range inst.NetworkInterfaces {
+		if ipam.SubnetworkName(nic.Subnetwork) != subnetwork {
+			continue
+		}
+		index = i
+		if n, err := strconv.Atoi(strings.TrimPrefix(nic.Name, "nic")); err == nil {
+			index = n
+		}
+		break
+	}
+	if index < 0 {
+		logger.Info("Pod network interface not attached yet", slog.String("subnetwork", subnetwork))
+		return nil
+	}
+
+	link, gateway, err := nicLink(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+	var cidrs []string
+	for _, pool := range pools {
+		if pool.Spec.Class != "" && pool.Spec.Class != v1alpha1.PoolClassPod {
+			continue
+		}
+		if ipam.SubnetworkName(pool.Spec.Subnet) != subnetwork {
+			continue
+		}
+		if pool.Spec.CIDR != "" {
+			cidrs = append(cidrs, pool.Spec.CIDR)
+		}
+		for _, r := range pool.Spec.SecondaryRanges {
+			cidrs = append(cidrs, r.CIDR)
+		}
+	}
+
+	if output, err := hostCommand(ctx, "ip", "route", "replace", "default", "via", gateway, "dev", link, "table", podNICTable).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set pod network interface route: %w: %s", err, output)
+	}
+	// Replies arrive on the pod interface but the way back to their source is the primary one
+	if output, err := hostCommand(ctx, "sysctl", "-w", fmt.Sprintf("net.ipv4.conf.%s.rp_filter=2", link)).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to loosen reverse path filter of %s: %w: %s", link, err, output)
+	}
+
+	rules, err := hostCommand(ctx, "ip", "rule", "show", "table", podNICTable).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to list routing rules: %w: %s", err, rules)
+	}
+	for _, cidr := range cidrs {
+		if strings.Contains(string(rules), "from "+cidr+" ") {
+			continue
+		}
+		if output, err := hostCommand(ctx, "ip", "rule", "add", "from", cidr, "table", podNICTable, "priority", podNICTable).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to add routing rule for %s: %w: %s", cidr, err, output)
+		}
+		logger.Info("Routing pod range through pod network interface", slog.String("cidr", cidr), slog.String("link", link))
+	}
+	return nil
+}
+
+// nicLink returns the host link and gateway of the network interface with
+// the given metadata server index
+func nicLink(ctx context.Context, index int) (string, string, error) {
+	prefix := fmt.Sprintf("instance/network-interfaces/%d/", index)
+	mac, err := metadata.GetWithContext(ctx, prefix+"mac")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get MAC address of network interface %d: %w", index, err)
+	}
+	gateway, err := metadata.GetWithContext(ctx, prefix+"gateway")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get gateway of network interface %d: %w", index, err)
+	}
+
+	links, err := net.Interfaces()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to list host links: %w", err)
+	}
+	for _, link := range links {
+		if strings.EqualFold(link.HardwareAddr.String(), strings.TrimSpace(mac)) {
+			return link.Name, strings.TrimSpace(gateway), nil
+		}
+	}
+	return "", "", fmt.Errorf("no host link with MAC address %s", mac)
+}
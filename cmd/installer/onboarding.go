@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// reportOnboarding applies report to the NodeOnboarding of this node, which
+// the provisioner's onboarding controller advances from, creating it when the
+// controller did not yet
+func reportOnboarding(logger *slog.Logger, report func(status *v1alpha1.NodeOnboardingStatus)) {
+	if *nodeName == "" {
+		return
+	}
+	clientset, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		logger.Debug("No Kubernetes client, onboarding progress is not reported", slog.String("error", err.Error()))
+		return
+	}
+	ctx := context.Background()
+	node, err := clientset.CoreV1().Nodes().Get(ctx, *nodeName, metav1.GetOptions{})
+	if err != nil {
+		logger.Warn("Failed to report onboarding progress", slog.String("error", err.Error()))
+		return
+	}
+	owner := metav1.OwnerReference{APIVersion: "v1", Kind: "Node", Name: node.Name, UID: node.UID}
+	if err := ipam.NewAllocator(dynamicClient).ReportOnboarding(ctx, owner, report); err != nil {
+		logger.Warn("Failed to report onboarding progress", slog.String("error", err.Error()))
+	}
+}
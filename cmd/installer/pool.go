@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/subnetpool"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// ensureNodePool creates the IPPool of the subnetwork the node attaches pod
+// aliases from when it does not exist yet, from the secondary range of the
+// plugin configuration, so nodes of a new subnetwork do not wait for the
+// provisioner to have run first. Nodes racing for a pool settle on the first.
+func ensureNodePool(ctx context.Context, logger *slog.Logger) error {
+	cfg, err := config.Load(filepath.Join(*hostRoot, *pluginConfigPath))
+	if err != nil {
+		return err
+	}
+	_, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	client, err := google.DefaultClient(ctx, compute.CloudPlatformScope)
+	if err != nil {
+		return fmt.Errorf("failed to create google default client: %w", err)
+	}
+	return ensureSubnetworkPool(ctx, logger, cfg, ipam.NewAllocator(dynamicClient), client)
+}
+
+// ensureSubnetworkPool is ensureNodePool on the given clients. The instance
+// and the Compute Engine endpoint are those the plugin uses, with the
+// identity overrides of cfg and the environment.
+func ensureSubnetworkPool(ctx context.Context, logger *slog.Logger, cfg *config.Config, allocator *ipam.Allocator, client *http.Client) error {
+	overrides := cfg.Identity.Merge(identity.FromEnv())
+	computeService, err := compute.NewService(ctx, append(overrides.ComputeOptions(), option.WithHTTPClient(client))...)
+	if err != nil {
+		return fmt.Errorf("failed to create compute service: %w", err)
+	}
+	projectID, err := overrides.ProjectID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get project ID from metadata: %w", err)
+	}
+	zone, err := overrides.ZoneName(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get zone from metadata: %w", err)
+	}
+	instanceName, err := overrides.InstanceName(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get instance name from metadata: %w", err)
+	}
+
+	inst, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get instance %s: %w", instanceName, err)
+	}
+	// The primary interface or, in the secondary NIC mode, the pod interface
+	var subnetwork string
+	for _, nic := range inst.NetworkInterfaces {
+		if cfg.NetworkInterface.Subnetwork == "" || ipam.SubnetworkName(nic.Subnetwork) == cfg.NetworkInterface.Subnetwork {
+			subnetwork = ipam.SubnetworkName(nic.Subnetwork)
+			break
+		}
+	}
+	if subnetwork == "" {
+		logger.Info("Pod network interface not attached yet, not creating its IPPool")
+		return nil
+	}
+
+	poolName, ok := cfg.PoolName(subnetwork)
+	if !ok {
+		poolName = cfg.DefaultPoolName(subnetwork)
+	}
+	exists, err := allocator.PoolExists(ctx, poolName)
+	if err != nil || exists {
+		return err
+	}
+
+	region, err := identity.Region(zone)
+	if err != nil {
+		return err
+	}
+	hostProject := cfg.SharedVPC.NetworkProject(projectID)
+	if cfg.SharedVPC.ServiceAccount != "" {
+		ts, err := identity.ImpersonatedTokenSource(ctx, cfg.SharedVPC.ServiceAccount)
+		if err != nil {
+			return err
+		}
+		computeService, err = compute.NewService(ctx, append(overrides.ComputeOptions(), option.WithHTTPClient(oauth2.NewClient(ctx, ts)))...)
+		if err != nil {
+			return fmt.Errorf("failed to create compute service for host project %s: %w", hostProject, err)
+		}
+	}
+	pool, err := subnetpool.Build(ctx, computeService, hostProject, region, subnetwork, cfg.ClusterRange(ipam.AliasRange(cfg.SecondaryRangeName)), poolName)
+	if err != nil {
+		return fmt.Errorf("failed to create missing IPPool %s: %w", poolName, err)
+	}
+
+	err = allocator.CreatePool(ctx, pool)
+	if apierrors.IsAlreadyExists(err) {
+		// Another node was first
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info("Created missing IPPool of the node subnetwork",
+		slog.String("pool", poolName),
+		slog.String("cidr", pool.Spec.CIDR),
+		slog.String("subnetwork", subnetwork),
+		slog.String("secondary_range", pool.Spec.SecondaryRangeName),
+	)
+	return nil
+}
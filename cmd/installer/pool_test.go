@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestEnsureSubnetworkPool(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	reply := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			t.Error(err)
+		}
+	}
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/projects/project/zones/europe-west1-b/instances/node-1":
+			reply(w, &compute.Instance{
+				Name: "node-1",
+				NetworkInterfaces: []*compute.NetworkInterface{{
+					Name:       "nic0",
+					Subnetwork: "https://www.googleapis.com/compute/v1/projects/project/regions/europe-west1/subnetworks/nodes",
+				}},
+			})
+		case "/projects/project/regions/europe-west1/subnetworks/nodes":
+			reply(w, &compute.Subnetwork{
+				Name:              "nodes",
+				SecondaryIpRanges: []*compute.SubnetworkSecondaryRange{{RangeName: "live-prod", IpCidrRange: "10.100.0.0/16"}},
+			})
+		default:
+			t.Errorf("unexpected GCE call %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer gce.Close()
+
+	// The instance comes from the environment, the endpoint from the plugin configuration
+	t.Setenv(identity.EnvProject, "project")
+	t.Setenv(identity.EnvZone, "europe-west1-b")
+	t.Setenv(identity.EnvInstance, "node-1")
+	cfg := config.Default()
+	cfg.ClusterID = "prod"
+	cfg.SecondaryRangeName = "live"
+	cfg.Identity.ComputeEndpoint = gce.URL
+
+	allocator := ipam.NewAllocator(dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{ipam.IPPoolGVR: "IPPoolList"}))
+
+	for range 2 {
+		if err := ensureSubnetworkPool(ctx, logger, cfg, allocator, gce.Client()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 1 {
+		t.Fatalf("pools = %d, want the pool of the node subnetwork", len(pools))
+	}
+	pool := pools[0]
+	if pool.Name != cfg.DefaultPoolName("nodes") || pool.Spec.CIDR != "10.100.0.0/16" || pool.Spec.SecondaryRangeName != "live-prod" {
+		t.Errorf("pool = %s %+v, want %s of secondary range live-prod", pool.Name, pool.Spec, cfg.DefaultPoolName("nodes"))
+	}
+	if len(pool.Spec.Allocations) == 0 {
+		t.Error("pool holds no system IPs, want them reserved like the plugin does")
+	}
+}
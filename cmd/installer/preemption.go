@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/gofrs/flock"
+	"github.com/samber/lo"
+	"golang.org/x/oauth2/google"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/instance"
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const (
+	// evacuateTimeout bounds the cleanup after a notice, GCE gives a preempted
+	// instance 30 seconds before it is stopped
+	evacuateTimeout = 25 * time.Second
+	// suspendCheckInterval is how often the wall clock is compared with the
+	// monotonic clock, which stands still while the instance is suspended
+	suspendCheckInterval = 10 * time.Second
+	// suspendThreshold is the clock gap taken as a suspend rather than a time step
+	suspendThreshold = 30 * time.Second
+)
+
+// watchInstanceEvents reacts to GCE lifecycle events of this instance until
+// ctx is done. Preemption and host maintenance terminations announced by the
+// metadata server evacuate the node: the aliases of its pods are removed and
+// their IPs released before the instance stops, so spot churn does not leave
+// them to the lease collector. Live migrations hold the GCE mutations of the
+// node until they are over. A resume after suspend drops the instance cache
+// and renews the leases that ran down while the instance was asleep.
+func watchInstanceEvents(ctx context.Context, logger *slog.Logger) error {
+	clientset, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	allocator := ipam.NewAllocator(dynamicClient)
+
+	logger.Info("Watching instance lifecycle events", slog.String("node", *nodeName))
+
+	evacuated := false
+	notice := func(event string) {
+		if evacuated {
+			return
+		}
+		evacuated = true
+		logger.Warn("Instance is about to stop, evacuating pod IPs", slog.String("event", event))
+		if err := evacuate(ctx, logger, allocator); err != nil {
+			logger.Error("Failed to evacuate pod IPs", slog.String("error", err.Error()))
+		}
+	}
+	notices := make(chan string, 2)
+	maintenance := make(chan string, 2)
+	quiesce := &quiescer{logger: logger, clientset: clientset}
+
+	subscribe := func(suffix string, handle func(v string)) {
+		for {
+			err := metadata.SubscribeWithContext(ctx, suffix, func(ctx context.Context, v string, ok bool) error {
+				if ok {
+					handle(v)
+				}
+				return nil
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("Instance event subscription ended", slog.String("suffix", suffix), slog.Any("error", err))
+			time.Sleep(time.Minute)
+		}
+	}
+	go subscribe("instance/preempted", func(v string) {
+		if v == "TRUE" {
+			notices <- "instance/preempted=" + v
+		}
+	})
+	go subscribe("instance/maintenance-event", func(v string) {
+		if v == "TERMINATE_ON_HOST_MAINTENANCE" {
+			notices <- "instance/maintenance-event=" + v
+			return
+		}
+		maintenance <- v
+	})
+
+	go func() {
+		ticker := time.NewTicker(suspendCheckInterval)
+		defer ticker.Stop()
+
+		last := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-notices:
+				// Evacuating takes the node mutation lock itself
+				quiesce.resume(ctx, "instance stopping")
+				notice(event)
+			case event := <-maintenance:
+				if event == migrateOnHostMaintenance {
+					quiesce.hold(ctx, event)
+				} else {
+					quiesce.resume(ctx, "live migration finished")
+				}
+			case now := <-ticker.C:
+				if quiesce.overdue(now) {
+					quiesce.resume(ctx, "end of live migration not announced")
+				}
+				if gap := suspendedFor(last, now); gap > suspendThreshold {
+					logger.Warn("Instance resumed from suspend", slog.Duration("suspended", gap))
+					if err := resume(ctx, logger, clientset, allocator); err != nil {
+						logger.Error("Failed to recover from suspend", slog.String("error", err.Error()))
+					}
+				}
+				last = now
+			}
+		}
+	}()
+	return nil
+}
+
+// suspendedFor returns how long the instance was suspended between two clock
+// readings. The monotonic clock does not advance while the guest is suspended,
+// the wall clock catches up once it is synced again on resume.
+func suspendedFor(last, now time.Time) time.Duration {
+	return now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+}
+
+// evacuate removes the aliases of the pods on this node from the instance in
+// a single update and releases their IPs. The node mutation lock is taken
+// directly, ahead of any queued plugin invocation. An IP whose pool release
+// fails stays release-pending, in case the instance comes back.
+func evacuate(ctx context.Context, logger *slog.Logger, allocator *ipam.Allocator) error {
+	ctx, cancel := context.WithTimeout(ctx, evacuateTimeout)
+	defer cancel()
+
+	computeService, projectID, zone, instanceName, err := thisInstance(ctx)
+	if err != nil {
+		return err
+	}
+	return evacuateInstance(ctx, logger, allocator, computeService, projectID, zone, instanceName)
+}
+
+// evacuateInstance is evacuate on the given instance
+func evacuateInstance(ctx context.Context, logger *slog.Logger, allocator *ipam.Allocator, computeService *compute.Service, projectID, zone, instanceName string) error {
+	lock := flock.New(filepath.Join(*hostRoot, mutation.DefaultLockPath))
+	if _, err := lock.TryLockContext(ctx, 50*time.Millisecond); err != nil {
+		return fmt.Errorf("failed to acquire node mutation lock: %w", err)
+	}
+	defer lock.Unlock()
+
+	attachments, err := liveAttachments()
+	if err != nil || len(attachments) == 0 {
+		return err
+	}
+
+	// IPs moving to another pod belong to their migration, the target node detaches them
+	migrations, err := allocator.ListMigrations(ctx, "")
+	if err != nil {
+		logger.Error("Failed to list migrations, evacuating all IPs", slog.String("error", err.Error()))
+	}
+	moving := make(map[string]bool)
+	for i := range migrations {
+		if ipam.MigrationActive(&migrations[i]) {
+			moving[ipam.CanonicalIP(migrations[i].Spec.IP)] = true
+		}
+	}
+	attachments = lo.Filter(attachments, func(a store.Attachment, _ int) bool {
+		if migrating(a, moving) {
+			logger.Info("Leaving migrating IP attached", slog.String("ip", a.IP))
+		}
+		return !migrating(a, moving)
+	})
+
+	if err := detachInstanceAliases(ctx, logger, computeService, projectID, zone, instanceName, attachments); err != nil {
+		return err
+	}
+
+	for _, a := range attachments {
+		attrs := []any{
+			slog.String("container", a.ContainerID),
+			slog.String("ip", a.IP),
+			slog.String("pool", a.Pool),
+		}
+
+		left := releaseAttachmentIPs(ctx, logger, allocator, a, "Failed to release evacuated IP")
+		state, err := setReleaseOutcome(a, left)
+		if err != nil {
+			logger.Error("Failed to record evacuated IP", append(attrs, slog.String("error", err.Error()))...)
+			continue
+		}
+		logger.Info("Evacuated IP", append(attrs, slog.Any("additionalIPs", a.AdditionalIPs), slog.String("state", string(state)))...)
+	}
+	return nil
+}
+
+// attachmentIPs returns every IP of the attachment, several for a pod that
+// asked for more than one
+func attachmentIPs(a store.Attachment) []string {
+	return append([]string{a.IP}, a.AdditionalIPs...)
+}
+
+// migrating reports whether an IP of the attachment moves to another pod
+func migrating(a store.Attachment, moving map[string]bool) bool {
+	return lo.ContainsBy(attachmentIPs(a), func(ip string) bool { return moving[ipam.CanonicalIP(ip)] })
+}
+
+// releaseAttachmentIPs releases every IP of a detached attachment from its
+// pool and returns those left to the deferred release, all of them when the
+// attachment does not name its pod
+func releaseAttachmentIPs(ctx context.Context, logger *slog.Logger, allocator *ipam.Allocator, a store.Attachment, failure string) []string {
+	if a.PodUID == "" {
+		return attachmentIPs(a)
+	}
+	var left []string
+	for _, ip := range attachmentIPs(a) {
+		if _, err := allocator.ReleaseIfOwner(ctx, a.Pool, ip, a.PodUID); err != nil {
+			logger.Error(failure,
+				slog.String("container", a.ContainerID),
+				slog.String("ip", ip),
+				slog.String("pool", a.Pool),
+				slog.String("error", err.Error()),
+			)
+			left = append(left, ip)
+		}
+	}
+	return left
+}
+
+// setReleaseOutcome records the attachment released, or release-pending with
+// only the IPs in left when some could not be released
+func setReleaseOutcome(a store.Attachment, left []string) (store.State, error) {
+	if len(left) == 0 {
+		return store.StateReleased, setState(a, store.StateReleased)
+	}
+	if err := setPendingIPs(a, left); err != nil {
+		return "", err
+	}
+	return store.StateReleasePending, setState(a, store.StateReleasePending)
+}
+
+// detachAliases removes the /32 aliases of every IP of attachments from the
+// network interfaces of this instance
+func detachAliases(ctx context.Context, logger *slog.Logger, attachments []store.Attachment) error {
+	computeService, projectID, zone, instanceName, err := thisInstance(ctx)
+	if err != nil {
+		return err
+	}
+	return detachInstanceAliases(ctx, logger, computeService, projectID, zone, instanceName, attachments)
+}
+
+// detachInstanceAliases is detachAliases on the given instance
+func detachInstanceAliases(ctx context.Context, logger *slog.Logger, computeService *compute.Service, projectID, zone, instanceName string, attachments []store.Attachment) error {
+	cfg, err := config.Load(filepath.Join(*hostRoot, *pluginConfigPath))
+	if err != nil {
+		return err
+	}
+
+	update := func() ([]*compute.Operation, error) {
+		inst, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get instance %s: %w", instanceName, err)
+		}
+
+		// Pod aliases are on the primary interface or, in the secondary NIC mode, on the pod interface
+		var ops []*compute.Operation
+		for _, nic := range inst.NetworkInterfaces {
+			// Only the aliases the plugin attached go, other ranges are passed through as read
+			remaining := lo.Filter(nic.AliasIpRanges, func(r *compute.AliasIpRange, _ int) bool {
+				return !lo.ContainsBy(attachments, func(a store.Attachment) bool {
+					return cfg.InClusterRange(r.SubnetworkRangeName, a.SecondaryRange) && lo.ContainsBy(attachmentIPs(a), func(ip string) bool {
+						return ipam.OwnsAlias(r.IpCidrRange, r.SubnetworkRangeName, ip, a.SecondaryRange)
+					})
+				})
+			})
+			if len(remaining) == len(nic.AliasIpRanges) {
+				continue
+			}
+
+			logger.Info("Removing pod aliases from instance",
+				slog.String("instance", instanceName),
+				slog.String("nic", nic.Name),
+				slog.Int("aliases", len(nic.AliasIpRanges)-len(remaining)),
+			)
+			op, err := computeService.Instances.UpdateNetworkInterface(projectID, zone, instanceName, nic.Name, &compute.NetworkInterface{
+				Fingerprint:   nic.Fingerprint,
+				AliasIpRanges: remaining,
+			}).Context(ctx).Do()
+			if err != nil {
+				return ops, err
+			}
+			ops = append(ops, op)
+		}
+		return ops, nil
+	}
+
+	ops, err := update()
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+		var retried []*compute.Operation
+		retried, err = update()
+		ops = append(ops, retried...)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update network interface: %w", err)
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	for _, op := range ops {
+		if _, err := computeService.ZoneOperations.Wait(projectID, zone, op.Name).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("failed to wait for network interface update operation: %w", err)
+		}
+	}
+	return instance.Invalidate(filepath.Join(*hostRoot, instance.DefaultCachePath))
+}
+
+// thisInstance returns a compute client and the identity of this instance
+func thisInstance(ctx context.Context) (*compute.Service, string, string, string, error) {
+	client, err := google.DefaultClient(ctx, compute.CloudPlatformScope)
+	if err != nil {
+		return nil, "", "", "", fmt.Errorf("failed to create google default client: %w", err)
+	}
+	computeService, err := compute.New(client)
+	if err != nil {
+		return nil, "", "", "", fmt.Errorf("failed to create compute service: %w", err)
+	}
+	projectID, err := metadata.ProjectIDWithContext(ctx)
+	if err != nil {
+		return nil, "", "", "", fmt.Errorf("failed to get project ID from metadata: %w", err)
+	}
+	zone, err := metadata.ZoneWithContext(ctx)
+	if err != nil {
+		return nil, "", "", "", fmt.Errorf("failed to get zone from metadata: %w", err)
+	}
+	instanceName, err := metadata.InstanceNameWithContext(ctx)
+	if err != nil {
+		return nil, "", "", "", fmt.Errorf("failed to get instance name from metadata: %w", err)
+	}
+	return computeService, projectID, zone, instanceName, nil
+}
+
+// resume brings the node back in sync after a suspend: the cached network
+// interface fingerprint is stale and leases may have run down meanwhile
+func resume(ctx context.Context, logger *slog.Logger, clientset kubernetes.Interface, allocator *ipam.Allocator) error {
+	if err := instance.Invalidate(filepath.Join(*hostRoot, instance.DefaultCachePath)); err != nil {
+		return fmt.Errorf("failed to invalidate instance cache: %w", err)
+	}
+	return renewLeasesOnce(ctx, logger, clientset, allocator)
+}
+
+// liveAttachments returns the attachments whose IP is attached to this
+// instance or still allocated in its pool
+func liveAttachments() ([]store.Attachment, error) {
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	attachments, err := s.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachments: %w", err)
+	}
+	return lo.Filter(attachments, func(a store.Attachment, _ int) bool {
+		return (a.State == store.StateAllocated || a.State == store.StateAttached) && a.IP != "" && a.Pool != ""
+	}), nil
+}
+
+func setState(a store.Attachment, state store.State) error {
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.SetState(a.ContainerID, a.IfName, state, nil)
+}
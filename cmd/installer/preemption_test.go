@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// fakeInstance serves instance node-1 of project in zone with aliases, and
+// applies network interface updates, recording the aliases of the last one in
+// updated
+func fakeInstance(t *testing.T, aliases []*compute.AliasIpRange, updated *[]string) *compute.Service {
+	t.Helper()
+	reply := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			t.Error(err)
+		}
+	}
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/projects/project/zones/zone/instances/node-1":
+			reply(w, &compute.Instance{
+				Name: "node-1",
+				NetworkInterfaces: []*compute.NetworkInterface{{
+					Name:          "nic0",
+					Subnetwork:    "https://www.googleapis.com/compute/v1/projects/project/regions/europe-west1/subnetworks/nodes",
+					AliasIpRanges: aliases,
+				}},
+			})
+		case "/projects/project/zones/zone/instances/node-1/updateNetworkInterface":
+			nic := &compute.NetworkInterface{}
+			if err := json.NewDecoder(r.Body).Decode(nic); err != nil {
+				t.Error(err)
+			}
+			aliases = nic.AliasIpRanges
+			*updated = []string{}
+			for _, r := range nic.AliasIpRanges {
+				*updated = append(*updated, r.IpCidrRange)
+			}
+			reply(w, &compute.Operation{Name: "operation", Status: "RUNNING"})
+		case "/projects/project/zones/zone/operations/operation/wait":
+			reply(w, &compute.Operation{Name: "operation", Status: "DONE"})
+		default:
+			t.Errorf("unexpected GCE call %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(gce.Close)
+	computeService, err := compute.NewService(context.Background(), option.WithEndpoint(gce.URL), option.WithHTTPClient(gce.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return computeService
+}
+
+// newNodeAllocator returns an allocator for a pool with allocations, and sets
+// up the host root of node-1 with attachments
+func newNodeAllocator(t *testing.T, allocations map[string]v1alpha1.IPAllocation, attachments ...store.Attachment) (*ipam.Allocator, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+	*hostRoot, *nodeName = t.TempDir(), "node-1"
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(*hostRoot, mutation.DefaultLockPath)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/24", SecondaryRangeName: "live", Allocations: allocations},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			ipam.IPPoolGVR:         "IPPoolList",
+			ipam.PodIPMigrationGVR: "PodIPMigrationList",
+		}, &unstructured.Unstructured{Object: obj})
+
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, a := range attachments {
+		err := s.Update(a.ContainerID, "eth0", func(current *store.Attachment) {
+			current.Netns, current.IP, current.AdditionalIPs, current.Pool, current.SecondaryRange = a.Netns, a.IP, a.AdditionalIPs, "pool", "live"
+			current.PodNamespace, current.PodName, current.PodUID = "default", a.PodName, a.PodUID
+			current.State = a.State
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ipam.NewAllocator(dynamicClient), dynamicClient
+}
+
+// nodeAttachment returns the attachment of container on node-1
+func nodeAttachment(t *testing.T, container string) *store.Attachment {
+	t.Helper()
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	a, err := s.Get(container, "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// allocatedIPs returns the IPs allocated to pods in the pool
+func allocatedIPs(t *testing.T, allocator *ipam.Allocator) []string {
+	t.Helper()
+	pools, err := allocator.ListPools(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	for ip, allocation := range pools[0].Spec.Allocations {
+		if allocation.System == "" {
+			ips = append(ips, ip)
+		}
+	}
+	slices.Sort(ips)
+	return ips
+}
+
+func TestEvacuateAdditionalIPs(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	allocator, _ := newNodeAllocator(t, map[string]v1alpha1.IPAllocation{
+		"10.8.0.5": {PodUID: "pod-uid", NodeName: "node-1"},
+		"10.8.0.6": {PodUID: "pod-uid", NodeName: "node-1", Additional: true},
+		"10.8.0.7": {PodUID: "pod-uid", NodeName: "node-1", Additional: true},
+	}, store.Attachment{
+		ContainerID: "container", IP: "10.8.0.5", AdditionalIPs: []string{"10.8.0.6", "10.8.0.7"},
+		PodName: "pod", PodUID: "pod-uid", State: store.StateAttached,
+	})
+	var updated []string
+	computeService := fakeInstance(t, []*compute.AliasIpRange{
+		{IpCidrRange: "10.8.0.5/32", SubnetworkRangeName: "live"},
+		{IpCidrRange: "10.8.0.6/32", SubnetworkRangeName: "live"},
+		{IpCidrRange: "10.8.0.7/32", SubnetworkRangeName: "live"},
+		{IpCidrRange: "10.9.0.0/24", SubnetworkRangeName: "gke-pods"},
+	}, &updated)
+
+	if err := evacuateInstance(context.Background(), logger, allocator, computeService, "project", "zone", "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(updated, []string{"10.9.0.0/24"}) {
+		t.Errorf("aliases left = %v, want every IP of the pod detached", updated)
+	}
+	if ips := allocatedIPs(t, allocator); len(ips) != 0 {
+		t.Errorf("allocated = %v, want every IP of the pod released", ips)
+	}
+	if a := nodeAttachment(t, "container"); a.State != store.StateReleased {
+		t.Errorf("attachment state = %s, want released", a.State)
+	}
+}
+
+func TestEvacuate(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		podUID        string
+		migrating     bool
+		failRelease   bool
+		wantState     store.State
+		wantAllocated bool
+		wantAttached  bool
+	}{
+		{name: "released", podUID: "pod-uid", wantState: store.StateReleased},
+		{name: "migrating IP kept", podUID: "pod-uid", migrating: true, wantState: store.StateAttached, wantAllocated: true, wantAttached: true},
+		{name: "release failed", podUID: "pod-uid", failRelease: true, wantState: store.StateReleasePending, wantAllocated: true},
+		{name: "pod unknown", wantState: store.StateReleasePending, wantAllocated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocator, dynamicClient := newNodeAllocator(t, map[string]v1alpha1.IPAllocation{
+				"10.8.0.5": {PodName: "pod", PodNamespace: "default", PodUID: "pod-uid", NodeName: "node-1"},
+			}, store.Attachment{
+				ContainerID: "container", IP: "10.8.0.5", PodName: "pod", PodUID: tt.podUID, State: store.StateAttached,
+			})
+			if tt.migrating {
+				if _, err := allocator.CreateMigration(ctx, &v1alpha1.PodIPMigration{
+					ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", CreationTimestamp: metav1.Now()},
+					Spec:       v1alpha1.PodIPMigrationSpec{IP: "10.8.0.5", SourcePod: "pod", SourceNode: "node-1"},
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.failRelease {
+				dynamicClient.PrependReactor("update", "ippools", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("etcdserver: request timed out")
+				})
+			}
+			var updated []string
+			computeService := fakeInstance(t, []*compute.AliasIpRange{
+				{IpCidrRange: "10.8.0.5/32", SubnetworkRangeName: "live"},
+			}, &updated)
+
+			if err := evacuateInstance(ctx, logger, allocator, computeService, "project", "zone", "node-1"); err != nil {
+				t.Fatal(err)
+			}
+			if attached := updated == nil; attached != tt.wantAttached {
+				t.Errorf("alias attached = %v (left %v), want %v", attached, updated, tt.wantAttached)
+			}
+			if allocated := slices.Contains(allocatedIPs(t, allocator), "10.8.0.5"); allocated != tt.wantAllocated {
+				t.Errorf("allocated = %v, want %v", allocated, tt.wantAllocated)
+			}
+			if a := nodeAttachment(t, "container"); a.State != tt.wantState {
+				t.Errorf("attachment state = %s, want %s", a.State, tt.wantState)
+			}
+		})
+	}
+}
+
+// A suspended guest cannot be faked, its wall clock moves apart from the
+// monotonic one. Readings of a guest that kept running must not count.
+func TestSuspendedFor(t *testing.T) {
+	last := time.Now()
+
+	tests := []struct {
+		name string
+		now  time.Time
+	}{
+		{name: "next tick", now: last.Add(suspendCheckInterval)},
+		{name: "long stall", now: last.Add(10 * suspendThreshold)},
+		{name: "readings without a monotonic clock", now: last.Round(0).Add(suspendCheckInterval)},
+		{name: "now", now: time.Now()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The wall and monotonic clocks are read a few nanoseconds apart
+			if gap := suspendedFor(last, tt.now); gap.Abs() > time.Millisecond {
+				t.Errorf("suspendedFor() = %v, want none", gap)
+			}
+		})
+	}
+}
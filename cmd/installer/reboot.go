@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	compute "google.golang.org/api/compute/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const (
+	// bootIDPath is where the installer records the boot of the node whose
+	// attachments it last recovered
+	bootIDPath = "/var/lib/gcp-cni/boot-id"
+	// rebootRecoveryTimeout bounds the recovery at startup
+	rebootRecoveryTimeout = 2 * time.Minute
+)
+
+// recoverFromReboot reconciles the node-local allocation database with the
+// network namespaces and the aliases of the instance once per boot of the
+// node. Sandboxes do not survive a reboot, but their attachments and aliases
+// do: the aliases of sandboxes that are still there are attached again where
+// missing, the IPs of sandboxes that are gone are detached and released
+// unless their pod is still on the node, whose recreated sandbox reuses them.
+func recoverFromReboot(ctx context.Context, logger *slog.Logger) error {
+	bootID, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return fmt.Errorf("failed to read boot ID: %w", err)
+	}
+	bootID = bytes.TrimSpace(bootID)
+
+	path := filepath.Join(*hostRoot, bootIDPath)
+	if recovered, err := os.ReadFile(path); err == nil && bytes.Equal(bytes.TrimSpace(recovered), bootID) {
+		logger.Debug("Attachments already recovered for this boot", slog.String("boot_id", string(bootID)))
+		return nil
+	}
+
+	clientset, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rebootRecoveryTimeout)
+	defer cancel()
+
+	logger.Info("Recovering attachments after node boot", slog.String("boot_id", string(bootID)))
+	computeService, projectID, zone, instanceName, err := thisInstance(ctx)
+	if err != nil {
+		return err
+	}
+	err = recoverAttachments(ctx, logger, clientset, ipam.NewAllocator(dynamicClient), computeService, projectID, zone, instanceName)
+	if err != nil {
+		return err
+	}
+
+	// Recorded only once recovered, a failed recovery runs again on the next start
+	if err := writeFileAtomic(path, append(bootID, '\n')); err != nil {
+		return fmt.Errorf("failed to record boot ID: %w", err)
+	}
+	return nil
+}
+
+func recoverAttachments(ctx context.Context, logger *slog.Logger, clientset kubernetes.Interface, allocator *ipam.Allocator, computeService *compute.Service, projectID, zone, instanceName string) error {
+	lock := flock.New(filepath.Join(*hostRoot, mutation.DefaultLockPath))
+	if _, err := lock.TryLockContext(ctx, 50*time.Millisecond); err != nil {
+		return fmt.Errorf("failed to acquire node mutation lock: %w", err)
+	}
+	defer lock.Unlock()
+
+	live, err := liveAttachments()
+	if err != nil || len(live) == 0 {
+		return err
+	}
+
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + *nodeName})
+	if err != nil {
+		return fmt.Errorf("failed to list pods of node %s: %w", *nodeName, err)
+	}
+	onNode := make(map[string]bool)
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp == nil {
+			onNode[string(pod.UID)] = true
+		}
+	}
+
+	// IPs moving to another pod belong to their migration, the target node detaches them
+	migrations, err := allocator.ListMigrations(ctx, "")
+	if err != nil {
+		return err
+	}
+	moving := make(map[string]bool)
+	for i := range migrations {
+		if ipam.MigrationActive(&migrations[i]) {
+			moving[ipam.CanonicalIP(migrations[i].Spec.IP)] = true
+		}
+	}
+
+	var alive, gone []store.Attachment
+	for _, a := range live {
+		attrs := []any{
+			slog.String("container", a.ContainerID),
+			slog.String("ip", a.IP),
+			slog.String("pool", a.Pool),
+		}
+		switch {
+		case sandboxAlive(a, onNode):
+			if !a.Routed {
+				alive = append(alive, a)
+			}
+		case onNode[a.PodUID]:
+			logger.Info("Sandbox did not survive, leaving IP to the recreated sandbox of its pod", attrs...)
+		case migrating(a, moving):
+			logger.Info("Sandbox did not survive, leaving migrating IP attached", attrs...)
+		default:
+			gone = append(gone, a)
+		}
+	}
+
+	if err := attachInstanceAliases(ctx, logger, computeService, projectID, zone, instanceName, alive, "surviving sandboxes"); err != nil {
+		return err
+	}
+	if len(gone) == 0 {
+		return nil
+	}
+	if err := detachInstanceAliases(ctx, logger, computeService, projectID, zone, instanceName, gone); err != nil {
+		return err
+	}
+
+	for _, a := range gone {
+		attrs := []any{
+			slog.String("container", a.ContainerID),
+			slog.String("ip", a.IP),
+			slog.String("pool", a.Pool),
+		}
+
+		left := releaseAttachmentIPs(ctx, logger, allocator, a, "Failed to release IP of lost sandbox")
+		state, err := setReleaseOutcome(a, left)
+		if err != nil {
+			logger.Error("Failed to record IP of lost sandbox", append(attrs, slog.String("error", err.Error()))...)
+			continue
+		}
+		logger.Info("Cleaned up IP of lost sandbox", append(attrs, slog.Any("additionalIPs", a.AdditionalIPs), slog.String("state", string(state)))...)
+	}
+	return nil
+}
+
+// sandboxAlive reports whether the sandbox of the attachment survived, by its
+// network namespace. Attachments recorded before the namespace was are judged
+// by their pod still being on the node, as are those of sandboxed runtimes
+// recorded by the namespace of their sandbox process.
+func sandboxAlive(a store.Attachment, onNode map[string]bool) bool {
+	if a.Netns == "" || strings.HasPrefix(a.Netns, "/proc/") {
+		return onNode[a.PodUID]
+	}
+	_, err := os.Stat(filepath.Join(*hostRoot, a.Netns))
+	return err == nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestRecoverAttachmentsAdditionalIPs(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	allocator, _ := newNodeAllocator(t, map[string]v1alpha1.IPAllocation{
+		"10.8.0.5": {PodUID: "pod-uid", NodeName: "node-1"},
+		"10.8.0.6": {PodUID: "pod-uid", NodeName: "node-1", Additional: true},
+	}, store.Attachment{
+		ContainerID: "container", Netns: "/var/run/netns/gone", IP: "10.8.0.5", AdditionalIPs: []string{"10.8.0.6"},
+		PodName: "pod", PodUID: "pod-uid", State: store.StateAttached,
+	})
+	var updated []string
+	computeService := fakeInstance(t, []*compute.AliasIpRange{
+		{IpCidrRange: "10.8.0.5/32", SubnetworkRangeName: "live"},
+		{IpCidrRange: "10.8.0.6/32", SubnetworkRangeName: "live"},
+	}, &updated)
+
+	err := recoverAttachments(context.Background(), logger, kubefake.NewSimpleClientset(), allocator, computeService, "project", "zone", "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(updated, []string{}) {
+		t.Errorf("aliases left = %v, want every IP of the lost sandbox detached", updated)
+	}
+	if ips := allocatedIPs(t, allocator); len(ips) != 0 {
+		t.Errorf("allocated = %v, want every IP of the lost sandbox released", ips)
+	}
+	if a := nodeAttachment(t, "container"); a.State != store.StateReleased {
+		t.Errorf("attachment state = %s, want released", a.State)
+	}
+}
+
+func TestSandboxAlive(t *testing.T) {
+	*hostRoot = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(*hostRoot, "/var/run/netns"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*hostRoot, "/var/run/netns/alive"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	onNode := map[string]bool{"running-uid": true}
+
+	tests := []struct {
+		name   string
+		netns  string
+		podUID string
+		want   bool
+	}{
+		{name: "namespace still there", netns: "/var/run/netns/alive", podUID: "gone-uid", want: true},
+		{name: "namespace gone", netns: "/var/run/netns/gone", podUID: "running-uid"},
+		{name: "recorded before namespaces, pod on the node", podUID: "running-uid", want: true},
+		{name: "recorded before namespaces, pod gone", podUID: "gone-uid"},
+		{name: "sandboxed runtime, pod on the node", netns: "/proc/1234/ns/net", podUID: "running-uid", want: true},
+		{name: "sandboxed runtime, pod gone", netns: "/proc/1234/ns/net", podUID: "gone-uid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sandboxAlive(store.Attachment{Netns: tt.netns, PodUID: tt.podUID}, onNode); got != tt.want {
+				t.Errorf("sandboxAlive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecoverAttachments(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	allocation := func(name string) v1alpha1.IPAllocation {
+		return v1alpha1.IPAllocation{PodName: name, PodNamespace: "default", PodUID: name + "-uid", NodeName: "node-1"}
+	}
+	attachment := func(name, ip, netns string, state store.State) store.Attachment {
+		return store.Attachment{ContainerID: name, Netns: netns, IP: ip, PodName: name, PodUID: name + "-uid", State: state}
+	}
+	allocator, _ := newNodeAllocator(t, map[string]v1alpha1.IPAllocation{
+		"10.8.0.2": allocation("alive"),
+		"10.8.0.3": allocation("gone"),
+		"10.8.0.4": allocation("recreated"),
+		"10.8.0.5": allocation("releasing"),
+		"10.8.0.6": allocation("pending"),
+	},
+		attachment("alive", "10.8.0.2", "/var/run/netns/alive", store.StateAttached),
+		attachment("gone", "10.8.0.3", "/var/run/netns/gone", store.StateAttached),
+		attachment("recreated", "10.8.0.4", "/var/run/netns/recreated", store.StateAllocated),
+		attachment("releasing", "10.8.0.5", "/var/run/netns/releasing", store.StateReleasing),
+		attachment("pending", "10.8.0.6", "/var/run/netns/pending", store.StateReleasePending),
+	)
+	if err := os.MkdirAll(filepath.Join(*hostRoot, "/var/run/netns"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*hostRoot, "/var/run/netns/alive"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The sandbox of the recreated pod is set up again after the recovery
+	clientset := kubefake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "recreated", UID: "recreated-uid"},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+	})
+	var updated []string
+	computeService := fakeInstance(t, []*compute.AliasIpRange{
+		{IpCidrRange: "10.8.0.3/32", SubnetworkRangeName: "live"},
+		{IpCidrRange: "10.8.0.4/32", SubnetworkRangeName: "live"},
+		{IpCidrRange: "10.8.0.5/32", SubnetworkRangeName: "live"},
+	}, &updated)
+
+	if err := recoverAttachments(context.Background(), logger, clientset, allocator, computeService, "project", "zone", "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(updated)
+	if want := []string{"10.8.0.2/32", "10.8.0.4/32", "10.8.0.5/32"}; !slices.Equal(updated, want) {
+		t.Errorf("aliases = %v, want %v: the surviving sandbox's attached again, the lost one's detached", updated, want)
+	}
+	if ips, want := allocatedIPs(t, allocator), []string{"10.8.0.2", "10.8.0.4", "10.8.0.5", "10.8.0.6"}; !slices.Equal(ips, want) {
+		t.Errorf("allocated = %v, want %v: only the IP of the lost sandbox released", ips, want)
+	}
+	for container, want := range map[string]store.State{
+		"alive":     store.StateAttached,
+		"gone":      store.StateReleased,
+		"recreated": store.StateAllocated,
+		"releasing": store.StateReleasing,
+		"pending":   store.StateReleasePending,
+	} {
+		if a := nodeAttachment(t, container); a.State != want {
+			t.Errorf("state of %s = %s, want %s", container, a.State, want)
+		}
+	}
+}
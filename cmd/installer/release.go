@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// releasePending completes the pool releases CNI DEL deferred because the
+// Kubernetes API was unavailable, every interval until ctx is done.
+func releasePending(ctx context.Context, logger *slog.Logger, interval time.Duration) error {
+	clientset, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	allocator := ipam.NewAllocator(dynamicClient)
+
+	logger.Info("Completing deferred IP releases",
+		slog.String("node", *nodeName),
+		slog.Duration("interval", interval),
+	)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := releasePendingOnce(ctx, logger, clientset, allocator); err != nil {
+				logger.Error("Failed to complete deferred IP releases", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func releasePendingOnce(ctx context.Context, logger *slog.Logger, clientset kubernetes.Interface, allocator *ipam.Allocator) error {
+	pending, err := pendingReleases()
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	// A pod carrying the IP as its live IP or the target of an active
+	// PodIPMigration took the IP over, keyed by IP to the UID of that pod. The
+	// target itself releases the IP it took over like any other.
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	moved := make(map[string]string)
+	for _, pod := range pods.Items {
+		if ip := pod.Annotations[ipam.LiveIPAnnotation]; ip != "" {
+			moved[ipam.CanonicalIP(ip)] = string(pod.UID)
+		}
+	}
+	migrations, err := allocator.ListMigrations(ctx, "")
+	if err != nil {
+		return err
+	}
+	for i := range migrations {
+		if ipam.MigrationActive(&migrations[i]) {
+			moved[ipam.CanonicalIP(migrations[i].Spec.IP)] = migrations[i].Status.TargetPodUID
+		}
+	}
+
+	for _, a := range pending {
+		attrs := []any{
+			slog.String("container", a.ContainerID),
+			slog.String("pool", a.Pool),
+		}
+
+		// A pod with several IPs has them all deferred, the released ones are
+		// dropped from the attachment so a retry never frees them again
+		var left []string
+		for _, ip := range append([]string{a.IP}, a.AdditionalIPs...) {
+			ipAttrs := append(attrs, slog.String("ip", ip))
+			owner, ok := moved[ipam.CanonicalIP(ip)]
+			switch {
+			case ok && (owner == "" || owner != a.PodUID):
+				logger.Info("Deferred IP moved to a migrated pod, skipping release", ipAttrs...)
+			case a.PodUID != "":
+				released, err := allocator.ReleaseIfOwner(ctx, a.Pool, ip, a.PodUID)
+				if err != nil {
+					logger.Error("Failed to release deferred IP", append(ipAttrs, slog.String("error", err.Error()))...)
+					left = append(left, ip)
+					continue
+				}
+				if !released {
+					logger.Info("Deferred IP is owned by another pod, skipping release", ipAttrs...)
+				}
+			default:
+				if err := allocator.Release(ctx, a.Pool, ip); err != nil {
+					logger.Error("Failed to release deferred IP", append(ipAttrs, slog.String("error", err.Error()))...)
+					left = append(left, ip)
+					continue
+				}
+			}
+		}
+		if len(left) > 0 {
+			if err := setPendingIPs(a, left); err != nil {
+				logger.Error("Failed to record deferred release", append(attrs, slog.String("error", err.Error()))...)
+			}
+			continue
+		}
+
+		if err := setReleased(a); err != nil {
+			logger.Error("Failed to record deferred release", append(attrs, slog.String("error", err.Error()))...)
+			continue
+		}
+		logger.Info("Completed deferred IP release", append(attrs, slog.String("ip", a.IP), slog.Any("additionalIPs", a.AdditionalIPs))...)
+	}
+	return nil
+}
+
+// pendingReleases returns the attachments waiting for a pool release. The
+// database is opened only for the read since the plugin shares its lock.
+func pendingReleases() ([]store.Attachment, error) {
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	attachments, err := s.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachments: %w", err)
+	}
+
+	var pending []store.Attachment
+	for _, a := range attachments {
+		if a.State == store.StateReleasePending && a.IP != "" && a.Pool != "" {
+			pending = append(pending, a)
+		}
+	}
+	return pending, nil
+}
+
+func setReleased(a store.Attachment) error {
+	return setState(a, store.StateReleased)
+}
+
+// setPendingIPs leaves the IPs of a that are still to release
+func setPendingIPs(a store.Attachment, ips []string) error {
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Update(a.ContainerID, a.IfName, func(current *store.Attachment) {
+		current.IP, current.AdditionalIPs = ips[0], ips[1:]
+	})
+}
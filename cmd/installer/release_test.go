@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestReleasePendingOnce(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	*hostRoot, *nodeName = t.TempDir(), "node-1"
+
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/24",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.5": {PodUID: "pod-uid", NodeName: "node-1"},
+				"10.8.0.6": {PodUID: "pod-uid", NodeName: "node-1", Additional: true},
+				"10.8.0.7": {PodUID: "pod-uid", NodeName: "node-1", Additional: true},
+				"10.8.0.8": {PodUID: "other-uid", NodeName: "node-2"},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			ipam.IPPoolGVR:         "IPPoolList",
+			ipam.PodIPMigrationGVR: "PodIPMigrationList",
+		},
+		&unstructured.Unstructured{Object: obj})
+	allocator := ipam.NewAllocator(dynamicClient)
+
+	// The release of the second IP fails once
+	updates := 0
+	dynamicClient.PrependReactor("update", "ippools", func(k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 2 {
+			return true, nil, errors.New("etcdserver: request timed out")
+		}
+		return false, nil, nil
+	})
+
+	s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Update("container", "eth0", func(a *store.Attachment) {
+		a.IP, a.AdditionalIPs, a.Pool, a.PodUID = "10.8.0.5", []string{"10.8.0.6", "10.8.0.7", "10.8.0.8"}, "pool", "pod-uid"
+		a.State = store.StateReleasePending
+	})
+	s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment := func() *store.Attachment {
+		t.Helper()
+		s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		a, err := s.Get("container", "eth0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	allocated := func() []string {
+		t.Helper()
+		pools, err := allocator.ListPools(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ips []string
+		for ip, allocation := range pools[0].Spec.Allocations {
+			if allocation.System == "" {
+				ips = append(ips, ip)
+			}
+		}
+		slices.Sort(ips)
+		return ips
+	}
+
+	clientset := kubefake.NewSimpleClientset()
+	if err := releasePendingOnce(ctx, logger, clientset, allocator); err != nil {
+		t.Fatal(err)
+	}
+	if a := attachment(); a.State != store.StateReleasePending || a.IP != "10.8.0.6" || len(a.AdditionalIPs) != 0 {
+		t.Fatalf("attachment = %s %s %v, want only the IP whose release failed pending", a.State, a.IP, a.AdditionalIPs)
+	}
+	if ips := allocated(); !slices.Equal(ips, []string{"10.8.0.6", "10.8.0.8"}) {
+		t.Fatalf("allocated = %v, want the failed IP and the IP of another pod", ips)
+	}
+
+	if err := releasePendingOnce(ctx, logger, clientset, allocator); err != nil {
+		t.Fatal(err)
+	}
+	if a := attachment(); a.State != store.StateReleased {
+		t.Errorf("attachment state = %s, want released", a.State)
+	}
+	if ips := allocated(); !slices.Equal(ips, []string{"10.8.0.8"}) {
+		t.Errorf("allocated = %v, want every IP of the pod released", ips)
+	}
+}
+
+func TestReleasePendingMigrated(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		podUID string
+		phase  v1alpha1.PodIPMigrationPhase
+		want   []string
+	}{
+		{name: "source of an active migration", podUID: "source-uid", phase: v1alpha1.PodIPMigrationAttached, want: []string{"10.8.0.5"}},
+		{name: "source of an unclaimed migration", podUID: "source-uid", phase: v1alpha1.PodIPMigrationPending, want: []string{"10.8.0.5"}},
+		{name: "target of a completed migration", podUID: "target-uid", phase: v1alpha1.PodIPMigrationCompleted},
+		{name: "source of a failed migration", podUID: "source-uid", phase: v1alpha1.PodIPMigrationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocator, _ := newNodeAllocator(t, map[string]v1alpha1.IPAllocation{
+				"10.8.0.5": {PodName: "pod", PodNamespace: "default", PodUID: tt.podUID, NodeName: "node-1"},
+			}, store.Attachment{
+				ContainerID: "container", IP: "10.8.0.5", PodName: "pod", PodUID: tt.podUID, State: store.StateReleasePending,
+			})
+			if _, err := allocator.CreateMigration(ctx, &v1alpha1.PodIPMigration{
+				ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", CreationTimestamp: metav1.Now()},
+				Spec:       v1alpha1.PodIPMigrationSpec{IP: "10.8.0.5", SourcePod: "pod", SourceNode: "node-2"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := allocator.ModifyMigration(ctx, "default", "pod", func(m *v1alpha1.PodIPMigration) error {
+				if tt.phase != v1alpha1.PodIPMigrationPending {
+					m.Status.TargetPodUID, m.Status.TargetNode = "target-uid", "node-1"
+				}
+				ipam.SetMigrationPhase(m, tt.phase, nil)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := releasePendingOnce(ctx, logger, kubefake.NewSimpleClientset(), allocator); err != nil {
+				t.Fatal(err)
+			}
+			if ips := allocatedIPs(t, allocator); !slices.Equal(ips, tt.want) {
+				t.Errorf("allocated = %v, want %v", ips, tt.want)
+			}
+			if a := nodeAttachment(t, "container"); a.State != store.StateReleased {
+				t.Errorf("attachment state = %s, want released", a.State)
+			}
+		})
+	}
+}
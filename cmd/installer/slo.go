@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/telemetry"
+)
+
+const (
+	sloCheckInterval = time.Minute
+	// sloBurnThreshold is the burn rate that spends a 30 day error budget in
+	// about two days, both windows have to exceed it before the node is flagged
+	sloBurnThreshold = 14.4
+	// sloMinOperations keeps a single slow pod on a quiet node from flagging it
+	sloMinOperations = 5
+)
+
+var sloWindows = []time.Duration{5 * time.Minute, time.Hour}
+
+func addLatencySLO() telemetry.SLO {
+	return telemetry.SLO{Latency: *addLatency, Objective: *addObjective}
+}
+
+// addLatencyBurns evaluates the ADD latency SLO over the operation records
+// the plugin keeps on the host
+func addLatencyBurns(now time.Time) ([]telemetry.Burn, bool, error) {
+	records, err := telemetry.List(filepath.Join(*hostRoot, telemetry.DefaultDir), 0)
+	if err != nil {
+		return nil, false, err
+	}
+
+	slo := addLatencySLO()
+	burns := make([]telemetry.Burn, 0, len(sloWindows))
+	violating := true
+	for _, window := range sloWindows {
+		burn := slo.BurnRate(records, window, now)
+		burns = append(burns, burn)
+		if burn.Total < sloMinOperations || burn.Rate < sloBurnThreshold {
+			violating = false
+		}
+	}
+	return burns, violating, nil
+}
+
+// trackAddLatency checks the ADD latency SLO of this node every minute until
+// ctx is done. IP assignment dominates pod cold start, so a node that keeps
+// burning its error budget is logged and gets a warning event, and a normal
+// event once it recovers.
+func trackAddLatency(ctx context.Context, logger *slog.Logger) error {
+	clientset, _, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Tracking ADD latency SLO",
+		slog.Duration("latency", *addLatency),
+		slog.Float64("objective", *addObjective),
+	)
+
+	go func() {
+		ticker := time.NewTicker(sloCheckInterval)
+		defer ticker.Stop()
+
+		violating := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				burns, v, err := addLatencyBurns(now)
+				if err != nil {
+					logger.Error("Failed to evaluate ADD latency SLO", slog.String("error", err.Error()))
+					continue
+				}
+				if v == violating {
+					continue
+				}
+				violating = v
+
+				attrs := []any{slog.Duration("latency", *addLatency)}
+				for _, burn := range burns {
+					attrs = append(attrs, slog.Float64("burnRate"+burn.Window.String(), burn.Rate))
+				}
+				eventType, reason := corev1.EventTypeNormal, "AddLatencySLORecovered"
+				message := fmt.Sprintf("Pod network setup is back within its %s latency objective", *addLatency)
+				if violating {
+					logger.Warn("Node violates ADD latency SLO", attrs...)
+					eventType, reason = corev1.EventTypeWarning, "AddLatencySLOViolated"
+					message = fmt.Sprintf("Pod network setup misses its %s latency objective, burn rate %.1f over %s",
+						*addLatency, burns[len(burns)-1].Rate, burns[len(burns)-1].Window)
+				} else {
+					logger.Info("Node recovered from ADD latency SLO violation", attrs...)
+				}
+				if err := emitNodeEvent(ctx, clientset, eventType, reason, message); err != nil {
+					logger.Error("Failed to emit node event", slog.String("reason", reason), slog.String("error", err.Error()))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// emitNodeEvent records an event on this node
+func emitNodeEvent(ctx context.Context, clientset kubernetes.Interface, eventType, reason, message string) error {
+	node, err := clientset.CoreV1().Nodes().Get(ctx, *nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", *nodeName, err)
+	}
+
+	now := metav1.Now()
+	_, err = clientset.CoreV1().Events(metav1.NamespaceDefault).Create(ctx, &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: *nodeName + ".",
+			Namespace:    metav1.NamespaceDefault,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind: "Node",
+			Name: node.Name,
+			UID:  node.UID,
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: "gcp-cni-installer", Host: *nodeName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create event: %w", err)
+	}
+	return nil
+}
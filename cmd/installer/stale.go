@@ -0,0 +1,113 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/samber/lo"
+	"google.golang.org/api/compute/v1"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/instance"
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// removeStaleAliases removes the aliases of the node in secondary ranges of
+// the cluster's IPPools that no allocation of those pools on the node
+// accounts for.
+// Instances that are reused or recreated keep the aliases of a previous life,
+// in this or another cluster, and GCE keeps routing their IPs to the node
+// while the pools hand them out again.
+func removeStaleAliases(ctx context.Context, logger *slog.Logger) error {
+	_, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	computeService, projectID, zone, instanceName, err := thisInstance(ctx)
+	if err != nil {
+		return err
+	}
+	return removeInstanceStaleAliases(ctx, logger, dynamicClient, computeService, projectID, zone, instanceName)
+}
+
+// removeInstanceStaleAliases is removeStaleAliases on the given clients
+func removeInstanceStaleAliases(ctx context.Context, logger *slog.Logger, dynamicClient dynamic.Interface, computeService *compute.Service, projectID, zone, instanceName string) error {
+	cfg, err := config.Load(filepath.Join(*hostRoot, *pluginConfigPath))
+	if err != nil {
+		return err
+	}
+
+	// ADD allocates before it attaches under the lock, so every alias attached
+	// by now has its allocation in the pools read below
+	lock := flock.New(filepath.Join(*hostRoot, mutation.DefaultLockPath))
+	if _, err := lock.TryLockContext(ctx, 50*time.Millisecond); err != nil {
+		return fmt.Errorf("failed to acquire node mutation lock: %w", err)
+	}
+	defer lock.Unlock()
+
+	pools, err := ipam.NewAllocator(dynamicClient).ListPools(ctx)
+	if err != nil {
+		return err
+	}
+	inst, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get instance %s: %w", instanceName, err)
+	}
+	// The primary interface or, in the secondary NIC mode, the pod interface
+	var nic *compute.NetworkInterface
+	for _, n := range inst.NetworkInterfaces {
+		if cfg.NetworkInterface.Subnetwork == "" || ipam.SubnetworkName(n.Subnetwork) == cfg.NetworkInterface.Subnetwork {
+			nic = n
+			break
+		}
+	}
+	if nic == nil {
+		return nil
+	}
+
+	// GKE names nodes after their instances
+	node := cmp.Or(*nodeName, instanceName)
+	defaultRange := cfg.ClusterRange(ipam.AliasRange(cfg.SecondaryRangeName))
+	subnetwork := ipam.SubnetworkName(nic.Subnetwork)
+	stale, kept := lo.FilterReject(nic.AliasIpRanges, func(r *compute.AliasIpRange, _ int) bool {
+		return cfg.InClusterRange(r.SubnetworkRangeName) &&
+			ipam.StaleAlias(pools, node, subnetwork, defaultRange, r.IpCidrRange, r.SubnetworkRangeName)
+	})
+	if len(stale) == 0 {
+		logger.Debug("No stale aliases on the instance", slog.String("instance", instanceName))
+		return nil
+	}
+
+	op, err := computeService.Instances.UpdateNetworkInterface(projectID, zone, instanceName, nic.Name, &compute.NetworkInterface{
+		Fingerprint:   nic.Fingerprint,
+		AliasIpRanges: kept,
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to update network interface: %w", err)
+	}
+	done, err := computeService.ZoneOperations.Wait(projectID, zone, op.Name).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to wait for network interface update operation: %w", err)
+	}
+	if done.Status != "DONE" {
+		return fmt.Errorf("network interface update operation %s still running", op.Name)
+	}
+	if done.Error != nil && len(done.Error.Errors) > 0 {
+		return fmt.Errorf("network interface update operation %s failed: %s", op.Name, done.Error.Errors[0].Message)
+	}
+	logger.Info("Removed stale aliases from instance",
+		slog.String("instance", instanceName),
+		slog.String("nic", nic.Name),
+		slog.Any("aliases", lo.Map(stale, func(r *compute.AliasIpRange, _ int) string {
+			return r.IpCidrRange + " (" + r.SubnetworkRangeName + ")"
+		})),
+	)
+	return instance.Invalidate(filepath.Join(*hostRoot, instance.DefaultCachePath))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestRemoveStaleAliases(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	*hostRoot, *nodeName = t.TempDir(), "node-1"
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(*hostRoot, mutation.DefaultLockPath)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:               "10.8.0.0/20",
+			Subnet:             "projects/project/regions/europe-west1/subnetworks/nodes",
+			SecondaryRangeName: "live",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.5": {PodUID: "a", NodeName: "node-1"},
+				"10.8.0.7": {PodUID: "b", NodeName: "node-2"},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{ipam.IPPoolGVR: "IPPoolList"},
+		&unstructured.Unstructured{Object: obj})
+
+	var updated *compute.NetworkInterface
+	reply := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			t.Error(err)
+		}
+	}
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/projects/project/zones/zone/instances/node-1":
+			reply(w, &compute.Instance{
+				Name: "node-1",
+				NetworkInterfaces: []*compute.NetworkInterface{{
+					Name:       "nic0",
+					Subnetwork: "https://www.googleapis.com/compute/v1/projects/project/regions/europe-west1/subnetworks/nodes",
+					AliasIpRanges: []*compute.AliasIpRange{
+						{IpCidrRange: "10.8.0.5/32", SubnetworkRangeName: "live"},
+						{IpCidrRange: "10.8.0.6/32", SubnetworkRangeName: "live"},
+						{IpCidrRange: "10.8.0.7/32", SubnetworkRangeName: "live"},
+						{IpCidrRange: "10.9.0.0/24", SubnetworkRangeName: "gke-pods"},
+					},
+				}},
+			})
+		case "/projects/project/zones/zone/instances/node-1/updateNetworkInterface":
+			updated = &compute.NetworkInterface{}
+			if err := json.NewDecoder(r.Body).Decode(updated); err != nil {
+				t.Error(err)
+			}
+			reply(w, &compute.Operation{Name: "operation", Status: "RUNNING"})
+		case "/projects/project/zones/zone/operations/operation/wait":
+			reply(w, &compute.Operation{Name: "operation", Status: "DONE"})
+		default:
+			t.Errorf("unexpected GCE call %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer gce.Close()
+	computeService, err := compute.NewService(context.Background(), option.WithEndpoint(gce.URL), option.WithHTTPClient(gce.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeInstanceStaleAliases(context.Background(), logger, dynamicClient, computeService, "project", "zone", "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if updated == nil {
+		t.Fatal("stale aliases were not removed")
+	}
+	var kept []string
+	for _, r := range updated.AliasIpRanges {
+		kept = append(kept, r.IpCidrRange)
+	}
+	// 10.8.0.6 is allocated to no pod, 10.8.0.7 to a pod of another node
+	if len(kept) != 2 || kept[0] != "10.8.0.5/32" || kept[1] != "10.9.0.0/24" {
+		t.Errorf("kept aliases %v, want the allocation of the node and the range of no pool", kept)
+	}
+}
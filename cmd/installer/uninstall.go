@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// uninstallPollInterval is how often the pods holding IPs are counted while
+// the node drains
+const uninstallPollInterval = 10 * time.Second
+
+// runUninstall off-boards the node from gcp-ipam. New pods are refused and
+// kept off the node by the ipam.UninstallTaint, whose pods holding IPs the
+// provisioner evicts; the IPs buffered for the node go back to their pools.
+// Once the pods terminated or were migrated, the aliases left are detached and
+// their IPs released, and only then is the CNI configuration switched back to
+// host-local and the binaries removed. Pods still running after the timeout
+// fail the uninstall, their IPs stay allocated and the node tainted.
+func runUninstall(ctx context.Context, logger *slog.Logger, timeout time.Duration) error {
+	clientset, dynamicClient, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	allocator := ipam.NewAllocator(dynamicClient)
+	markPath := filepath.Join(*hostRoot, mutation.DefaultUninstallPath)
+
+	logger.Info("Uninstalling gcp-ipam from the node", slog.String("node", *nodeName), slog.Duration("timeout", timeout))
+	if err := mutation.MarkUninstalling(markPath); err != nil {
+		return err
+	}
+	if err := setUninstallTaint(ctx, clientset, true); err != nil {
+		logger.Error("Failed to taint node", slog.String("error", err.Error()))
+	}
+
+	returnBuffer(ctx, logger, allocator)
+
+	if err := waitForPodsToLeave(ctx, logger, clientset, timeout); err != nil {
+		return err
+	}
+
+	if err := evacuate(ctx, logger, allocator); err != nil {
+		return fmt.Errorf("failed to release remaining IPs: %w", err)
+	}
+
+	installMu.Lock()
+	defer installMu.Unlock()
+
+	logger.Info("Reverting CNI configuration to use host-local IPAM")
+	if err := reconfigureCNIIPAMConf(logger, "host-local", ""); err != nil {
+		return err
+	}
+	removeHostBinaries(logger, *binaries)
+
+	if err := mutation.ClearUninstalling(markPath); err != nil {
+		logger.Error("Failed to clear uninstall mark", slog.String("error", err.Error()))
+	}
+	if err := setUninstallTaint(ctx, clientset, false); err != nil {
+		logger.Error("Failed to remove node taint", slog.String("error", err.Error()))
+	}
+	logger.Info("Uninstalled gcp-ipam from the node")
+	return nil
+}
+
+// waitForPodsToLeave waits until no running pod holds an IP attached to the
+// node, failing once the timeout passed. Attachments whose pod is gone,
+// replaced or finished are left to evacuate.
+func waitForPodsToLeave(ctx context.Context, logger *slog.Logger, clientset kubernetes.Interface, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		live, err := liveAttachments()
+		if err != nil {
+			return err
+		}
+		holding, err := podsHoldingIPs(ctx, clientset, live)
+		if err != nil {
+			return err
+		}
+		if len(holding) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d running pods still hold IPs after the uninstall timeout, evict them and restart the uninstall: %v",
+				len(holding), holding)
+		}
+		logger.Info("Waiting for pods holding IPs to leave the node", slog.Int("pods", len(holding)))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(uninstallPollInterval):
+		}
+	}
+}
+
+// podsHoldingIPs returns the namespaced names of the running pods of
+// attachments
+func podsHoldingIPs(ctx context.Context, clientset kubernetes.Interface, attachments []store.Attachment) ([]string, error) {
+	var holding []string
+	for _, a := range attachments {
+		if a.PodName == "" {
+			continue
+		}
+		pod, err := clientset.CoreV1().Pods(a.PodNamespace).Get(ctx, a.PodName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pod %s/%s: %w", a.PodNamespace, a.PodName, err)
+		}
+		if a.PodUID != "" && string(pod.UID) != a.PodUID {
+			continue
+		}
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		holding = append(holding, a.PodNamespace+"/"+a.PodName)
+	}
+	return lo.Uniq(holding), nil
+}
+
+// returnBuffer detaches the warm IPs of the node and returns them to their
+// pools
+func returnBuffer(ctx context.Context, logger *slog.Logger, allocator *ipam.Allocator) {
+	_, reservations, err := bufferState()
+	if err != nil {
+		logger.Error("Failed to read buffered IPs", slog.String("error", err.Error()))
+		return
+	}
+	if len(reservations) == 0 {
+		return
+	}
+	if err := detachWarmAliases(ctx, logger, reservations); err != nil {
+		logger.Error("Failed to detach warm IPs", slog.String("error", err.Error()))
+		return
+	}
+
+	for _, r := range reservations {
+		attrs := []any{slog.String("pool", r.Pool), slog.String("ip", r.IP)}
+		if err := allocator.ReleaseBuffered(ctx, r.Pool, r.IP, *nodeName); err != nil {
+			logger.Error("Failed to return buffered IP to the pool", append(attrs, slog.String("error", err.Error()))...)
+			continue
+		}
+		if _, err := removeReservation(r.Pool, r.IP); err != nil {
+			logger.Error("Failed to remove returned reservation", append(attrs, slog.String("error", err.Error()))...)
+		}
+		logger.Info("Returned buffered IP to the pool", attrs...)
+	}
+}
+
+// setUninstallTaint adds or removes the ipam.UninstallTaint of this node. The
+// patch only applies to the taints read.
+func setUninstallTaint(ctx context.Context, clientset kubernetes.Interface, present bool) error {
+	node, err := clientset.CoreV1().Nodes().Get(ctx, *nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", *nodeName, err)
+	}
+	tainted := lo.ContainsBy(node.Spec.Taints, func(t corev1.Taint) bool { return t.Key == ipam.UninstallTaint })
+	if tainted == present {
+		return nil
+	}
+
+	taints := lo.Filter(node.Spec.Taints, func(t corev1.Taint, _ int) bool { return t.Key != ipam.UninstallTaint })
+	if present {
+		taints = append(taints, corev1.Taint{Key: ipam.UninstallTaint, Effect: corev1.TaintEffectNoSchedule})
+	}
+	ops := []map[string]any{{"op": "add", "path": "/spec/taints", "value": taints}}
+	if len(node.Spec.Taints) > 0 {
+		ops = []map[string]any{
+			{"op": "test", "path": "/spec/taints", "value": node.Spec.Taints},
+			{"op": "replace", "path": "/spec/taints", "value": taints},
+		}
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return fmt.Errorf("failed to marshal taint patch: %w", err)
+	}
+	if _, err := clientset.CoreV1().Nodes().Patch(ctx, *nodeName, types.JSONPatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to patch taints of node %s: %w", *nodeName, err)
+	}
+	return nil
+}
+
+// removeHostBinaries removes the binaries, their releases kept for canary
+// rollbacks included, from the host CNI binary directory
+func removeHostBinaries(logger *slog.Logger, binaryNames []string) {
+	destDir := filepath.Join(*hostRoot, *cniBinDir)
+	for _, binaryName := range binaryNames {
+		releases, err := filepath.Glob(filepath.Join(destDir, versionedBinaryName(binaryName, "*")))
+		if err != nil {
+			logger.Error("Failed to list installed releases", slog.String("binary", binaryName), slog.String("error", err.Error()))
+		}
+		for _, path := range append(releases, filepath.Join(destDir, binaryName)) {
+			err := os.Remove(path)
+			switch {
+			case err == nil:
+				logger.Info("Removed binary", slog.String("path", path))
+			case !os.IsNotExist(err):
+				logger.Error("Failed to remove binary", slog.String("path", path), slog.String("error", err.Error()))
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/castai/gcp-cni/internal/store"
+)
+
+func TestWaitForPodsToLeave(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		wantErr bool
+	}{
+		{
+			name:    "running pod holds its IP",
+			pod:     &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", UID: "pod-uid"}, Status: corev1.PodStatus{Phase: corev1.PodRunning}},
+			wantErr: true,
+		},
+		{
+			name: "pod gone",
+		},
+		{
+			name: "pod replaced",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", UID: "other-uid"}, Status: corev1.PodStatus{Phase: corev1.PodRunning}},
+		},
+		{
+			name: "pod finished",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", UID: "pod-uid"}, Status: corev1.PodStatus{Phase: corev1.PodSucceeded}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*hostRoot = t.TempDir()
+			s, err := store.Open(filepath.Join(*hostRoot, store.DefaultPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Update("container", "eth0", func(a *store.Attachment) {
+				a.IP, a.Pool, a.State = "10.8.0.5", "ippool-nodes", store.StateAttached
+				a.PodNamespace, a.PodName, a.PodUID = "default", "pod", "pod-uid"
+			})
+			s.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clientset := fake.NewSimpleClientset()
+			if tt.pod != nil {
+				clientset = fake.NewSimpleClientset(tt.pod)
+			}
+			// A zero timeout checks once, the IPs of running pods must not be released
+			err = waitForPodsToLeave(ctx, logger, clientset, 0)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "default/pod") {
+					t.Fatalf("waitForPodsToLeave() error = %v, want the running pod named", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("waitForPodsToLeave() error = %v", err)
+			}
+		})
+	}
+}
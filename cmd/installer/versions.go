@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const versionTimeout = 10 * time.Second
+
+// pluginVersion is what "gcp-ipam version --output json" reports
+type pluginVersion struct {
+	Version           string `json:"version"`
+	ConfigFingerprint string `json:"configFingerprint"`
+	ConfigError       string `json:"configError"`
+}
+
+// annotateVersions records the gcp-ipam release the node runs, the
+// fingerprint of its effective configuration and the installer release on
+// the node. The plugin reports the first two itself, chrooted into the host
+// root like the self-test, so they are what ADD sees.
+func annotateVersions(logger *slog.Logger) {
+	if *nodeName == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+
+	if err := writeVersionAnnotations(ctx); err != nil {
+		logger.Warn("Failed to annotate node with the plugin version", slog.String("error", err.Error()))
+	}
+}
+
+func writeVersionAnnotations(ctx context.Context) error {
+	output, err := hostCommand(ctx, filepath.Join(*cniBinDir, "gcp-ipam"), "version", "--output", "json", "--config", *pluginConfigPath).Output()
+	if err != nil {
+		return fmt.Errorf("failed to run gcp-ipam version: %w", err)
+	}
+	var plugin pluginVersion
+	if err := json.Unmarshal(output, &plugin); err != nil {
+		return fmt.Errorf("failed to parse gcp-ipam version: %w", err)
+	}
+	if plugin.ConfigError != "" {
+		return fmt.Errorf("gcp-ipam cannot load its configuration: %s", plugin.ConfigError)
+	}
+
+	clientset, _, err := buildKubeClients()
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": map[string]string{
+		ipam.PluginVersionAnnotation:    plugin.Version,
+		ipam.PluginConfigAnnotation:     plugin.ConfigFingerprint,
+		ipam.InstallerVersionAnnotation: version,
+	}}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal version annotations: %w", err)
+	}
+	if _, err := clientset.CoreV1().Nodes().Patch(ctx, *nodeName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to annotate node %s: %w", *nodeName, err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/samber/lo"
+	"google.golang.org/api/compute/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/instance"
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// attachWarmAliases attaches the buffered IPs of the node to the pod network
+// interface in a single update, so the ADD taking one finds its alias
+// attached already. The node mutation lock keeps the update from racing the
+// plugin.
+func attachWarmAliases(ctx context.Context, logger *slog.Logger, reservations []store.Reservation) error {
+	if len(reservations) == 0 {
+		return nil
+	}
+
+	lock := flock.New(filepath.Join(*hostRoot, mutation.DefaultLockPath))
+	if _, err := lock.TryLockContext(ctx, 50*time.Millisecond); err != nil {
+		return fmt.Errorf("failed to acquire node mutation lock: %w", err)
+	}
+	defer lock.Unlock()
+
+	attachments := lo.Map(reservations, func(r store.Reservation, _ int) store.Attachment {
+		return store.Attachment{IP: r.IP, Pool: r.Pool, SecondaryRange: ipam.AliasRange(r.SecondaryRange)}
+	})
+	return attachAliases(ctx, logger, attachments, "warm IPs")
+}
+
+// attachAliases adds the /32 aliases of every IP of attachments missing on
+// the pod network interface in a single update. The caller holds the node
+// mutation lock.
+func attachAliases(ctx context.Context, logger *slog.Logger, attachments []store.Attachment, what string) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	computeService, projectID, zone, instanceName, err := thisInstance(ctx)
+	if err != nil {
+		return err
+	}
+	return attachInstanceAliases(ctx, logger, computeService, projectID, zone, instanceName, attachments, what)
+}
+
+// attachInstanceAliases is attachAliases on the given instance
+func attachInstanceAliases(ctx context.Context, logger *slog.Logger, computeService *compute.Service, projectID, zone, instanceName string, attachments []store.Attachment, what string) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	cfg, err := config.Load(filepath.Join(*hostRoot, *pluginConfigPath))
+	if err != nil {
+		return err
+	}
+
+	inst, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get instance %s: %w", instanceName, err)
+	}
+	// The primary interface or, in the secondary NIC mode, the pod interface
+	var nic *compute.NetworkInterface
+	for _, n := range inst.NetworkInterfaces {
+		if cfg.NetworkInterface.Subnetwork == "" || ipam.SubnetworkName(n.Subnetwork) == cfg.NetworkInterface.Subnetwork {
+			nic = n
+			break
+		}
+	}
+	if nic == nil {
+		logger.Info("Pod network interface not attached yet, leaving aliases detached", slog.String("aliases", what))
+		return nil
+	}
+
+	var missing []*compute.AliasIpRange
+	for _, a := range attachments {
+		for _, ip := range attachmentIPs(a) {
+			if lo.ContainsBy(nic.AliasIpRanges, func(r *compute.AliasIpRange) bool { return ipam.IsHostPrefix(r.IpCidrRange, ip) }) {
+				continue
+			}
+			missing = append(missing, &compute.AliasIpRange{
+				IpCidrRange:         ipam.HostPrefix(ip),
+				SubnetworkRangeName: a.SecondaryRange,
+			})
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	aliases := append(slices.Clone(nic.AliasIpRanges), missing...)
+
+	op, err := computeService.Instances.UpdateNetworkInterface(projectID, zone, instanceName, nic.Name, &compute.NetworkInterface{
+		Fingerprint:   nic.Fingerprint,
+		AliasIpRanges: aliases,
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to update network interface: %w", err)
+	}
+	done, err := computeService.ZoneOperations.Wait(projectID, zone, op.Name).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to wait for network interface update operation: %w", err)
+	}
+	if done.Status != "DONE" {
+		return fmt.Errorf("network interface update operation %s still running", op.Name)
+	}
+	if done.Error != nil && len(done.Error.Errors) > 0 {
+		return fmt.Errorf("network interface update operation %s failed: %s", op.Name, done.Error.Errors[0].Message)
+	}
+	logger.Info("Attached aliases to instance",
+		slog.String("aliases", what),
+		slog.String("instance", instanceName),
+		slog.String("nic", nic.Name),
+		slog.Int("aliases", len(missing)),
+	)
+	return instance.Invalidate(filepath.Join(*hostRoot, instance.DefaultCachePath))
+}
+
+// detachWarmAliases removes the aliases of reservations dropped from the node
+// buffer. IPs a container uses are left alone, the pool may have handed an
+// expired reservation to a pod of this node meanwhile.
+func detachWarmAliases(ctx context.Context, logger *slog.Logger, reservations []store.Reservation) error {
+	lock := flock.New(filepath.Join(*hostRoot, mutation.DefaultLockPath))
+	if _, err := lock.TryLockContext(ctx, 50*time.Millisecond); err != nil {
+		return fmt.Errorf("failed to acquire node mutation lock: %w", err)
+	}
+	defer lock.Unlock()
+
+	live, err := liveAttachments()
+	if err != nil {
+		return err
+	}
+	var detach []store.Attachment
+	for _, r := range reservations {
+		if lo.ContainsBy(live, func(a store.Attachment) bool { return a.IP == r.IP }) {
+			continue
+		}
+		detach = append(detach, store.Attachment{IP: r.IP, Pool: r.Pool, SecondaryRange: ipam.AliasRange(r.SecondaryRange)})
+	}
+	if len(detach) == 0 {
+		return nil
+	}
+	return detachAliases(ctx, logger, detach)
+}
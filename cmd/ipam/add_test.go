@@ -0,0 +1,754 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	logging "github.com/k8snetworkplumbingwg/cni-log"
+	"github.com/samber/lo"
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/instance"
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// gcePhases are the ADD phases spent waiting on GCE, which in-process fakes
+// cannot tell anything about. pacing is a deliberate wait before them.
+var gcePhases = map[string]bool{
+	"pacing":                   true,
+	"get-instance":             true,
+	"get-subnetwork":           true,
+	"update-network-interface": true,
+	"wait-operation":           true,
+	"conflict-detection":       true,
+}
+
+// addBudget is what each non-GCE phase of an ADD may take against in-process
+// fakes. It does not model API server latency, it catches work creeping into
+// the critical path, like clients built twice or files read per lookup.
+var addBudget = map[string]time.Duration{
+	"build-clients":  2 * time.Millisecond,
+	"get-pod":        time.Millisecond,
+	"get-migration":  time.Millisecond,
+	"mutation-queue": time.Millisecond,
+	"resolve-pool":   time.Millisecond,
+	"allocate":       2 * time.Millisecond,
+	"recheck-pod":    time.Millisecond,
+}
+
+// addNonGCEBudget bounds the whole ADD without its GCE phases, including the
+// work outside any phase such as config loading and the node-local database
+const addNonGCEBudget = 9 * time.Millisecond
+
+// raceEnabled is set by race_test.go, the race detector slows everything down
+// far beyond any budget
+var raceEnabled bool
+
+const (
+	benchProject    = "project"
+	benchZone       = "europe-west1-b"
+	benchInstance   = "node-1"
+	benchSubnetwork = "nodes"
+	benchPool       = "ippool-nodes"
+)
+
+// addEnv runs cmdAdd against a fake API server, a fake GCE API and node-local
+// state in a temporary directory
+type addEnv struct {
+	kube    *kubefake.Clientset
+	dynamic *dynamicfake.FakeDynamicClient
+	pool    *unstructured.Unstructured
+	stdin   []byte
+	records string
+	// config is the path of the plugin configuration
+	config string
+	// gce serves the Compute Engine calls, fakeGCE unless a test wraps it
+	gce http.Handler
+	// updates counts the alias updates GCE accepted
+	updates atomic.Int32
+}
+
+func newAddEnv(tb testing.TB) *addEnv {
+	tb.Helper()
+	dir := tb.TempDir()
+
+	savedPaths, savedClients, savedGoogle, savedStdout := nodePaths, newClients, newGoogleClient, os.Stdout
+	tb.Cleanup(func() {
+		nodePaths, newClients, newGoogleClient, os.Stdout = savedPaths, savedClients, savedGoogle, savedStdout
+	})
+	nodePaths.store = filepath.Join(dir, "allocations.db")
+	nodePaths.operations = filepath.Join(dir, "operations")
+	nodePaths.mutationLock = filepath.Join(dir, "mutation.lock")
+	nodePaths.mutationQueue = filepath.Join(dir, "queue")
+	nodePaths.poolQueue = filepath.Join(dir, "pool-queue")
+	nodePaths.pacer = filepath.Join(dir, "pacing.json")
+	nodePaths.maintenance = filepath.Join(dir, "maintenance.json")
+	nodePaths.uninstall = filepath.Join(dir, "uninstalling")
+	nodePaths.instanceCache = filepath.Join(dir, "instance.json")
+	nodePaths.quota = filepath.Join(dir, "quota.json")
+
+	// Logged like on a node, into the log file of TestMain
+	logging.SetLogLevel(logging.DebugLevel)
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { devNull.Close() })
+	os.Stdout = devNull
+
+	env := &addEnv{}
+	env.gce = fakeGCE(tb, &env.updates)
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { env.gce.ServeHTTP(w, r) }))
+	tb.Cleanup(gce.Close)
+	newGoogleClient = func(ctx context.Context) (*http.Client, error) {
+		return &http.Client{}, nil
+	}
+
+	cfg := config.Default()
+	// A cold node spaces its first GCE calls by a second, the benchmark starts warm
+	cfg.Pacing.Initial = metav1.Duration{Duration: time.Microsecond}
+	cfg.Identity = identity.Overrides{
+		Project:         benchProject,
+		Zone:            benchZone,
+		Instance:        benchInstance,
+		ComputeEndpoint: gce.URL + "/compute/v1/",
+	}
+	data, err := cfg.Render()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "config.json")
+	env.config = configPath
+	if err := os.WriteFile(configPath, data, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: benchPool},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/20"},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	env.pool = &unstructured.Unstructured{Object: obj}
+	env.records = nodePaths.operations
+	env.dynamic = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			ipam.IPPoolGVR:         "IPPoolList",
+			ipam.PodIPMigrationGVR: "PodIPMigrationList",
+		}, env.pool.DeepCopy())
+
+	env.kube = kubefake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", UID: "pod-uid"},
+	})
+	newClients = func(string) (*apiClients, error) {
+		return &apiClients{kube: env.kube, dynamic: env.dynamic}, nil
+	}
+
+	env.stdin, err = json.Marshal(map[string]any{
+		"cniVersion": "1.0.0",
+		"name":       "gcp-cni",
+		"type":       "gcp-ipam",
+		"ipam":       map[string]string{"type": "gcp-ipam", "configPath": configPath},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return env
+}
+
+// fakeGCE serves the Compute Engine calls of an ADD. The alias update is
+// counted in updates and accepted without being applied, every ADD attaches
+// to an empty interface.
+func fakeGCE(tb testing.TB, updates *atomic.Int32) http.Handler {
+	prefix := fmt.Sprintf("/compute/v1/projects/%s/", benchProject)
+	instance := fmt.Sprintf("zones/%s/instances/%s", benchZone, benchInstance)
+	reply := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			tb.Error(err)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, prefix)
+		switch {
+		case path == instance:
+			reply(w, &compute.Instance{
+				Name: benchInstance,
+				NetworkInterfaces: []*compute.NetworkInterface{{
+					Name:        "nic0",
+					Network:     "https://www.googleapis.com/compute/v1/projects/project/global/networks/default",
+					Subnetwork:  "https://www.googleapis.com/compute/v1/projects/project/regions/europe-west1/subnetworks/" + benchSubnetwork,
+					Fingerprint: "fingerprint",
+				}},
+			})
+		case path == "regions/europe-west1/subnetworks/"+benchSubnetwork:
+			reply(w, &compute.Subnetwork{Name: benchSubnetwork, IpCidrRange: "10.0.0.0/20"})
+		case path == instance+"/updateNetworkInterface":
+			updates.Add(1)
+			reply(w, &compute.Operation{Name: "operation", Status: "RUNNING"})
+		case strings.HasSuffix(path, "/operations/operation/wait"):
+			reply(w, &compute.Operation{Name: "operation", Status: "DONE"})
+		default:
+			tb.Errorf("unexpected GCE call %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// add runs the ADD of container i and resets the pool, so every ADD starts
+// from the same state
+func (env *addEnv) add(tb testing.TB, i int) {
+	tb.Helper()
+	err := cmdAdd(&skel.CmdArgs{
+		ContainerID: fmt.Sprintf("container-%d", i),
+		Netns:       "/var/run/netns/bench",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+		StdinData:   env.stdin,
+	})
+	if err != nil {
+		tb.Fatalf("ADD failed: %v", err)
+	}
+	if err := env.dynamic.Tracker().Update(ipam.IPPoolGVR, env.pool.DeepCopy(), ""); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// setAllocation records allocation of ip as the only one of the pool
+func (env *addEnv) setAllocation(tb testing.TB, ip string, allocation v1alpha1.IPAllocation) *v1alpha1.IPPool {
+	tb.Helper()
+	pool := &v1alpha1.IPPool{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(env.pool.Object, pool); err != nil {
+		tb.Fatal(err)
+	}
+	pool.Spec.Allocations = map[string]v1alpha1.IPAllocation{ip: allocation}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := env.dynamic.Tracker().Update(ipam.IPPoolGVR, &unstructured.Unstructured{Object: obj}, ""); err != nil {
+		tb.Fatal(err)
+	}
+	return pool
+}
+
+// bufferWarmIP buffers ip for the node in the store, recorded in the pool as
+// allocation
+func (env *addEnv) bufferWarmIP(tb testing.TB, ip string, allocation v1alpha1.IPAllocation) {
+	tb.Helper()
+	pool := env.setAllocation(tb, ip, allocation)
+
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	_, err = db.AddReservations([]store.Reservation{{IP: ip, Pool: benchPool, CIDR: pool.Spec.CIDR}})
+	db.Close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestAddTakesWarmIP(t *testing.T) {
+	env := newAddEnv(t)
+	const warm = "10.8.0.9"
+	env.bufferWarmIP(t, warm, v1alpha1.IPAllocation{NodeName: benchInstance, Buffered: true})
+
+	err := cmdAdd(&skel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "/var/run/netns/warm",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+		StdinData:   env.stdin,
+	})
+	if err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+
+	got, err := ipam.NewAllocator(env.dynamic).ListPools(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocation, ok := got[0].Spec.Allocations[warm]
+	if !ok || allocation.Buffered || allocation.PodUID != "pod-uid" {
+		t.Errorf("warm IP allocation = %+v, %v, want claimed by the pod", allocation, ok)
+	}
+	if n := len(got[0].Spec.Allocations); n != 1+len(systemAllocations(got[0])) {
+		t.Errorf("pool holds %d allocations, want only the warm IP besides system ones", n)
+	}
+}
+
+func TestAddReturnsUnclaimedWarmIP(t *testing.T) {
+	env := newAddEnv(t)
+	const warm = "10.8.0.9"
+	// Another node took the IP after the pool stopped buffering it for this one
+	env.bufferWarmIP(t, warm, v1alpha1.IPAllocation{PodUID: "other-uid", NodeName: "node-2"})
+
+	err := cmdAdd(&skel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "/var/run/netns/warm",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+		StdinData:   env.stdin,
+	})
+	if err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	attachment, err := db.Get("container", "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.IP == warm || attachment.Buffered {
+		t.Errorf("attachment = %+v, want an IP of the pool in place of the unclaimed warm IP", attachment)
+	}
+	// Back in the buffer, the installer drops it and detaches its alias
+	reservations, err := db.Reservations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reservations) != 1 || reservations[0].IP != warm {
+		t.Errorf("reservations = %+v, want the unclaimed warm IP returned", reservations)
+	}
+}
+
+func TestAddAttachesAliasMissingFromCache(t *testing.T) {
+	env := newAddEnv(t)
+	const ip = "10.8.0.9"
+	// A recreated sandbox reuses the IP the pod holds
+	env.setAllocation(t, ip, v1alpha1.IPAllocation{PodName: "pod", PodNamespace: "default", PodUID: "pod-uid", NodeName: benchInstance})
+
+	// The cached interface still lists the alias GCE no longer has
+	cfg := config.Default()
+	cache := &instance.Cache{NIC: &compute.NetworkInterface{
+		Name:          "nic0",
+		Subnetwork:    "https://www.googleapis.com/compute/v1/projects/project/regions/europe-west1/subnetworks/" + benchSubnetwork,
+		Fingerprint:   "stale",
+		AliasIpRanges: []*compute.AliasIpRange{{IpCidrRange: ip + "/32", SubnetworkRangeName: cfg.ClusterRange(ipam.AliasRange(cfg.SecondaryRangeName))}},
+	}}
+	if err := cache.Save(nodePaths.instanceCache); err != nil {
+		t.Fatal(err)
+	}
+
+	err := cmdAdd(&skel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "/var/run/netns/cached",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+		StdinData:   env.stdin,
+	})
+	if err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+	if got := env.updates.Load(); got != 1 {
+		t.Errorf("ADD updated the aliases %d times, want the alias attached once", got)
+	}
+}
+
+func TestAddWhileUninstalling(t *testing.T) {
+	env := newAddEnv(t)
+	if err := mutation.MarkUninstalling(nodePaths.uninstall); err != nil {
+		t.Fatal(err)
+	}
+
+	err := cmdAdd(&skel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "/var/run/netns/uninstall",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+		StdinData:   env.stdin,
+	})
+	var cniErr *types.Error
+	if !errors.As(err, &cniErr) || cniErr.Code != types.ErrTryAgainLater {
+		t.Fatalf("ADD while uninstalling error = %v, want try again later", err)
+	}
+
+	got, err := ipam.NewAllocator(env.dynamic).ListPools(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got[0].Spec.Allocations); n != len(systemAllocations(got[0])) {
+		t.Errorf("pool holds %d allocations, want only system ones", n)
+	}
+}
+
+func TestAddReclaimsFromExhaustedPool(t *testing.T) {
+	env := newAddEnv(t)
+	ctx := context.Background()
+
+	pool := &v1alpha1.IPPool{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(env.pool.Object, pool); err != nil {
+		t.Fatal(err)
+	}
+	pool.Spec.CIDR = "10.8.0.0/29"
+	pool.Spec.ReclaimOnExhaustion = true
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.dynamic.Tracker().Update(ipam.IPPoolGVR, &unstructured.Unstructured{Object: obj}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pods that are gone still hold every IP of the pool
+	allocator := ipam.NewAllocator(env.dynamic)
+	for i := 0; ; i++ {
+		_, err := allocator.Allocate(ctx, &ipam.AllocationRequest{
+			PoolName:     benchPool,
+			PodName:      fmt.Sprintf("gone-%d", i),
+			PodNamespace: "default",
+			PodUID:       fmt.Sprintf("gone-uid-%d", i),
+			NodeName:     benchInstance,
+		})
+		if errors.Is(err, ipam.ErrPoolExhausted) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = cmdAdd(&skel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "/var/run/netns/reclaim",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+		StdinData:   env.stdin,
+	})
+	if err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+
+	got, err := allocator.ListPools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lo.ContainsBy(lo.Values(got[0].Spec.Allocations), func(a v1alpha1.IPAllocation) bool { return a.PodUID == "pod-uid" }) {
+		t.Errorf("pool allocations = %v, want an IP reclaimed for the pod", got[0].Spec.Allocations)
+	}
+}
+
+func TestAddRecreatedSandbox(t *testing.T) {
+	env := newAddEnv(t)
+
+	// kubelet recreates the sandbox of the pod, e.g. after a node restart,
+	// without DEL of the previous one
+	for _, containerID := range []string{"sandbox-1", "sandbox-2"} {
+		err := cmdAdd(&skel.CmdArgs{
+			ContainerID: containerID,
+			Netns:       "/var/run/netns/" + containerID,
+			IfName:      "eth0",
+			Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+			StdinData:   env.stdin,
+		})
+		if err != nil {
+			t.Fatalf("ADD of %s failed: %v", containerID, err)
+		}
+	}
+
+	got, err := ipam.NewAllocator(env.dynamic).ListPools(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got[0].Spec.Allocations); n != 1+len(systemAllocations(got[0])) {
+		t.Fatalf("pool holds %d allocations, want the pod's only besides system ones", n)
+	}
+
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	previous, err := db.Get("sandbox-1", "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := db.Get("sandbox-2", "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.IP != previous.IP {
+		t.Errorf("recreated sandbox got IP %s, want %s of the previous one", current.IP, previous.IP)
+	}
+	if previous.State != store.StateReleased {
+		t.Errorf("previous sandbox attachment state = %s, want %s so its DEL leaves the IP alone", previous.State, store.StateReleased)
+	}
+}
+
+func TestAddMultipleIPs(t *testing.T) {
+	env := newAddEnv(t)
+	ctx := context.Background()
+
+	pod, err := env.kube.CoreV1().Pods("default").Get(ctx, "pod", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.Annotations = map[string]string{ipam.IPCountAnnotation: "3"}
+	if _, err := env.kube.CoreV1().Pods("default").Update(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: "vm",
+		Netns:       "/var/run/netns/vm",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+		StdinData:   env.stdin,
+	}
+	if err := cmdAdd(args); err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+
+	allocator := ipam.NewAllocator(env.dynamic)
+	got, err := allocator.ListPools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got[0].Spec.Allocations); n != 3+len(systemAllocations(got[0])) {
+		t.Fatalf("pool holds %d allocations, want the pod's 3 besides system ones", n)
+	}
+
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment, err := db.Get("vm", "eth0")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachment.AdditionalIPs) != 2 {
+		t.Fatalf("recorded additional IPs = %v, want 2", attachment.AdditionalIPs)
+	}
+
+	if err := cmdDel(args); err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	if got, err = allocator.ListPools(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got[0].Spec.Allocations); n != len(systemAllocations(got[0])) {
+		t.Errorf("pool holds %d allocations after DEL, want system ones only", n)
+	}
+}
+
+func TestDelAfterReclaim(t *testing.T) {
+	env := newAddEnv(t)
+	ctx := context.Background()
+
+	args := &skel.CmdArgs{
+		ContainerID: "vm",
+		Netns:       "/var/run/netns/vm",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+		StdinData:   env.stdin,
+	}
+	if err := cmdAdd(args); err != nil {
+		t.Fatalf("ADD failed: %v", err)
+	}
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment, err := db.Get("vm", "eth0")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The IP was reclaimed and handed to a pod on another node before the DEL
+	allocator := ipam.NewAllocator(env.dynamic)
+	err = allocator.TransferAllocation(ctx, benchPool, attachment.IP, &ipam.AllocationRequest{
+		PodName:      "new",
+		PodNamespace: "default",
+		PodUID:       "new-uid",
+		NodeName:     "other-node",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmdDel(args); err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	allocation, ok, err := allocator.AllocationOf(ctx, benchPool, attachment.IP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || allocation.PodUID != "new-uid" {
+		t.Errorf("allocation of %s after DEL = %+v (found %v), want it kept for new-uid", attachment.IP, allocation, ok)
+	}
+}
+
+func systemAllocations(pool v1alpha1.IPPool) []string {
+	var ips []string
+	for ip, allocation := range pool.Spec.Allocations {
+		if allocation.System != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func BenchmarkCmdAdd(b *testing.B) {
+	env := newAddEnv(b)
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		env.add(b, i)
+	}
+}
+
+// TestAddPhaseBudget checks the non-GCE part of an ADD against addBudget. Each
+// phase is judged by its fastest of several runs, so a loaded machine does not
+// fail the test but work added to the critical path does.
+func TestAddPhaseBudget(t *testing.T) {
+	if raceEnabled {
+		t.Skip("timings are meaningless under the race detector")
+	}
+	if testing.Short() {
+		t.Skip("runs a series of ADDs")
+	}
+
+	const runs = 20
+	env := newAddEnv(t)
+	best := map[string]time.Duration{}
+	bestTotal := time.Duration(-1)
+	for i := range runs {
+		env.add(t, i)
+		records, err := telemetry.List(env.records, 1)
+		if err != nil || len(records) == 0 {
+			t.Fatalf("no operation record of ADD %d: %v", i, err)
+		}
+
+		phases := map[string]time.Duration{}
+		total := records[0].Duration
+		for _, phase := range records[0].Phases {
+			if gcePhases[phase.Name] {
+				total -= phase.Duration
+				continue
+			}
+			phases[phase.Name] += phase.Duration
+		}
+		for name, d := range phases {
+			if current, ok := best[name]; !ok || d < current {
+				best[name] = d
+			}
+		}
+		if bestTotal < 0 || total < bestTotal {
+			bestTotal = total
+		}
+	}
+
+	for name, budget := range addBudget {
+		d, ok := best[name]
+		if !ok {
+			t.Errorf("phase %s was not recorded", name)
+			continue
+		}
+		t.Logf("%-16s %10v of %v", name, d, budget)
+		if d > budget {
+			t.Errorf("phase %s took %v, budget %v", name, d, budget)
+		}
+	}
+	for name := range best {
+		if _, ok := addBudget[name]; !ok {
+			t.Errorf("phase %s has no budget", name)
+		}
+	}
+	t.Logf("%-16s %10v of %v", "non-GCE total", bestTotal, addNonGCEBudget)
+	if bestTotal > addNonGCEBudget {
+		t.Errorf("non-GCE part of ADD took %v, budget %v", bestTotal, addNonGCEBudget)
+	}
+}
+
+func TestResolveAliasRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		conf      PluginConf
+		runtime   string
+		rangeName string
+		want      string
+	}{
+		{name: "pool range wins", conf: PluginConf{SecondaryRangeName: "net"}, runtime: "runtime", rangeName: "pool", want: "pool"},
+		{name: "network config", conf: PluginConf{SecondaryRangeName: "net"}, runtime: "runtime", want: "net"},
+		{name: "runtime config", runtime: "runtime", want: "runtime"},
+		{name: "default", want: ipam.DefaultAliasRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pluginConfig := config.Default()
+			pluginConfig.SecondaryRangeName = tt.runtime
+			if got := resolveAliasRange(&tt.conf, pluginConfig, tt.rangeName); got != tt.want {
+				t.Errorf("resolveAliasRange() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddMissingPool(t *testing.T) {
+	env := newAddEnv(t)
+	gets := func() int {
+		n := 0
+		for _, action := range env.dynamic.Actions() {
+			if action.GetVerb() == "get" && action.GetResource() == ipam.IPPoolGVR {
+				n++
+			}
+		}
+		return n
+	}
+
+	// An ADD from an existing pool does not check for it first
+	env.add(t, 0)
+	if n := gets(); n != 1 {
+		t.Errorf("ADD got the IPPool %d times, want once", n)
+	}
+
+	if err := env.dynamic.Tracker().Delete(ipam.IPPoolGVR, "", benchPool); err != nil {
+		t.Fatal(err)
+	}
+	err := cmdAdd(&skel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "/var/run/netns/missing",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+		StdinData:   env.stdin,
+	})
+	if err == nil || !strings.Contains(err.Error(), "IPPool "+benchPool+" for subnetwork "+benchSubnetwork+" does not exist") {
+		t.Errorf("ADD from a missing pool error = %v, want it named with its subnetwork", err)
+	}
+}
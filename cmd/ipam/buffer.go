@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// apiUnavailable reports whether err is the API server failing to serve the
+// IPPool rather than refusing the allocation: throttling, timeouts, failing
+// webhooks and connections that cannot be made
+func apiUnavailable(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case apierrors.IsTooManyRequests(err), apierrors.IsServerTimeout(err), apierrors.IsTimeout(err),
+		apierrors.IsServiceUnavailable(err), apierrors.IsInternalError(err), apierrors.IsUnexpectedServerError(err):
+		return true
+	case utilnet.IsConnectionRefused(err), utilnet.IsConnectionReset(err), utilnet.IsProbableEOF(err):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// takeWarmIP hands the pod an IP of the warm pool of the node and claims it
+// for the pod in the IPPool, in place of a new allocation. While the IPPool is
+// unavailable the pod keeps the IP as buffered, reported by the second result,
+// and the installer claims it once the pool is back. It returns nil when the
+// warm pool holds no more than keep IPs or the IP could not be claimed, which
+// goes back to the warm pool.
+func takeWarmIP(ctx context.Context, operation string, args *skel.CmdArgs, allocator *ipam.Allocator, req *ipam.AllocationRequest, pod *corev1.Pod, keep int) (*ipam.AllocationResult, bool) {
+	result := takeBufferedIP(operation, args, req.PoolName, pod, keep)
+	if result == nil {
+		return nil, false
+	}
+
+	claimed, err := allocator.ClaimBuffered(ctx, req.PoolName, result.IP, req)
+	switch {
+	case err == nil && claimed:
+		allocatorLog.Infof("[%s] Took warm IP %s of pool %s", operation, result.IP, req.PoolName)
+		return result, false
+	case apiUnavailable(err):
+		// The pod still starts on an IP the node holds for exactly this
+		allocatorLog.Infof("[%s] IPPool %s unavailable, using IP %s buffered for the node: %v", operation, req.PoolName, result.IP, err)
+		telemetry.Retry(ctx, "buffered-ip")
+		return result, true
+	case err != nil:
+		allocatorLog.Infof("[%s] Failed to claim warm IP %s, allocating from pool %s: %v", operation, result.IP, req.PoolName, err)
+	default:
+		allocatorLog.Infof("[%s] Warm IP %s is no longer buffered for the node, allocating from pool %s", operation, result.IP, req.PoolName)
+	}
+	recordAttachment(operation, args, func(a *store.Attachment) {
+		a.IP = ""
+		a.Buffered = false
+	})
+	// Back in the buffer, the installer keeps it as long as the pool buffers
+	// it for the node and detaches its warm alias otherwise
+	returnBufferedIP(operation, req.PoolName, result)
+	return nil, false
+}
+
+// takeBufferedIP takes an IP the installer keeps buffered for the node in the
+// pool, recorded on the attachment as buffered. It returns nil when the buffer
+// holds no more than keep IPs.
+func takeBufferedIP(operation string, args *skel.CmdArgs, poolName string, pod *corev1.Pod, keep int) *ipam.AllocationResult {
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		allocatorLog.Errorf("[%s] Failed to open allocation database: %v", operation, err)
+		return nil
+	}
+	defer db.Close()
+
+	reservation, err := db.TakeReservation(poolName, keep, args.ContainerID, args.IfName, func(a *store.Attachment) {
+		a.PodNamespace = pod.Namespace
+		a.PodName = pod.Name
+		a.PodUID = string(pod.UID)
+		a.Protected = pod.Annotations[ipam.ProtectedIPAnnotation] == "true"
+	})
+	if err != nil {
+		allocatorLog.Errorf("[%s] Failed to take buffered IP of pool %s: %v", operation, poolName, err)
+		return nil
+	}
+	if reservation == nil {
+		return nil
+	}
+	return &ipam.AllocationResult{
+		IP:                 reservation.IP,
+		CIDR:               reservation.CIDR,
+		SecondaryRangeName: reservation.SecondaryRange,
+	}
+}
+
+// returnBufferedIP gives back an IP takeBufferedIP took but the pod could not
+// claim
+func returnBufferedIP(operation, poolName string, result *ipam.AllocationResult) {
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		allocatorLog.Errorf("[%s] Failed to open allocation database: %v", operation, err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.AddReservations([]store.Reservation{{
+		IP:             result.IP,
+		Pool:           poolName,
+		CIDR:           result.CIDR,
+		SecondaryRange: result.SecondaryRangeName,
+		ReservedAt:     time.Now(),
+	}})
+	if err != nil {
+		allocatorLog.Errorf("[%s] Failed to return buffered IP %s of pool %s: %v", operation, result.IP, poolName, err)
+	}
+}
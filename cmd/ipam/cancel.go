@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/samber/lo"
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// errPodGone means the pod of an ADD was deleted or replaced while the ADD was running
+var errPodGone = errors.New("pod was deleted while the ADD was in progress")
+
+// checkPodWanted re-reads the pod right before the first GCE mutation, so an
+// ADD for a pod deleted while it waited for the mutation queue stops early
+func checkPodWanted(ctx context.Context, k8sclient kubernetes.Interface, pod *corev1.Pod) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("ADD cancelled: %w", err)
+	}
+
+	current, err := k8sclient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return errPodGone
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	if current.UID != pod.UID || current.DeletionTimestamp != nil {
+		return errPodGone
+	}
+	return nil
+}
+
+// addCleanup undoes what an aborted ADD already did: it detaches the alias or
+// removes the route if the attach was issued and releases the IP if this ADD
+// owns it. It runs with its own context because the ADD context is already
+// cancelled.
+type addCleanup struct {
+	operation      string
+	computeService *compute.Service
+	host           *hostProject
+	projectID      string
+	zone           string
+	instanceName   string
+	allocator      *ipam.Allocator
+	poolName       string
+	ip             string
+	rangeName      string
+	timeout        time.Duration
+
+	// releaseIP is set when the IP was allocated for this pod, not migrated in
+	releaseIP bool
+	// additionalIPs are the IPs allocated besides ip, always for this pod
+	additionalIPs []string
+	// attachIssued is set right before the alias update is sent, attachOp
+	// once GCE accepted it
+	attachIssued bool
+	attachOp     string
+	// routed is set when a VPC route was programmed instead of the alias
+	routed bool
+	// queue is set once the ADD gave up its slot of the node mutation queue,
+	// which the cleanup takes again
+	queue *mutation.Queue
+}
+
+// shouldRun reports whether an ADD that failed with err was aborted rather
+// than failed on its own, in which case the runtime may never send a DEL
+func (c *addCleanup) shouldRun(ctx context.Context, err error) bool {
+	return err != nil && (ctx.Err() != nil || errors.Is(err, errPodGone) || errors.Is(err, ipam.ErrMigrationClaimed))
+}
+
+// run reports whether everything the ADD took was given back, so nothing is
+// left for a DEL to release
+func (c *addCleanup) run() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	cniLog.Infof("[%s] ADD aborted, cleaning up IP %s", c.operation, c.ip)
+
+	if c.queue != nil {
+		if err := c.queue.Acquire(ctx, mutation.PriorityCleanup); err != nil {
+			gceLog.Errorf("[%s] Failed to acquire node mutation queue to clean up IP %s: %v", c.operation, c.ip, err)
+			return false
+		}
+		defer c.queue.Release()
+	}
+
+	if c.routed {
+		if err := detachRoute(ctx, c.operation, c.host, c.projectID, c.zone, c.instanceName, c.ip, c.timeout); err != nil {
+			gceLog.Errorf("[%s] Failed to remove route of aborted ADD for IP %s: %v", c.operation, c.ip, err)
+			return false
+		}
+	} else if c.attachIssued {
+		// The attach has to finish first, the detach needs the fingerprint it leaves behind
+		if c.attachOp != "" {
+			if err := zoneOperations(c.computeService, c.projectID, c.zone).wait(ctx, c.attachOp, c.timeout); err != nil {
+				gceLog.Infof("[%s] Aborted attach operation did not complete: %v", c.operation, err)
+			}
+		}
+		if err := c.detachAlias(ctx); err != nil {
+			// Keep the IP allocated, it may still be attached to this instance
+			gceLog.Errorf("[%s] Failed to detach alias IP %s of aborted ADD: %v", c.operation, c.ip, err)
+			return false
+		}
+	}
+
+	released := true
+	for _, ip := range c.additionalIPs {
+		if err := c.allocator.Release(ctx, c.poolName, ip); err != nil {
+			allocatorLog.Errorf("[%s] Failed to release IP %s of aborted ADD from pool %s: %v", c.operation, ip, c.poolName, err)
+			released = false
+			continue
+		}
+		allocatorLog.Infof("[%s] Released IP %s of aborted ADD from pool %s", c.operation, ip, c.poolName)
+	}
+	if c.releaseIP {
+		if err := c.allocator.Release(ctx, c.poolName, c.ip); err != nil {
+			allocatorLog.Errorf("[%s] Failed to release IP %s of aborted ADD from pool %s: %v", c.operation, c.ip, c.poolName, err)
+			return false
+		}
+		allocatorLog.Infof("[%s] Released IP %s of aborted ADD from pool %s", c.operation, c.ip, c.poolName)
+	}
+	return released
+}
+
+func (c *addCleanup) detachAlias(ctx context.Context) error {
+	nic, err := refreshNIC(ctx, c.operation, c.computeService, c.projectID, c.zone, c.instanceName)
+	if err != nil {
+		return err
+	}
+
+	ips := append([]string{c.ip}, c.additionalIPs...)
+	if !lo.ContainsBy(nic.AliasIpRanges, func(a *compute.AliasIpRange) bool {
+		return lo.ContainsBy(ips, func(ip string) bool { return holdsAlias(a, ip, c.rangeName) })
+	}) {
+		return nil
+	}
+
+	op, err := updateAliases(ctx, c.operation, c.computeService, c.projectID, c.zone, c.instanceName, nic, func(current []*compute.AliasIpRange) []*compute.AliasIpRange {
+		return withoutOwnedAliases(c.operation, current, ips, c.rangeName)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update network interface: %w", err)
+	}
+	return zoneOperations(c.computeService, c.projectID, c.zone).wait(ctx, op.Name, c.timeout)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kuberuntime "k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestAddCancelledReleasesAllocation(t *testing.T) {
+	tests := []struct {
+		name string
+		// ipCount is the number of IPs the pod asks for
+		ipCount string
+		// recheck is the pod the ADD finds when it checks the pod again, nil
+		// for a deleted one
+		recheck func(pod *corev1.Pod) *corev1.Pod
+		// deadline makes the ADD run out of time while waiting for its attach
+		deadline    bool
+		wantUpdates int32
+	}{
+		{
+			name:    "pod deleted while the ADD waited",
+			recheck: func(*corev1.Pod) *corev1.Pod { return nil },
+		},
+		{
+			name: "pod replaced while the ADD waited",
+			recheck: func(pod *corev1.Pod) *corev1.Pod {
+				pod.UID = "other-uid"
+				return pod
+			},
+		},
+		{
+			name: "pod terminating while the ADD waited",
+			recheck: func(pod *corev1.Pod) *corev1.Pod {
+				pod.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+				return pod
+			},
+		},
+		{
+			name:        "deadline during the attach",
+			deadline:    true,
+			wantUpdates: 1,
+		},
+		{
+			name:        "deadline during the attach of several IPs",
+			ipCount:     "3",
+			deadline:    true,
+			wantUpdates: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newAddEnv(t)
+			ctx := context.Background()
+
+			pod, err := env.kube.CoreV1().Pods("default").Get(ctx, "pod", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.ipCount != "" {
+				pod.Annotations = map[string]string{ipam.IPCountAnnotation: tt.ipCount}
+				if pod, err = env.kube.CoreV1().Pods("default").Update(ctx, pod, metav1.UpdateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.recheck != nil {
+				var gets atomic.Int32
+				env.kube.PrependReactor("get", "pods", func(k8stesting.Action) (bool, kuberuntime.Object, error) {
+					if gets.Add(1) == 1 {
+						return true, pod.DeepCopy(), nil
+					}
+					current := tt.recheck(pod.DeepCopy())
+					if current == nil {
+						return true, nil, apierrors.NewNotFound(corev1.Resource("pods"), "pod")
+					}
+					return true, current, nil
+				})
+			}
+
+			if tt.deadline {
+				cfg, err := config.Load(env.config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.Timeouts.Add = metav1.Duration{Duration: time.Second}
+				data, err := cfg.Render()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(env.config, data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+
+				// The attach of the ADD never completes, the one the cleanup waits for does
+				var waits atomic.Int32
+				gce := env.gce
+				env.gce = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if strings.HasSuffix(r.URL.Path, "/operations/operation/wait") && waits.Add(1) == 1 {
+						select {
+						case <-r.Context().Done():
+						case <-time.After(10 * time.Second):
+							t.Error("ADD kept waiting for its attach past the deadline")
+						}
+						return
+					}
+					gce.ServeHTTP(w, r)
+				})
+			}
+
+			args := &skel.CmdArgs{
+				ContainerID: "container",
+				Netns:       "/var/run/netns/container",
+				IfName:      "eth0",
+				Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod",
+				StdinData:   env.stdin,
+			}
+			if err := cmdAdd(args); err == nil {
+				t.Fatal("cancelled ADD succeeded")
+			}
+
+			if n := env.updates.Load(); n != tt.wantUpdates {
+				t.Errorf("alias updates = %d, want %d", n, tt.wantUpdates)
+			}
+
+			pools, err := ipam.NewAllocator(env.dynamic).ListPools(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for ip, allocation := range pools[0].Spec.Allocations {
+				if allocation.PodUID == string(pod.UID) {
+					t.Errorf("IP %s still allocated to the pod of the cancelled ADD", ip)
+				}
+			}
+
+			db, err := store.Open(nodePaths.store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attachment, err := db.Get("container", "eth0")
+			db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attachment.State == store.StateAllocated || attachment.State == store.StateAttached {
+				t.Errorf("attachment state = %s after the cancelled ADD, want it to hold nothing", attachment.State)
+			}
+			if tt.deadline && attachment.State != store.StateReleased {
+				t.Errorf("attachment state = %s, want %s so a DEL leaves its released IPs alone", attachment.State, store.StateReleased)
+			}
+		})
+	}
+}
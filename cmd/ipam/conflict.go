@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/samber/lo"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"google.golang.org/api/compute/v1"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// conflictPingTimeout bounds how long an echo reply from the IP is waited for
+const conflictPingTimeout = time.Second
+
+// conflictError means the IP about to be assigned is already in use elsewhere
+type conflictError struct {
+	ip     string
+	holder string
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("IP %s is already in use by %s", e.ip, e.holder)
+}
+
+// quarantineConflict hands the allocation of a conflicting IP over to a
+// placeholder owner, so the retried ADD gets another IP instead of the first
+// free one again and the DEL of the failed ADD leaves it allocated. The
+// placeholder's lease is never renewed, lease collection gets the IP back
+// once the quarantine is over.
+func quarantineConflict(ctx context.Context, operation string, allocator *ipam.Allocator, args *skel.CmdArgs, poolName, ip, instanceName string) {
+	err := allocator.Quarantine(ctx, poolName, ip, instanceName, time.Now())
+	if err != nil {
+		gceLog.Errorf("[%s] Failed to quarantine conflicting IP %s in pool %s: %v", operation, ip, poolName, err)
+		return
+	}
+	recordAttachment(operation, args, func(a *store.Attachment) {
+		if a.IP == ip {
+			a.IP = ""
+		}
+		a.AdditionalIPs = lo.Without(a.AdditionalIPs, ip)
+	})
+	gceLog.Infof("[%s] Quarantined conflicting IP %s in pool %s", operation, ip, poolName)
+}
+
+// detectConflict checks that nothing uses ip before it is attached to this
+// instance: no neighbor of the node has it, nothing answers a ping to it and
+// no other instance in the network holds it in an alias IP range. A pool that
+// split brain or an alias added by hand would otherwise give two pods the
+// same IP.
+func detectConflict(ctx context.Context, operation string, computeService *compute.Service, projectID, instanceName, network, ip string) error {
+	startTime := time.Now()
+	defer func() {
+		gceLog.Infof("[%s] Conflict detection for IP %s took %v", operation, ip, time.Since(startTime))
+	}()
+
+	if mac, err := neighborMAC(ip); err != nil {
+		gceLog.Errorf("[%s] Failed to read neighbor table: %v", operation, err)
+	} else if mac != "" {
+		return &conflictError{ip: ip, holder: "neighbor " + mac + " of this node"}
+	}
+
+	answered, err := ping(ctx, ip, conflictPingTimeout)
+	if err != nil {
+		gceLog.Errorf("[%s] Failed to ping IP %s: %v", operation, ip, err)
+	} else if answered {
+		return &conflictError{ip: ip, holder: "a host answering ping"}
+	}
+
+	holder, err := aliasHolder(ctx, computeService, projectID, instanceName, network, ip)
+	if err != nil {
+		return fmt.Errorf("failed to scan alias IP ranges for IP %s: %w", ip, err)
+	}
+	if holder != "" {
+		return &conflictError{ip: ip, holder: "an alias IP range of instance " + holder}
+	}
+	return nil
+}
+
+// neighborMAC returns the MAC address of a resolved neighbor entry for ip
+func neighborMAC(ip string) (string, error) {
+	f, err := os.Open(nodePaths.arpTable)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != ip {
+			continue
+		}
+		// 0x2 is ATF_COM, the entry is resolved
+		flags, err := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 32)
+		if err == nil && flags&0x2 != 0 {
+			return fields[3], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// ping sends an ICMP echo request to ip and reports whether it was answered
+// within timeout
+func ping(ctx context.Context, ip string, timeout time.Duration) (bool, error) {
+	dst, err := ipam.ParseAddr(ip)
+	if err != nil || !dst.Is4() {
+		return false, fmt.Errorf("invalid IPv4 address %q", ip)
+	}
+
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return false, err
+	}
+
+	id := os.Getpid() & 0xffff
+	request, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: 1, Data: []byte("gcp-ipam")},
+	}).Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+	if _, err := conn.WriteTo(request, &net.IPAddr{IP: dst.AsSlice()}); err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if ipam.CanonicalIP(peer.String()) != dst.String() {
+			continue
+		}
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.ID == id {
+			return true, nil
+		}
+	}
+}
+
+// aliasHolder returns the name of another instance in network with an alias
+// IP range containing ip, if any
+func aliasHolder(ctx context.Context, computeService *compute.Service, projectID, instanceName, network, ip string) (string, error) {
+	addr, err := ipam.ParseAddr(ip)
+	if err != nil {
+		return "", fmt.Errorf("invalid IP %q: %w", ip, err)
+	}
+	var holder string
+	errFound := errors.New("found")
+
+	err = computeService.Instances.AggregatedList(projectID).
+		Fields("nextPageToken", "items/*/instances(name,networkInterfaces(network,aliasIpRanges))").
+		Pages(ctx, func(list *compute.InstanceAggregatedList) error {
+			for _, scoped := range list.Items {
+				for _, inst := range scoped.Instances {
+					if inst.Name == instanceName {
+						continue
+					}
+					for _, nic := range inst.NetworkInterfaces {
+						if nic.Network != network {
+							continue
+						}
+						for _, r := range nic.AliasIpRanges {
+							if prefix, err := ipam.ParsePrefix(r.IpCidrRange); err == nil && prefix.Contains(addr) {
+								holder = inst.Name
+								return errFound
+							}
+						}
+					}
+				}
+			}
+			return nil
+		})
+	if errors.Is(err, errFound) {
+		return holder, nil
+	}
+	return "", err
+}
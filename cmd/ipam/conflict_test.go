@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestNeighborMAC(t *testing.T) {
+	saved := nodePaths.arpTable
+	t.Cleanup(func() { nodePaths.arpTable = saved })
+	nodePaths.arpTable = filepath.Join(t.TempDir(), "arp")
+	table := `IP address       HW type     Flags       HW address            Mask     Device
+10.8.0.5         0x1         0x2         42:01:0a:08:00:05     *        eth0
+10.8.0.6         0x1         0x0         00:00:00:00:00:00     *        eth0
+`
+	if err := os.WriteFile(nodePaths.arpTable, []byte(table), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		wantMAC string
+	}{
+		{ip: "10.8.0.5", wantMAC: "42:01:0a:08:00:05"},
+		// Incomplete entries are left behind by lookups nobody answered
+		{ip: "10.8.0.6"},
+		{ip: "10.8.0.7"},
+	}
+	for _, tt := range tests {
+		mac, err := neighborMAC(tt.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mac != tt.wantMAC {
+			t.Errorf("neighborMAC(%s) = %q, want %q", tt.ip, mac, tt.wantMAC)
+		}
+	}
+}
+
+func TestAliasHolder(t *testing.T) {
+	const network = "https://www.googleapis.com/compute/v1/projects/project/global/networks/default"
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/projects/project/aggregated/instances" {
+			t.Errorf("unexpected GCE call %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		instance := func(name, network, cidr string) *compute.Instance {
+			return &compute.Instance{Name: name, NetworkInterfaces: []*compute.NetworkInterface{{
+				Network:       network,
+				AliasIpRanges: []*compute.AliasIpRange{{IpCidrRange: cidr}},
+			}}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&compute.InstanceAggregatedList{Items: map[string]compute.InstancesScopedList{
+			"zones/europe-west1-b": {Instances: []*compute.Instance{
+				instance("node-1", network, "10.8.0.5/32"),
+				instance("other-vpc", "https://www.googleapis.com/compute/v1/projects/project/global/networks/other", "10.8.0.6/32"),
+			}},
+			"zones/europe-west1-c": {Instances: []*compute.Instance{
+				instance("node-2", network, "10.8.0.16/28"),
+			}},
+		}})
+	}))
+	defer gce.Close()
+	computeService, err := compute.NewService(context.Background(), option.WithEndpoint(gce.URL), option.WithHTTPClient(gce.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip         string
+		wantHolder string
+	}{
+		{ip: "10.8.0.20", wantHolder: "node-2"},
+		// The instance itself and other networks do not conflict
+		{ip: "10.8.0.5"},
+		{ip: "10.8.0.6"},
+		{ip: "10.8.0.40"},
+	}
+	for _, tt := range tests {
+		holder, err := aliasHolder(context.Background(), computeService, "project", "node-1", network, tt.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if holder != tt.wantHolder {
+			t.Errorf("aliasHolder(%s) = %q, want %q", tt.ip, holder, tt.wantHolder)
+		}
+	}
+}
+
+func TestQuarantineConflict(t *testing.T) {
+	env := newAddEnv(t)
+	const ip = "10.8.0.9"
+	env.setAllocation(t, ip, v1alpha1.IPAllocation{PodNamespace: "default", PodName: "pod", PodUID: "pod-uid", NodeName: benchInstance})
+	args := &skel.CmdArgs{ContainerID: "container", IfName: "eth0"}
+	recordAttachment("ADD", args, func(a *store.Attachment) { a.IP, a.Pool = ip, benchPool })
+
+	allocator := ipam.NewAllocator(env.dynamic)
+	quarantineConflict(context.Background(), "ADD", allocator, args, benchPool, ip, benchInstance)
+
+	allocation, ok, err := allocator.AllocationOf(context.Background(), benchPool, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || allocation.PodName != ipam.ConflictPlaceholder || allocation.NodeName != benchInstance {
+		t.Fatalf("allocation = %+v, %v, want held by the %s placeholder", allocation, ok, ipam.ConflictPlaceholder)
+	}
+	// The pool has no leases, the quarantine expires all the same
+	if allocation.LeaseExpiresAt == nil || time.Until(allocation.LeaseExpiresAt.Time) > ipam.ConflictQuarantine {
+		t.Errorf("placeholder lease expires at %v, want within %v", allocation.LeaseExpiresAt, ipam.ConflictQuarantine)
+	}
+
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	attachment, err := db.Get("container", "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment != nil && attachment.IP != "" {
+		t.Errorf("attachment keeps IP %s, want it dropped so the DEL leaves the placeholder alone", attachment.IP)
+	}
+}
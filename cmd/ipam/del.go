@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// getPodForDel fetches the pod of a DEL. Any error, including the pod being
+// gone, leaves DEL to work from its local records.
+func getPodForDel(ctx context.Context, k8sclient kubernetes.Interface, namespace, name string) (*corev1.Pod, error) {
+	pod, err := k8sclient.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %w", namespace, name, err)
+	}
+	return pod, nil
+}
+
+// delIPs returns the IPs to clean up for a DEL: the ones recorded for the
+// container interface, then those of the prevResult the runtime passes for
+// it, then those of the pod status. fromStatus reports the latter, which may
+// list addresses of other interfaces, plugins or an earlier sandbox, so they
+// are checked against the pool before they are touched. Empty when none of
+// them knows an IP.
+func delIPs(conf *PluginConf, ifName string, recorded *store.Attachment, pod *corev1.Pod) (ips []string, fromStatus bool) {
+	if recorded != nil && recorded.IP != "" {
+		return append([]string{recorded.IP}, recorded.AdditionalIPs...), false
+	}
+
+	if conf.PrevResult != nil {
+		if result, err := current.NewResultFromResult(conf.PrevResult); err == nil {
+			for _, ip := range result.IPs {
+				// A chained result also lists the addresses of other interfaces
+				if i := ip.Interface; i != nil && *i >= 0 && *i < len(result.Interfaces) && result.Interfaces[*i].Name != ifName {
+					continue
+				}
+				ips = append(ips, ip.Address.IP.String())
+			}
+			if len(ips) > 0 {
+				return ips, false
+			}
+		}
+	}
+
+	if pod == nil {
+		return nil, false
+	}
+	for _, ip := range pod.Status.PodIPs {
+		if ip.IP != "" {
+			ips = append(ips, ip.IP)
+		}
+	}
+	return ips, true
+}
+
+// podOwnedIPs keeps the IPs of the pod status the pool holds for the pod, the
+// others belong to other plugins or were handed on already
+func podOwnedIPs(ctx context.Context, operation string, allocator *ipam.Allocator, poolName string, pod *corev1.Pod, ips []string) []string {
+	var owned []string
+	for _, ip := range ips {
+		allocation, ok, err := allocator.AllocationOf(ctx, poolName, ip)
+		switch {
+		case err != nil:
+			allocatorLog.Errorf("[%s] Failed to look up allocation of IP %s in pool %s, leaving it alone: %v", operation, ip, poolName, err)
+		case !ok || allocation.PodUID != string(pod.UID):
+			allocatorLog.Infof("[%s] IP %s of the pod status is not allocated to the pod in pool %s, leaving it alone", operation, ip, poolName)
+		default:
+			owned = append(owned, ip)
+		}
+	}
+	return owned
+}
+
+// delAliasRange returns the secondary range the alias was attached from.
+// Attachments recorded before the range was tracked match the /32 in any range.
+func delAliasRange(recorded *store.Attachment) string {
+	if recorded == nil {
+		return ""
+	}
+	return recorded.SecondaryRange
+}
+
+// delPoolName returns the pool recorded at ADD, falling back to the pool of
+// the subnetwork when the pod annotations cannot be consulted
+func delPoolName(conf *PluginConf, pluginConfig *config.Config, subnetwork string, recorded *store.Attachment) string {
+	if recorded != nil && recorded.Pool != "" {
+		return recorded.Pool
+	}
+	return resolvePoolName(conf, pluginConfig, subnetwork)
+}
+
+// deferRelease records the IPs and pool of the attachment so the installer
+// can complete the pool release later, the first as its IP and the others as
+// its additional IPs. It reports whether DEL should finish in the
+// release-pending state.
+func deferRelease(operation string, args *skel.CmdArgs, ips []string, pool string) bool {
+	recordAttachment(operation, args, func(a *store.Attachment) {
+		a.IP = ips[0]
+		a.AdditionalIPs = ips[1:]
+		a.Pool = pool
+	})
+	allocatorLog.Infof("[%s] Deferred release of IPs %v to pool %s", operation, ips, pool)
+	return true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	logging "github.com/k8snetworkplumbingwg/cni-log"
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestDelIPs(t *testing.T) {
+	withPrev, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "gke-pod-network",
+		"type": "ptp",
+		"ipam": {"type": "gcp-ipam"},
+		"prevResult": {
+			"cniVersion": "1.0.0",
+			"interfaces": [{"name": "veth1"}, {"name": "eth0", "sandbox": "/var/run/netns/pod"}],
+			"ips": [{"address": "10.0.0.5/32", "interface": 1}, {"address": "10.9.0.1/32", "interface": 0}]
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutPrev := &PluginConf{}
+	pod := &corev1.Pod{Status: corev1.PodStatus{PodIPs: []corev1.PodIP{{IP: "10.0.0.7"}, {IP: "fd00::7"}}}}
+
+	tests := []struct {
+		name       string
+		conf       *PluginConf
+		recorded   *store.Attachment
+		pod        *corev1.Pod
+		want       []string
+		fromStatus bool
+	}{
+		{name: "recorded", conf: withPrev, recorded: &store.Attachment{IP: "10.0.0.4"}, pod: pod, want: []string{"10.0.0.4"}},
+		{name: "prevResult of the interface", conf: withPrev, pod: pod, want: []string{"10.0.0.5"}},
+		{name: "every pod status IP", conf: withoutPrev, recorded: &store.Attachment{}, pod: pod, want: []string{"10.0.0.7", "fd00::7"}, fromStatus: true},
+		{name: "pod without IPs", conf: withoutPrev, pod: &corev1.Pod{}, fromStatus: true},
+		{name: "nothing known", conf: withoutPrev},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, fromStatus := delIPs(tt.conf, "eth0", tt.recorded, tt.pod)
+			if !slices.Equal(ips, tt.want) || fromStatus != tt.fromStatus {
+				t.Errorf("delIPs() = %v, %v, want %v, %v", ips, fromStatus, tt.want, tt.fromStatus)
+			}
+		})
+	}
+}
+
+func TestWithoutOwnedAlias(t *testing.T) {
+	aliases := []*compute.AliasIpRange{
+		{IpCidrRange: "10.8.0.4/32", SubnetworkRangeName: "live"},
+		{IpCidrRange: "10.8.0.8/30", SubnetworkRangeName: "live"},
+		{IpCidrRange: "10.9.0.0/24", SubnetworkRangeName: "gke-pods"},
+	}
+	cidrs := func(aliases []*compute.AliasIpRange) []string {
+		var cidrs []string
+		for _, a := range aliases {
+			cidrs = append(cidrs, a.IpCidrRange+" "+a.SubnetworkRangeName)
+		}
+		return cidrs
+	}
+
+	tests := []struct {
+		name      string
+		ip        string
+		rangeName string
+		want      []string
+	}{
+		{name: "host prefix", ip: "10.8.0.4", rangeName: "live", want: []string{"10.8.0.8/30 live", "10.9.0.0/24 gke-pods"}},
+		{name: "split", ip: "10.8.0.9", rangeName: "live", want: []string{"10.8.0.4/32 live", "10.8.0.10/31 live", "10.8.0.8/32 live", "10.9.0.0/24 gke-pods"}},
+		{name: "split of unknown range", ip: "10.8.0.9", want: cidrs(aliases)},
+		{name: "foreign range", ip: "10.9.0.3", rangeName: "live", want: cidrs(aliases)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cidrs(withoutOwnedAlias("DEL", aliases, tt.ip, tt.rangeName)); !slices.Equal(got, tt.want) {
+				t.Errorf("withoutOwnedAlias() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithoutOwnedAliasLimit(t *testing.T) {
+	// A /28 splits into 4 prefixes, 3 more than it takes now
+	aliases := append(nodeAliases(ipam.MaxAliasRanges-4), &compute.AliasIpRange{IpCidrRange: "10.8.1.0/28", SubnetworkRangeName: "live"})
+	left := withoutOwnedAlias("DEL", aliases, "10.8.1.5", "live")
+	if len(left) != ipam.MaxAliasRanges {
+		t.Errorf("withoutOwnedAlias() left %d aliases, want the split within the limit of %d", len(left), ipam.MaxAliasRanges)
+	}
+	if held := stillHeld(left, []string{"10.8.1.5"}, "live"); len(held) != 0 {
+		t.Errorf("stillHeld() = %v after the split, want none", held)
+	}
+
+	// One alias more and the split would take the interface past the limit
+	aliases = append(nodeAliases(ipam.MaxAliasRanges-3), &compute.AliasIpRange{IpCidrRange: "10.8.1.0/28", SubnetworkRangeName: "live"})
+	left = withoutOwnedAlias("DEL", aliases, "10.8.1.5", "live")
+	if !slices.Equal(left, aliases) {
+		t.Errorf("withoutOwnedAlias() changed the aliases past the limit: %s", summarizeAliases(left))
+	}
+	if held := stillHeld(left, []string{"10.8.0.3", "10.8.1.5"}, "live"); !slices.Equal(held, []string{"10.8.0.3", "10.8.1.5"}) {
+		t.Errorf("stillHeld() = %v, want the IPs the aliases hold", held)
+	}
+}
+
+// nodeAliases are the aliases of a node running n pods
+func nodeAliases(n int) []*compute.AliasIpRange {
+	aliases := make([]*compute.AliasIpRange, 0, n)
+	for i := range n {
+		aliases = append(aliases, &compute.AliasIpRange{
+			IpCidrRange:         fmt.Sprintf("10.8.%d.%d/32", i/256, i%256),
+			SubnetworkRangeName: "live",
+		})
+	}
+	return aliases
+}
+
+func TestSummarizeAliases(t *testing.T) {
+	if got, want := summarizeAliases(nodeAliases(2)), "[10.8.0.0/32 (live), 10.8.0.1/32 (live)]"; got != want {
+		t.Errorf("summarizeAliases() = %q, want %q", got, want)
+	}
+	got := summarizeAliases(nodeAliases(110))
+	if n := strings.Count(got, "/32"); n != maxLoggedAliases {
+		t.Errorf("summarizeAliases() lists %d aliases, want %d", n, maxLoggedAliases)
+	}
+	if !strings.HasSuffix(got, fmt.Sprintf(" and %d more]", 110-maxLoggedAliases)) {
+		t.Errorf("summarizeAliases() = %q, want the rest counted", got)
+	}
+}
+
+// BenchmarkWithoutOwnedAliases covers the DEL of a pod on a node with more
+// aliases than the 100 of a single alias range limit, as with route fallback
+func BenchmarkWithoutOwnedAliases(b *testing.B) {
+	for _, level := range []logging.Level{logging.InfoLevel, logging.DebugLevel} {
+		b.Run(level.String(), func(b *testing.B) {
+			logging.SetLogLevel(level)
+			aliases := nodeAliases(128)
+			b.ReportAllocs()
+			for b.Loop() {
+				withoutOwnedAliases("DEL", aliases, []string{"10.8.0.64"}, "live")
+			}
+		})
+	}
+}
+
+func TestDeferRelease(t *testing.T) {
+	newAddEnv(t)
+	args := &skel.CmdArgs{ContainerID: "container", IfName: "eth0"}
+
+	if !deferRelease("DEL", args, []string{"10.8.0.5", "10.8.0.6", "10.8.0.7"}, "pool") {
+		t.Fatal("deferRelease() did not leave DEL release-pending")
+	}
+	s, err := store.Open(nodePaths.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	a, err := s.Get("container", "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every IP of the pod is left to the installer, not only the first
+	if a.IP != "10.8.0.5" || !slices.Equal(a.AdditionalIPs, []string{"10.8.0.6", "10.8.0.7"}) || a.Pool != "pool" {
+		t.Errorf("attachment = %s %v of %s, want every IP of pool", a.IP, a.AdditionalIPs, a.Pool)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/hooks"
+	"github.com/castai/gcp-cni/internal/telemetry"
+)
+
+// runAttachHooks runs the afterAttach hooks for every IP of the pod. Once a
+// Fail hook fails the ADD, its IPs are released again, so the beforeRelease
+// hooks run for the IPs the afterAttach hooks were told about.
+func runAttachHooks(ctx context.Context, operation string, pluginConfig *config.Config, args *skel.CmdArgs, cniArgs map[string]string, ips []string, pool, rangeName, instanceName string) error {
+	for i, ip := range ips {
+		err := runHooks(ctx, operation, pluginConfig, config.HookAfterAttach, args, cniArgs, ip, pool, rangeName, instanceName)
+		if err == nil {
+			continue
+		}
+		for _, hooked := range ips[:i+1] {
+			if err := runHooks(ctx, operation, pluginConfig, config.HookBeforeRelease, args, cniArgs, hooked, pool, rangeName, instanceName); err != nil {
+				cniLog.Errorf("[%s] %v, releasing IP %s anyway", operation, err, hooked)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// runHooks runs the hooks of the plugin configuration subscribed to eventType
+// for ip. Only failures of hooks with the Fail policy are returned.
+func runHooks(ctx context.Context, operation string, pluginConfig *config.Config, eventType string, args *skel.CmdArgs, cniArgs map[string]string, ip, pool, rangeName, instanceName string) error {
+	if len(pluginConfig.Hooks) == 0 {
+		return nil
+	}
+
+	startTime := time.Now()
+	err := hooks.Run(ctx, pluginConfig.Hooks, hooks.Event{
+		Type:           eventType,
+		Time:           startTime,
+		IP:             ip,
+		Pool:           pool,
+		SecondaryRange: rangeName,
+		Instance:       instanceName,
+		PodNamespace:   cniArgs["K8S_POD_NAMESPACE"],
+		PodName:        cniArgs["K8S_POD_NAME"],
+		PodUID:         cniArgs["K8S_POD_UID"],
+		ContainerID:    args.ContainerID,
+		IfName:         args.IfName,
+	}, func(hook string, err error) {
+		cniLog.Warningf("[%s] Hook %s failed on %s of IP %s, ignoring: %v", operation, hook, eventType, ip, err)
+	})
+	telemetry.Phase(ctx, "hooks", time.Since(startTime))
+	cniLog.Debugf("[%s] Hooks on %s of IP %s took %v", operation, eventType, ip, time.Since(startTime))
+	return err
+}
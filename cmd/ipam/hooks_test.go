@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/hooks"
+)
+
+func TestRunAttachHooks(t *testing.T) {
+	events := filepath.Join(t.TempDir(), "events")
+	pluginConfig := &config.Config{Hooks: []config.Hook{
+		{Name: "record", Events: []string{config.HookAfterAttach, config.HookBeforeRelease},
+			Command: []string{"sh", "-c", "cat >> " + events + " && echo >> " + events}},
+		{Name: "reject", Events: []string{config.HookAfterAttach}, FailurePolicy: config.HookFailurePolicyFail,
+			Command: []string{"sh", "-c", "! grep -q 10.8.0.3"}},
+	}}
+	args := &skel.CmdArgs{ContainerID: "container", IfName: "eth0"}
+
+	err := runAttachHooks(context.Background(), "ADD", pluginConfig, args, map[string]string{}, []string{"10.8.0.2", "10.8.0.3", "10.8.0.4"}, "pool", "live", "node-1")
+	if err == nil {
+		t.Fatal("runAttachHooks() with a failing Fail hook succeeded")
+	}
+
+	f, err := os.Open(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event hooks.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, event.Type+" "+event.IP)
+	}
+	want := []string{
+		"afterAttach 10.8.0.2",
+		"afterAttach 10.8.0.3",
+		"beforeRelease 10.8.0.2",
+		"beforeRelease 10.8.0.3",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("hook events = %q, want %q", got, want)
+	}
+}
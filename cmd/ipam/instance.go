@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	logging "github.com/k8snetworkplumbingwg/cni-log"
+	"github.com/samber/lo"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/castai/gcp-cni/internal/instance"
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const (
+	// fingerprintRetries bounds the rereads after a fingerprint conflict
+	fingerprintRetries = 3
+	// fingerprintBackoff spaces retries after the first immediate one
+	fingerprintBackoff = 250 * time.Millisecond
+	// maxLoggedAliases caps the aliases a log line spells out, nodes with
+	// hundreds of pods have as many
+	maxLoggedAliases = 16
+)
+
+// loadInstanceCache returns the node instance cache, empty when it cannot be read
+func loadInstanceCache() *instance.Cache {
+	cache, err := instance.Load(nodePaths.instanceCache)
+	if err != nil {
+		gceLog.Infof("Ignoring instance cache: %v", err)
+	}
+	return cache
+}
+
+func saveInstanceCache(cache *instance.Cache) {
+	if err := cache.Save(nodePaths.instanceCache); err != nil {
+		gceLog.Errorf("Failed to save instance cache: %v", err)
+	}
+}
+
+// podSubnetwork is the subnetwork of the network interface pod aliases are
+// attached to, the primary interface when empty. It is set from the plugin
+// configuration at the start of every invocation.
+var podSubnetwork string
+
+// clusterID is the cluster ID of the plugin configuration and clusterRanges
+// the known secondary range names of the cluster, aliases of other ranges are
+// never the plugin's to remove. They are set at the start of every invocation.
+var (
+	clusterID     string
+	clusterRanges []string
+)
+
+// podNIC returns the network interface of the instance pod aliases are
+// attached to, from the cache while no mutation made its fingerprint stale
+func podNIC(ctx context.Context, operation string, computeService *compute.Service, projectID, zone, instanceName string) (*compute.NetworkInterface, error) {
+	if cache := loadInstanceCache(); cache.NIC != nil && cache.NIC.Fingerprint != "" && isPodInterface(cache.NIC) {
+		gceLog.Debugf("[%s] Using cached network interface of instance %s", operation, instanceName)
+		return cache.NIC, nil
+	}
+	return refreshNIC(ctx, operation, computeService, projectID, zone, instanceName)
+}
+
+// refreshNIC reads the pod network interface from GCE and caches it
+func refreshNIC(ctx context.Context, operation string, computeService *compute.Service, projectID, zone, instanceName string) (*compute.NetworkInterface, error) {
+	nic, err := instanceNIC(ctx, operation, computeService, projectID, zone, instanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := loadInstanceCache()
+	cache.NIC = nic
+	saveInstanceCache(cache)
+	return nic, nil
+}
+
+// instanceNIC reads the pod network interface of any instance from GCE
+func instanceNIC(ctx context.Context, operation string, computeService *compute.Service, projectID, zone, instanceName string) (*compute.NetworkInterface, error) {
+	startTime := time.Now()
+	inst, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	gceLog.Infof("[%s][Cloud Operation] Get instance %s took %v", operation, instanceName, time.Since(startTime))
+	telemetry.Phase(ctx, "get-instance", time.Since(startTime))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance details: %w", err)
+	}
+	return podInterface(inst)
+}
+
+// podInterface picks the pod network interface out of the interfaces of inst
+func podInterface(inst *compute.Instance) (*compute.NetworkInterface, error) {
+	if len(inst.NetworkInterfaces) == 0 {
+		return nil, fmt.Errorf("instance %s has no network interfaces", inst.Name)
+	}
+	if podSubnetwork == "" {
+		return inst.NetworkInterfaces[0], nil
+	}
+	for _, nic := range inst.NetworkInterfaces {
+		if isPodInterface(nic) {
+			return nic, nil
+		}
+	}
+	return nil, fmt.Errorf("instance %s has no network interface in subnetwork %s, it is attached by the provisioner", inst.Name, podSubnetwork)
+}
+
+func isPodInterface(nic *compute.NetworkInterface) bool {
+	if podSubnetwork == "" {
+		// GCE names the primary interface nic0
+		return nic.Name == "" || nic.Name == "nic0"
+	}
+	return ipam.SubnetworkName(nic.Subnetwork) == podSubnetwork
+}
+
+// subnetworkCIDR returns the primary range of the subnetwork, which is only
+// read from GCE once per node boot
+func subnetworkCIDR(ctx context.Context, operation string, computeService *compute.Service, projectID, region, subnetwork string) (string, error) {
+	cache := loadInstanceCache()
+	if cidr, ok := cache.SubnetworkCIDRs[subnetwork]; ok {
+		return cidr, nil
+	}
+
+	startTime := time.Now()
+	subnet, err := computeService.Subnetworks.Get(projectID, region, subnetwork).Context(ctx).Do()
+	gceLog.Infof("[%s][Cloud Operation] Get subnetwork %s took %v", operation, subnetwork, time.Since(startTime))
+	telemetry.Phase(ctx, "get-subnetwork", time.Since(startTime))
+	if err != nil {
+		return "", fmt.Errorf("failed to get subnetwork details: %w", err)
+	}
+
+	if cache.SubnetworkCIDRs == nil {
+		cache.SubnetworkCIDRs = map[string]string{}
+	}
+	cache.SubnetworkCIDRs[subnetwork] = subnet.IpCidrRange
+	saveInstanceCache(cache)
+	return subnet.IpCidrRange, nil
+}
+
+// updateAliases replaces the alias IP ranges of the pod network interface
+// with what aliases makes of the current ones. A stale cached fingerprint is
+// detected by GCE, in which case the interface is read again and the update
+// retried. Any accepted update makes the cached fingerprint stale.
+func updateAliases(ctx context.Context, operation string, computeService *compute.Service, projectID, zone, instanceName string,
+	nic *compute.NetworkInterface, aliases func([]*compute.AliasIpRange) []*compute.AliasIpRange) (*compute.Operation, error) {
+	op, err := updateNICAliases(ctx, operation, computeService, projectID, zone, instanceName, nic, refreshNIC, aliases)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := loadInstanceCache()
+	cache.NIC = nil
+	saveInstanceCache(cache)
+	return op, nil
+}
+
+// updateInstanceAliases is updateAliases for an instance other than this
+// node's, whose interface is read fresh and never cached
+func updateInstanceAliases(ctx context.Context, operation string, computeService *compute.Service, projectID, zone, instanceName string,
+	aliases func([]*compute.AliasIpRange) []*compute.AliasIpRange) (*compute.Operation, error) {
+	nic, err := instanceNIC(ctx, operation, computeService, projectID, zone, instanceName)
+	if err != nil {
+		return nil, err
+	}
+	return updateNICAliases(ctx, operation, computeService, projectID, zone, instanceName, nic, instanceNIC, aliases)
+}
+
+// updateNICAliases sends the alias update guarded by the interface
+// fingerprint. GKE's netd and other node agents update the same interface, so
+// on a fingerprint conflict it is read again and the update reapplied to what
+// they wrote, a few times with jittered backoff while they settle.
+func updateNICAliases(ctx context.Context, operation string, computeService *compute.Service, projectID, zone, instanceName string,
+	nic *compute.NetworkInterface, read func(context.Context, string, *compute.Service, string, string, string) (*compute.NetworkInterface, error),
+	aliases func([]*compute.AliasIpRange) []*compute.AliasIpRange) (*compute.Operation, error) {
+	for attempt := 0; ; attempt++ {
+		startTime := time.Now()
+		op, err := computeService.Instances.UpdateNetworkInterface(projectID, zone, instanceName, nic.Name, &compute.NetworkInterface{
+			Fingerprint:   nic.Fingerprint,
+			AliasIpRanges: aliases(nic.AliasIpRanges),
+		}).Context(ctx).Do()
+		gceLog.Infof("[%s][Cloud Operation] Update network interface on instance %s took %v", operation, instanceName, time.Since(startTime))
+		telemetry.Phase(ctx, "update-network-interface", time.Since(startTime))
+		if !isFingerprintConflict(err) || attempt == fingerprintRetries {
+			return op, err
+		}
+
+		gceLog.Infof("[%s] Network interface fingerprint of instance %s is stale, reading it again", operation, instanceName)
+		telemetry.Retry(ctx, "update-network-interface")
+		if attempt > 0 {
+			backoff := time.Duration(attempt)*fingerprintBackoff + rand.N(fingerprintBackoff)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+		if nic, err = read(ctx, operation, computeService, projectID, zone, instanceName); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func isFingerprintConflict(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// ownedAliasAttached reports whether the alias of ip from rangeName is among
+// aliases. The host prefix attached from any other range belongs to someone else and
+// is a conflict the plugin must not paper over.
+func ownedAliasAttached(aliases []*compute.AliasIpRange, ip, rangeName string) (bool, error) {
+	for _, a := range aliases {
+		if holdsAlias(a, ip, rangeName) {
+			return true, nil
+		}
+		if ipam.IsHostPrefix(a.IpCidrRange, ip) {
+			return false, fmt.Errorf("IP %s is attached from secondary range %q, not %q", ip, a.SubnetworkRangeName, rangeName)
+		}
+	}
+	return false, nil
+}
+
+// holdsAlias is ipam.HoldsAlias limited to the secondary ranges of the
+// cluster, rangeName among them
+func holdsAlias(a *compute.AliasIpRange, ip, rangeName string) bool {
+	return (a.SubnetworkRangeName == rangeName || ipam.InClusterRange(a.SubnetworkRangeName, clusterID, clusterRanges...)) &&
+		ipam.HoldsAlias(a.IpCidrRange, a.SubnetworkRangeName, ip, rangeName)
+}
+
+// withoutOwnedAlias returns aliases without the alias of ip the plugin
+// attached from rangeName. A wider alias holding ip is split into the
+// prefixes of the rest of it, unless that takes the interface past
+// ipam.MaxAliasRanges: GCE would refuse the whole update, so the alias is
+// kept and ip stays attached, see stillHeld. Everything else, including
+// ranges GKE and other controllers manage, is passed through as read.
+func withoutOwnedAlias(operation string, aliases []*compute.AliasIpRange, ip, rangeName string) []*compute.AliasIpRange {
+	kept := make([]*compute.AliasIpRange, 0, len(aliases))
+	for i, a := range aliases {
+		if holdsAlias(a, ip, rangeName) {
+			rest := ipam.SplitAlias(a.IpCidrRange, ip)
+			if n := len(aliases) - 1 + len(rest); n > ipam.MaxAliasRanges {
+				gceLog.Errorf("[%s] Splitting alias %s to release %s takes the instance to %d alias ranges, over the limit of %d, keeping it",
+					operation, a.IpCidrRange, ip, n, ipam.MaxAliasRanges)
+				return append(kept, aliases[i:]...)
+			}
+			if len(rest) > 0 {
+				gceLog.Infof("[%s] Splitting alias %s into %v to release %s", operation, a.IpCidrRange, rest, ip)
+			}
+			for _, cidr := range rest {
+				kept = append(kept, &compute.AliasIpRange{IpCidrRange: cidr, SubnetworkRangeName: a.SubnetworkRangeName})
+			}
+			continue
+		}
+		if ipam.IsHostPrefix(a.IpCidrRange, ip) {
+			gceLog.Infof("[%s] Keeping alias %s from foreign secondary range %q", operation, a.IpCidrRange, a.SubnetworkRangeName)
+		}
+		kept = append(kept, a)
+	}
+	return kept
+}
+
+// withoutOwnedAliases returns aliases without those of ips. Only the counts are
+// logged, the aliases left are listed at debug level up to maxLoggedAliases.
+func withoutOwnedAliases(operation string, aliases []*compute.AliasIpRange, ips []string, rangeName string) []*compute.AliasIpRange {
+	kept := aliases
+	for _, ip := range ips {
+		kept = withoutOwnedAlias(operation, kept, ip, rangeName)
+	}
+	gceLog.Infof("[%s] Removing %d of %d aliases of the instance", operation, len(aliases)-len(kept), len(aliases))
+	if gceLog.enabled(logging.DebugLevel) {
+		gceLog.Debugf("[%s] Aliases left on the instance: %s", operation, summarizeAliases(kept))
+	}
+	return kept
+}
+
+// stillHeld returns the IPs of ips that aliases, as left by withoutOwnedAlias,
+// still hold from rangeName. They must stay allocated, another node could not
+// attach them.
+func stillHeld(aliases []*compute.AliasIpRange, ips []string, rangeName string) []string {
+	return lo.Filter(ips, func(ip string, _ int) bool {
+		return lo.ContainsBy(aliases, func(a *compute.AliasIpRange) bool { return holdsAlias(a, ip, rangeName) })
+	})
+}
+
+// summarizeAliases lists the first maxLoggedAliases aliases and counts the rest
+func summarizeAliases(aliases []*compute.AliasIpRange) string {
+	var b strings.Builder
+	for i, a := range aliases {
+		if i == maxLoggedAliases {
+			fmt.Fprintf(&b, " and %d more", len(aliases)-i)
+			break
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(a.IpCidrRange)
+		if a.SubnetworkRangeName != "" {
+			b.WriteString(" (" + a.SubnetworkRangeName + ")")
+		}
+	}
+	return "[" + b.String() + "]"
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	logging "github.com/k8snetworkplumbingwg/cni-log"
+
+	"github.com/castai/gcp-cni/internal/config"
+)
+
+// logComponent is a part of the plugin whose log level is set on its own in
+// the logging section of the plugin configuration. The cni-log level stays at
+// debug, components drop what is above their level.
+type logComponent struct {
+	level logging.Level
+}
+
+var (
+	cniLog       = &logComponent{level: logging.DebugLevel}
+	allocatorLog = &logComponent{level: logging.DebugLevel}
+	gceLog       = &logComponent{level: logging.DebugLevel}
+)
+
+// setLogLevels applies the logging section of the plugin configuration
+func setLogLevels(cfg config.Logging) {
+	level := func(name string) logging.Level {
+		if name == "" {
+			name = cfg.Level
+		}
+		if name == "" {
+			return logging.DebugLevel
+		}
+		return logging.StringToLevel(name)
+	}
+	cniLog.level = level(cfg.CNI)
+	allocatorLog.level = level(cfg.Allocator)
+	gceLog.level = level(cfg.GCE)
+}
+
+// enabled reports whether messages of level are logged
+func (c *logComponent) enabled(level logging.Level) bool {
+	return level <= c.level
+}
+
+func (c *logComponent) Debugf(format string, a ...any) {
+	if c.enabled(logging.DebugLevel) {
+		logging.Debugf(format, a...)
+	}
+}
+
+func (c *logComponent) Infof(format string, a ...any) {
+	if c.enabled(logging.InfoLevel) {
+		logging.Infof(format, a...)
+	}
+}
+
+func (c *logComponent) Warningf(format string, a ...any) {
+	if c.enabled(logging.WarningLevel) {
+		logging.Warningf(format, a...)
+	}
+}
+
+func (c *logComponent) Errorf(format string, a ...any) {
+	if c.enabled(logging.ErrorLevel) {
+		logging.Errorf(format, a...)
+	}
+}
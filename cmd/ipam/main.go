@@ -17,42 +17,75 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
-	"cloud.google.com/go/compute/metadata"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
-	"github.com/containernetworking/cni/pkg/version"
+	cniversion "github.com/containernetworking/cni/pkg/version"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
-	"github.com/gofrs/flock"
 	logging "github.com/k8snetworkplumbingwg/cni-log"
 	"github.com/samber/lo"
-	"github.com/sanity-io/litter"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/instance"
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/quota"
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/internal/subnetpool"
+	"github.com/castai/gcp-cni/internal/telemetry"
 	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
 	"github.com/castai/gcp-cni/pkg/ipam"
 )
 
+var (
+	// Set at build time via ldflags
+	version = "dev"
+	commit  = "unknown"
+)
+
 type PluginConf struct {
 	types.NetConf
 
-	Args          map[string]string      `json:"args"`
-	RuntimeConfig map[string]interface{} `json:"runtimeConfig"`
-	IPPoolName    string                 `json:"ipPoolName,omitempty"` // Name of the IPPool resource to use
+	Args               map[string]string      `json:"args"`
+	RuntimeConfig      map[string]interface{} `json:"runtimeConfig"`
+	IPPoolName         string                 `json:"ipPoolName,omitempty"`         // Name of the IPPool resource to use
+	SecondaryRangeName string                 `json:"secondaryRangeName,omitempty"` // Secondary range aliases are attached from when the pool names none
+	IPAM               IPAMConf               `json:"ipam,omitempty"`               // Shadows NetConf.IPAM with gcp-ipam specific settings
+}
+
+// IPAMConf is the ipam section of the network configuration
+type IPAMConf struct {
+	Type string `json:"type,omitempty"`
+
+	// PluginVersion is the gcp-ipam release the installer wrote this config for
+	PluginVersion string `json:"gcpIpamVersion,omitempty"`
+
+	// ConfigPath is the runtime config file rendered by the installer
+	ConfigPath string `json:"configPath,omitempty"`
 }
 
 func parseConfig(stdin []byte) (*PluginConf, error) {
@@ -62,14 +95,142 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 		return nil, fmt.Errorf("failed to parse network configuration: %w", err)
 	}
 
-	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+	if err := cniversion.ParsePrevResult(&conf.NetConf); err != nil {
 		return nil, fmt.Errorf("could not parse prevResult: %w", err)
 	}
 
 	return &conf, nil
 }
 
+// loadPluginConfig reads the installer rendered runtime config for this network
+func loadPluginConfig(conf *PluginConf) (*config.Config, error) {
+	path := conf.IPAM.ConfigPath
+	if path == "" {
+		path = config.DefaultPath
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	env, err := config.RetryFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Retry = cfg.Retry.Merge(env)
+	return cfg, nil
+}
+
+// resolvePoolName picks the IPPool for the subnetwork: the network config
+// wins, then the runtime config pool mappings, then the default naming
+func resolvePoolName(conf *PluginConf, pluginConfig *config.Config, subnetwork string) string {
+	if conf.IPPoolName != "" {
+		return conf.IPPoolName
+	}
+	if poolName, ok := pluginConfig.PoolName(subnetwork); ok {
+		return poolName
+	}
+	return pluginConfig.DefaultPoolName(subnetwork)
+}
+
+// resolveAliasRange picks the secondary range the alias of an allocation from
+// rangeName is attached from: the range of the pool wins, then the network
+// config, then the runtime config, then ipam.DefaultAliasRange. The last three
+// are named for the cluster by the naming of the runtime config.
+func resolveAliasRange(conf *PluginConf, pluginConfig *config.Config, rangeName string) string {
+	if rangeName != "" {
+		return rangeName
+	}
+	if conf.SecondaryRangeName != "" {
+		return pluginConfig.ClusterRange(conf.SecondaryRangeName)
+	}
+	return pluginConfig.ClusterRange(ipam.AliasRange(pluginConfig.SecondaryRangeName))
+}
+
+// resolvePodPoolName picks the IPPool for the pod: a secondary range selected
+// through ipam.SecondaryRangeAnnotation wins over resolvePoolName
+func resolvePodPoolName(ctx context.Context, allocator *ipam.Allocator, conf *PluginConf, pluginConfig *config.Config, subnetwork string, pod *corev1.Pod) (string, error) {
+	rangeName := pod.Annotations[ipam.SecondaryRangeAnnotation]
+	if rangeName == "" {
+		return resolvePoolName(conf, pluginConfig, subnetwork), nil
+	}
+	return allocator.FindPoolForRange(ctx, subnetwork, rangeName)
+}
+
+// kubeletKubeconfig is the kubeconfig the plugin reaches the Kubernetes API
+// with. It is set from the plugin configuration at the start of every
+// invocation, since its path depends on the distribution of the cluster.
+var kubeletKubeconfig = config.DefaultKubeletKubeconfig
+
+// identityOverrides replaces the project, zone and instance of the metadata
+// server, set from the plugin configuration and the environment at the start
+// of every invocation
+var identityOverrides identity.Overrides
+
+// nodePaths are the node-local files and directories the plugin keeps its
+// state in, tests point them at a temporary directory
+var nodePaths = struct {
+	store         string
+	operations    string
+	mutationLock  string
+	mutationQueue string
+	poolQueue     string
+	pacer         string
+	maintenance   string
+	uninstall     string
+	instanceCache string
+	quota         string
+	arpTable      string
+}{
+	store:         store.DefaultPath,
+	operations:    telemetry.DefaultDir,
+	mutationLock:  mutation.DefaultLockPath,
+	mutationQueue: mutation.DefaultQueueDir,
+	poolQueue:     mutation.DefaultPoolQueueDir,
+	pacer:         mutation.DefaultPacerPath,
+	maintenance:   mutation.DefaultMaintenancePath,
+	uninstall:     mutation.DefaultUninstallPath,
+	instanceCache: instance.DefaultCachePath,
+	quota:         quota.DefaultPath,
+	arpTable:      "/proc/net/arp",
+}
+
+const (
+	// ErrCodeNodeLimitReached is the CNI error code of an ADD refused because
+	// the node holds maxIPsPerNode IPs of the pool, codes from 100 are plugin specific
+	ErrCodeNodeLimitReached = 100
+
+	// ErrCodeIPConflict is the CNI error code of an ADD refused because the
+	// allocated IP is already in use, see detectConflict
+	ErrCodeIPConflict = 101
+
+	// ErrCodeIPFamilyUnavailable is the CNI error code of an ADD refused
+	// because the pool has no range of the address families the pod asks for
+	ErrCodeIPFamilyUnavailable = 102
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "self-test" {
+		if err := runSelfTest(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		if err := runVersion(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err := runSimulate(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logging.SetLogFile("/tmp/gcp-ipam.log")
 	logging.SetLogLevel(logging.DebugLevel)
 	logging.SetLogStderr(true)
@@ -78,135 +239,238 @@ func main() {
 		Add:   cmdAdd,
 		Check: cmdCheck,
 		Del:   cmdDel,
-	}, version.All, bv.BuildString("gcp-ipam"))
+	}, cniversion.All, bv.BuildString(fmt.Sprintf("gcp-ipam %s (%s)", version, commit)))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
 	return nil
 }
 
-func waitForInstanceOperation(ctx context.Context, service *compute.Service, projectID, zone, opName string) error {
-	for {
-		op, err := service.ZoneOperations.Get(projectID, zone, opName).Context(ctx).Do()
-		if err != nil {
-			return err
-		}
-		if op.Status == "DONE" {
-			if op.Error != nil {
-				var errs []string
-				for _, e := range op.Error.Errors {
-					errs = append(errs, e.Message)
-				}
-				return fmt.Errorf("operation failed: %s", strings.Join(errs, ", "))
-			}
-			return nil
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(100 * time.Millisecond):
-		}
-	}
-}
-
 func isNotFound(err error) bool {
 	gerr, ok := err.(*googleapi.Error)
 	return ok && gerr.Code == 404
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	addTimeStart := time.Now()
 	operation := "ADD"
-	fileLock := flock.New("/var/run/gcp-ipam.lock")
-	fileLock.Lock()
-	logging.Debugf("[%s] Acquired file lock time %v", operation, time.Since(addTimeStart))
-	defer fileLock.Unlock()
+
+	opRecord := newOperationRecord(operation, args.ContainerID, args.IfName)
+	defer func() { writeOperationRecord(operation, opRecord, err) }()
 
 	conf, err := parseConfig(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	logging.Debugf("[%s] Processing CNI add command: %+v", operation, args.Args)
-	logging.Debugf("[%s] Configuration: %+v", operation, conf)
+	// released is set when an aborted ADD gave back everything it took
+	var released bool
+	defer func() {
+		if err != nil {
+			state := store.StateFailed
+			if released {
+				state = store.StateReleased
+			}
+			setAttachmentState(operation, args, state, err)
+		}
+	}()
+
+	cniLog.Debugf("[%s] Processing CNI add command: %+v", operation, args.Args)
+	cniLog.Debugf("[%s] Configuration: %+v", operation, conf)
+
+	// A mismatch means the node is half way through an upgrade, refuse to allocate until the installer settles it
+	if conf.IPAM.PluginVersion != "" && conf.IPAM.PluginVersion != version {
+		return fmt.Errorf("gcp-ipam version %s does not match version %s recorded in CNI config", version, conf.IPAM.PluginVersion)
+	}
+
+	// The installer is draining the node before switching it back to host-local, the runtime retries the pod
+	if mutation.Uninstalling(nodePaths.uninstall) {
+		return types.NewError(types.ErrTryAgainLater, "gcp-ipam is being uninstalled from this node", "new pods start once the CNI configuration is reverted")
+	}
 
-	k8sclient, err := buildKubeClient()
+	pluginConfig, err := loadPluginConfig(conf)
 	if err != nil {
-		return fmt.Errorf("failed to build k8s client: %w", err)
+		return err
 	}
+	setLogLevels(pluginConfig.Logging)
+	podSubnetwork = pluginConfig.NetworkInterface.Subnetwork
+	clusterID, clusterRanges = pluginConfig.ClusterID, pluginConfig.RangeNames(conf.SecondaryRangeName)
+	kubeletKubeconfig = pluginConfig.Kubeconfig()
+	identityOverrides = pluginConfig.Identity.Merge(identity.FromEnv())
 
-	cniArgs := lo.SliceToMap(strings.Split(args.Args, ";"), func(s string) (string, string) {
-		parts := strings.SplitN(s, "=", 2)
-		if len(parts) == 2 {
-			return parts[0], parts[1]
-		}
-		return parts[0], ""
-	})
+	ctx, cancel := context.WithTimeout(context.Background(), pluginConfig.Timeouts.Add.Duration)
+	defer cancel()
+
+	// The runtime signals the plugin when it gives up on the ADD, e.g. because the pod was deleted
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	ctx = telemetry.NewContext(ctx, opRecord)
 
 	startTime := time.Now()
-	p, err := k8sclient.CoreV1().Pods(cniArgs["K8S_POD_NAMESPACE"]).Get(context.TODO(), cniArgs["K8S_POD_NAME"], metav1.GetOptions{})
-	logging.Infof("[%s][K8s Operation] Get pod %s/%s took %v", operation, cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"], time.Since(startTime))
+	clients, err := newClients(kubeletKubeconfig)
 	if err != nil {
-		return fmt.Errorf("failed to get pod %s/%s: %w", cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"], err)
+		return fmt.Errorf("failed to build k8s clients: %w", err)
 	}
+	telemetry.Phase(ctx, "build-clients", time.Since(startTime))
 
-	const LiveIPAnnotation = "live.cast.ai/ip"
-	reqIP, isMigrationFlow := p.Annotations[LiveIPAnnotation]
-	origInst, hasOriginalInstance := p.Annotations["live.cast.ai/original-instance"]
+	cniArgs := parseCNIArgs(args.Args)
+	opRecord.PodNamespace, opRecord.PodName = cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"]
 
-	ctx := context.Background()
-	client, err := google.DefaultClient(ctx, compute.CloudPlatformScope)
-	if err != nil {
-		return fmt.Errorf("failed to create google default client: %w", err)
+	// Create IP allocator
+	allocator := ipam.NewAllocator(clients.dynamic)
+	allocator.SetRetryPolicy(retryPolicy(pluginConfig))
+	if pluginConfig.Freeze.Enabled {
+		cniLog.Infof("[%s] IP allocation is frozen: %s", operation, pluginConfig.Freeze.Reason)
+		allocator.Freeze(pluginConfig.Freeze.Reason)
 	}
 
-	computeService, projectID, zone, region, instanceName, err := getInstanceInfo(client)
+	// The PodIPMigration only depends on the pod name, so it is read while the pod is
+	pendingMigration := getMigrationAsync(ctx, allocator, cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"])
+
+	startTime = time.Now()
+	p, err := clients.kube.CoreV1().Pods(cniArgs["K8S_POD_NAMESPACE"]).Get(ctx, cniArgs["K8S_POD_NAME"], metav1.GetOptions{})
+	cniLog.Infof("[%s][K8s Operation] Get pod %s/%s took %v", operation, cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"], time.Since(startTime))
+	telemetry.Phase(ctx, "get-pod", time.Since(startTime))
+	if err != nil {
+		return fmt.Errorf("failed to get pod %s/%s: %w", cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"], err)
+	}
+	// An ADD of a sandbox of the deleted pod must not allocate for the recreated one of the same name
+	if uid := cniArgs["K8S_POD_UID"]; uid != "" && uid != string(p.UID) {
+		return fmt.Errorf("pod %s/%s has UID %s, not UID %s of the sandbox", p.Namespace, p.Name, p.UID, uid)
+	}
+	ipCount, err := ipam.PodIPCount(p.Annotations)
+	if err != nil {
+		return err
+	}
+	families, err := ipam.PodIPFamilies(p.Annotations)
 	if err != nil {
 		return err
 	}
+	switch families.Policy {
+	case corev1.IPFamilyPolicyRequireDualStack:
+		return types.NewError(ErrCodeIPFamilyUnavailable, "requested IP family not available in pool",
+			fmt.Sprintf("pod %s/%s requires dual-stack IPs, gcp-ipam assigns IPs of a single family", p.Namespace, p.Name))
+	case corev1.IPFamilyPolicyPreferDualStack:
+		cniLog.Infof("[%s] Pod %s/%s prefers dual-stack IPs, assigning IPs of a single family", operation, p.Namespace, p.Name)
+	}
 
 	startTime = time.Now()
-	instance, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
-	logging.Infof("[%s][Cloud Operation] Get instance %s took %v", operation, instanceName, time.Since(startTime))
+	migration, err := migrationFor(ctx, allocator, p, pendingMigration)
 	if err != nil {
-		return fmt.Errorf("failed to get instance details: %w", err)
+		return fmt.Errorf("failed to get PodIPMigration of pod %s/%s: %w", p.Namespace, p.Name, err)
 	}
+	telemetry.Phase(ctx, "get-migration", time.Since(startTime))
 
-	logging.Debugf("[%s] Instance details: %+v", operation, instance)
-
-	subnetwork := instance.NetworkInterfaces[0].Subnetwork
-	subnetworkParts := strings.Split(subnetwork, "/")
-	subnetwork = subnetworkParts[len(subnetworkParts)-1]
+	var reqIP, origInst string
+	isMigrationFlow := migration != nil
+	if isMigrationFlow {
+		reqIP, origInst = ipam.CanonicalIP(migration.Spec.IP), migration.Spec.SourceNode
+	}
+	hasOriginalInstance := origInst != ""
+	if isMigrationFlow && len(families.Families) > 0 {
+		if family, err := ipam.IPFamily(reqIP); err != nil || !slices.Contains(families.Families, family) {
+			return types.NewError(ErrCodeIPFamilyUnavailable, "requested IP family not available in pool",
+				fmt.Sprintf("migrated IP %s of pod %s/%s is not of families %v", reqIP, p.Namespace, p.Name, families.Families))
+		}
+	}
 
+	// Migrations are interactive, so they jump ahead of routine pod churn on this node,
+	// critical pods ahead of everything
+	critical := pluginConfig.CriticalPods.Match(p.Namespace, p.Spec.PriorityClassName)
+	priority := mutation.PriorityNewPod
+	switch {
+	case critical:
+		priority = mutation.PriorityCritical
+	case isMigrationFlow:
+		priority = mutation.PriorityMigration
+	}
+	if m, err := mutation.ReadMaintenance(nodePaths.maintenance); err == nil && m != nil {
+		cniLog.Infof("[%s] Node mutations are held for %s since %s, waiting for it to finish", operation, m.Event, m.Since.Format(time.RFC3339))
+	}
+	queue := mutation.NewQueue(nodePaths.mutationLock, nodePaths.mutationQueue, pluginConfig.Concurrency.NodeMutations)
 	startTime = time.Now()
-	subnet, err := computeService.Subnetworks.Get(projectID, region, subnetwork).Context(ctx).Do()
-	logging.Infof("[%s][Cloud Operation] Get subnetwork %s took %v", operation, subnetwork, time.Since(startTime))
+	if err := queue.Acquire(ctx, priority); err != nil {
+		return fmt.Errorf("failed to acquire node mutation queue: %w", err)
+	}
+	telemetry.Phase(ctx, "mutation-queue", time.Since(startTime))
+	cniLog.Debugf("[%s] Acquired %s mutation slot time %v", operation, priority, time.Since(addTimeStart))
+	defer queue.Release()
+	limitPoolUpdates(allocator, pluginConfig, priority)
+
+	pacer, err := waitForPacing(ctx, operation, pluginConfig, critical)
 	if err != nil {
-		return fmt.Errorf("failed to get subnetwork details: %w", err)
+		return fmt.Errorf("failed to wait for GCE call pacing: %w", err)
 	}
+	defer func() { observePacing(operation, pacer, err) }()
 
-	// Build dynamic client for IPPool access
-	dynamicClient, err := buildDynamicClient()
+	client, err := newGoogleClient(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to build dynamic client: %w", err)
+		return fmt.Errorf("failed to create google default client: %w", err)
 	}
+	gceCalls := countGCECalls(client)
+	defer recordGCECalls(operation, gceCalls)
 
-	// Create IP allocator
-	allocator := ipam.NewAllocator(dynamicClient)
+	computeService, projectID, zone, region, instanceName, err := getInstanceInfo(client)
+	if err != nil {
+		return err
+	}
+	host, err := newHostProject(ctx, computeService, gceCalls, projectID, pluginConfig.SharedVPC)
+	if err != nil {
+		return err
+	}
+
+	nic, err := podNIC(ctx, operation, computeService, projectID, zone, instanceName)
+	if err != nil {
+		return err
+	}
+
+	gceLog.Debugf("[%s] Network interface details: %+v", operation, nic)
+
+	subnetwork := ipam.SubnetworkName(nic.Subnetwork)
+
+	subnetCIDR, err := subnetworkCIDR(ctx, operation, host.service, host.id, region, subnetwork)
+	if err != nil {
+		return err
+	}
 
 	// Determine IPPool name - default to subnet-based naming if not configured
-	poolName := conf.IPPoolName
-	if poolName == "" {
-		// Default to a pool name based on the subnet
-		poolName = fmt.Sprintf("ippool-%s", subnetwork)
+	startTime = time.Now()
+	poolName, err := resolvePodPoolName(ctx, allocator, conf, pluginConfig, subnetwork, p)
+	if err != nil {
+		return fmt.Errorf("failed to resolve IPPool: %w", err)
 	}
+	allocatorLog.Debugf("[%s] Using IPPool %s, resolving took %v", operation, poolName, time.Since(startTime))
+	telemetry.Phase(ctx, "resolve-pool", time.Since(startTime))
 
 	var newAddress string
 	var allocationResult *ipam.AllocationResult
 
+	// A retried ADD for the same pod reuses the IP it already got instead of leaking it
+	var reusedAllocation bool
+	// A warm IP of the node may have its alias attached already, buffered is
+	// one the pool could not hand over to the pod yet
+	var warmIP, buffered bool
+	if existing := lookupAttachment(operation, args); !isMigrationFlow && existing != nil &&
+		existing.PodUID == string(p.UID) && existing.Pool == poolName && existing.IP != "" && existing.State != store.StateReleased {
+		startTime = time.Now()
+		allocationResult, err = allocator.GetAllocation(ctx, poolName, existing.IP)
+		allocatorLog.Infof("[%s][K8s Operation] Get allocation for IP %s from pool %s took %v", operation, existing.IP, poolName, time.Since(startTime))
+		telemetry.Phase(ctx, "get-allocation", time.Since(startTime))
+		if err == nil {
+			reusedAllocation = true
+			buffered = existing.Buffered
+			newAddress = existing.IP
+			allocatorLog.Infof("[%s] Reusing IP %s recorded for container %s", operation, newAddress, args.ContainerID)
+		} else {
+			allocatorLog.Infof("[%s] Recorded IP %s is no longer allocated, allocating a new one: %v", operation, existing.IP, err)
+		}
+	}
+
 	// Only allocate IP when this is not a migration flow
 	// For migration, the IP is already allocated in the pool
-	if !isMigrationFlow {
+	if reusedAllocation {
+		// Allocation recorded by a previous attempt is still valid
+	} else if !isMigrationFlow {
 		// Allocate IP from the pool
 		allocationReq := &ipam.AllocationRequest{
 			PoolName:     poolName,
@@ -214,312 +478,790 @@ func cmdAdd(args *skel.CmdArgs) error {
 			PodNamespace: cniArgs["K8S_POD_NAMESPACE"],
 			PodUID:       string(p.UID),
 			NodeName:     instanceName,
+			RangeName:    p.Annotations[ipam.SecondaryRangeAnnotation],
+			Protected:    p.Annotations[ipam.ProtectedIPAnnotation] == "true",
+			Families:     families.Families,
 		}
 
 		startTime = time.Now()
-		allocationResult, err = allocator.Allocate(ctx, allocationReq)
-		logging.Infof("[%s][K8s Operation] Allocate IP from pool %s took %v", operation, poolName, time.Since(startTime))
+		// Warm IPs may be of any family of the pool
+		if !pluginConfig.Freeze.Enabled && len(families.Families) == 0 {
+			// Some warm IPs are held back for critical pods
+			keep := pluginConfig.CriticalPods.WarmIPs
+			if critical {
+				keep = 0
+			}
+			allocationResult, buffered = takeWarmIP(ctx, operation, args, allocator, allocationReq, p, keep)
+			warmIP = allocationResult != nil
+		}
+		if !warmIP {
+			allocationResult, err = allocateIP(ctx, operation, pluginConfig, clients, allocator, allocationReq)
+		}
+		if apierrors.IsNotFound(err) {
+			// Only a pool found missing costs another get, not every ADD
+			var resolved string
+			resolved, err = resolveMissingPool(ctx, operation, allocator, pluginConfig, poolName, subnetwork, func() (*v1alpha1.IPPool, error) {
+				return subnetpool.Build(ctx, host.service, host.id, region, subnetwork, resolveAliasRange(conf, pluginConfig, ""), poolName)
+			})
+			if err != nil {
+				return err
+			}
+			poolName, allocationReq.PoolName = resolved, resolved
+			allocationResult, err = allocateIP(ctx, operation, pluginConfig, clients, allocator, allocationReq)
+		}
+		if errors.Is(err, ipam.ErrPoolExhausted) {
+			r := &reclaimer{
+				operation:      operation,
+				args:           args,
+				conf:           conf,
+				pluginConfig:   pluginConfig,
+				clients:        clients,
+				allocator:      allocator,
+				computeService: computeService,
+				host:           host,
+				projectID:      projectID,
+				zone:           zone,
+				instanceName:   instanceName,
+			}
+			if r.reclaim(ctx, poolName) > 0 {
+				allocationResult, err = allocateIP(ctx, operation, pluginConfig, clients, allocator, allocationReq)
+			}
+		}
+		allocatorLog.Infof("[%s][K8s Operation] Allocate IP from pool %s took %v", operation, poolName, time.Since(startTime))
+		telemetry.Phase(ctx, "allocate", time.Since(startTime))
+		if errors.Is(err, ipam.ErrNodeLimitReached) {
+			// Distinct code and message, so the sandbox failure event tells why the pod cannot start here
+			return types.NewError(ErrCodeNodeLimitReached, "node IP limit of pool reached", err.Error())
+		}
+		if errors.Is(err, ipam.ErrIPFamilyUnavailable) {
+			return types.NewError(ErrCodeIPFamilyUnavailable, "requested IP family not available in pool", err.Error())
+		}
 		if err != nil {
 			return fmt.Errorf("failed to allocate IP from pool %s: %w", poolName, err)
 		}
 
 		newAddress = allocationResult.IP
-		logging.Infof("[%s] Allocated IP %s from pool %s", operation, newAddress, poolName)
+		if allocationResult.Existing {
+			// kubelet recreated the sandbox, the alias of the previous one may still be attached
+			reusedAllocation = true
+			allocatorLog.Infof("[%s] Reusing IP %s the pod already holds in pool %s", operation, newAddress, poolName)
+			supersedeAttachments(operation, args, newAddress)
+		} else {
+			allocatorLog.Infof("[%s] Allocated IP %s from pool %s", operation, newAddress, poolName)
+		}
 	} else {
 		// Migration flow - use the requested IP directly
 		newAddress = reqIP
-		logging.Infof("[%s] Migration flow - using existing IP %s", operation, newAddress)
+		cniLog.Infof("[%s] Migration flow - using existing IP %s", operation, newAddress)
+
+		// Claiming is an optimistic update, so two pods can never both take the IP over
+		startTime = time.Now()
+		migration, err = allocator.ClaimMigration(ctx, p.Namespace, p.Name, string(p.UID), instanceName, poolName)
+		allocatorLog.Infof("[%s][K8s Operation] Claim PodIPMigration %s/%s took %v", operation, p.Namespace, p.Name, time.Since(startTime))
+		telemetry.Phase(ctx, "claim-migration", time.Since(startTime))
+		if err != nil {
+			return fmt.Errorf("failed to claim PodIPMigration %s/%s: %w", p.Namespace, p.Name, err)
+		}
+		defer func() {
+			if err != nil {
+				failMigration(operation, allocator, p, err, pluginConfig.Timeouts.Operation.Duration)
+			}
+		}()
 
 		// Get allocation result for the migrated IP to retrieve secondary range info
 		startTime = time.Now()
 		allocationResult, err = allocator.GetAllocation(ctx, poolName, reqIP)
-		logging.Infof("[%s][K8s Operation] Get allocation for IP %s from pool %s took %v", operation, reqIP, poolName, time.Since(startTime))
+		allocatorLog.Infof("[%s][K8s Operation] Get allocation for IP %s from pool %s took %v", operation, reqIP, poolName, time.Since(startTime))
+		telemetry.Phase(ctx, "get-allocation", time.Since(startTime))
 		if err != nil {
 			return fmt.Errorf("failed to get allocation for IP %s from pool %s: %w", reqIP, poolName, err)
 		}
 	}
 
-	if hasOriginalInstance {
-		logging.Infof("[%s] Migrating IP %s from original instance %s", operation, reqIP, origInst)
-		startTime = time.Now()
-		origInstance, err := computeService.Instances.Get(projectID, zone, origInst).Context(ctx).Do()
-		logging.Infof("[%s][Cloud Operation] Get original instance %s took %v", operation, origInst, time.Since(startTime))
-		if err != nil {
-			return fmt.Errorf("failed to get original instance: %w", err)
+	cleanup := &addCleanup{
+		operation:      operation,
+		computeService: computeService,
+		host:           host,
+		projectID:      projectID,
+		zone:           zone,
+		instanceName:   instanceName,
+		allocator:      allocator,
+		poolName:       poolName,
+		ip:             newAddress,
+		rangeName:      resolveAliasRange(conf, pluginConfig, allocationResult.SecondaryRangeName),
+		timeout:        pluginConfig.Timeouts.Operation.Duration,
+		releaseIP:      !isMigrationFlow,
+		// A previous attempt for this pod or the installer may have attached the IP already
+		attachIssued: reusedAllocation || warmIP,
+	}
+	defer func() {
+		if cleanup.shouldRun(ctx, err) {
+			released = cleanup.run()
 		}
+	}()
 
-		removed := lo.Filter(origInstance.NetworkInterfaces[0].AliasIpRanges, func(a *compute.AliasIpRange, _ int) bool {
-			return a.IpCidrRange != fmt.Sprintf("%s/32", reqIP)
+	// Last cheap point to back out: the pod may have been deleted while the ADD waited in the queue
+	startTime = time.Now()
+	if err := checkPodWanted(ctx, clients.kube, p); err != nil {
+		return err
+	}
+	cniLog.Debugf("[%s][K8s Operation] Recheck pod %s/%s took %v", operation, p.Namespace, p.Name, time.Since(startTime))
+	telemetry.Phase(ctx, "recheck-pod", time.Since(startTime))
+
+	// A retried ADD of the migration target finds the alias detached already
+	if hasOriginalInstance && migration.Status.Phase == v1alpha1.PodIPMigrationClaimed {
+		cniLog.Infof("[%s] Migrating IP %s from original instance %s", operation, reqIP, origInst)
+		c, err := updateInstanceAliases(ctx, operation, computeService, projectID, zone, origInst, func(current []*compute.AliasIpRange) []*compute.AliasIpRange {
+			return withoutOwnedAlias(operation, current, reqIP, allocationResult.SecondaryRangeName)
 		})
-
-		startTime = time.Now()
-		c, err := computeService.Instances.UpdateNetworkInterface(projectID, zone, origInst, origInstance.NetworkInterfaces[0].Name, &compute.NetworkInterface{
-			Fingerprint:   origInstance.NetworkInterfaces[0].Fingerprint,
-			AliasIpRanges: removed,
-		}).Do()
-		logging.Infof("[%s][Cloud Operation] Update network interface on original instance %s took %v", operation, origInst, time.Since(startTime))
 		if err != nil {
-			return fmt.Errorf("failed to update network interface: %w", err)
+			return fmt.Errorf("failed to update network interface of original instance: %w", err)
 		}
 
 		startTime = time.Now()
-		if err := waitForInstanceOperation(ctx, computeService, projectID, zone, c.Name); err != nil {
+		if err := zoneOperations(computeService, projectID, zone).wait(ctx, c.Name, pluginConfig.Timeouts.Operation.Duration); err != nil {
 			return fmt.Errorf("failed to wait for network interface update operation: %w", err)
 		}
-		logging.Infof("[%s][Cloud Operation] Wait for network interface update operation on original instance took %v", operation, time.Since(startTime))
+		gceLog.Infof("[%s][Cloud Operation] Wait for network interface update operation on original instance took %v", operation, time.Since(startTime))
+
+		if pluginConfig.Enabled(config.FeatureRouteFallback) {
+			if err := detachRoute(ctx, operation, host, projectID, zone, origInst, reqIP, pluginConfig.Timeouts.Operation.Duration); err != nil {
+				return fmt.Errorf("failed to remove route of original instance: %w", err)
+			}
+		}
+
+		migration, err = allocator.AdvanceMigration(ctx, p.Namespace, p.Name, string(p.UID), v1alpha1.PodIPMigrationDetached, nil)
+		if err != nil {
+			return fmt.Errorf("failed to record detach on PodIPMigration %s/%s: %w", p.Namespace, p.Name, err)
+		}
 	}
 
-	// Use secondary range name from allocation result, default to "live" if empty
-	secondaryRangeName := allocationResult.SecondaryRangeName
-	if secondaryRangeName == "" {
-		secondaryRangeName = "live"
+	secondaryRangeName := resolveAliasRange(conf, pluginConfig, allocationResult.SecondaryRangeName)
+	if !pluginConfig.InClusterRange(secondaryRangeName, conf.SecondaryRangeName) {
+		return fmt.Errorf("IPPool %s attaches from secondary range %s, which is not a range of cluster %s", poolName, secondaryRangeName, pluginConfig.ClusterID)
 	}
 
-	startTime = time.Now()
-	c, err := computeService.Instances.UpdateNetworkInterface(projectID, zone, instanceName, instance.NetworkInterfaces[0].Name, &compute.NetworkInterface{
-		Fingerprint: instance.NetworkInterfaces[0].Fingerprint,
-		AliasIpRanges: append(instance.NetworkInterfaces[0].AliasIpRanges, &compute.AliasIpRange{
-			IpCidrRange:         fmt.Sprintf("%s/32", newAddress),
-			SubnetworkRangeName: secondaryRangeName,
-		}),
-	}).Do()
-	logging.Infof("[%s][Cloud Operation] Update network interface on instance %s took %v", operation, instanceName, time.Since(startTime))
+	// The other IPs of a pod asking for several come from the range of the first
+	var additionalIPs []string
+	if ipCount > 1 {
+		additionalIPs, err = allocateAdditionalIPs(ctx, operation, allocator, p, poolName, instanceName, allocationResult.SecondaryRangeName, ipCount-1)
+		if err != nil {
+			return err
+		}
+		cleanup.additionalIPs = additionalIPs
+	}
+
+	opRecord.IP, opRecord.Pool = newAddress, poolName
+	recordAttachment(operation, args, func(a *store.Attachment) {
+		a.IP = newAddress
+		a.AdditionalIPs = additionalIPs
+		a.Pool = poolName
+		a.SecondaryRange = secondaryRangeName
+		a.PodNamespace = cniArgs["K8S_POD_NAMESPACE"]
+		a.PodName = cniArgs["K8S_POD_NAME"]
+		a.PodUID = string(p.UID)
+		a.Netns = recordedNetns(args.Netns)
+		a.Buffered = buffered
+		a.State = store.StateAllocated
+		a.Error = ""
+	})
+
+	aliasCIDR := ipam.HostPrefix(newAddress)
+	alreadyAttached, attachIPs, err := aliasesToAttach(nic, newAddress, additionalIPs, secondaryRangeName)
+	if len(attachIPs) < 1+len(additionalIPs) {
+		// The cached interface may have lost the aliases since, never skip an
+		// attach or report a conflict on it
+		if nic, err = refreshNIC(ctx, operation, computeService, projectID, zone, instanceName); err != nil {
+			return err
+		}
+		alreadyAttached, attachIPs, err = aliasesToAttach(nic, newAddress, additionalIPs, secondaryRangeName)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to update network interface: %w", err)
+		return err
 	}
 
-	startTime = time.Now()
-	if err := waitForInstanceOperation(ctx, computeService, projectID, zone, c.Name); err != nil {
-		return fmt.Errorf("failed to wait for network interface update operation: %w", err)
+	routeFallback := pluginConfig.Enabled(config.FeatureRouteFallback)
+	// Pods gated on the alias start with their IP now, the installer attaches it
+	asyncAttach := !alreadyAttached && len(additionalIPs) == 0 && !isMigrationFlow && pluginConfig.Enabled(config.FeatureAsyncAttach) &&
+		hasAliasAttachedGate(p) && !(routeFallback && aliasRangesFull(nic))
+	// When this ADD attached the IPs, the VPC may still be propagating them
+	var attachedAt time.Time
+	if len(attachIPs) == 0 {
+		gceLog.Infof("[%s] Alias IP %s already attached to instance %s", operation, aliasCIDR, instanceName)
+	} else {
+		// Attached later or now, a conflicting IP must not reach the pod
+		if pluginConfig.Enabled(config.FeatureConflictDetection) {
+			startTime = time.Now()
+			for _, ip := range attachIPs {
+				if err = detectConflict(ctx, operation, computeService, projectID, instanceName, nic.Network, ip); err != nil {
+					break
+				}
+			}
+			telemetry.Phase(ctx, "conflict-detection", time.Since(startTime))
+			var conflict *conflictError
+			if errors.As(err, &conflict) {
+				// A migrated IP still belongs to its source pod
+				if !isMigrationFlow || conflict.ip != newAddress {
+					quarantineConflict(ctx, operation, allocator, args, poolName, conflict.ip, instanceName)
+				}
+				return types.NewError(ErrCodeIPConflict, "IP address conflict", err.Error())
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if asyncAttach {
+			cniLog.Infof("[%s] Leaving alias IP %s for the installer to attach, pod %s/%s waits for readiness gate %s",
+				operation, aliasCIDR, p.Namespace, p.Name, ipam.AliasAttachedCondition)
+			recordAttachment(operation, args, func(a *store.Attachment) { a.AttachPending = true })
+		} else {
+			cleanup.attachIssued = true
+			useRoute := routeFallback && aliasRangesFull(nic)
+			var c *compute.Operation
+			if !useRoute {
+				c, err = updateAliases(ctx, operation, computeService, projectID, zone, instanceName, nic, func(current []*compute.AliasIpRange) []*compute.AliasIpRange {
+					// The interface may have been read again after a fingerprint conflict, never add the IP twice
+					aliases := current
+					for _, ip := range attachIPs {
+						aliases = withoutOwnedAlias(operation, aliases, ip, secondaryRangeName)
+					}
+					for _, ip := range attachIPs {
+						aliases = append(aliases, &compute.AliasIpRange{
+							IpCidrRange:         ipam.HostPrefix(ip),
+							SubnetworkRangeName: secondaryRangeName,
+						})
+					}
+					return aliases
+				})
+				useRoute = routeFallback && isAliasLimitError(err)
+			}
+
+			if useRoute && len(additionalIPs) > 0 {
+				return fmt.Errorf("instance %s is out of alias IP ranges for the %d IPs of pod %s/%s", instanceName, ipCount, p.Namespace, p.Name)
+			}
+			if useRoute {
+				// Large nodes keep starting pods past the alias limit, at the cost of a VPC route per pod
+				gceLog.Infof("[%s] Instance %s is out of alias IP ranges, routing IP %s to it instead", operation, instanceName, newAddress)
+				cleanup.routed = true
+				recordAttachment(operation, args, func(a *store.Attachment) { a.Routed = true })
+				if err := attachRoute(ctx, operation, host, projectID, zone, instanceName, nic.Network, newAddress, pluginConfig.Timeouts.Operation.Duration); err != nil {
+					return fmt.Errorf("failed to route IP %s: %w", newAddress, err)
+				}
+				attachedAt = time.Now()
+			} else {
+				if err != nil {
+					return fmt.Errorf("failed to update network interface: %w", err)
+				}
+				cleanup.attachOp = c.Name
+
+				startTime = time.Now()
+				err = zoneOperations(computeService, projectID, zone).wait(ctx, c.Name, pluginConfig.Timeouts.Operation.Duration)
+				if finished := finishedOperation(c, instanceName, err); finished != nil {
+					recordAttachment(operation, args, func(a *store.Attachment) { a.AttachOperation = finished })
+				}
+				if errors.Is(err, errIPInUse) || errors.Is(err, errAliasRangeOverlap) {
+					// GCE found the conflict detectConflict would have, the IP must not be handed out again.
+					// It does not say which of several IPs conflicts, those are left to the DEL.
+					if len(attachIPs) == 1 && (!isMigrationFlow || attachIPs[0] != newAddress) {
+						quarantineConflict(ctx, operation, allocator, args, poolName, attachIPs[0], instanceName)
+					}
+					return types.NewError(ErrCodeIPConflict, "IP address conflict", err.Error())
+				}
+				if err != nil {
+					return fmt.Errorf("failed to wait for network interface update operation: %w", err)
+				}
+				gceLog.Infof("[%s][Cloud Operation] Wait for network interface update operation %s (%d) took %v", operation, c.Name, c.Id, time.Since(startTime))
+				attachedAt = time.Now()
+			}
+		}
+	}
+
+	if !asyncAttach {
+		setAttachmentState(operation, args, store.StateAttached, nil)
+		// The check only waits, other invocations may mutate the node meanwhile
+		if err := queue.Release(); err != nil {
+			cniLog.Warningf("[%s] Failed to release node mutation queue: %v", operation, err)
+		}
+		cleanup.queue = queue
+		if err := verifyReachability(ctx, operation, pluginConfig, append([]string{newAddress}, additionalIPs...), attachedAt); err != nil {
+			return err
+		}
+	}
+
+	if isMigrationFlow {
+		// From here on the IP belongs to this pod, its DEL releases it
+		err = allocator.TransferAllocation(ctx, poolName, newAddress, &ipam.AllocationRequest{
+			PodName:      p.Name,
+			PodNamespace: p.Namespace,
+			PodUID:       string(p.UID),
+			NodeName:     instanceName,
+			Protected:    p.Annotations[ipam.ProtectedIPAnnotation] == "true",
+		})
+		if err != nil {
+			return fmt.Errorf("failed to transfer allocation of IP %s in pool %s: %w", newAddress, poolName, err)
+		}
+		if _, err = allocator.AdvanceMigration(ctx, p.Namespace, p.Name, string(p.UID), v1alpha1.PodIPMigrationAttached, nil); err != nil {
+			return fmt.Errorf("failed to record attach on PodIPMigration %s/%s: %w", p.Namespace, p.Name, err)
+		}
+		cniLog.Infof("[%s] Migrated IP %s to pod %s/%s", operation, newAddress, p.Namespace, p.Name)
+	}
+
+	// A Fail hook fails the ADD, which releases the IPs again. The installer
+	// runs the hooks of an alias it attaches asynchronously once it is attached.
+	if !asyncAttach {
+		err = runAttachHooks(ctx, operation, pluginConfig, args, cniArgs, append([]string{newAddress}, additionalIPs...), poolName, secondaryRangeName, instanceName)
+		if err != nil {
+			return err
+		}
+	}
+
+	allocatorLog.Infof("Allocation result: %+v", allocationResult)
+	result, err := addResult(newAddress, subnetCIDR, allocationResult.CIDR)
+	if err != nil {
+		return err
+	}
+	if err := addAdditionalIPs(result, additionalIPs); err != nil {
+		return err
 	}
-	logging.Infof("[%s][Cloud Operation] Wait for network interface update operation took %v", operation, time.Since(startTime))
+	cniLog.Infof("[%s] Assigned IP %s to pod %s/%s with gateway %s", operation, newAddress, cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"], result.IPs[0].Gateway)
+
+	cniLog.Infof("[%s] CNI add command completed in %v", operation, time.Since(addTimeStart))
+	return types.PrintResult(result, conf.CNIVersion)
+}
 
-	_, ipNet, err := net.ParseCIDR(subnet.IpCidrRange)
+// addResult builds the CNI result of ip: its address with the prefix length
+// of the subnetwork, the first address of the range it was allocated from as
+// gateway and a default route
+func addResult(ip, subnetCIDR, rangeCIDR string) (*current.Result, error) {
+	subnetPrefix, err := ipam.ParsePrefix(subnetCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse subnetwork CIDR %s: %w", subnetCIDR, err)
+	}
+	addr, err := ipam.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse allocated IP %s: %w", ip, err)
+	}
+	rangePrefix, err := ipam.ParsePrefix(rangeCIDR)
 	if err != nil {
-		return fmt.Errorf("failed to parse subnetwork CIDR %s: %w", subnet.IpCidrRange, err)
+		return nil, fmt.Errorf("failed to parse range CIDR %s: %w", rangeCIDR, err)
 	}
-	logging.Infof("Allocation result: %+v", allocationResult)
-	ipNet.IP = net.ParseIP(newAddress)
-	gw, _, _ := net.ParseCIDR(allocationResult.CIDR)
-	gw[15] = gw[15] + 1
-	logging.Infof("[%s] Assigned IP %s to pod %s/%s with gateway %+v", operation, newAddress, cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"], gw)
-	_, r, _ := net.ParseCIDR("0.0.0.0/0")
-	result := &current.Result{
+	gw := rangePrefix.Addr().Next()
+	defaultRoute := netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	if addr.Is6() {
+		defaultRoute = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	}
+	return &current.Result{
 		CNIVersion: current.ImplementedSpecVersion,
 		IPs: []*current.IPConfig{
 			{
-				Address: *ipNet,
-				Gateway: gw,
+				Address: ipNet(netip.PrefixFrom(addr, subnetPrefix.Bits())),
+				Gateway: gw.AsSlice(),
 			},
 		},
 
 		Routes: []*types.Route{
 			{
-				Dst: *r,
+				Dst: ipNet(defaultRoute),
 			},
 		},
-	}
+	}, nil
+}
 
-	logging.Infof("[%s] CNI add command completed in %v", operation, time.Since(addTimeStart))
-	return types.PrintResult(result, conf.CNIVersion)
+// hasAliasAttachedGate reports whether the pod waits for the
+// ipam.AliasAttachedCondition to become ready
+func hasAliasAttachedGate(pod *corev1.Pod) bool {
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == ipam.AliasAttachedCondition {
+			return true
+		}
+	}
+	return false
 }
 
 func getInstanceInfo(client *http.Client) (*compute.Service, string, string, string, string, error) {
-	computeService, err := compute.New(client)
+	computeService, err := newComputeService(client)
+	if err != nil {
+		return nil, "", "", "", "", err
+	}
+
+	// Overrides name the instance outside GCE, the metadata server is never asked
+	if identityOverrides.Complete() {
+		region, err := identity.Region(identityOverrides.Zone)
+		if err != nil {
+			return nil, "", "", "", "", err
+		}
+		return computeService, identityOverrides.Project, identityOverrides.Zone, region, identityOverrides.Instance, nil
+	}
+
+	// The identity never changes, steady state invocations skip the metadata server
+	cache := loadInstanceCache()
+	if cache.HasIdentity() {
+		return computeService, cache.ProjectID, cache.Zone, cache.Region, cache.InstanceName, nil
+	}
+
+	projectID, zone, region, instanceName, err := lookupInstance(context.Background())
 	if err != nil {
-		return nil, "", "", "", "", fmt.Errorf("failed to create compute service: %w", err)
+		return nil, "", "", "", "", err
 	}
+	cache.ProjectID, cache.Zone, cache.Region, cache.InstanceName = projectID, zone, region, instanceName
+	saveInstanceCache(cache)
+	return computeService, projectID, zone, region, instanceName, nil
+}
 
-	projectID, err := metadata.ProjectID()
+func newComputeService(client *http.Client) (*compute.Service, error) {
+	computeService, err := compute.NewService(context.Background(), append(identityOverrides.ComputeOptions(), option.WithHTTPClient(client))...)
 	if err != nil {
-		return nil, "", "", "", "", fmt.Errorf("failed to get project ID from metadata: %w", err)
+		return nil, fmt.Errorf("failed to create compute service: %w", err)
 	}
+	return computeService, nil
+}
 
-	zone, err := metadata.Zone()
+// lookupInstance returns the project, zone, region and name of the instance,
+// each the override or the one of the metadata server, bypassing the
+// instance cache
+func lookupInstance(ctx context.Context) (string, string, string, string, error) {
+	projectID, err := identityOverrides.ProjectID(ctx)
 	if err != nil {
-		return nil, "", "", "", "", fmt.Errorf("failed to get zone from metadata: %w", err)
+		return "", "", "", "", fmt.Errorf("failed to get project ID from metadata: %w", err)
 	}
-	region := ""
-	if region == "" {
-		if len(zone) > 2 {
-			region = zone[:len(zone)-2]
-		} else {
-			return nil, "", "", "", "", fmt.Errorf("cannot determine region from zone: %s", zone)
-		}
+
+	zone, err := identityOverrides.ZoneName(ctx)
+	if err != nil {
+		return "", "", "", "", fmt.Errorf("failed to get zone from metadata: %w", err)
+	}
+	region, err := identity.Region(zone)
+	if err != nil {
+		return "", "", "", "", err
 	}
 
-	instanceName, err := metadata.InstanceName()
+	instanceName, err := identityOverrides.InstanceName(ctx)
 	if err != nil {
-		return nil, "", "", "", "", fmt.Errorf("failed to get instance name from metadata: %w", err)
+		return "", "", "", "", fmt.Errorf("failed to get instance name from metadata: %w", err)
 	}
-	return computeService, projectID, zone, region, instanceName, err
+	return projectID, zone, region, instanceName, nil
 }
 
-func cmdDel(args *skel.CmdArgs) error {
+func cmdDel(args *skel.CmdArgs) (err error) {
 	delTimeStart := time.Now()
 	operation := "DEL"
-	if args.Netns == "" {
+	// Sandboxed runtimes tear the namespace down before DEL, the IP recorded
+	// for the container is released all the same
+	if args.Netns == "" && lookupAttachment(operation, args) == nil {
 		return nil
 	}
-	fileLock := flock.New("/var/run/gcp-ipam.lock")
-	fileLock.Lock()
-	logging.Debugf("[%s] Acquired file lock time %v", operation, time.Since(delTimeStart))
-	defer fileLock.Unlock()
+
+	opRecord := newOperationRecord(operation, args.ContainerID, args.IfName)
+	defer func() { writeOperationRecord(operation, opRecord, err) }()
 
 	conf, err := parseConfig(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	logging.Debugf("[%s] Processing CNI del command: %+v", operation, args.Args)
-	logging.Debugf("[%s] Configuration: %+v", operation, string(args.StdinData))
+	pluginConfig, err := loadPluginConfig(conf)
+	if err != nil {
+		return err
+	}
+	setLogLevels(pluginConfig.Logging)
+	podSubnetwork = pluginConfig.NetworkInterface.Subnetwork
+	clusterID, clusterRanges = pluginConfig.ClusterID, pluginConfig.RangeNames(conf.SecondaryRangeName)
+	kubeletKubeconfig = pluginConfig.Kubeconfig()
+	identityOverrides = pluginConfig.Identity.Merge(identity.FromEnv())
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginConfig.Timeouts.Del.Duration)
+	defer cancel()
+	ctx = telemetry.NewContext(ctx, opRecord)
 
-	cniArgs := lo.SliceToMap(strings.Split(args.Args, ";"), func(s string) (string, string) {
-		parts := strings.SplitN(s, "=", 2)
-		if len(parts) == 2 {
-			return parts[0], parts[1]
+	queue := mutation.NewQueue(nodePaths.mutationLock, nodePaths.mutationQueue, pluginConfig.Concurrency.NodeMutations)
+	startTime := time.Now()
+	if err := queue.Acquire(ctx, mutation.PriorityCleanup); err != nil {
+		return fmt.Errorf("failed to acquire node mutation queue: %w", err)
+	}
+	telemetry.Phase(ctx, "mutation-queue", time.Since(startTime))
+	cniLog.Debugf("[%s] Acquired %s mutation slot time %v", operation, mutation.PriorityCleanup, time.Since(delTimeStart))
+	defer queue.Release()
+
+	// Read before the state changes below, the record is the primary source of the IP
+	recorded := lookupAttachment(operation, args)
+	if recorded != nil && recorded.State == store.StateReleased {
+		// A repeated DEL must not touch an IP that may already belong to another pod
+		cniLog.Infof("[%s] IP %s of container %s already released", operation, recorded.IP, args.ContainerID)
+		return nil
+	}
+
+	var releaseDeferred bool
+	setAttachmentState(operation, args, store.StateReleasing, nil)
+	defer func() {
+		if err != nil {
+			setAttachmentState(operation, args, store.StateFailed, err)
+			return
 		}
-		return parts[0], ""
-	})
+		if releaseDeferred {
+			setAttachmentState(operation, args, store.StateReleasePending, nil)
+			return
+		}
+		setAttachmentState(operation, args, store.StateReleased, nil)
+		pruneAttachments(operation)
+	}()
+
+	cniLog.Debugf("[%s] Processing CNI del command: %+v", operation, args.Args)
+	cniLog.Debugf("[%s] Configuration: %+v", operation, string(args.StdinData))
+
+	cniArgs := parseCNIArgs(args.Args)
+	opRecord.PodNamespace, opRecord.PodName = cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"]
 
-	k8sclient, err := buildKubeClient()
+	// DEL has to complete during API server outages too, otherwise the sandbox
+	// never finishes terminating, so a missing pod is not fatal
+	startTime = time.Now()
+	var p *corev1.Pod
+	clients, err := newClients(kubeletKubeconfig)
 	if err != nil {
-		return fmt.Errorf("failed to build k8s client: %w", err)
+		err = fmt.Errorf("failed to build k8s clients: %w", err)
+	} else {
+		p, err = getPodForDel(ctx, clients.kube, cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"])
 	}
-
-	startTime := time.Now()
-	p, err := k8sclient.CoreV1().Pods(cniArgs["K8S_POD_NAMESPACE"]).Get(context.TODO(), cniArgs["K8S_POD_NAME"], metav1.GetOptions{})
-	logging.Infof("[%s][K8s Operation] Get pod %s/%s took %v", operation, cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"], time.Since(startTime))
+	cniLog.Infof("[%s][K8s Operation] Get pod %s/%s took %v", operation, cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"], time.Since(startTime))
+	telemetry.Phase(ctx, "get-pod", time.Since(startTime))
 	if err != nil {
-		return fmt.Errorf("failed to get pod %s/%s: %w", cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"], err)
+		cniLog.Infof("[%s] Pod unavailable, continuing from local records: %v", operation, err)
+		p = nil
 	}
 
-	// Check if this is a migration flow - if so, don't release the IP from the pool
-	const MoveOutAnnotation = "live.cast.ai/move-out-ip"
-	_, isMigrationFlow := p.Annotations[MoveOutAnnotation]
-	if isMigrationFlow {
-		logging.Infof("[%s] Migration flow detected (moveout annotation present), skipping IP release from pool", operation)
+	ips, fromStatus := delIPs(conf, args.IfName, recorded, p)
+	ips = lo.Filter(ips, func(ip string, _ int) bool {
+		holder := ipHeldByOtherSandbox(operation, args, ip)
+		if holder != nil {
+			// The sandbox was recreated and the new one took the IP over
+			cniLog.Infof("[%s] IP %s is held by container %s/%s now, leaving it attached and allocated", operation, ip, holder.ContainerID, holder.IfName)
+		}
+		return holder == nil
+	})
+	opRecord.IP = strings.Join(ips, ",")
+	if len(ips) == 0 {
+		cniLog.Infof("[%s] No IP known for container %s, nothing to release", operation, args.ContainerID)
+		return nil
 	}
 
-	ip := p.Status.PodIPs[0].IP
+	pacer, err := waitForPacing(ctx, operation, pluginConfig, false)
+	if err != nil {
+		return fmt.Errorf("failed to wait for GCE call pacing: %w", err)
+	}
+	defer func() { observePacing(operation, pacer, err) }()
 
-	ctx := context.Background()
-	client, err := google.DefaultClient(ctx, compute.CloudPlatformScope)
+	client, err := newGoogleClient(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create google default client: %w", err)
 	}
+	gceCalls := countGCECalls(client)
+	defer recordGCECalls(operation, gceCalls)
 
 	computeService, projectID, zone, _, instanceName, err := getInstanceInfo(client)
 	if err != nil {
 		return err
 	}
-
-	startTime = time.Now()
-	instance, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
-	logging.Infof("[%s][Cloud Operation] Get instance %s took %v", operation, instanceName, time.Since(startTime))
+	host, err := newHostProject(ctx, computeService, gceCalls, projectID, pluginConfig.SharedVPC)
 	if err != nil {
-		return fmt.Errorf("failed to get instance details: %w", err)
+		return err
 	}
 
-	startTime = time.Now()
-	i, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
-	logging.Infof("[%s][Cloud Operation] Get instance (2nd call) %s took %v", operation, instanceName, time.Since(startTime))
+	nic, err := podNIC(ctx, operation, computeService, projectID, zone, instanceName)
 	if err != nil {
-		return fmt.Errorf("failed to get instance: %w", err)
+		return err
+	}
+	subnetwork := ipam.SubnetworkName(nic.Subnetwork)
+
+	// Pod status IPs are only touched while the pool holds them for the pod
+	var allocator *ipam.Allocator
+	var poolName string
+	if p != nil {
+		allocator = ipam.NewAllocator(clients.dynamic)
+		allocator.SetRetryPolicy(retryPolicy(pluginConfig))
+		limitPoolUpdates(allocator, pluginConfig, mutation.PriorityCleanup)
+		resolved, err := resolvePodPoolName(ctx, allocator, conf, pluginConfig, subnetwork, p)
+		if err != nil {
+			allocatorLog.Errorf("[%s] Failed to resolve IPPool for IP release: %v", operation, err)
+			if fromStatus {
+				return nil
+			}
+		}
+		poolName = resolved
+		if fromStatus {
+			if ips = podOwnedIPs(ctx, operation, allocator, poolName, p, ips); len(ips) == 0 {
+				return nil
+			}
+			opRecord.IP = strings.Join(ips, ",")
+		}
 	}
-	removed := lo.Filter(i.NetworkInterfaces[0].AliasIpRanges, func(a *compute.AliasIpRange, _ int) bool {
-		return a.IpCidrRange != fmt.Sprintf("%s/32", ip)
-	})
-
-	logging.Infof("[%s] Removing IP %s from instance %s", operation, ip, instance.Name)
-	logging.Infof("[%s] Current IPs on instance: %+v", operation, litter.Sdump(i.NetworkInterfaces[0].AliasIpRanges))
-	logging.Infof("[%s] IPs to be left on instance: %+v", operation, litter.Sdump(removed))
 
-	startTime = time.Now()
-	c, err := computeService.Instances.UpdateNetworkInterface(projectID, zone, instanceName, i.NetworkInterfaces[0].Name, &compute.NetworkInterface{
-		Fingerprint:   i.NetworkInterfaces[0].Fingerprint,
-		AliasIpRanges: removed,
-	}).Do()
-	logging.Infof("[%s][Cloud Operation] Update network interface on instance %s took %v", operation, instanceName, time.Since(startTime))
-	if err != nil {
-		return fmt.Errorf("failed to update network interface: %w", err)
+	// DEL never fails on hooks, the sandbox would not finish terminating
+	hookPool := poolName
+	if hookPool == "" {
+		hookPool = delPoolName(conf, pluginConfig, subnetwork, recorded)
+	}
+	for _, ip := range ips {
+		if err := runHooks(ctx, operation, pluginConfig, config.HookBeforeRelease, args, cniArgs, ip, hookPool, delAliasRange(recorded), instanceName); err != nil {
+			cniLog.Errorf("[%s] %v, releasing IP %s anyway", operation, err, ip)
+		}
 	}
 
-	startTime = time.Now()
-	if err := waitForInstanceOperation(ctx, computeService, projectID, zone, c.Name); err != nil {
-		return fmt.Errorf("failed to wait for network interface update operation: %w", err)
+	// Only the aliases this plugin attached are removed, the interface is not
+	// rewritten at all when they are gone already
+	rangeName := delAliasRange(recorded)
+	routed := recorded != nil && recorded.Routed
+	attachedIPs := func() []string {
+		return lo.Filter(ips, func(ip string, _ int) bool {
+			return lo.ContainsBy(nic.AliasIpRanges, func(a *compute.AliasIpRange) bool {
+				return holdsAlias(a, ip, rangeName)
+			})
+		})
+	}
+	attached := attachedIPs()
+	if len(attached) < len(ips) && !routed {
+		// The cached interface may predate the attach
+		nic, err = refreshNIC(ctx, operation, computeService, projectID, zone, instanceName)
+		if err != nil {
+			return err
+		}
+		attached = attachedIPs()
 	}
-	logging.Infof("[%s][Cloud Operation] Wait for network interface update operation took %v", operation, time.Since(startTime))
 
-	// Release IP from the pool only if this is not a migration flow
-	if !isMigrationFlow {
-		dynamicClient, err := buildDynamicClient()
+	if routed {
+		for _, ip := range ips {
+			if err := detachRoute(ctx, operation, host, projectID, zone, instanceName, ip, pluginConfig.Timeouts.Operation.Duration); err != nil {
+				return fmt.Errorf("failed to remove route: %w", err)
+			}
+		}
+	} else if len(attached) == 0 {
+		gceLog.Infof("[%s] Alias IPs %v not attached to instance %s, leaving the interface alone", operation, ips, instanceName)
+	} else {
+		gceLog.Infof("[%s] Removing IPs %v from instance %s", operation, attached, instanceName)
+		var left []*compute.AliasIpRange
+		c, err := updateAliases(ctx, operation, computeService, projectID, zone, instanceName, nic, func(current []*compute.AliasIpRange) []*compute.AliasIpRange {
+			left = withoutOwnedAliases(operation, current, attached, rangeName)
+			return left
+		})
 		if err != nil {
-			logging.Errorf("[%s] Failed to build dynamic client for IP release: %v", operation, err)
-			// Don't fail the entire operation if we can't release from pool
-			// The IP is already removed from the instance
-			return nil
+			return fmt.Errorf("failed to update network interface: %w", err)
+		}
+		if held := stillHeld(left, attached, rangeName); len(held) > 0 {
+			// Releasing them would hand another node IPs it cannot attach
+			allocatorLog.Errorf("[%s] IPs %v stay attached to instance %s, keeping them allocated", operation, held, instanceName)
+			ips = lo.Without(ips, held...)
 		}
 
-		allocator := ipam.NewAllocator(dynamicClient)
+		startTime = time.Now()
+		err = zoneOperations(computeService, projectID, zone).wait(ctx, c.Name, pluginConfig.Timeouts.Operation.Duration)
+		if finished := finishedOperation(c, instanceName, err); finished != nil {
+			recordAttachment(operation, args, func(a *store.Attachment) { a.DetachOperation = finished })
+		}
+		if err != nil {
+			return fmt.Errorf("failed to wait for network interface update operation: %w", err)
+		}
+		gceLog.Infof("[%s][Cloud Operation] Wait for network interface update operation %s (%d) took %v", operation, c.Name, c.Id, time.Since(startTime))
+		if len(ips) == 0 {
+			return nil
+		}
+	}
 
-		// Determine pool name
-		subnetwork := instance.NetworkInterfaces[0].Subnetwork
-		subnetworkParts := strings.Split(subnetwork, "/")
-		subnetwork = subnetworkParts[len(subnetworkParts)-1]
+	// Without the pod the migration marker is unknown, so the release is left
+	// to the installer, which checks the IPs did not move to another pod
+	if p == nil {
+		releaseDeferred = deferRelease(operation, args, ips, delPoolName(conf, pluginConfig, subnetwork, recorded))
+	}
 
-		poolName := conf.IPPoolName
+	// Release the IPs from the pool only if they do not migrate to another pod
+	if p != nil {
 		if poolName == "" {
-			poolName = fmt.Sprintf("ippool-%s", subnetwork)
+			// Don't fail the entire operation - the IP is already removed from the instance
+			if recorded != nil && recorded.Pool != "" {
+				releaseDeferred = deferRelease(operation, args, ips, recorded.Pool)
+			}
+			return nil
 		}
+		opRecord.Pool = poolName
+
+		// The IPs whose release failed are left to the installer together
+		var deferred []string
+		for _, ip := range ips {
+			migrating, err := releaseSourceMigration(ctx, operation, allocator, p, ip)
+			if err != nil {
+				allocatorLog.Errorf("[%s] Failed to look up migrations of IP %s: %v", operation, ip, err)
+				// The installer checks the IP did not move before releasing it
+				deferred = append(deferred, ip)
+				continue
+			}
+			if migrating {
+				allocatorLog.Infof("[%s] IP %s migrates to another pod, skipping IP release from pool", operation, ip)
+				continue
+			}
 
-		startTime = time.Now()
-		if err := allocator.Release(ctx, poolName, ip); err != nil {
-			logging.Errorf("[%s] Failed to release IP %s from pool %s: %v", operation, ip, poolName, err)
-			// Don't fail the entire operation - IP is already removed from instance
-		} else {
-			logging.Infof("[%s][K8s Operation] Release IP %s from pool %s took %v", operation, ip, poolName, time.Since(startTime))
-			logging.Infof("[%s] Released IP %s from pool %s", operation, ip, poolName)
+			startTime = time.Now()
+			// The IP may have been reclaimed and handed to another pod while this one's sandbox was gone
+			released, err := allocator.ReleaseIfOwner(ctx, poolName, ip, string(p.UID))
+			if err != nil {
+				allocatorLog.Errorf("[%s] Failed to release IP %s from pool %s: %v", operation, ip, poolName, err)
+				// Don't fail the entire operation - IP is already removed from instance, the installer retries the release
+				deferred = append(deferred, ip)
+				continue
+			}
+			if !released {
+				allocatorLog.Infof("[%s] IP %s is no longer allocated to pod %s/%s in pool %s, leaving it", operation, ip, p.Namespace, p.Name, poolName)
+				continue
+			}
+			allocatorLog.Infof("[%s][K8s Operation] Release IP %s from pool %s took %v", operation, ip, poolName, time.Since(startTime))
+			telemetry.Phase(ctx, "release", time.Since(startTime))
+			allocatorLog.Infof("[%s] Released IP %s from pool %s", operation, ip, poolName)
+		}
+		if len(deferred) > 0 {
+			releaseDeferred = deferRelease(operation, args, deferred, poolName)
 		}
 	}
 
-	logging.Infof("[%s] CNI del command completed in %v", operation, time.Since(delTimeStart))
+	cniLog.Infof("[%s] CNI del command completed in %v", operation, time.Since(delTimeStart))
 	return nil
 }
 
-func buildKubeClient() (*kubernetes.Clientset, error) {
-	kubeconfig := "/var/lib/kubelet/kubeconfig"
+// apiClients are the Kubernetes API clients of an invocation
+type apiClients struct {
+	kube    kubernetes.Interface
+	dynamic dynamic.Interface
+}
 
+// newClients and newGoogleClient build the clients of an invocation, tests
+// replace them with fakes
+var (
+	newClients      = buildClients
+	newGoogleClient = func(ctx context.Context) (*http.Client, error) {
+		return google.DefaultClient(ctx, compute.CloudPlatformScope)
+	}
+)
+
+// buildClients loads the kubeconfig once and shares a single HTTP client
+// between the typed and the dynamic client, so an invocation pays for one
+// TLS handshake with the API server instead of one per client
+func buildClients(kubeconfig string) (*apiClients, error) {
 	conf, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
 		return nil, err
 	}
-	clientset, err := kubernetes.NewForConfig(conf)
+	httpClient, err := rest.HTTPClientFor(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	return clientset, nil
-}
-
-func buildDynamicClient() (dynamic.Interface, error) {
-	kubeconfig := "/var/lib/kubelet/kubeconfig"
-
-	conf, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	kube, err := kubernetes.NewForConfigAndClient(conf, httpClient)
 	if err != nil {
 		return nil, err
 	}
-
-	// Register our API types
-	scheme := runtime.NewScheme()
-	if err := v1alpha1.AddToScheme(scheme); err != nil {
-		return nil, fmt.Errorf("failed to add types to scheme: %w", err)
-	}
-
-	dynamicClient, err := dynamic.NewForConfig(conf)
+	dynamicClient, err := dynamic.NewForConfigAndClient(conf, httpClient)
 	if err != nil {
 		return nil, err
 	}
+	return &apiClients{kube: kube, dynamic: dynamicClient}, nil
+}
 
-	return dynamicClient, nil
+// ipNet converts prefix to the net.IPNet of CNI results
+func ipNet(prefix netip.Prefix) net.IPNet {
+	return net.IPNet{IP: prefix.Addr().AsSlice(), Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())}
 }
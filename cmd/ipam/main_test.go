@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	logging "github.com/k8snetworkplumbingwg/cni-log"
+)
+
+// TestMain logs like on a node, but not onto the test output. The log file is
+// set once: its rotation runs in the background and must not see it change.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "gcp-ipam-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logging.SetLogFile(filepath.Join(dir, "gcp-ipam.log"))
+	logging.SetLogStderr(false)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// MoveOutAnnotation marks a source pod whose IP is migrating away, set by
+// orchestrators that predate PodIPMigration
+const MoveOutAnnotation = "live.cast.ai/move-out-ip"
+
+// pendingMigration is a read of the PodIPMigration of a pod started before
+// the pod itself is known, so the two API round trips of an ADD overlap
+type pendingMigration struct {
+	done      chan struct{}
+	migration *v1alpha1.PodIPMigration
+	err       error
+}
+
+func getMigrationAsync(ctx context.Context, allocator *ipam.Allocator, namespace, name string) *pendingMigration {
+	pending := &pendingMigration{done: make(chan struct{})}
+	go func() {
+		defer close(pending.done)
+		pending.migration, pending.err = allocator.GetMigration(ctx, namespace, name)
+	}()
+	return pending
+}
+
+func (p *pendingMigration) wait() (*v1alpha1.PodIPMigration, error) {
+	<-p.done
+	return p.migration, p.err
+}
+
+// migrationFor returns the PodIPMigration handing an IP over to the pod. Pods
+// annotated by orchestrators that predate the resource get one created from
+// their live.cast.ai annotations. nil means the pod takes a fresh IP.
+func migrationFor(ctx context.Context, allocator *ipam.Allocator, pod *corev1.Pod, pending *pendingMigration) (*v1alpha1.PodIPMigration, error) {
+	m, err := pending.wait()
+	if err == nil {
+		return m, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	reqIP, ok := pod.Annotations[ipam.LiveIPAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	m, err = allocator.CreateMigration(ctx, &v1alpha1.PodIPMigration{
+		ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+		Spec: v1alpha1.PodIPMigrationSpec{
+			IP:         reqIP,
+			SourceNode: pod.Annotations[ipam.OriginalInstanceAnnotation],
+		},
+	})
+	if apierrors.IsAlreadyExists(err) {
+		return allocator.GetMigration(ctx, pod.Namespace, pod.Name)
+	}
+	return m, err
+}
+
+// failMigration hands a migration the target pod could not finish to the
+// provisioner, which rolls it back
+func failMigration(operation string, allocator *ipam.Allocator, pod *corev1.Pod, cause error, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if _, err := allocator.AdvanceMigration(ctx, pod.Namespace, pod.Name, string(pod.UID), v1alpha1.PodIPMigrationFailed, cause); err != nil {
+		allocatorLog.Errorf("[%s] Failed to mark PodIPMigration %s/%s failed: %v", operation, pod.Namespace, pod.Name, err)
+		return
+	}
+	allocatorLog.Infof("[%s] Marked PodIPMigration %s/%s failed", operation, pod.Namespace, pod.Name)
+}
+
+// releaseSourceMigration reports whether ip of the source pod is migrating to
+// another pod, in which case it must stay allocated, and records on the
+// migration that the source pod let go of it
+func releaseSourceMigration(ctx context.Context, operation string, allocator *ipam.Allocator, pod *corev1.Pod, ip string) (bool, error) {
+	m, err := allocator.SourceMigration(ctx, pod, ip)
+	if err != nil {
+		return false, err
+	}
+	if m == nil {
+		_, moveOut := pod.Annotations[MoveOutAnnotation]
+		return moveOut, nil
+	}
+
+	allocatorLog.Infof("[%s] IP %s is migrating with PodIPMigration %s/%s in phase %s", operation, ip, m.Namespace, m.Name, m.Status.Phase)
+	if m.Status.SourceReleased {
+		return true, nil
+	}
+	_, err = allocator.ModifyMigration(ctx, m.Namespace, m.Name, func(m *v1alpha1.PodIPMigration) error {
+		m.Status.SourceReleased = true
+		return nil
+	})
+	if err != nil {
+		// The provisioner notices the source pod is gone on its own
+		allocatorLog.Errorf("[%s] Failed to record source release on PodIPMigration %s/%s: %v", operation, m.Namespace, m.Name, err)
+	}
+	return true, nil
+}
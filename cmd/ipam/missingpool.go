@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// resolveMissingPool checks that the pool resolved for a pod exists once an
+// allocation from it was not found, and applies missingPool of the plugin
+// configuration when it does not. newPool builds the pool of the create
+// action.
+func resolveMissingPool(ctx context.Context, operation string, allocator *ipam.Allocator, pluginConfig *config.Config, poolName, subnetwork string,
+	newPool func() (*v1alpha1.IPPool, error)) (string, error) {
+	exists, err := allocator.PoolExists(ctx, poolName)
+	if err != nil || exists {
+		return poolName, err
+	}
+
+	switch pluginConfig.MissingPool.Action {
+	case config.MissingPoolCreate:
+		pool, err := newPool()
+		if err != nil {
+			return "", fmt.Errorf("failed to create missing IPPool %s: %w", poolName, err)
+		}
+		startTime := time.Now()
+		err = allocator.CreatePool(ctx, pool)
+		telemetry.Phase(ctx, "create-pool", time.Since(startTime))
+		if apierrors.IsAlreadyExists(err) {
+			// Another node was first
+			return poolName, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		allocatorLog.Infof("[%s] Created missing IPPool %s with CIDR %s from secondary range %s of subnetwork %s",
+			operation, poolName, pool.Spec.CIDR, pool.Spec.SecondaryRangeName, subnetwork)
+		return poolName, nil
+
+	case config.MissingPoolFallback:
+		fallback := pluginConfig.MissingPool.FallbackPool
+		exists, err := allocator.PoolExists(ctx, fallback)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", fmt.Errorf("IPPool %s does not exist and neither does its fallback IPPool %s", poolName, fallback)
+		}
+		allocatorLog.Infof("[%s] IPPool %s does not exist, falling back to IPPool %s", operation, poolName, fallback)
+		return fallback, nil
+
+	default:
+		return "", fmt.Errorf("IPPool %s for subnetwork %s does not exist: provision it, map the subnetwork to an existing pool in poolMappings or set missingPool in the plugin configuration", poolName, subnetwork)
+	}
+}
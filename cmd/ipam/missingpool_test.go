@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestResolveMissingPool(t *testing.T) {
+	ctx := context.Background()
+	fallback := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "ippool-shared"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/16", Allocations: map[string]v1alpha1.IPAllocation{}},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocator := ipam.NewAllocator(dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{ipam.IPPoolGVR: "IPPoolList"},
+		&unstructured.Unstructured{Object: obj}))
+
+	newPool := func() (*v1alpha1.IPPool, error) {
+		return &v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "ippool-new"},
+			Spec:       v1alpha1.IPPoolSpec{CIDR: "10.9.0.0/24", SecondaryRangeName: "live"},
+		}, nil
+	}
+	resolve := func(action, poolName string) (string, error) {
+		cfg := config.Default()
+		cfg.MissingPool = config.MissingPool{Action: action, FallbackPool: "ippool-shared"}
+		return resolveMissingPool(ctx, "ADD", allocator, cfg, poolName, "subnet-new", newPool)
+	}
+
+	if _, err := resolve("", "ippool-new"); err == nil || !strings.Contains(err.Error(), "poolMappings") {
+		t.Errorf("resolveMissingPool() with the fail action error = %v, want a hint", err)
+	}
+	if got, err := resolve(config.MissingPoolFallback, "ippool-new"); err != nil || got != "ippool-shared" {
+		t.Errorf("resolveMissingPool() with the fallback action = %q, %v, want ippool-shared", got, err)
+	}
+	if got, err := resolve(config.MissingPoolCreate, "ippool-new"); err != nil || got != "ippool-new" {
+		t.Fatalf("resolveMissingPool() with the create action = %q, %v, want ippool-new", got, err)
+	}
+	// The created pool is used from now on, whatever the action
+	if got, err := resolve(config.MissingPoolFail, "ippool-new"); err != nil || got != "ippool-new" {
+		t.Errorf("resolveMissingPool() of the created pool = %q, %v", got, err)
+	}
+	result, err := allocator.Allocate(ctx, &ipam.AllocationRequest{PoolName: "ippool-new", PodUID: "uid", NodeName: "node"})
+	if err != nil || result.IP == "10.9.0.0" || result.IP == "10.9.0.1" {
+		t.Errorf("Allocate() from the created pool = %+v, %v, want an IP past the system reservations", result, err)
+	}
+}
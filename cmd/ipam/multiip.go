@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// allocateAdditionalIPs allocates count IPs of pool to the pod besides its
+// primary one, from the secondary range rangeName the primary one came from
+func allocateAdditionalIPs(ctx context.Context, operation string, allocator *ipam.Allocator, p *corev1.Pod, poolName, instanceName, rangeName string, count int) ([]string, error) {
+	startTime := time.Now()
+	ips, err := allocator.AllocateAdditional(ctx, &ipam.AllocationRequest{
+		PoolName:     poolName,
+		PodName:      p.Name,
+		PodNamespace: p.Namespace,
+		PodUID:       string(p.UID),
+		NodeName:     instanceName,
+		RangeName:    rangeName,
+		Protected:    p.Annotations[ipam.ProtectedIPAnnotation] == "true",
+	}, count)
+	allocatorLog.Infof("[%s][K8s Operation] Allocate %d additional IPs from pool %s took %v", operation, count, poolName, time.Since(startTime))
+	telemetry.Phase(ctx, "allocate-additional", time.Since(startTime))
+	if errors.Is(err, ipam.ErrNodeLimitReached) {
+		return nil, types.NewError(ErrCodeNodeLimitReached, "node IP limit of pool reached", err.Error())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate additional IPs from pool %s: %w", poolName, err)
+	}
+	allocatorLog.Infof("[%s] Allocated additional IPs %v from pool %s", operation, ips, poolName)
+	return ips, nil
+}
+
+// aliasesToAttach reports whether the alias of ip from rangeName is attached
+// to nic and returns the IPs of ip and additionalIPs whose alias is not
+func aliasesToAttach(nic *compute.NetworkInterface, ip string, additionalIPs []string, rangeName string) (bool, []string, error) {
+	attached, err := ownedAliasAttached(nic.AliasIpRanges, ip, rangeName)
+	if err != nil {
+		return false, nil, err
+	}
+	attachIPs, err := unattachedIPs(nic.AliasIpRanges, additionalIPs, rangeName)
+	if err != nil {
+		return false, nil, err
+	}
+	if !attached {
+		attachIPs = append([]string{ip}, attachIPs...)
+	}
+	return attached, attachIPs, nil
+}
+
+// unattachedIPs returns the IPs of ips whose alias from rangeName is not
+// attached yet
+func unattachedIPs(aliases []*compute.AliasIpRange, ips []string, rangeName string) ([]string, error) {
+	var unattached []string
+	for _, ip := range ips {
+		attached, err := ownedAliasAttached(aliases, ip, rangeName)
+		if err != nil {
+			return nil, err
+		}
+		if !attached {
+			unattached = append(unattached, ip)
+		}
+	}
+	return unattached, nil
+}
+
+// addAdditionalIPs adds ips to the result of the primary IP, with its prefix
+// length and gateway
+func addAdditionalIPs(result *current.Result, ips []string) error {
+	primary := result.IPs[0]
+	bits, _ := primary.Address.Mask.Size()
+	for _, ip := range ips {
+		addr, err := ipam.ParseAddr(ip)
+		if err != nil {
+			return fmt.Errorf("failed to parse allocated IP %s: %w", ip, err)
+		}
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Address: ipNet(netip.PrefixFrom(addr, bits)),
+			Gateway: primary.Gateway,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/internal/telemetry"
+)
+
+// Classes of failed GCE operations, matched with errors.Is
+var (
+	errAliasRangeOverlap   = errors.New("alias IP range overlaps an existing range")
+	errOperationQuota      = errors.New("GCE quota exceeded")
+	errFingerprintMismatch = errors.New("network interface fingerprint mismatch")
+	errIPInUse             = errors.New("IP address in use by another resource")
+)
+
+// operationFailure is what a GCE operation error code means and what the
+// operator can do about it
+type operationFailure struct {
+	class error
+	hint  string
+}
+
+var operationFailures = map[string]operationFailure{
+	"ALIAS_IP_RANGE_OVERLAP": {
+		class: errAliasRangeOverlap,
+		hint:  "another alias or subnetwork range covers the IP, check the aliases GKE or other agents attached and that pool CIDRs do not overlap",
+	},
+	"QUOTA_EXCEEDED": {
+		class: errOperationQuota,
+		hint:  "raise the GCE quota of the project or lower concurrency.nodeMutations and widen pacing in the plugin configuration",
+	},
+	"CONDITION_NOT_MET": {
+		class: errFingerprintMismatch,
+		hint:  "another agent updated the network interface at the same time, the retried ADD or DEL reads it again",
+	},
+	"IP_IN_USE_BY_ANOTHER_RESOURCE": {
+		class: errIPInUse,
+		hint:  "an instance, forwarding rule or reserved address outside the pool holds the IP, exclude it from the pool or free it",
+	},
+}
+
+// operationError is a GCE operation that finished with errors
+type operationError struct {
+	class   error
+	hint    string
+	codes   []string
+	message string
+}
+
+// newOperationError classifies the errors of a finished operation by the
+// first code it knows
+func newOperationError(opErr *compute.OperationError) *operationError {
+	e := &operationError{}
+	var messages []string
+	for _, item := range opErr.Errors {
+		e.codes = append(e.codes, item.Code)
+		messages = append(messages, item.Message)
+		if failure, ok := operationFailures[item.Code]; ok && e.class == nil {
+			e.class, e.hint = failure.class, failure.hint
+		}
+	}
+	e.message = strings.Join(messages, ", ")
+	return e
+}
+
+func (e *operationError) Error() string {
+	if e.class == nil {
+		return fmt.Sprintf("operation failed with %s: %s", strings.Join(e.codes, ", "), e.message)
+	}
+	return fmt.Sprintf("operation failed, %v: %s; %s", e.class, e.message, e.hint)
+}
+
+func (e *operationError) Unwrap() error {
+	return e.class
+}
+
+// finishedOperation is the record of op once waiting for it returned err. It
+// is nil unless the operation finished, successfully or not.
+func finishedOperation(op *compute.Operation, instanceName string, err error) *store.Operation {
+	var opErr *operationError
+	if err != nil && !errors.As(err, &opErr) {
+		return nil
+	}
+
+	finished := &store.Operation{
+		Name:     op.Name,
+		ID:       op.Id,
+		Instance: instanceName,
+		DoneAt:   time.Now(),
+	}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	return finished
+}
+
+const (
+	// operationRetryBackoff spaces the wait calls retried after a transient
+	// error, doubling up to operationRetryMaxBackoff
+	operationRetryBackoff    = 250 * time.Millisecond
+	operationRetryMaxBackoff = 4 * time.Second
+)
+
+// operationScope is where GCE keeps an operation: instance changes are zonal,
+// subnetwork changes regional and route changes global. Each scope has an
+// operations service of its own.
+type operationScope struct {
+	service *compute.Service
+	project string
+	zone    string
+	region  string
+}
+
+func zoneOperations(service *compute.Service, project, zone string) operationScope {
+	return operationScope{service: service, project: project, zone: zone}
+}
+
+func regionOperations(service *compute.Service, project, region string) operationScope {
+	return operationScope{service: service, project: project, region: region}
+}
+
+func globalOperations(service *compute.Service, project string) operationScope {
+	return operationScope{service: service, project: project}
+}
+
+// wait waits up to timeout for the named operation of the scope, see
+// waitForOperation
+func (s operationScope) wait(ctx context.Context, name string, timeout time.Duration) error {
+	return waitForOperation(ctx, timeout, func(ctx context.Context) (*compute.Operation, error) {
+		switch {
+		case s.zone != "":
+			return s.service.ZoneOperations.Wait(s.project, s.zone, name).Context(ctx).Do()
+		case s.region != "":
+			return s.service.RegionOperations.Wait(s.project, s.region, name).Context(ctx).Do()
+		default:
+			return s.service.GlobalOperations.Wait(s.project, name).Context(ctx).Do()
+		}
+	})
+}
+
+// waitForOperation calls an operations.wait method until the operation is
+// done. It returns once the operation is done or after up to two minutes, a
+// single request instead of polling every 100ms. Throttled and server errors
+// of the wait call itself are retried with backoff until timeout, the
+// operation keeps running meanwhile.
+func waitForOperation(ctx context.Context, timeout time.Duration, wait func(context.Context) (*compute.Operation, error)) error {
+	defer func(start time.Time) { telemetry.Phase(ctx, "wait-operation", time.Since(start)) }(time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := operationRetryBackoff
+	for {
+		op, err := wait(ctx)
+		if err != nil {
+			delay, transient := transientWaitError(err)
+			if !transient || ctx.Err() != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(max(delay, backoff)):
+			}
+			backoff = min(2*backoff, operationRetryMaxBackoff)
+			continue
+		}
+		if op.Status == "DONE" {
+			if op.Error != nil {
+				return newOperationError(op.Error)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// transientWaitError reports whether a failed wait call is worth retrying and
+// how long GCE asked to wait before that
+func transientWaitError(err error) (time.Duration, bool) {
+	if throttled, retryAfter := quotaExceeded(err); throttled {
+		return retryAfter, true
+	}
+	var gerr *googleapi.Error
+	return 0, errors.As(err, &gerr) && gerr.Code >= http.StatusInternalServerError
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestOperationError(t *testing.T) {
+	opError := func(codes ...string) *compute.OperationError {
+		e := &compute.OperationError{}
+		for _, code := range codes {
+			e.Errors = append(e.Errors, &compute.OperationErrorErrors{Code: code, Message: "message of " + code})
+		}
+		return e
+	}
+
+	tests := []struct {
+		name     string
+		opError  *compute.OperationError
+		want     error
+		wantText string
+	}{
+		{name: "alias overlap", opError: opError("ALIAS_IP_RANGE_OVERLAP"), want: errAliasRangeOverlap, wantText: "pool CIDRs"},
+		{name: "quota", opError: opError("QUOTA_EXCEEDED"), want: errOperationQuota, wantText: "concurrency.nodeMutations"},
+		{name: "fingerprint", opError: opError("CONDITION_NOT_MET"), want: errFingerprintMismatch, wantText: "reads it again"},
+		{name: "first known code wins", opError: opError("UNKNOWN", "IP_IN_USE_BY_ANOTHER_RESOURCE", "QUOTA_EXCEEDED"), want: errIPInUse, wantText: "message of UNKNOWN"},
+		{name: "unknown", opError: opError("UNKNOWN"), wantText: "operation failed with UNKNOWN: message of UNKNOWN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fmt.Errorf("failed to wait: %w", newOperationError(tt.opError))
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("error %v is not %v", err, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.wantText) {
+				t.Errorf("error %q does not mention %q", err, tt.wantText)
+			}
+		})
+	}
+
+	if throttled, _ := quotaExceeded(newOperationError(opError("QUOTA_EXCEEDED"))); !throttled {
+		t.Errorf("quotaExceeded() = false for a quota operation error")
+	}
+}
+
+func TestFinishedOperation(t *testing.T) {
+	op := &compute.Operation{Name: "operation-1", Id: 42}
+
+	if finished := finishedOperation(op, "node-1", nil); finished == nil || finished.Name != "operation-1" || finished.ID != 42 || finished.Instance != "node-1" || finished.Error != "" {
+		t.Errorf("finishedOperation() = %+v for a successful operation", finished)
+	}
+	failed := fmt.Errorf("failed to wait: %w", newOperationError(&compute.OperationError{
+		Errors: []*compute.OperationErrorErrors{{Code: "QUOTA_EXCEEDED", Message: "quota"}},
+	}))
+	if finished := finishedOperation(op, "node-1", failed); finished == nil || finished.Error == "" {
+		t.Errorf("finishedOperation() = %+v for a failed operation", finished)
+	}
+	if finished := finishedOperation(op, "node-1", context.DeadlineExceeded); finished != nil {
+		t.Errorf("finishedOperation() = %+v for an operation not waited for", finished)
+	}
+}
+
+func TestOperationScopeWait(t *testing.T) {
+	var calls atomic.Int32
+	var path atomic.Value
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path.Store(r.URL.Path)
+		// The first wait call of every operation fails transiently
+		if calls.Add(1)%2 == 1 {
+			http.Error(w, `{"error": {"code": 503, "message": "backend unavailable"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		op := &compute.Operation{Name: r.URL.Path, Status: "DONE"}
+		if strings.Contains(r.URL.Path, "/regions/") {
+			op.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: "QUOTA_EXCEEDED"}}}
+		}
+		json.NewEncoder(w).Encode(op)
+	}))
+	defer gce.Close()
+
+	service, err := compute.NewService(context.Background(), option.WithEndpoint(gce.URL+"/compute/v1/"), option.WithHTTPClient(gce.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		scope operationScope
+		path  string
+		want  error
+	}{
+		{scope: zoneOperations(service, "project", "europe-west1-b"), path: "/compute/v1/projects/project/zones/europe-west1-b/operations/operation-1/wait"},
+		{scope: regionOperations(service, "project", "europe-west1"), path: "/compute/v1/projects/project/regions/europe-west1/operations/operation-1/wait", want: errOperationQuota},
+		{scope: globalOperations(service, "project"), path: "/compute/v1/projects/project/global/operations/operation-1/wait"},
+	}
+	for _, tt := range tests {
+		err := tt.scope.wait(context.Background(), "operation-1", 10*time.Second)
+		if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+			t.Errorf("wait() in scope %+v = %v, want %v", tt.scope, err, tt.want)
+		}
+		if path.Load() != tt.path {
+			t.Errorf("wait() called %v, want %s", path.Load(), tt.path)
+		}
+	}
+	if calls.Load() != 6 {
+		t.Errorf("wait calls = %d, want one retry per operation", calls.Load())
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/telemetry"
+)
+
+// quotaReasons are the googleapi error reasons GCE uses for rate and quota limits
+var quotaReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+}
+
+// waitForPacing holds the invocation back until the node may call GCE again,
+// critical invocations are not held back. It must be called with the node
+// mutation lock held.
+func waitForPacing(ctx context.Context, operation string, pluginConfig *config.Config, critical bool) (*mutation.Pacer, error) {
+	pacer := mutation.NewPacer(nodePaths.pacer, mutation.PacerConfig{
+		Initial:   pluginConfig.Pacing.Initial.Duration,
+		Min:       pluginConfig.Pacing.Min.Duration,
+		Max:       pluginConfig.Pacing.Max.Duration,
+		IdleReset: pluginConfig.Pacing.IdleReset.Duration,
+	})
+	if critical {
+		if err := pacer.Bypass(); err != nil {
+			return nil, err
+		}
+		gceLog.Debugf("[%s] Critical pod, not waiting for GCE call pacing", operation)
+		return pacer, nil
+	}
+
+	waited, err := pacer.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	telemetry.Phase(ctx, "pacing", waited)
+	if waited > 0 {
+		gceLog.Infof("[%s] Waited %v for GCE call pacing", operation, waited)
+	}
+	return pacer, nil
+}
+
+// observePacing feeds the outcome of the invocation back into the node pacing
+func observePacing(operation string, pacer *mutation.Pacer, err error) {
+	throttled, retryAfter := quotaExceeded(err)
+	if throttled {
+		gceLog.Errorf("[%s] GCE quota exceeded, slowing down GCE calls on this node: %v", operation, err)
+	}
+	if err := pacer.Observe(throttled, retryAfter); err != nil {
+		gceLog.Errorf("[%s] Failed to record GCE call pacing: %v", operation, err)
+		return
+	}
+	gceLog.Debugf("[%s] Next GCE call pacing interval %v", operation, pacer.Interval())
+}
+
+// quotaExceeded reports whether err is GCE rejecting a call for rate or quota
+// limits, along with the Retry-After the API sent
+func quotaExceeded(err error) (bool, time.Duration) {
+	if errors.Is(err, errOperationQuota) {
+		// Accepted, but failed on quota while running
+		return true, 0
+	}
+
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return false, 0
+	}
+
+	throttled := gerr.Code == http.StatusTooManyRequests
+	for _, item := range gerr.Errors {
+		if quotaReasons[item.Reason] {
+			throttled = true
+		}
+	}
+	if !throttled {
+		return false, 0
+	}
+
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(gerr.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	return true, retryAfter
+}
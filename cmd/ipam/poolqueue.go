@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/mutation"
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// nodePoolLimiter queues the pool updates of plugin invocations on the node,
+// at most limit of every pool at once, in the order of the node mutation queue
+type nodePoolLimiter struct {
+	limit    int
+	priority mutation.Priority
+}
+
+func (l nodePoolLimiter) Acquire(ctx context.Context, pool string) (func(), error) {
+	queue := mutation.NewPoolQueue(nodePaths.poolQueue, pool, l.limit)
+	startTime := time.Now()
+	if err := queue.Acquire(ctx, l.priority); err != nil {
+		return nil, fmt.Errorf("failed to acquire update queue of pool %s: %w", pool, err)
+	}
+	telemetry.Phase(ctx, "pool-queue", time.Since(startTime))
+	return func() { _ = queue.Release() }, nil
+}
+
+// limitPoolUpdates makes allocator queue its pool updates on the node when the
+// configuration limits them
+func limitPoolUpdates(allocator *ipam.Allocator, pluginConfig *config.Config, priority mutation.Priority) {
+	if pluginConfig.Concurrency.PoolUpdates > 0 {
+		allocator.SetPoolLimiter(nodePoolLimiter{limit: pluginConfig.Concurrency.PoolUpdates, priority: priority})
+	}
+}
+
+// retryPolicy is the backoff of conflicting pool updates the configuration sets
+func retryPolicy(pluginConfig *config.Config) ipam.RetryPolicy {
+	return ipam.RetryPolicy{
+		Attempts:  pluginConfig.Retry.Attempts,
+		BaseDelay: pluginConfig.Retry.BaseDelay.Duration,
+		MaxDelay:  pluginConfig.Retry.MaxDelay.Duration,
+	}
+}
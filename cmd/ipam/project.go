@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/quota"
+)
+
+// hostProject is the project the subnetworks and routes of the VPC live in:
+// the project of the node, or the Shared VPC host project when the node runs
+// in a service project
+type hostProject struct {
+	service *compute.Service
+	id      string
+}
+
+// newHostProject returns the host project of a node in nodeProject. Calls on
+// it use computeService unless a service account of the host project is
+// impersonated, they are counted against the node quota either way.
+func newHostProject(ctx context.Context, computeService *compute.Service, gceCalls *quota.Counter, nodeProject string, sharedVPC config.SharedVPC) (*hostProject, error) {
+	host := &hostProject{service: computeService, id: sharedVPC.NetworkProject(nodeProject)}
+	if sharedVPC.ServiceAccount == "" {
+		return host, nil
+	}
+
+	ts, err := identity.ImpersonatedTokenSource(ctx, sharedVPC.ServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: gceCalls.Transport(&oauth2.Transport{Source: ts})}
+	host.service, err = compute.NewService(ctx, append(identityOverrides.ComputeOptions(), option.WithHTTPClient(client))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compute service for host project %s: %w", host.id, err)
+	}
+	return host, nil
+}
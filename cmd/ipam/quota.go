@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/castai/gcp-cni/internal/quota"
+)
+
+// countGCECalls charges every request made through client to its GCE quota bucket
+func countGCECalls(client *http.Client) *quota.Counter {
+	counter := quota.NewCounter()
+	client.Transport = counter.Transport(client.Transport)
+	return counter
+}
+
+// recordGCECalls adds the requests of this invocation to the node quota usage.
+// It must be called with the node mutation lock held.
+func recordGCECalls(operation string, counter *quota.Counter) {
+	gceLog.Debugf("[%s] GCE requests: read=%d mutate=%d operations=%d", operation,
+		counter.Calls(quota.BucketRead), counter.Calls(quota.BucketMutate), counter.Calls(quota.BucketOperations))
+
+	if err := quota.Record(nodePaths.quota, counter, time.Now()); err != nil {
+		gceLog.Errorf("[%s] Failed to record GCE quota usage: %v", operation, err)
+	}
+}
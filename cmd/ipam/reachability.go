@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// reachabilityDialTimeout bounds a single connection attempt of the check
+const reachabilityDialTimeout = 2 * time.Second
+
+// verifyReachability waits until the IPs are reachable over the VPC, checked
+// by connecting from each of them to the configured target within the timeout.
+// The pod's interface does not exist before the ADD result is returned, so each
+// IP is added to the loopback interface of the node for the check, scoped to
+// the host so nothing else picks it as source, and removed again before the
+// result is returned. Only failures with the Fail policy are returned.
+// Without a target, IPs this ADD attached at attachedAt are given the settle
+// delay to propagate instead.
+func verifyReachability(ctx context.Context, operation string, pluginConfig *config.Config, ips []string, attachedAt time.Time) error {
+	reachability := pluginConfig.Reachability
+	if reachability.Target == "" {
+		return settle(ctx, operation, ips, attachedAt, reachability.SettleDelay.Duration)
+	}
+
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, reachability.Timeout.Duration)
+	defer cancel()
+	var err error
+	for _, ip := range ips {
+		if err = probeReachability(ctx, ip, reachability.Target); err != nil {
+			err = fmt.Errorf("IP %s: %w", ip, err)
+			break
+		}
+	}
+	telemetry.Phase(ctx, "reachability", time.Since(startTime))
+	if err == nil {
+		gceLog.Infof("[%s] IPs %v reached %s over the VPC after %v", operation, ips, reachability.Target, time.Since(startTime))
+		return nil
+	}
+	if reachability.FailurePolicy != config.HookFailurePolicyFail {
+		gceLog.Warningf("[%s] Pod IPs did not reach %s over the VPC, ignoring: %v", operation, reachability.Target, err)
+		return nil
+	}
+	return types.NewError(types.ErrTryAgainLater, "pod IP unreachable over the VPC", err.Error())
+}
+
+// addHostAddress and removeHostAddress put the IP checked on the loopback
+// interface and take it off again, replaced in tests
+var (
+	addHostAddress = func(ctx context.Context, ip string) error {
+		if output, err := exec.CommandContext(ctx, "ip", "addr", "replace", ipam.HostPrefix(ip), "dev", "lo", "scope", "host").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to add IP %s to the loopback interface: %w: %s", ip, err, output)
+		}
+		return nil
+	}
+	removeHostAddress = func(ip string) error {
+		if output, err := exec.Command("ip", "addr", "del", ipam.HostPrefix(ip), "dev", "lo").CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return nil
+	}
+)
+
+// probeReachability connects from ip to target until a connection is
+// established or ctx is done. Refused connections do not count, the reset may
+// come from the node itself rather than over the VPC.
+func probeReachability(ctx context.Context, ip, target string) error {
+	if err := addHostAddress(ctx, ip); err != nil {
+		return err
+	}
+	defer func() {
+		// A leftover address would take the pod's traffic, removed even when the ADD is cancelled
+		if err := removeHostAddress(ip); err != nil {
+			gceLog.Errorf("Failed to remove IP %s from the loopback interface: %v", ip, err)
+		}
+	}()
+
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)},
+		Timeout:   reachabilityDialTimeout,
+	}
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", target)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no answer from %s: %w", target, err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// settle waits until delay passed since the IPs were attached at attachedAt,
+// zero when they were attached before this ADD. It only runs without a
+// reachability target: with one, the check waits for the propagation itself
+// and settleDelay is ignored.
+func settle(ctx context.Context, operation string, ips []string, attachedAt time.Time, delay time.Duration) error {
+	wait := time.Until(attachedAt.Add(delay))
+	if attachedAt.IsZero() || wait <= 0 {
+		return nil
+	}
+
+	gceLog.Debugf("[%s] Waiting %v for IPs %v to propagate through the VPC", operation, wait, ips)
+	startTime := time.Now()
+	defer func() { telemetry.Phase(ctx, "settle", time.Since(startTime)) }()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+)
+
+// stubHostAddresses records the IPs put on and taken off the loopback
+// interface instead of running ip
+func stubHostAddresses(t *testing.T) (added, removed *[]string) {
+	added, removed = &[]string{}, &[]string{}
+	addHost, removeHost := addHostAddress, removeHostAddress
+	t.Cleanup(func() { addHostAddress, removeHostAddress = addHost, removeHost })
+	addHostAddress = func(_ context.Context, ip string) error {
+		*added = append(*added, ip)
+		return nil
+	}
+	removeHostAddress = func(ip string) error {
+		*removed = append(*removed, ip)
+		return nil
+	}
+	return added, removed
+}
+
+func reachabilityConfig(target, policy string) *config.Config {
+	return &config.Config{Reachability: config.Reachability{
+		Target:        target,
+		Timeout:       metav1.Duration{Duration: 1500 * time.Millisecond},
+		FailurePolicy: policy,
+	}}
+}
+
+func TestVerifyReachability(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	added, removed := stubHostAddresses(t)
+	ips := []string{"127.0.0.1", "127.0.0.1"}
+	if err := verifyReachability(context.Background(), "test", reachabilityConfig(listener.Addr().String(), config.HookFailurePolicyFail), ips, time.Time{}); err != nil {
+		t.Fatalf("verifyReachability() error = %v", err)
+	}
+	if !slices.Equal(*added, ips) || !slices.Equal(*removed, ips) {
+		t.Errorf("host addresses added %v and removed %v, want every IP of the pod both", *added, *removed)
+	}
+}
+
+func TestVerifyReachabilityRefused(t *testing.T) {
+	// A port nothing listens on answers with a reset from the node itself
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := listener.Addr().String()
+	listener.Close()
+
+	_, removed := stubHostAddresses(t)
+	err = verifyReachability(context.Background(), "test", reachabilityConfig(target, config.HookFailurePolicyFail), []string{"127.0.0.1"}, time.Time{})
+	var cniErr *types.Error
+	if !errors.As(err, &cniErr) || cniErr.Code != types.ErrTryAgainLater {
+		t.Fatalf("verifyReachability() of a refused target error = %v, want try again later", err)
+	}
+	if len(*removed) != 1 {
+		t.Errorf("host addresses removed %v, want the checked IP removed again", *removed)
+	}
+
+	if err := verifyReachability(context.Background(), "test", reachabilityConfig(target, config.HookFailurePolicyIgnore), []string{"127.0.0.1"}, time.Time{}); err != nil {
+		t.Errorf("verifyReachability() with the Ignore policy error = %v", err)
+	}
+}
+
+func TestVerifyReachabilityHostAddressFailure(t *testing.T) {
+	stubHostAddresses(t)
+	addHostAddress = func(context.Context, string) error { return errors.New("operation not permitted") }
+
+	err := verifyReachability(context.Background(), "test", reachabilityConfig("10.0.0.2:443", config.HookFailurePolicyFail), []string{"10.8.0.5"}, time.Time{})
+	if err == nil {
+		t.Fatal("verifyReachability() without the host address succeeded")
+	}
+}
+
+func TestSettle(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	ips := []string{"10.8.0.5"}
+
+	tests := []struct {
+		name     string
+		attached time.Duration // ago, zero for IPs attached by an earlier ADD
+		wantWait time.Duration
+	}{
+		{name: "attached by an earlier ADD"},
+		{name: "attached long ago", attached: time.Minute},
+		{name: "just attached", attached: time.Nanosecond, wantWait: delay},
+		{name: "attached a while ago", attached: delay / 2, wantWait: delay / 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTime := time.Now()
+			var attachedAt time.Time
+			if tt.attached > 0 {
+				attachedAt = startTime.Add(-tt.attached)
+			}
+			if err := settle(context.Background(), "test", ips, attachedAt, delay); err != nil {
+				t.Fatal(err)
+			}
+			// Only the remainder of the delay is waited
+			if waited := time.Since(startTime); waited < tt.wantWait-delay/4 || waited > tt.wantWait+delay/4 {
+				t.Errorf("settle() waited %v, want %v", waited, tt.wantWait)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := settle(ctx, "test", ips, time.Now(), time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("settle() of a cancelled ADD error = %v, want context.Canceled", err)
+	}
+}
+
+func TestVerifyReachabilitySettle(t *testing.T) {
+	stubHostAddresses(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Without a target the IPs attached now are given the settle delay, here cut short
+	pluginConfig := reachabilityConfig("", config.HookFailurePolicyFail)
+	pluginConfig.Reachability.SettleDelay = metav1.Duration{Duration: time.Minute}
+	if err := verifyReachability(ctx, "test", pluginConfig, []string{"10.8.0.5"}, time.Now()); !errors.Is(err, context.Canceled) {
+		t.Errorf("verifyReachability() without a target error = %v, want the settle delay waited", err)
+	}
+
+	// With a target the check replaces the delay
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	pluginConfig = reachabilityConfig(listener.Addr().String(), config.HookFailurePolicyFail)
+	pluginConfig.Reachability.SettleDelay = metav1.Duration{Duration: time.Minute}
+	startTime := time.Now()
+	if err := verifyReachability(context.Background(), "test", pluginConfig, []string{"127.0.0.1"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(startTime); waited > 10*time.Second {
+		t.Errorf("verifyReachability() with a target waited %v, want the settle delay ignored", waited)
+	}
+}
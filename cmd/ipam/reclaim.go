@@ -0,0 +1,161 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/samber/lo"
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const (
+	// reclaimChecks bounds the pods an ADD finding its pool exhausted verifies
+	reclaimChecks = 32
+	// reclaimMax bounds the IPs such an ADD reclaims, later ADDs reclaim more
+	reclaimMax = 4
+)
+
+// reclaimer frees IPs of an exhausted pool whose pods completed, failed or are
+// gone, for pools with spec.reclaimOnExhaustion. Allocations outliving their
+// pod for a while are bookkeeping lag, e.g. a DEL whose release was deferred,
+// that would otherwise fail the ADDs of new pods until the provisioner
+// catches up.
+type reclaimer struct {
+	operation      string
+	args           *skel.CmdArgs
+	conf           *PluginConf
+	pluginConfig   *config.Config
+	clients        *apiClients
+	allocator      *ipam.Allocator
+	computeService *compute.Service
+	host           *hostProject
+	projectID      string
+	zone           string
+	instanceName   string
+}
+
+// reclaim frees up to reclaimMax IPs of the pool and reports how many. Every
+// pod is read from the API server, and the alias of its IP detached from the
+// instance of its node before the IP is released, only while it still
+// belongs to the pod, so no IP is handed out while still attached somewhere.
+// IPs of active migrations are left alone.
+func (r *reclaimer) reclaim(ctx context.Context, poolName string) int {
+	startTime := time.Now()
+	defer func() { telemetry.Phase(ctx, "reclaim", time.Since(startTime)) }()
+
+	candidates, err := r.allocator.ReclaimCandidates(ctx, poolName)
+	if err != nil {
+		allocatorLog.Errorf("[%s] Failed to list reclaimable IPs of pool %s: %v", r.operation, poolName, err)
+		return 0
+	}
+
+	// The target pod of a migration has the name of its source, so the
+	// source's allocation looks recreated while the IP moves
+	migrating, err := r.allocator.MigratingIPs(ctx)
+	if err != nil {
+		allocatorLog.Errorf("[%s] Failed to list migrating IPs of pool %s: %v", r.operation, poolName, err)
+		return 0
+	}
+	candidates = lo.Reject(candidates, func(c ipam.ReclaimCandidate, _ int) bool { return migrating[ipam.CanonicalIP(c.IP)] })
+
+	reclaimed := 0
+	for _, c := range candidates[:min(len(candidates), reclaimChecks)] {
+		if reclaimed == reclaimMax {
+			break
+		}
+		pod, err := r.clients.kube.CoreV1().Pods(c.PodNamespace).Get(ctx, c.PodName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			pod, err = nil, nil
+		}
+		if err != nil {
+			allocatorLog.Errorf("[%s] Failed to verify pod %s/%s of IP %s: %v", r.operation, c.PodNamespace, c.PodName, c.IP, err)
+			continue
+		}
+		reason := ipam.StaleReason(c.IPAllocation, pod)
+		if reason == "" {
+			continue
+		}
+
+		if err := r.detach(ctx, c); err != nil {
+			gceLog.Errorf("[%s] Failed to detach reclaimable IP %s from instance %s: %v", r.operation, c.IP, c.NodeName, err)
+			continue
+		}
+		released, err := r.allocator.ReleaseIfOwner(ctx, poolName, c.IP, c.PodUID)
+		if err != nil {
+			allocatorLog.Errorf("[%s] Failed to reclaim IP %s of pool %s: %v", r.operation, c.IP, poolName, err)
+			continue
+		}
+		if !released {
+			continue
+		}
+		if c.NodeName == r.instanceName {
+			// A late DEL of the pod's sandbox must leave the IP to whoever gets it next
+			supersedeAttachments(r.operation, r.args, c.IP)
+		}
+		allocatorLog.Infof("[%s] Reclaimed IP %s of pod %s/%s on node %s from exhausted pool %s: %s",
+			r.operation, c.IP, c.PodNamespace, c.PodName, c.NodeName, poolName, reason)
+		reclaimed++
+	}
+	return reclaimed
+}
+
+// detach removes the alias, or the route, of the candidate's IP from the
+// instance of its node, found in the zone of the node
+func (r *reclaimer) detach(ctx context.Context, c ipam.ReclaimCandidate) error {
+	own := c.NodeName == r.instanceName
+	zone := r.zone
+	if !own {
+		node, err := r.clients.kube.CoreV1().Nodes().Get(ctx, c.NodeName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get node %s: %w", c.NodeName, err)
+		}
+		zone = cmp.Or(node.Labels[corev1.LabelTopologyZone], zone)
+	}
+
+	read := instanceNIC
+	if own {
+		read = refreshNIC
+	}
+	nic, err := read(ctx, r.operation, r.computeService, r.projectID, zone, c.NodeName)
+	if err != nil {
+		return err
+	}
+	rangeName := resolveAliasRange(r.conf, r.pluginConfig, c.SecondaryRangeName)
+	if lo.ContainsBy(nic.AliasIpRanges, func(a *compute.AliasIpRange) bool { return holdsAlias(a, c.IP, rangeName) }) {
+		var left []*compute.AliasIpRange
+		without := func(current []*compute.AliasIpRange) []*compute.AliasIpRange {
+			left = withoutOwnedAlias(r.operation, current, c.IP, rangeName)
+			return left
+		}
+		var op *compute.Operation
+		if own {
+			op, err = updateAliases(ctx, r.operation, r.computeService, r.projectID, zone, c.NodeName, nic, without)
+		} else {
+			op, err = updateNICAliases(ctx, r.operation, r.computeService, r.projectID, zone, c.NodeName, nic, instanceNIC, without)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update network interface: %w", err)
+		}
+		if err := zoneOperations(r.computeService, r.projectID, zone).wait(ctx, op.Name, r.pluginConfig.Timeouts.Operation.Duration); err != nil {
+			return fmt.Errorf("failed to wait for network interface update operation: %w", err)
+		}
+		if len(stillHeld(left, []string{c.IP}, rangeName)) > 0 {
+			return fmt.Errorf("alias of IP %s cannot be split within the alias range limit of instance %s", c.IP, c.NodeName)
+		}
+	}
+
+	if r.pluginConfig.Enabled(config.FeatureRouteFallback) {
+		return detachRoute(ctx, r.operation, r.host, r.projectID, zone, c.NodeName, c.IP, r.pluginConfig.Timeouts.Operation.Duration)
+	}
+	return nil
+}
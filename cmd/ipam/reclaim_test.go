@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestReclaimSkipsMigratingIPs(t *testing.T) {
+	newAddEnv(t)
+	ctx := context.Background()
+	old := metav1.NewTime(time.Now().Add(-time.Hour))
+
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: benchPool},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:                "10.8.0.0/24",
+			ReclaimOnExhaustion: true,
+			Allocations: map[string]v1alpha1.IPAllocation{
+				// Moving to the target pod web, which has the name of its source
+				"10.8.0.5": {PodName: "web", PodNamespace: "default", PodUID: "source-uid", NodeName: benchInstance, AllocatedAt: old},
+				"10.8.0.6": {PodName: "job", PodNamespace: "default", PodUID: "job-uid", NodeName: benchInstance, AllocatedAt: old},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			ipam.IPPoolGVR:         "IPPoolList",
+			ipam.PodIPMigrationGVR: "PodIPMigrationList",
+		}, &unstructured.Unstructured{Object: obj})
+	allocator := ipam.NewAllocator(dynamicClient)
+	if _, err := allocator.CreateMigration(ctx, &v1alpha1.PodIPMigration{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", CreationTimestamp: metav1.Now()},
+		Spec:       v1alpha1.PodIPMigrationSpec{IP: "10.8.0.5", SourcePod: "web", SourceNode: benchInstance},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allocator.ClaimMigration(ctx, "default", "web", "target-uid", "node-2", benchPool); err != nil {
+		t.Fatal(err)
+	}
+
+	var updates atomic.Int32
+	gce := httptest.NewServer(fakeGCE(t, &updates))
+	t.Cleanup(gce.Close)
+	computeService, err := compute.NewService(ctx, option.WithEndpoint(gce.URL+"/compute/v1/"), option.WithHTTPClient(gce.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &reclaimer{
+		operation:    "ADD",
+		args:         &skel.CmdArgs{ContainerID: "container", IfName: "eth0"},
+		conf:         &PluginConf{},
+		pluginConfig: config.Default(),
+		clients: &apiClients{
+			kube: kubefake.NewSimpleClientset(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "target-uid"},
+			}),
+			dynamic: dynamicClient,
+		},
+		allocator:      allocator,
+		computeService: computeService,
+		projectID:      benchProject,
+		zone:           benchZone,
+		instanceName:   benchInstance,
+	}
+	if reclaimed := r.reclaim(ctx, benchPool); reclaimed != 1 {
+		t.Errorf("reclaim() = %d, want only the IP of the deleted pod", reclaimed)
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := pools[0].Spec.Allocations["10.8.0.5"]; !ok || a.PodUID != "source-uid" {
+		t.Errorf("allocation of the migrating IP = %+v, %v, want kept for the migration", a, ok)
+	}
+	if _, ok := pools[0].Spec.Allocations["10.8.0.6"]; ok {
+		t.Error("IP of the deleted pod not reclaimed")
+	}
+}
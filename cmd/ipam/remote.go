@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// allocateIP allocates the IP of the pod through the allocation API of the
+// provisioner when enabled, so the node does not read and write the whole
+// IPPool. While the allocation API is not served or unavailable the pod is
+// allocated from the IPPool directly, as without it.
+func allocateIP(ctx context.Context, operation string, pluginConfig *config.Config, clients *apiClients, allocator *ipam.Allocator, req *ipam.AllocationRequest) (*ipam.AllocationResult, error) {
+	if !pluginConfig.Enabled(config.FeatureAllocationAPI) || pluginConfig.Freeze.Enabled {
+		return allocator.Allocate(ctx, req)
+	}
+	client := clients.kube.Discovery().RESTClient()
+	if client == nil {
+		return allocator.Allocate(ctx, req)
+	}
+
+	result, err := ipam.AllocateRemote(ctx, client, req)
+	if apiUnavailable(err) || apierrors.IsNotFound(err) {
+		allocatorLog.Infof("[%s] Allocation API unavailable, allocating from pool %s directly: %v", operation, req.PoolName, err)
+		telemetry.Retry(ctx, "allocation-api")
+		return allocator.Allocate(ctx, req)
+	}
+	return result, err
+}
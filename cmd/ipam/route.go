@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// aliasRangesFull reports whether nic cannot take another alias IP range
+func aliasRangesFull(nic *compute.NetworkInterface) bool {
+	return len(nic.AliasIpRanges) >= ipam.MaxAliasRanges
+}
+
+// aliasLimitReason is the googleapi error reason GCE refuses an alias update
+// with when the interface is out of alias IP ranges
+const aliasLimitReason = "limitExceeded"
+
+// isAliasLimitError reports whether GCE refused an alias update because the
+// interface is out of alias IP ranges
+func isAliasLimitError(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code != http.StatusBadRequest {
+		return false
+	}
+	return lo.ContainsBy(gerr.Errors, func(item googleapi.ErrorItem) bool {
+		return item.Reason == aliasLimitReason
+	})
+}
+
+func instancePath(projectID, zone, instanceName string) string {
+	return fmt.Sprintf("projects/%s/zones/%s/instances/%s", projectID, zone, instanceName)
+}
+
+// attachRoute programs a VPC route in the host project for ip with this
+// instance as next hop, in place of an alias IP range. A route left behind for
+// another instance, by a migration or a reclaimed lease, is replaced.
+func attachRoute(ctx context.Context, operation string, host *hostProject, projectID, zone, instanceName, network, ip string, timeout time.Duration) error {
+	name := ipam.RouteName(ip)
+	nextHop := instancePath(projectID, zone, instanceName)
+
+	existing, err := host.service.Routes.Get(host.id, name).Context(ctx).Do()
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to get route %s: %w", name, err)
+	}
+	if err == nil {
+		if strings.HasSuffix(existing.NextHopInstance, nextHop) {
+			gceLog.Infof("[%s] Route %s for IP %s already points at instance %s", operation, name, ip, instanceName)
+			return nil
+		}
+		gceLog.Infof("[%s] Replacing route %s for IP %s pointing at %s", operation, name, ip, existing.NextHopInstance)
+		if err := deleteRoute(ctx, host, name, timeout); err != nil {
+			return err
+		}
+	}
+
+	startTime := time.Now()
+	op, err := host.service.Routes.Insert(host.id, &compute.Route{
+		Name:            name,
+		Network:         network,
+		DestRange:       ipam.HostPrefix(ip),
+		NextHopInstance: nextHop,
+		Description:     "gcp-cni pod IP on a node out of alias IP ranges",
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to insert route %s: %w", name, err)
+	}
+	if err := globalOperations(host.service, host.id).wait(ctx, op.Name, timeout); err != nil {
+		return fmt.Errorf("failed to wait for route insert operation: %w", err)
+	}
+	gceLog.Infof("[%s][Cloud Operation] Route %s for IP %s took %v", operation, name, ip, time.Since(startTime))
+	return nil
+}
+
+// detachRoute removes the VPC route of ip if it still points at this
+// instance, the IP may have moved to another node meanwhile
+func detachRoute(ctx context.Context, operation string, host *hostProject, projectID, zone, instanceName, ip string, timeout time.Duration) error {
+	name := ipam.RouteName(ip)
+	existing, err := host.service.Routes.Get(host.id, name).Context(ctx).Do()
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get route %s: %w", name, err)
+	}
+	if !strings.HasSuffix(existing.NextHopInstance, instancePath(projectID, zone, instanceName)) {
+		gceLog.Infof("[%s] Route %s for IP %s points at %s, leaving it alone", operation, name, ip, existing.NextHopInstance)
+		return nil
+	}
+
+	gceLog.Infof("[%s] Removing route %s for IP %s", operation, name, ip)
+	return deleteRoute(ctx, host, name, timeout)
+}
+
+func deleteRoute(ctx context.Context, host *hostProject, name string, timeout time.Duration) error {
+	op, err := host.service.Routes.Delete(host.id, name).Context(ctx).Do()
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete route %s: %w", name, err)
+	}
+	if err := globalOperations(host.service, host.id).wait(ctx, op.Name, timeout); err != nil {
+		return fmt.Errorf("failed to wait for route delete operation: %w", err)
+	}
+	return nil
+}
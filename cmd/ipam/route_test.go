@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsAliasLimitError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "alias limit",
+			err: &googleapi.Error{Code: http.StatusBadRequest, Message: "Exceeded limit of alias IP ranges",
+				Errors: []googleapi.ErrorItem{{Reason: "limitExceeded"}}},
+			want: true,
+		},
+		{
+			name: "wrapped",
+			err: fmt.Errorf("failed to update network interface: %w", &googleapi.Error{Code: http.StatusBadRequest,
+				Errors: []googleapi.ErrorItem{{Reason: "limitExceeded"}}}),
+			want: true,
+		},
+		{
+			// The message alone is not relied on, it changes and is localized
+			name: "message only",
+			err: &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid alias IP range, exceeds the subnetwork limit",
+				Errors: []googleapi.ErrorItem{{Reason: "invalid"}}},
+		},
+		{
+			name: "project quota",
+			err: &googleapi.Error{Code: http.StatusForbidden,
+				Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}},
+		},
+		{
+			name: "not a GCE error",
+			err:  errors.New("alias IP range limit exceeded"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAliasLimitError(tt.err); got != tt.want {
+				t.Errorf("isAliasLimitError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
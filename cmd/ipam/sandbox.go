@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// parseCNIArgs parses CNI_ARGS into its keys and values. Runtimes differ in
+// the details: containerd with sandboxed runtime classes such as gVisor or
+// Kata passes a trailing separator and padded pairs, which are ignored here.
+func parseCNIArgs(args string) map[string]string {
+	parsed := map[string]string{}
+	for _, pair := range strings.Split(args, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if key = strings.TrimSpace(key); key != "" {
+			parsed[key] = strings.TrimSpace(value)
+		}
+	}
+	return parsed
+}
+
+// recordedNetns returns the network namespace path recorded for the
+// attachment. Sandboxed runtimes may hand over the namespace of the sandbox
+// process as /proc/<pid>/ns/net, which tells nothing once the process is gone
+// and may name another process after a reboot, so it is not recorded and the
+// sandbox is judged by its pod instead.
+func recordedNetns(netns string) string {
+	if netns == "" {
+		return ""
+	}
+	netns = filepath.Clean(netns)
+	if strings.HasPrefix(netns, "/proc/") {
+		return ""
+	}
+	return netns
+}
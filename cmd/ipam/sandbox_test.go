@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestParseCNIArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		want map[string]string
+	}{
+		{
+			args: "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod;K8S_POD_INFRA_CONTAINER_ID=abc;K8S_POD_UID=pod-uid",
+			want: map[string]string{"IgnoreUnknown": "1", "K8S_POD_NAMESPACE": "default", "K8S_POD_NAME": "pod", "K8S_POD_INFRA_CONTAINER_ID": "abc", "K8S_POD_UID": "pod-uid"},
+		},
+		{
+			args: " K8S_POD_NAMESPACE=default ; K8S_POD_NAME = pod;;IgnoreUnknown;",
+			want: map[string]string{"K8S_POD_NAMESPACE": "default", "K8S_POD_NAME": "pod", "IgnoreUnknown": ""},
+		},
+		{args: "", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := parseCNIArgs(tt.args); !maps.Equal(got, tt.want) {
+			t.Errorf("parseCNIArgs(%q) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRecordedNetns(t *testing.T) {
+	for netns, want := range map[string]string{
+		"":                         "",
+		"/var/run/netns/cni-1234":  "/var/run/netns/cni-1234",
+		"/run/netns//cni-1234/":    "/run/netns/cni-1234",
+		"/proc/4711/ns/net":        "",
+		"/proc/4711/task/1/ns/net": "",
+	} {
+		if got := recordedNetns(netns); got != want {
+			t.Errorf("recordedNetns(%q) = %q, want %q", netns, got, want)
+		}
+	}
+}
+
+func TestAddSandboxedRuntime(t *testing.T) {
+	env := newAddEnv(t)
+
+	// gVisor hands over the namespace of the sandbox process and repeats the
+	// ADD of the pause sandbox
+	args := &skel.CmdArgs{
+		ContainerID: "sandbox",
+		Netns:       "/proc/4711/ns/net",
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1; K8S_POD_NAMESPACE=default; K8S_POD_NAME=pod; K8S_POD_UID=pod-uid;",
+		StdinData:   env.stdin,
+	}
+	for range 2 {
+		if err := cmdAdd(args); err != nil {
+			t.Fatalf("ADD failed: %v", err)
+		}
+	}
+
+	allocator := ipam.NewAllocator(env.dynamic)
+	got, err := allocator.ListPools(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got[0].Spec.Allocations); n != 1+len(systemAllocations(got[0])) {
+		t.Fatalf("pool holds %d allocations, want the pod's only besides system ones", n)
+	}
+
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment, err := db.Get("sandbox", "eth0")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.Netns != "" {
+		t.Errorf("recorded netns = %q, want none for a sandbox process namespace", attachment.Netns)
+	}
+
+	// The namespace is gone by the time the runtime deletes the sandbox
+	args.Netns = ""
+	if err := cmdDel(args); err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	if got, err = allocator.ListPools(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got[0].Spec.Allocations[attachment.IP]; ok {
+		t.Errorf("IP %s still allocated after DEL without netns", attachment.IP)
+	}
+
+	// A stale ADD of a deleted pod of the same name allocates nothing
+	args.ContainerID, args.Netns = "stale", "/var/run/netns/stale"
+	args.Args = "K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod;K8S_POD_UID=old-uid"
+	if err := cmdAdd(args); err == nil {
+		t.Error("ADD of a sandbox of another pod UID succeeded")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/compute/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/validation"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const selfTestTimeout = 30 * time.Second
+
+// selfTestCheck is the outcome of a single self-test step
+type selfTestCheck struct {
+	name   string
+	err    error
+	detail string
+}
+
+// runSelfTest checks everything the plugin needs at runtime on this node and
+// prints a pass/fail report. It returns an error if any check failed.
+func runSelfTest(args []string, out io.Writer) error {
+	identityOverrides = identity.FromEnv()
+	if cfg, err := config.Load(config.DefaultPath); err == nil {
+		kubeletKubeconfig = cfg.Kubeconfig()
+		identityOverrides = cfg.Identity.Merge(identityOverrides)
+	}
+
+	flags := pflag.NewFlagSet("self-test", pflag.ContinueOnError)
+	kubeconfig := flags.String("kubeconfig", kubeletKubeconfig, "Kubeconfig used to reach the Kubernetes API")
+	poolName := flags.String("pool", "", "IPPool to check, defaults to the pool of the node subnetwork")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	var checks []selfTestCheck
+	record := func(name, detail string, err error) bool {
+		checks = append(checks, selfTestCheck{name: name, detail: detail, err: err})
+		return err == nil
+	}
+
+	metadataOK := record(selfTestMetadata(ctx))
+	tokenOK := record(selfTestToken(ctx))
+
+	clients, err := buildClients(*kubeconfig)
+	kubeOK := record("kubernetes client", *kubeconfig, err)
+	if kubeOK {
+		record(selfTestRBAC(ctx, clients.kube))
+	}
+
+	if *poolName == "" && metadataOK && tokenOK {
+		subnetwork, err := selfTestSubnetwork(ctx)
+		if record("compute instance", subnetwork, err) {
+			cfg, err := config.Load(config.DefaultPath)
+			if err != nil {
+				cfg = config.Default()
+			}
+			*poolName = cfg.DefaultPoolName(subnetwork)
+		}
+	}
+
+	if kubeOK && *poolName != "" {
+		record(selfTestPool(ctx, clients.dynamic, *poolName))
+	}
+	if kubeOK {
+		record(selfTestConfiguration(ctx, clients.dynamic))
+	}
+
+	failed := 0
+	for _, c := range checks {
+		status := "PASS"
+		detail := c.detail
+		if c.err != nil {
+			status = "FAIL"
+			detail = c.err.Error()
+			failed++
+		}
+		fmt.Fprintf(out, "%-4s  %-20s  %s\n", status, c.name, detail)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d self-test checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+func selfTestMetadata(ctx context.Context) (string, string, error) {
+	const name = "metadata server"
+	if identityOverrides.Complete() {
+		return name, fmt.Sprintf("skipped, identity overridden: project=%s zone=%s instance=%s",
+			identityOverrides.Project, identityOverrides.Zone, identityOverrides.Instance), nil
+	}
+	if !metadata.OnGCEWithContext(ctx) {
+		return name, "", fmt.Errorf("metadata server is not reachable")
+	}
+	projectID, err := identityOverrides.ProjectID(ctx)
+	if err != nil {
+		return name, "", fmt.Errorf("failed to get project ID: %w", err)
+	}
+	zone, err := identityOverrides.ZoneName(ctx)
+	if err != nil {
+		return name, "", fmt.Errorf("failed to get zone: %w", err)
+	}
+	instanceName, err := identityOverrides.InstanceName(ctx)
+	if err != nil {
+		return name, "", fmt.Errorf("failed to get instance name: %w", err)
+	}
+	return name, fmt.Sprintf("project=%s zone=%s instance=%s", projectID, zone, instanceName), nil
+}
+
+func selfTestToken(ctx context.Context) (string, string, error) {
+	const name = "token acquisition"
+	creds, err := google.FindDefaultCredentials(ctx, compute.CloudPlatformScope)
+	if err != nil {
+		return name, "", fmt.Errorf("failed to find default credentials: %w", err)
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return name, "", fmt.Errorf("failed to acquire token: %w", err)
+	}
+	return name, fmt.Sprintf("expires %s", token.Expiry.Format(time.RFC3339)), nil
+}
+
+func selfTestSubnetwork(ctx context.Context) (string, error) {
+	client, err := google.DefaultClient(ctx, compute.CloudPlatformScope)
+	if err != nil {
+		return "", fmt.Errorf("failed to create google default client: %w", err)
+	}
+	computeService, projectID, zone, _, instanceName, err := getInstanceInfo(client)
+	if err != nil {
+		return "", err
+	}
+	instance, err := computeService.Instances.Get(projectID, zone, instanceName).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get instance details: %w", err)
+	}
+	if cfg, err := config.Load(config.DefaultPath); err == nil {
+		podSubnetwork = cfg.NetworkInterface.Subnetwork
+	}
+	nic, err := podInterface(instance)
+	if err != nil {
+		return "", err
+	}
+	return ipam.SubnetworkName(nic.Subnetwork), nil
+}
+
+func selfTestRBAC(ctx context.Context, k8sclient kubernetes.Interface) (string, string, error) {
+	const name = "rbac"
+	required := []authorizationv1.ResourceAttributes{
+		{Verb: "get", Resource: "pods"},
+		{Verb: "get", Group: ipam.IPPoolGVR.Group, Resource: ipam.IPPoolGVR.Resource},
+		{Verb: "update", Group: ipam.IPPoolGVR.Group, Resource: ipam.IPPoolGVR.Resource},
+		{Verb: "list", Group: ipam.IPPoolGVR.Group, Resource: ipam.IPPoolGVR.Resource},
+	}
+
+	var denied []string
+	for _, attrs := range required {
+		review, err := k8sclient.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attrs},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return name, "", fmt.Errorf("failed to review access: %w", err)
+		}
+		if !review.Status.Allowed {
+			denied = append(denied, fmt.Sprintf("%s %s", attrs.Verb, attrs.Resource))
+		}
+	}
+
+	if len(denied) > 0 {
+		return name, "", fmt.Errorf("access denied: %s", strings.Join(denied, ", "))
+	}
+	return name, fmt.Sprintf("%d permissions granted", len(required)), nil
+}
+
+func selfTestPool(ctx context.Context, dynamicClient dynamic.Interface, poolName string) (string, string, error) {
+	const name = "ippool"
+	pool, err := dynamicClient.Resource(ipam.IPPoolGVR).Get(ctx, poolName, metav1.GetOptions{})
+	if err != nil {
+		return name, "", fmt.Errorf("failed to read IPPool %s: %w", poolName, err)
+	}
+	return name, fmt.Sprintf("%s resourceVersion=%s", pool.GetName(), pool.GetResourceVersion()), nil
+}
+
+// selfTestConfiguration checks the plugin configuration against the IPPools
+// of the cluster, warnings pass
+func selfTestConfiguration(ctx context.Context, dynamicClient dynamic.Interface) (string, string, error) {
+	const name = "configuration"
+	cfg, err := config.Load(config.DefaultPath)
+	if err != nil {
+		return name, "", err
+	}
+	pools, err := ipam.NewAllocator(dynamicClient).ListPools(ctx)
+	if err != nil {
+		return name, "", err
+	}
+	findings := validation.Validate(validation.Stack{PluginConfig: cfg, Pools: pools})
+	var errs []string
+	for _, f := range findings {
+		if f.Severity == validation.SeverityError {
+			errs = append(errs, f.Source+": "+f.Message)
+		}
+	}
+	if len(errs) > 0 {
+		return name, "", fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return name, fmt.Sprintf("%d pools, %d warnings", len(pools), len(findings)), nil
+}
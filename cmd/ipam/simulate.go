@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/spf13/pflag"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/quota"
+	"github.com/castai/gcp-cni/internal/subnetpool"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// simulateStep is one decision of a simulated ADD
+type simulateStep struct {
+	name   string
+	detail string
+}
+
+// runSimulate runs the decisions of an ADD for a pod against the live state
+// of the cluster and GCE without changing either, and prints them followed by
+// the result ADD would return. Warm IPs of the node and retries of a sandbox
+// are not simulated, and the instance cache of the node is left alone.
+func runSimulate(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("simulate", pflag.ContinueOnError)
+	pod := flags.String("pod", "", "Pod to simulate the ADD of, as namespace/name")
+	netConf := flags.String("net-conf", "", "CNI network configuration or conflist delegating to gcp-ipam, empty uses none")
+	pluginConfigPath := flags.String("plugin-config", "", "Plugin configuration, defaults to the configPath of the network configuration")
+	kubeconfig := flags.String("kubeconfig", "", "Kubeconfig used to reach the Kubernetes API, defaults to the one of the plugin configuration")
+	project := flags.String("project", "", "Project of the node instance, overrides the metadata server")
+	zone := flags.String("zone", "", "Zone of the node instance, overrides the metadata server")
+	instance := flags.String("instance", "", "Node instance to simulate the ADD on, overrides the metadata server")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	namespace, name, ok := strings.Cut(*pod, "/")
+	if !ok || namespace == "" || name == "" {
+		return fmt.Errorf("--pod namespace/name is required")
+	}
+
+	conf := &PluginConf{}
+	conf.CNIVersion = "1.0.0"
+	if *netConf != "" {
+		data, err := os.ReadFile(*netConf)
+		if err != nil {
+			return fmt.Errorf("failed to read network configuration: %w", err)
+		}
+		if conf, err = delegatingConf(data); err != nil {
+			return err
+		}
+	}
+	if *pluginConfigPath != "" {
+		conf.IPAM.ConfigPath = *pluginConfigPath
+	}
+	pluginConfig, err := loadPluginConfig(conf)
+	if err != nil {
+		return err
+	}
+	podSubnetwork = pluginConfig.NetworkInterface.Subnetwork
+	clusterID, clusterRanges = pluginConfig.ClusterID, pluginConfig.RangeNames(conf.SecondaryRangeName)
+	kubeletKubeconfig = pluginConfig.Kubeconfig()
+	if *kubeconfig != "" {
+		kubeletKubeconfig = *kubeconfig
+	}
+	identityOverrides = pluginConfig.Identity.Merge(identity.FromEnv()).Merge(identity.Overrides{
+		Project:  *project,
+		Zone:     *zone,
+		Instance: *instance,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginConfig.Timeouts.Add.Duration)
+	defer cancel()
+
+	var steps []simulateStep
+	step := func(name, format string, a ...any) {
+		steps = append(steps, simulateStep{name: name, detail: fmt.Sprintf(format, a...)})
+	}
+	defer func() {
+		for _, s := range steps {
+			fmt.Fprintf(out, "%-10s  %s\n", s.name, s.detail)
+		}
+	}()
+
+	result, err := simulateAdd(ctx, conf, pluginConfig, namespace, name, step)
+	if err != nil {
+		step("error", "ADD would fail: %v", err)
+		return fmt.Errorf("simulated ADD failed")
+	}
+	versioned, err := result.GetAsVersion(conf.CNIVersion)
+	if err != nil {
+		return fmt.Errorf("failed to convert result to CNI version %s: %w", conf.CNIVersion, err)
+	}
+	data, err := json.MarshalIndent(versioned, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+	step("result", "%s", data)
+	return nil
+}
+
+// simulateAdd follows cmdAdd up to the result, reading instead of changing
+func simulateAdd(ctx context.Context, conf *PluginConf, pluginConfig *config.Config, namespace, name string, step func(name, format string, a ...any)) (types.Result, error) {
+	clients, err := newClients(kubeletKubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build k8s clients: %w", err)
+	}
+	allocator := ipam.NewAllocator(clients.dynamic)
+	if pluginConfig.Freeze.Enabled {
+		allocator.Freeze(pluginConfig.Freeze.Reason)
+	}
+
+	p, err := clients.kube.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %w", namespace, name, err)
+	}
+	critical := pluginConfig.CriticalPods.Match(p.Namespace, p.Spec.PriorityClassName)
+	step("pod", "%s/%s uid=%s critical=%t", p.Namespace, p.Name, p.UID, critical)
+
+	var reqIP string
+	migration, err := allocator.GetMigration(ctx, p.Namespace, p.Name)
+	switch {
+	case err == nil:
+		reqIP = ipam.CanonicalIP(migration.Spec.IP)
+		step("migration", "PodIPMigration takes over IP %s from %s, phase %s", reqIP, migration.Spec.SourceNode, migration.Status.Phase)
+	case !apierrors.IsNotFound(err):
+		return nil, fmt.Errorf("failed to get PodIPMigration of pod %s/%s: %w", p.Namespace, p.Name, err)
+	case p.Annotations[ipam.LiveIPAnnotation] != "":
+		reqIP = ipam.CanonicalIP(p.Annotations[ipam.LiveIPAnnotation])
+		step("migration", "would create a PodIPMigration taking over IP %s from %s", reqIP, p.Annotations[ipam.OriginalInstanceAnnotation])
+	}
+	isMigrationFlow := reqIP != ""
+
+	client, err := newGoogleClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create google default client: %w", err)
+	}
+	// Neither read from nor written to the instance cache: the flags may name
+	// any instance, in part or in full
+	computeService, err := newComputeService(client)
+	if err != nil {
+		return nil, err
+	}
+	projectID, zone, region, instanceName, err := lookupInstance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	host, err := newHostProject(ctx, computeService, quota.NewCounter(), projectID, pluginConfig.SharedVPC)
+	if err != nil {
+		return nil, err
+	}
+	// The cache of this node may be of another instance
+	nic, err := instanceNIC(ctx, "SIMULATE", computeService, projectID, zone, instanceName)
+	if err != nil {
+		return nil, err
+	}
+	subnetwork := ipam.SubnetworkName(nic.Subnetwork)
+	subnet, err := host.service.Subnetworks.Get(host.id, region, subnetwork).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subnetwork details: %w", err)
+	}
+	step("instance", "%s/%s/%s interface %s in subnetwork %s (%s), %d alias IP ranges",
+		projectID, zone, instanceName, nic.Name, subnetwork, subnet.IpCidrRange, len(nic.AliasIpRanges))
+
+	poolName, err := resolvePodPoolName(ctx, allocator, conf, pluginConfig, subnetwork, p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve IPPool: %w", err)
+	}
+	exists, err := allocator.PoolExists(ctx, poolName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists && pluginConfig.MissingPool.Action == config.MissingPoolCreate {
+		pool, err := subnetpool.Build(ctx, host.service, host.id, region, subnetwork, resolveAliasRange(conf, pluginConfig, ""), poolName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create missing IPPool %s: %w", poolName, err)
+		}
+		step("pool", "would create missing IPPool %s with CIDR %s from secondary range %s", poolName, pool.Spec.CIDR, pool.Spec.SecondaryRangeName)
+		return nil, fmt.Errorf("IPPool %s does not exist yet, the IP it would hand out depends on the pool ADD creates", poolName)
+	}
+	resolved, err := resolveMissingPool(ctx, "SIMULATE", allocator, pluginConfig, poolName, subnetwork, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resolved != poolName {
+		step("pool", "IPPool %s does not exist, falling back to %s", poolName, resolved)
+	} else {
+		step("pool", "IPPool %s", poolName)
+	}
+	poolName = resolved
+
+	var allocation *ipam.AllocationResult
+	if isMigrationFlow {
+		if allocation, err = allocator.GetAllocation(ctx, poolName, reqIP); err != nil {
+			return nil, fmt.Errorf("failed to get allocation for IP %s from pool %s: %w", reqIP, poolName, err)
+		}
+		step("allocate", "keeps migrated IP %s of secondary range %s", allocation.IP, allocation.SecondaryRangeName)
+	} else {
+		allocation, err = allocator.PreviewAllocation(ctx, &ipam.AllocationRequest{
+			PoolName:     poolName,
+			PodName:      p.Name,
+			PodNamespace: p.Namespace,
+			PodUID:       string(p.UID),
+			NodeName:     instanceName,
+			RangeName:    p.Annotations[ipam.SecondaryRangeAnnotation],
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate IP from pool %s: %w", poolName, err)
+		}
+		if allocation.Existing {
+			step("allocate", "reuses IP %s the pod holds on the node, secondary range %s", allocation.IP, allocation.SecondaryRangeName)
+		} else {
+			step("allocate", "would allocate IP %s of secondary range %s (CIDR %s)", allocation.IP, allocation.SecondaryRangeName, allocation.CIDR)
+		}
+	}
+
+	rangeName := resolveAliasRange(conf, pluginConfig, allocation.SecondaryRangeName)
+	if !pluginConfig.InClusterRange(rangeName, conf.SecondaryRangeName) {
+		return nil, fmt.Errorf("IPPool %s attaches from secondary range %s, which is not a range of cluster %s", poolName, rangeName, pluginConfig.ClusterID)
+	}
+	aliasCIDR := ipam.HostPrefix(allocation.IP)
+	attached, err := ownedAliasAttached(nic.AliasIpRanges, allocation.IP, rangeName)
+	if err != nil {
+		return nil, err
+	}
+	routeFallback := pluginConfig.Enabled(config.FeatureRouteFallback)
+	switch {
+	case attached:
+		step("attach", "alias %s of range %s is attached already", aliasCIDR, rangeName)
+	case !isMigrationFlow && pluginConfig.Enabled(config.FeatureAsyncAttach) && hasAliasAttachedGate(p) && !(routeFallback && aliasRangesFull(nic)):
+		step("attach", "would return before attaching alias %s of range %s, the installer attaches it", aliasCIDR, rangeName)
+	case routeFallback && aliasRangesFull(nic):
+		step("attach", "interface is out of alias IP ranges, would route %s to the instance", allocation.IP)
+	default:
+		step("attach", "would attach alias %s of range %s", aliasCIDR, rangeName)
+	}
+	if !attached && pluginConfig.Enabled(config.FeatureConflictDetection) {
+		step("conflicts", "would check that no other host uses %s first", allocation.IP)
+	}
+	for _, hook := range pluginConfig.Hooks {
+		if hook.Subscribed(config.HookAfterAttach) {
+			step("hook", "would run %s after the attach, failure policy %q", hook.Name, hook.FailurePolicy)
+		}
+	}
+
+	return addResult(allocation.IP, subnet.IpCidrRange, allocation.CIDR)
+}
+
+// delegatingConf returns the network configuration of the plugin delegating
+// to gcp-ipam as the runtime passes it: a .conf as is, from a conflist the
+// plugin with the gcp-ipam ipam section with the name and version of the list
+func delegatingConf(data []byte) (*PluginConf, error) {
+	var list struct {
+		CNIVersion string            `json:"cniVersion"`
+		Name       string            `json:"name"`
+		Plugins    []json.RawMessage `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %w", err)
+	}
+	if list.Plugins == nil {
+		return parseConfig(data)
+	}
+	for _, plugin := range list.Plugins {
+		conf, err := parseConfig(plugin)
+		if err != nil {
+			return nil, err
+		}
+		if conf.IPAM.Type == "gcp-ipam" {
+			conf.CNIVersion, conf.Name = list.CNIVersion, list.Name
+			return conf, nil
+		}
+	}
+	return nil, fmt.Errorf("no plugin of the conflist delegates IPAM to gcp-ipam")
+}
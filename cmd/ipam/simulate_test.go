@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/internal/instance"
+)
+
+func TestDelegatingConf(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		wantName   string
+		wantConfig string
+		wantErr    bool
+	}{
+		{
+			name:       "conf",
+			data:       `{"cniVersion":"0.4.0","name":"gcp","type":"ptp","ipam":{"type":"gcp-ipam","configPath":"/etc/a.yaml"}}`,
+			wantName:   "gcp",
+			wantConfig: "/etc/a.yaml",
+		},
+		{
+			name: "conflist",
+			data: `{"cniVersion":"1.0.0","name":"gcp","plugins":[
+				{"type":"ptp","ipam":{"type":"gcp-ipam","configPath":"/etc/b.yaml"}},
+				{"type":"portmap"}]}`,
+			wantName:   "gcp",
+			wantConfig: "/etc/b.yaml",
+		},
+		{
+			name:    "conflist without gcp-ipam",
+			data:    `{"cniVersion":"1.0.0","name":"gcp","plugins":[{"type":"ptp","ipam":{"type":"host-local"}}]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := delegatingConf([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("delegatingConf() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("delegatingConf() error = %v", err)
+			}
+			if conf.Name != tt.wantName || conf.IPAM.ConfigPath != tt.wantConfig || conf.CNIVersion == "" {
+				t.Errorf("delegatingConf() = %s %s %s, want %s %s", conf.CNIVersion, conf.Name, conf.IPAM.ConfigPath, tt.wantName, tt.wantConfig)
+			}
+		})
+	}
+}
+
+func TestSimulateBypassesInstanceCache(t *testing.T) {
+	env := newAddEnv(t)
+
+	// The zone comes from the metadata server, the instance from the flag
+	var netConf PluginConf
+	if err := json.Unmarshal(env.stdin, &netConf); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(netConf.IPAM.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Identity = identity.Overrides{Project: benchProject, ComputeEndpoint: cfg.Identity.ComputeEndpoint}
+	data, err := cfg.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(netConf.IPAM.ConfigPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	metadataServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computeMetadata/v1/instance/zone" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		w.Write([]byte("projects/1/zones/" + benchZone))
+	}))
+	defer metadataServer.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadataServer.URL, "http://"))
+
+	// The cache of the node names another instance
+	cached := &instance.Cache{ProjectID: "other", Zone: "us-east1-b", Region: "us-east1", InstanceName: "cached"}
+	if err := cached.Save(nodePaths.instanceCache); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(nodePaths.instanceCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	netConfPath := filepath.Join(t.TempDir(), "net.conf")
+	if err := os.WriteFile(netConfPath, env.stdin, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := runSimulate([]string{"--pod", "default/pod", "--net-conf", netConfPath, "--instance", benchInstance}, &out); err != nil {
+		t.Fatalf("simulate failed: %v\n%s", err, out.String())
+	}
+	if want := benchProject + "/" + benchZone + "/" + benchInstance; !strings.Contains(out.String(), want) {
+		t.Errorf("simulate output does not name instance %s:\n%s", want, out.String())
+	}
+	after, err := os.ReadFile(nodePaths.instanceCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("simulate changed the instance cache to %s", after)
+	}
+}
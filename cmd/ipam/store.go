@@ -0,0 +1,141 @@
+package main
+
+import (
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"github.com/castai/gcp-cni/internal/store"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// attachmentRetention is how long released attachments stay in the node-local
+// database for debugging
+const attachmentRetention = 24 * time.Hour
+
+// recordAttachment updates the node-local allocation database entry of the
+// container interface. The database is bookkeeping only, so failures are
+// logged and never fail the CNI operation.
+func recordAttachment(operation string, args *skel.CmdArgs, fn func(a *store.Attachment)) {
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		cniLog.Errorf("[%s] Failed to open allocation database: %v", operation, err)
+		return
+	}
+	defer db.Close()
+
+	if err := db.Update(args.ContainerID, args.IfName, fn); err != nil {
+		cniLog.Errorf("[%s] Failed to record attachment of %s/%s: %v", operation, args.ContainerID, args.IfName, err)
+	}
+}
+
+// setAttachmentState is recordAttachment for plain state changes
+func setAttachmentState(operation string, args *skel.CmdArgs, state store.State, err error) {
+	recordAttachment(operation, args, func(a *store.Attachment) {
+		a.State = state
+		a.Error = ""
+		if err != nil {
+			a.Error = err.Error()
+		}
+	})
+}
+
+// lookupAttachment returns the recorded attachment of the container interface, or nil
+func lookupAttachment(operation string, args *skel.CmdArgs) *store.Attachment {
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		cniLog.Errorf("[%s] Failed to open allocation database: %v", operation, err)
+		return nil
+	}
+	defer db.Close()
+
+	attachment, err := db.Get(args.ContainerID, args.IfName)
+	if err != nil {
+		cniLog.Errorf("[%s] Failed to look up attachment of %s/%s: %v", operation, args.ContainerID, args.IfName, err)
+		return nil
+	}
+	return attachment
+}
+
+// supersedeAttachments marks the live attachments of other containers holding
+// ip released, once a recreated sandbox of the pod took the IP over. A late
+// DEL of the previous sandbox then leaves the IP alone.
+func supersedeAttachments(operation string, args *skel.CmdArgs, ip string) {
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		cniLog.Errorf("[%s] Failed to open allocation database: %v", operation, err)
+		return
+	}
+	defer db.Close()
+
+	attachments, err := db.List()
+	if err != nil {
+		cniLog.Errorf("[%s] Failed to list attachments: %v", operation, err)
+		return
+	}
+	for _, a := range attachments {
+		if a.ContainerID == args.ContainerID || ipam.CanonicalIP(a.IP) != ipam.CanonicalIP(ip) ||
+			(a.State != store.StateAllocated && a.State != store.StateAttached) {
+			continue
+		}
+		if err := db.SetState(a.ContainerID, a.IfName, store.StateReleased, nil); err != nil {
+			cniLog.Errorf("[%s] Failed to supersede attachment of %s/%s: %v", operation, a.ContainerID, a.IfName, err)
+			continue
+		}
+		cniLog.Infof("[%s] IP %s of container %s taken over by container %s", operation, ip, a.ContainerID, args.ContainerID)
+	}
+}
+
+// ipHeldByOtherSandbox returns the container interface another live
+// attachment of the node holds ip for, or nil. A recreated sandbox of a pod
+// reuses its IP, the DEL of the previous one must leave it alone, as must the
+// DEL of another interface of the pod.
+func ipHeldByOtherSandbox(operation string, args *skel.CmdArgs, ip string) *store.Attachment {
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		cniLog.Errorf("[%s] Failed to open allocation database: %v", operation, err)
+		return nil
+	}
+	defer db.Close()
+
+	attachments, err := db.List()
+	if err != nil {
+		cniLog.Errorf("[%s] Failed to list attachments: %v", operation, err)
+		return nil
+	}
+	for _, a := range attachments {
+		if (a.ContainerID != args.ContainerID || a.IfName != args.IfName) && holdsIP(a, ip) &&
+			(a.State == store.StateAllocated || a.State == store.StateAttached) {
+			return &a
+		}
+	}
+	return nil
+}
+
+// pruneAttachments drops released attachments older than attachmentRetention
+func pruneAttachments(operation string) {
+	db, err := store.Open(nodePaths.store)
+	if err != nil {
+		cniLog.Errorf("[%s] Failed to open allocation database: %v", operation, err)
+		return
+	}
+	defer db.Close()
+
+	if _, err := db.Prune(time.Now().Add(-attachmentRetention)); err != nil {
+		cniLog.Errorf("[%s] Failed to prune allocation database: %v", operation, err)
+	}
+}
+
+// holdsIP reports whether ip is the IP or one of the additional IPs of the attachment
+func holdsIP(a store.Attachment, ip string) bool {
+	ip = ipam.CanonicalIP(ip)
+	if ipam.CanonicalIP(a.IP) == ip {
+		return true
+	}
+	for _, additional := range a.AdditionalIPs {
+		if ipam.CanonicalIP(additional) == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// newOperationRecord starts the telemetry record of this invocation
+func newOperationRecord(operation string, containerID, ifName string) *telemetry.Record {
+	record := telemetry.NewRecord(operation, containerID, ifName)
+	record.PluginVersion = version
+	return record
+}
+
+// writeOperationRecord stores the outcome of this invocation on the node
+func writeOperationRecord(operation string, record *telemetry.Record, err error) {
+	record.Finish(err)
+	record.Cause = failureCause(err)
+	if err := record.Write(nodePaths.operations, telemetry.DefaultMaxRecords); err != nil {
+		cniLog.Errorf("[%s] Failed to write operation record: %v", operation, err)
+	}
+}
+
+// failureCause is the telemetry cause of err when the invocation failed for
+// lack of IPs or GCE quota rather than a fault of the plugin, so the canary
+// does not roll a release back for them
+func failureCause(err error) string {
+	var cniErr *types.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &cniErr) && cniErr.Code == ErrCodeNodeLimitReached,
+		errors.Is(err, ipam.ErrPoolExhausted), errors.Is(err, ipam.ErrNodeLimitReached), isAliasLimitError(err):
+		return telemetry.CauseCapacity
+	}
+	if throttled, _ := quotaExceeded(err); throttled {
+		return telemetry.CauseQuota
+	}
+	return ""
+}
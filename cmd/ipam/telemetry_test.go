@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"google.golang.org/api/googleapi"
+
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestFailureCause(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "succeeded"},
+		{name: "plugin fault", err: errors.New("failed to attach alias IP")},
+		{name: "pool exhausted", err: fmt.Errorf("failed to allocate IP from pool pool: %w", ipam.ErrPoolExhausted), want: telemetry.CauseCapacity},
+		{name: "node limit", err: types.NewError(ErrCodeNodeLimitReached, "node IP limit of pool reached", "limit 32"), want: telemetry.CauseCapacity},
+		{
+			name: "alias limit",
+			err: fmt.Errorf("failed to update network interface: %w", &googleapi.Error{Code: http.StatusBadRequest,
+				Errors: []googleapi.ErrorItem{{Reason: aliasLimitReason}}}),
+			want: telemetry.CauseCapacity,
+		},
+		{
+			name: "rate limited",
+			err:  fmt.Errorf("failed to get instance: %w", &googleapi.Error{Code: http.StatusTooManyRequests}),
+			want: telemetry.CauseQuota,
+		},
+		{name: "operation quota", err: fmt.Errorf("failed to attach alias IP: %w", errOperationQuota), want: telemetry.CauseQuota},
+		{name: "IP conflict", err: types.NewError(ErrCodeIPConflict, "IP address conflict", "10.8.0.5 answers ARP")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureCause(tt.err); got != tt.want {
+				t.Errorf("failureCause(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
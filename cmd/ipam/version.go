@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/spf13/pflag"
+
+	"github.com/castai/gcp-cni/internal/config"
+)
+
+// versionInfo is the build of the plugin and the fingerprint of the
+// configuration it runs with
+type versionInfo struct {
+	Version           string `json:"version"`
+	Commit            string `json:"commit"`
+	GoVersion         string `json:"goVersion"`
+	Platform          string `json:"platform"`
+	ConfigPath        string `json:"configPath"`
+	ConfigFingerprint string `json:"configFingerprint,omitempty"`
+	ConfigError       string `json:"configError,omitempty"`
+}
+
+// runVersion prints the build of the plugin and the SHA-256 of its effective
+// configuration: the rendered config file merged with the environment, with
+// defaults applied
+func runVersion(args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet("version", pflag.ContinueOnError)
+	configPath := flags.String("config", config.DefaultPath, "Plugin configuration file to fingerprint")
+	output := flags.String("output", "text", "Output format: json or text")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output != "json" && *output != "text" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	info := versionInfo{
+		Version:    version,
+		Commit:     commit,
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		ConfigPath: *configPath,
+	}
+	cfg, err := loadPluginConfig(&PluginConf{IPAM: IPAMConf{ConfigPath: *configPath}})
+	if err == nil {
+		info.ConfigFingerprint, err = cfg.Fingerprint()
+	}
+	if err != nil {
+		info.ConfigError = err.Error()
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(info)
+	}
+	fmt.Fprintf(out, "gcp-ipam %s (%s) %s %s\n", info.Version, info.Commit, info.GoVersion, info.Platform)
+	if info.ConfigError != "" {
+		fmt.Fprintf(out, "config %s: %s\n", info.ConfigPath, info.ConfigError)
+	} else {
+		fmt.Fprintf(out, "config %s sha256:%s\n", info.ConfigPath, info.ConfigFingerprint)
+	}
+	return nil
+}
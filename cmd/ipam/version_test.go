@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/castai/gcp-cni/internal/config"
+)
+
+func TestRunVersion(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.ClusterID = "prod"
+	data, err := cfg.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := cfg.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := runVersion([]string{"--config", path, "--output", "json"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var info versionInfo
+	if err := json.Unmarshal([]byte(out.String()), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != version || info.ConfigPath != path || info.ConfigFingerprint != fingerprint || info.ConfigError != "" {
+		t.Errorf("version = %+v, want %s with fingerprint %s", info, version, fingerprint)
+	}
+
+	out.Reset()
+	if err := runVersion([]string{"--config", path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "config " + path + " sha256:" + fingerprint + "\n"; !strings.HasPrefix(out.String(), "gcp-ipam "+version+" ") || !strings.HasSuffix(out.String(), want) {
+		t.Errorf("version text = %q, want the build and %q", out.String(), want)
+	}
+
+	// A broken configuration is reported, not fatal, the build is still of use
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runVersion([]string{"--config", path, "--output", "json"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	info = versionInfo{}
+	if err := json.Unmarshal([]byte(out.String()), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ConfigFingerprint != "" || info.ConfigError == "" {
+		t.Errorf("version of a broken config = %+v, want its error", info)
+	}
+
+	if err := runVersion([]string{"--output", "yaml"}, &out); err == nil {
+		t.Error("runVersion() with an unknown output format succeeded")
+	}
+}
@@ -2,20 +2,82 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"os"
 	"time"
 
 	"github.com/spf13/pflag"
+	"golang.org/x/sync/errgroup"
 
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
 	"github.com/castai/gcp-cni/internal/provisioner"
+	"github.com/castai/gcp-cni/internal/validation"
+)
+
+var (
+	// Set at build time via ldflags
+	version = "dev"
+	commit  = "unknown"
 )
 
 var (
 	secondaryRangeName = pflag.String("secondary-range-name", "live", "Name for the secondary IP range")
+	clusterID          = pflag.String("cluster-id", "", "Suffixes the secondary range name as <name>-<cluster-id> so aliases of this cluster tell apart from those of others on shared instances, must match the clusterID of the plugin configuration")
 	rangeSizeBits      = pflag.Int("range-size-bits", 16, "Size of the secondary range in bits (e.g., 16 for /16)")
 	logLevel           = pflag.String("log-level", "info", "Log level (debug, info, warn, error)")
 	dryRun             = pflag.Bool("dry-run", false, "Dry run mode - don't make any changes")
+	leaseGCInterval    = pflag.Duration("lease-gc-interval", 0, "Interval for reclaiming allocations with expired leases, 0 disables the collector")
+	podFinalizer       = pflag.Bool("pod-cleanup-finalizer", false, "Remove the IP cleanup finalizer the admission webhook adds to pods once their IP is detached and released, needs --lease-gc-interval")
+	egressInterval     = pflag.Duration("egress-interval", 0, "Interval for assigning egress IPs from Egress class pools to annotated namespaces, 0 disables the controller")
+	floatingIPInterval = pflag.Duration("floating-ip-interval", 0, "Interval for attaching FloatingIPs to the node they ask for, 0 disables the controller")
+	serviceIPInterval  = pflag.Duration("service-ip-interval", 0, "Interval for assigning IPs from Service class pools to annotated LoadBalancer Services, 0 disables the controller")
+	renumberInterval   = pflag.Duration("renumber-interval", 0, "Interval for evicting pods holding IPs of draining pools and ranges, 0 disables the controller")
+	renumberMaxUnavail = pflag.Int("renumber-max-unavailable", 1, "Maximum number of pods holding draining IPs terminating at once")
+	uninstallInterval  = pflag.Duration("uninstall-interval", 0, "Interval for evicting pods holding IPs on nodes gcp-ipam is being uninstalled from, 0 disables the controller")
+	uninstallUnavail   = pflag.Int("uninstall-max-unavailable", 1, "Maximum number of pods of uninstalling nodes terminating at once")
+	migrationInterval  = pflag.Duration("migration-interval", 0, "Interval for completing and rolling back PodIPMigrations, 0 disables the controller")
+	migrationTimeout   = pflag.Duration("migration-timeout", 5*time.Minute, "Time a PodIPMigration may stay in one phase before it is rolled back")
+	webhookAddress     = pflag.String("webhook-address", "", "Address to serve the pod admission webhook validating IP annotations on, empty disables the webhook")
+	webhookCertFile    = pflag.String("webhook-cert-file", "/etc/gcp-cni/webhook/tls.crt", "TLS certificate of the admission webhook")
+	webhookKeyFile     = pflag.String("webhook-key-file", "/etc/gcp-cni/webhook/tls.key", "TLS key of the admission webhook")
+	allocationAddress  = pflag.String("allocation-api-address", "", "Address to serve the aggregated allocation API on, empty disables it")
+	allocationCertFile = pflag.String("allocation-api-cert-file", "/etc/gcp-cni/allocation-api/tls.crt", "TLS certificate of the allocation API")
+	allocationKeyFile  = pflag.String("allocation-api-key-file", "/etc/gcp-cni/allocation-api/tls.key", "TLS key of the allocation API")
+	configMapName      = pflag.String("config-map-name", "", "ConfigMap holding the plugin configuration whose freeze switch the controllers follow, empty disables it")
+	configMapNamespace = pflag.String("config-map-namespace", "kube-system", "Namespace of the plugin configuration ConfigMap")
+	podSubnetwork      = pflag.String("secondary-nic-subnetwork", "", "Dedicated subnetwork pod IPs come from through an additional network interface on every node, empty uses the node subnetwork")
+	nicInterval        = pflag.Duration("secondary-nic-interval", time.Minute, "Interval for attaching the pod network interface to nodes lacking it")
+	verifyInterval     = pflag.Duration("verify-interval", 0, "Interval for cross-checking IPPool allocations, instance alias IPs and pod IPs for drift, 0 disables the verifier")
+	annotateInterval   = pflag.Duration("pod-annotation-interval", 0, "Interval for annotating pods with the pool, secondary range and allocation time of their IP, 0 disables the controller")
+	profile            = pflag.String("profile", config.ProfileGKE, "Cluster profile (gke, kubeadm, k3s), outside GKE new pod ranges stay clear of the discovered service CIDR")
+	serviceCIDR        = pflag.String("service-cidr", "", "Service IP range of the cluster new pod ranges must not overlap, empty discovers it for self-managed clusters")
+	nodeDrainInterval  = pflag.Duration("node-drain-interval", 0, "Interval for releasing the IPs of nodes CAST AI drains or that are being deleted, 0 disables the controller")
+	warmPoolInterval   = pflag.Duration("warm-pool-interval", 0, "Interval for sizing the warm IP pools of nodes by the pods waiting for them, 0 disables the controller")
+	warmPoolMin        = pflag.Int("warm-pool-min", 2, "Warm pool size of a node no pods are waiting for")
+	warmPoolMax        = pflag.Int("warm-pool-max", 16, "Largest warm pool size of a node")
+	forecastInterval   = pflag.Duration("forecast-interval", 0, "Interval for sampling pool allocations and recording the days until each pool runs out of IPs, 0 disables the forecast")
+	forecastWindow     = pflag.Duration("forecast-window", 7*24*time.Hour, "Period of pool allocations the usage forecast fits the growth to")
+	metricsAddress     = pflag.String("metrics-address", "", "Address to serve pool usage metrics in the Prometheus text format on, empty disables them")
+	hostProject        = pflag.String("host-project", "", "Shared VPC host project owning the subnetworks and routes when nodes run in service projects, empty is the project of the provisioner")
+	hostProjectSA      = pflag.String("host-project-service-account", "", "Service account of the host project to impersonate for subnetwork and route calls, empty uses the provisioner credentials")
+	firewallInterval   = pflag.Duration("firewall-interval", 0, "Interval for checking the firewall rules and network tags IPPools reference and setting their FirewallReady condition, 0 disables the controller")
+	protectionInterval = pflag.Duration("pool-protection-interval", 0, "Interval for adding the protection finalizer to IPPools and releasing deleted ones once they allocate no IPs, 0 disables the controller")
+	onboardingInterval = pflag.Duration("onboarding-interval", 0, "Interval for onboarding nodes through their NodeOnboarding: waiting for the installed plugin, its self-test and buffered IPs before removing the startup taint, 0 disables the controller")
+	onboardingTaint    = pflag.String("onboarding-taint", "gcp-cni.cast.ai/not-ready", "Startup taint key removed from nodes once they are onboarded")
+	onboardingWarmIPs  = pflag.Int("onboarding-warm-ips", 0, "IPs buffered for a node before it is onboarded, 0 does not wait for buffered IPs")
+	dnsInterval        = pflag.Duration("dns-interval", 0, "Interval for registering the pod IPs of the pools in Cloud DNS and removing the records of released ones, 0 disables the controller")
+	dnsProject         = pflag.String("dns-project", "", "Project of the Cloud DNS managed zones, empty is the project of the provisioner")
+	dnsZone            = pflag.String("dns-zone", "", "Cloud DNS managed zone of the A and AAAA records of pod IPs")
+	dnsReverseZone     = pflag.String("dns-reverse-zone", "", "Cloud DNS managed zone of the PTR records of pod IPs, empty manages none")
+	dnsNameTemplate    = pflag.String("dns-name-template", provisioner.DefaultDNSNameTemplate, "Go template of the record name of a pod IP relative to --dns-zone, with .PodName, .PodNamespace, .Node, .Pool and .IP (dashed)")
+	dnsTTL             = pflag.Duration("dns-ttl", 5*time.Minute, "TTL of the DNS records of pod IPs")
+	probeInterval      = pflag.Duration("probe-interval", 0, "Interval for running a probe pod on every node that must get a pool IP and be reachable over the VPC, exported as metrics, 0 disables the prober")
+	probeTimeout       = pflag.Duration("probe-timeout", 2*time.Minute, "Time a probe pod has to get an IP and answer before its node fails the probe")
+	probeNamespace     = pflag.String("probe-namespace", "kube-system", "Namespace of the probe pods")
+	probeImage         = pflag.String("probe-image", provisioner.DefaultProbeImage, "Image of the probe pods, running agnhost netexec")
+	repairLimit        = pflag.Int("repair-limit", 0, "Maximum number of orphaned allocations, orphaned aliases and unallocated pod IPs the verifier repairs per check, 0 only reports them")
 )
 
 func main() {
@@ -26,6 +88,8 @@ func main() {
 	slog.SetDefault(logger)
 
 	logger.Info("Starting GCP CNI cluster provisioner",
+		slog.String("version", version),
+		slog.String("commit", commit),
 		slog.String("secondary_range_name", *secondaryRangeName),
 		slog.Int("range_size_bits", *rangeSizeBits),
 		slog.Bool("dry_run", *dryRun),
@@ -38,6 +102,29 @@ func main() {
 		logger.Error("Failed to create provisioner", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
+	provisioner.SetVersion(version, commit)
+	if *configMapName != "" {
+		provisioner.SetPluginConfigMap(*configMapNamespace, *configMapName)
+	}
+	if *podSubnetwork != "" {
+		provisioner.SetPodSubnetwork(*podSubnetwork)
+	}
+	clusterProfile, err := config.LookupProfile(*profile)
+	if err != nil {
+		logger.Error("Invalid cluster profile", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	provisioner.SetProfile(clusterProfile, *serviceCIDR)
+	if err := provisioner.SetClusterID(*clusterID); err != nil {
+		logger.Error("Invalid cluster ID", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	if *hostProject != "" {
+		if err := provisioner.SetSharedVPC(ctx, config.SharedVPC{HostProject: *hostProject, ServiceAccount: *hostProjectSA}); err != nil {
+			logger.Error("Failed to set up Shared VPC host project", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
 
 	err = provisioner.Provision(ctx, secondaryRangeName)
 	if err != nil {
@@ -46,11 +133,210 @@ func main() {
 	}
 
 	logger.Info("Cluster provisioning completed successfully")
+	validateStack(ctx, logger, provisioner)
+
+	if *leaseGCInterval > 0 || *serviceIPInterval > 0 || *egressInterval > 0 || *floatingIPInterval > 0 || *renumberInterval > 0 || *uninstallInterval > 0 || *migrationInterval > 0 || *webhookAddress != "" || *podSubnetwork != "" || *verifyInterval > 0 || *annotateInterval > 0 || *warmPoolInterval > 0 || *allocationAddress != "" || *nodeDrainInterval > 0 || *forecastInterval > 0 || *metricsAddress != "" || *dnsInterval > 0 || *firewallInterval > 0 || *protectionInterval > 0 || *onboardingInterval > 0 || *probeInterval > 0 {
+		g, ctx := errgroup.WithContext(ctx)
+		if *leaseGCInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunLeaseGC(ctx, *leaseGCInterval, *podFinalizer); err != nil {
+					return fmt.Errorf("lease garbage collector stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *serviceIPInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunServiceIPController(ctx, *serviceIPInterval); err != nil {
+					return fmt.Errorf("service IP controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *egressInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunEgressController(ctx, *egressInterval); err != nil {
+					return fmt.Errorf("egress controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *floatingIPInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunFloatingIPController(ctx, *floatingIPInterval); err != nil {
+					return fmt.Errorf("floating IP controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *renumberInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunRenumberController(ctx, *renumberInterval, *renumberMaxUnavail, *dryRun); err != nil {
+					return fmt.Errorf("renumbering controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *uninstallInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunUninstallController(ctx, *uninstallInterval, *uninstallUnavail); err != nil {
+					return fmt.Errorf("uninstall controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *migrationInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunMigrationController(ctx, *migrationInterval, *migrationTimeout); err != nil {
+					return fmt.Errorf("migration controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *podSubnetwork != "" {
+			g.Go(func() error {
+				if err := provisioner.RunSecondaryNICController(ctx, *nicInterval); err != nil {
+					return fmt.Errorf("secondary NIC controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *verifyInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunVerifier(ctx, *verifyInterval, *repairLimit, *dryRun); err != nil {
+					return fmt.Errorf("consistency verifier stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *annotateInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunPodAnnotationController(ctx, *annotateInterval); err != nil {
+					return fmt.Errorf("pod annotation controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *warmPoolInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunWarmPoolController(ctx, *warmPoolInterval, *warmPoolMin, *warmPoolMax); err != nil {
+					return fmt.Errorf("warm pool controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *nodeDrainInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunNodeDrainController(ctx, *nodeDrainInterval); err != nil {
+					return fmt.Errorf("node drain controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *forecastInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunForecastController(ctx, *forecastInterval, *forecastWindow); err != nil {
+					return fmt.Errorf("pool usage forecast controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *firewallInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunFirewallController(ctx, *firewallInterval); err != nil {
+					return fmt.Errorf("firewall verification controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *protectionInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunPoolProtectionController(ctx, *protectionInterval); err != nil {
+					return fmt.Errorf("pool protection controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *onboardingInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunOnboardingController(ctx, *onboardingInterval, *onboardingTaint, *onboardingWarmIPs); err != nil {
+					return fmt.Errorf("node onboarding controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *dnsInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunDNSController(ctx, *dnsInterval, dnsRecords()); err != nil {
+					return fmt.Errorf("DNS record controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *probeInterval > 0 {
+			g.Go(func() error {
+				if err := provisioner.RunProbeController(ctx, *probeInterval, probePods()); err != nil {
+					return fmt.Errorf("probe controller stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *metricsAddress != "" {
+			g.Go(func() error {
+				if err := provisioner.RunMetricsServer(ctx, *metricsAddress); err != nil {
+					return fmt.Errorf("metrics server stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *webhookAddress != "" {
+			g.Go(func() error {
+				if err := provisioner.RunAdmissionWebhook(ctx, *webhookAddress, *webhookCertFile, *webhookKeyFile); err != nil {
+					return fmt.Errorf("admission webhook stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if *allocationAddress != "" {
+			g.Go(func() error {
+				if err := provisioner.RunAllocationAPI(ctx, *allocationAddress, *allocationCertFile, *allocationKeyFile); err != nil {
+					return fmt.Errorf("allocation API stopped: %w", err)
+				}
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			logger.Error("Provisioner controllers stopped", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger.Info("Entering sleep mode - provisioner will run indefinitely")
 
 	time.Sleep(24 * time.Hour)
 }
 
+// dnsRecords returns the DNS records of the --dns flags
+func dnsRecords() provisioner.DNSRecords {
+	return provisioner.DNSRecords{
+		Project:      *dnsProject,
+		Zone:         *dnsZone,
+		ReverseZone:  *dnsReverseZone,
+		NameTemplate: *dnsNameTemplate,
+		TTL:          *dnsTTL,
+	}
+}
+
+// probePods returns the probe pods of the --probe flags
+func probePods() provisioner.ProbePods {
+	return provisioner.ProbePods{
+		Namespace: *probeNamespace,
+		Image:     *probeImage,
+		Timeout:   *probeTimeout,
+	}
+}
+
 func parseLogLevel(level string) slog.Level {
 	switch level {
 	case "debug":
@@ -65,3 +351,31 @@ func parseLogLevel(level string) slog.Level {
 		return slog.LevelInfo
 	}
 }
+
+// validateStack logs the inconsistencies between the plugin configuration,
+// the IPPools and their subnetworks. They do not stop the provisioner, run
+// gcpcnictl validate before rollouts to catch them.
+func validateStack(ctx context.Context, logger *slog.Logger, p *provisioner.Provisioner) {
+	projectID, err := identity.ProjectID(ctx)
+	if err != nil {
+		logger.Warn("Failed to validate configuration", slog.String("error", err.Error()))
+		return
+	}
+	rangeName, err := p.ClusterRange(ctx, *secondaryRangeName)
+	if err != nil {
+		logger.Warn("Failed to validate configuration", slog.String("error", err.Error()))
+		return
+	}
+	findings, err := p.Validate(ctx, projectID, validation.Stack{SecondaryRangeName: rangeName})
+	if err != nil {
+		logger.Warn("Failed to validate configuration", slog.String("error", err.Error()))
+		return
+	}
+	for _, f := range findings {
+		logger.Warn("Inconsistent configuration",
+			slog.String("severity", f.Severity),
+			slog.String("source", f.Source),
+			slog.String("finding", f.Message),
+		)
+	}
+}
@@ -0,0 +1,694 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/castai/gcp-cni/internal/identity"
+)
+
+// FeatureRouteFallback programs a VPC route with the node as next hop for a
+// pod IP when the pod network interface has no alias IP range left
+const FeatureRouteFallback = "RouteFallback"
+
+// FeatureConflictDetection makes ADD check that no other host uses the IP
+// before attaching it, at the cost of a ping and an instance list per ADD
+const FeatureConflictDetection = "ConflictDetection"
+
+// FeatureAllocationAPI makes ADD allocate through the allocation API of the
+// provisioner, which updates the pool server-side, instead of reading and
+// writing the whole IPPool itself
+const FeatureAllocationAPI = "AllocationAPI"
+
+// FeatureAsyncAttach makes ADD return the IP of pods with the
+// gcp-cni.cast.ai/alias-attached readiness gate before its alias is attached,
+// the installer attaches it and flips the condition. Experimental.
+const FeatureAsyncAttach = "AsyncAttach"
+
+const (
+	// DefaultPath is where the installer renders the plugin config on the host
+	DefaultPath = "/etc/gcp-cni/ipam.json"
+
+	// ConfigMapKey is the ConfigMap data key holding the plugin config
+	ConfigMapKey = "config.yaml"
+)
+
+// Config is the gcp-ipam runtime configuration. Operators manage it through a
+// ConfigMap, the installer renders it to a file on every node and the plugin
+// reads it on every invocation, so changes apply without restarting anything.
+type Config struct {
+	// PoolMappings maps subnetwork names to the IPPool used for them, overriding
+	// the naming of Naming.Pool
+	// +optional
+	PoolMappings map[string]string `json:"poolMappings,omitempty"`
+
+	// MissingPool is what ADD does when the pool resolved for a pod does not
+	// exist
+	// +optional
+	MissingPool MissingPool `json:"missingPool,omitempty"`
+
+	// Timeouts bounds how long plugin operations may take
+	// +optional
+	Timeouts Timeouts `json:"timeouts,omitempty"`
+
+	// Pacing spaces the GCE calls of plugin invocations on a node to stay
+	// within project quotas
+	// +optional
+	Pacing Pacing `json:"pacing,omitempty"`
+
+	// Concurrency bounds how many GCE and pool updates run at once
+	// +optional
+	Concurrency Concurrency `json:"concurrency,omitempty"`
+
+	// Retry is the backoff of pool updates that conflict with concurrent ones
+	// +optional
+	Retry Retry `json:"retry,omitempty"`
+
+	// Logging sets the log levels of the plugin per component
+	// +optional
+	Logging Logging `json:"logging,omitempty"`
+
+	// FeatureGates enables or disables optional plugin behavior by name
+	// +optional
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+
+	// Freeze stops new allocations and provisioner mutations cluster-wide
+	// +optional
+	Freeze Freeze `json:"freeze,omitempty"`
+
+	// NetworkInterface selects the network interface pod IPs are attached to
+	// +optional
+	NetworkInterface NetworkInterface `json:"networkInterface,omitempty"`
+
+	// SecondaryRangeName is the secondary range pod aliases are attached from
+	// when their pool does not name one. Empty is "live".
+	// +optional
+	SecondaryRangeName string `json:"secondaryRangeName,omitempty"`
+
+	// ClusterID suffixes the secondary range names of the cluster as
+	// <secondaryRangeName>-<clusterID>. The plugin attaches and removes aliases
+	// of those ranges only, so instances reused from or sharing templates with
+	// another cluster keep its aliases. Must match the provisioner --cluster-id.
+	// +optional
+	ClusterID string `json:"clusterID,omitempty"`
+
+	// ClusterRanges names the secondary ranges of the cluster besides
+	// secondaryRangeName, e.g. ranges added for renumbering, as configured
+	// before the naming template applies. With a clusterID only the known
+	// ranges are the cluster's.
+	// +optional
+	ClusterRanges []string `json:"clusterRanges,omitempty"`
+
+	// Profile names the Kubernetes distribution of the cluster: gke, kubeadm
+	// or k3s. Empty is gke.
+	// +optional
+	Profile string `json:"profile,omitempty"`
+
+	// KubeletKubeconfig overrides the kubelet kubeconfig of the profile
+	// +optional
+	KubeletKubeconfig string `json:"kubeletKubeconfig,omitempty"`
+
+	// Identity overrides the project, zone and instance otherwise read from
+	// the metadata server, for CI, kind clusters and the GCE emulator
+	// +optional
+	Identity identity.Overrides `json:"identity,omitempty"`
+
+	// SharedVPC names the host project of a Shared VPC nodes of several
+	// service projects attach to
+	// +optional
+	SharedVPC SharedVPC `json:"sharedVPC,omitempty"`
+
+	// CriticalPods marks the pods whose ADDs are served ahead of the others
+	// on a node
+	// +optional
+	CriticalPods CriticalPods `json:"criticalPods,omitempty"`
+
+	// Hooks run commands or call webhooks after an IP is attached to a pod and
+	// before it is released, for DNS registration, firewall automation or CMDB
+	// updates
+	// +optional
+	Hooks []Hook `json:"hooks,omitempty"`
+
+	// Reachability holds back the ADD result until the pod IP is reachable
+	// over the VPC
+	// +optional
+	Reachability Reachability `json:"reachability,omitempty"`
+
+	// Naming overrides the names of the IPPools, secondary ranges and
+	// internal ranges created for the cluster
+	// +optional
+	Naming Naming `json:"naming,omitempty"`
+}
+
+// Reachability verifies the pod IPs before ADD returns: the node connects from
+// each to Target over TCP, and the connection being accepted shows that GCE
+// routes the IP to the node both ways. Pods would otherwise become ready while
+// the alias or route is still propagating.
+type Reachability struct {
+	// Target is the listening host:port in the VPC connected to, e.g. the
+	// private endpoint of the control plane. It must not be masqueraded by the
+	// node.
+	// Empty disables the check.
+	// +optional
+	Target string `json:"target,omitempty"`
+
+	// Timeout bounds the check. Defaults to 30s.
+	// +optional
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+
+	// FailurePolicy is Ignore to log an IP still unreachable after Timeout or
+	// Fail to fail the ADD, which releases it. Empty is Ignore.
+	// +optional
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+
+	// SettleDelay is waited after attaching an IP, counted from the attach
+	// operation being done, before ADD returns when there is no Target to
+	// observe the propagation with. Zero returns right away.
+	// +optional
+	SettleDelay metav1.Duration `json:"settleDelay,omitempty"`
+}
+
+func (r Reachability) validate() error {
+	if r.Target != "" {
+		if _, _, err := net.SplitHostPort(r.Target); err != nil {
+			return fmt.Errorf("invalid reachability target %q: %w", r.Target, err)
+		}
+	}
+	switch r.FailurePolicy {
+	case "", HookFailurePolicyIgnore, HookFailurePolicyFail:
+	default:
+		return fmt.Errorf("unknown reachability failurePolicy %q, expected Ignore or Fail", r.FailurePolicy)
+	}
+	if r.SettleDelay.Duration < 0 {
+		return fmt.Errorf("reachability settleDelay %v is negative", r.SettleDelay.Duration)
+	}
+	return nil
+}
+
+// CriticalPods selects pods that keep scheduling fast while a node is busy,
+// e.g. kube-system and the CAST AI agents during a scale-up storm. Their ADDs
+// are served first from the node mutation queue, skip the GCE call pacing and
+// may take the warm IPs held back for them.
+type CriticalPods struct {
+	// Namespaces whose pods are critical
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// PriorityClasses whose pods are critical
+	// +optional
+	PriorityClasses []string `json:"priorityClasses,omitempty"`
+
+	// WarmIPs is the number of warm IPs per pool of a node only critical pods
+	// take
+	// +optional
+	WarmIPs int `json:"warmIPs,omitempty"`
+}
+
+// Match reports whether a pod in namespace with priorityClassName is critical
+func (c CriticalPods) Match(namespace, priorityClassName string) bool {
+	return slices.Contains(c.Namespaces, namespace) ||
+		(priorityClassName != "" && slices.Contains(c.PriorityClasses, priorityClassName))
+}
+
+// NetworkInterface selects the instance network interface pods get their IPs
+// on. By default that is the primary interface, shared with node traffic.
+// Clusters that isolate pod traffic at the VPC level attach an additional
+// interface in a dedicated subnetwork to every node; pod IPs are then
+// allocated from the pool of that subnetwork and attached to that interface.
+type NetworkInterface struct {
+	// Subnetwork is the name of the subnetwork of the pod interface, empty
+	// uses the primary interface
+	// +optional
+	Subnetwork string `json:"subnetwork,omitempty"`
+}
+
+// Logging sets the level of the plugin log, error, warning, info or debug,
+// separately for its components. Components without a level use Level,
+// debug when unset.
+type Logging struct {
+	// Level of the components without a level of their own
+	// +optional
+	Level string `json:"level,omitempty"`
+
+	// CNI covers the ADD and DEL flow itself: arguments, the network
+	// configuration, queueing and the node-local database
+	// +optional
+	CNI string `json:"cni,omitempty"`
+
+	// Allocator covers IPPool allocations, releases and warm IPs
+	// +optional
+	Allocator string `json:"allocator,omitempty"`
+
+	// GCE covers Compute Engine calls: network interfaces, operations, routes
+	// and pacing
+	// +optional
+	GCE string `json:"gce,omitempty"`
+}
+
+func (l Logging) validate() error {
+	for field, level := range map[string]string{"level": l.Level, "cni": l.CNI, "allocator": l.Allocator, "gce": l.GCE} {
+		switch level {
+		case "", "error", "warning", "info", "debug":
+		default:
+			return fmt.Errorf("unknown logging.%s %q, expected error, warning, info or debug", field, level)
+		}
+	}
+	return nil
+}
+
+// clusterIDPattern keeps secondary range names suffixed with the cluster ID
+// valid GCE resource names
+var clusterIDPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,18}[a-z0-9])?$`)
+
+// ValidateClusterID checks that clusterID, when set, is at most 20 lower case
+// letters, digits and inner hyphens
+func ValidateClusterID(clusterID string) error {
+	if clusterID != "" && !clusterIDPattern.MatchString(clusterID) {
+		return fmt.Errorf("invalid clusterID %q, expected at most 20 lower case letters, digits and inner hyphens", clusterID)
+	}
+	return nil
+}
+
+// Events of a Hook
+const (
+	HookAfterAttach   = "afterAttach"
+	HookBeforeRelease = "beforeRelease"
+)
+
+// Failure policies of a Hook
+const (
+	HookFailurePolicyIgnore = "Ignore"
+	HookFailurePolicyFail   = "Fail"
+)
+
+// Hook is a command or webhook the plugin runs on events of pod IPs. The
+// event is passed as JSON on the stdin of Command or as the body of a POST to
+// URL. Hooks run while the invocation holds its node mutation slot, so Timeout
+// delays the ADDs and DELs queued behind it.
+type Hook struct {
+	// Name identifies the hook in logs
+	Name string `json:"name"`
+
+	// Events the hook runs on: afterAttach or beforeRelease
+	Events []string `json:"events"`
+
+	// Command is run with its arguments, without a shell
+	// +optional
+	Command []string `json:"command,omitempty"`
+
+	// URL is POSTed the event
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Timeout bounds a single run. Defaults to 10s.
+	// +optional
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+
+	// FailurePolicy is Ignore to log failures or Fail to fail the ADD of the
+	// pod on afterAttach failures, which releases its IP. DELs never fail on
+	// hooks. Empty is Ignore.
+	// +optional
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+}
+
+// Subscribed reports whether the hook runs on event
+func (h Hook) Subscribed(event string) bool {
+	return slices.Contains(h.Events, event)
+}
+
+func (h Hook) validate() error {
+	if h.Name == "" {
+		return fmt.Errorf("hooks need a name")
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("hook %s has no events", h.Name)
+	}
+	for _, event := range h.Events {
+		if event != HookAfterAttach && event != HookBeforeRelease {
+			return fmt.Errorf("unknown event %q of hook %s, expected afterAttach or beforeRelease", event, h.Name)
+		}
+	}
+	if (len(h.Command) == 0) == (h.URL == "") {
+		return fmt.Errorf("hook %s needs either a command or a url", h.Name)
+	}
+	switch h.FailurePolicy {
+	case "", HookFailurePolicyIgnore, HookFailurePolicyFail:
+	default:
+		return fmt.Errorf("unknown failurePolicy %q of hook %s, expected Ignore or Fail", h.FailurePolicy, h.Name)
+	}
+	return nil
+}
+
+// Actions of MissingPool
+const (
+	MissingPoolFail     = "fail"
+	MissingPoolCreate   = "create"
+	MissingPoolFallback = "fallback"
+)
+
+// MissingPool handles subnetworks no IPPool was provisioned or mapped for,
+// e.g. of a node pool added in a new subnetwork
+type MissingPool struct {
+	// Action is fail, create to create the pool from the secondary range of
+	// the subnetwork aliases are attached from, or fallback to allocate from
+	// FallbackPool. Empty is fail.
+	// +optional
+	Action string `json:"action,omitempty"`
+
+	// FallbackPool is the pool of the fallback action
+	// +optional
+	FallbackPool string `json:"fallbackPool,omitempty"`
+}
+
+func (m MissingPool) validate() error {
+	switch m.Action {
+	case "", MissingPoolFail, MissingPoolCreate:
+		return nil
+	case MissingPoolFallback:
+		if m.FallbackPool == "" {
+			return fmt.Errorf("missingPool.fallbackPool is required with the fallback action")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown missingPool.action %q, expected fail, create or fallback", m.Action)
+	}
+}
+
+// SharedVPC covers fleets whose nodes run in several service projects of one
+// Shared VPC. Instances are always changed in the project of their node, read
+// from its metadata server or provider ID, while subnetworks and routes are
+// read and changed in the host project.
+type SharedVPC struct {
+	// HostProject is the project owning the VPC, empty is the project of the
+	// node
+	// +optional
+	HostProject string `json:"hostProject,omitempty"`
+
+	// ServiceAccount of the host project impersonated for calls on it, when
+	// the node service accounts are not granted the network roles there
+	// +optional
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+}
+
+// NetworkProject returns the project the subnetworks and routes of a node in
+// nodeProject live in
+func (s SharedVPC) NetworkProject(nodeProject string) string {
+	if s.HostProject != "" {
+		return s.HostProject
+	}
+	return nodeProject
+}
+
+// Freeze is the maintenance switch for incident response and GCP maintenance
+// windows. While enabled the plugin refuses to allocate IPs for new pods and
+// the provisioner refuses to change instances, pools and pods, but reads and
+// releases keep working.
+type Freeze struct {
+	// Enabled switches the freeze on
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Reason is reported with every refused operation
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// Timeouts bounds how long plugin operations may take
+type Timeouts struct {
+	// Add is the deadline for a whole CNI ADD
+	// +optional
+	Add metav1.Duration `json:"add,omitempty"`
+
+	// Del is the deadline for a whole CNI DEL
+	// +optional
+	Del metav1.Duration `json:"del,omitempty"`
+
+	// Operation is the deadline for waiting on a single GCE operation
+	// +optional
+	Operation metav1.Duration `json:"operation,omitempty"`
+}
+
+// Pacing configures the slow start of GCE calls on a node. A cold node waits
+// Initial between invocations, halving it down to Min while calls succeed;
+// quota errors double it up to Max.
+type Pacing struct {
+	// Initial is the spacing a cold node starts from
+	// +optional
+	Initial metav1.Duration `json:"initial,omitempty"`
+
+	// Min is the spacing while GCE calls succeed
+	// +optional
+	Min metav1.Duration `json:"min,omitempty"`
+
+	// Max caps the spacing after repeated quota errors
+	// +optional
+	Max metav1.Duration `json:"max,omitempty"`
+
+	// IdleReset is how long a node has to be quiet to start cold again
+	// +optional
+	IdleReset metav1.Duration `json:"idleReset,omitempty"`
+}
+
+// Concurrency trades pod startup parallelism against API quota pressure.
+// Small projects keep the defaults, large ones raise NodeMutations for faster
+// scale-ups or cap PoolUpdates to ease conflicts on busy pools.
+type Concurrency struct {
+	// NodeMutations is the number of plugin invocations on a node mutating
+	// the instance at once, the others queue. Defaults to 1.
+	// +optional
+	NodeMutations int `json:"nodeMutations,omitempty"`
+
+	// PoolUpdates is the number of updates of a pool in flight at once, per
+	// node from the plugin and cluster-wide in the allocation API, the others
+	// queue. 0 is unlimited.
+	// +optional
+	PoolUpdates int `json:"poolUpdates,omitempty"`
+}
+
+// Environment variables filling the retry policy fields the configuration
+// leaves unset
+const (
+	EnvRetryAttempts  = "GCP_CNI_RETRY_ATTEMPTS"
+	EnvRetryBaseDelay = "GCP_CNI_RETRY_BASE_DELAY"
+	EnvRetryMaxDelay  = "GCP_CNI_RETRY_MAX_DELAY"
+)
+
+// Retry is the backoff of IPPool updates that lost a race with a concurrent
+// one. Small clusters rarely conflict, busy pools of large ones need more
+// attempts spread further apart. Unset fields keep the allocator defaults.
+type Retry struct {
+	// Attempts is the number of tries of a conflicting update. Defaults to 10.
+	// +optional
+	Attempts int `json:"attempts,omitempty"`
+
+	// BaseDelay is the delay after the first conflict, doubling with every
+	// further one. Defaults to 100ms.
+	// +optional
+	BaseDelay metav1.Duration `json:"baseDelay,omitempty"`
+
+	// MaxDelay caps the delay between attempts, 0 does not cap it
+	// +optional
+	MaxDelay metav1.Duration `json:"maxDelay,omitempty"`
+}
+
+func (r Retry) validate() error {
+	if r.Attempts < 0 || r.BaseDelay.Duration < 0 || r.MaxDelay.Duration < 0 {
+		return fmt.Errorf("retry attempts and delays must not be negative")
+	}
+	return nil
+}
+
+// RetryFromEnv reads the retry policy from the environment
+func RetryFromEnv() (Retry, error) {
+	var r Retry
+	if v := os.Getenv(EnvRetryAttempts); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil {
+			return r, fmt.Errorf("invalid %s %q: %w", EnvRetryAttempts, v, err)
+		}
+		r.Attempts = attempts
+	}
+	for name, d := range map[string]*metav1.Duration{EnvRetryBaseDelay: &r.BaseDelay, EnvRetryMaxDelay: &r.MaxDelay} {
+		if v := os.Getenv(name); v != "" {
+			duration, err := time.ParseDuration(v)
+			if err != nil {
+				return r, fmt.Errorf("invalid %s %q: %w", name, v, err)
+			}
+			d.Duration = duration
+		}
+	}
+	return r, r.validate()
+}
+
+// Merge fills the fields r leaves unset from other
+func (r Retry) Merge(other Retry) Retry {
+	if r.Attempts == 0 {
+		r.Attempts = other.Attempts
+	}
+	if r.BaseDelay.Duration == 0 {
+		r.BaseDelay = other.BaseDelay
+	}
+	if r.MaxDelay.Duration == 0 {
+		r.MaxDelay = other.MaxDelay
+	}
+	return r
+}
+
+// defaultHookTimeout bounds hooks without a timeout
+const defaultHookTimeout = 10 * time.Second
+
+// defaultReachabilityTimeout bounds reachability checks without a timeout
+const defaultReachabilityTimeout = 30 * time.Second
+
+// Default returns the configuration used when no config file is present
+func Default() *Config {
+	return &Config{
+		Timeouts: Timeouts{
+			Add:       metav1.Duration{Duration: 2 * time.Minute},
+			Del:       metav1.Duration{Duration: 2 * time.Minute},
+			Operation: metav1.Duration{Duration: time.Minute},
+		},
+		Pacing: Pacing{
+			Initial:   metav1.Duration{Duration: time.Second},
+			Max:       metav1.Duration{Duration: 30 * time.Second},
+			IdleReset: metav1.Duration{Duration: 5 * time.Minute},
+		},
+		Concurrency: Concurrency{
+			NodeMutations: 1,
+		},
+	}
+}
+
+// Parse reads a YAML or JSON config, filling unset fields with defaults
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if _, err := LookupProfile(cfg.Profile); err != nil {
+		return nil, err
+	}
+	if err := cfg.MissingPool.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Logging.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Retry.validate(); err != nil {
+		return nil, err
+	}
+	if err := ValidateClusterID(cfg.ClusterID); err != nil {
+		return nil, err
+	}
+	for _, hook := range cfg.Hooks {
+		if err := hook.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.Reachability.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Naming.validate(cfg.ClusterID); err != nil {
+		return nil, err
+	}
+	cfg.applyDefaults()
+	return cfg, nil
+}
+
+// Load reads the config file at path. A missing file yields the defaults.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Default(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	return Parse(data)
+}
+
+// Render returns the config in the on-disk format read by Load
+func (c *Config) Render() ([]byte, error) {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+	return data, nil
+}
+
+// Fingerprint returns the SHA-256 of the config in hex, the same for configs
+// that only differ in defaults spelled out or in the order of their keys
+func (c *Config) Fingerprint() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// PoolName returns the IPPool mapped to the subnetwork, if any
+func (c *Config) PoolName(subnetwork string) (string, bool) {
+	name, ok := c.PoolMappings[subnetwork]
+	return name, ok && name != ""
+}
+
+// Kubeconfig returns the kubeconfig the plugin reaches the Kubernetes API with
+func (c *Config) Kubeconfig() string {
+	if c.KubeletKubeconfig != "" {
+		return c.KubeletKubeconfig
+	}
+	if profile, err := LookupProfile(c.Profile); err == nil {
+		return profile.KubeletKubeconfig
+	}
+	return DefaultKubeletKubeconfig
+}
+
+// Enabled reports whether the named feature gate is switched on
+func (c *Config) Enabled(gate string) bool {
+	return c.FeatureGates[gate]
+}
+
+func (c *Config) applyDefaults() {
+	defaults := Default()
+	if c.Timeouts.Add.Duration == 0 {
+		c.Timeouts.Add = defaults.Timeouts.Add
+	}
+	if c.Timeouts.Del.Duration == 0 {
+		c.Timeouts.Del = defaults.Timeouts.Del
+	}
+	if c.Timeouts.Operation.Duration == 0 {
+		c.Timeouts.Operation = defaults.Timeouts.Operation
+	}
+	if c.Pacing.Initial.Duration == 0 {
+		c.Pacing.Initial = defaults.Pacing.Initial
+	}
+	if c.Pacing.Max.Duration == 0 {
+		c.Pacing.Max = defaults.Pacing.Max
+	}
+	if c.Pacing.IdleReset.Duration == 0 {
+		c.Pacing.IdleReset = defaults.Pacing.IdleReset
+	}
+	if c.Concurrency.NodeMutations <= 0 {
+		c.Concurrency.NodeMutations = defaults.Concurrency.NodeMutations
+	}
+	for i := range c.Hooks {
+		if c.Hooks[i].Timeout.Duration == 0 {
+			c.Hooks[i].Timeout = metav1.Duration{Duration: defaultHookTimeout}
+		}
+	}
+	if c.Reachability.Target != "" && c.Reachability.Timeout.Duration == 0 {
+		c.Reachability.Timeout = metav1.Duration{Duration: defaultReachabilityTimeout}
+	}
+}
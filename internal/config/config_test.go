@@ -0,0 +1,267 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantErr  bool
+		wantAdd  time.Duration
+		wantPool string
+	}{
+		{
+			name:    "empty config uses defaults",
+			data:    "",
+			wantAdd: 2 * time.Minute,
+		},
+		{
+			name: "yaml config",
+			data: `
+poolMappings:
+  default: ippool-custom
+timeouts:
+  add: 30s
+featureGates:
+  example: true
+`,
+			wantAdd:  30 * time.Second,
+			wantPool: "ippool-custom",
+		},
+		{
+			name:     "json config",
+			data:     `{"poolMappings": {"default": "ippool-json"}}`,
+			wantAdd:  2 * time.Minute,
+			wantPool: "ippool-json",
+		},
+		{
+			name:    "unknown field is rejected",
+			data:    "poolMapping: {}",
+			wantErr: true,
+		},
+		{
+			name:    "fallback without a pool is rejected",
+			data:    `{"missingPool": {"action": "fallback"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown missing pool action is rejected",
+			data:    `{"missingPool": {"action": "ignore"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown log level is rejected",
+			data:    `{"logging": {"allocator": "trace"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "cluster ID that is no range name suffix is rejected",
+			data:    `{"clusterID": "Prod_1"}`,
+			wantErr: true,
+		},
+		{
+			name: "hook with a command",
+			data: `
+hooks:
+- name: dns
+  events: [afterAttach, beforeRelease]
+  command: [/opt/bin/register-dns]
+`,
+			wantAdd: 2 * time.Minute,
+		},
+		{
+			name:    "hook with both a command and a url is rejected",
+			data:    `{"hooks": [{"name": "dns", "events": ["afterAttach"], "command": ["true"], "url": "http://dns.local"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "reachability target without a port is rejected",
+			data:    `{"reachability": {"target": "10.0.0.2"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "negative settle delay is rejected",
+			data:    `{"reachability": {"settleDelay": "-1s"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "hook with an unknown event is rejected",
+			data:    `{"hooks": [{"name": "dns", "events": ["beforeAttach"], "url": "http://dns.local"}]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if cfg.Timeouts.Add.Duration != tt.wantAdd {
+				t.Errorf("Timeouts.Add = %v, want %v", cfg.Timeouts.Add.Duration, tt.wantAdd)
+			}
+			if cfg.Timeouts.Operation.Duration == 0 {
+				t.Errorf("Timeouts.Operation was not defaulted")
+			}
+			if cfg.Concurrency.NodeMutations != 1 {
+				t.Errorf("Concurrency.NodeMutations = %d, want 1", cfg.Concurrency.NodeMutations)
+			}
+
+			pool, ok := cfg.PoolName("default")
+			if ok != (tt.wantPool != "") || pool != tt.wantPool {
+				t.Errorf("PoolName() = %q, %v, want %q", pool, ok, tt.wantPool)
+			}
+
+			// Rendered config must load back to the same values
+			data, err := cfg.Render()
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			again, err := Parse(data)
+			if err != nil {
+				t.Fatalf("Parse(Render()) error = %v", err)
+			}
+			if again.Timeouts.Add != cfg.Timeouts.Add {
+				t.Errorf("round trip Timeouts.Add = %v, want %v", again.Timeouts.Add, cfg.Timeouts.Add)
+			}
+		})
+	}
+}
+
+func TestProfileKubeconfig(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`{}`, DefaultKubeletKubeconfig},
+		{`{"profile": "k3s"}`, "/var/lib/rancher/k3s/agent/kubelet.kubeconfig"},
+		{`{"profile": "kubeadm", "kubeletKubeconfig": "/etc/kubelet/kubeconfig"}`, "/etc/kubelet/kubeconfig"},
+	}
+	for _, tt := range tests {
+		cfg, err := Parse([]byte(tt.data))
+		if err != nil {
+			t.Fatalf("Parse(%s) error = %v", tt.data, err)
+		}
+		if got := cfg.Kubeconfig(); got != tt.want {
+			t.Errorf("Parse(%s).Kubeconfig() = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+
+	if _, err := Parse([]byte(`{"profile": "eks"}`)); err == nil {
+		t.Errorf("Parse() accepted unknown profile")
+	}
+}
+
+func TestRetryFromEnv(t *testing.T) {
+	t.Setenv(EnvRetryAttempts, "25")
+	t.Setenv(EnvRetryBaseDelay, "50ms")
+	env, err := RetryFromEnv()
+	if err != nil {
+		t.Fatalf("RetryFromEnv() error = %v", err)
+	}
+
+	retry := Retry{MaxDelay: metav1.Duration{Duration: 2 * time.Second}, Attempts: 5}.Merge(env)
+	if retry.Attempts != 5 || retry.BaseDelay.Duration != 50*time.Millisecond || retry.MaxDelay.Duration != 2*time.Second {
+		t.Errorf("Merge() = %+v, want the attempts and max delay of the configuration and the base delay of the environment", retry)
+	}
+
+	t.Setenv(EnvRetryMaxDelay, "soon")
+	if _, err := RetryFromEnv(); err == nil {
+		t.Error("RetryFromEnv() accepted an invalid delay")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := func(data string) string {
+		t.Helper()
+		cfg, err := Parse([]byte(data))
+		if err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+		f, err := cfg.Fingerprint()
+		if err != nil {
+			t.Fatalf("Fingerprint() error = %v", err)
+		}
+		return f
+	}
+
+	defaults := fingerprint("")
+	if got := fingerprint(`{"timeouts": {"add": "2m"}}`); got != defaults {
+		t.Errorf("Fingerprint() with the default spelled out = %s, want %s", got, defaults)
+	}
+	if got := fingerprint(`{"timeouts": {"add": "30s"}}`); got == defaults {
+		t.Error("Fingerprint() did not change with the config")
+	}
+}
+
+func TestNaming(t *testing.T) {
+	cfg, err := Parse([]byte(`{"clusterID": "prod1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.DefaultPoolName("nodes"); got != "ippool-nodes" {
+		t.Errorf("DefaultPoolName() = %q, want ippool-nodes", got)
+	}
+	if got := cfg.ClusterRange("live"); got != "live-prod1" {
+		t.Errorf("ClusterRange() = %q, want live-prod1", got)
+	}
+	if got := cfg.InternalRangeName("live-prod1", "nodes"); got != "live-prod1" {
+		t.Errorf("InternalRangeName() = %q, want live-prod1", got)
+	}
+
+	cfg, err = Parse([]byte(`
+clusterID: prod1
+naming:
+  env: eu
+  pool: "{{.Env}}-{{.Subnetwork}}-pods"
+  secondaryRange: "{{.Env}}-{{.Range}}-{{.ClusterID}}"
+  internalRange: "ir-{{.Subnetwork}}-{{.Range}}"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.DefaultPoolName("nodes"); got != "eu-nodes-pods" {
+		t.Errorf("DefaultPoolName() = %q, want eu-nodes-pods", got)
+	}
+	rangeName := cfg.ClusterRange("live")
+	if rangeName != "eu-live-prod1" {
+		t.Errorf("ClusterRange() = %q, want eu-live-prod1", rangeName)
+	}
+	if got := cfg.ClusterRange("pods-prod1"); got != "eu-pods-prod1-prod1" {
+		t.Errorf("ClusterRange() of a base name ending in the cluster ID = %q, want eu-pods-prod1-prod1", got)
+	}
+	if got := cfg.InternalRangeName(rangeName, "nodes"); got != "ir-nodes-eu-live-prod1" {
+		t.Errorf("InternalRangeName() = %q, want ir-nodes-eu-live-prod1", got)
+	}
+	for aliasRange, want := range map[string]bool{
+		"eu-live-prod1":    true,
+		"live-prod1":       true,
+		"live":             true,
+		"eu-extra-prod1":   true,
+		"live-eu-prod1":    false,
+		"eu-live-eu-prod1": false,
+	} {
+		if got := cfg.InClusterRange(aliasRange, "extra"); got != want {
+			t.Errorf("InClusterRange(%q) = %v, want %v", aliasRange, got, want)
+		}
+	}
+
+	for _, data := range []string{
+		`{"clusterID": "prod1", "naming": {"secondaryRange": "{{.Range}}"}}`,
+		`{"naming": {"pool": "{{.Subnet}}"}}`,
+		`{"naming": {"internalRange": "IR_{{.Range}}"}}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse(%s) accepted invalid naming", data)
+		}
+	}
+}
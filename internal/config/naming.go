@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// Default naming templates, the names of clusters without a Naming
+const (
+	DefaultPoolNameTemplate           = "ippool-{{.Subnetwork}}"
+	DefaultSecondaryRangeNameTemplate = "{{.Range}}{{with .ClusterID}}-{{.}}{{end}}"
+	DefaultInternalRangeNameTemplate  = "{{.Range}}"
+)
+
+// gceNamePattern is what GCE accepts as secondary and internal range names
+var gceNamePattern = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// poolNamePattern is what Kubernetes accepts as IPPool names
+var poolNamePattern = regexp.MustCompile(`^[a-z0-9]([-.a-z0-9]{0,251}[a-z0-9])?$`)
+
+// Naming are the Go templates the provisioner names the resources it
+// creates for the cluster with, and the plugin finds them by. Both read them
+// from the plugin configuration, so organizations can follow their cloud
+// naming standards.
+type Naming struct {
+	// Pool names the IPPool of a subnetwork, with .Subnetwork, .ClusterID and
+	// .Env. Defaults to ippool-{{.Subnetwork}}.
+	// +optional
+	Pool string `json:"pool,omitempty"`
+
+	// SecondaryRange names the secondary range pods get IPs from, with .Range
+	// (the configured secondaryRangeName), .ClusterID and .Env. The name must
+	// end in -<clusterID> when a clusterID is set, as only those ranges are
+	// the cluster's. Defaults to {{.Range}}-{{.ClusterID}}, or {{.Range}}
+	// without a clusterID.
+	// +optional
+	SecondaryRange string `json:"secondaryRange,omitempty"`
+
+	// InternalRange names the internal range reserving the secondary range,
+	// with .Range (the secondary range name), .Subnetwork, .ClusterID and
+	// .Env. Defaults to {{.Range}}.
+	// +optional
+	InternalRange string `json:"internalRange,omitempty"`
+
+	// Env is the environment of the cluster, e.g. prod, available to the
+	// templates as .Env
+	// +optional
+	Env string `json:"env,omitempty"`
+}
+
+// NameData is what the naming templates are executed with
+type NameData struct {
+	Subnetwork string
+	Range      string
+	ClusterID  string
+	Env        string
+}
+
+func (n Naming) validate(clusterID string) error {
+	data := NameData{Subnetwork: "subnet", Range: ipam.DefaultAliasRange, ClusterID: clusterID, Env: n.Env}
+	pool, err := renderName(n.Pool, DefaultPoolNameTemplate, data)
+	if err != nil {
+		return fmt.Errorf("invalid naming.pool: %w", err)
+	}
+	if !poolNamePattern.MatchString(pool) {
+		return fmt.Errorf("naming.pool renders %q, which is no valid IPPool name", pool)
+	}
+	rangeName, err := renderName(n.SecondaryRange, DefaultSecondaryRangeNameTemplate, data)
+	if err != nil {
+		return fmt.Errorf("invalid naming.secondaryRange: %w", err)
+	}
+	if !gceNamePattern.MatchString(rangeName) {
+		return fmt.Errorf("naming.secondaryRange renders %q, which is no valid secondary range name", rangeName)
+	}
+	if clusterID != "" && !strings.HasSuffix(rangeName, "-"+clusterID) {
+		return fmt.Errorf("naming.secondaryRange renders %q, which does not end in -%s of the clusterID", rangeName, clusterID)
+	}
+	data.Range = rangeName
+	internalRange, err := renderName(n.InternalRange, DefaultInternalRangeNameTemplate, data)
+	if err != nil {
+		return fmt.Errorf("invalid naming.internalRange: %w", err)
+	}
+	if !gceNamePattern.MatchString(internalRange) {
+		return fmt.Errorf("naming.internalRange renders %q, which is no valid internal range name", internalRange)
+	}
+	return nil
+}
+
+func renderName(text, defaultText string, data NameData) (string, error) {
+	if text == "" {
+		text = defaultText
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// mustRenderName renders a template Parse validated, falling back to the
+// default naming for configs that skipped validation
+func mustRenderName(text, defaultText string, data NameData) string {
+	name, err := renderName(text, defaultText, data)
+	if err != nil {
+		name, _ = renderName(defaultText, defaultText, data)
+	}
+	return name
+}
+
+// DefaultPoolName returns the IPPool the provisioner creates for the
+// subnetwork, the pool of subnetworks without pool mappings
+func (c *Config) DefaultPoolName(subnetwork string) string {
+	return mustRenderName(c.Naming.Pool, DefaultPoolNameTemplate, NameData{
+		Subnetwork: subnetwork,
+		ClusterID:  c.ClusterID,
+		Env:        c.Naming.Env,
+	})
+}
+
+// ClusterRange returns the secondary range name rangeName, the configured
+// secondaryRangeName, takes in the cluster by the naming template. The
+// template always applies, a rangeName that happens to end in -<clusterID> is
+// a base name like any other.
+func (c *Config) ClusterRange(rangeName string) string {
+	return mustRenderName(c.Naming.SecondaryRange, DefaultSecondaryRangeNameTemplate, NameData{
+		Range:     rangeName,
+		ClusterID: c.ClusterID,
+		Env:       c.Naming.Env,
+	})
+}
+
+// RangeNames returns the known secondary range names of the cluster for
+// ipam.InClusterRange: secondaryRangeName, clusterRanges and names, each as
+// configured, like ranges named before the cluster had an ID, and as named by
+// the naming template
+func (c *Config) RangeNames(names ...string) []string {
+	var rangeNames []string
+	for _, name := range slices.Concat([]string{ipam.AliasRange(c.SecondaryRangeName)}, c.ClusterRanges, names) {
+		if name != "" {
+			rangeNames = append(rangeNames, name, c.ClusterRange(name))
+		}
+	}
+	return rangeNames
+}
+
+// InClusterRange reports whether aliasRange is one of RangeNames(names...)
+// or one of them suffixed with the cluster ID
+func (c *Config) InClusterRange(aliasRange string, names ...string) bool {
+	return ipam.InClusterRange(aliasRange, c.ClusterID, c.RangeNames(names...)...)
+}
+
+// InternalRangeName returns the internal range reserving the secondary range
+// rangeName of the subnetwork
+func (c *Config) InternalRangeName(rangeName, subnetwork string) string {
+	return mustRenderName(c.Naming.InternalRange, DefaultInternalRangeNameTemplate, NameData{
+		Subnetwork: subnetwork,
+		Range:      rangeName,
+		ClusterID:  c.ClusterID,
+		Env:        c.Naming.Env,
+	})
+}
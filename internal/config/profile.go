@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Cluster profiles
+const (
+	ProfileGKE     = "gke"
+	ProfileKubeadm = "kubeadm"
+	ProfileK3s     = "k3s"
+)
+
+// DefaultKubeletKubeconfig is the kubeconfig of the kubelet on GKE nodes
+const DefaultKubeletKubeconfig = "/var/lib/kubelet/kubeconfig"
+
+// Profile describes where a Kubernetes distribution keeps what gcp-cni uses
+// on the node, so self-managed clusters on GCE can adopt alias IP IPAM
+type Profile struct {
+	// KubeletKubeconfig is the kubeconfig the plugin reaches the Kubernetes
+	// API with
+	KubeletKubeconfig string
+
+	// CNIConfDir and CNIConfName locate the CNI configuration the installer
+	// switches to gcp-ipam
+	CNIConfDir  string
+	CNIConfName string
+
+	// CNIBinDir is where the container runtime looks for CNI plugins
+	CNIBinDir string
+
+	// ServiceCIDR is the default service IP range of the distribution, which
+	// the VPC does not know about. Empty on GKE, where the service range is a
+	// secondary range of the subnetwork.
+	ServiceCIDR string
+}
+
+var profiles = map[string]Profile{
+	ProfileGKE: {
+		KubeletKubeconfig: DefaultKubeletKubeconfig,
+		CNIConfDir:        "/etc/cni/net.d",
+		CNIConfName:       "10-gke-ptp.conflist",
+		CNIBinDir:         "/home/kubernetes/bin",
+	},
+	ProfileKubeadm: {
+		KubeletKubeconfig: "/etc/kubernetes/kubelet.conf",
+		CNIConfDir:        "/etc/cni/net.d",
+		CNIConfName:       "10-containerd-net.conflist",
+		CNIBinDir:         "/opt/cni/bin",
+		ServiceCIDR:       "10.96.0.0/12",
+	},
+	ProfileK3s: {
+		KubeletKubeconfig: "/var/lib/rancher/k3s/agent/kubelet.kubeconfig",
+		CNIConfDir:        "/var/lib/rancher/k3s/agent/etc/cni/net.d",
+		CNIConfName:       "10-flannel.conflist",
+		CNIBinDir:         "/var/lib/rancher/k3s/data/current/bin",
+		ServiceCIDR:       "10.43.0.0/16",
+	},
+}
+
+// LookupProfile returns the named cluster profile, GKE when name is empty
+func LookupProfile(name string) (Profile, error) {
+	if name == "" {
+		name = ProfileGKE
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Profile{}, fmt.Errorf("unknown cluster profile %q, known profiles are %s", name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
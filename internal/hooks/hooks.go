@@ -0,0 +1,107 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/castai/gcp-cni/internal/config"
+)
+
+// maxOutput bounds the command output and response body kept for errors
+const maxOutput = 512
+
+// Event is what hooks are passed about a pod IP
+type Event struct {
+	// Type is the config.HookAfterAttach or config.HookBeforeRelease event
+	Type           string    `json:"type"`
+	Time           time.Time `json:"time"`
+	IP             string    `json:"ip"`
+	Pool           string    `json:"pool,omitempty"`
+	SecondaryRange string    `json:"secondaryRange,omitempty"`
+	Instance       string    `json:"instance"`
+	PodNamespace   string    `json:"podNamespace,omitempty"`
+	PodName        string    `json:"podName,omitempty"`
+	PodUID         string    `json:"podUID,omitempty"`
+	ContainerID    string    `json:"containerID"`
+	IfName         string    `json:"ifName"`
+}
+
+// Run runs the hooks subscribed to the event one after another. Failures of
+// hooks with the Fail policy are returned, those of the others are passed to
+// ignored.
+func Run(ctx context.Context, hooks []config.Hook, event Event, ignored func(hook string, err error)) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hook event: %w", err)
+	}
+	for _, hook := range hooks {
+		if !hook.Subscribed(event.Type) {
+			continue
+		}
+		if err := run(ctx, hook, body); err != nil {
+			if hook.FailurePolicy == config.HookFailurePolicyFail {
+				return fmt.Errorf("hook %s failed: %w", hook.Name, err)
+			}
+			ignored(hook.Name, err)
+		}
+	}
+	return nil
+}
+
+func run(ctx context.Context, hook config.Hook, body []byte) error {
+	if hook.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hook.Timeout.Duration)
+		defer cancel()
+	}
+	if len(hook.Command) > 0 {
+		return runCommand(ctx, hook.Command, body)
+	}
+	return post(ctx, hook.URL, body)
+}
+
+func runCommand(ctx context.Context, command []string, body []byte) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if output := truncate(out); output != "" {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+func post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		out, _ := io.ReadAll(io.LimitReader(resp.Body, maxOutput))
+		return fmt.Errorf("status %s: %s", resp.Status, truncate(out))
+	}
+	return nil
+}
+
+func truncate(out []byte) string {
+	s := strings.TrimSpace(string(out))
+	if len(s) > maxOutput {
+		return s[:maxOutput] + "..."
+	}
+	return s
+}
@@ -0,0 +1,74 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+)
+
+func TestRun(t *testing.T) {
+	var received Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if received.IP == "10.0.0.9" {
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer server.Close()
+
+	out := filepath.Join(t.TempDir(), "event.json")
+	hooks := []config.Hook{
+		{Name: "cmdb", Events: []string{config.HookAfterAttach}, Command: []string{"sh", "-c", "cat > " + out}},
+		{Name: "dns", Events: []string{config.HookAfterAttach, config.HookBeforeRelease}, URL: server.URL, FailurePolicy: config.HookFailurePolicyFail},
+		{Name: "firewall", Events: []string{config.HookBeforeRelease}, Command: []string{"sh", "-c", "exit 3"}},
+		{Name: "slow", Events: []string{config.HookBeforeRelease}, Command: []string{"sleep", "5"},
+			Timeout: metav1.Duration{Duration: 50 * time.Millisecond}},
+	}
+
+	var ignored []string
+	collect := func(hook string, err error) { ignored = append(ignored, hook) }
+
+	event := Event{Type: config.HookAfterAttach, IP: "10.0.0.5", ContainerID: "abc", IfName: "eth0"}
+	if err := Run(context.Background(), hooks, event, collect); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("command hook did not run: %v", err)
+	}
+	var written Event
+	if err := json.Unmarshal(data, &written); err != nil || written.IP != "10.0.0.5" {
+		t.Errorf("command hook got %s, want the event", data)
+	}
+	if received.IP != "10.0.0.5" || received.Type != config.HookAfterAttach {
+		t.Errorf("webhook got %+v, want the event", received)
+	}
+	if len(ignored) != 0 {
+		t.Errorf("ignored = %v, want none", ignored)
+	}
+
+	event.Type = config.HookBeforeRelease
+	if err := Run(context.Background(), hooks, event, collect); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(ignored) != 2 || ignored[0] != "firewall" || ignored[1] != "slow" {
+		t.Errorf("ignored = %v, want the failing and timed out Ignore hooks", ignored)
+	}
+
+	event.IP = "10.0.0.9"
+	if err := Run(context.Background(), hooks, event, collect); err == nil {
+		t.Errorf("Run() error = nil, want the failure of the Fail hook")
+	}
+}
@@ -0,0 +1,149 @@
+// Package identity resolves the project, zone and instance gcp-cni works on.
+// On GCE they come from the metadata server; overrides through the
+// environment or the plugin configuration let the plugin and the provisioner
+// run in CI, local kind clusters and against the GCE emulator.
+package identity
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// Environment variables overriding the identity
+const (
+	EnvProject         = "GCP_CNI_PROJECT"
+	EnvZone            = "GCP_CNI_ZONE"
+	EnvInstance        = "GCP_CNI_INSTANCE"
+	EnvComputeEndpoint = "GCP_CNI_COMPUTE_ENDPOINT"
+)
+
+// Overrides replaces what would be read from the metadata server. Empty
+// fields are still read from it.
+type Overrides struct {
+	// Project is the GCP project ID
+	// +optional
+	Project string `json:"project,omitempty"`
+
+	// Zone is the zone of the instance, the region is derived from it
+	// +optional
+	Zone string `json:"zone,omitempty"`
+
+	// Instance is the name of the GCE instance of the node
+	// +optional
+	Instance string `json:"instance,omitempty"`
+
+	// ComputeEndpoint is the base URL of the Compute Engine API, e.g. of an
+	// emulator
+	// +optional
+	ComputeEndpoint string `json:"computeEndpoint,omitempty"`
+}
+
+// FromEnv returns the overrides set through the environment
+func FromEnv() Overrides {
+	return Overrides{
+		Project:         os.Getenv(EnvProject),
+		Zone:            os.Getenv(EnvZone),
+		Instance:        os.Getenv(EnvInstance),
+		ComputeEndpoint: os.Getenv(EnvComputeEndpoint),
+	}
+}
+
+// Merge returns o with its empty fields taken from other
+func (o Overrides) Merge(other Overrides) Overrides {
+	if o.Project == "" {
+		o.Project = other.Project
+	}
+	if o.Zone == "" {
+		o.Zone = other.Zone
+	}
+	if o.Instance == "" {
+		o.Instance = other.Instance
+	}
+	if o.ComputeEndpoint == "" {
+		o.ComputeEndpoint = other.ComputeEndpoint
+	}
+	return o
+}
+
+// Complete reports whether the overrides name the instance, so the metadata
+// server is not needed at all
+func (o Overrides) Complete() bool {
+	return o.Project != "" && o.Zone != "" && o.Instance != ""
+}
+
+// ProjectID returns the project override or the project of the metadata server
+func (o Overrides) ProjectID(ctx context.Context) (string, error) {
+	if o.Project != "" {
+		return o.Project, nil
+	}
+	return metadata.ProjectIDWithContext(ctx)
+}
+
+// ZoneName returns the zone override or the zone of the metadata server
+func (o Overrides) ZoneName(ctx context.Context) (string, error) {
+	if o.Zone != "" {
+		return o.Zone, nil
+	}
+	return metadata.ZoneWithContext(ctx)
+}
+
+// InstanceName returns the instance override or the instance of the metadata server
+func (o Overrides) InstanceName(ctx context.Context) (string, error) {
+	if o.Instance != "" {
+		return o.Instance, nil
+	}
+	return metadata.InstanceNameWithContext(ctx)
+}
+
+// ComputeOptions returns the client options pointing Compute Engine clients
+// at the endpoint override, none without one
+func (o Overrides) ComputeOptions() []option.ClientOption {
+	if o.ComputeEndpoint == "" {
+		return nil
+	}
+	return []option.ClientOption{option.WithEndpoint(o.ComputeEndpoint)}
+}
+
+// ImpersonatedTokenSource returns tokens of serviceAccount obtained with the
+// default credentials. Shared VPC host projects often grant the network roles
+// to a service account of their own rather than to those of the nodes.
+func ImpersonatedTokenSource(ctx context.Context, serviceAccount string) (oauth2.TokenSource, error) {
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: serviceAccount,
+		Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", serviceAccount, err)
+	}
+	return ts, nil
+}
+
+// ParseProviderID returns the project, zone and instance of a node provider
+// ID such as gce://my-project/europe-west1-b/node-1
+func ParseProviderID(providerID string) (project, zone, instance string, err error) {
+	parts := strings.Split(strings.TrimPrefix(providerID, "gce://"), "/")
+	if !strings.HasPrefix(providerID, "gce://") || len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("invalid GCE provider ID %q", providerID)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// ProjectID returns the project from the environment or the metadata server
+func ProjectID(ctx context.Context) (string, error) {
+	return FromEnv().ProjectID(ctx)
+}
+
+// Region returns the region of a zone such as europe-west1-b
+func Region(zone string) (string, error) {
+	if len(zone) <= 2 {
+		return "", fmt.Errorf("cannot determine region from zone: %s", zone)
+	}
+	return zone[:len(zone)-2], nil
+}
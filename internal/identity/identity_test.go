@@ -0,0 +1,38 @@
+package identity
+
+import (
+	"context"
+	"testing"
+)
+
+func TestOverrides(t *testing.T) {
+	t.Setenv(EnvProject, "env-project")
+	t.Setenv(EnvZone, "europe-west1-b")
+	t.Setenv(EnvInstance, "")
+
+	o := Overrides{Project: "conf-project", Instance: "kind-worker"}.Merge(FromEnv())
+	if !o.Complete() {
+		t.Fatalf("Merge() = %+v, want complete overrides", o)
+	}
+	if project, _ := o.ProjectID(context.Background()); project != "conf-project" {
+		t.Errorf("ProjectID() = %q, want the configured project to win over the environment", project)
+	}
+	if region, err := Region(o.Zone); err != nil || region != "europe-west1" {
+		t.Errorf("Region(%q) = %q, %v, want europe-west1", o.Zone, region, err)
+	}
+	if _, err := Region("x"); err == nil {
+		t.Errorf("Region() accepted an invalid zone")
+	}
+}
+
+func TestParseProviderID(t *testing.T) {
+	project, zone, instance, err := ParseProviderID("gce://service-a/europe-west1-b/node-1")
+	if err != nil || project != "service-a" || zone != "europe-west1-b" || instance != "node-1" {
+		t.Errorf("ParseProviderID() = %q, %q, %q, %v", project, zone, instance, err)
+	}
+	for _, invalid := range []string{"", "aws:///eu-west-1a/i-0123", "gce://service-a/node-1", "gce:///europe-west1-b/node-1"} {
+		if _, _, _, err := ParseProviderID(invalid); err == nil {
+			t.Errorf("ParseProviderID(%q) accepted an invalid provider ID", invalid)
+		}
+	}
+}
@@ -1,18 +1,61 @@
 package installer
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 )
 
+// PluginVersionKey is the IPAM config key recording which gcp-ipam release the
+// conflist was written for.
+const PluginVersionKey = "gcpIpamVersion"
+
+// ManagedByKey is the top level config key marking the configuration as
+// written by the installer, ManagedBy is its value.
+const (
+	ManagedByKey = "gcpCniManagedBy"
+	ManagedBy    = "gcp-cni-installer"
+)
+
+// ConfChange classifies a change to the CNI configuration made while the
+// installer guards it
+type ConfChange string
+
+const (
+	// ConfChangeOwn leaves the configuration exactly as the installer writes it
+	ConfChangeOwn ConfChange = "own"
+
+	// ConfChangeBenign keeps every IPAM section on gcp-ipam, e.g. another agent
+	// reformatting the file, dropping the marker or adding a plugin
+	ConfChangeBenign ConfChange = "benign"
+
+	// ConfChangeConflicting switched an IPAM section away from gcp-ipam or its
+	// release, e.g. GKE netd resetting it to host-local
+	ConfChangeConflicting ConfChange = "conflicting"
+)
+
 type CNIConfig struct {
 	CNIVersion string                   `json:"cniVersion"`
 	Name       string                   `json:"name"`
+	ManagedBy  string                   `json:"gcpCniManagedBy,omitempty"`
 	Plugins    []map[string]interface{} `json:"plugins"`
 }
 
-func UpdateCNIIPAM(data []byte, ipamType string, logger *slog.Logger) ([]byte, error) {
+// UpdateCNIIPAM switches every IPAM section in the conflist, or the IPAM
+// section of a single-plugin .conf, to ipamType. A non-empty pluginVersion is
+// recorded next to the type and the configuration is marked as managed by the
+// installer, otherwise the version and the marker are dropped. The
+// configuration keeps its format.
+func UpdateCNIIPAM(data []byte, ipamType, pluginVersion string, logger *slog.Logger) ([]byte, error) {
+	list, err := IsConfList(data)
+	if err != nil {
+		return nil, err
+	}
+	if !list {
+		return updateConfIPAM(data, ipamType, pluginVersion, logger)
+	}
+
 	var config CNIConfig
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse CNI config: %w", err)
@@ -25,7 +68,7 @@ func UpdateCNIIPAM(data []byte, ipamType string, logger *slog.Logger) ([]byte, e
 			continue
 		}
 
-		ipam["type"] = ipamType
+		setIPAM(ipam, ipamType, pluginVersion)
 		config.Plugins[i] = plugin
 		modified = true
 		logger.Info("Updated IPAM plugin to use gcp-ipam IPAM")
@@ -35,6 +78,10 @@ func UpdateCNIIPAM(data []byte, ipamType string, logger *slog.Logger) ([]byte, e
 		logger.Warn("No IPAM plugin found in CNI configuration")
 		return nil, nil
 	}
+	config.ManagedBy = ""
+	if pluginVersion != "" {
+		config.ManagedBy = ManagedBy
+	}
 
 	updatedData, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
@@ -42,3 +89,147 @@ func UpdateCNIIPAM(data []byte, ipamType string, logger *slog.Logger) ([]byte, e
 	}
 	return updatedData, nil
 }
+
+func updateConfIPAM(data []byte, ipamType, pluginVersion string, logger *slog.Logger) ([]byte, error) {
+	var plugin map[string]interface{}
+	if err := json.Unmarshal(data, &plugin); err != nil {
+		return nil, fmt.Errorf("failed to parse CNI config: %w", err)
+	}
+
+	ipam, ok := plugin["ipam"].(map[string]interface{})
+	if !ok {
+		logger.Warn("No IPAM section found in single-plugin CNI configuration")
+		return nil, nil
+	}
+	setIPAM(ipam, ipamType, pluginVersion)
+	if pluginVersion != "" {
+		plugin[ManagedByKey] = ManagedBy
+	} else {
+		delete(plugin, ManagedByKey)
+	}
+	logger.Info("Updated IPAM of single-plugin configuration to use gcp-ipam IPAM")
+
+	updatedData, err := json.MarshalIndent(plugin, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal updated config: %w", err)
+	}
+	return updatedData, nil
+}
+
+func setIPAM(ipam map[string]interface{}, ipamType, pluginVersion string) {
+	ipam["type"] = ipamType
+	if pluginVersion != "" {
+		ipam[PluginVersionKey] = pluginVersion
+	} else {
+		delete(ipam, PluginVersionKey)
+	}
+}
+
+// IsConfList reports whether data is a conflist rather than a single-plugin
+// .conf configuration.
+func IsConfList(data []byte) (bool, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return false, fmt.Errorf("failed to parse CNI config: %w", err)
+	}
+	_, ok := raw["plugins"]
+	return ok, nil
+}
+
+// ConvertToConfList wraps a single-plugin configuration in a conflist with the
+// same name and version, the way libcni loads .conf files. Container runtimes
+// parse a .conflist file as a list, so a single plugin written to one has to
+// be converted.
+func ConvertToConfList(data []byte) ([]byte, error) {
+	var plugin map[string]interface{}
+	if err := json.Unmarshal(data, &plugin); err != nil {
+		return nil, fmt.Errorf("failed to parse CNI config: %w", err)
+	}
+
+	config := CNIConfig{Plugins: []map[string]interface{}{plugin}}
+	config.CNIVersion, _ = plugin["cniVersion"].(string)
+	config.Name, _ = plugin["name"].(string)
+	// The marker belongs to the file, not the plugin
+	if managedBy, ok := plugin[ManagedByKey].(string); ok {
+		config.ManagedBy = managedBy
+		delete(plugin, ManagedByKey)
+	}
+
+	listData, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal converted config: %w", err)
+	}
+	return listData, nil
+}
+
+// ConfiguredPluginVersion returns the gcp-ipam version recorded in the first
+// IPAM section of the conflist or .conf, or an empty string if none is recorded.
+func ConfiguredPluginVersion(data []byte) (string, error) {
+	sections, err := ipamSections(data)
+	if err != nil || len(sections) == 0 {
+		return "", err
+	}
+	version, _ := sections[0][PluginVersionKey].(string)
+	return version, nil
+}
+
+// ClassifyConfChange tells whether the configuration is exactly what the
+// installer writes for ipamType and pluginVersion, still uses them in every
+// IPAM section after another agent changed it, or no longer does.
+func ClassifyConfChange(data []byte, ipamType, pluginVersion string) (ConfChange, error) {
+	sections, err := ipamSections(data)
+	if err != nil {
+		return "", err
+	}
+	if len(sections) == 0 {
+		return ConfChangeConflicting, nil
+	}
+	for _, ipam := range sections {
+		version, _ := ipam[PluginVersionKey].(string)
+		if ipam["type"] != ipamType || version != pluginVersion {
+			return ConfChangeConflicting, nil
+		}
+	}
+
+	// Writing the configuration again is a no-op only for our own output
+	rewritten, err := UpdateCNIIPAM(data, ipamType, pluginVersion, slog.New(slog.DiscardHandler))
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(rewritten, data) {
+		return ConfChangeOwn, nil
+	}
+	return ConfChangeBenign, nil
+}
+
+// ipamSections returns the IPAM sections of the conflist plugins in order, or
+// the IPAM section of a .conf
+func ipamSections(data []byte) ([]map[string]interface{}, error) {
+	list, err := IsConfList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var plugins []map[string]interface{}
+	if list {
+		var config CNIConfig
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse CNI config: %w", err)
+		}
+		plugins = config.Plugins
+	} else {
+		var plugin map[string]interface{}
+		if err := json.Unmarshal(data, &plugin); err != nil {
+			return nil, fmt.Errorf("failed to parse CNI config: %w", err)
+		}
+		plugins = []map[string]interface{}{plugin}
+	}
+
+	var sections []map[string]interface{}
+	for _, plugin := range plugins {
+		if ipam, ok := plugin["ipam"].(map[string]interface{}); ok {
+			sections = append(sections, ipam)
+		}
+	}
+	return sections, nil
+}
@@ -0,0 +1,72 @@
+package installer
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestUpdateCNIIPAMSingleConf(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	conf := []byte(`{"cniVersion": "0.4.0", "name": "bridge", "type": "bridge", "bridge": "cni0", "ipam": {"type": "host-local", "subnet": "10.1.0.0/24"}}`)
+
+	updated, err := UpdateCNIIPAM(conf, "gcp-ipam", "v1.2.3", logger)
+	if err != nil {
+		t.Fatalf("UpdateCNIIPAM() error = %v", err)
+	}
+	if list, _ := IsConfList(updated); list {
+		t.Errorf("UpdateCNIIPAM() converted the .conf to a conflist:\n%s", updated)
+	}
+	if version, _ := ConfiguredPluginVersion(updated); version != "v1.2.3" {
+		t.Errorf("ConfiguredPluginVersion() = %q, want v1.2.3", version)
+	}
+
+	reverted, err := UpdateCNIIPAM(updated, "host-local", "", logger)
+	if err != nil {
+		t.Fatalf("UpdateCNIIPAM() revert error = %v", err)
+	}
+	if version, _ := ConfiguredPluginVersion(reverted); version != "" {
+		t.Errorf("ConfiguredPluginVersion() after revert = %q, want none", version)
+	}
+
+	list, err := ConvertToConfList(reverted)
+	if err != nil {
+		t.Fatalf("ConvertToConfList() error = %v", err)
+	}
+	parsed, err := parseNetworkList(list)
+	if err != nil {
+		t.Fatalf("parseNetworkList() error = %v", err)
+	}
+	if parsed.Name != "bridge" || len(parsed.Plugins) != 1 || parsed.Plugins[0].Network.IPAM.Type != "host-local" {
+		t.Errorf("ConvertToConfList() = %s", list)
+	}
+}
+
+func TestClassifyConfChange(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	original := []byte(`{"cniVersion": "0.4.0", "name": "k8s-pod-network", "plugins": [{"type": "ptp", "ipam": {"type": "host-local"}}]}`)
+	own, err := UpdateCNIIPAM(original, "gcp-ipam", "v1.2.3", logger)
+	if err != nil {
+		t.Fatalf("UpdateCNIIPAM() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data string
+		want ConfChange
+	}{
+		{"own", string(own), ConfChangeOwn},
+		{"reformatted", `{"cniVersion": "0.4.0", "name": "k8s-pod-network", "plugins": [{"type": "ptp", "ipam": {"type": "gcp-ipam", "gcpIpamVersion": "v1.2.3"}}, {"type": "portmap"}]}`, ConfChangeBenign},
+		{"reset to host-local", string(original), ConfChangeConflicting},
+		{"stale version", `{"plugins": [{"type": "ptp", "ipam": {"type": "gcp-ipam", "gcpIpamVersion": "v1.2.2"}}]}`, ConfChangeConflicting},
+	}
+	for _, tt := range tests {
+		got, err := ClassifyConfChange([]byte(tt.data), "gcp-ipam", "v1.2.3")
+		if err != nil {
+			t.Fatalf("ClassifyConfChange(%s) error = %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("ClassifyConfChange(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
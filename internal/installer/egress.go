@@ -0,0 +1,36 @@
+package installer
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// EgressChain is the nat table chain holding the egress SNAT rules
+const EgressChain = "GCP-CNI-EGRESS"
+
+// EgressRule translates the source of traffic from a pod to its namespace's egress IP
+type EgressRule struct {
+	PodIP    string
+	EgressIP string
+}
+
+// RenderEgressRules returns iptables-restore input that replaces the content
+// of EgressChain. Traffic to excludedCIDRs keeps the pod IP.
+func RenderEgressRules(rules []EgressRule, excludedCIDRs []string) []byte {
+	sorted := append([]EgressRule(nil), rules...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PodIP < sorted[j].PodIP })
+
+	var b bytes.Buffer
+	b.WriteString("*nat\n")
+	// Declaring the chain flushes it, even with --noflush
+	fmt.Fprintf(&b, ":%s - [0:0]\n", EgressChain)
+	for _, cidr := range excludedCIDRs {
+		fmt.Fprintf(&b, "-A %s -d %s -j RETURN\n", EgressChain, cidr)
+	}
+	for _, rule := range sorted {
+		fmt.Fprintf(&b, "-A %s -s %s/32 -j SNAT --to-source %s\n", EgressChain, rule.PodIP, rule.EgressIP)
+	}
+	b.WriteString("COMMIT\n")
+	return b.Bytes()
+}
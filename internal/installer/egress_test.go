@@ -0,0 +1,21 @@
+package installer
+
+import "testing"
+
+func TestRenderEgressRules(t *testing.T) {
+	got := string(RenderEgressRules([]EgressRule{
+		{PodIP: "10.1.0.6", EgressIP: "10.2.0.2"},
+		{PodIP: "10.1.0.5", EgressIP: "10.2.0.1"},
+	}, []string{"10.0.0.0/8"}))
+
+	want := `*nat
+:GCP-CNI-EGRESS - [0:0]
+-A GCP-CNI-EGRESS -d 10.0.0.0/8 -j RETURN
+-A GCP-CNI-EGRESS -s 10.1.0.5/32 -j SNAT --to-source 10.2.0.1
+-A GCP-CNI-EGRESS -s 10.1.0.6/32 -j SNAT --to-source 10.2.0.2
+COMMIT
+`
+	if got != want {
+		t.Errorf("RenderEgressRules() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package installer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// selfManagedPlugins are interface plugins that assign pod addresses on their
+// own or delegate to other configurations, and ignore the result of the IPAM
+// plugin of their section
+var selfManagedPlugins = map[string]bool{
+	"aws-cni":             true,
+	"azure-vnet":          true,
+	"cilium-cni":          true,
+	"multus":              true,
+	"multus-shim":         true,
+	"ovn-k8s-cni-overlay": true,
+	"weave-net":           true,
+}
+
+// ShapeProblem is a reason switching the IPAM of a CNI configuration to
+// gcp-ipam would leave pods without a working network
+type ShapeProblem struct {
+	Plugin string
+	Reason string
+}
+
+func (p ShapeProblem) String() string {
+	if p.Plugin == "" {
+		return p.Reason
+	}
+	return fmt.Sprintf("plugin %s: %s", p.Plugin, p.Reason)
+}
+
+// CheckConfShape reports the problems of the conflist or .conf the installer
+// would switch to gcp-ipam: no IPAM section, IPAM only on chained plugins, an
+// interface plugin that ignores IPAM results, several plugins allocating per
+// pod, or no loopback plugin in binDirs for the runtime to set up lo with.
+func CheckConfShape(data []byte, binDirs []string) ([]ShapeProblem, error) {
+	list, err := parseNetworkList(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CNI config: %w", err)
+	}
+
+	var problems []ShapeProblem
+	var withIPAM []string
+	for i, plugin := range list.Plugins {
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(plugin.Bytes, &raw); err != nil {
+			return nil, fmt.Errorf("failed to parse plugin %s: %w", plugin.Network.Type, err)
+		}
+		if _, ok := raw["ipam"]; !ok {
+			continue
+		}
+		withIPAM = append(withIPAM, plugin.Network.Type)
+
+		switch {
+		case i > 0 && len(withIPAM) == 1:
+			problems = append(problems, ShapeProblem{Plugin: plugin.Network.Type,
+				Reason: fmt.Sprintf("chained after the interface plugin %s, which has no IPAM section", list.Plugins[0].Network.Type)})
+		case i == 0 && selfManagedPlugins[plugin.Network.Type]:
+			problems = append(problems, ShapeProblem{Plugin: plugin.Network.Type,
+				Reason: "assigns pod addresses itself and ignores the IPAM result"})
+		}
+	}
+	if len(withIPAM) == 0 {
+		problems = append(problems, ShapeProblem{Reason: "no plugin has an IPAM section to delegate to gcp-ipam"})
+	}
+	if len(withIPAM) > 1 {
+		problems = append(problems, ShapeProblem{
+			Reason: fmt.Sprintf("plugins %s each have an IPAM section and would allocate an alias IP per pod each", strings.Join(withIPAM, ", "))})
+	}
+
+	if len(binDirs) > 0 && !pluginInstalled("loopback", binDirs) {
+		problems = append(problems, ShapeProblem{Plugin: "loopback",
+			Reason: fmt.Sprintf("not found in %s, the runtime cannot bring up lo in pods", strings.Join(binDirs, ", "))})
+	}
+	return problems, nil
+}
+
+func pluginInstalled(name string, binDirs []string) bool {
+	for _, dir := range binDirs {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package installer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckConfShape(t *testing.T) {
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "loopback"), nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		binDirs []string
+		want    int
+	}{
+		{"ptp with portmap", `{"cniVersion": "0.4.0", "name": "k8s", "plugins": [{"type": "ptp", "ipam": {"type": "host-local"}}, {"type": "portmap"}]}`, []string{binDir}, 0},
+		{"single conf", `{"cniVersion": "0.4.0", "name": "k8s", "type": "bridge", "ipam": {"type": "host-local"}}`, []string{binDir}, 0},
+		{"no ipam", `{"cniVersion": "0.4.0", "name": "k8s", "plugins": [{"type": "ptp"}]}`, []string{binDir}, 1},
+		{"ipam on chained plugin", `{"cniVersion": "0.4.0", "name": "k8s", "plugins": [{"type": "ptp"}, {"type": "bandwidth", "ipam": {"type": "host-local"}}]}`, []string{binDir}, 1},
+		{"self-managed", `{"cniVersion": "0.4.0", "name": "k8s", "plugins": [{"type": "cilium-cni", "ipam": {"type": "host-local"}}]}`, []string{binDir}, 1},
+		{"ipam twice", `{"cniVersion": "0.4.0", "name": "k8s", "plugins": [{"type": "ptp", "ipam": {"type": "host-local"}}, {"type": "tuning", "ipam": {"type": "host-local"}}]}`, []string{binDir}, 1},
+		{"no loopback", `{"cniVersion": "0.4.0", "name": "k8s", "plugins": [{"type": "ptp", "ipam": {"type": "host-local"}}]}`, []string{t.TempDir()}, 1},
+	}
+	for _, tt := range tests {
+		problems, err := CheckConfShape([]byte(tt.data), tt.binDirs)
+		if err != nil {
+			t.Fatalf("CheckConfShape(%s) error = %v", tt.name, err)
+		}
+		if len(problems) != tt.want {
+			t.Errorf("CheckConfShape(%s) = %v, want %d problems", tt.name, problems, tt.want)
+		}
+	}
+}
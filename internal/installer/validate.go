@@ -0,0 +1,61 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/containernetworking/cni/libcni"
+)
+
+// ValidateCNIConfig checks that the conflist or .conf parses and that every
+// plugin it references, including delegated IPAM plugins, exists in binDirs
+// and supports the configured CNI version.
+func ValidateCNIConfig(ctx context.Context, data []byte, binDirs []string) error {
+	list, err := parseNetworkList(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse CNI config: %w", err)
+	}
+
+	cniConfig := libcni.NewCNIConfig(binDirs, nil)
+	if _, err := cniConfig.ValidateNetworkList(ctx, list); err != nil {
+		return fmt.Errorf("failed to validate CNI plugins: %w", err)
+	}
+
+	// libcni only checks the top level plugins, IPAM plugins are exec'd by them
+	for _, plugin := range list.Plugins {
+		ipamType := plugin.Network.IPAM.Type
+		if ipamType == "" {
+			continue
+		}
+
+		info, err := cniConfig.GetVersionInfo(ctx, ipamType)
+		if err != nil {
+			return fmt.Errorf("failed to get version of IPAM plugin %s: %w", ipamType, err)
+		}
+
+		if list.CNIVersion != "" && !slices.Contains(info.SupportedVersions(), list.CNIVersion) {
+			return fmt.Errorf("IPAM plugin %s does not support config version %q", ipamType, list.CNIVersion)
+		}
+	}
+
+	return nil
+}
+
+// parseNetworkList loads a conflist, or a .conf as the single plugin of a list
+// like container runtimes do
+func parseNetworkList(data []byte) (*libcni.NetworkConfigList, error) {
+	isList, err := IsConfList(data)
+	if err != nil {
+		return nil, err
+	}
+	if isList {
+		return libcni.ConfListFromBytes(data)
+	}
+
+	conf, err := libcni.ConfFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return libcni.ConfListFromConf(conf)
+}
@@ -0,0 +1,99 @@
+package instance
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gofrs/flock"
+	"google.golang.org/api/compute/v1"
+)
+
+// DefaultCachePath holds what the plugin knows about the instance it runs on
+const DefaultCachePath = "/var/run/gcp-ipam-instance.json"
+
+// Cache saves plugin invocations from asking the metadata server and GCE for
+// facts about the instance that do not change between them. The identity never
+// changes for the lifetime of a VM and /var/run is cleared on reboot. The
+// network interface is only valid until the next mutation, after which its
+// fingerprint is stale and it has to be read from GCE again.
+type Cache struct {
+	ProjectID    string `json:"projectID,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+	Region       string `json:"region,omitempty"`
+	InstanceName string `json:"instanceName,omitempty"`
+
+	// SubnetworkCIDRs maps subnetwork names to their primary range
+	SubnetworkCIDRs map[string]string `json:"subnetworkCIDRs,omitempty"`
+
+	// NIC is the pod network interface as last read from GCE, nil once a
+	// mutation made its fingerprint stale
+	NIC *compute.NetworkInterface `json:"nic,omitempty"`
+}
+
+// HasIdentity reports whether the instance identity is cached
+func (c *Cache) HasIdentity() bool {
+	return c.ProjectID != "" && c.Zone != "" && c.Region != "" && c.InstanceName != ""
+}
+
+// Load reads the cache at path, empty if there is none or it is unreadable
+func Load(path string) (*Cache, error) {
+	cache := &Cache{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, fmt.Errorf("failed to read instance cache: %w", err)
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		return &Cache{}, fmt.Errorf("failed to parse instance cache: %w", err)
+	}
+	return cache, nil
+}
+
+// Save writes the cache to path. Several invocations may hold a slot of the
+// node mutation queue at once, so it is written under a file lock next to it.
+func (c *Cache) Save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal instance cache: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create instance cache directory: %w", err)
+	}
+	lock := flock.New(path + ".lock")
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("failed to lock instance cache: %w", err)
+	}
+	defer lock.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write instance cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write instance cache: %w", err)
+	}
+	return nil
+}
+
+// Invalidate drops the cache at path, the next invocation reads everything again
+func Invalidate(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove instance cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package instance
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestCacheRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instance.json")
+
+	cache, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.HasIdentity() {
+		t.Fatal("missing cache has identity")
+	}
+
+	cache.ProjectID, cache.Zone, cache.Region, cache.InstanceName = "project", "europe-west1-b", "europe-west1", "node-1"
+	cache.NIC = &compute.NetworkInterface{Name: "nic0", Fingerprint: "abc"}
+	if err := cache.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.HasIdentity() || again.InstanceName != "node-1" {
+		t.Errorf("identity = %+v, want cached", again)
+	}
+	if again.NIC == nil || again.NIC.Fingerprint != "abc" {
+		t.Errorf("NIC = %+v, want cached fingerprint", again.NIC)
+	}
+
+	if err := Invalidate(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := Invalidate(path); err != nil {
+		t.Errorf("Invalidate() of missing cache error = %v", err)
+	}
+	if cache, _ := Load(path); cache.HasIdentity() {
+		t.Error("invalidated cache still has identity")
+	}
+}
+
+func TestSaveConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instance.json")
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache := &Cache{ProjectID: "project", Zone: "europe-west1-b", Region: "europe-west1", InstanceName: fmt.Sprintf("node-%d", i)}
+			if err := cache.Save(path); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	cache, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() after concurrent saves error = %v", err)
+	}
+	if !cache.HasIdentity() {
+		t.Errorf("cache = %+v, want one of the saved ones", cache)
+	}
+	if leftovers, _ := filepath.Glob(path + ".*.tmp"); len(leftovers) > 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+}
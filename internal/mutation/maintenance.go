@@ -0,0 +1,75 @@
+package mutation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultMaintenancePath marks the node mutations held by the installer while
+// GCE live-migrates the instance to another host
+const DefaultMaintenancePath = "/var/run/gcp-ipam-maintenance.json"
+
+// Maintenance is a host maintenance event the node mutations are held for
+type Maintenance struct {
+	Event string    `json:"event"`
+	Since time.Time `json:"since"`
+}
+
+// ReadMaintenance returns the maintenance the node mutations are held for,
+// nil when they are not
+func ReadMaintenance(path string) (*Maintenance, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance state: %w", err)
+	}
+	var m Maintenance
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse maintenance state: %w", err)
+	}
+	return &m, nil
+}
+
+// WriteMaintenance records that the node mutations are held for m
+func WriteMaintenance(path string, m Maintenance) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal maintenance state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create maintenance state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write maintenance state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write maintenance state: %w", err)
+	}
+	return nil
+}
+
+// ClearMaintenance records that the node mutations are no longer held
+func ClearMaintenance(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear maintenance state: %w", err)
+	}
+	return nil
+}
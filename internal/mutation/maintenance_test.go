@@ -0,0 +1,36 @@
+package mutation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance.json")
+	if m, err := ReadMaintenance(path); m != nil || err != nil {
+		t.Fatalf("ReadMaintenance() without state = %+v, %v, want none", m, err)
+	}
+
+	since := time.Now().Truncate(time.Second)
+	if err := WriteMaintenance(path, Maintenance{Event: "MIGRATE_ON_HOST_MAINTENANCE", Since: since}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Fatalf("state directory holds %v, %v, want only the state", entries, err)
+	}
+	m, err := ReadMaintenance(path)
+	if err != nil || m == nil || m.Event != "MIGRATE_ON_HOST_MAINTENANCE" || !m.Since.Equal(since) {
+		t.Fatalf("ReadMaintenance() = %+v, %v, want the written state", m, err)
+	}
+
+	for range 2 {
+		if err := ClearMaintenance(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, err := ReadMaintenance(path); m != nil || err != nil {
+		t.Errorf("ReadMaintenance() after clearing = %+v, %v, want none", m, err)
+	}
+}
@@ -0,0 +1,181 @@
+package mutation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// DefaultPacerPath holds the GCE call pacing state shared by plugin invocations
+const DefaultPacerPath = "/var/run/gcp-ipam-pacing.json"
+
+// PacerConfig bounds the spacing between plugin invocations calling GCE
+type PacerConfig struct {
+	// Initial is the spacing a cold node starts from
+	Initial time.Duration
+	// Min is the spacing the node ramps down to while calls succeed
+	Min time.Duration
+	// Max caps the spacing after repeated quota errors
+	Max time.Duration
+	// IdleReset is how long the node has to be quiet to start cold again
+	IdleReset time.Duration
+}
+
+// PacerState is the pacing state persisted between plugin invocations
+type PacerState struct {
+	Interval  time.Duration `json:"interval"`
+	Last      time.Time     `json:"last"`
+	Throttled time.Time     `json:"throttled,omitempty"`
+}
+
+// Next is the earliest time the next invocation may call GCE
+func (s PacerState) Next() time.Time {
+	return s.Last.Add(s.Interval)
+}
+
+// Pacer spaces GCE calls of plugin invocations on a node, like TCP slow
+// start: a cold node starts with a wide spacing that halves after every
+// successful invocation, and quota errors double it again. A node booting with
+// dozens of pods so ramps up instead of bursting into project-wide quotas.
+//
+// The state lives in a file since every invocation is a separate process,
+// guarded by a file lock next to it as several invocations may hold a slot of
+// the node mutation queue at once.
+type Pacer struct {
+	path  string
+	lock  *flock.Flock
+	cfg   PacerConfig
+	state PacerState
+}
+
+func NewPacer(path string, cfg PacerConfig) *Pacer {
+	return &Pacer{path: path, lock: flock.New(path + ".lock"), cfg: cfg}
+}
+
+// Wait blocks until the node may call GCE again and returns how long it waited.
+// The start is reserved in the state right away, so invocations waiting
+// concurrently are spaced by the interval too.
+func (p *Pacer) Wait(ctx context.Context) (time.Duration, error) {
+	if _, err := p.lock.TryLockContext(ctx, 10*time.Millisecond); err != nil {
+		return 0, fmt.Errorf("failed to lock pacing state: %w", err)
+	}
+	err := p.load()
+	start := time.Now()
+	if err == nil {
+		if next := p.state.Next(); next.After(start) {
+			start = next
+		}
+		p.state.Last = start
+		err = writePacerState(p.path, p.state)
+	}
+	_ = p.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return 0, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(delay):
+		return delay, nil
+	}
+}
+
+// Bypass lets an invocation too urgent to be paced call GCE right away. Its
+// outcome is still observed, so quota errors slow down the others.
+func (p *Pacer) Bypass() error {
+	return p.load()
+}
+
+func (p *Pacer) load() error {
+	state, err := ReadPacerState(p.path)
+	if err != nil {
+		return err
+	}
+	if state.Last.IsZero() || time.Since(state.Last) > p.cfg.IdleReset {
+		state = PacerState{Interval: p.cfg.Initial}
+	}
+	p.state = state
+	return nil
+}
+
+// Observe records the outcome of the invocation's GCE calls. retryAfter is the
+// backoff the API asked for, if any.
+func (p *Pacer) Observe(throttled bool, retryAfter time.Duration) error {
+	if err := p.lock.Lock(); err != nil {
+		return fmt.Errorf("failed to lock pacing state: %w", err)
+	}
+	defer p.lock.Unlock()
+	// Other invocations may have observed or reserved a start meanwhile
+	if err := p.load(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.After(p.state.Last) {
+		p.state.Last = now
+	}
+
+	if throttled {
+		p.state.Throttled = now
+		p.state.Interval = max(2*p.state.Interval, p.cfg.Initial)
+		p.state.Interval = min(p.state.Interval, p.cfg.Max)
+		// The API knows better than our estimate
+		p.state.Interval = max(p.state.Interval, retryAfter)
+	} else {
+		p.state.Interval = max(p.state.Interval/2, p.cfg.Min)
+	}
+
+	return writePacerState(p.path, p.state)
+}
+
+// Interval is the spacing the next invocation will wait for
+func (p *Pacer) Interval() time.Duration {
+	return p.state.Interval
+}
+
+// ReadPacerState returns the persisted pacing state, empty if there is none
+func ReadPacerState(path string) (PacerState, error) {
+	var state PacerState
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read pacing state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		// A torn write only costs a cold start
+		return PacerState{}, nil
+	}
+	return state, nil
+}
+
+func writePacerState(path string, state PacerState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pacing state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create pacing state directory: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write pacing state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write pacing state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package mutation
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPacerSlowStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pacing.json")
+	cfg := PacerConfig{
+		Initial:   time.Second,
+		Min:       100 * time.Millisecond,
+		Max:       8 * time.Second,
+		IdleReset: time.Hour,
+	}
+
+	// Every invocation is a new process with a fresh pacer
+	invoke := func(throttled bool, retryAfter time.Duration) time.Duration {
+		t.Helper()
+		p := NewPacer(path, cfg)
+		state, err := ReadPacerState(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !state.Last.IsZero() {
+			// Skip the actual wait, only the interval arithmetic is under test
+			state.Last = time.Now().Add(-state.Interval)
+			if err := writePacerState(path, state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := p.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Observe(throttled, retryAfter); err != nil {
+			t.Fatal(err)
+		}
+		return p.Interval()
+	}
+
+	steps := []struct {
+		throttled  bool
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{want: 500 * time.Millisecond},
+		{want: 250 * time.Millisecond},
+		{want: 125 * time.Millisecond},
+		{want: 100 * time.Millisecond},
+		{throttled: true, want: time.Second},
+		{throttled: true, want: 2 * time.Second},
+		{throttled: true, retryAfter: 20 * time.Second, want: 20 * time.Second},
+		{throttled: true, want: 8 * time.Second},
+		{want: 4 * time.Second},
+	}
+	for i, step := range steps {
+		if got := invoke(step.throttled, step.retryAfter); got != step.want {
+			t.Fatalf("step %d: interval = %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestPacerIdleReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pacing.json")
+	cfg := PacerConfig{Initial: time.Second, Max: time.Minute, IdleReset: time.Minute}
+
+	if err := writePacerState(path, PacerState{Interval: time.Minute, Last: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPacer(path, cfg)
+	waited, err := p.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited != 0 {
+		t.Errorf("waited %v after idle period, want no wait", waited)
+	}
+	if p.Interval() != time.Second {
+		t.Errorf("interval = %v, want cold start %v", p.Interval(), time.Second)
+	}
+}
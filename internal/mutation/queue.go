@@ -0,0 +1,268 @@
+package mutation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// Priority orders GCE network interface mutations queued on a node.
+// Lower values are served first.
+type Priority int
+
+const (
+	PriorityCritical Priority = iota
+	PriorityMigration
+	PriorityNewPod
+	PriorityCleanup
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityCritical:
+		return "critical"
+	case PriorityMigration:
+		return "migration"
+	case PriorityNewPod:
+		return "new-pod"
+	case PriorityCleanup:
+		return "cleanup"
+	default:
+		return fmt.Sprintf("priority-%d", int(p))
+	}
+}
+
+// MarshalText renders the priority by name in JSON output
+func (p Priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+const (
+	// DefaultLockPath is the node file lock held while mutating the instance,
+	// shared by plugin invocations and exclusive for node agents
+	DefaultLockPath = "/var/run/gcp-ipam.lock"
+	// DefaultQueueDir holds one ticket per waiting plugin invocation
+	DefaultQueueDir = "/var/run/gcp-ipam-queue"
+	// DefaultPoolQueueDir holds the update queue of every pool, see NewPoolQueue
+	DefaultPoolQueueDir = "/var/run/gcp-ipam-pool-queue"
+
+	pollDelay = 50 * time.Millisecond
+)
+
+// Queue bounds the UpdateNetworkInterface calls of plugin invocations running
+// concurrently on the same node to a number of slots, one by default. Every
+// waiter registers a ticket in the queue directory and only takes a free slot
+// once its ticket is at the head of the queue, so live-migration moves are not
+// stuck behind a backlog of routine deletes.
+//
+// Holders also share the lock at lockPath, which node agents take exclusively
+// to keep every plugin invocation out however many slots there are.
+type Queue struct {
+	gate   *flock.Flock
+	slots  []*flock.Flock
+	held   *flock.Flock
+	dir    string
+	ticket string
+}
+
+// NewQueue returns the queue of the lock at lockPath that slots invocations
+// hold at once
+func NewQueue(lockPath, dir string, slots int) *Queue {
+	q := &Queue{
+		gate: flock.New(lockPath),
+		dir:  dir,
+	}
+	for i := range max(slots, 1) {
+		q.slots = append(q.slots, flock.New(fmt.Sprintf("%s.%d", lockPath, i)))
+	}
+	return q
+}
+
+// NewPoolQueue returns the queue of updates of a pool from the node, that
+// slots invocations make at once
+func NewPoolQueue(dir, pool string, slots int) *Queue {
+	return NewQueue(filepath.Join(dir, pool+".lock"), filepath.Join(dir, pool), slots)
+}
+
+// Acquire blocks until the caller holds the node mutation lock.
+func (q *Queue) Acquire(ctx context.Context, prio Priority) error {
+	if err := os.MkdirAll(q.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create mutation queue directory: %w", err)
+	}
+
+	name := ticketName(prio, time.Now(), os.Getpid())
+	q.ticket = filepath.Join(q.dir, name)
+	if err := os.WriteFile(q.ticket, nil, 0o644); err != nil {
+		return fmt.Errorf("failed to register mutation queue ticket: %w", err)
+	}
+
+	for {
+		head, err := q.head()
+		if err != nil {
+			q.dropTicket()
+			return err
+		}
+
+		if head == name {
+			locked, err := q.tryLock()
+			if err != nil {
+				q.dropTicket()
+				return fmt.Errorf("failed to acquire mutation lock: %w", err)
+			}
+			if locked {
+				q.dropTicket()
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			q.dropTicket()
+			return ctx.Err()
+		case <-time.After(pollDelay):
+		}
+	}
+}
+
+// Release gives up the node mutation lock.
+func (q *Queue) Release() error {
+	if q.held == nil {
+		return nil
+	}
+	err := errors.Join(q.held.Unlock(), q.gate.Unlock())
+	q.held = nil
+	return err
+}
+
+// tryLock takes the first free slot and shares the gate lock
+func (q *Queue) tryLock() (bool, error) {
+	for _, slot := range q.slots {
+		locked, err := slot.TryLock()
+		if err != nil {
+			return false, err
+		}
+		if !locked {
+			continue
+		}
+
+		shared, err := q.gate.TryRLock()
+		if err != nil || !shared {
+			_ = slot.Unlock()
+			return false, err
+		}
+		q.held = slot
+		return true, nil
+	}
+	return false, nil
+}
+
+// head returns the ticket that is next in line, pruning tickets left behind by
+// plugin processes that no longer exist.
+func (q *Queue) head() (string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read mutation queue: %w", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !ticketOwnerAlive(e.Name()) {
+			_ = os.Remove(filepath.Join(q.dir, e.Name()))
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	sort.Strings(names)
+	return names[0], nil
+}
+
+func (q *Queue) dropTicket() {
+	if q.ticket == "" {
+		return
+	}
+	_ = os.Remove(q.ticket)
+	q.ticket = ""
+}
+
+// Ticket is a plugin invocation waiting for the node mutation lock
+type Ticket struct {
+	Priority Priority  `json:"priority"`
+	Since    time.Time `json:"since"`
+	PID      int       `json:"pid"`
+}
+
+// Pending lists the tickets waiting in the queue directory, next in line first
+func Pending(dir string) ([]Ticket, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mutation queue: %w", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	tickets := make([]Ticket, 0, len(names))
+	for _, name := range names {
+		if ticket, ok := parseTicket(name); ok {
+			tickets = append(tickets, ticket)
+		}
+	}
+	return tickets, nil
+}
+
+// Ticket names sort by priority first and arrival time second
+func ticketName(prio Priority, since time.Time, pid int) string {
+	return fmt.Sprintf("%d-%020d-%d", prio, since.UnixNano(), pid)
+}
+
+func parseTicket(name string) (Ticket, bool) {
+	parts := strings.Split(name, "-")
+	if len(parts) != 3 {
+		return Ticket{}, false
+	}
+	prio, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Ticket{}, false
+	}
+	since, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Ticket{}, false
+	}
+	pid, err := strconv.Atoi(parts[2])
+	if err != nil || pid <= 0 {
+		return Ticket{}, false
+	}
+	return Ticket{Priority: Priority(prio), Since: time.Unix(0, since), PID: pid}, true
+}
+
+func ticketOwnerAlive(name string) bool {
+	ticket, ok := parseTicket(name)
+	if !ok {
+		return false
+	}
+	pid := ticket.PID
+	if pid == os.Getpid() {
+		return true
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
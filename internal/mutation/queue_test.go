@@ -0,0 +1,119 @@
+package mutation
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+func TestMutationQueueHead(t *testing.T) {
+	dir := t.TempDir()
+	q := NewQueue(filepath.Join(dir, "lock"), filepath.Join(dir, "queue"), 1)
+	if err := os.MkdirAll(q.dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	pid := os.Getpid()
+	tickets := []string{
+		fmt.Sprintf("%d-%020d-%d", PriorityCleanup, 1, pid),
+		fmt.Sprintf("%d-%020d-%d", PriorityNewPod, 3, pid),
+		fmt.Sprintf("%d-%020d-%d", PriorityMigration, 5, pid),
+		fmt.Sprintf("%d-%020d-%d", PriorityCritical, 6, pid),
+		fmt.Sprintf("%d-%020d-%d", PriorityMigration, 4, pid),
+		// Left behind by a process that no longer exists
+		fmt.Sprintf("%d-%020d-%d", PriorityCritical, 0, 0),
+	}
+	for _, ticket := range tickets {
+		if err := os.WriteFile(filepath.Join(q.dir, ticket), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	head, err := q.head()
+	if err != nil {
+		t.Fatalf("head() error = %v", err)
+	}
+	if want := tickets[3]; head != want {
+		t.Errorf("head() = %s, want %s", head, want)
+	}
+	if _, err := os.Stat(filepath.Join(q.dir, tickets[5])); !os.IsNotExist(err) {
+		t.Errorf("stale ticket was not pruned")
+	}
+}
+
+func TestMutationQueueAcquireWaitsForHigherPriority(t *testing.T) {
+	dir := t.TempDir()
+	q := NewQueue(filepath.Join(dir, "lock"), filepath.Join(dir, "queue"), 1)
+	if err := os.MkdirAll(q.dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	waiting := filepath.Join(q.dir, fmt.Sprintf("%d-%020d-%d", PriorityMigration, 0, os.Getpid()))
+	if err := os.WriteFile(waiting, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*pollDelay)
+	defer cancel()
+	if err := q.Acquire(ctx, PriorityCleanup); err == nil {
+		t.Fatalf("Acquire() succeeded while a migration was waiting")
+	}
+
+	if err := os.Remove(waiting); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := q.Acquire(ctx, PriorityCleanup); err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	if err := q.Release(); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+}
+
+func TestMutationQueueSlots(t *testing.T) {
+	dir := t.TempDir()
+	lockPath, queueDir := filepath.Join(dir, "lock"), filepath.Join(dir, "queue")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*pollDelay)
+	defer cancel()
+	var holders []*Queue
+	for range 2 {
+		q := NewQueue(lockPath, queueDir, 2)
+		if err := q.Acquire(ctx, PriorityNewPod); err != nil {
+			t.Fatalf("Acquire() error = %v", err)
+		}
+		holders = append(holders, q)
+	}
+	if err := NewQueue(lockPath, queueDir, 2).Acquire(ctx, PriorityNewPod); err == nil {
+		t.Fatalf("Acquire() succeeded with every slot held")
+	}
+
+	// Node agents lock out every holder
+	agent := flock.New(lockPath)
+	if locked, err := agent.TryLock(); err != nil || locked {
+		t.Fatalf("TryLock() = %v, %v while slots are held", locked, err)
+	}
+	for _, q := range holders {
+		if err := q.Release(); err != nil {
+			t.Fatalf("Release() error = %v", err)
+		}
+	}
+	if locked, err := agent.TryLock(); err != nil || !locked {
+		t.Fatalf("TryLock() = %v, %v after the slots were released", locked, err)
+	}
+	defer agent.Unlock()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 3*pollDelay)
+	defer cancel()
+	if err := NewQueue(lockPath, queueDir, 2).Acquire(ctx, PriorityNewPod); err == nil {
+		t.Fatalf("Acquire() succeeded while a node agent held the lock")
+	}
+}
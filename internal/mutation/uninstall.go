@@ -0,0 +1,36 @@
+package mutation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DefaultUninstallPath marks a node the installer uninstalls gcp-ipam from,
+// the plugin refuses new pods meanwhile
+const DefaultUninstallPath = "/var/run/gcp-ipam-uninstalling"
+
+// MarkUninstalling records that gcp-ipam is being uninstalled from the node
+func MarkUninstalling(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create uninstall state directory: %w", err)
+	}
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		return fmt.Errorf("failed to write uninstall state: %w", err)
+	}
+	return nil
+}
+
+// Uninstalling reports whether gcp-ipam is being uninstalled from the node
+func Uninstalling(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// ClearUninstalling removes the uninstall mark of the node
+func ClearUninstalling(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear uninstall state: %w", err)
+	}
+	return nil
+}
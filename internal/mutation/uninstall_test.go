@@ -0,0 +1,27 @@
+package mutation
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUninstalling(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "uninstalling")
+	if Uninstalling(path) {
+		t.Fatal("Uninstalling() without mark = true")
+	}
+	if err := MarkUninstalling(path); err != nil {
+		t.Fatal(err)
+	}
+	if !Uninstalling(path) {
+		t.Fatal("Uninstalling() after marking = false")
+	}
+	for range 2 {
+		if err := ClearUninstalling(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if Uninstalling(path) {
+		t.Error("Uninstalling() after clearing = true")
+	}
+}
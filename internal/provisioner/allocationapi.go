@@ -0,0 +1,246 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const (
+	// maxAllocationRequestSize bounds the allocation request bodies the allocation API reads
+	maxAllocationRequestSize = 64 << 10
+
+	// freezeRefreshInterval is how often the allocation API rereads the freeze
+	// switch and the pool update limit
+	freezeRefreshInterval = 10 * time.Second
+
+	// nodeUserPrefix is the user name prefix of kubelet credentials
+	nodeUserPrefix = "system:node:"
+)
+
+// requestHeaderAuth is how the API server authenticates itself and the user
+// it proxies for, published in the extension-apiserver-authentication ConfigMap
+type requestHeaderAuth struct {
+	clientCAs       *x509.CertPool
+	allowedNames    []string
+	usernameHeaders []string
+}
+
+// RunAllocationAPI serves the allocation API on addr with the TLS certificate
+// and key in certFile and keyFile until ctx is done. It is an aggregated API
+// server: the API server authorizes POSTs to the allocate subresource of
+// ippools in ipam.AllocationAPIGroup and proxies them here, where the IP is
+// allocated server-side and only the result is returned. Nodes spare reading
+// and writing the whole IPPool for every pod, which for large pools is most of
+// the cost of an ADD. The proxied requests are authenticated by the client
+// certificate of the API server. Allocations of a pool beyond the
+// concurrency.poolUpdates of the plugin configuration queue, the allocation
+// API being where the whole cluster's updates of the pool meet.
+func (p *Provisioner) RunAllocationAPI(ctx context.Context, addr, certFile, keyFile string) error {
+	auth, err := p.requestHeaderAuth(ctx)
+	if err != nil {
+		return err
+	}
+
+	var frozen atomic.Pointer[config.Freeze]
+	frozen.Store(&config.Freeze{})
+	var retry atomic.Pointer[config.Retry]
+	retry.Store(&config.Retry{})
+	limiter := ipam.NewPoolSemaphore(0)
+	go func() {
+		ticker := time.NewTicker(freezeRefreshInterval)
+		defer ticker.Stop()
+		for {
+			cfg, err := p.pluginConfig(ctx)
+			if err != nil {
+				cfg = &config.Config{Freeze: config.Freeze{Enabled: true, Reason: fmt.Sprintf("plugin configuration unreadable: %v", err)}}
+			} else {
+				limiter.SetLimit(cfg.Concurrency.PoolUpdates)
+				retry.Store(&cfg.Retry)
+			}
+			frozen.Store(&cfg.Freeze)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	prefix := fmt.Sprintf("/apis/%s/%s", ipam.AllocationAPIGroup, ipam.AllocationAPIVersion)
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: ipam.AllocationAPIGroup + "/" + ipam.AllocationAPIVersion,
+			APIResources: []metav1.APIResource{{
+				Name:  "ippools/allocate",
+				Kind:  "AllocationResult",
+				Verbs: metav1.Verbs{"create"},
+			}},
+		})
+	})
+	mux.HandleFunc("POST "+prefix+"/ippools/{pool}/allocate", func(w http.ResponseWriter, r *http.Request) {
+		p.serveAllocate(w, r, auth, frozen.Load(), retry.Load(), limiter)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			// Probes come without a certificate, allocations are checked in serveAllocate
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  auth.clientCAs,
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	p.logger.Info("Starting allocation API", slog.String("address", addr))
+	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve allocation API: %w", err)
+	}
+	return ctx.Err()
+}
+
+func (p *Provisioner) serveAllocate(w http.ResponseWriter, r *http.Request, auth *requestHeaderAuth, freeze *config.Freeze, retry *config.Retry, limiter ipam.PoolLimiter) {
+	user, err := auth.user(r)
+	if err != nil {
+		writeStatus(w, http.StatusUnauthorized, metav1.StatusReasonUnauthorized, err.Error())
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAllocationRequestSize))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+		return
+	}
+	req := &ipam.AllocationRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("decode allocation request: %v", err))
+		return
+	}
+	req.PoolName = r.PathValue("pool")
+
+	// A node allocates for its own pods only
+	if node, ok := strings.CutPrefix(user, nodeUserPrefix); ok && req.NodeName != node {
+		writeStatus(w, http.StatusForbidden, metav1.StatusReasonForbidden,
+			fmt.Sprintf("%s may not allocate IPs for node %s", user, req.NodeName))
+		return
+	}
+
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	allocator.SetPoolLimiter(limiter)
+	allocator.SetRetryPolicy(ipam.RetryPolicy{
+		Attempts:  retry.Attempts,
+		BaseDelay: retry.BaseDelay.Duration,
+		MaxDelay:  retry.MaxDelay.Duration,
+	})
+	if freeze.Enabled {
+		allocator.Freeze(freeze.Reason)
+	}
+	result, err := allocator.Allocate(r.Context(), req)
+	if err != nil {
+		p.logger.Info("Allocation failed",
+			slog.String("pool", req.PoolName),
+			slog.String("pod", fmt.Sprintf("%s/%s", req.PodNamespace, req.PodName)),
+			slog.String("user", user),
+			slog.String("error", err.Error()),
+		)
+		status := ipam.AllocationStatus(err)
+		writeJSON(w, int(status.Code), status)
+		return
+	}
+
+	p.logger.Debug("Allocated IP",
+		slog.String("pool", req.PoolName),
+		slog.String("ip", result.IP),
+		slog.String("pod", fmt.Sprintf("%s/%s", req.PodNamespace, req.PodName)),
+		slog.String("node", req.NodeName),
+	)
+	writeJSON(w, http.StatusCreated, result)
+}
+
+// requestHeaderAuth reads how the API server authenticates to aggregated API servers
+func (p *Provisioner) requestHeaderAuth(ctx context.Context) (*requestHeaderAuth, error) {
+	cm, err := p.kubeClient.CoreV1().ConfigMaps(metav1.NamespaceSystem).Get(ctx, "extension-apiserver-authentication", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get request header authentication: %w", err)
+	}
+
+	auth := &requestHeaderAuth{clientCAs: x509.NewCertPool()}
+	if !auth.clientCAs.AppendCertsFromPEM([]byte(cm.Data["requestheader-client-ca-file"])) {
+		return nil, fmt.Errorf("request header client CA missing in ConfigMap %s/%s", cm.Namespace, cm.Name)
+	}
+	for key, list := range map[string]*[]string{
+		"requestheader-allowed-names":    &auth.allowedNames,
+		"requestheader-username-headers": &auth.usernameHeaders,
+	} {
+		if value := cm.Data[key]; value != "" {
+			if err := json.Unmarshal([]byte(value), list); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", key, err)
+			}
+		}
+	}
+	if len(auth.usernameHeaders) == 0 {
+		auth.usernameHeaders = []string{"X-Remote-User"}
+	}
+	return auth, nil
+}
+
+// user returns the user the API server proxies the request for, once the
+// client certificate proved the request comes from the API server
+func (a *requestHeaderAuth) user(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", errors.New("request is not proxied by the API server")
+	}
+	if name := r.TLS.VerifiedChains[0][0].Subject.CommonName; len(a.allowedNames) > 0 && !slices.Contains(a.allowedNames, name) {
+		return "", fmt.Errorf("client certificate %s is not allowed to proxy requests", name)
+	}
+	for _, header := range a.usernameHeaders {
+		if user := r.Header.Get(header); user != "" {
+			return user, nil
+		}
+	}
+	return "", errors.New("request carries no user")
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason, message string) {
+	writeJSON(w, code, &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Code:     int32(code),
+		Reason:   reason,
+		Message:  message,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
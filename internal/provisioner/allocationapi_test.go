@@ -0,0 +1,77 @@
+package provisioner
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestServeAllocate(t *testing.T) {
+	auth := &requestHeaderAuth{
+		allowedNames:    []string{"front-proxy-client"},
+		usernameHeaders: []string{"X-Remote-User"},
+	}
+	proxied := func(name string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	tests := []struct {
+		name     string
+		tls      *tls.ConnectionState
+		user     string
+		node     string
+		wantCode int
+	}{
+		{name: "own node", tls: proxied("front-proxy-client"), user: "system:node:node-1", node: "node-1", wantCode: http.StatusCreated},
+		{name: "controller for any node", tls: proxied("front-proxy-client"), user: "system:serviceaccount:kube-system:controller", node: "node-2", wantCode: http.StatusCreated},
+		{name: "node for another node", tls: proxied("front-proxy-client"), user: "system:node:node-1", node: "node-2", wantCode: http.StatusForbidden},
+		{name: "not proxied", user: "system:node:node-1", node: "node-1", wantCode: http.StatusUnauthorized},
+		{name: "proxy not allowed", tls: proxied("someone"), user: "system:node:node-1", node: "node-1", wantCode: http.StatusUnauthorized},
+		{name: "no user", tls: proxied("front-proxy-client"), node: "node-1", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvisioner(t, []*v1alpha1.IPPool{{
+				ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+				Spec:       v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/24"},
+			}})
+
+			body, err := json.Marshal(&ipam.AllocationRequest{PodNamespace: "default", PodName: "pod", PodUID: "pod-uid", NodeName: tt.node})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/apis/"+ipam.AllocationAPIGroup+"/"+ipam.AllocationAPIVersion+"/ippools/pool/allocate", strings.NewReader(string(body)))
+			r.SetPathValue("pool", "pool")
+			r.TLS = tt.tls
+			if tt.user != "" {
+				r.Header.Set("X-Remote-User", tt.user)
+			}
+			w := httptest.NewRecorder()
+			p.serveAllocate(w, r, auth, &config.Freeze{}, &config.Retry{}, ipam.NewPoolSemaphore(0))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			allocations := testPool(t, p, "pool").Spec.Allocations
+			allocated := false
+			for _, a := range allocations {
+				allocated = allocated || a.PodUID == "pod-uid"
+			}
+			if allocated != (tt.wantCode == http.StatusCreated) {
+				t.Errorf("pod allocated = %v after status %d", allocated, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const (
+	// AllocatedPoolAnnotation is the IPPool the IP of the pod was allocated from
+	AllocatedPoolAnnotation = "gcp-cni.cast.ai/allocated-pool"
+
+	// AllocatedRangeAnnotation is the secondary range the IP of the pod belongs to
+	AllocatedRangeAnnotation = "gcp-cni.cast.ai/allocated-range"
+
+	// AllocatedAtAnnotation is when the IP of the pod was allocated, in RFC 3339
+	AllocatedAtAnnotation = "gcp-cni.cast.ai/allocated-at"
+)
+
+// RunPodAnnotationController annotates pods with the pool, secondary range
+// and allocation time of their IP every interval until ctx is done, so IPAM
+// provenance shows up in kubectl describe. The plugin runs with the kubelet's
+// credentials, which may not change pod metadata, so this is done here.
+func (p *Provisioner) RunPodAnnotationController(ctx context.Context, interval time.Duration) error {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting pod annotation controller", slog.Duration("interval", interval))
+
+	for {
+		if err := p.annotatePods(ctx, allocator); err != nil {
+			p.logger.Error("Pod annotation failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) annotatePods(ctx context.Context, allocator *ipam.Allocator) error {
+	if p.frozen(ctx, allocator) {
+		return nil
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Node name to pod UID to the annotations describing its allocation
+	wanted := map[string]map[string]map[string]string{}
+	for i := range pools {
+		pool := &pools[i]
+		if pool.Spec.Class != "" && pool.Spec.Class != v1alpha1.PoolClassPod {
+			continue
+		}
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.PodUID == "" || allocation.FloatingIP != "" || allocation.PodName == ipam.ConflictPlaceholder {
+				continue
+			}
+			annotations := map[string]string{
+				AllocatedPoolAnnotation:  pool.Name,
+				AllocatedRangeAnnotation: ipam.RangeName(pool, ip),
+			}
+			if !allocation.AllocatedAt.IsZero() {
+				annotations[AllocatedAtAnnotation] = allocation.AllocatedAt.UTC().Format(time.RFC3339)
+			}
+			if wanted[allocation.NodeName] == nil {
+				wanted[allocation.NodeName] = map[string]map[string]string{}
+			}
+			wanted[allocation.NodeName][allocation.PodUID] = annotations
+		}
+	}
+
+	for nodeName, podAnnotations := range wanted {
+		if err := p.annotateNodePods(ctx, nodeName, podAnnotations); err != nil {
+			p.logger.Error("Failed to annotate pods of node",
+				slog.String("node", nodeName),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	return nil
+}
+
+// annotateNodePods patches the pods of nodeName whose annotations differ from
+// wanted, keyed by pod UID. Only the pods of the node are listed, from the
+// watch cache of the API server, so a tick does not read every pod of the
+// cluster from etcd.
+func (p *Provisioner) annotateNodePods(ctx context.Context, nodeName string, wanted map[string]map[string]string) error {
+	pods, err := p.kubeClient.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+		ResourceVersion: "0",
+	})
+	if err != nil {
+		return fmt.Errorf("list pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		annotations, ok := wanted[string(pod.UID)]
+		if !ok || pod.DeletionTimestamp != nil {
+			continue
+		}
+		stale := false
+		for key, value := range annotations {
+			if pod.Annotations[key] != value {
+				stale = true
+			}
+		}
+		if !stale {
+			continue
+		}
+
+		patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": annotations}})
+		if err != nil {
+			return fmt.Errorf("marshal annotation patch: %w", err)
+		}
+		if _, err := p.kubeClient.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			p.logger.Error("Failed to annotate pod",
+				slog.String("pod", fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		p.logger.Debug("Annotated pod with its allocation",
+			slog.String("pod", fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)),
+			slog.String("pool", annotations[AllocatedPoolAnnotation]),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package provisioner
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestAnnotatePods(t *testing.T) {
+	ctx := context.Background()
+	allocatedAt := metav1.NewTime(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	pod := func(name, nodeName string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+			Spec:       corev1.PodSpec{NodeName: nodeName},
+		}
+	}
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/24",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.5": {PodName: "a", PodNamespace: "default", PodUID: "uid-a", NodeName: "node-1", AllocatedAt: allocatedAt},
+				"10.8.0.6": {PodName: "b", PodNamespace: "default", PodUID: "uid-b", NodeName: "node-2"},
+			},
+		},
+	}}, pod("a", "node-1"), pod("b", "node-2"), pod("c", "node-3"))
+
+	var selectors []string
+	p.kubeClient.(*kubefake.Clientset).PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		opts := action.(k8stesting.ListActionImpl).ListOptions
+		if opts.ResourceVersion != "0" {
+			t.Errorf("pods listed with resourceVersion %q, want from the watch cache", opts.ResourceVersion)
+		}
+		selectors = append(selectors, opts.FieldSelector)
+		return false, nil, nil
+	})
+
+	if err := p.annotatePods(ctx, ipam.NewAllocator(p.dynamicClient)); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(selectors)
+	if want := []string{"spec.nodeName=node-1", "spec.nodeName=node-2"}; !slices.Equal(selectors, want) {
+		t.Errorf("pods listed with field selectors %v, want %v", selectors, want)
+	}
+
+	want := map[string]map[string]string{
+		"a": {AllocatedPoolAnnotation: "pool", AllocatedAtAnnotation: "2026-10-01T12:00:00Z"},
+		"b": {AllocatedPoolAnnotation: "pool"},
+		"c": nil,
+	}
+	for name, annotations := range want {
+		got, err := p.kubeClient.CoreV1().Pods("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range annotations {
+			if got.Annotations[key] != value {
+				t.Errorf("pod %s annotation %s = %q, want %q", name, key, got.Annotations[key], value)
+			}
+		}
+		if annotations == nil && len(got.Annotations) != 0 {
+			t.Errorf("pod %s without an allocation annotated with %v", name, got.Annotations)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/iterator"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// Capacity reports the IP usage of all pools, the alias headroom of every
+// node and the top namespaces by IPs held
+func (p *Provisioner) Capacity(ctx context.Context, projectID string, top int) (*ipam.CapacityReport, error) {
+	pools, err := ipam.NewAllocator(p.dynamicClient).ListPools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := p.nodeAliases(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return ipam.Capacity(pools, nodes, top, time.Now()), nil
+}
+
+// nodeAliases counts the alias IP ranges of the instance of every node, on its
+// network interface carrying the most. Nodes without an instance in the
+// projects of the nodes count none.
+func (p *Provisioner) nodeAliases(ctx context.Context, projectID string) ([]ipam.NodeAliases, error) {
+	nodeList, err := p.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	ranges := make(map[string]int, len(nodeList.Items))
+	for _, node := range nodeList.Items {
+		ranges[node.Name] = 0
+	}
+
+	projects, err := p.instanceProjects(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	for _, project := range projects {
+		instances := p.instancesClient.AggregatedList(ctx, &computepb.AggregatedListInstancesRequest{
+			Project: project,
+		})
+		for {
+			pair, err := instances.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("list instances of project %s: %w", project, err)
+			}
+			for _, instance := range pair.Value.GetInstances() {
+				if _, ok := ranges[instance.GetName()]; !ok {
+					continue
+				}
+				for _, nic := range instance.GetNetworkInterfaces() {
+					ranges[instance.GetName()] = max(ranges[instance.GetName()], len(nic.GetAliasIpRanges()))
+				}
+			}
+		}
+	}
+
+	nodes := make([]ipam.NodeAliases, 0, len(ranges))
+	for node, n := range ranges {
+		nodes = append(nodes, ipam.NodeAliases{Node: node, AliasRanges: n})
+	}
+	return nodes, nil
+}
@@ -8,7 +8,8 @@ import (
 
 	compute "cloud.google.com/go/compute/apiv1"
 	"cloud.google.com/go/compute/apiv1/computepb"
-	"cloud.google.com/go/compute/metadata"
+
+	"github.com/castai/gcp-cni/internal/identity"
 )
 
 type clusterInfo struct {
@@ -21,24 +22,23 @@ type clusterInfo struct {
 // TODO: get information from actual GKE cluster API,
 // TODO: assume single subnet for cluster
 func getClusterInfo(ctx context.Context, instancesClient *compute.InstancesClient, logger *slog.Logger) (*clusterInfo, error) {
-	projectID, err := metadata.ProjectID()
+	overrides := identity.FromEnv()
+	projectID, err := overrides.ProjectID(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get project ID from metadata: %w", err)
 	}
 
-	zone, err := metadata.Zone()
+	zone, err := overrides.ZoneName(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get zone from metadata: %w", err)
 	}
 
-	region := ""
-	if len(zone) > 2 {
-		region = zone[:len(zone)-2]
-	} else {
-		return nil, fmt.Errorf("cannot determine region from zone: %s", zone)
+	region, err := identity.Region(zone)
+	if err != nil {
+		return nil, err
 	}
 
-	instanceName, err := metadata.InstanceName()
+	instanceName, err := overrides.InstanceName(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get instance name from metadata: %w", err)
 	}
@@ -0,0 +1,296 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	dns "google.golang.org/api/dns/v1"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// DefaultDNSNameTemplate names the record of a pod IP in the forward zone
+const DefaultDNSNameTemplate = "{{.PodName}}.{{.PodNamespace}}"
+
+// maxDNSChangeRecords bounds the record sets of a single Cloud DNS change
+const maxDNSChangeRecords = 500
+
+// DNSRecords configures the pod IP records the DNS controller manages
+type DNSRecords struct {
+	// Project of the managed zones, empty is the project of the provisioner
+	Project string
+	// Zone is the managed zone of the A and AAAA records
+	Zone string
+	// ReverseZone is the managed zone of the PTR records, empty manages none
+	ReverseZone string
+	// NameTemplate renders the record name of a pod IP relative to Zone, with
+	// .PodName, .PodNamespace, .Node, .Pool and .IP (dashed)
+	NameTemplate string
+	// TTL of the records
+	TTL time.Duration
+}
+
+// dnsRecordName is the data of DNSRecords.NameTemplate
+type dnsRecordName struct {
+	PodName      string
+	PodNamespace string
+	Node         string
+	Pool         string
+	IP           string
+}
+
+// RunDNSController registers A, AAAA and PTR records for the pod IPs of the
+// pools in Cloud DNS every interval until ctx is done, and removes them once
+// the IPs are released. Only records marked as owned by this cluster with a
+// TXT record next to them are changed, records created by hand are left
+// alone.
+func (p *Provisioner) RunDNSController(ctx context.Context, interval time.Duration, records DNSRecords) error {
+	if records.Zone == "" {
+		return fmt.Errorf("DNS zone is required")
+	}
+	// Without an ID the TXT records would mark the names as owned by every
+	// cluster without one
+	if p.clusterID == "" {
+		return fmt.Errorf("cluster ID is required to mark the DNS records of the cluster")
+	}
+	nameTemplate, err := template.New("name").Option("missingkey=error").Parse(records.NameTemplate)
+	if err != nil {
+		return fmt.Errorf("parse DNS name template: %w", err)
+	}
+	if records.Project == "" {
+		if records.Project, err = identity.ProjectID(ctx); err != nil {
+			return fmt.Errorf("get project ID from metadata: %w", err)
+		}
+	}
+	service, err := dns.NewService(ctx)
+	if err != nil {
+		return fmt.Errorf("create DNS client: %w", err)
+	}
+
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting DNS record controller",
+		slog.Duration("interval", interval),
+		slog.String("zone", records.Zone),
+		slog.String("reverse_zone", records.ReverseZone),
+	)
+
+	for {
+		if err := p.reconcileDNSRecords(ctx, allocator, service, records, nameTemplate); err != nil {
+			p.logger.Error("DNS record reconciliation failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) reconcileDNSRecords(ctx context.Context, allocator *ipam.Allocator, service *dns.Service, records DNSRecords, nameTemplate *template.Template) error {
+	if p.frozen(ctx, allocator) {
+		return nil
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+
+	zone, err := service.ManagedZones.Get(records.Project, records.Zone).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("get managed zone %s: %w", records.Zone, err)
+	}
+	var reverseZone *dns.ManagedZone
+	if records.ReverseZone != "" {
+		if reverseZone, err = service.ManagedZones.Get(records.Project, records.ReverseZone).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("get managed zone %s: %w", records.ReverseZone, err)
+		}
+	}
+
+	// Record name to type to rrdatas, per zone
+	forward := map[string]map[string][]string{}
+	reverse := map[string]map[string][]string{}
+	for i := range pools {
+		pool := &pools[i]
+		if pool.Spec.Class != "" && pool.Spec.Class != v1alpha1.PoolClassPod {
+			continue
+		}
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.PodUID == "" || allocation.FloatingIP != "" || allocation.PodName == ipam.ConflictPlaceholder {
+				continue
+			}
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				continue
+			}
+
+			var relative strings.Builder
+			if err := nameTemplate.Execute(&relative, dnsRecordName{
+				PodName:      allocation.PodName,
+				PodNamespace: allocation.PodNamespace,
+				Node:         allocation.NodeName,
+				Pool:         pool.Name,
+				IP:           strings.NewReplacer(".", "-", ":", "-").Replace(ip),
+			}); err != nil {
+				return fmt.Errorf("render DNS name of IP %s: %w", ip, err)
+			}
+			name := strings.ToLower(strings.Trim(relative.String(), ".")) + "." + zone.DnsName
+			recordType := "A"
+			if addr.Is6() {
+				recordType = "AAAA"
+			}
+			addRecord(forward, name, recordType, addr.String())
+
+			if reverseZone != nil {
+				if ptr := reverseName(addr); strings.HasSuffix(ptr, "."+reverseZone.DnsName) {
+					addRecord(reverse, ptr, "PTR", name)
+				}
+			}
+		}
+	}
+
+	if err := p.syncDNSZone(ctx, service, records, zone, forward); err != nil {
+		return err
+	}
+	if reverseZone != nil {
+		return p.syncDNSZone(ctx, service, records, reverseZone, reverse)
+	}
+	return nil
+}
+
+func addRecord(records map[string]map[string][]string, name, recordType, rrdata string) {
+	if records[name] == nil {
+		records[name] = map[string][]string{}
+	}
+	if !slices.Contains(records[name][recordType], rrdata) {
+		records[name][recordType] = append(records[name][recordType], rrdata)
+	}
+}
+
+// syncDNSZone makes the records of zone owned by this cluster match wanted.
+// Names holding records of others are skipped.
+func (p *Provisioner) syncDNSZone(ctx context.Context, service *dns.Service, records DNSRecords, zone *dns.ManagedZone, wanted map[string]map[string][]string) error {
+	owner := p.dnsOwner()
+
+	// Record name to type to the existing record set
+	existing := map[string]map[string]*dns.ResourceRecordSet{}
+	err := service.ResourceRecordSets.List(records.Project, zone.Name).Pages(ctx, func(page *dns.ResourceRecordSetsListResponse) error {
+		for _, rrset := range page.Rrsets {
+			if existing[rrset.Name] == nil {
+				existing[rrset.Name] = map[string]*dns.ResourceRecordSet{}
+			}
+			existing[rrset.Name][rrset.Type] = rrset
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("list records of managed zone %s: %w", zone.Name, err)
+	}
+
+	ttl := int64(records.TTL.Seconds())
+	change := &dns.Change{}
+	apply := func(force bool) error {
+		if len(change.Additions)+len(change.Deletions) == 0 || (!force && len(change.Additions)+len(change.Deletions) < maxDNSChangeRecords) {
+			return nil
+		}
+		if _, err := service.Changes.Create(records.Project, zone.Name, change).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("change records of managed zone %s: %w", zone.Name, err)
+		}
+		p.logger.Info("Changed DNS records",
+			slog.String("zone", zone.Name),
+			slog.Int("additions", len(change.Additions)),
+			slog.Int("deletions", len(change.Deletions)),
+		)
+		change = &dns.Change{}
+		return nil
+	}
+
+	names := make([]string, 0, len(wanted)+len(existing))
+	for name := range wanted {
+		names = append(names, name)
+	}
+	for name := range existing {
+		if _, ok := wanted[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		current := existing[name]
+		owned := current["TXT"] != nil && slices.Contains(current["TXT"].Rrdatas, owner)
+		if !owned && len(current) > 0 {
+			if wanted[name] != nil {
+				p.logger.Warn("DNS name is taken by records of others, skipping it", slog.String("name", name))
+			}
+			continue
+		}
+		if !owned {
+			current = map[string]*dns.ResourceRecordSet{}
+		}
+
+		types := map[string][]string{}
+		for recordType, rrdatas := range wanted[name] {
+			types[recordType] = rrdatas
+		}
+		if len(types) > 0 {
+			types["TXT"] = []string{owner}
+		}
+		for _, recordType := range []string{"A", "AAAA", "PTR", "TXT"} {
+			rrdatas, old := types[recordType], current[recordType]
+			if old != nil && old.Ttl == ttl && sameRrdatas(old.Rrdatas, rrdatas) {
+				continue
+			}
+			if old != nil {
+				change.Deletions = append(change.Deletions, old)
+			}
+			if len(rrdatas) > 0 {
+				slices.Sort(rrdatas)
+				change.Additions = append(change.Additions, &dns.ResourceRecordSet{Name: name, Type: recordType, Ttl: ttl, Rrdatas: rrdatas})
+			}
+		}
+		if err := apply(false); err != nil {
+			return err
+		}
+	}
+	return apply(true)
+}
+
+// dnsOwner is the TXT rrdata marking records as owned by this cluster
+func (p *Provisioner) dnsOwner() string {
+	return fmt.Sprintf(`"heritage=gcp-cni,cluster=%s"`, p.clusterID)
+}
+
+func sameRrdatas(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// reverseName is the in-addr.arpa or ip6.arpa name of addr
+func reverseName(addr netip.Addr) string {
+	var labels []string
+	if addr.Is4() {
+		for _, b := range addr.As4() {
+			labels = append([]string{fmt.Sprint(b)}, labels...)
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa."
+	}
+	for _, b := range addr.As16() {
+		labels = append([]string{fmt.Sprintf("%x", b&0xf), fmt.Sprintf("%x", b>>4)}, labels...)
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa."
+}
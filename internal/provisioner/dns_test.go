@@ -0,0 +1,170 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	dns "google.golang.org/api/dns/v1"
+	"google.golang.org/api/option"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestRunDNSControllerRequiresClusterID(t *testing.T) {
+	p := newTestProvisioner(t, nil)
+	err := p.RunDNSController(context.Background(), time.Minute, DNSRecords{Zone: "pods", NameTemplate: DefaultDNSNameTemplate})
+	if err == nil || !strings.Contains(err.Error(), "cluster ID") {
+		t.Errorf("RunDNSController() without a cluster ID = %v, want it refused", err)
+	}
+}
+
+func TestReconcileDNSRecords(t *testing.T) {
+	ctx := context.Background()
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/24",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.5": {PodName: "web", PodNamespace: "default", PodUID: "web-uid", NodeName: "node-1"},
+				"10.8.0.6": {PodName: "db", PodNamespace: "default", PodUID: "db-uid", NodeName: "node-1"},
+				"10.8.0.7": {PodName: ipam.ConflictPlaceholder, PodUID: ipam.ConflictPlaceholder + "-10.8.0.7"},
+				"10.8.0.8": {FloatingIP: "default/vip", PodUID: "vip"},
+			},
+		},
+	}
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{pool})
+	if err := p.SetClusterID("prod1"); err != nil {
+		t.Fatal(err)
+	}
+	owner := `"heritage=gcp-cni,cluster=prod1"`
+
+	var mu sync.Mutex
+	changes := 0
+	rrsets := map[string][]*dns.ResourceRecordSet{
+		"pods": {
+			// Released IP of this cluster
+			{Name: "old.default.pods.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"10.8.0.9"}},
+			{Name: "old.default.pods.example.com.", Type: "TXT", Ttl: 300, Rrdatas: []string{owner}},
+			// Made by hand
+			{Name: "db.default.pods.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"10.1.0.1"}},
+			// Of another cluster sharing the zone
+			{Name: "api.default.pods.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"10.9.0.1"}},
+			{Name: "api.default.pods.example.com.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"heritage=gcp-cni,cluster=prod2"`}},
+		},
+	}
+	zones := map[string]string{"pods": "pods.example.com.", "reverse": "8.10.in-addr.arpa."}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/dns/v1/projects/project/managedZones/"), "/")
+		reply := func(v any) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(v); err != nil {
+				t.Error(err)
+			}
+		}
+		switch {
+		case len(parts) == 1 && zones[parts[0]] != "":
+			reply(&dns.ManagedZone{Name: parts[0], DnsName: zones[parts[0]]})
+		case len(parts) == 2 && parts[1] == "rrsets":
+			reply(&dns.ResourceRecordSetsListResponse{Rrsets: rrsets[parts[0]]})
+		case len(parts) == 2 && parts[1] == "changes" && r.Method == http.MethodPost:
+			changes++
+			change := &dns.Change{}
+			if err := json.NewDecoder(r.Body).Decode(change); err != nil {
+				t.Error(err)
+			}
+			for _, deleted := range change.Deletions {
+				for i, rrset := range rrsets[parts[0]] {
+					if rrset.Name == deleted.Name && rrset.Type == deleted.Type {
+						rrsets[parts[0]] = append(rrsets[parts[0]][:i], rrsets[parts[0]][i+1:]...)
+						break
+					}
+				}
+			}
+			rrsets[parts[0]] = append(rrsets[parts[0]], change.Additions...)
+			reply(change)
+		default:
+			t.Errorf("unexpected Cloud DNS request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	service, err := dns.NewService(ctx, option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := DNSRecords{Project: "project", Zone: "pods", ReverseZone: "reverse", TTL: 5 * time.Minute}
+	nameTemplate := template.Must(template.New("name").Option("missingkey=error").Parse(DefaultDNSNameTemplate))
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	if err := p.reconcileDNSRecords(ctx, allocator, service, records, nameTemplate); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	first := changes
+	mu.Unlock()
+	if err := p.reconcileDNSRecords(ctx, allocator, service, records, nameTemplate); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if changes != first {
+		t.Errorf("second pass made %d changes, want none", changes-first)
+	}
+	got := func(zone, name, recordType string) []string {
+		for _, rrset := range rrsets[zone] {
+			if rrset.Name == name && rrset.Type == recordType {
+				return rrset.Rrdatas
+			}
+		}
+		return nil
+	}
+	tests := []struct {
+		zone, name, recordType string
+		want                   string
+	}{
+		{"pods", "web.default.pods.example.com.", "A", "10.8.0.5"},
+		{"pods", "web.default.pods.example.com.", "TXT", owner},
+		{"reverse", "5.0.8.10.in-addr.arpa.", "PTR", "web.default.pods.example.com."},
+		{"reverse", "5.0.8.10.in-addr.arpa.", "TXT", owner},
+		{"pods", "old.default.pods.example.com.", "A", ""},
+		{"pods", "old.default.pods.example.com.", "TXT", ""},
+		{"pods", "db.default.pods.example.com.", "A", "10.1.0.1"},
+		{"pods", "db.default.pods.example.com.", "TXT", ""},
+		{"pods", "api.default.pods.example.com.", "A", "10.9.0.1"},
+		{"reverse", "7.0.8.10.in-addr.arpa.", "PTR", ""},
+		{"reverse", "8.0.8.10.in-addr.arpa.", "PTR", ""},
+	}
+	for _, tt := range tests {
+		if rrdatas := strings.Join(got(tt.zone, tt.name, tt.recordType), ","); rrdatas != tt.want {
+			t.Errorf("%s %s in zone %s = %q, want %q", tt.recordType, tt.name, tt.zone, rrdatas, tt.want)
+		}
+	}
+	if n := len(rrsets["pods"]); n != 5 {
+		t.Errorf("zone pods holds %d record sets, want 5", n)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := map[string]string{
+		"10.8.0.5":    "5.0.8.10.in-addr.arpa.",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+	}
+	for ip, want := range tests {
+		if got := reverseName(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("reverseName(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// CastAIDrainingTaint is the taint CAST AI puts on a node it drains ahead of
+// deleting its instance
+const CastAIDrainingTaint = "autoscaling.cast.ai/draining"
+
+// RunNodeDrainController releases the IPs of nodes on their way out every
+// interval until ctx is done: nodes CAST AI drains, nodes being deleted and
+// nodes gcp-ipam is being uninstalled from.
+// IPs of pods that left the node without a DEL are detached from the instance
+// and released, so nothing relies on best-effort DELs or the lease collector
+// once the instance is deleted. IPs of pods still on the node are left to
+// their DEL, the IPs buffered for the node to its installer while it is ready.
+func (p *Provisioner) RunNodeDrainController(ctx context.Context, interval time.Duration) error {
+	projectID, err := identity.ProjectID(ctx)
+	if err != nil {
+		return fmt.Errorf("get project ID from metadata: %w", err)
+	}
+
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting node drain controller", slog.Duration("interval", interval))
+
+	for {
+		if err := p.releaseDrainingNodes(ctx, allocator, projectID); err != nil {
+			p.logger.Error("Releasing IPs of draining nodes failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) releaseDrainingNodes(ctx context.Context, allocator *ipam.Allocator, projectID string) error {
+	nodes, err := p.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list nodes: %w", err)
+	}
+	draining := lo.Filter(nodes.Items, func(node corev1.Node, _ int) bool { return nodeDraining(&node) })
+	if len(draining) == 0 || p.frozen(ctx, allocator) {
+		return nil
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+	migrating, err := allocator.MigratingIPs(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range draining {
+		if err := p.releaseDrainingNode(ctx, allocator, projectID, &draining[i], pools, migrating); err != nil {
+			p.logger.Error("Failed to release IPs of draining node",
+				slog.String("node", draining[i].Name),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	return nil
+}
+
+func (p *Provisioner) releaseDrainingNode(ctx context.Context, allocator *ipam.Allocator, projectID string, node *corev1.Node, pools []v1alpha1.IPPool, migrating map[string]bool) error {
+	nodeName := node.Name
+	// A live installer returns its buffer itself once its warm pool is sized to
+	// none, its node-local reservations would outlive a release from here
+	releaseBuffer := node.DeletionTimestamp != nil || !nodeReady(node)
+
+	pods, err := p.kubeClient.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + nodeName})
+	if err != nil {
+		return fmt.Errorf("list pods of node %s: %w", nodeName, err)
+	}
+	// kubelet removes a pod only after its sandbox is torn down, a terminal pod
+	// may still wait for its DEL
+	onNode := map[string]bool{}
+	for _, pod := range pods.Items {
+		onNode[string(pod.UID)] = true
+	}
+
+	for _, pool := range pools {
+		for ip, allocation := range pool.Spec.Allocations {
+			if !drainReleasable(&pool, ip, allocation, nodeName, onNode, migrating, releaseBuffer) {
+				continue
+			}
+			logger := p.logger.With(
+				slog.String("node", nodeName),
+				slog.String("pool", pool.Name),
+				slog.String("ip", ip),
+			)
+
+			if err := p.removeAliasIP(ctx, projectID, nodeName, ip); err != nil {
+				logger.Error("Failed to detach IP of draining node", slog.String("error", err.Error()))
+				continue
+			}
+			if allocation.Buffered {
+				err = allocator.ReleaseBuffered(ctx, pool.Name, ip, nodeName)
+			} else {
+				_, err = allocator.ReleaseIfOwner(ctx, pool.Name, ip, allocation.PodUID)
+			}
+			if err != nil {
+				logger.Error("Failed to release IP of draining node", slog.String("error", err.Error()))
+				continue
+			}
+			logger.Info("Released IP of draining node",
+				slog.String("pod", fmt.Sprintf("%s/%s", allocation.PodNamespace, allocation.PodName)),
+				slog.Bool("buffered", allocation.Buffered),
+			)
+		}
+	}
+	return nil
+}
+
+// drainReleasable reports whether the allocation is a pod IP of the draining
+// node to detach and release: its pod left the node, or it is buffered and
+// releaseBuffer is set. Service and egress IPs, and the egress gateways of pod
+// pools, are moved by their own controllers. An IP in migrating keeps the UID
+// of its source pod until the target node took it over, it is left to the
+// migration.
+func drainReleasable(pool *v1alpha1.IPPool, ip string, allocation v1alpha1.IPAllocation, nodeName string, onNode, migrating map[string]bool, releaseBuffer bool) bool {
+	if pool.Spec.Class != "" && pool.Spec.Class != v1alpha1.PoolClassPod {
+		return false
+	}
+	if allocation.NodeName != nodeName || allocation.System != "" || allocation.FloatingIP != "" ||
+		allocation.EgressNamespace != "" || allocation.ServiceUID != "" ||
+		allocation.PodName == ipam.ConflictPlaceholder || allocation.Protected || migrating[ipam.CanonicalIP(ip)] {
+		return false
+	}
+	if allocation.Buffered {
+		return releaseBuffer
+	}
+	return allocation.PodUID != "" && !onNode[allocation.PodUID]
+}
+
+// nodeDraining reports whether the node is on its way out, drained by CAST AI
+// or being deleted, or leaving gcp-ipam, see RunUninstallController
+func nodeDraining(node *corev1.Node) bool {
+	return node.DeletionTimestamp != nil || nodeUninstalling(node) || lo.ContainsBy(node.Spec.Taints, func(t corev1.Taint) bool {
+		return t.Key == CastAIDrainingTaint
+	})
+}
@@ -0,0 +1,75 @@
+package provisioner
+
+import (
+	"testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestDrainReleasable(t *testing.T) {
+	podPool := &v1alpha1.IPPool{}
+	left := v1alpha1.IPAllocation{PodName: "left", PodNamespace: "default", PodUID: "left-uid", NodeName: "node"}
+	onNode := map[string]bool{"running-uid": true}
+	migrating := map[string]bool{"10.0.0.9": true}
+
+	tests := []struct {
+		name          string
+		pool          *v1alpha1.IPPool
+		ip            string
+		allocation    func(a v1alpha1.IPAllocation) v1alpha1.IPAllocation
+		releaseBuffer bool
+		want          bool
+	}{
+		{name: "pod left the node", want: true},
+		{name: "pod pool by class", pool: &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{Class: v1alpha1.PoolClassPod}}, want: true},
+		{name: "pod still on the node", allocation: func(a v1alpha1.IPAllocation) v1alpha1.IPAllocation {
+			a.PodUID = "running-uid"
+			return a
+		}},
+		{name: "other node", allocation: func(a v1alpha1.IPAllocation) v1alpha1.IPAllocation {
+			a.NodeName = "other"
+			return a
+		}},
+		{name: "egress gateway", allocation: func(a v1alpha1.IPAllocation) v1alpha1.IPAllocation {
+			return v1alpha1.IPAllocation{EgressNamespace: "team", NodeName: "node"}
+		}},
+		{name: "service pool", pool: &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{Class: v1alpha1.PoolClassService}}},
+		{name: "egress pool", pool: &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{Class: v1alpha1.PoolClassEgress}}},
+		{name: "floating IP", allocation: func(a v1alpha1.IPAllocation) v1alpha1.IPAllocation {
+			a.FloatingIP = "fip"
+			return a
+		}},
+		{name: "protected", allocation: func(a v1alpha1.IPAllocation) v1alpha1.IPAllocation {
+			a.Protected = true
+			return a
+		}},
+		{name: "conflict placeholder", allocation: func(a v1alpha1.IPAllocation) v1alpha1.IPAllocation {
+			return v1alpha1.IPAllocation{PodName: ipam.ConflictPlaceholder, NodeName: "node"}
+		}},
+		{name: "migrating to another node", ip: "10.0.0.9"},
+		{name: "buffered of a live installer", allocation: buffered},
+		{name: "buffered of a gone node", allocation: buffered, releaseBuffer: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, ip, allocation := podPool, "10.0.0.5", left
+			if tt.ip != "" {
+				ip = tt.ip
+			}
+			if tt.pool != nil {
+				pool = tt.pool
+			}
+			if tt.allocation != nil {
+				allocation = tt.allocation(allocation)
+			}
+			if got := drainReleasable(pool, ip, allocation, "node", onNode, migrating, tt.releaseBuffer); got != tt.want {
+				t.Errorf("drainReleasable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func buffered(a v1alpha1.IPAllocation) v1alpha1.IPAllocation {
+	return v1alpha1.IPAllocation{NodeName: a.NodeName, Buffered: true}
+}
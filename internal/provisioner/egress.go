@@ -0,0 +1,241 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/samber/lo"
+	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const (
+	// EgressPoolAnnotation selects the Egress class IPPool a namespace gets
+	// its egress IP from
+	EgressPoolAnnotation = "gcp-cni.cast.ai/egress-pool"
+
+	// EgressGatewayLabel marks the nodes egress IPs may be attached to
+	EgressGatewayLabel = "gcp-cni.cast.ai/egress-gateway"
+
+	// EgressNodeAnnotation is set on egress namespaces to the gateway node
+	// holding their egress IP, so workloads can be scheduled there
+	EgressNodeAnnotation = "gcp-cni.cast.ai/egress-node"
+)
+
+// RunEgressController gives every annotated namespace an egress IP from its
+// Egress class pool and attaches it as an alias IP to one of the egress
+// gateway nodes, every interval until ctx is done. Gateways keep their
+// namespaces while they are ready. The SNAT rules are programmed by the
+// installer on the gateway node.
+func (p *Provisioner) RunEgressController(ctx context.Context, interval time.Duration) error {
+	projectID, err := identity.ProjectID(ctx)
+	if err != nil {
+		return fmt.Errorf("get project ID from metadata: %w", err)
+	}
+
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting egress controller", slog.Duration("interval", interval))
+
+	for {
+		if err := p.reconcileEgress(ctx, allocator, projectID); err != nil {
+			p.logger.Error("Egress reconciliation failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) reconcileEgress(ctx context.Context, allocator *ipam.Allocator, projectID string) error {
+	frozen := p.frozen(ctx, allocator)
+
+	namespaces, err := p.kubeClient.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list namespaces: %w", err)
+	}
+
+	nodes, err := p.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{EgressGatewayLabel: "true"}).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("list egress gateway nodes: %w", err)
+	}
+	gateways := lo.FilterMap(nodes.Items, func(node corev1.Node, _ int) (string, bool) {
+		return node.Name, nodeReady(&node)
+	})
+	sort.Strings(gateways)
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Current gateway and egress IP of every namespace and the number of
+	// egress IPs per gateway
+	current := make(map[string]string)
+	currentIP := make(map[string]string)
+	load := make(map[string]int)
+	for _, pool := range pools {
+		if pool.Spec.Class != v1alpha1.PoolClassEgress {
+			continue
+		}
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.System != "" {
+				continue
+			}
+			current[allocation.EgressNamespace] = allocation.NodeName
+			currentIP[allocation.EgressNamespace] = ip
+			load[allocation.NodeName]++
+		}
+	}
+
+	wanted := make(map[string]string)
+	for i := range namespaces.Items {
+		ns := &namespaces.Items[i]
+		poolName := ns.Annotations[EgressPoolAnnotation]
+		if poolName == "" || ns.DeletionTimestamp != nil {
+			continue
+		}
+		wanted[ns.Name] = poolName
+		if frozen {
+			continue
+		}
+
+		logger := p.logger.With(slog.String("namespace", ns.Name), slog.String("pool", poolName))
+		if len(gateways) == 0 {
+			logger.Warn("No ready egress gateway node", slog.String("label", EgressGatewayLabel))
+			continue
+		}
+
+		gateway := current[ns.Name]
+		if !lo.Contains(gateways, gateway) {
+			gateway = lo.MinBy(gateways, func(a, b string) bool { return load[a] < load[b] })
+			load[gateway]++
+		}
+
+		if err := p.assignEgressIP(ctx, allocator, projectID, poolName, ns, current[ns.Name], currentIP[ns.Name], gateway); err != nil {
+			logger.Error("Failed to assign egress IP", slog.String("gateway", gateway), slog.String("error", err.Error()))
+		}
+	}
+
+	// Namespaces that no longer want an egress IP give it back
+	for _, pool := range pools {
+		if pool.Spec.Class != v1alpha1.PoolClassEgress {
+			continue
+		}
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.System != "" || wanted[allocation.EgressNamespace] == pool.Name {
+				continue
+			}
+
+			logger := p.logger.With(
+				slog.String("namespace", allocation.EgressNamespace),
+				slog.String("pool", pool.Name),
+				slog.String("ip", ip),
+			)
+			if err := p.removeAliasIP(ctx, projectID, allocation.NodeName, ip); err != nil {
+				logger.Error("Failed to detach egress IP", slog.String("error", err.Error()))
+				continue
+			}
+			if err := allocator.ReleaseEgressIP(ctx, pool.Name, allocation.EgressNamespace); err != nil {
+				logger.Error("Failed to release egress IP", slog.String("error", err.Error()))
+				continue
+			}
+			logger.Info("Released egress IP")
+		}
+	}
+	return nil
+}
+
+// assignEgressIP reserves the egress IP of the namespace on gateway and
+// attaches it there. An IP held by another gateway, from, is detached there
+// before the allocation moves, so a failed detach leaves it recorded on the
+// old gateway and the next reconcile tries again.
+func (p *Provisioner) assignEgressIP(ctx context.Context, allocator *ipam.Allocator, projectID, poolName string, ns *corev1.Namespace, from, ip, gateway string) error {
+	if from != "" && from != gateway {
+		if err := p.removeAliasIP(ctx, projectID, from, ip); err != nil {
+			return fmt.Errorf("detach egress IP from %s: %w", from, err)
+		}
+	}
+
+	result, previousNode, err := allocator.ReserveEgressIP(ctx, poolName, ns.Name, gateway)
+	if err != nil {
+		return err
+	}
+
+	// Fence the old gateway before the IP shows up on the new one. It was
+	// detached above unless the allocation moved since the pools were listed.
+	if previousNode != "" {
+		if previousNode != from {
+			if err := p.removeAliasIP(ctx, projectID, previousNode, result.IP); err != nil {
+				return fmt.Errorf("detach egress IP from %s: %w", previousNode, err)
+			}
+		}
+		p.logger.Info("Moved egress IP off previous gateway",
+			slog.String("namespace", ns.Name),
+			slog.String("ip", result.IP),
+			slog.String("from", previousNode),
+			slog.String("to", gateway),
+		)
+	}
+
+	if err := p.addAliasIP(ctx, projectID, gateway, result.IP, result.SecondaryRangeName); err != nil {
+		return err
+	}
+
+	if ns.Annotations[EgressNodeAnnotation] != gateway {
+		updated := ns.DeepCopy()
+		updated.Annotations[EgressNodeAnnotation] = gateway
+		if _, err := p.kubeClient.CoreV1().Namespaces().Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("update namespace: %w", err)
+		}
+		p.logger.Info("Assigned egress IP",
+			slog.String("namespace", ns.Name),
+			slog.String("ip", result.IP),
+			slog.String("gateway", gateway),
+		)
+	}
+	return nil
+}
+
+// addAliasIP attaches ip as a /32 alias from the named secondary range to the
+// instance, doing nothing when it is already attached
+func (p *Provisioner) addAliasIP(ctx context.Context, projectID, instanceName, ip, rangeName string) error {
+	naming, err := p.naming(ctx)
+	if err != nil {
+		return err
+	}
+	return p.updateAliasRanges(ctx, projectID, instanceName, true, false, func(current []*computepb.AliasIpRange) ([]*computepb.AliasIpRange, bool) {
+		if lo.ContainsBy(current, func(r *computepb.AliasIpRange) bool {
+			return ownsAlias(naming, r, ip, ipam.AliasRange(rangeName))
+		}) {
+			return current, false
+		}
+		return append(current, &computepb.AliasIpRange{
+			IpCidrRange:         proto.String(ipam.HostPrefix(ip)),
+			SubnetworkRangeName: proto.String(ipam.AliasRange(rangeName)),
+		}), true
+	})
+}
+
+func nodeReady(node *corev1.Node) bool {
+	return lo.ContainsBy(node.Status.Conditions, func(c corev1.NodeCondition) bool {
+		return c.Type == corev1.NodeReady && c.Status == corev1.ConditionTrue
+	})
+}
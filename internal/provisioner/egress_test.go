@@ -0,0 +1,79 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestReconcileEgressMovesGateway(t *testing.T) {
+	ctx := context.Background()
+	const ip = "10.8.0.5"
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "egress"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:               "10.8.0.0/24",
+			Class:              v1alpha1.PoolClassEgress,
+			SecondaryRangeName: "egress",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				ip: {EgressNamespace: "team", NodeName: "gw-1"},
+			},
+		},
+	}
+	gateway := func(name string, ready corev1.ConditionStatus) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{EgressGatewayLabel: "true"}},
+			Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: ready}}},
+		}
+	}
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{pool},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "team",
+			Annotations: map[string]string{EgressPoolAnnotation: "egress", EgressNodeAnnotation: "gw-1"},
+		}},
+		gateway("gw-1", corev1.ConditionFalse),
+		gateway("gw-2", corev1.ConditionTrue),
+	)
+	gce := newFakeGCE(t, p)
+	gce.addInstance("gw-1", "egress", ip)
+	gce.addInstance("gw-2", "egress")
+	allocator := ipam.NewAllocator(p.dynamicClient)
+
+	// The IP stays on the old gateway while it cannot be detached there
+	gce.failUpdates("gw-1", true)
+	if err := p.reconcileEgress(ctx, allocator, testProject); err != nil {
+		t.Fatal(err)
+	}
+	if got := testPool(t, p, "egress").Spec.Allocations[ip].NodeName; got != "gw-1" {
+		t.Errorf("allocation moved to %s before the alias left gw-1", got)
+	}
+	if got := gce.aliases("gw-2"); len(got) != 0 {
+		t.Errorf("aliases of gw-2 = %v while gw-1 holds the IP", got)
+	}
+
+	gce.failUpdates("gw-1", false)
+	if err := p.reconcileEgress(ctx, allocator, testProject); err != nil {
+		t.Fatal(err)
+	}
+	if got := gce.aliases("gw-1"); len(got) != 0 {
+		t.Errorf("aliases of gw-1 = %v, want the egress IP detached", got)
+	}
+	if got := gce.aliases("gw-2"); len(got) != 1 || got[0] != ip+"/32" {
+		t.Errorf("aliases of gw-2 = %v, want %s/32", got, ip)
+	}
+	if got := testPool(t, p, "egress").Spec.Allocations[ip].NodeName; got != "gw-2" {
+		t.Errorf("allocation on %s, want gw-2", got)
+	}
+	ns, err := p.kubeClient.CoreV1().Namespaces().Get(ctx, "team", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ns.Annotations[EgressNodeAnnotation]; got != "gw-2" {
+		t.Errorf("namespace %s = %s, want gw-2", EgressNodeAnnotation, got)
+	}
+}
@@ -0,0 +1,163 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// PodCleanupFinalizer keeps a deleted pod around until its IP is released in
+// the pool and no longer attached to or routed to its node
+const PodCleanupFinalizer = "ipam.gcp-cni.cast.ai/ip-cleanup"
+
+// releaseCleanupFinalizers removes PodCleanupFinalizer from deleted pods once
+// their IP is cleaned up. The plugin's DEL detaches and releases the IP of a
+// pod on a live node, the pods of a node that is gone are cleaned up here.
+func (p *Provisioner) releaseCleanupFinalizers(ctx context.Context, allocator *ipam.Allocator, projectID string, frozen bool) error {
+	pods, err := p.kubeClient.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list pods: %w", err)
+	}
+
+	var deleted []*corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil && lo.Contains(pod.Finalizers, PodCleanupFinalizer) {
+			deleted = append(deleted, pod)
+		}
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+	// Pod UID to the pool and IP still allocated to it, and IP to the pod
+	// UID it is allocated to
+	allocated := map[string][][2]string{}
+	owners := map[string]string{}
+	for _, pool := range pools {
+		for ip, allocation := range pool.Spec.Allocations {
+			owners[ip] = allocation.PodUID
+			if allocation.PodUID != "" && !allocation.Buffered {
+				allocated[allocation.PodUID] = append(allocated[allocation.PodUID], [2]string{pool.Name, ip})
+			}
+		}
+	}
+
+	for _, pod := range deleted {
+		logger := p.logger.With(
+			slog.String("pod", fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)),
+			slog.String("node", pod.Spec.NodeName),
+		)
+		clean, err := p.podIPCleanedUp(ctx, allocator, projectID, pod, allocated[string(pod.UID)], owners, frozen, logger)
+		if err != nil {
+			logger.Error("Failed to check IP cleanup of deleted pod", slog.String("error", err.Error()))
+			continue
+		}
+		if !clean {
+			continue
+		}
+
+		pod.Finalizers = lo.Without(pod.Finalizers, PodCleanupFinalizer)
+		if _, err := p.kubeClient.CoreV1().Pods(pod.Namespace).Update(ctx, pod, metav1.UpdateOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			logger.Error("Failed to remove IP cleanup finalizer", slog.String("error", err.Error()))
+			continue
+		}
+		logger.Debug("Removed IP cleanup finalizer of deleted pod")
+	}
+	return nil
+}
+
+// podIPCleanedUp reports whether the deleted pod has no IP allocated, attached
+// or routed anymore. The IPs allocated to a pod whose node is gone are
+// detached and released here, unless frozen. A released IP that is allocated
+// again, to another pod, is no longer the deleted pod's to clean up.
+func (p *Provisioner) podIPCleanedUp(ctx context.Context, allocator *ipam.Allocator, projectID string, pod *corev1.Pod, allocated [][2]string, owners map[string]string, frozen bool, logger *slog.Logger) (bool, error) {
+	if pod.Spec.NodeName == "" {
+		return len(allocated) == 0, nil
+	}
+
+	if len(allocated) > 0 {
+		_, err := p.kubeClient.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{})
+		switch {
+		case err == nil:
+			// DEL on the node has yet to run
+			return false, nil
+		case !apierrors.IsNotFound(err):
+			return false, fmt.Errorf("get node %s: %w", pod.Spec.NodeName, err)
+		case frozen:
+			return false, nil
+		}
+		for _, allocation := range allocated {
+			poolName, ip := allocation[0], allocation[1]
+			if err := p.removeAliasIP(ctx, projectID, pod.Spec.NodeName, ip); err != nil {
+				return false, fmt.Errorf("detach %s: %w", ip, err)
+			}
+			if _, err := allocator.ReleaseIfOwner(ctx, poolName, ip, string(pod.UID)); err != nil {
+				return false, fmt.Errorf("release %s: %w", ip, err)
+			}
+			logger.Info("Released IP of deleted pod on a node that is gone", slog.String("pool", poolName), slog.String("ip", ip))
+		}
+		return true, nil
+	}
+
+	var ips []string
+	for _, podIP := range pod.Status.PodIPs {
+		ip := ipam.CanonicalIP(podIP.IP)
+		if owner, ok := owners[ip]; ok && owner != string(pod.UID) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return true, nil
+	}
+	_, instance, err := p.findInstance(ctx, p.instanceProject(ctx, projectID, pod.Spec.NodeName), pod.Spec.NodeName)
+	if err != nil {
+		return false, err
+	}
+	naming, err := p.naming(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		for _, nic := range instance.GetNetworkInterfaces() {
+			if lo.ContainsBy(nic.GetAliasIpRanges(), func(r *computepb.AliasIpRange) bool {
+				return ownsAlias(naming, r, ip)
+			}) {
+				return false, nil
+			}
+		}
+		routed, err := p.routedTo(ctx, projectID, pod.Spec.NodeName, ip)
+		if err != nil || routed {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// routedTo reports whether the VPC route the plugin programs for ip points at
+// the named instance
+func (p *Provisioner) routedTo(ctx context.Context, projectID, instanceName, ip string) (bool, error) {
+	name := ipam.RouteName(ip)
+	route, err := p.routesClient.Get(ctx, &computepb.GetRouteRequest{Project: p.networkProject(projectID), Route: name})
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("get route %s: %w", name, err)
+	}
+	return strings.HasSuffix(route.GetNextHopInstance(), "/instances/"+instanceName), nil
+}
@@ -0,0 +1,82 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestReleaseCleanupFinalizers(t *testing.T) {
+	ctx := context.Background()
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/24",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				// Released by DEL and taken by a new pod on the same node
+				"10.8.0.3": {PodName: "new", PodNamespace: "default", PodUID: "new-uid", NodeName: "node-1"},
+				"10.8.0.5": {PodName: "orphan", PodNamespace: "default", PodUID: "orphan-uid", NodeName: "node-2"},
+			},
+		},
+	}
+	deleted := func(name, node, ip string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         "default",
+				Name:              name,
+				UID:               types.UID(name + "-uid"),
+				DeletionTimestamp: &metav1.Time{},
+				Finalizers:        []string{PodCleanupFinalizer},
+			},
+			Spec:   corev1.PodSpec{NodeName: node},
+			Status: corev1.PodStatus{PodIPs: []corev1.PodIP{{IP: ip}}},
+		}
+	}
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{pool},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		deleted("reused", "node-1", "10.8.0.3"),
+		deleted("attached", "node-1", "10.8.0.4"),
+		deleted("orphan", "node-2", "10.8.0.5"),
+	)
+	gce := newFakeGCE(t, p)
+	gce.addInstance("node-1", "pods", "10.8.0.3", "10.8.0.4")
+	gce.addInstance("node-2", "pods", "10.8.0.5")
+	allocator := ipam.NewAllocator(p.dynamicClient)
+
+	if err := p.releaseCleanupFinalizers(ctx, allocator, testProject, false); err != nil {
+		t.Fatal(err)
+	}
+	finalized := func(name string) bool {
+		t.Helper()
+		pod, err := p.kubeClient.CoreV1().Pods("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return !lo.Contains(pod.Finalizers, PodCleanupFinalizer)
+	}
+	if !finalized("reused") {
+		t.Error("finalizer of a pod whose IP went to another pod was kept")
+	}
+	if finalized("attached") {
+		t.Error("finalizer of a pod whose IP is still attached was removed")
+	}
+	if !finalized("orphan") {
+		t.Error("finalizer of a pod on a node that is gone was kept")
+	}
+	if _, ok := testPool(t, p, "pool").Spec.Allocations["10.8.0.5"]; ok {
+		t.Error("IP of the pod on a node that is gone was not released")
+	}
+	if got := gce.aliases("node-2"); len(got) != 0 {
+		t.Errorf("aliases of node-2 = %v, want none", got)
+	}
+	if got := gce.updateCount("node-1"); got != 0 {
+		t.Errorf("node-1 got %d network interface updates, want none", got)
+	}
+}
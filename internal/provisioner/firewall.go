@@ -0,0 +1,149 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/iterator"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// RunFirewallController checks the firewall rules and network tags IPPools
+// reference every interval until ctx is done and reports the result in their
+// FirewallReady condition, so pods that got IPs but whose traffic is blocked
+// are diagnosed from the pool instead of packet captures
+func (p *Provisioner) RunFirewallController(ctx context.Context, interval time.Duration) error {
+	projectID, err := identity.ProjectID(ctx)
+	if err != nil {
+		return fmt.Errorf("get project ID from metadata: %w", err)
+	}
+
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting firewall verification controller", slog.Duration("interval", interval))
+
+	for {
+		if err := p.verifyFirewalls(ctx, allocator, projectID); err != nil {
+			p.logger.Error("Firewall verification failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) verifyFirewalls(ctx context.Context, allocator *ipam.Allocator, projectID string) error {
+	if p.frozen(ctx, allocator) {
+		return nil
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+	var referencing []*v1alpha1.IPPool
+	tagged := false
+	for i := range pools {
+		pool := &pools[i]
+		if pool.Spec.Firewall != nil {
+			referencing = append(referencing, pool)
+			tagged = tagged || len(pool.Spec.Firewall.Tags) > 0
+			continue
+		}
+		// References removed from the pool take the condition with them
+		if meta.FindStatusCondition(pool.Status.Conditions, v1alpha1.IPPoolFirewallReady) != nil {
+			if err := allocator.SetCondition(ctx, pool.Name, metav1.Condition{Type: v1alpha1.IPPoolFirewallReady}); err != nil {
+				p.logger.Error("Failed to remove firewall condition of pool", slog.String("pool", pool.Name), slog.String("error", err.Error()))
+			}
+		}
+	}
+	if len(referencing) == 0 {
+		return nil
+	}
+
+	rules, err := p.firewallRules(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	var nodeTags map[string][]string
+	if tagged {
+		if nodeTags, err = p.instanceTags(ctx, projectID); err != nil {
+			return err
+		}
+	}
+
+	for _, pool := range referencing {
+		condition := ipam.CheckFirewall(pool, rules, nodeTags)
+		if err := allocator.SetCondition(ctx, pool.Name, condition); err != nil {
+			p.logger.Error("Failed to set firewall condition of pool", slog.String("pool", pool.Name), slog.String("error", err.Error()))
+			continue
+		}
+		if condition.Status != metav1.ConditionTrue {
+			p.logger.Warn("Firewall of pool is incomplete",
+				slog.String("pool", pool.Name),
+				slog.String("reason", condition.Reason),
+				slog.String("message", condition.Message),
+			)
+		}
+	}
+	return nil
+}
+
+// firewallRules lists the firewall rules of the VPC by name
+func (p *Provisioner) firewallRules(ctx context.Context, projectID string) (map[string]ipam.FirewallRule, error) {
+	rules := map[string]ipam.FirewallRule{}
+	it := p.firewallsClient.List(ctx, &computepb.ListFirewallsRequest{
+		Project: p.networkProject(projectID),
+	})
+	for {
+		rule, err := it.Next()
+		if err == iterator.Done {
+			return rules, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list firewall rules: %w", err)
+		}
+		rules[rule.GetName()] = ipam.FirewallRule{Disabled: rule.GetDisabled()}
+	}
+}
+
+// instanceTags lists the network tags of the instances in the projects of the
+// nodes by instance name
+func (p *Provisioner) instanceTags(ctx context.Context, projectID string) (map[string][]string, error) {
+	tags := map[string][]string{}
+	projects, err := p.instanceProjects(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	for _, project := range projects {
+		instances := p.instancesClient.AggregatedList(ctx, &computepb.AggregatedListInstancesRequest{
+			Project: project,
+		})
+		for {
+			pair, err := instances.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("list instances of project %s: %w", project, err)
+			}
+			for _, instance := range pair.Value.GetInstances() {
+				tags[instance.GetName()] = instance.GetTags().GetItems()
+			}
+		}
+	}
+	return tags, nil
+}
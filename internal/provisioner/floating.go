@@ -0,0 +1,227 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/samber/lo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// FloatingIPFinalizer keeps a FloatingIP around until its alias is detached
+// and its IP released
+const FloatingIPFinalizer = "ipam.gcp-cni.cast.ai/floating-ip"
+
+// RunFloatingIPController attaches every FloatingIP to the node it asks for
+// every interval until ctx is done. A move always detaches the alias from the
+// old node before attaching it to the new one, so the IP is never routed to
+// two nodes at once.
+func (p *Provisioner) RunFloatingIPController(ctx context.Context, interval time.Duration) error {
+	projectID, err := identity.ProjectID(ctx)
+	if err != nil {
+		return fmt.Errorf("get project ID from metadata: %w", err)
+	}
+
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting floating IP controller", slog.Duration("interval", interval))
+
+	for {
+		if err := p.reconcileFloatingIPs(ctx, allocator, projectID); err != nil {
+			p.logger.Error("Floating IP reconciliation failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) reconcileFloatingIPs(ctx context.Context, allocator *ipam.Allocator, projectID string) error {
+	frozen := p.frozen(ctx, allocator)
+
+	list, err := p.dynamicClient.Resource(ipam.FloatingIPGVR).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list floating IPs: %w", err)
+	}
+
+	for _, item := range list.Items {
+		fip := &v1alpha1.FloatingIP{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, fip); err != nil {
+			return fmt.Errorf("convert floating IP: %w", err)
+		}
+
+		// Deleted floating IPs are still released
+		if frozen && fip.DeletionTimestamp == nil {
+			continue
+		}
+
+		logger := p.logger.With(slog.String("floating_ip", fmt.Sprintf("%s/%s", fip.Namespace, fip.Name)))
+		if err := p.reconcileFloatingIP(ctx, allocator, projectID, fip, logger); err != nil {
+			logger.Error("Failed to reconcile floating IP", slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+func (p *Provisioner) reconcileFloatingIP(ctx context.Context, allocator *ipam.Allocator, projectID string, fip *v1alpha1.FloatingIP, logger *slog.Logger) error {
+	ref := fmt.Sprintf("%s/%s", fip.Namespace, fip.Name)
+
+	if fip.DeletionTimestamp != nil {
+		if !lo.Contains(fip.Finalizers, FloatingIPFinalizer) {
+			return nil
+		}
+		if fip.Status.NodeName != "" {
+			if err := p.removeAliasIP(ctx, projectID, fip.Status.NodeName, fip.Status.IP); err != nil {
+				return fmt.Errorf("detach from %s: %w", fip.Status.NodeName, err)
+			}
+		}
+		if err := allocator.ReleaseFloatingIP(ctx, fip.Spec.Pool, ref); err != nil {
+			return err
+		}
+		fip.Finalizers = lo.Without(fip.Finalizers, FloatingIPFinalizer)
+		if _, err := p.updateFloatingIP(ctx, fip); err != nil {
+			return err
+		}
+		logger.Info("Released floating IP", slog.String("ip", fip.Status.IP))
+		return nil
+	}
+
+	if !lo.Contains(fip.Finalizers, FloatingIPFinalizer) {
+		fip.Finalizers = append(fip.Finalizers, FloatingIPFinalizer)
+		updated, err := p.updateFloatingIP(ctx, fip)
+		if err != nil {
+			return err
+		}
+		fip = updated
+	}
+
+	result, err := allocator.ReserveFloatingIP(ctx, fip.Spec.Pool, ref, fip.Spec.IP)
+	if err != nil {
+		return p.setFloatingIPPhase(ctx, fip, v1alpha1.FloatingIPFailed, err)
+	}
+	fip.Status.IP = result.IP
+
+	desired, err := p.floatingIPTarget(ctx, fip)
+	if err != nil {
+		return p.setFloatingIPPhase(ctx, fip, v1alpha1.FloatingIPFailed, err)
+	}
+
+	if fip.Status.NodeName == desired && (desired == "" || fip.Status.Phase == v1alpha1.FloatingIPAttached) {
+		phase := v1alpha1.FloatingIPAttached
+		if desired == "" {
+			phase = v1alpha1.FloatingIPPending
+		}
+		return p.setFloatingIPPhase(ctx, fip, phase, nil)
+	}
+
+	// Fence the old node before the IP shows up anywhere else
+	if fip.Status.NodeName != "" && fip.Status.NodeName != desired {
+		if err := p.removeAliasIP(ctx, projectID, fip.Status.NodeName, result.IP); err != nil {
+			return p.setFloatingIPPhase(ctx, fip, v1alpha1.FloatingIPFailed, fmt.Errorf("detach from %s: %w", fip.Status.NodeName, err))
+		}
+		if err := allocator.SetFloatingIPNode(ctx, fip.Spec.Pool, ref, ""); err != nil {
+			return err
+		}
+		logger.Info("Detached floating IP", slog.String("ip", result.IP), slog.String("node", fip.Status.NodeName))
+
+		fip.Status.NodeName = ""
+		phase := v1alpha1.FloatingIPMoving
+		if desired == "" {
+			phase = v1alpha1.FloatingIPPending
+		}
+		if err := p.setFloatingIPPhase(ctx, fip, phase, nil); err != nil {
+			return err
+		}
+	}
+
+	if desired == "" {
+		return nil
+	}
+
+	if err := p.addAliasIP(ctx, projectID, desired, result.IP, result.SecondaryRangeName); err != nil {
+		return p.setFloatingIPPhase(ctx, fip, v1alpha1.FloatingIPFailed, fmt.Errorf("attach to %s: %w", desired, err))
+	}
+	if err := allocator.SetFloatingIPNode(ctx, fip.Spec.Pool, ref, desired); err != nil {
+		return err
+	}
+	logger.Info("Attached floating IP", slog.String("ip", result.IP), slog.String("node", desired))
+
+	fip.Status.NodeName = desired
+	return p.setFloatingIPPhase(ctx, fip, v1alpha1.FloatingIPAttached, nil)
+}
+
+// floatingIPTarget returns the node the floating IP should be attached to:
+// the node of the followed pod, or the requested node. Empty means nowhere.
+func (p *Provisioner) floatingIPTarget(ctx context.Context, fip *v1alpha1.FloatingIP) (string, error) {
+	if fip.Spec.PodName == "" {
+		return fip.Spec.NodeName, nil
+	}
+
+	pod, err := p.kubeClient.CoreV1().Pods(fip.Namespace).Get(ctx, fip.Spec.PodName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("get followed pod %s: %w", fip.Spec.PodName, err)
+	}
+	if pod.DeletionTimestamp != nil {
+		return "", nil
+	}
+	return pod.Spec.NodeName, nil
+}
+
+// setFloatingIPPhase records phase and err in the status, together with the IP
+// and node the caller set, writing it only when the phase or message changed.
+// It returns err so failures can be recorded and returned at once.
+func (p *Provisioner) setFloatingIPPhase(ctx context.Context, fip *v1alpha1.FloatingIP, phase v1alpha1.FloatingIPPhase, err error) error {
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+
+	if fip.Status.Phase != phase || fip.Status.Message != message {
+		if fip.Status.Phase != phase {
+			fip.Status.LastTransitionTime = metav1.Now()
+		}
+		fip.Status.Phase = phase
+		fip.Status.Message = message
+
+		updated, updateErr := p.updateFloatingIP(ctx, fip)
+		if updateErr != nil {
+			if err != nil {
+				return err
+			}
+			return updateErr
+		}
+		*fip = *updated
+	}
+	return err
+}
+
+func (p *Provisioner) updateFloatingIP(ctx context.Context, fip *v1alpha1.FloatingIP) (*v1alpha1.FloatingIP, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(fip)
+	if err != nil {
+		return nil, fmt.Errorf("convert to unstructured: %w", err)
+	}
+
+	result, err := p.dynamicClient.Resource(ipam.FloatingIPGVR).Namespace(fip.Namespace).Update(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("update floating IP: %w", err)
+	}
+
+	updated := &v1alpha1.FloatingIP{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(result.Object, updated); err != nil {
+		return nil, fmt.Errorf("convert floating IP: %w", err)
+	}
+	return updated, nil
+}
@@ -0,0 +1,73 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestReconcileFloatingIPRequestedIP(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		ip        string
+		wantPhase v1alpha1.FloatingIPPhase
+	}{
+		{name: "IP of the pool", ip: "10.8.0.50", wantPhase: v1alpha1.FloatingIPPending},
+		{name: "IP outside the pool", ip: "10.9.0.50", wantPhase: v1alpha1.FloatingIPFailed},
+		{name: "gateway address", ip: "10.8.0.1", wantPhase: v1alpha1.FloatingIPFailed},
+		{name: "broadcast address", ip: "10.8.0.255", wantPhase: v1alpha1.FloatingIPFailed},
+		{name: "vacating IP", ip: "10.8.0.200", wantPhase: v1alpha1.FloatingIPFailed},
+		{name: "not an IP", ip: "vip", wantPhase: v1alpha1.FloatingIPFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvisioner(t, []*v1alpha1.IPPool{{
+				ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+				Spec: v1alpha1.IPPoolSpec{
+					CIDR:        "10.8.0.0/24",
+					Vacating:    []string{"10.8.0.192/26"},
+					Allocations: map[string]v1alpha1.IPAllocation{},
+				},
+			}})
+			fip := &v1alpha1.FloatingIP{
+				TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: "FloatingIP"},
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vip"},
+				Spec:       v1alpha1.FloatingIPSpec{Pool: "pool", IP: tt.ip},
+			}
+			obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(fip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.dynamicClient.Resource(ipam.FloatingIPGVR).Namespace("default").Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := p.reconcileFloatingIPs(ctx, ipam.NewAllocator(p.dynamicClient), testProject); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := p.dynamicClient.Resource(ipam.FloatingIPGVR).Namespace("default").Get(ctx, "vip", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(got.Object, fip); err != nil {
+				t.Fatal(err)
+			}
+			if fip.Status.Phase != tt.wantPhase {
+				t.Errorf("phase = %s (%s), want %s", fip.Status.Phase, fip.Status.Message, tt.wantPhase)
+			}
+			_, reserved := testPool(t, p, "pool").Spec.Allocations[ipam.CanonicalIP(tt.ip)]
+			if reserved != (tt.wantPhase != v1alpha1.FloatingIPFailed) {
+				t.Errorf("%s reserved = %v in phase %s", tt.ip, reserved, fip.Status.Phase)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package provisioner
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// minForecastSpan is how long a pool is sampled before its forecast is
+// trusted, a few samples after a restart say little about the trend
+const minForecastSpan = time.Hour
+
+// RunForecastController samples the allocations of every pool every interval
+// until ctx is done and records in the pool status how many allocations per
+// day it grows by over the last window, and the days until it runs out of IPs
+// at that rate, so capacity is expanded before pods fail to get IPs. Samples
+// are kept in memory, a restarted provisioner keeps the recorded forecasts
+// until it sampled for minForecastSpan again.
+func (p *Provisioner) RunForecastController(ctx context.Context, interval, window time.Duration) error {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting pool usage forecast controller",
+		slog.Duration("interval", interval),
+		slog.Duration("window", window),
+	)
+
+	samples := map[string][]ipam.UsageSample{}
+	for {
+		if err := p.forecastPools(ctx, allocator, samples, window); err != nil {
+			p.logger.Error("Pool usage forecast failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) forecastPools(ctx context.Context, allocator *ipam.Allocator, samples map[string][]ipam.UsageSample, window time.Duration) error {
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, pool := range pools {
+		seen[pool.Name] = true
+		kept := samples[pool.Name][:0]
+		for _, sample := range samples[pool.Name] {
+			if now.Sub(sample.Time) <= window {
+				kept = append(kept, sample)
+			}
+		}
+		samples[pool.Name] = append(kept, ipam.UsageSample{Time: now, Allocated: pool.Status.Allocated})
+	}
+	for name := range samples {
+		if !seen[name] {
+			delete(samples, name)
+		}
+	}
+
+	if p.frozen(ctx, allocator) {
+		return nil
+	}
+
+	for _, pool := range pools {
+		history := samples[pool.Name]
+		if now.Sub(history[0].Time) < minForecastSpan {
+			continue
+		}
+
+		perDay, days, ok := ipam.ForecastExhaustion(history, pool.Status.Available)
+		var daysUntilExhaustion *int
+		if ok {
+			daysUntilExhaustion = new(int)
+			*daysUntilExhaustion = int(min(days, math.MaxInt32))
+		}
+		if err := allocator.SetForecast(ctx, pool.Name, int(math.Round(perDay)), daysUntilExhaustion); err != nil {
+			p.logger.Error("Failed to record usage forecast of pool",
+				slog.String("pool", pool.Name),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		if ok {
+			p.logger.Debug("Forecast pool exhaustion",
+				slog.String("pool", pool.Name),
+				slog.Float64("allocations_per_day", perDay),
+				slog.Int("days_until_exhaustion", *daysUntilExhaustion),
+			)
+		}
+	}
+	return nil
+}
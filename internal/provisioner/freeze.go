@@ -0,0 +1,65 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// SetPluginConfigMap names the ConfigMap holding the plugin configuration,
+// whose freeze switch the controllers follow
+func (p *Provisioner) SetPluginConfigMap(namespace, name string) {
+	p.configMapNamespace = namespace
+	p.configMapName = name
+}
+
+// frozen reports whether operators froze IP management through the plugin
+// configuration and freezes or unfreezes allocator accordingly. Controllers
+// skip instance, pool and pod mutations while frozen but keep serving reads
+// and releases. A configuration that cannot be read counts as frozen, an
+// incident is the worst time to mutate on a guess.
+func (p *Provisioner) frozen(ctx context.Context, allocator *ipam.Allocator) bool {
+	freeze, err := p.freeze(ctx)
+	if err != nil {
+		freeze = config.Freeze{Enabled: true, Reason: fmt.Sprintf("plugin configuration unreadable: %v", err)}
+	}
+	if !freeze.Enabled {
+		allocator.Unfreeze()
+		return false
+	}
+
+	allocator.Freeze(freeze.Reason)
+	p.logger.Warn("IP management is frozen, skipping mutations", slog.String("reason", freeze.Reason))
+	return true
+}
+
+func (p *Provisioner) freeze(ctx context.Context) (config.Freeze, error) {
+	cfg, err := p.pluginConfig(ctx)
+	if err != nil {
+		return config.Freeze{}, err
+	}
+	return cfg.Freeze, nil
+}
+
+// pluginConfig reads the plugin configuration, the defaults when there is none
+func (p *Provisioner) pluginConfig(ctx context.Context) (*config.Config, error) {
+	if p.configMapName == "" {
+		return config.Default(), nil
+	}
+
+	cm, err := p.kubeClient.CoreV1().ConfigMaps(p.configMapNamespace).Get(ctx, p.configMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return config.Default(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get ConfigMap %s/%s: %w", p.configMapNamespace, p.configMapName, err)
+	}
+
+	return config.Parse([]byte(cm.Data[config.ConfigMapKey]))
+}
@@ -0,0 +1,293 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/samber/lo"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// fingerprintRetries bounds the rereads of an instance whose network interface
+// fingerprint went stale
+const fingerprintRetries = 3
+
+// gcConcurrency bounds the nodes whose expired leases are reclaimed at once
+const gcConcurrency = 10
+
+// RunLeaseGC reclaims allocations whose lease expired every interval until
+// ctx is done. The allocation is released only while its lease is still
+// expired, and the alias IP removed from the instance only after that, so a
+// lease renewed meanwhile never loses its alias. An ADD handed the IP before
+// the alias is gone fails its attach and is retried. With podFinalizer it also
+// releases PodCleanupFinalizer of deleted pods whose IP is cleaned up.
+func (p *Provisioner) RunLeaseGC(ctx context.Context, interval time.Duration, podFinalizer bool) error {
+	projectID, err := identity.ProjectID(ctx)
+	if err != nil {
+		return fmt.Errorf("get project ID from metadata: %w", err)
+	}
+
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting allocation lease garbage collector",
+		slog.Duration("interval", interval),
+		slog.Bool("pod_finalizer", podFinalizer),
+	)
+
+	for {
+		if err := p.collectExpiredLeases(ctx, allocator, projectID); err != nil {
+			p.logger.Error("Lease garbage collection failed", slog.String("error", err.Error()))
+		}
+		if podFinalizer {
+			if err := p.releaseCleanupFinalizers(ctx, allocator, projectID, p.frozen(ctx, allocator)); err != nil {
+				p.logger.Error("Releasing pod cleanup finalizers failed", slog.String("error", err.Error()))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) collectExpiredLeases(ctx context.Context, allocator *ipam.Allocator, projectID string) error {
+	if p.frozen(ctx, allocator) {
+		return nil
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, pool := range pools {
+		// Pools without leases only expire the quarantine of conflicting IPs
+		leased := pool.Spec.LeaseDuration != nil
+		if !leased && !lo.SomeBy(lo.Values(pool.Spec.Allocations), quarantined) {
+			continue
+		}
+
+		expired, err := allocator.ExpiredLeases(ctx, pool.Name, now)
+		if err != nil {
+			p.logger.Error("Failed to list expired leases", slog.String("pool", pool.Name), slog.String("error", err.Error()))
+			continue
+		}
+		if !leased {
+			expired = lo.PickBy(expired, func(_ string, allocation v1alpha1.IPAllocation) bool {
+				return quarantined(allocation)
+			})
+		}
+
+		// Nodes are detached concurrently so their operations are waited for
+		// together, the IPs of a single node one after another
+		byNode := map[string][]string{}
+		for ip, allocation := range expired {
+			byNode[allocation.NodeName] = append(byNode[allocation.NodeName], ip)
+		}
+
+		var g errgroup.Group
+		g.SetLimit(gcConcurrency)
+		for _, ips := range byNode {
+			g.Go(func() error {
+				for _, ip := range ips {
+					p.reclaimExpiredLease(ctx, allocator, projectID, pool.Name, ip, expired[ip], now)
+				}
+				return nil
+			})
+		}
+		_ = g.Wait()
+	}
+	return nil
+}
+
+// quarantined reports whether the allocation is a conflicting IP the plugin
+// quarantined until its lease expires
+func quarantined(allocation v1alpha1.IPAllocation) bool {
+	return allocation.PodName == ipam.ConflictPlaceholder && allocation.LeaseExpiresAt != nil
+}
+
+func (p *Provisioner) reclaimExpiredLease(ctx context.Context, allocator *ipam.Allocator, projectID, poolName, ip string, allocation v1alpha1.IPAllocation, now time.Time) {
+	logger := p.logger.With(
+		slog.String("pool", poolName),
+		slog.String("ip", ip),
+		slog.String("node", allocation.NodeName),
+		slog.String("pod", fmt.Sprintf("%s/%s", allocation.PodNamespace, allocation.PodName)),
+	)
+
+	// A lease renewed since it was listed keeps its alias
+	released, err := allocator.ReleaseExpired(ctx, poolName, ip, now)
+	if err != nil {
+		logger.Error("Failed to release expired lease", slog.String("error", err.Error()))
+		return
+	}
+	if !released {
+		return
+	}
+
+	if err := p.removeAliasIP(ctx, projectID, allocation.NodeName, ip); err != nil {
+		logger.Error("Failed to remove alias IP of expired lease", slog.String("error", err.Error()))
+		return
+	}
+	logger.Info("Reclaimed allocation with expired lease")
+}
+
+// removeAliasIP detaches the /32 alias of ip from whichever network interface
+// of the named instance holds it. An IP without an alias may be routed to
+// the instance instead, the route is removed then. An instance that no longer
+// exists has nothing to detach.
+func (p *Provisioner) removeAliasIP(ctx context.Context, projectID, instanceName, ip string) error {
+	naming, err := p.naming(ctx)
+	if err != nil {
+		return err
+	}
+	removed := false
+	err = p.updateAliasRanges(ctx, projectID, instanceName, false, true, func(current []*computepb.AliasIpRange) ([]*computepb.AliasIpRange, bool) {
+		remaining := lo.Filter(current, func(r *computepb.AliasIpRange, _ int) bool {
+			return !ownsAlias(naming, r, ip)
+		})
+		if len(remaining) != len(current) {
+			removed = true
+		}
+		return remaining, len(remaining) != len(current)
+	})
+	if err != nil || removed {
+		return err
+	}
+	return p.removeRoute(ctx, projectID, instanceName, ip)
+}
+
+// removeRoute deletes the VPC route the plugin programmed for ip on a node out
+// of alias IP ranges, if it points at the named instance
+func (p *Provisioner) removeRoute(ctx context.Context, projectID, instanceName, ip string) error {
+	routed, err := p.routedTo(ctx, projectID, instanceName, ip)
+	if err != nil || !routed {
+		return err
+	}
+
+	name := ipam.RouteName(ip)
+	op, err := p.routesClient.Delete(ctx, &computepb.DeleteRouteRequest{Project: p.networkProject(projectID), Route: name})
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delete route %s: %w", name, err)
+	}
+	if err := op.Wait(ctx); err != nil {
+		return fmt.Errorf("wait for route %s deletion: %w", name, err)
+	}
+	return nil
+}
+
+// updateAliasRanges sets the alias IP ranges of the instance's primary
+// network interface to what mutate makes of the current ones, skipping the
+// update when mutate reports no change. With anyNIC the first interface
+// mutate changes is updated instead, for pod IPs that may be attached to a
+// secondary interface. The update is guarded by the interface fingerprint;
+// when GKE's netd or another agent changed the interface meanwhile it is read
+// again and mutate reapplied. A missing instance is an error only when
+// required.
+func (p *Provisioner) updateAliasRanges(ctx context.Context, projectID, instanceName string, required, anyNIC bool,
+	mutate func([]*computepb.AliasIpRange) ([]*computepb.AliasIpRange, bool)) error {
+	projectID = p.instanceProject(ctx, projectID, instanceName)
+	for attempt := 0; ; attempt++ {
+		zone, instance, err := p.findInstance(ctx, projectID, instanceName)
+		if err != nil {
+			return err
+		}
+		if instance == nil || len(instance.GetNetworkInterfaces()) == 0 {
+			if required {
+				return fmt.Errorf("instance %s not found", instanceName)
+			}
+			return nil
+		}
+
+		nics := instance.GetNetworkInterfaces()
+		if !anyNIC {
+			nics = nics[:1]
+		}
+		var nic *computepb.NetworkInterface
+		var aliases []*computepb.AliasIpRange
+		for _, candidate := range nics {
+			if mutated, changed := mutate(candidate.GetAliasIpRanges()); changed {
+				nic, aliases = candidate, mutated
+				break
+			}
+		}
+		if nic == nil {
+			return nil
+		}
+
+		op, err := p.instancesClient.UpdateNetworkInterface(ctx, &computepb.UpdateNetworkInterfaceInstanceRequest{
+			Project:          projectID,
+			Zone:             zone,
+			Instance:         instanceName,
+			NetworkInterface: nic.GetName(),
+			NetworkInterfaceResource: &computepb.NetworkInterface{
+				Fingerprint:   nic.Fingerprint,
+				AliasIpRanges: aliases,
+			},
+		})
+		if isFingerprintConflict(err) && attempt < fingerprintRetries {
+			p.logger.Info("Network interface changed meanwhile, reading it again",
+				slog.String("instance", instanceName),
+				slog.Int("attempt", attempt+1),
+			)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("update network interface of %s: %w", instanceName, err)
+		}
+
+		if err := p.operations.wait(ctx, projectID, zone, op.Proto().GetName()); err != nil {
+			return fmt.Errorf("wait for network interface update of %s: %w", instanceName, err)
+		}
+		return nil
+	}
+}
+
+func isFingerprintConflict(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// findInstance looks the instance up across all zones of the project
+func (p *Provisioner) findInstance(ctx context.Context, projectID, instanceName string) (string, *computepb.Instance, error) {
+	it := p.instancesClient.AggregatedList(ctx, &computepb.AggregatedListInstancesRequest{
+		Project: projectID,
+		Filter:  proto.String(fmt.Sprintf("name = %q", instanceName)),
+	})
+
+	for {
+		pair, err := it.Next()
+		if err == iterator.Done {
+			return "", nil, nil
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("list instances named %s: %w", instanceName, err)
+		}
+
+		for _, instance := range pair.Value.GetInstances() {
+			if instance.GetName() == instanceName {
+				return strings.TrimPrefix(pair.Key, "zones/"), instance, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestReclaimExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	expired := metav1.NewTime(now.Add(-time.Minute))
+	renewed := metav1.NewTime(now.Add(time.Hour))
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:          "10.8.0.0/24",
+			LeaseDuration: &metav1.Duration{Duration: time.Hour},
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.2": {PodName: "gone", PodNamespace: "default", PodUID: "gone-uid", NodeName: "node-1", LeaseExpiresAt: &expired},
+				// Listed as expired, renewed by the installer before the release
+				"10.8.0.3": {PodName: "live", PodNamespace: "default", PodUID: "live-uid", NodeName: "node-1", LeaseExpiresAt: &renewed},
+			},
+		},
+	}
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{pool})
+	gce := newFakeGCE(t, p)
+	gce.addInstance("node-1", "pods", "10.8.0.2", "10.8.0.3")
+	allocator := ipam.NewAllocator(p.dynamicClient)
+
+	listed := pool.Spec.Allocations["10.8.0.3"]
+	listed.LeaseExpiresAt = &expired
+	p.reclaimExpiredLease(ctx, allocator, testProject, "pool", "10.8.0.3", listed, now)
+	if got := gce.updateCount("node-1"); got != 0 {
+		t.Fatalf("renewed lease caused %d network interface updates, want its alias kept", got)
+	}
+	if _, ok := testPool(t, p, "pool").Spec.Allocations["10.8.0.3"]; !ok {
+		t.Fatal("renewed lease was released")
+	}
+
+	p.reclaimExpiredLease(ctx, allocator, testProject, "pool", "10.8.0.2", pool.Spec.Allocations["10.8.0.2"], now)
+	if _, ok := testPool(t, p, "pool").Spec.Allocations["10.8.0.2"]; ok {
+		t.Error("expired lease was not released")
+	}
+	if got := gce.aliases("node-1"); len(got) != 1 || got[0] != "10.8.0.3/32" {
+		t.Errorf("aliases of node-1 = %v, want only the renewed lease's", got)
+	}
+}
+
+func TestCollectExpiredQuarantine(t *testing.T) {
+	ctx := context.Background()
+	expired := metav1.NewTime(time.Now().Add(-time.Minute))
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/24",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.2": {PodName: ipam.ConflictPlaceholder, PodUID: ipam.ConflictPlaceholder + "-10.8.0.2", NodeName: "node-1", LeaseExpiresAt: &expired},
+				// Imported reservations are released by hand
+				"10.8.0.3": {PodName: ipam.ConflictPlaceholder, PodUID: ipam.ConflictPlaceholder + "-10.8.0.3", NodeName: "node-1"},
+				// Left over from when the pool had leases
+				"10.8.0.4": {PodName: "live", PodNamespace: "default", PodUID: "live-uid", NodeName: "node-1", LeaseExpiresAt: &expired},
+			},
+		},
+	}
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{pool})
+	gce := newFakeGCE(t, p)
+	gce.addInstance("node-1", "pods", "10.8.0.4")
+
+	if err := p.collectExpiredLeases(ctx, ipam.NewAllocator(p.dynamicClient), testProject); err != nil {
+		t.Fatal(err)
+	}
+	allocations := testPool(t, p, "pool").Spec.Allocations
+	if _, ok := allocations["10.8.0.2"]; ok {
+		t.Error("expired quarantine was not released")
+	}
+	for _, ip := range []string{"10.8.0.3", "10.8.0.4"} {
+		if _, ok := allocations[ip]; !ok {
+			t.Errorf("%s was released from a pool without leases", ip)
+		}
+	}
+	if got := gce.aliases("node-1"); len(got) != 1 {
+		t.Errorf("aliases of node-1 = %v, want the pod's kept", got)
+	}
+}
@@ -0,0 +1,367 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	networkconnectivity "cloud.google.com/go/networkconnectivity/apiv1"
+	"cloud.google.com/go/networkconnectivity/apiv1/networkconnectivitypb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	testProject    = "project"
+	testZone       = "europe-west1-b"
+	testRegion     = "europe-west1"
+	testSubnetwork = "nodes"
+)
+
+// fakeGCE serves the compute API calls the provisioner makes for instances,
+// subnetworks, routes and operations from memory. Operations are done right
+// away. Instances are in testZone and testSubnetwork.
+type fakeGCE struct {
+	t       *testing.T
+	mu      sync.Mutex
+	ops     int
+	nics    map[string]*computepb.NetworkInterface
+	routes  map[string]*computepb.Route
+	subnets map[string]*computepb.Subnetwork
+	// updates counts the network interface updates per instance
+	updates map[string]int
+	// failing instances refuse network interface updates
+	failing map[string]bool
+}
+
+// newFakeGCE serves GCE to p for the duration of the test
+func newFakeGCE(t *testing.T, p *Provisioner) *fakeGCE {
+	t.Helper()
+	f := &fakeGCE{
+		t:       t,
+		nics:    map[string]*computepb.NetworkInterface{},
+		routes:  map[string]*computepb.Route{},
+		subnets: map[string]*computepb.Subnetwork{},
+		updates: map[string]int{},
+		failing: map[string]bool{},
+	}
+	server := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(server.Close)
+
+	ctx := context.Background()
+	opts := []option.ClientOption{option.WithEndpoint(server.URL), option.WithoutAuthentication()}
+	instances, err := compute.NewInstancesRESTClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := compute.NewRoutesRESTClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operations, err := compute.NewZoneOperationsRESTClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnetworks, err := compute.NewSubnetworksRESTClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.instancesClient, p.routesClient, p.subnetworkClient = instances, routes, subnetworks
+	p.operations = newOperationWaiter(p.logger, operations)
+	return f
+}
+
+// addInstance adds an instance whose primary network interface holds the
+// /32 aliases of ips in rangeName
+func (f *fakeGCE) addInstance(name, rangeName string, ips ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	nic := &computepb.NetworkInterface{Name: proto.String("nic0"), Fingerprint: proto.String("fp-0")}
+	for _, ip := range ips {
+		nic.AliasIpRanges = append(nic.AliasIpRanges, &computepb.AliasIpRange{
+			IpCidrRange:         proto.String(ip + "/32"),
+			SubnetworkRangeName: proto.String(rangeName),
+		})
+	}
+	f.nics[name] = nic
+}
+
+// aliases returns the alias IP ranges of the instance
+func (f *fakeGCE) aliases(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var aliases []string
+	for _, r := range f.nics[name].GetAliasIpRanges() {
+		aliases = append(aliases, r.GetIpCidrRange())
+	}
+	return aliases
+}
+
+// addSubnetwork adds a subnetwork in testRegion with the secondary ranges,
+// name to CIDR
+func (f *fakeGCE) addSubnetwork(name string, ranges map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	subnet := &computepb.Subnetwork{
+		Name:        proto.String(name),
+		Network:     proto.String(fmt.Sprintf("projects/%s/global/networks/vpc", testProject)),
+		IpCidrRange: proto.String("10.0.0.0/20"),
+		Fingerprint: proto.String("fp-0"),
+	}
+	for rangeName, cidr := range ranges {
+		subnet.SecondaryIpRanges = append(subnet.SecondaryIpRanges, &computepb.SubnetworkSecondaryRange{
+			RangeName:   proto.String(rangeName),
+			IpCidrRange: proto.String(cidr),
+		})
+	}
+	f.subnets[name] = subnet
+}
+
+// secondaryRanges returns the secondary ranges of the subnetwork, name to the
+// internal range reserving it
+func (f *fakeGCE) secondaryRanges(name string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ranges := map[string]string{}
+	for _, r := range f.subnets[name].GetSecondaryIpRanges() {
+		ranges[r.GetRangeName()] = r.GetReservedInternalRange()
+	}
+	return ranges
+}
+
+// failUpdates makes network interface updates of the instance fail, or work
+// again
+func (f *fakeGCE) failUpdates(name string, fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[name] = fail
+}
+
+func (f *fakeGCE) updateCount(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.updates[name]
+}
+
+func (f *fakeGCE) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/compute/v1/projects/"+testProject)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[0] == "zones" && parts[2] == "instances":
+		nic, ok := f.nics[parts[3]]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NOT_FOUND")
+			return
+		}
+		nic = proto.Clone(nic).(*computepb.NetworkInterface)
+		nic.Network = proto.String(fmt.Sprintf("projects/%s/global/networks/vpc", testProject))
+		nic.Subnetwork = proto.String(fmt.Sprintf("projects/%s/regions/%s/subnetworks/%s", testProject, testRegion, testSubnetwork))
+		f.write(w, &computepb.Instance{Name: proto.String(parts[3]), NetworkInterfaces: []*computepb.NetworkInterface{nic}})
+
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[2] == "subnetworks":
+		subnet, ok := f.subnets[parts[3]]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NOT_FOUND")
+			return
+		}
+		f.write(w, subnet)
+
+	case r.Method == http.MethodPatch && len(parts) == 4 && parts[2] == "subnetworks":
+		subnet, ok := f.subnets[parts[3]]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NOT_FOUND")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		update := &computepb.Subnetwork{}
+		if err := protojson.Unmarshal(body, update); err != nil {
+			f.t.Errorf("invalid subnetwork update: %v", err)
+		}
+		if update.GetFingerprint() != subnet.GetFingerprint() {
+			f.error(w, http.StatusPreconditionFailed, "FAILED_PRECONDITION")
+			return
+		}
+		f.ops++
+		subnet.SecondaryIpRanges = update.SecondaryIpRanges
+		subnet.Fingerprint = proto.String(fmt.Sprintf("fp-%d", f.ops))
+		f.write(w, &computepb.Operation{
+			Name:   proto.String(fmt.Sprintf("op-%d", f.ops)),
+			Region: proto.String(testRegion),
+			Status: computepb.Operation_DONE.Enum(),
+		})
+
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[0] == "regions" && parts[2] == "operations":
+		f.write(w, &computepb.Operation{Name: proto.String(parts[3]), Status: computepb.Operation_DONE.Enum()})
+
+	case r.Method == http.MethodGet && path == "/aggregated/instances":
+		scoped := &computepb.InstancesScopedList{}
+		for name, nic := range f.nics {
+			if strings.Contains(r.URL.Query().Get("filter"), fmt.Sprintf("%q", name)) {
+				scoped.Instances = append(scoped.Instances, &computepb.Instance{
+					Name:              proto.String(name),
+					NetworkInterfaces: []*computepb.NetworkInterface{proto.Clone(nic).(*computepb.NetworkInterface)},
+				})
+			}
+		}
+		f.write(w, &computepb.InstanceAggregatedList{Items: map[string]*computepb.InstancesScopedList{"zones/" + testZone: scoped}})
+
+	case r.Method == http.MethodPatch && len(parts) == 5 && parts[4] == "updateNetworkInterface":
+		nic, ok := f.nics[parts[3]]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NOT_FOUND")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		update := &computepb.NetworkInterface{}
+		if err := protojson.Unmarshal(body, update); err != nil {
+			f.t.Errorf("invalid network interface update: %v", err)
+		}
+		if update.GetFingerprint() != nic.GetFingerprint() {
+			f.error(w, http.StatusPreconditionFailed, "FAILED_PRECONDITION")
+			return
+		}
+		if f.failing[parts[3]] {
+			f.error(w, http.StatusServiceUnavailable, "UNAVAILABLE")
+			return
+		}
+		f.updates[parts[3]]++
+		nic.AliasIpRanges = update.AliasIpRanges
+		nic.Fingerprint = proto.String(fmt.Sprintf("fp-%d", f.updates[parts[3]]))
+		f.ops++
+		f.write(w, &computepb.Operation{
+			Name:   proto.String(fmt.Sprintf("op-%d", f.ops)),
+			Zone:   proto.String(testZone),
+			Status: computepb.Operation_DONE.Enum(),
+		})
+
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[2] == "operations":
+		// Operations are done as soon as they are created
+		list := &computepb.OperationList{}
+		for i := 1; i <= f.ops; i++ {
+			list.Items = append(list.Items, &computepb.Operation{
+				Name:   proto.String(fmt.Sprintf("op-%d", i)),
+				Status: computepb.Operation_DONE.Enum(),
+			})
+		}
+		f.write(w, list)
+
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[1] == "routes":
+		route, ok := f.routes[parts[2]]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NOT_FOUND")
+			return
+		}
+		f.write(w, route)
+
+	default:
+		f.t.Errorf("unexpected GCE request %s %s", r.Method, r.URL.Path)
+		f.error(w, http.StatusNotImplemented, "UNIMPLEMENTED")
+	}
+}
+
+func (f *fakeGCE) write(w http.ResponseWriter, m proto.Message) {
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		f.t.Errorf("marshal GCE response: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+func (f *fakeGCE) error(w http.ResponseWriter, code int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = fmt.Fprintf(w, `{"error": {"code": %d, "message": %q, "status": %q}}`, code, strings.ToLower(status), status)
+}
+
+// fakeInternalRanges serves the internal ranges API, every range it creates
+// is 10.100.0.0/16 and done right away
+type fakeInternalRanges struct {
+	networkconnectivitypb.UnimplementedInternalRangeServiceServer
+	mu sync.Mutex
+	// ranges are the internal ranges by resource name
+	ranges map[string]*networkconnectivitypb.InternalRange
+}
+
+// newFakeInternalRanges serves internal ranges to p for the duration of the test
+func newFakeInternalRanges(t *testing.T, p *Provisioner) *fakeInternalRanges {
+	t.Helper()
+	f := &fakeInternalRanges{ranges: map[string]*networkconnectivitypb.InternalRange{}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	networkconnectivitypb.RegisterInternalRangeServiceServer(server, f)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	client, err := networkconnectivity.NewInternalRangeClient(context.Background(),
+		option.WithEndpoint(listener.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	p.internalRangeClient = client
+	return f
+}
+
+// names returns the resource names of the internal ranges
+func (f *fakeInternalRanges) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.ranges {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (f *fakeInternalRanges) GetInternalRange(_ context.Context, req *networkconnectivitypb.GetInternalRangeRequest) (*networkconnectivitypb.InternalRange, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.ranges[req.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "internal range %s not found", req.GetName())
+	}
+	return r, nil
+}
+
+func (f *fakeInternalRanges) CreateInternalRange(_ context.Context, req *networkconnectivitypb.CreateInternalRangeRequest) (*longrunningpb.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := proto.Clone(req.GetInternalRange()).(*networkconnectivitypb.InternalRange)
+	r.Name = req.GetParent() + "/internalRanges/" + req.GetInternalRangeId()
+	r.IpCidrRange = "10.100.0.0/16"
+	f.ranges[r.Name] = r
+	response, err := anypb.New(r)
+	if err != nil {
+		return nil, err
+	}
+	return &longrunningpb.Operation{
+		Name:   "operations/create-" + req.GetInternalRangeId(),
+		Done:   true,
+		Result: &longrunningpb.Operation_Response{Response: response},
+	}, nil
+}
@@ -0,0 +1,100 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/iterator"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// PlanImport plans seeding poolName with the IPs in use in a cluster that
+// attached alias IPs by other means, so it moves onto this IPAM without
+// renumbering: the IPs of its pods and the alias ranges instances of the
+// project have attached from rangeNames of the pool's subnetwork. Empty
+// rangeNames are the secondary ranges of the pool.
+func (p *Provisioner) PlanImport(ctx context.Context, projectID, poolName string, rangeNames []string) (*ipam.ImportPlan, error) {
+	pools, err := ipam.NewAllocator(p.dynamicClient).ListPools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(pools, func(pool v1alpha1.IPPool) bool { return pool.Name == poolName })
+	if i < 0 {
+		return nil, fmt.Errorf("IPPool %s not found, create it before importing into it", poolName)
+	}
+	pool := &pools[i]
+	if len(rangeNames) == 0 {
+		for _, r := range pool.Spec.SecondaryRanges {
+			rangeNames = append(rangeNames, ipam.AliasRange(r.Name))
+		}
+		if len(pool.Spec.SecondaryRanges) == 0 {
+			rangeNames = append(rangeNames, ipam.AliasRange(pool.Spec.SecondaryRangeName))
+		}
+	}
+
+	projects, err := p.instanceProjects(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []ipam.AttachedRange
+	for _, project := range projects {
+		instances := p.instancesClient.AggregatedList(ctx, &computepb.AggregatedListInstancesRequest{
+			Project: project,
+		})
+		for {
+			pair, err := instances.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("list instances of project %s: %w", project, err)
+			}
+			for _, instance := range pair.Value.GetInstances() {
+				for _, nic := range instance.GetNetworkInterfaces() {
+					if pool.Spec.Subnet != "" && ipam.SubnetworkName(nic.GetSubnetwork()) != ipam.SubnetworkName(pool.Spec.Subnet) {
+						continue
+					}
+					for _, r := range nic.GetAliasIpRanges() {
+						if slices.Contains(rangeNames, r.GetSubnetworkRangeName()) {
+							ranges = append(ranges, ipam.AttachedRange{Instance: instance.GetName(), CIDR: r.GetIpCidrRange()})
+						}
+					}
+				}
+			}
+		}
+	}
+
+	podList, err := p.kubeClient.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list pods: %w", err)
+	}
+	var pods []ipam.PodIP
+	for _, pod := range podList.Items {
+		if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			pods = append(pods, ipam.PodIP{
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				UID:       string(pod.UID),
+				Node:      pod.Spec.NodeName,
+				IP:        podIP.IP,
+			})
+		}
+	}
+
+	return ipam.PlanImport(pool, ranges, pods), nil
+}
+
+// Import records the allocations of plan in its pool and returns how many it
+// added
+func (p *Provisioner) Import(ctx context.Context, plan *ipam.ImportPlan) (int, error) {
+	return ipam.NewAllocator(p.dynamicClient).Import(ctx, plan)
+}
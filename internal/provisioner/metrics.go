@@ -0,0 +1,156 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// RunMetricsServer serves the usage of every pool in the Prometheus text
+// format on addr until ctx is done, read from the pool status at scrape time
+// including the forecast of RunForecastController, and the releases and
+// plugin configurations the nodes run next to the provisioner's own, and the
+// results of RunProbeController
+func (p *Provisioner) RunMetricsServer(ctx context.Context, addr string) error {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		p.serveMetrics(w, r, allocator)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	p.logger.Info("Starting metrics server", slog.String("address", addr))
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve metrics: %w", err)
+	}
+	return ctx.Err()
+}
+
+// serveMetrics writes the metrics of a scrape. Nodes are listed from the
+// watch cache of the API server rather than etcd, and failing to list them
+// only leaves their counts out: the pools are what alerts depend on.
+func (p *Provisioner) serveMetrics(w http.ResponseWriter, r *http.Request, allocator *ipam.Allocator) {
+	pools, err := allocator.ListPools(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	var nodes []corev1.Node
+	nodeList, err := p.kubeClient.CoreV1().Nodes().List(r.Context(), metav1.ListOptions{ResourceVersion: "0"})
+	if err != nil {
+		p.logger.Warn("Failed to list nodes for metrics", slog.String("error", err.Error()))
+	} else {
+		nodes = nodeList.Items
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := writePoolMetrics(w, pools); err != nil {
+		p.logger.Error("Failed to write metrics", slog.String("error", err.Error()))
+		return
+	}
+	if err := writeVersionMetrics(w, p.version, p.commit, nodes); err != nil {
+		p.logger.Error("Failed to write metrics", slog.String("error", err.Error()))
+		return
+	}
+	if err := writeProbeMetrics(w, p.probes.snapshot()); err != nil {
+		p.logger.Error("Failed to write metrics", slog.String("error", err.Error()))
+	}
+}
+
+func writePoolMetrics(w io.Writer, pools []v1alpha1.IPPool) error {
+	var b strings.Builder
+	metric := func(name, help string, value func(*v1alpha1.IPPool) (int, bool)) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for i := range pools {
+			if v, ok := value(&pools[i]); ok {
+				fmt.Fprintf(&b, "%s{pool=%q} %d\n", name, pools[i].Name, v)
+			}
+		}
+	}
+
+	metric("gcp_cni_ippool_capacity", "IPs in the pool available to workloads",
+		func(pool *v1alpha1.IPPool) (int, bool) { return pool.Status.Capacity, true })
+	metric("gcp_cni_ippool_allocated", "IPs of the pool allocated to workloads",
+		func(pool *v1alpha1.IPPool) (int, bool) { return pool.Status.Allocated, true })
+	metric("gcp_cni_ippool_available", "IPs of the pool still available",
+		func(pool *v1alpha1.IPPool) (int, bool) { return pool.Status.Available, true })
+	metric("gcp_cni_ippool_allocations_per_day", "Net growth of allocations per day observed by the usage forecast",
+		func(pool *v1alpha1.IPPool) (int, bool) { return pool.Status.AllocationsPerDay, true })
+	metric("gcp_cni_ippool_days_until_exhaustion", "Days until the pool runs out of IPs at the forecast growth, absent while allocations do not grow",
+		func(pool *v1alpha1.IPPool) (int, bool) {
+			if pool.Status.DaysUntilExhaustion == nil {
+				return 0, false
+			}
+			return *pool.Status.DaysUntilExhaustion, true
+		})
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeVersionMetrics writes the build of the provisioner and counts the
+// nodes by the versions and plugin configuration their installer annotated
+// them with, a fleet running one release has a single series per metric
+func writeVersionMetrics(w io.Writer, version, commit string, nodes []corev1.Node) error {
+	type key struct{ plugin, config, installer string }
+	counts := map[key]int{}
+	for i := range nodes {
+		annotations := nodes[i].Annotations
+		counts[key{
+			plugin:    annotations[ipam.PluginVersionAnnotation],
+			config:    annotations[ipam.PluginConfigAnnotation],
+			installer: annotations[ipam.InstallerVersionAnnotation],
+		}]++
+	}
+	keys := make([]key, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.plugin != b.plugin {
+			return a.plugin < b.plugin
+		}
+		if a.config != b.config {
+			return a.config < b.config
+		}
+		return a.installer < b.installer
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP gcp_cni_provisioner_info Build of the provisioner\n# TYPE gcp_cni_provisioner_info gauge\n")
+	fmt.Fprintf(&b, "gcp_cni_provisioner_info{version=%q,commit=%q} 1\n", version, commit)
+	fmt.Fprintf(&b, "# HELP gcp_cni_nodes Nodes by the gcp-ipam release, plugin configuration and installer release they run, empty before the installer annotated them\n# TYPE gcp_cni_nodes gauge\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "gcp_cni_nodes{plugin_version=%q,config_sha256=%q,installer_version=%q} %d\n", k.plugin, k.config, k.installer, counts[k])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
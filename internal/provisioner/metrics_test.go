@@ -0,0 +1,71 @@
+package provisioner
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestServeMetrics(t *testing.T) {
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/24"},
+		Status:     v1alpha1.IPPoolStatus{Capacity: 253},
+	}}, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Annotations: map[string]string{
+		ipam.PluginVersionAnnotation:    "v1.2.0",
+		ipam.PluginConfigAnnotation:     "abc",
+		ipam.InstallerVersionAnnotation: "v1.2.0",
+	}}})
+	p.version, p.commit = "v1.2.0", "0123abc"
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	var listOptions []metav1.ListOptions
+	var listErr error
+	p.kubeClient.(*kubefake.Clientset).PrependReactor("list", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		listOptions = append(listOptions, action.(k8stesting.ListActionImpl).ListOptions)
+		return listErr != nil, nil, listErr
+	})
+	scrape := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.serveMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil), allocator)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	metrics := scrape()
+	for _, line := range []string{
+		`gcp_cni_ippool_capacity{pool="pool"} 253`,
+		`gcp_cni_provisioner_info{version="v1.2.0",commit="0123abc"} 1`,
+		`gcp_cni_nodes{plugin_version="v1.2.0",config_sha256="abc",installer_version="v1.2.0"} 1`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metrics miss %q:\n%s", line, metrics)
+		}
+	}
+	if len(listOptions) != 1 || listOptions[0].ResourceVersion != "0" {
+		t.Errorf("nodes listed with %+v, want once from the watch cache", listOptions)
+	}
+
+	// Pool metrics outlive a failing node list
+	listErr = errors.New("etcdserver: request timed out")
+	metrics = scrape()
+	if !strings.Contains(metrics, `gcp_cni_ippool_capacity{pool="pool"} 253`+"\n") {
+		t.Errorf("pool metrics missing while nodes cannot be listed:\n%s", metrics)
+	}
+	if strings.Contains(metrics, "gcp_cni_nodes{") {
+		t.Errorf("node counts written without nodes:\n%s", metrics)
+	}
+}
@@ -0,0 +1,261 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// migrationRetention is how long finished PodIPMigrations are kept for inspection
+const migrationRetention = time.Hour
+
+// RunMigrationController drives PodIPMigrations the nodes cannot finish on
+// their own every interval until ctx is done. Attached migrations complete
+// once the source pod let go of the IP. Failed migrations, and migrations
+// stuck in a phase for longer than timeout, are rolled back: the alias is
+// removed from the target node and returned to the source node while the
+// source pod is still around.
+func (p *Provisioner) RunMigrationController(ctx context.Context, interval, timeout time.Duration) error {
+	projectID, err := identity.ProjectID(ctx)
+	if err != nil {
+		return fmt.Errorf("get project ID from metadata: %w", err)
+	}
+
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting migration controller",
+		slog.Duration("interval", interval),
+		slog.Duration("timeout", timeout),
+	)
+
+	for {
+		if err := p.reconcileMigrations(ctx, allocator, projectID, timeout); err != nil {
+			p.logger.Error("Migration reconciliation failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) reconcileMigrations(ctx context.Context, allocator *ipam.Allocator, projectID string, timeout time.Duration) error {
+	migrations, err := allocator.ListMigrations(ctx, metav1.NamespaceAll)
+	if err != nil {
+		return err
+	}
+	frozen := p.frozen(ctx, allocator)
+
+	for i := range migrations {
+		m := &migrations[i]
+		logger := p.logger.With(
+			slog.String("migration", fmt.Sprintf("%s/%s", m.Namespace, m.Name)),
+			slog.String("ip", m.Spec.IP),
+		)
+		if err := p.reconcileMigration(ctx, allocator, projectID, timeout, frozen, m, logger); err != nil {
+			logger.Error("Failed to reconcile migration", slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+func (p *Provisioner) reconcileMigration(ctx context.Context, allocator *ipam.Allocator, projectID string, timeout time.Duration, frozen bool, m *v1alpha1.PodIPMigration, logger *slog.Logger) error {
+	since := m.Status.LastTransitionTime.Time
+	if since.IsZero() {
+		since = m.CreationTimestamp.Time
+	}
+	stuck := time.Since(since) > timeout
+
+	switch m.Status.Phase {
+	case v1alpha1.PodIPMigrationCompleted, v1alpha1.PodIPMigrationRolledBack:
+		if time.Since(since) < migrationRetention {
+			return nil
+		}
+		err := p.dynamicClient.Resource(ipam.PodIPMigrationGVR).Namespace(m.Namespace).Delete(ctx, m.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("delete migration: %w", err)
+		}
+		return nil
+
+	case v1alpha1.PodIPMigrationAttached:
+		released := m.Status.SourceReleased
+		if !released {
+			source, err := p.migrationSourcePod(ctx, allocator, m)
+			if err != nil {
+				return err
+			}
+			released = source == nil
+		}
+		if !released {
+			return nil
+		}
+		if err := p.setMigrationPhase(ctx, allocator, m, v1alpha1.PodIPMigrationCompleted, nil); err != nil {
+			return err
+		}
+		logger.Info("Completed migration", slog.String("target_node", m.Status.TargetNode))
+		return nil
+
+	case v1alpha1.PodIPMigrationFailed:
+		if frozen {
+			// Rollbacks move aliases, they wait for the freeze to be lifted
+			return nil
+		}
+		return p.rollBackMigration(ctx, allocator, projectID, m, fmt.Errorf("target failed: %s", m.Status.Message), logger)
+
+	case "", v1alpha1.PodIPMigrationPending:
+		if !stuck {
+			return nil
+		}
+		// Nothing moved yet, the source pod keeps the IP
+		return p.setMigrationPhase(ctx, allocator, m, v1alpha1.PodIPMigrationRolledBack, fmt.Errorf("not claimed within %s", timeout))
+
+	default:
+		if frozen {
+			return nil
+		}
+		cause := fmt.Errorf("stuck in phase %s for more than %s", m.Status.Phase, timeout)
+		if !stuck {
+			alive, err := p.migrationTargetAlive(ctx, m)
+			if err != nil || alive {
+				return err
+			}
+			cause = fmt.Errorf("target pod %s is gone", m.Name)
+		}
+		// Fence the target node first, its ADD cannot advance a failed migration
+		if err := p.setMigrationPhase(ctx, allocator, m, v1alpha1.PodIPMigrationFailed, cause); err != nil {
+			return err
+		}
+		return p.rollBackMigration(ctx, allocator, projectID, m, cause, logger)
+	}
+}
+
+// rollBackMigration returns the IP to the source pod: the alias is fenced off
+// the target node first, then attached to the source node again. With the
+// source pod gone as well nobody holds the IP, so it is released.
+func (p *Provisioner) rollBackMigration(ctx context.Context, allocator *ipam.Allocator, projectID string, m *v1alpha1.PodIPMigration, cause error, logger *slog.Logger) error {
+	if m.Status.TargetNode != "" {
+		if err := p.removeAliasIP(ctx, projectID, m.Status.TargetNode, m.Spec.IP); err != nil {
+			return fmt.Errorf("detach from target %s: %w", m.Status.TargetNode, err)
+		}
+	}
+
+	source, err := p.migrationSourcePod(ctx, allocator, m)
+	if err != nil {
+		return err
+	}
+
+	if source == nil {
+		if _, held, err := allocator.AllocationOf(ctx, m.Status.Pool, m.Spec.IP); err != nil {
+			return err
+		} else if held {
+			if err := allocator.Release(ctx, m.Status.Pool, m.Spec.IP); err != nil {
+				return err
+			}
+			logger.Info("Released IP of rolled back migration, the source pod is gone", slog.String("pool", m.Status.Pool))
+		}
+	} else {
+		result, err := allocator.GetAllocation(ctx, m.Status.Pool, m.Spec.IP)
+		if err != nil {
+			return err
+		}
+		err = allocator.TransferAllocation(ctx, m.Status.Pool, m.Spec.IP, &ipam.AllocationRequest{
+			PodName:      source.Name,
+			PodNamespace: source.Namespace,
+			PodUID:       string(source.UID),
+			NodeName:     m.Spec.SourceNode,
+		})
+		if err != nil {
+			return err
+		}
+		if m.Spec.SourceNode != "" {
+			if err := p.addAliasIP(ctx, projectID, m.Spec.SourceNode, m.Spec.IP, result.SecondaryRangeName); err != nil {
+				return fmt.Errorf("attach to source %s: %w", m.Spec.SourceNode, err)
+			}
+		}
+		logger.Info("Returned IP to source pod", slog.String("pod", source.Name), slog.String("node", m.Spec.SourceNode))
+	}
+
+	if err := p.setMigrationPhase(ctx, allocator, m, v1alpha1.PodIPMigrationRolledBack, cause); err != nil {
+		return err
+	}
+	logger.Info("Rolled back migration", slog.String("cause", cause.Error()))
+	return nil
+}
+
+// migrationSourcePod returns the running source pod of the migration, nil once
+// it is gone. Migrations created from annotations do not name the source pod,
+// it is then the pod the IP is still allocated to.
+func (p *Provisioner) migrationSourcePod(ctx context.Context, allocator *ipam.Allocator, m *v1alpha1.PodIPMigration) (*corev1.Pod, error) {
+	name, uid := m.Spec.SourcePod, ""
+	if name == "" {
+		if m.Status.Pool == "" {
+			return nil, nil
+		}
+		allocation, held, err := allocator.AllocationOf(ctx, m.Status.Pool, m.Spec.IP)
+		if err != nil {
+			return nil, err
+		}
+		if !held || allocation.PodUID == m.Status.TargetPodUID || allocation.PodNamespace != m.Namespace {
+			return nil, nil
+		}
+		name, uid = allocation.PodName, allocation.PodUID
+	}
+
+	pod, err := p.kubeClient.CoreV1().Pods(m.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get source pod %s: %w", name, err)
+	}
+	if pod.DeletionTimestamp != nil || (uid != "" && string(pod.UID) != uid) {
+		return nil, nil
+	}
+	return pod, nil
+}
+
+// migrationTargetAlive reports whether the pod taking the IP over still exists
+func (p *Provisioner) migrationTargetAlive(ctx context.Context, m *v1alpha1.PodIPMigration) (bool, error) {
+	pod, err := p.kubeClient.CoreV1().Pods(m.Namespace).Get(ctx, m.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("get target pod %s: %w", m.Name, err)
+	}
+	if m.Status.TargetPodUID != "" && string(pod.UID) != m.Status.TargetPodUID {
+		return false, nil
+	}
+	return pod.DeletionTimestamp == nil, nil
+}
+
+// setMigrationPhase writes phase and cause to the migration, unless a node
+// moved it on in the meantime
+func (p *Provisioner) setMigrationPhase(ctx context.Context, allocator *ipam.Allocator, m *v1alpha1.PodIPMigration, phase v1alpha1.PodIPMigrationPhase, cause error) error {
+	observed := m.Status.Phase
+	updated, err := allocator.ModifyMigration(ctx, m.Namespace, m.Name, func(current *v1alpha1.PodIPMigration) error {
+		if current.Status.Phase != observed {
+			return fmt.Errorf("migration moved from %s to %s meanwhile", observed, current.Status.Phase)
+		}
+		ipam.SetMigrationPhase(current, phase, cause)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*m = *updated
+	return nil
+}
@@ -0,0 +1,178 @@
+package provisioner
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestReconcileMigration(t *testing.T) {
+	const timeout = time.Minute
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	source := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "source", UID: "source-uid"}}
+	target := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "target", UID: "target-uid"}}
+
+	tests := []struct {
+		name           string
+		phase          v1alpha1.PodIPMigrationPhase
+		age            time.Duration
+		sourceReleased bool
+		frozen         bool
+		// owner is the pod the IP is allocated to, "" when it is not allocated
+		owner string
+		// attachedTo is the instance holding the alias of the IP
+		attachedTo string
+		pods       []runtime.Object
+
+		wantPhase      v1alpha1.PodIPMigrationPhase
+		wantDeleted    bool
+		wantOwner      string
+		wantAttachedTo string
+	}{
+		{
+			name: "pending", phase: v1alpha1.PodIPMigrationPending, owner: "source-uid", attachedTo: "node-a", pods: []runtime.Object{source},
+			wantPhase: v1alpha1.PodIPMigrationPending, wantOwner: "source-uid", wantAttachedTo: "node-a",
+		},
+		{
+			name: "pending not claimed in time", phase: v1alpha1.PodIPMigrationPending, age: time.Hour, owner: "source-uid", attachedTo: "node-a", pods: []runtime.Object{source},
+			wantPhase: v1alpha1.PodIPMigrationRolledBack, wantOwner: "source-uid", wantAttachedTo: "node-a",
+		},
+		{
+			name: "claimed by a live target", phase: v1alpha1.PodIPMigrationClaimed, owner: "source-uid", attachedTo: "node-a", pods: []runtime.Object{source, target},
+			wantPhase: v1alpha1.PodIPMigrationClaimed, wantOwner: "source-uid", wantAttachedTo: "node-a",
+		},
+		{
+			name: "claimed by a target that is gone", phase: v1alpha1.PodIPMigrationClaimed, owner: "source-uid", attachedTo: "node-a", pods: []runtime.Object{source},
+			wantPhase: v1alpha1.PodIPMigrationRolledBack, wantOwner: "source-uid", wantAttachedTo: "node-a",
+		},
+		{
+			name: "detached and stuck", phase: v1alpha1.PodIPMigrationDetached, age: time.Hour, owner: "source-uid", pods: []runtime.Object{source, target},
+			wantPhase: v1alpha1.PodIPMigrationRolledBack, wantOwner: "source-uid", wantAttachedTo: "node-a",
+		},
+		{
+			name: "detached and stuck while frozen", phase: v1alpha1.PodIPMigrationDetached, age: time.Hour, frozen: true, owner: "source-uid", pods: []runtime.Object{source, target},
+			wantPhase: v1alpha1.PodIPMigrationDetached, wantOwner: "source-uid",
+		},
+		{
+			name: "attached while the source runs", phase: v1alpha1.PodIPMigrationAttached, owner: "target-uid", attachedTo: "node-b", pods: []runtime.Object{source, target},
+			wantPhase: v1alpha1.PodIPMigrationAttached, wantOwner: "target-uid", wantAttachedTo: "node-b",
+		},
+		{
+			name: "attached and the source gone", phase: v1alpha1.PodIPMigrationAttached, owner: "target-uid", attachedTo: "node-b", pods: []runtime.Object{target},
+			wantPhase: v1alpha1.PodIPMigrationCompleted, wantOwner: "target-uid", wantAttachedTo: "node-b",
+		},
+		{
+			name: "attached and the source released", phase: v1alpha1.PodIPMigrationAttached, sourceReleased: true, owner: "target-uid", attachedTo: "node-b", pods: []runtime.Object{source, target},
+			wantPhase: v1alpha1.PodIPMigrationCompleted, wantOwner: "target-uid", wantAttachedTo: "node-b",
+		},
+		{
+			name: "attached and stuck", phase: v1alpha1.PodIPMigrationAttached, age: time.Hour, owner: "target-uid", attachedTo: "node-b", pods: []runtime.Object{source, target},
+			wantPhase: v1alpha1.PodIPMigrationAttached, wantOwner: "target-uid", wantAttachedTo: "node-b",
+		},
+		{
+			name: "failed with the source running", phase: v1alpha1.PodIPMigrationFailed, owner: "target-uid", attachedTo: "node-b", pods: []runtime.Object{source},
+			wantPhase: v1alpha1.PodIPMigrationRolledBack, wantOwner: "source-uid", wantAttachedTo: "node-a",
+		},
+		{
+			name: "failed with the source gone", phase: v1alpha1.PodIPMigrationFailed, owner: "target-uid", attachedTo: "node-b",
+			wantPhase: v1alpha1.PodIPMigrationRolledBack,
+		},
+		{
+			name: "failed while frozen", phase: v1alpha1.PodIPMigrationFailed, frozen: true, owner: "target-uid", attachedTo: "node-b", pods: []runtime.Object{source},
+			wantPhase: v1alpha1.PodIPMigrationFailed, wantOwner: "target-uid", wantAttachedTo: "node-b",
+		},
+		{
+			name: "completed within retention", phase: v1alpha1.PodIPMigrationCompleted, owner: "target-uid", attachedTo: "node-b", pods: []runtime.Object{target},
+			wantPhase: v1alpha1.PodIPMigrationCompleted, wantOwner: "target-uid", wantAttachedTo: "node-b",
+		},
+		{
+			name: "completed past retention", phase: v1alpha1.PodIPMigrationCompleted, age: 2 * migrationRetention, owner: "target-uid", attachedTo: "node-b", pods: []runtime.Object{target},
+			wantDeleted: true, wantOwner: "target-uid", wantAttachedTo: "node-b",
+		},
+		{
+			name: "rolled back past retention", phase: v1alpha1.PodIPMigrationRolledBack, age: 2 * migrationRetention, owner: "source-uid", attachedTo: "node-a", pods: []runtime.Object{source},
+			wantDeleted: true, wantOwner: "source-uid", wantAttachedTo: "node-a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			allocations := map[string]v1alpha1.IPAllocation{}
+			switch tt.owner {
+			case "source-uid":
+				allocations["10.8.0.5"] = v1alpha1.IPAllocation{PodName: "source", PodNamespace: "default", PodUID: "source-uid", NodeName: "node-a"}
+			case "target-uid":
+				allocations["10.8.0.5"] = v1alpha1.IPAllocation{PodName: "target", PodNamespace: "default", PodUID: "target-uid", NodeName: "node-b"}
+			}
+			p := newTestProvisioner(t, []*v1alpha1.IPPool{{
+				ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+				Spec:       v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/24", Allocations: allocations},
+			}}, tt.pods...)
+			gce := newFakeGCE(t, p)
+			for _, node := range []string{"node-a", "node-b"} {
+				if node == tt.attachedTo {
+					gce.addInstance(node, "pods", "10.8.0.5")
+				} else {
+					gce.addInstance(node, "pods")
+				}
+			}
+			allocator := ipam.NewAllocator(p.dynamicClient)
+
+			transitioned := metav1.NewTime(time.Now().Add(-tt.age))
+			if _, err := allocator.CreateMigration(ctx, &v1alpha1.PodIPMigration{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "target", CreationTimestamp: transitioned},
+				Spec:       v1alpha1.PodIPMigrationSpec{IP: "10.8.0.5", SourcePod: "source", SourceNode: "node-a"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			m, err := allocator.ModifyMigration(ctx, "default", "target", func(m *v1alpha1.PodIPMigration) error {
+				if tt.phase != v1alpha1.PodIPMigrationPending {
+					m.Status.TargetNode, m.Status.TargetPodUID, m.Status.Pool = "node-b", "target-uid", "pool"
+				}
+				m.Status.Phase, m.Status.SourceReleased, m.Status.LastTransitionTime = tt.phase, tt.sourceReleased, transitioned
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := p.reconcileMigration(ctx, allocator, testProject, timeout, tt.frozen, m, logger); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := allocator.GetMigration(ctx, "default", "target")
+			switch {
+			case tt.wantDeleted:
+				if !apierrors.IsNotFound(err) {
+					t.Errorf("migration = %+v, %v, want deleted", got, err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case got.Status.Phase != tt.wantPhase:
+				t.Errorf("phase = %s (%s), want %s", got.Status.Phase, got.Status.Message, tt.wantPhase)
+			}
+
+			allocation, held := testPool(t, p, "pool").Spec.Allocations["10.8.0.5"]
+			if owner := allocation.PodUID; owner != tt.wantOwner || held != (tt.wantOwner != "") {
+				t.Errorf("IP allocated to %q, want %q", owner, tt.wantOwner)
+			}
+			for _, node := range []string{"node-a", "node-b"} {
+				attached := slices.Contains(gce.aliases(node), "10.8.0.5/32")
+				if attached != (node == tt.wantAttachedTo) {
+					t.Errorf("alias attached to %s = %v, want it on %q", node, attached, tt.wantAttachedTo)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/samber/lo"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/proto"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// SetPodSubnetwork switches the provisioner to the secondary NIC mode: pod
+// IPs come from a dedicated subnetwork instead of the node subnetwork, and
+// every node gets an additional network interface in it
+func (p *Provisioner) SetPodSubnetwork(subnetwork string) {
+	p.podSubnetwork = subnetwork
+}
+
+// RunSecondaryNICController attaches a network interface in the pod
+// subnetwork to every node lacking one, every interval until ctx is done.
+// Pods on a node without it fail to get an IP until it is attached.
+func (p *Provisioner) RunSecondaryNICController(ctx context.Context, interval time.Duration) error {
+	if p.podSubnetwork == "" {
+		return fmt.Errorf("no pod subnetwork configured")
+	}
+
+	projectID, err := identity.ProjectID(ctx)
+	if err != nil {
+		return fmt.Errorf("get project ID from metadata: %w", err)
+	}
+
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting secondary NIC controller",
+		slog.String("subnetwork", p.podSubnetwork),
+		slog.Duration("interval", interval),
+	)
+
+	for {
+		if !p.frozen(ctx, allocator) {
+			if err := p.reconcileSecondaryNICs(ctx, projectID); err != nil {
+				p.logger.Error("Secondary NIC reconciliation failed", slog.String("error", err.Error()))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) reconcileSecondaryNICs(ctx context.Context, projectID string) error {
+	nodes, err := p.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list nodes: %w", err)
+	}
+
+	// Attachments are waited for together, see operationWaiter
+	var g errgroup.Group
+	g.SetLimit(gcConcurrency)
+	for _, node := range nodes.Items {
+		if node.DeletionTimestamp != nil {
+			continue
+		}
+		g.Go(func() error {
+			if err := p.attachSecondaryNIC(ctx, projectID, node.Name); err != nil {
+				p.logger.Error("Failed to attach secondary NIC",
+					slog.String("node", node.Name),
+					slog.String("error", err.Error()),
+				)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// attachSecondaryNIC adds a network interface in the pod subnetwork to the
+// instance of the node, doing nothing when it has one already
+func (p *Provisioner) attachSecondaryNIC(ctx context.Context, projectID, instanceName string) error {
+	subnetProject := p.networkProject(projectID)
+	projectID = p.instanceProject(ctx, projectID, instanceName)
+	zone, instance, err := p.findInstance(ctx, projectID, instanceName)
+	if err != nil {
+		return err
+	}
+	if instance == nil {
+		return nil
+	}
+	if lo.ContainsBy(instance.GetNetworkInterfaces(), func(nic *computepb.NetworkInterface) bool {
+		return ipam.SubnetworkName(nic.GetSubnetwork()) == p.podSubnetwork
+	}) {
+		return nil
+	}
+
+	region := zone[:strings.LastIndex(zone, "-")]
+	subnetURL := fmt.Sprintf("projects/%s/regions/%s/subnetworks/%s", subnetProject, region, p.podSubnetwork)
+
+	p.logger.Info("Attaching secondary NIC",
+		slog.String("instance", instanceName),
+		slog.String("subnetwork", subnetURL),
+	)
+	op, err := p.instancesClient.AddNetworkInterface(ctx, &computepb.AddNetworkInterfaceInstanceRequest{
+		Project:  projectID,
+		Zone:     zone,
+		Instance: instanceName,
+		NetworkInterfaceResource: &computepb.NetworkInterface{
+			Subnetwork: proto.String(subnetURL),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("add network interface to %s: %w", instanceName, err)
+	}
+	if err := p.operations.wait(ctx, projectID, zone, op.Proto().GetName()); err != nil {
+		return fmt.Errorf("wait for network interface of %s: %w", instanceName, err)
+	}
+	return nil
+}
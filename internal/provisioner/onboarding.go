@@ -0,0 +1,160 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// RunOnboardingController onboards every node every interval until ctx is
+// done. Each node gets a NodeOnboarding its installer reports the installed
+// plugin binary and the self-test to; once the self-test of the installed
+// release passed and warmIPs IPs are buffered for the node, its startup
+// taint is removed so pods get scheduled to it.
+func (p *Provisioner) RunOnboardingController(ctx context.Context, interval time.Duration, taint string, warmIPs int) error {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting node onboarding controller",
+		slog.Duration("interval", interval),
+		slog.String("taint", taint),
+		slog.Int("warm_ips", warmIPs),
+	)
+
+	for {
+		if err := p.onboardNodes(ctx, allocator, taint, warmIPs); err != nil {
+			p.logger.Error("Node onboarding failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) onboardNodes(ctx context.Context, allocator *ipam.Allocator, taint string, warmIPs int) error {
+	nodes, err := p.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list nodes: %w", err)
+	}
+	onboardings, err := allocator.ListOnboardings(ctx)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]*v1alpha1.NodeOnboarding, len(onboardings))
+	for i := range onboardings {
+		existing[onboardings[i].Name] = &onboardings[i]
+	}
+
+	buffered := map[string]int{}
+	if warmIPs > 0 {
+		pools, err := allocator.ListPools(ctx)
+		if err != nil {
+			return err
+		}
+		for _, pool := range pools {
+			for _, allocation := range pool.Spec.Allocations {
+				if allocation.Buffered {
+					buffered[allocation.NodeName]++
+				}
+			}
+		}
+	}
+
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		logger := p.logger.With(slog.String("node", node.Name))
+		if err := p.onboardNode(ctx, allocator, node, existing[node.Name], taint, warmIPs, buffered[node.Name], logger); err != nil {
+			logger.Error("Failed to onboard node", slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+func (p *Provisioner) onboardNode(ctx context.Context, allocator *ipam.Allocator, node *corev1.Node, o *v1alpha1.NodeOnboarding, taint string, warmIPs, buffered int, logger *slog.Logger) error {
+	if node.DeletionTimestamp != nil {
+		return nil
+	}
+	if o == nil {
+		created, err := allocator.CreateOnboarding(ctx, &v1alpha1.NodeOnboarding{ObjectMeta: metav1.ObjectMeta{
+			Name: node.Name,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Node",
+				Name:       node.Name,
+				UID:        node.UID,
+			}},
+		}})
+		if err != nil {
+			return err
+		}
+		logger.Info("Onboarding node")
+		o = created
+	}
+	if o.Status.Phase == v1alpha1.NodeOnboardingReady {
+		return nil
+	}
+
+	o.Status.WarmIPs = buffered
+	phase, message := ipam.OnboardingPhase(o, warmIPs)
+	if phase == v1alpha1.NodeOnboardingReady {
+		if err := p.removeTaint(ctx, node, taint); err != nil {
+			return err
+		}
+	}
+
+	if o.Status.Phase == phase && o.Status.Message == message {
+		return nil
+	}
+	logger.Info("Node onboarding advanced",
+		slog.String("from", string(o.Status.Phase)),
+		slog.String("to", string(phase)),
+		slog.String("version", o.Status.InstalledVersion),
+		slog.String("message", message),
+	)
+	return allocator.ModifyOnboarding(ctx, o.Name, func(current *v1alpha1.NodeOnboarding) error {
+		current.Status.WarmIPs = buffered
+		ipam.SetOnboardingPhase(current, phase, message)
+		return nil
+	})
+}
+
+// removeTaint removes the taint with key from the node. The patch only
+// applies to the taints read, a concurrent change of them fails it and the
+// next run tries again.
+func (p *Provisioner) removeTaint(ctx context.Context, node *corev1.Node, key string) error {
+	taints := make([]corev1.Taint, 0, len(node.Spec.Taints))
+	for _, t := range node.Spec.Taints {
+		if t.Key != key {
+			taints = append(taints, t)
+		}
+	}
+	if len(taints) == len(node.Spec.Taints) {
+		return nil
+	}
+
+	patch, err := json.Marshal([]map[string]any{
+		{"op": "test", "path": "/spec/taints", "value": node.Spec.Taints},
+		{"op": "replace", "path": "/spec/taints", "value": taints},
+	})
+	if err != nil {
+		return fmt.Errorf("marshal taint patch: %w", err)
+	}
+	if _, err := p.kubeClient.CoreV1().Nodes().Patch(ctx, node.Name, types.JSONPatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("remove taint %s: %w", key, err)
+	}
+	p.logger.Info("Removed startup taint", slog.String("node", node.Name), slog.String("taint", key))
+	return nil
+}
@@ -0,0 +1,97 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestOnboardNodes(t *testing.T) {
+	ctx := context.Background()
+	const taint = "gcp-cni.cast.ai/not-ready"
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:        "10.8.0.0/24",
+			Allocations: map[string]v1alpha1.IPAllocation{"10.8.0.2": {NodeName: "node-1", Buffered: true}},
+		},
+	}
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{pool}, &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", UID: "node-uid"},
+		Spec:       corev1.NodeSpec{Taints: []corev1.Taint{{Key: taint, Effect: corev1.TaintEffectNoSchedule}}},
+	})
+	allocator := ipam.NewAllocator(p.dynamicClient)
+
+	phase := func() v1alpha1.NodeOnboardingPhase {
+		t.Helper()
+		if err := p.onboardNodes(ctx, allocator, taint, 1); err != nil {
+			t.Fatal(err)
+		}
+		o, err := allocator.GetOnboarding(ctx, "node-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o.Status.Phase
+	}
+	report := func(report func(status *v1alpha1.NodeOnboardingStatus)) {
+		t.Helper()
+		node := metav1.OwnerReference{APIVersion: "v1", Kind: "Node", Name: "node-1", UID: "node-uid"}
+		if err := allocator.ReportOnboarding(ctx, node, report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tainted := func() bool {
+		t.Helper()
+		node, err := p.kubeClient.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(node.Spec.Taints) > 0
+	}
+
+	if got := phase(); got != v1alpha1.NodeOnboardingInstalling {
+		t.Fatalf("phase of a new node = %s, want Installing", got)
+	}
+	report(func(status *v1alpha1.NodeOnboardingStatus) { status.InstalledVersion = "v2" })
+	if got := phase(); got != v1alpha1.NodeOnboardingSelfTesting || !tainted() {
+		t.Fatalf("phase after install = %s, want SelfTesting with the taint kept", got)
+	}
+	report(func(status *v1alpha1.NodeOnboardingStatus) { status.SelfTestError = "no token" })
+	if got := phase(); got != v1alpha1.NodeOnboardingFailed || !tainted() {
+		t.Fatalf("phase after a failed self-test = %s, want Failed with the taint kept", got)
+	}
+	report(func(status *v1alpha1.NodeOnboardingStatus) { status.SelfTestVersion, status.SelfTestError = "v2", "" })
+	if got := phase(); got != v1alpha1.NodeOnboardingReady || tainted() {
+		t.Fatalf("phase after the self-test passed = %s, want Ready without the taint", got)
+	}
+}
+
+func TestOnboardNodesWaitsForWarmIPs(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{{ObjectMeta: metav1.ObjectMeta{Name: "pool"}, Spec: v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/24"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", UID: "node-uid"}})
+	allocator := ipam.NewAllocator(p.dynamicClient)
+
+	node := metav1.OwnerReference{APIVersion: "v1", Kind: "Node", Name: "node-1", UID: "node-uid"}
+	err := allocator.ReportOnboarding(ctx, node, func(status *v1alpha1.NodeOnboardingStatus) {
+		status.InstalledVersion, status.SelfTestSkipped = "v2", true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.onboardNodes(ctx, allocator, "gcp-cni.cast.ai/not-ready", 1); err != nil {
+		t.Fatal(err)
+	}
+	o, err := allocator.GetOnboarding(ctx, "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Status.Phase != v1alpha1.NodeOnboardingPreWarming {
+		t.Errorf("phase without buffered IPs = %s, want PreWarming", o.Status.Phase)
+	}
+}
@@ -0,0 +1,168 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// operationPollInterval is how often pending zone operations are checked
+	operationPollInterval = 500 * time.Millisecond
+	// operationBatchSize bounds the operation names in a single list filter
+	operationBatchSize = 50
+)
+
+type zoneKey struct {
+	project string
+	zone    string
+}
+
+// operationWaiter waits for zone operations of concurrent callers together.
+// Instead of every caller polling its own operation, the operations pending in
+// a zone are checked with a single filtered list call per interval, so bulk
+// work such as reclaiming the leases of a removed node pool stays within the
+// operations read quota.
+type operationWaiter struct {
+	logger *slog.Logger
+	client *compute.ZoneOperationsClient
+
+	mu      sync.Mutex
+	pending map[zoneKey]map[string]chan error
+	polling bool
+}
+
+func newOperationWaiter(logger *slog.Logger, client *compute.ZoneOperationsClient) *operationWaiter {
+	return &operationWaiter{
+		logger:  logger,
+		client:  client,
+		pending: map[zoneKey]map[string]chan error{},
+	}
+}
+
+// wait blocks until the named zone operation is done and returns its error
+func (w *operationWaiter) wait(ctx context.Context, project, zone, name string) error {
+	key := zoneKey{project: project, zone: zone}
+	done := make(chan error, 1)
+
+	w.mu.Lock()
+	if w.pending[key] == nil {
+		w.pending[key] = map[string]chan error{}
+	}
+	w.pending[key][name] = done
+	if !w.polling {
+		w.polling = true
+		go w.poll()
+	}
+	w.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		w.mu.Lock()
+		delete(w.pending[key], name)
+		w.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// poll checks the pending operations until there are none left
+func (w *operationWaiter) poll() {
+	ticker := time.NewTicker(operationPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.mu.Lock()
+		batches := map[zoneKey][]string{}
+		for key, ops := range w.pending {
+			if len(ops) == 0 {
+				delete(w.pending, key)
+				continue
+			}
+			for name := range ops {
+				batches[key] = append(batches[key], name)
+			}
+		}
+		if len(batches) == 0 {
+			w.polling = false
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+
+		for key, names := range batches {
+			for len(names) > 0 {
+				n := min(len(names), operationBatchSize)
+				if err := w.check(key, names[:n]); err != nil {
+					w.logger.Error("Failed to check zone operations",
+						slog.String("zone", key.zone),
+						slog.Int("operations", n),
+						slog.String("error", err.Error()),
+					)
+				}
+				names = names[n:]
+			}
+		}
+	}
+}
+
+// check lists the named operations and completes the callers of those done
+func (w *operationWaiter) check(key zoneKey, names []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	it := w.client.List(ctx, &computepb.ListZoneOperationsRequest{
+		Project: key.project,
+		Zone:    key.zone,
+		Filter:  proto.String(operationsFilter(names)),
+	})
+	for {
+		op, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("list operations: %w", err)
+		}
+		if op.GetStatus() != computepb.Operation_DONE {
+			continue
+		}
+
+		w.mu.Lock()
+		done, ok := w.pending[key][op.GetName()]
+		delete(w.pending[key], op.GetName())
+		w.mu.Unlock()
+		if ok {
+			done <- operationError(op)
+		}
+	}
+}
+
+func operationsFilter(names []string) string {
+	clauses := make([]string, 0, len(names))
+	for _, name := range names {
+		clauses = append(clauses, fmt.Sprintf("(name = %q)", name))
+	}
+	return strings.Join(clauses, " OR ")
+}
+
+func operationError(op *computepb.Operation) error {
+	if op.GetError() == nil || len(op.GetError().GetErrors()) == 0 {
+		return nil
+	}
+	var errs []string
+	for _, e := range op.GetError().GetErrors() {
+		errs = append(errs, e.GetMessage())
+	}
+	return fmt.Errorf("operation %s failed: %s", op.GetName(), strings.Join(errs, ", "))
+}
@@ -0,0 +1,136 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOperationsFilter(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		{names: []string{"op-1"}, want: `(name = "op-1")`},
+		{names: []string{"op-1", "op-2", "op-3"}, want: `(name = "op-1") OR (name = "op-2") OR (name = "op-3")`},
+	}
+	for _, tt := range tests {
+		if got := operationsFilter(tt.names); got != tt.want {
+			t.Errorf("operationsFilter(%v) = %s, want %s", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestOperationWaiter(t *testing.T) {
+	var mu sync.Mutex
+	var lists []int
+	filterName := regexp.MustCompile(`name = "([^"]+)"`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != fmt.Sprintf("/compute/v1/projects/%s/zones/%s/operations", testProject, testZone) {
+			t.Errorf("unexpected GCE request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		matches := filterName.FindAllStringSubmatch(r.URL.Query().Get("filter"), -1)
+		mu.Lock()
+		lists = append(lists, len(matches))
+		mu.Unlock()
+
+		list := &computepb.OperationList{}
+		for _, m := range matches {
+			op := &computepb.Operation{Name: proto.String(m[1]), Status: computepb.Operation_DONE.Enum()}
+			switch {
+			case m[1] == "op-running":
+				op.Status = computepb.Operation_RUNNING.Enum()
+			case m[1] == "op-failed":
+				op.Error = &computepb.Error{Errors: []*computepb.Errors{{Message: proto.String("alias IP range overlaps")}}}
+			}
+			list.Items = append(list.Items, op)
+		}
+		data, err := protojson.Marshal(list)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+	client, err := compute.NewZoneOperationsRESTClient(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiter := newOperationWaiter(slog.New(slog.NewTextHandler(io.Discard, nil)), client)
+
+	// More concurrent callers than fit in one list filter
+	const callers = operationBatchSize + 10
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("op-%d", i)
+			if i == 0 {
+				name = "op-failed"
+			}
+			errs[i] = waiter.wait(context.Background(), testProject, testZone, name)
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*operationPollInterval)
+	defer cancel()
+	if err := waiter.wait(ctx, testProject, testZone, "op-running"); err != context.DeadlineExceeded {
+		t.Errorf("wait() of a running operation = %v, want the deadline exceeded", err)
+	}
+	wg.Wait()
+
+	if errs[0] == nil || !strings.Contains(errs[0].Error(), "alias IP range overlaps") {
+		t.Errorf("wait() of a failed operation = %v, want its error", errs[0])
+	}
+	for i, err := range errs[1:] {
+		if err != nil {
+			t.Errorf("wait() of op-%d = %v", i+1, err)
+		}
+	}
+
+	mu.Lock()
+	listed := append([]int(nil), lists...)
+	mu.Unlock()
+	checked := 0
+	for _, n := range listed {
+		if n > operationBatchSize {
+			t.Errorf("list filter of %d operations, want at most %d", n, operationBatchSize)
+		}
+		checked += n
+	}
+	// All callers are done after one poll, the running operation is checked
+	// again on every poll until its caller gives up
+	if polls := len(listed); polls > 2+3 {
+		t.Errorf("%d list calls for %d operations, want them batched", polls, callers+1)
+	}
+	if checked < callers+1 {
+		t.Errorf("%d operations checked, want all %d", checked, callers+1)
+	}
+
+	// The waiter stops polling once nobody waits
+	time.Sleep(2 * operationPollInterval)
+	waiter.mu.Lock()
+	polling := waiter.polling
+	waiter.mu.Unlock()
+	if polling {
+		t.Error("waiter still polls without pending operations")
+	}
+}
@@ -0,0 +1,92 @@
+package provisioner
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// RunPoolProtectionController adds the pool protection finalizer to every
+// IPPool every interval until ctx is done. A deleted pool is only let go once
+// it allocates no IP anymore, or once it is annotated for a forced deletion;
+// until then its DeletionBlocked condition names who still holds IPs.
+func (p *Provisioner) RunPoolProtectionController(ctx context.Context, interval time.Duration) error {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting pool protection controller", slog.Duration("interval", interval))
+
+	for {
+		if err := p.protectPools(ctx, allocator); err != nil {
+			p.logger.Error("Pool protection failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) protectPools(ctx context.Context, allocator *ipam.Allocator) error {
+	if p.frozen(ctx, allocator) {
+		return nil
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range pools {
+		pool := &pools[i]
+		logger := p.logger.With(slog.String("pool", pool.Name))
+		if err := p.protectPool(ctx, allocator, pool, logger); err != nil {
+			logger.Error("Failed to protect pool", slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+func (p *Provisioner) protectPool(ctx context.Context, allocator *ipam.Allocator, pool *v1alpha1.IPPool, logger *slog.Logger) error {
+	protected := slices.Contains(pool.Finalizers, ipam.PoolProtectionFinalizer)
+	if pool.DeletionTimestamp == nil {
+		if protected {
+			return nil
+		}
+		return allocator.SetFinalizer(ctx, pool.Name, ipam.PoolProtectionFinalizer, true)
+	}
+	if !protected {
+		return nil
+	}
+
+	holders := ipam.PoolHolders(pool)
+	force := pool.Annotations[ipam.ForceDeleteAnnotation] == "true"
+	if len(holders) > 0 && !force {
+		condition := ipam.DeletionBlockedCondition(pool, holders)
+		if current := meta.FindStatusCondition(pool.Status.Conditions, v1alpha1.IPPoolDeletionBlocked); current == nil || current.Message != condition.Message {
+			logger.Warn("Deletion of pool waits for its IPs to be released",
+				slog.Int("allocations", len(holders)),
+				slog.String("holders", condition.Message),
+			)
+		}
+		return allocator.SetCondition(ctx, pool.Name, condition)
+	}
+
+	if err := allocator.SetFinalizer(ctx, pool.Name, ipam.PoolProtectionFinalizer, false); err != nil {
+		return err
+	}
+	if force && len(holders) > 0 {
+		logger.Warn("Forced deletion of pool, its allocations are orphaned", slog.Int("allocations", len(holders)))
+	} else {
+		logger.Info("Released deleted pool")
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+const (
+	// ProbeLabel marks the probe pods, its value is "true"
+	ProbeLabel = "gcp-cni.cast.ai/probe"
+	// DefaultProbeImage serves HTTP on probePort with agnhost netexec
+	DefaultProbeImage = "registry.k8s.io/e2e-test-images/agnhost:2.47"
+
+	probePort = 8080
+	// probeGracePeriod is the termination grace period of probe pods. They are
+	// deleted gracefully, so the kubelet releases the IP through the plugin
+	// before the pod is gone, and netexec exits on SIGTERM right away.
+	probeGracePeriod = 1
+)
+
+// ProbePods configures the pods the probe controller runs on every node
+type ProbePods struct {
+	// Namespace the probe pods are created in
+	Namespace string
+	// Image of the probe pods, serving GET /hostname on probePort like
+	// agnhost netexec
+	Image string
+	// Timeout for a probe pod to get an IP and answer
+	Timeout time.Duration
+}
+
+// probeResult is the outcome of the last probe of a node
+type probeResult struct {
+	success  bool
+	latency  time.Duration
+	failures int
+}
+
+// probeResults are the probe results of every node, served with the metrics
+type probeResults struct {
+	mu    sync.Mutex
+	nodes map[string]probeResult
+}
+
+func (r *probeResults) record(node string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.nodes == nil {
+		r.nodes = map[string]probeResult{}
+	}
+	result := r.nodes[node]
+	result.success, result.latency = err == nil, latency
+	if err != nil {
+		result.failures++
+	}
+	r.nodes[node] = result
+}
+
+// retain drops the results of nodes that are gone
+func (r *probeResults) retain(nodes map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for node := range r.nodes {
+		if !nodes[node] {
+			delete(r.nodes, node)
+		}
+	}
+}
+
+func (r *probeResults) snapshot() map[string]probeResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshot := make(map[string]probeResult, len(r.nodes))
+	for node, result := range r.nodes {
+		snapshot[node] = result
+	}
+	return snapshot
+}
+
+// RunProbeController verifies the whole datapath of every node running
+// gcp-ipam every interval until ctx is done: a probe pod is created on the
+// node, must get an IP allocated to it in a pool and answer HTTP from the
+// provisioner over the VPC within the timeout, and is deleted again. The
+// results are served by RunMetricsServer. Nodes draining, being uninstalled
+// or not schedulable are skipped.
+func (p *Provisioner) RunProbeController(ctx context.Context, interval time.Duration, probe ProbePods) error {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting probe controller",
+		slog.Duration("interval", interval),
+		slog.Duration("timeout", probe.Timeout),
+		slog.String("namespace", probe.Namespace),
+	)
+
+	for {
+		if err := p.probeNodes(ctx, allocator, probe); err != nil {
+			p.logger.Error("Probing nodes failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) probeNodes(ctx context.Context, allocator *ipam.Allocator, probe ProbePods) error {
+	p.deleteProbePods(ctx, probe.Namespace)
+
+	nodes, err := p.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list nodes: %w", err)
+	}
+	present := map[string]bool{}
+	var g errgroup.Group
+	g.SetLimit(gcConcurrency)
+	for _, node := range nodes.Items {
+		present[node.Name] = true
+		if node.DeletionTimestamp != nil || node.Spec.Unschedulable || nodeDraining(&node) ||
+			node.Annotations[ipam.PluginVersionAnnotation] == "" {
+			continue
+		}
+		g.Go(func() error {
+			startTime := time.Now()
+			err := p.probeNode(ctx, allocator, probe, node.Name)
+			latency := time.Since(startTime)
+			p.probes.record(node.Name, latency, err)
+			if err != nil {
+				p.logger.Warn("Probe of node failed",
+					slog.String("node", node.Name),
+					slog.Duration("latency", latency),
+					slog.String("error", err.Error()),
+				)
+				return nil
+			}
+			p.logger.Debug("Probe of node succeeded", slog.String("node", node.Name), slog.Duration("latency", latency))
+			return nil
+		})
+	}
+	g.Wait()
+	p.probes.retain(present)
+	return nil
+}
+
+// probeNode runs one probe pod on the node and deletes it again
+func (p *Provisioner) probeNode(ctx context.Context, allocator *ipam.Allocator, probe ProbePods, nodeName string) error {
+	ctx, cancel := context.WithTimeout(ctx, probe.Timeout)
+	defer cancel()
+
+	pods := p.kubeClient.CoreV1().Pods(probe.Namespace)
+	pod, err := pods.Create(ctx, probePod(probe, nodeName), metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("create probe pod: %w", err)
+	}
+	defer func() {
+		err := pods.Delete(context.WithoutCancel(ctx), pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			p.logger.Error("Failed to delete probe pod", slog.String("pod", pod.Name), slog.String("error", err.Error()))
+		}
+	}()
+
+	for pod.Status.PodIP == "" {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("probe pod %s got no IP: %w", pod.Name, ctx.Err())
+		case <-time.After(time.Second):
+		}
+		if pod, err = pods.Get(ctx, pod.Name, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("get probe pod: %w", err)
+		}
+	}
+
+	if err := verifyProbeAllocation(ctx, allocator, pod); err != nil {
+		return err
+	}
+
+	url := "http://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(probePort)) + "/hostname"
+	for {
+		err := probeHTTP(ctx, url, pod.Name)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("probe pod %s unreachable at %s: %w", pod.Name, pod.Status.PodIP, err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// verifyProbeAllocation checks that the IP of the probe pod is allocated to
+// it in one of the pools
+func verifyProbeAllocation(ctx context.Context, allocator *ipam.Allocator, pod *corev1.Pod) error {
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		if allocation, ok := pool.Spec.Allocations[pod.Status.PodIP]; ok {
+			if allocation.PodUID != string(pod.UID) {
+				return fmt.Errorf("IP %s of probe pod %s is allocated to pod %s/%s in pool %s",
+					pod.Status.PodIP, pod.Name, allocation.PodNamespace, allocation.PodName, pool.Name)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("IP %s of probe pod %s is not allocated in any pool", pod.Status.PodIP, pod.Name)
+}
+
+func probeHTTP(ctx context.Context, url, hostname string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if got := strings.TrimSpace(string(body)); got != hostname {
+		return fmt.Errorf("answered by %q instead of the probe pod", got)
+	}
+	return nil
+}
+
+func probePod(probe ProbePods, nodeName string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "gcp-cni-probe-",
+			Namespace:    probe.Namespace,
+			Labels:       map[string]string{ProbeLabel: "true"},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:                      nodeName,
+			RestartPolicy:                 corev1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: lo.ToPtr[int64](probeGracePeriod),
+			AutomountServiceAccountToken:  lo.ToPtr(false),
+			Tolerations:                   []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+			Containers: []corev1.Container{{
+				Name:  "probe",
+				Image: probe.Image,
+				Args:  []string{"netexec", "--http-port=" + strconv.Itoa(probePort)},
+				Ports: []corev1.ContainerPort{{ContainerPort: probePort}},
+			}},
+		},
+	}
+}
+
+// deleteProbePods deletes probe pods left behind by an earlier provisioner.
+// Pods already terminating are left to the kubelet.
+func (p *Provisioner) deleteProbePods(ctx context.Context, namespace string) {
+	pods, err := p.kubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: ProbeLabel + "=true"})
+	if err != nil {
+		p.logger.Error("Failed to list probe pods", slog.String("error", err.Error()))
+		return
+	}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		err := p.kubeClient.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			p.logger.Error("Failed to delete leftover probe pod", slog.String("pod", pod.Name), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// writeProbeMetrics writes the result of the last probe of every node
+func writeProbeMetrics(w io.Writer, results map[string]probeResult) error {
+	nodes := make([]string, 0, len(results))
+	for node := range results {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP gcp_cni_probe_success Whether the last probe pod of the node got a pool IP and was reachable over the VPC\n# TYPE gcp_cni_probe_success gauge\n")
+	for _, node := range nodes {
+		fmt.Fprintf(&b, "gcp_cni_probe_success{node=%q} %d\n", node, map[bool]int{true: 1}[results[node].success])
+	}
+	fmt.Fprintf(&b, "# HELP gcp_cni_probe_latency_seconds Time from creating the last probe pod of the node until it answered or the probe failed\n# TYPE gcp_cni_probe_latency_seconds gauge\n")
+	for _, node := range nodes {
+		fmt.Fprintf(&b, "gcp_cni_probe_latency_seconds{node=%q} %g\n", node, results[node].latency.Seconds())
+	}
+	fmt.Fprintf(&b, "# HELP gcp_cni_probe_failures_total Failed probes of the node\n# TYPE gcp_cni_probe_failures_total counter\n")
+	for _, node := range nodes {
+		fmt.Fprintf(&b, "gcp_cni_probe_failures_total{node=%q} %d\n", node, results[node].failures)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
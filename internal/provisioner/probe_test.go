@@ -0,0 +1,126 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestProbeResults(t *testing.T) {
+	var results probeResults
+	results.record("node-1", time.Second, nil)
+	results.record("node-2", 2*time.Second, errors.New("unreachable"))
+	results.record("node-2", 3*time.Second, errors.New("unreachable"))
+	results.record("node-3", time.Second, errors.New("no IP"))
+	results.record("node-3", time.Second, nil)
+	results.retain(map[string]bool{"node-2": true, "node-3": true})
+
+	want := map[string]probeResult{
+		"node-2": {success: false, latency: 3 * time.Second, failures: 2},
+		// A node that recovered keeps counting its earlier failures
+		"node-3": {success: true, latency: time.Second, failures: 1},
+	}
+	got := results.snapshot()
+	if len(got) != len(want) {
+		t.Fatalf("snapshot() = %v, want %v", got, want)
+	}
+	for node, result := range want {
+		if got[node] != result {
+			t.Errorf("result of %s = %+v, want %+v", node, got[node], result)
+		}
+	}
+}
+
+func TestProbeHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hostname":
+			fmt.Fprintln(w, "gcp-cni-probe-abc")
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	if err := probeHTTP(ctx, server.URL+"/hostname", "gcp-cni-probe-abc"); err != nil {
+		t.Errorf("probeHTTP() of the probe pod = %v", err)
+	}
+	if err := probeHTTP(ctx, server.URL+"/hostname", "gcp-cni-probe-xyz"); err == nil {
+		t.Error("probeHTTP() answered by another pod succeeded")
+	}
+	if err := probeHTTP(ctx, server.URL+"/missing", "gcp-cni-probe-abc"); err == nil {
+		t.Error("probeHTTP() with status 404 succeeded")
+	}
+}
+
+func TestWriteProbeMetrics(t *testing.T) {
+	var b strings.Builder
+	err := writeProbeMetrics(&b, map[string]probeResult{
+		"node-2": {success: false, latency: 1500 * time.Millisecond, failures: 3},
+		"node-1": {success: true, latency: 250 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE gcp_cni_probe_success gauge",
+		`gcp_cni_probe_success{node="node-1"} 1`,
+		`gcp_cni_probe_success{node="node-2"} 0`,
+		`gcp_cni_probe_latency_seconds{node="node-1"} 0.25`,
+		`gcp_cni_probe_latency_seconds{node="node-2"} 1.5`,
+		"# TYPE gcp_cni_probe_failures_total counter",
+		`gcp_cni_probe_failures_total{node="node-1"} 0`,
+		`gcp_cni_probe_failures_total{node="node-2"} 3`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("metrics miss %q:\n%s", line, b.String())
+		}
+	}
+	// Nodes are written in order
+	if strings.Index(b.String(), `{node="node-1"}`) > strings.Index(b.String(), `{node="node-2"}`) {
+		t.Errorf("node-2 written before node-1:\n%s", b.String())
+	}
+}
+
+func TestDeleteProbePods(t *testing.T) {
+	now := metav1.Now()
+	probe := func(name string, deleted *metav1.Time) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "kube-system",
+			Name:              name,
+			Labels:            map[string]string{ProbeLabel: "true"},
+			DeletionTimestamp: deleted,
+		}}
+	}
+	p := newTestProvisioner(t, nil,
+		probe("gcp-cni-probe-left", nil),
+		probe("gcp-cni-probe-terminating", &now),
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "other"}},
+	)
+	var deleted []string
+	p.kubeClient.(*kubefake.Clientset).PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		del := action.(k8stesting.DeleteActionImpl)
+		if grace := del.GetDeleteOptions().GracePeriodSeconds; grace != nil {
+			t.Errorf("probe pod %s deleted with grace period %d, want the pod's own", del.GetName(), *grace)
+		}
+		deleted = append(deleted, del.GetName())
+		return false, nil, nil
+	})
+
+	p.deleteProbePods(context.Background(), "kube-system")
+	if len(deleted) != 1 || deleted[0] != "gcp-cni-probe-left" {
+		t.Errorf("deleted %v, want only the leftover probe pod", deleted)
+	}
+}
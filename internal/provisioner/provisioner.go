@@ -5,18 +5,24 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path"
 
 	compute "cloud.google.com/go/compute/apiv1"
 	"cloud.google.com/go/compute/apiv1/computepb"
 	networkconnectivity "cloud.google.com/go/networkconnectivity/apiv1"
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
 	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
 	"github.com/samber/lo"
 	"google.golang.org/protobuf/proto"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -27,12 +33,31 @@ type Provisioner struct {
 	subnetworkClient       *compute.SubnetworksClient
 	internalRangeClient    *networkconnectivity.InternalRangeClient
 	instancesClient        *compute.InstancesClient
+	routesClient           *compute.RoutesClient
+	firewallsClient        *compute.FirewallsClient
 	regionOperationsClient *compute.RegionOperationsClient
+	operations             *operationWaiter
 	dynamicClient          dynamic.Interface
+	kubeClient             kubernetes.Interface
+
+	configMapNamespace string
+	configMapName      string
+	podSubnetwork      string
+	profile            config.Profile
+	serviceCIDR        string
+	sharedVPC          config.SharedVPC
+	clusterID          string
+	version            string
+	commit             string
+
+	probes probeResults
 }
 
 func NewProvisioner(ctx context.Context, logger *slog.Logger) (*Provisioner, error) {
-	subnetworksClient, err := compute.NewSubnetworksRESTClient(ctx)
+	// An emulator endpoint from the environment, for CI and kind clusters
+	computeOptions := identity.FromEnv().ComputeOptions()
+
+	subnetworksClient, err := compute.NewSubnetworksRESTClient(ctx, computeOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("create subnetworks client: %w", err)
 	}
@@ -42,33 +67,62 @@ func NewProvisioner(ctx context.Context, logger *slog.Logger) (*Provisioner, err
 		return nil, fmt.Errorf("create internal ranges client: %w", err)
 	}
 
-	instancesClient, err := compute.NewInstancesRESTClient(ctx)
+	instancesClient, err := compute.NewInstancesRESTClient(ctx, computeOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("create instances client: %w", err)
 	}
 
-	regionOperationsClient, err := compute.NewRegionOperationsRESTClient(ctx)
+	routesClient, err := compute.NewRoutesRESTClient(ctx, computeOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("create routes client: %w", err)
+	}
+
+	firewallsClient, err := compute.NewFirewallsRESTClient(ctx, computeOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("create firewalls client: %w", err)
+	}
+
+	regionOperationsClient, err := compute.NewRegionOperationsRESTClient(ctx, computeOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("create region operations client: %w", err)
 	}
 
-	dynamicClient, err := buildDynamicClient()
+	zoneOperationsClient, err := compute.NewZoneOperationsRESTClient(ctx, computeOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("create zone operations client: %w", err)
+	}
+
+	restConfig, err := buildRestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dynamicClient, err := buildDynamicClient(restConfig)
 	if err != nil {
 		return nil, fmt.Errorf("create dynamic client: %w", err)
 	}
 
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("create kubernetes client: %w", err)
+	}
+
 	return &Provisioner{
 		logger:                 logger,
 		subnetworkClient:       subnetworksClient,
 		internalRangeClient:    internalRangesClient,
 		instancesClient:        instancesClient,
+		routesClient:           routesClient,
+		firewallsClient:        firewallsClient,
 		regionOperationsClient: regionOperationsClient,
+		operations:             newOperationWaiter(logger, zoneOperationsClient),
 		dynamicClient:          dynamicClient,
+		kubeClient:             kubeClient,
 	}, nil
 }
 
-// buildDynamicClient creates a Kubernetes dynamic client
-func buildDynamicClient() (dynamic.Interface, error) {
+// buildRestConfig loads the in-cluster config, falling back to the local kubeconfig
+func buildRestConfig() (*rest.Config, error) {
 	var config *rest.Config
 	var err error
 
@@ -90,7 +144,11 @@ func buildDynamicClient() (dynamic.Interface, error) {
 			return nil, fmt.Errorf("build kubeconfig: %w", err)
 		}
 	}
+	return config, nil
+}
 
+// buildDynamicClient creates a Kubernetes dynamic client
+func buildDynamicClient(config *rest.Config) (dynamic.Interface, error) {
 	// Register our API types
 	scheme := runtime.NewScheme()
 	if err := v1alpha1.AddToScheme(scheme); err != nil {
@@ -105,7 +163,117 @@ func buildDynamicClient() (dynamic.Interface, error) {
 	return dynamicClient, nil
 }
 
+// SetVersion records the build of the provisioner for its metrics
+func (p *Provisioner) SetVersion(version, commit string) {
+	p.version = version
+	p.commit = commit
+}
+
+// SetClusterID names the secondary ranges the provisioner creates after the
+// cluster, <secondary range name>-<clusterID> unless the naming of the plugin
+// configuration says otherwise, and limits the aliases it removes from
+// instances to those ranges
+func (p *Provisioner) SetClusterID(clusterID string) error {
+	if err := config.ValidateClusterID(clusterID); err != nil {
+		return err
+	}
+	p.clusterID = clusterID
+	return nil
+}
+
+// naming returns the plugin configuration the provisioner names the pools and
+// ranges it creates by, for its own cluster ID. An invalid configuration falls
+// back to the default naming, the installers keep rendering the last valid one
+// meanwhile. A configuration of another cluster ID is refused, the plugin would
+// look for ranges named after that one.
+func (p *Provisioner) naming(ctx context.Context) (*config.Config, error) {
+	cfg := config.Default()
+	if p.configMapName != "" {
+		cm, err := p.kubeClient.CoreV1().ConfigMaps(p.configMapNamespace).Get(ctx, p.configMapName, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+		case err != nil:
+			return nil, fmt.Errorf("get ConfigMap %s/%s: %w", p.configMapNamespace, p.configMapName, err)
+		default:
+			parsed, err := config.Parse([]byte(cm.Data[config.ConfigMapKey]))
+			switch {
+			case err != nil:
+				p.logger.Warn("Plugin configuration is invalid, naming pools and ranges by the defaults",
+					slog.String("configmap", p.configMapNamespace+"/"+p.configMapName),
+					slog.String("error", err.Error()),
+				)
+			case parsed.ClusterID != p.clusterID:
+				return nil, fmt.Errorf("cluster ID %q of the plugin configuration differs from --cluster-id %q", parsed.ClusterID, p.clusterID)
+			default:
+				cfg = parsed
+			}
+		}
+	}
+	cfg.ClusterID = p.clusterID
+	return cfg, nil
+}
+
+// checkRenamed refuses to provision the pool and range of the subnetwork
+// under new names while a pool of the old naming serves it, which a change of
+// the naming templates would otherwise leave next to a second range or pool
+func (p *Provisioner) checkRenamed(ctx context.Context, naming *config.Config, poolName, rangeName, subnetwork string) error {
+	pools, err := ipam.NewAllocator(p.dynamicClient).ListPools(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		if pool.DeletionTimestamp != nil || (pool.Spec.Class != "" && pool.Spec.Class != v1alpha1.PoolClassPod) ||
+			ipam.SubnetworkName(pool.Spec.Subnet) != subnetwork {
+			continue
+		}
+		switch {
+		case pool.Name != poolName && pool.Spec.SecondaryRangeName == rangeName:
+			return fmt.Errorf("IPPool %s already serves secondary range %s, naming.pool now names it %s: revert the template or migrate the pool first",
+				pool.Name, rangeName, poolName)
+		case pool.Name == poolName && pool.Spec.SecondaryRangeName != "" && pool.Spec.SecondaryRangeName != rangeName:
+			return fmt.Errorf("IPPool %s serves secondary range %s, naming.secondaryRange now names it %s: revert the template or migrate the pool first",
+				pool.Name, pool.Spec.SecondaryRangeName, rangeName)
+		case pool.Name != poolName && p.clusterID != "" && naming.InClusterRange(pool.Spec.SecondaryRangeName):
+			p.logger.Warn("Subnetwork already has an IPPool of the cluster under other names, provisioning a second one",
+				slog.String("subnetwork", subnetwork),
+				slog.String("existing_pool", pool.Name),
+				slog.String("existing_range", pool.Spec.SecondaryRangeName),
+				slog.String("pool", poolName),
+				slog.String("range", rangeName),
+			)
+		}
+	}
+	return nil
+}
+
+// ClusterRange returns the name of the secondary range rangeName the
+// provisioner provisions for the cluster
+func (p *Provisioner) ClusterRange(ctx context.Context, rangeName string) (string, error) {
+	naming, err := p.naming(ctx)
+	if err != nil {
+		return "", err
+	}
+	return naming.ClusterRange(rangeName), nil
+}
+
+// ownsAlias reports whether r is the host prefix of ip from a secondary range
+// of the cluster, known by naming or among names
+func ownsAlias(naming *config.Config, r *computepb.AliasIpRange, ip string, names ...string) bool {
+	return naming.InClusterRange(r.GetSubnetworkRangeName(), names...) && ipam.OwnsAlias(r.GetIpCidrRange(), r.GetSubnetworkRangeName(), ip, "")
+}
+
 func (p *Provisioner) Provision(ctx context.Context, secondaryRangeName *string) error {
+	naming, err := p.naming(ctx)
+	if err != nil {
+		return err
+	}
+	if naming.Freeze.Enabled {
+		p.logger.Warn("IP management is frozen, skipping mutations", slog.String("reason", naming.Freeze.Reason))
+		return nil
+	}
+	rangeName := naming.ClusterRange(*secondaryRangeName)
+	secondaryRangeName = &rangeName
+
 	clusterInfo, err := getClusterInfo(ctx, p.instancesClient, p.logger)
 	if err != nil {
 		return fmt.Errorf("get cluster info: %w", err)
@@ -118,6 +286,14 @@ func (p *Provisioner) Provision(ctx context.Context, secondaryRangeName *string)
 		slog.String("subnetwork", clusterInfo.subnetworkName),
 	)
 
+	// Subnetworks and internal ranges of a Shared VPC belong to the host project
+	clusterInfo.projectID = p.networkProject(clusterInfo.projectID)
+
+	// In the secondary NIC mode the pod range lives in the dedicated subnetwork
+	if p.podSubnetwork != "" {
+		clusterInfo.subnetworkName = p.podSubnetwork
+	}
+
 	subnet, err := p.subnetworkClient.Get(ctx, &computepb.GetSubnetworkRequest{
 		Project:    clusterInfo.projectID,
 		Region:     clusterInfo.region,
@@ -126,6 +302,12 @@ func (p *Provisioner) Provision(ctx context.Context, secondaryRangeName *string)
 	if err != nil {
 		return fmt.Errorf("get subnetwork: %w", err)
 	}
+	clusterInfo.networkName = path.Base(subnet.GetNetwork())
+	poolName := naming.DefaultPoolName(clusterInfo.subnetworkName)
+	internalRangeName := naming.InternalRangeName(*secondaryRangeName, clusterInfo.subnetworkName)
+	if err := p.checkRenamed(ctx, naming, poolName, *secondaryRangeName, clusterInfo.subnetworkName); err != nil {
+		return err
+	}
 
 	p.logger.Info("Current subnet configuration",
 		slog.String("primary_cidr", subnet.GetIpCidrRange()),
@@ -154,7 +336,7 @@ func (p *Provisioner) Provision(ctx context.Context, secondaryRangeName *string)
 				clusterInfo.subnetworkName,
 			)
 
-			if err := p.createOrUpdateIPPool(ctx, clusterInfo.subnetworkName, r.GetIpCidrRange(), subnetURL, *secondaryRangeName); err != nil {
+			if err := p.createOrUpdateIPPool(ctx, poolName, r.GetIpCidrRange(), subnetURL, *secondaryRangeName); err != nil {
 				p.logger.Error("Failed to ensure IPPool resource exists",
 					slog.String("error", err.Error()),
 				)
@@ -165,7 +347,12 @@ func (p *Provisioner) Provision(ctx context.Context, secondaryRangeName *string)
 		}
 	}
 
-	internalRangeCIDR, err := allocateInternalRange(ctx, p.internalRangeClient, clusterInfo, *secondaryRangeName, p.logger)
+	excludeCIDRs, err := p.serviceCIDRs(ctx)
+	if err != nil {
+		return fmt.Errorf("discover service CIDR: %w", err)
+	}
+
+	internalRangeCIDR, err := allocateInternalRange(ctx, p.internalRangeClient, clusterInfo, internalRangeName, excludeCIDRs, p.logger)
 
 	p.logger.Info("Creating secondary IP range on subnet",
 		slog.String("name", *secondaryRangeName),
@@ -175,7 +362,7 @@ func (p *Provisioner) Provision(ctx context.Context, secondaryRangeName *string)
 	patchSubnet := computepb.Subnetwork{
 		Fingerprint: subnet.Fingerprint,
 	}
-	internalRangePath := fmt.Sprintf("//networkconnectivity.googleapis.com/projects/%s/locations/global/internalRanges/%s", clusterInfo.projectID, *secondaryRangeName)
+	internalRangePath := fmt.Sprintf("//networkconnectivity.googleapis.com/projects/%s/locations/global/internalRanges/%s", clusterInfo.projectID, internalRangeName)
 	patchSubnet.SecondaryIpRanges = append(subnet.SecondaryIpRanges, &computepb.SubnetworkSecondaryRange{
 		RangeName:             proto.String(*secondaryRangeName),
 		ReservedInternalRange: proto.String(internalRangePath),
@@ -201,7 +388,7 @@ func (p *Provisioner) Provision(ctx context.Context, secondaryRangeName *string)
 	}
 
 	p.logger.Info("VPC provisioning completed successfully",
-		slog.String("reservation_name", *secondaryRangeName),
+		slog.String("reservation_name", internalRangeName),
 		slog.String("secondary_range_name", *secondaryRangeName),
 		slog.String("cidr", internalRangeCIDR),
 	)
@@ -213,7 +400,7 @@ func (p *Provisioner) Provision(ctx context.Context, secondaryRangeName *string)
 		clusterInfo.subnetworkName,
 	)
 
-	if err := p.createOrUpdateIPPool(ctx, clusterInfo.subnetworkName, internalRangeCIDR, subnetURL, *secondaryRangeName); err != nil {
+	if err := p.createOrUpdateIPPool(ctx, poolName, internalRangeCIDR, subnetURL, *secondaryRangeName); err != nil {
 		p.logger.Error("Failed to create IPPool resource",
 			slog.String("error", err.Error()),
 		)
@@ -221,7 +408,7 @@ func (p *Provisioner) Provision(ctx context.Context, secondaryRangeName *string)
 	}
 
 	p.logger.Info("IPPool resource created successfully",
-		slog.String("pool_name", fmt.Sprintf("ippool-%s", clusterInfo.subnetworkName)),
+		slog.String("pool_name", poolName),
 		slog.String("cidr", internalRangeCIDR),
 	)
 
@@ -229,9 +416,7 @@ func (p *Provisioner) Provision(ctx context.Context, secondaryRangeName *string)
 }
 
 // createOrUpdateIPPool creates or updates an IPPool resource for the secondary range
-func (p *Provisioner) createOrUpdateIPPool(ctx context.Context, subnetworkName, cidr, subnetURL, secondaryRangeName string) error {
-	poolName := fmt.Sprintf("ippool-%s", subnetworkName)
-
+func (p *Provisioner) createOrUpdateIPPool(ctx context.Context, poolName, cidr, subnetURL, secondaryRangeName string) error {
 	// Define IPPool GVR
 	ipPoolGVR := schema.GroupVersionResource{
 		Group:    "ipam.gcp-cni.cast.ai",
@@ -278,8 +463,23 @@ func (p *Provisioner) createOrUpdateIPPool(ctx context.Context, subnetworkName,
 			return fmt.Errorf("convert existing IPPool: %w", err)
 		}
 
+		// A narrower CIDR would orphan the allocations outside it, they have to
+		// be vacated first
+		if len(existingIPPool.Spec.SecondaryRanges) == 0 && cidr != existingIPPool.Spec.CIDR {
+			if outside := ipam.AllocationsOutside(existingIPPool, cidr); outside > 0 {
+				return fmt.Errorf("shrink IPPool %s to %s: %d allocations outside it, vacate them first", poolName, cidr, outside)
+			}
+		}
+
 		// Update only CIDR, Subnet, and SecondaryRangeName, keep existing allocations
+		// and the settings operators manage on the pool
 		ipPool.Spec.Allocations = existingIPPool.Spec.Allocations
+		ipPool.Spec.SecondaryRanges = existingIPPool.Spec.SecondaryRanges
+		ipPool.Spec.RangeStrategy = existingIPPool.Spec.RangeStrategy
+		ipPool.Spec.LeaseDuration = existingIPPool.Spec.LeaseDuration
+		ipPool.Spec.Draining = existingIPPool.Spec.Draining
+		ipPool.Spec.Vacating = existingIPPool.Spec.Vacating
+		ipPool.Spec.ReclaimOnExhaustion = existingIPPool.Spec.ReclaimOnExhaustion
 		ipPool.ObjectMeta.ResourceVersion = existingIPPool.ObjectMeta.ResourceVersion
 
 		// Convert to unstructured again with updated data
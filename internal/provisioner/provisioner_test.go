@@ -0,0 +1,170 @@
+package provisioner
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// newTestProvisioner returns a provisioner on fake clients holding pools and
+// the Kubernetes objects, without GCE clients
+func newTestProvisioner(t *testing.T, pools []*v1alpha1.IPPool, objects ...runtime.Object) *Provisioner {
+	t.Helper()
+	var unstructuredPools []runtime.Object
+	for _, pool := range pools {
+		unstructuredPools = append(unstructuredPools, toUnstructured(t, pool))
+	}
+	return &Provisioner{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		dynamicClient: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{
+				ipam.IPPoolGVR:         "IPPoolList",
+				ipam.FloatingIPGVR:     "FloatingIPList",
+				ipam.PodIPMigrationGVR: "PodIPMigrationList",
+				ipam.NodeOnboardingGVR: "NodeOnboardingList",
+			}, unstructuredPools...),
+		kubeClient: kubefake.NewSimpleClientset(objects...),
+	}
+}
+
+func toUnstructured(t *testing.T, pool *v1alpha1.IPPool) *unstructured.Unstructured {
+	t.Helper()
+	pool = pool.DeepCopy()
+	pool.APIVersion, pool.Kind = v1alpha1.SchemeGroupVersion.String(), "IPPool"
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &unstructured.Unstructured{Object: obj}
+}
+
+// testPool returns the pool after the provisioner ran
+func testPool(t *testing.T, p *Provisioner, name string) *v1alpha1.IPPool {
+	t.Helper()
+	obj, err := p.dynamicClient.Resource(ipam.IPPoolGVR).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &v1alpha1.IPPool{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, pool); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// newProvisionTest returns a provisioner of cluster prod1 on fake GCE with
+// node-1 in testSubnetwork, whose plugin configuration is pluginConfig
+func newProvisionTest(t *testing.T, pluginConfig string, pools ...*v1alpha1.IPPool) (*Provisioner, *fakeGCE, *fakeInternalRanges) {
+	t.Helper()
+	t.Setenv(identity.EnvProject, testProject)
+	t.Setenv(identity.EnvZone, testZone)
+	t.Setenv(identity.EnvInstance, "node-1")
+
+	p := newTestProvisioner(t, pools, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "gcp-cni-config"},
+		Data:       map[string]string{config.ConfigMapKey: pluginConfig},
+	})
+	p.SetPluginConfigMap("kube-system", "gcp-cni-config")
+	if err := p.SetClusterID("prod1"); err != nil {
+		t.Fatal(err)
+	}
+	gce := newFakeGCE(t, p)
+	gce.addInstance("node-1", "")
+	gce.addSubnetwork(testSubnetwork, nil)
+	return p, gce, newFakeInternalRanges(t, p)
+}
+
+func TestProvisionNaming(t *testing.T) {
+	ctx := context.Background()
+	p, gce, internalRanges := newProvisionTest(t, `
+clusterID: prod1
+naming:
+  env: eu
+  pool: "{{.Env}}-{{.Subnetwork}}-pods"
+  secondaryRange: "{{.Env}}-{{.Range}}-{{.ClusterID}}"
+  internalRange: "ir-{{.Subnetwork}}-{{.Range}}"
+`)
+
+	rangeName := "live"
+	if err := p.Provision(ctx, &rangeName); err != nil {
+		t.Fatal(err)
+	}
+	internalRange := "projects/project/locations/global/internalRanges/ir-nodes-eu-live-prod1"
+	if got := internalRanges.names(); len(got) != 1 || got[0] != internalRange {
+		t.Errorf("internal ranges = %v, want %s", got, internalRange)
+	}
+	ranges := gce.secondaryRanges(testSubnetwork)
+	if reserved, ok := ranges["eu-live-prod1"]; !ok || reserved != "//networkconnectivity.googleapis.com/"+internalRange {
+		t.Errorf("secondary ranges = %v, want eu-live-prod1 reserved by %s", ranges, internalRange)
+	}
+	pool := testPool(t, p, "eu-nodes-pods")
+	if pool.Spec.SecondaryRangeName != "eu-live-prod1" || pool.Spec.CIDR != "10.100.0.0/16" {
+		t.Errorf("IPPool spec = %+v, want range eu-live-prod1 of 10.100.0.0/16", pool.Spec)
+	}
+
+	// Provisioning again finds the range and keeps the pool
+	if err := p.Provision(ctx, &rangeName); err != nil {
+		t.Fatal(err)
+	}
+	if got := gce.secondaryRanges(testSubnetwork); len(got) != 1 {
+		t.Errorf("secondary ranges after provisioning again = %v, want one", got)
+	}
+}
+
+func TestProvisionRenamed(t *testing.T) {
+	ctx := context.Background()
+	existing := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "ippool-nodes"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:               "10.100.0.0/16",
+			Subnet:             "projects/project/regions/europe-west1/subnetworks/nodes",
+			SecondaryRangeName: "live-prod1",
+		},
+	}
+	rangeName := "live"
+
+	p, gce, _ := newProvisionTest(t, `{"clusterID": "prod1", "naming": {"pool": "{{.Subnetwork}}-pods"}}`, existing)
+	if err := p.Provision(ctx, &rangeName); err == nil {
+		t.Error("Provision() with a renamed pool succeeded")
+	}
+	p, gce, _ = newProvisionTest(t, `{"clusterID": "prod1", "naming": {"secondaryRange": "pods-{{.Range}}-{{.ClusterID}}"}}`, existing)
+	if err := p.Provision(ctx, &rangeName); err == nil {
+		t.Error("Provision() with a renamed secondary range succeeded")
+	}
+	if got := gce.secondaryRanges(testSubnetwork); len(got) != 0 {
+		t.Errorf("secondary ranges = %v, want none created", got)
+	}
+}
+
+func TestProvisionConfigFallback(t *testing.T) {
+	ctx := context.Background()
+	rangeName := "live"
+
+	p, gce, _ := newProvisionTest(t, `{"clusterID": "prod1", "naming": {"pool": "{{.Unknown}}"}}`)
+	if err := p.Provision(ctx, &rangeName); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gce.secondaryRanges(testSubnetwork)["live-prod1"]; !ok {
+		t.Errorf("secondary ranges = %v, want the default live-prod1", gce.secondaryRanges(testSubnetwork))
+	}
+	testPool(t, p, "ippool-nodes")
+
+	p, _, _ = newProvisionTest(t, `{"clusterID": "prod2"}`)
+	if err := p.Provision(ctx, &rangeName); err == nil {
+		t.Error("Provision() with the plugin configuration of another cluster ID succeeded")
+	}
+}
@@ -16,8 +16,8 @@ const (
 	targetCidr                = "10.0.0.0/8"
 )
 
-// Auto allocate an internal IP range reservation
-func allocateInternalRange(ctx context.Context, internalRangesClient *networkconnectivity.InternalRangeClient, c *clusterInfo, addressName string, logger *slog.Logger) (string, error) {
+// Auto allocate an internal IP range reservation outside excludeCIDRs
+func allocateInternalRange(ctx context.Context, internalRangesClient *networkconnectivity.InternalRangeClient, c *clusterInfo, addressName string, excludeCIDRs []string, logger *slog.Logger) (string, error) {
 	parent := fmt.Sprintf("projects/%s/locations/global", c.projectID)
 	resourceName := fmt.Sprintf("%s/internalRanges/%s", parent, addressName)
 
@@ -44,18 +44,20 @@ func allocateInternalRange(ctx context.Context, internalRangesClient *networkcon
 		slog.String("name", addressName),
 		slog.Int("prefix_length", internalRangePrefixLength),
 		slog.String("network", c.networkName),
+		slog.Any("exclude_cidrs", excludeCIDRs),
 	)
 
 	// Build the network URL
 	networkURL := fmt.Sprintf("projects/%s/global/networks/%s", c.projectID, c.networkName)
 
 	internalRange := &networkconnectivitypb.InternalRange{
-		Name:            addressName,
-		Network:         networkURL,
-		PrefixLength:    int32(internalRangePrefixLength),
-		TargetCidrRange: []string{targetCidr},
-		Usage:           networkconnectivitypb.InternalRange_FOR_VPC,
-		Description:     "Reserved internal IP range for GCP CNI",
+		Name:              addressName,
+		Network:           networkURL,
+		PrefixLength:      int32(internalRangePrefixLength),
+		TargetCidrRange:   []string{targetCidr},
+		ExcludeCidrRanges: excludeCIDRs,
+		Usage:             networkconnectivitypb.InternalRange_FOR_VPC,
+		Description:       "Reserved internal IP range for GCP CNI",
 	}
 
 	op, err := internalRangesClient.CreateInternalRange(ctx, &networkconnectivitypb.CreateInternalRangeRequest{
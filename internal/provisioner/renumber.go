@@ -0,0 +1,147 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// RunRenumberController moves pods off draining pools and ranges every
+// interval until ctx is done. Pods keep their IP for life, so they are evicted
+// and come back with an IP from the ranges and pools still taking
+// allocations. Evictions go through the Eviction API, so PodDisruptionBudgets
+// are honored, and at most maxUnavailable pods holding draining IPs are
+// terminating at any time. With dryRun the evictions are only logged.
+func (p *Provisioner) RunRenumberController(ctx context.Context, interval time.Duration, maxUnavailable int, dryRun bool) error {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting renumbering controller",
+		slog.Duration("interval", interval),
+		slog.Int("max_unavailable", maxUnavailable),
+		slog.Bool("dry_run", dryRun),
+	)
+
+	for {
+		if err := p.renumber(ctx, allocator, maxUnavailable, dryRun); err != nil {
+			p.logger.Error("Renumbering failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainingPod is a pod holding an IP that has to move
+type drainingPod struct {
+	pool string
+	ip   string
+	v1alpha1.IPAllocation
+}
+
+func (p *Provisioner) renumber(ctx context.Context, allocator *ipam.Allocator, maxUnavailable int, dryRun bool) error {
+	if p.frozen(ctx, allocator) {
+		return nil
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+
+	var pending []drainingPod
+	for _, pool := range pools {
+		if pool.Spec.Class != "" && pool.Spec.Class != v1alpha1.PoolClassPod {
+			continue
+		}
+		allocations, err := allocator.DrainingPodAllocations(ctx, pool.Name)
+		if err != nil {
+			p.logger.Error("Failed to list draining allocations", slog.String("pool", pool.Name), slog.String("error", err.Error()))
+			continue
+		}
+		for ip, allocation := range allocations {
+			pending = append(pending, drainingPod{pool: pool.Name, ip: ip, IPAllocation: allocation})
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Oldest allocations move first, so repeated runs make steady progress
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].AllocatedAt.Before(&pending[j].AllocatedAt)
+	})
+
+	var evict []drainingPod
+	unavailable := 0
+	for _, d := range pending {
+		pod, err := p.kubeClient.CoreV1().Pods(d.PodNamespace).Get(ctx, d.PodName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// Released by the pod's DEL, or reclaimed by the lease garbage collector
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("get pod %s/%s: %w", d.PodNamespace, d.PodName, err)
+		}
+		if string(pod.UID) != d.PodUID {
+			continue
+		}
+		if pod.DeletionTimestamp != nil {
+			unavailable++
+			continue
+		}
+		evict = append(evict, d)
+	}
+
+	p.logger.Info("Renumbering draining allocations",
+		slog.Int("pending", len(pending)),
+		slog.Int("terminating", unavailable),
+	)
+
+	for _, d := range evict {
+		if unavailable >= maxUnavailable {
+			break
+		}
+
+		attrs := []any{
+			slog.String("pod", fmt.Sprintf("%s/%s", d.PodNamespace, d.PodName)),
+			slog.String("pool", d.pool),
+			slog.String("ip", d.ip),
+		}
+		if dryRun {
+			p.logger.Info("Would evict pod holding draining IP", attrs...)
+			unavailable++
+			continue
+		}
+
+		err := p.kubeClient.PolicyV1().Evictions(d.PodNamespace).Evict(ctx, &policyv1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Name: d.PodName, Namespace: d.PodNamespace},
+		})
+		if apierrors.IsTooManyRequests(err) {
+			// Blocked by a PodDisruptionBudget, retried next run
+			p.logger.Debug("Eviction blocked by disruption budget", attrs...)
+			continue
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			p.logger.Error("Failed to evict pod holding draining IP", append(attrs, slog.String("error", err.Error()))...)
+			continue
+		}
+
+		p.logger.Info("Evicted pod holding draining IP", attrs...)
+		unavailable++
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestRenumber(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name + "-uid")}}
+	}
+	// allocation is made age minutes after start, older ones move first
+	allocation := func(name string, age int) v1alpha1.IPAllocation {
+		return v1alpha1.IPAllocation{
+			PodName: name, PodNamespace: "default", PodUID: name + "-uid", NodeName: "node-1",
+			AllocatedAt: metav1.NewTime(start.Add(time.Duration(age) * time.Minute)),
+		}
+	}
+	floating := allocation("floating", 0)
+	floating.FloatingIP = "fip"
+	newPool := func(draining bool) *v1alpha1.IPPool {
+		return &v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+			Spec: v1alpha1.IPPoolSpec{
+				CIDR:     "10.8.0.0/24",
+				Draining: draining,
+				SecondaryRanges: []v1alpha1.SecondaryRange{
+					{Name: "old", CIDR: "10.8.0.0/25", Draining: true},
+					{Name: "new", CIDR: "10.8.0.128/25"},
+				},
+				Allocations: map[string]v1alpha1.IPAllocation{
+					"10.8.0.2":   allocation("second", 2),
+					"10.8.0.3":   allocation("oldest", 1),
+					"10.8.0.4":   allocation("terminating", 3),
+					"10.8.0.5":   allocation("replaced", 0),
+					"10.8.0.6":   allocation("gone", 0),
+					"10.8.0.7":   floating,
+					"10.8.0.8":   allocation("third", 4),
+					"10.8.0.130": allocation("kept", 5),
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		poolDraining   bool
+		maxUnavailable int
+		dryRun         bool
+		// evictErr fails the eviction of the named pods
+		evictErr map[string]error
+		getErr   error
+		wantErr  bool
+		// wantEvicted are the pods evicted in order
+		wantEvicted []string
+	}{
+		{
+			name:           "in-use draining IPs move oldest first",
+			maxUnavailable: 3,
+			wantEvicted:    []string{"oldest", "second"},
+		},
+		{
+			name:           "terminating pods count against maxUnavailable",
+			maxUnavailable: 1,
+		},
+		{
+			name:           "whole pool draining",
+			poolDraining:   true,
+			maxUnavailable: 10,
+			wantEvicted:    []string{"oldest", "second", "third", "kept"},
+		},
+		{
+			name:           "dry run",
+			maxUnavailable: 3,
+			dryRun:         true,
+		},
+		{
+			name:           "eviction blocked by a disruption budget",
+			maxUnavailable: 3,
+			evictErr:       map[string]error{"oldest": apierrors.NewTooManyRequests("disruption budget", 0)},
+			wantEvicted:    []string{"second", "third"},
+		},
+		{
+			name:           "failed eviction",
+			maxUnavailable: 3,
+			evictErr:       map[string]error{"oldest": apierrors.NewInternalError(errors.New("etcd unavailable"))},
+			wantEvicted:    []string{"second", "third"},
+		},
+		{
+			name:           "pod gone before its eviction",
+			maxUnavailable: 3,
+			evictErr:       map[string]error{"oldest": apierrors.NewNotFound(corev1.Resource("pods"), "oldest")},
+			wantEvicted:    []string{"oldest", "second"},
+		},
+		{
+			name:           "pods unreadable",
+			maxUnavailable: 3,
+			getErr:         apierrors.NewInternalError(errors.New("etcd unavailable")),
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newPool(tt.poolDraining)
+			terminating := pod("terminating")
+			terminating.DeletionTimestamp, terminating.Finalizers = &metav1.Time{Time: start}, []string{"test"}
+			replaced := pod("replaced")
+			replaced.UID = "other-uid"
+			p := newTestProvisioner(t, []*v1alpha1.IPPool{pool},
+				pod("oldest"), pod("second"), pod("third"), terminating, replaced, pod("floating"), pod("kept"))
+			client := p.kubeClient.(*kubefake.Clientset)
+			var evicted []string
+			client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if action.GetSubresource() != "eviction" {
+					return false, nil, nil
+				}
+				name := action.(k8stesting.CreateAction).GetObject().(metav1.Object).GetName()
+				if err := tt.evictErr[name]; err != nil {
+					if apierrors.IsNotFound(err) {
+						evicted = append(evicted, name)
+					}
+					return true, nil, err
+				}
+				evicted = append(evicted, name)
+				return true, nil, nil
+			})
+			if tt.getErr != nil {
+				client.PrependReactor("get", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.getErr
+				})
+			}
+
+			err := p.renumber(context.Background(), ipam.NewAllocator(p.dynamicClient), tt.maxUnavailable, tt.dryRun)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renumber() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(evicted, tt.wantEvicted) {
+				t.Errorf("evicted %v, want %v", evicted, tt.wantEvicted)
+			}
+
+			// The IPs stay allocated until the DEL of the evicted pods, whatever the outcome
+			got := testPool(t, p, "pool")
+			if len(got.Spec.Allocations) != len(pool.Spec.Allocations) {
+				t.Errorf("allocations = %v, want all %d kept for their pods", got.Spec.Allocations, len(pool.Spec.Allocations))
+			}
+			for ip, allocation := range pool.Spec.Allocations {
+				if got.Spec.Allocations[ip].PodUID != allocation.PodUID {
+					t.Errorf("allocation of %s = %+v, want %+v", ip, got.Spec.Allocations[ip], allocation)
+				}
+			}
+		})
+	}
+}
+
+// A pod whose eviction failed is evicted on the next run, once the failure is gone
+func TestRenumberRetriesFailedEviction(t *testing.T) {
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:     "10.8.0.0/24",
+			Draining: true,
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.2": {PodName: "web", PodNamespace: "default", PodUID: "web-uid", NodeName: "node-1"},
+			},
+		},
+	}
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{pool},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "web-uid"}})
+	attempts := 0
+	p.kubeClient.(*kubefake.Clientset).PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		attempts++
+		if attempts == 1 {
+			return true, nil, apierrors.NewInternalError(errors.New("etcd unavailable"))
+		}
+		return true, nil, nil
+	})
+
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	for run := 0; run < 2; run++ {
+		if err := p.renumber(context.Background(), allocator, 1, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if attempts != 2 {
+		t.Errorf("eviction attempts = %d, want the failed one retried on the next run", attempts)
+	}
+	if _, ok := testPool(t, p, "pool").Spec.Allocations["10.8.0.2"]; !ok {
+		t.Error("IP of the pod released before its DEL")
+	}
+}
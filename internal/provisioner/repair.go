@@ -0,0 +1,184 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// Outcomes of a repair recorded on the drift
+const (
+	repairPlanned  = "Planned"
+	repairDone     = "Repaired"
+	repairSkipped  = "Skipped"
+	repairFailed   = "Failed"
+	repairDeferred = "Deferred"
+)
+
+// Repair fixes the orphaned allocations, orphaned aliases and unallocated pod
+// IPs of the report, at most limit of them, and records the outcome on each
+// drift. Every drift is checked again right before it is fixed, since the
+// report is a snapshot and pods start and stop meanwhile. With dryRun the
+// repairs are only logged. Other drift kinds are left to the operator.
+func (p *Provisioner) Repair(ctx context.Context, projectID string, report *ipam.DriftReport, limit int, dryRun bool) {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	if !dryRun && p.frozen(ctx, allocator) {
+		return
+	}
+
+	repaired := 0
+	for i := range report.Drifts {
+		drift := &report.Drifts[i]
+		if !autoRepairable(drift.Kind) || drift.Repair == ipam.RepairManual {
+			continue
+		}
+		if repaired >= limit {
+			drift.Outcome = repairDeferred
+			continue
+		}
+		repaired++
+
+		logger := p.logger.With(
+			slog.String("kind", string(drift.Kind)),
+			slog.String("pool", drift.Pool),
+			slog.String("ip", drift.IP),
+			slog.String("repair", string(drift.Repair)),
+			slog.Bool("dry_run", dryRun),
+		)
+		if dryRun {
+			drift.Outcome = repairPlanned
+			logger.Info("Would repair IP state drift", slog.String("detail", drift.Detail))
+			continue
+		}
+
+		fixed, err := p.repairDrift(ctx, allocator, projectID, drift)
+		switch {
+		case err != nil:
+			drift.Outcome = repairFailed + ": " + err.Error()
+			logger.Error("Failed to repair IP state drift", slog.String("error", err.Error()))
+			p.emitRepairEvent(ctx, drift, corev1.EventTypeWarning, "DriftRepairFailed",
+				fmt.Sprintf("%s of %s (%s) failed: %v", drift.Repair, drift.IP, drift.Kind, err))
+		case !fixed:
+			drift.Outcome = repairSkipped
+			logger.Info("IP state drift resolved itself, nothing to repair")
+		default:
+			drift.Outcome = repairDone
+			logger.Info("Repaired IP state drift")
+			p.emitRepairEvent(ctx, drift, corev1.EventTypeNormal, "DriftRepaired",
+				fmt.Sprintf("%s of %s: %s", drift.Repair, drift.IP, drift.Detail))
+		}
+	}
+}
+
+func autoRepairable(kind ipam.DriftKind) bool {
+	switch kind {
+	case ipam.DriftOrphanAllocation, ipam.DriftOrphanAlias, ipam.DriftUnallocatedPodIP:
+		return true
+	}
+	return false
+}
+
+// repairDrift applies the repair of a single drift and reports whether there
+// was still something to fix
+func (p *Provisioner) repairDrift(ctx context.Context, allocator *ipam.Allocator, projectID string, drift *ipam.Drift) (bool, error) {
+	switch drift.Kind {
+	case ipam.DriftOrphanAllocation:
+		// Released, taken over by another pod or node, or protected since
+		// the report. Only the alias of the orphan itself may be detached.
+		allocation, allocated, err := allocator.AllocationOf(ctx, drift.Pool, drift.IP)
+		if err != nil || !allocated || allocation.Protected ||
+			allocation.PodUID != drift.PodUID || allocation.NodeName != drift.Node {
+			return false, err
+		}
+		// The alias goes first, so the IP is never handed out while still attached
+		if err := p.removeAliasIP(ctx, projectID, drift.Node, drift.IP); err != nil {
+			return false, err
+		}
+		return allocator.ReleaseIfOwner(ctx, drift.Pool, drift.IP, drift.PodUID)
+
+	case ipam.DriftOrphanAlias:
+		// An ADD allocates before it attaches, an allocation now means the alias is in use
+		_, allocated, err := allocator.AllocationOf(ctx, drift.Pool, drift.IP)
+		if err != nil || allocated {
+			return false, err
+		}
+		return true, p.removeAliasIP(ctx, projectID, drift.Instance, drift.IP)
+
+	case ipam.DriftUnallocatedPodIP:
+		namespace, name, _ := cutPodRef(drift.Pod)
+		pod, err := p.kubeClient.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("get pod %s: %w", drift.Pod, err)
+		}
+		if string(pod.UID) != drift.PodUID || pod.DeletionTimestamp != nil || pod.Status.PodIP != drift.IP {
+			return false, nil
+		}
+		_, allocated, err := allocator.AllocationOf(ctx, drift.Pool, drift.IP)
+		if err != nil || allocated {
+			return false, err
+		}
+		_, err = allocator.Allocate(ctx, &ipam.AllocationRequest{
+			PoolName:     drift.Pool,
+			PodName:      pod.Name,
+			PodNamespace: pod.Namespace,
+			PodUID:       string(pod.UID),
+			NodeName:     pod.Spec.NodeName,
+			RequestedIP:  drift.IP,
+		})
+		return err == nil, err
+	}
+	return false, fmt.Errorf("no automatic repair for %s", drift.Kind)
+}
+
+// emitRepairEvent records a repair on the pod it concerns, or on the pool
+func (p *Provisioner) emitRepairEvent(ctx context.Context, drift *ipam.Drift, eventType, reason, message string) {
+	ref := corev1.ObjectReference{
+		APIVersion: v1alpha1.SchemeGroupVersion.String(),
+		Kind:       "IPPool",
+		Name:       drift.Pool,
+	}
+	if namespace, name, ok := cutPodRef(drift.Pod); ok && drift.Kind == ipam.DriftUnallocatedPodIP {
+		ref = corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  namespace,
+			Name:       name,
+			UID:        types.UID(drift.PodUID),
+		}
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	now := metav1.Now()
+	_, err := p.kubeClient.CoreV1().Events(namespace).Create(ctx, &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: ref.Name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: ref,
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: "gcp-cni-provisioner"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		p.logger.Error("Failed to emit repair event", slog.String("reason", reason), slog.String("error", err.Error()))
+	}
+}
+
+func cutPodRef(ref string) (string, string, bool) {
+	return strings.Cut(ref, "/")
+}
@@ -0,0 +1,72 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestRepairOrphanAllocation(t *testing.T) {
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/24",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.2": {PodName: "gone", PodNamespace: "default", PodUID: "gone-uid", NodeName: "node-1"},
+				// Released and handed to a new pod after the report
+				"10.8.0.3": {PodName: "new", PodNamespace: "default", PodUID: "new-uid", NodeName: "node-1"},
+				// Released and handed to a pod of another node after the report
+				"10.8.0.4": {PodName: "moved", PodNamespace: "default", PodUID: "moved-uid", NodeName: "node-2"},
+			},
+		},
+	}
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{pool})
+	gce := newFakeGCE(t, p)
+	gce.addInstance("node-1", "pods", "10.8.0.2", "10.8.0.3")
+	gce.addInstance("node-2", "pods", "10.8.0.4")
+
+	orphan := func(ip, podUID string) ipam.Drift {
+		return ipam.Drift{
+			Kind:   ipam.DriftOrphanAllocation,
+			Repair: ipam.RepairReleaseIP,
+			Pool:   "pool",
+			IP:     ip,
+			Node:   "node-1",
+			Pod:    "default/old",
+			PodUID: podUID,
+		}
+	}
+	report := &ipam.DriftReport{Drifts: []ipam.Drift{
+		orphan("10.8.0.3", "old-uid"),
+		orphan("10.8.0.4", "moved-uid"),
+		orphan("10.8.0.5", "released-uid"),
+		orphan("10.8.0.2", "gone-uid"),
+	}}
+	p.Repair(context.Background(), testProject, report, 10, false)
+
+	want := []string{repairSkipped, repairSkipped, repairSkipped, repairDone}
+	for i, drift := range report.Drifts {
+		if drift.Outcome != want[i] {
+			t.Errorf("outcome of %s = %q, want %q", drift.IP, drift.Outcome, want[i])
+		}
+	}
+	allocations := testPool(t, p, "pool").Spec.Allocations
+	if _, ok := allocations["10.8.0.2"]; ok {
+		t.Error("orphaned allocation was not released")
+	}
+	for _, ip := range []string{"10.8.0.3", "10.8.0.4"} {
+		if _, ok := allocations[ip]; !ok {
+			t.Errorf("allocation of %s taken over since the report was released", ip)
+		}
+	}
+	if got := gce.aliases("node-1"); len(got) != 1 || got[0] != "10.8.0.3/32" {
+		t.Errorf("aliases of node-1 = %v, want only the new pod's", got)
+	}
+	if got := gce.updateCount("node-2"); got != 0 {
+		t.Errorf("node-2 got %d network interface updates, want none", got)
+	}
+}
@@ -0,0 +1,54 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// PlanRestore plans restoring the pools of backup, or only those named in
+// poolNames, checking their allocations against the live pools and the alias
+// IPs attached to the instances of the project
+func (p *Provisioner) PlanRestore(ctx context.Context, projectID string, backup *ipam.Backup, poolNames []string) ([]*ipam.RestorePlan, error) {
+	pools, err := ipam.NewAllocator(p.dynamicClient).ListPools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	attached, err := p.attachedIPs(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []*ipam.RestorePlan
+	for i := range backup.Pools {
+		pool := &backup.Pools[i]
+		if len(poolNames) > 0 && !slices.Contains(poolNames, pool.Name) {
+			continue
+		}
+		var live *v1alpha1.IPPool
+		if j := slices.IndexFunc(pools, func(l v1alpha1.IPPool) bool { return l.Name == pool.Name }); j >= 0 {
+			live = &pools[j]
+		}
+		plans = append(plans, ipam.PlanRestore(pool, live, attached))
+	}
+	for _, name := range poolNames {
+		if !slices.ContainsFunc(plans, func(plan *ipam.RestorePlan) bool { return plan.Pool == name }) {
+			return nil, fmt.Errorf("IPPool %s is not in the backup", name)
+		}
+	}
+	return plans, nil
+}
+
+// Restore writes the allocations of plans back to their pools
+func (p *Provisioner) Restore(ctx context.Context, plans []*ipam.RestorePlan) error {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	for _, plan := range plans {
+		if err := allocator.Restore(ctx, plan); err != nil {
+			return fmt.Errorf("restore IPPool %s: %w", plan.Pool, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+)
+
+// serviceRangeMessage is how the API server names the service IP range when
+// asked for a cluster IP outside it
+var serviceRangeMessage = regexp.MustCompile(`range of valid IPs is (\S+)`)
+
+// serviceProbeIP is a documentation address (RFC 5737) no service range uses
+const serviceProbeIP = "192.0.2.1"
+
+// SetProfile sets the distribution of the cluster and an explicit service
+// CIDR. Outside GKE the service range is unknown to the VPC, so new pod
+// ranges have to stay clear of it.
+func (p *Provisioner) SetProfile(profile config.Profile, serviceCIDR string) {
+	p.profile = profile
+	p.serviceCIDR = serviceCIDR
+}
+
+// serviceCIDRs returns the service IP ranges new pod ranges must not overlap,
+// none when they are ranges of the VPC anyway
+func (p *Provisioner) serviceCIDRs(ctx context.Context) ([]string, error) {
+	if p.serviceCIDR != "" {
+		return []string{p.serviceCIDR}, nil
+	}
+	if p.profile.ServiceCIDR == "" {
+		return nil, nil
+	}
+
+	cidr, source, err := p.discoverServiceCIDR(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.logger.Info("Discovered service CIDR", slog.String("cidr", cidr), slog.String("source", source))
+	return []string{cidr}, nil
+}
+
+// discoverServiceCIDR asks the ServiceCIDR API, then the API server through a
+// dry-run Service, and falls back to the default range of the profile if the
+// kubernetes Service is in it
+func (p *Provisioner) discoverServiceCIDR(ctx context.Context) (string, string, error) {
+	// GA in Kubernetes 1.33, beta and disabled by default before
+	serviceCIDR, err := p.kubeClient.NetworkingV1beta1().ServiceCIDRs().Get(ctx, "kubernetes", metav1.GetOptions{})
+	if err == nil && len(serviceCIDR.Spec.CIDRs) > 0 {
+		return serviceCIDR.Spec.CIDRs[0], "ServiceCIDR", nil
+	}
+
+	_, err = p.kubeClient.CoreV1().Services(metav1.NamespaceDefault).Create(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "gcp-cni-service-cidr-probe-"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: serviceProbeIP,
+			Ports:     []corev1.ServicePort{{Port: 443}},
+		},
+	}, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	if err != nil {
+		if match := serviceRangeMessage.FindStringSubmatch(err.Error()); match != nil {
+			if _, perr := netip.ParsePrefix(match[1]); perr == nil {
+				return match[1], "API server", nil
+			}
+		}
+	}
+
+	kubernetesService, err := p.kubeClient.CoreV1().Services(metav1.NamespaceDefault).Get(ctx, "kubernetes", metav1.GetOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("get kubernetes service: %w", err)
+	}
+	prefix := netip.MustParsePrefix(p.profile.ServiceCIDR)
+	if ip, err := netip.ParseAddr(kubernetesService.Spec.ClusterIP); err == nil && prefix.Contains(ip) {
+		return p.profile.ServiceCIDR, "profile", nil
+	}
+	return "", "", fmt.Errorf("service CIDR not found, cluster IP %s of the kubernetes service is outside the profile default %s, pass --service-cidr",
+		kubernetesService.Spec.ClusterIP, p.profile.ServiceCIDR)
+}
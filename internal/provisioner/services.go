@@ -0,0 +1,121 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// ServicePoolAnnotation selects the Service class IPPool a LoadBalancer
+// Service gets its stable internal IP from
+const ServicePoolAnnotation = "gcp-cni.cast.ai/ip-pool"
+
+// RunServiceIPController assigns stable internal IPs from Service class pools
+// to annotated LoadBalancer Services every interval until ctx is done. The IP
+// is written to spec.loadBalancerIP for the internal load balancer to pick
+// up, and released once the Service is gone or no longer annotated.
+func (p *Provisioner) RunServiceIPController(ctx context.Context, interval time.Duration) error {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting Service IP controller", slog.Duration("interval", interval))
+
+	for {
+		if err := p.reconcileServiceIPs(ctx, allocator); err != nil {
+			p.logger.Error("Service IP reconciliation failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) reconcileServiceIPs(ctx context.Context, allocator *ipam.Allocator) error {
+	// Existing reservations are kept while frozen, new ones are refused by the allocator
+	p.frozen(ctx, allocator)
+
+	services, err := p.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list services: %w", err)
+	}
+
+	// Reservations are released per pool, only for Services that no longer claim them
+	alive := make(map[string]map[string]bool)
+	for i := range services.Items {
+		svc := &services.Items[i]
+		poolName := svc.Annotations[ServicePoolAnnotation]
+		if poolName == "" || svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		if alive[poolName] == nil {
+			alive[poolName] = make(map[string]bool)
+		}
+		alive[poolName][string(svc.UID)] = true
+
+		if err := p.assignServiceIP(ctx, allocator, poolName, svc); err != nil {
+			p.logger.Error("Failed to assign Service IP",
+				slog.String("service", fmt.Sprintf("%s/%s", svc.Namespace, svc.Name)),
+				slog.String("pool", poolName),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		if pool.Spec.Class != v1alpha1.PoolClassService {
+			continue
+		}
+		released, err := allocator.ReleaseServiceIPs(ctx, pool.Name, alive[pool.Name])
+		if err != nil {
+			p.logger.Error("Failed to release Service IPs", slog.String("pool", pool.Name), slog.String("error", err.Error()))
+			continue
+		}
+		if released > 0 {
+			p.logger.Info("Released Service IPs", slog.String("pool", pool.Name), slog.Int("count", released))
+		}
+	}
+	return nil
+}
+
+func (p *Provisioner) assignServiceIP(ctx context.Context, allocator *ipam.Allocator, poolName string, svc *corev1.Service) error {
+	ip, err := allocator.ReserveServiceIP(ctx, poolName, ipam.ServiceRef{
+		Namespace: svc.Namespace,
+		Name:      svc.Name,
+		UID:       string(svc.UID),
+	}, svc.Spec.LoadBalancerIP)
+	if err != nil {
+		return err
+	}
+
+	if ipam.CanonicalIP(svc.Spec.LoadBalancerIP) == ip {
+		return nil
+	}
+
+	updated := svc.DeepCopy()
+	updated.Spec.LoadBalancerIP = ip
+	if _, err := p.kubeClient.CoreV1().Services(svc.Namespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update service: %w", err)
+	}
+
+	p.logger.Info("Assigned Service IP",
+		slog.String("service", fmt.Sprintf("%s/%s", svc.Namespace, svc.Name)),
+		slog.String("pool", poolName),
+		slog.String("ip", ip),
+	)
+	return nil
+}
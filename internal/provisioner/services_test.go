@@ -0,0 +1,82 @@
+package provisioner
+
+import (
+	"cmp"
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestReconcileServiceIPs(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name           string
+		loadBalancerIP string
+		wantIP         string
+	}{
+		{name: "no IP set", wantIP: "10.20.0.2"},
+		{name: "IP of the pool", loadBalancerIP: "10.20.0.50", wantIP: "10.20.0.50"},
+		{name: "IP outside the pool", loadBalancerIP: "10.30.0.50"},
+		{name: "network address", loadBalancerIP: "10.20.0.0"},
+		{name: "broadcast address", loadBalancerIP: "10.20.0.255"},
+		{name: "vacating IP", loadBalancerIP: "10.20.0.130"},
+		{name: "not an IP", loadBalancerIP: "ilb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &v1alpha1.IPPool{
+				ObjectMeta: metav1.ObjectMeta{Name: "services"},
+				Spec: v1alpha1.IPPoolSpec{
+					CIDR:        "10.20.0.0/24",
+					Class:       v1alpha1.PoolClassService,
+					Vacating:    []string{"10.20.0.128/25"},
+					Allocations: map[string]v1alpha1.IPAllocation{},
+				},
+			}
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "ilb",
+					UID:         types.UID("svc-uid"),
+					Annotations: map[string]string{ServicePoolAnnotation: "services"},
+				},
+				Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, LoadBalancerIP: tt.loadBalancerIP},
+			}
+			p := newTestProvisioner(t, []*v1alpha1.IPPool{pool}, svc)
+
+			if err := p.reconcileServiceIPs(ctx, ipam.NewAllocator(p.dynamicClient)); err != nil {
+				t.Fatal(err)
+			}
+
+			var reserved []string
+			for ip, allocation := range testPool(t, p, "services").Spec.Allocations {
+				if allocation.ServiceUID == "svc-uid" {
+					reserved = append(reserved, ip)
+				}
+			}
+			if tt.wantIP == "" {
+				if len(reserved) != 0 {
+					t.Errorf("reserved %v for loadBalancerIP %q, want it refused", reserved, tt.loadBalancerIP)
+				}
+			} else if len(reserved) != 1 || reserved[0] != tt.wantIP {
+				t.Errorf("reserved %v, want %s", reserved, tt.wantIP)
+			}
+
+			updated, err := p.kubeClient.CoreV1().Services("default").Get(ctx, "ilb", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A refused IP is left on the Service for its owner to fix
+			if want := cmp.Or(tt.wantIP, tt.loadBalancerIP); updated.Spec.LoadBalancerIP != want {
+				t.Errorf("loadBalancerIP = %q, want %q", updated.Spec.LoadBalancerIP, want)
+			}
+		})
+	}
+}
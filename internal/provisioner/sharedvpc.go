@@ -0,0 +1,88 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	networkconnectivity "cloud.google.com/go/networkconnectivity/apiv1"
+	"google.golang.org/api/option"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/identity"
+)
+
+// SetSharedVPC makes subnetwork, internal range, route and firewall calls
+// target the host project of a Shared VPC, as its service account if one is
+// set, while instances are changed in the project of their node
+func (p *Provisioner) SetSharedVPC(ctx context.Context, sharedVPC config.SharedVPC) error {
+	p.sharedVPC = sharedVPC
+	if sharedVPC.ServiceAccount == "" {
+		return nil
+	}
+
+	ts, err := identity.ImpersonatedTokenSource(ctx, sharedVPC.ServiceAccount)
+	if err != nil {
+		return err
+	}
+	computeOptions := append(identity.FromEnv().ComputeOptions(), option.WithTokenSource(ts))
+
+	if p.subnetworkClient, err = compute.NewSubnetworksRESTClient(ctx, computeOptions...); err != nil {
+		return fmt.Errorf("create host project subnetworks client: %w", err)
+	}
+	if p.routesClient, err = compute.NewRoutesRESTClient(ctx, computeOptions...); err != nil {
+		return fmt.Errorf("create host project routes client: %w", err)
+	}
+	if p.firewallsClient, err = compute.NewFirewallsRESTClient(ctx, computeOptions...); err != nil {
+		return fmt.Errorf("create host project firewalls client: %w", err)
+	}
+	if p.internalRangeClient, err = networkconnectivity.NewInternalRangeClient(ctx, option.WithTokenSource(ts)); err != nil {
+		return fmt.Errorf("create host project internal ranges client: %w", err)
+	}
+	return nil
+}
+
+// networkProject returns the project the subnetworks and routes of the VPC
+// live in
+func (p *Provisioner) networkProject(projectID string) string {
+	return p.sharedVPC.NetworkProject(projectID)
+}
+
+// instanceProject returns the project of the instance of a node, taken from
+// the provider ID of the node. Without a Shared VPC, or for instances that are
+// not nodes, it is projectID.
+func (p *Provisioner) instanceProject(ctx context.Context, projectID, nodeName string) string {
+	if p.sharedVPC.HostProject == "" {
+		return projectID
+	}
+	node, err := p.kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return projectID
+	}
+	project, _, _, err := identity.ParseProviderID(node.Spec.ProviderID)
+	if err != nil {
+		return projectID
+	}
+	return project
+}
+
+// instanceProjects returns the projects the instances of the cluster run in,
+// projectID first
+func (p *Provisioner) instanceProjects(ctx context.Context, projectID string) ([]string, error) {
+	projects := []string{projectID}
+	if p.sharedVPC.HostProject == "" {
+		return projects, nil
+	}
+	nodes, err := p.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	for _, node := range nodes.Items {
+		if project, _, _, err := identity.ParseProviderID(node.Spec.ProviderID); err == nil && !slices.Contains(projects, project) {
+			projects = append(projects, project)
+		}
+	}
+	return projects, nil
+}
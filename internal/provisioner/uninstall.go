@@ -0,0 +1,140 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// RunUninstallController moves the pods holding IPs off the nodes gcp-ipam is
+// being uninstalled from, marked with the ipam.UninstallTaint by their
+// installer, every interval until ctx is done. The installer reverts the node
+// to host-local once they are gone. Like renumbering, evictions go through the
+// Eviction API and at most maxUnavailable of these pods are terminating at any
+// time. The node drain controller releases the IPs of the evicted pods whose
+// DEL did not.
+func (p *Provisioner) RunUninstallController(ctx context.Context, interval time.Duration, maxUnavailable int) error {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting uninstall controller",
+		slog.Duration("interval", interval),
+		slog.Int("max_unavailable", maxUnavailable),
+	)
+
+	for {
+		if err := p.evictUninstalling(ctx, allocator, maxUnavailable); err != nil {
+			p.logger.Error("Evicting pods of uninstalling nodes failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) evictUninstalling(ctx context.Context, allocator *ipam.Allocator, maxUnavailable int) error {
+	nodes, err := p.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list nodes: %w", err)
+	}
+	uninstalling := map[string]bool{}
+	for _, node := range nodes.Items {
+		if nodeUninstalling(&node) {
+			uninstalling[node.Name] = true
+		}
+	}
+	if len(uninstalling) == 0 || p.frozen(ctx, allocator) {
+		return nil
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return err
+	}
+	var pending []drainingPod
+	for _, pool := range pools {
+		for ip, allocation := range pool.Spec.Allocations {
+			if uninstalling[allocation.NodeName] && allocation.PodUID != "" && allocation.FloatingIP == "" {
+				pending = append(pending, drainingPod{pool: pool.Name, ip: ip, IPAllocation: allocation})
+			}
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].AllocatedAt.Before(&pending[j].AllocatedAt)
+	})
+
+	var evict []drainingPod
+	unavailable := 0
+	for _, d := range pending {
+		pod, err := p.kubeClient.CoreV1().Pods(d.PodNamespace).Get(ctx, d.PodName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("get pod %s/%s: %w", d.PodNamespace, d.PodName, err)
+		}
+		if string(pod.UID) != d.PodUID {
+			continue
+		}
+		if pod.DeletionTimestamp != nil {
+			unavailable++
+			continue
+		}
+		evict = append(evict, d)
+	}
+	if len(evict) == 0 {
+		return nil
+	}
+
+	p.logger.Info("Evicting pods of uninstalling nodes",
+		slog.Int("pending", len(evict)),
+		slog.Int("terminating", unavailable),
+	)
+	for _, d := range evict {
+		if unavailable >= maxUnavailable {
+			break
+		}
+		attrs := []any{
+			slog.String("pod", fmt.Sprintf("%s/%s", d.PodNamespace, d.PodName)),
+			slog.String("node", d.NodeName),
+			slog.String("ip", d.ip),
+		}
+
+		err := p.kubeClient.PolicyV1().Evictions(d.PodNamespace).Evict(ctx, &policyv1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Name: d.PodName, Namespace: d.PodNamespace},
+		})
+		if apierrors.IsTooManyRequests(err) {
+			p.logger.Debug("Eviction blocked by disruption budget", attrs...)
+			continue
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			p.logger.Error("Failed to evict pod of uninstalling node", append(attrs, slog.String("error", err.Error()))...)
+			continue
+		}
+
+		p.logger.Info("Evicted pod of uninstalling node", attrs...)
+		unavailable++
+	}
+	return nil
+}
+
+// nodeUninstalling reports whether gcp-ipam is being uninstalled from the node
+func nodeUninstalling(node *corev1.Node) bool {
+	return lo.ContainsBy(node.Spec.Taints, func(t corev1.Taint) bool {
+		return t.Key == ipam.UninstallTaint
+	})
+}
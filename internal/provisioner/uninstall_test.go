@@ -0,0 +1,77 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestEvictUninstalling(t *testing.T) {
+	now := time.Now()
+	allocation := func(name, node string, age time.Duration) v1alpha1.IPAllocation {
+		return v1alpha1.IPAllocation{
+			PodName:      name,
+			PodNamespace: "default",
+			PodUID:       name + "-uid",
+			NodeName:     node,
+			AllocatedAt:  metav1.NewTime(now.Add(-age)),
+		}
+	}
+	floating := allocation("floating", "uninstalling", 5*time.Hour)
+	floating.FloatingIP = "fip"
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/24",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.2": allocation("oldest", "uninstalling", 3*time.Hour),
+				"10.8.0.3": allocation("newest", "uninstalling", time.Hour),
+				"10.8.0.4": allocation("terminating", "uninstalling", 4*time.Hour),
+				"10.8.0.5": allocation("staying", "ready", 4*time.Hour),
+				"10.8.0.6": allocation("gone", "uninstalling", 4*time.Hour),
+				"10.8.0.7": floating,
+			},
+		},
+	}
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name + "-uid")}}
+	}
+	terminating := pod("terminating")
+	terminating.DeletionTimestamp = &metav1.Time{Time: now}
+	terminating.Finalizers = []string{"test"}
+
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{pool},
+		&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "uninstalling"},
+			Spec:       corev1.NodeSpec{Taints: []corev1.Taint{{Key: ipam.UninstallTaint, Effect: corev1.TaintEffectNoSchedule}}},
+		},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "ready"}},
+		pod("oldest"), pod("newest"), terminating, pod("staying"), pod("floating"),
+	)
+	var evicted []string
+	p.kubeClient.(*kubefake.Clientset).PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		evicted = append(evicted, action.(k8stesting.CreateAction).GetObject().(metav1.Object).GetName())
+		return true, nil, nil
+	})
+
+	// One pod is already terminating, so only the oldest of the others fits
+	if err := p.evictUninstalling(context.Background(), ipam.NewAllocator(p.dynamicClient), 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 1 || evicted[0] != "oldest" {
+		t.Errorf("evicted %v, want the oldest pod of the uninstalling node only", evicted)
+	}
+}
@@ -0,0 +1,88 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// Vacate stops allocations from cidr, a slice of the ranges of the pool, and
+// reports what still holds IPs in it. With evict the pods holding them are
+// evicted through the Eviction API like the renumbering controller does, at
+// most maxUnavailable of them terminating at a time. Pods keep their IP for
+// life, so eviction is what frees it, a live migration would take the IP along.
+func (p *Provisioner) Vacate(ctx context.Context, poolName, cidr string, evict bool, maxUnavailable int) (*ipam.VacateReport, error) {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	report, err := allocator.SetVacating(ctx, poolName, cidr, true)
+	if err != nil {
+		return nil, err
+	}
+	if !evict {
+		return report, nil
+	}
+	if p.frozen(ctx, allocator) {
+		return nil, fmt.Errorf("allocations are frozen")
+	}
+
+	var pending []*ipam.SliceHolder
+	unavailable := 0
+	for i := range report.Holders {
+		h := &report.Holders[i]
+		allocation := h.Allocation
+		if allocation.PodUID == "" || allocation.FloatingIP != "" || allocation.Protected {
+			h.Outcome = ipam.VacateLeft
+			continue
+		}
+		pod, err := p.kubeClient.CoreV1().Pods(allocation.PodNamespace).Get(ctx, allocation.PodName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && string(pod.UID) != allocation.PodUID) {
+			// Released by the pod's DEL, or reclaimed by the lease garbage collector
+			h.Outcome = ipam.VacateLeft
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get pod %s/%s: %w", allocation.PodNamespace, allocation.PodName, err)
+		}
+		if pod.DeletionTimestamp != nil {
+			h.Outcome = ipam.VacateTerminating
+			unavailable++
+			continue
+		}
+		pending = append(pending, h)
+	}
+
+	for _, h := range pending {
+		if unavailable >= maxUnavailable {
+			break
+		}
+		allocation := h.Allocation
+		attrs := []any{
+			slog.String("pod", fmt.Sprintf("%s/%s", allocation.PodNamespace, allocation.PodName)),
+			slog.String("pool", poolName),
+			slog.String("ip", h.IP),
+		}
+
+		err := p.kubeClient.PolicyV1().Evictions(allocation.PodNamespace).Evict(ctx, &policyv1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Name: allocation.PodName, Namespace: allocation.PodNamespace},
+		})
+		if apierrors.IsTooManyRequests(err) {
+			h.Outcome = ipam.VacateBlocked
+			continue
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			p.logger.Error("Failed to evict pod holding vacating IP", append(attrs, slog.String("error", err.Error()))...)
+			h.Outcome = ipam.VacateFailed
+			continue
+		}
+
+		p.logger.Info("Evicted pod holding vacating IP", attrs...)
+		h.Outcome = ipam.VacateEvicted
+		unavailable++
+	}
+	return report, nil
+}
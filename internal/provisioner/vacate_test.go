@@ -0,0 +1,97 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestVacate(t *testing.T) {
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name + "-uid")}}
+	}
+	allocation := func(name string) v1alpha1.IPAllocation {
+		return v1alpha1.IPAllocation{PodName: name, PodNamespace: "default", PodUID: name + "-uid", NodeName: "node-1"}
+	}
+	floating, protected := allocation("floating"), allocation("protected")
+	floating.FloatingIP, protected.Protected = "fip", true
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/24",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.2":  allocation("first"),
+				"10.8.0.3":  allocation("terminating"),
+				"10.8.0.4":  allocation("blocked"),
+				"10.8.0.5":  allocation("second"),
+				"10.8.0.6":  floating,
+				"10.8.0.7":  protected,
+				"10.8.0.8":  allocation("gone"),
+				"10.8.0.9":  {NodeName: "node-1", Buffered: true},
+				"10.8.0.10": allocation("waiting"),
+				"10.8.0.20": allocation("outside"),
+			},
+		},
+	}
+	terminating := pod("terminating")
+	terminating.DeletionTimestamp = &metav1.Time{}
+	terminating.Finalizers = []string{"test"}
+	p := newTestProvisioner(t, []*v1alpha1.IPPool{pool},
+		pod("first"), terminating, pod("blocked"), pod("second"), pod("floating"), pod("protected"), pod("waiting"), pod("outside"))
+	var evicted []string
+	p.kubeClient.(*kubefake.Clientset).PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		name := action.(k8stesting.CreateAction).GetObject().(metav1.Object).GetName()
+		if name == "blocked" {
+			return true, nil, apierrors.NewTooManyRequests("disruption budget", 0)
+		}
+		evicted = append(evicted, name)
+		return true, nil, nil
+	})
+
+	report, err := p.Vacate(context.Background(), "pool", "10.8.0.0/28", true, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"10.8.0.2":  ipam.VacateEvicted,
+		"10.8.0.3":  ipam.VacateTerminating,
+		"10.8.0.4":  ipam.VacateBlocked,
+		"10.8.0.5":  ipam.VacateEvicted,
+		"10.8.0.6":  ipam.VacateLeft,
+		"10.8.0.7":  ipam.VacateLeft,
+		"10.8.0.8":  ipam.VacateLeft,
+		"10.8.0.10": "",
+	}
+	if len(report.Holders) != len(want) {
+		t.Errorf("holders = %+v, want %d of them", report.Holders, len(want))
+	}
+	for _, h := range report.Holders {
+		if outcome, ok := want[h.IP]; !ok || h.Outcome != outcome {
+			t.Errorf("outcome of %s = %q, want %q", h.IP, h.Outcome, outcome)
+		}
+	}
+	if len(evicted) != 2 {
+		t.Errorf("evicted %v, want 2 pods within maxUnavailable", evicted)
+	}
+
+	vacated := testPool(t, p, "pool")
+	if len(vacated.Spec.Vacating) != 1 || vacated.Spec.Vacating[0] != "10.8.0.0/28" {
+		t.Errorf("vacating slices = %v, want 10.8.0.0/28", vacated.Spec.Vacating)
+	}
+	if _, ok := vacated.Spec.Allocations["10.8.0.9"]; ok {
+		t.Error("IP buffered in the vacating slice was not released")
+	}
+}
@@ -0,0 +1,60 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+
+	"github.com/castai/gcp-cni/internal/validation"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// Validate checks the plugin configuration and the IPPools of the cluster
+// against each other, the secondary ranges of the pool subnetworks and
+// secondaryRangeName the provisioner provisions. stack carries the parts only
+// the caller knows, such as the conflist of the nodes.
+func (p *Provisioner) Validate(ctx context.Context, projectID string, stack validation.Stack) ([]validation.Finding, error) {
+	if stack.PluginConfig == nil {
+		cfg, err := p.pluginConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stack.PluginConfig = cfg
+	}
+	pools, err := ipam.NewAllocator(p.dynamicClient).ListPools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stack.Pools = pools
+
+	stack.Subnetworks = map[string]validation.Subnetwork{}
+	for _, pool := range pools {
+		project, region, name := ipam.ParseSubnetwork(pool.Spec.Subnet)
+		if _, ok := stack.Subnetworks[name]; ok || region == "" {
+			continue
+		}
+		if project == "" {
+			project = p.networkProject(projectID)
+		}
+		subnet, err := p.subnetworkClient.Get(ctx, &computepb.GetSubnetworkRequest{
+			Project:    project,
+			Region:     region,
+			Subnetwork: name,
+		})
+		if isNotFound(err) {
+			// Reported as missing by the validation
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get subnetwork %s: %w", name, err)
+		}
+		subnetwork := validation.Subnetwork{Name: name, SecondaryRanges: map[string]string{}}
+		for _, r := range subnet.GetSecondaryIpRanges() {
+			subnetwork.SecondaryRanges[r.GetRangeName()] = r.GetIpCidrRange()
+		}
+		stack.Subnetworks[name] = subnetwork
+	}
+
+	return validation.Validate(stack), nil
+}
@@ -0,0 +1,198 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/identity"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// RunVerifier checks IPPool allocations, the IPs attached to instances and
+// pod IPs for drift every interval until ctx is done, logging every drift it
+// finds. With a repairLimit above 0 it repairs up to that many drifts per
+// check, see Repair; with dryRun the repairs are only logged.
+func (p *Provisioner) RunVerifier(ctx context.Context, interval time.Duration, repairLimit int, dryRun bool) error {
+	projectID, err := identity.ProjectID(ctx)
+	if err != nil {
+		return fmt.Errorf("get project ID from metadata: %w", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting consistency verifier",
+		slog.Duration("interval", interval),
+		slog.Int("repair_limit", repairLimit),
+		slog.Bool("dry_run", dryRun),
+	)
+
+	for {
+		report, err := p.Verify(ctx, projectID)
+		if err != nil {
+			p.logger.Error("Consistency check failed", slog.String("error", err.Error()))
+		} else {
+			if repairLimit > 0 {
+				p.Repair(ctx, projectID, report, repairLimit, dryRun)
+			}
+			for _, drift := range report.Drifts {
+				p.logger.Warn("IP state drift",
+					slog.String("kind", string(drift.Kind)),
+					slog.String("pool", drift.Pool),
+					slog.String("ip", drift.IP),
+					slog.String("node", drift.Node),
+					slog.String("instance", drift.Instance),
+					slog.String("pod", drift.Pod),
+					slog.String("repair", string(drift.Repair)),
+					slog.String("detail", drift.Detail),
+					slog.String("outcome", drift.Outcome),
+				)
+			}
+			p.logger.Info("Consistency check completed",
+				slog.Int("pools", report.Pools),
+				slog.Int("attached", report.Attached),
+				slog.Int("pods", report.Pods),
+				slog.Int("drifts", len(report.Drifts)),
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Verify cross-checks the allocations of all IPPools against the IPs attached
+// to the instances of the project and the IPs of the pods in the cluster
+func (p *Provisioner) Verify(ctx context.Context, projectID string) (*ipam.DriftReport, error) {
+	allocator := ipam.NewAllocator(p.dynamicClient)
+	now := time.Now()
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := allocator.ListMigrations(ctx, metav1.NamespaceAll)
+	if err != nil {
+		return nil, err
+	}
+	migrating := map[string]bool{}
+	for i := range migrations {
+		if ipam.MigrationActive(&migrations[i]) {
+			migrating[migrations[i].Spec.IP] = true
+		}
+	}
+
+	attached, err := p.attachedIPs(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	podList, err := p.kubeClient.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list pods: %w", err)
+	}
+	pods := make([]ipam.PodIP, 0, len(podList.Items))
+	for _, pod := range podList.Items {
+		podIP := ipam.PodIP{
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			UID:       string(pod.UID),
+			Node:      pod.Spec.NodeName,
+		}
+		// Finished pods keep their IP in the status after the sandbox is gone
+		if !pod.Spec.HostNetwork && pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			podIP.IP = pod.Status.PodIP
+			podIP.AttachPending = aliasAttachPending(&pod)
+		}
+		pods = append(pods, podIP)
+	}
+
+	return &ipam.DriftReport{
+		GeneratedAt: now,
+		Pools:       len(pools),
+		Attached:    len(attached),
+		Pods:        len(pods),
+		Drifts:      ipam.Verify(pools, attached, pods, migrating),
+	}, nil
+}
+
+// aliasAttachPending reports whether pod waits for the installer to attach
+// its alias: it is gated on ipam.AliasAttachedCondition, which is not true yet
+func aliasAttachPending(pod *corev1.Pod) bool {
+	if !slices.ContainsFunc(pod.Spec.ReadinessGates, func(gate corev1.PodReadinessGate) bool {
+		return gate.ConditionType == ipam.AliasAttachedCondition
+	}) {
+		return false
+	}
+	return !slices.ContainsFunc(pod.Status.Conditions, func(c corev1.PodCondition) bool {
+		return c.Type == ipam.AliasAttachedCondition && c.Status == corev1.ConditionTrue
+	})
+}
+
+// attachedIPs lists the single address alias IP ranges of all instances in the
+// projects of the nodes and the routes the plugin programmed for pod IPs
+func (p *Provisioner) attachedIPs(ctx context.Context, projectID string) ([]ipam.AttachedIP, error) {
+	var attached []ipam.AttachedIP
+
+	projects, err := p.instanceProjects(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	for _, project := range projects {
+		instances := p.instancesClient.AggregatedList(ctx, &computepb.AggregatedListInstancesRequest{
+			Project: project,
+		})
+		for {
+			pair, err := instances.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("list instances of project %s: %w", project, err)
+			}
+			for _, instance := range pair.Value.GetInstances() {
+				for _, nic := range instance.GetNetworkInterfaces() {
+					for _, r := range nic.GetAliasIpRanges() {
+						if ip, ok := ipam.HostIP(r.GetIpCidrRange()); ok {
+							attached = append(attached, ipam.AttachedIP{IP: ip, Instance: instance.GetName()})
+						}
+					}
+				}
+			}
+		}
+	}
+
+	routes := p.routesClient.List(ctx, &computepb.ListRoutesRequest{
+		Project: p.networkProject(projectID),
+		Filter:  proto.String(`name eq "gcp-cni-.*"`),
+	})
+	for {
+		route, err := routes.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list routes: %w", err)
+		}
+		ip, ok := ipam.HostIP(route.GetDestRange())
+		if !ok || route.GetNextHopInstance() == "" {
+			continue
+		}
+		attached = append(attached, ipam.AttachedIP{IP: ip, Instance: path.Base(route.GetNextHopInstance()), Routed: true})
+	}
+	return attached, nil
+}
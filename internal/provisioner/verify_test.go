@@ -0,0 +1,34 @@
+package provisioner
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+func TestAliasAttachPending(t *testing.T) {
+	gated := corev1.PodSpec{ReadinessGates: []corev1.PodReadinessGate{{ConditionType: ipam.AliasAttachedCondition}}}
+	condition := func(status corev1.ConditionStatus) corev1.PodStatus {
+		return corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: ipam.AliasAttachedCondition, Status: status}}}
+	}
+
+	tests := []struct {
+		name string
+		pod  corev1.Pod
+		want bool
+	}{
+		{name: "not gated"},
+		{name: "gated without condition", pod: corev1.Pod{Spec: gated}, want: true},
+		{name: "attach failed", pod: corev1.Pod{Spec: gated, Status: condition(corev1.ConditionFalse)}, want: true},
+		{name: "attached", pod: corev1.Pod{Spec: gated, Status: condition(corev1.ConditionTrue)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aliasAttachPending(&tt.pod); got != tt.want {
+				t.Errorf("aliasAttachPending() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// RunWarmPoolController sizes the warm pool of every node, the IPs its
+// installer keeps buffered per pool and attached ahead of the pods taking
+// them, every interval until ctx is done. Pods scheduled to a node without an
+// IP yet grow the warm pool of that node, pods not scheduled yet grow those of
+// all ready nodes alike, so a burst of deployments finds IPs attached already
+// instead of waiting for GCE per pod. Sizes range from minSize to maxSize and
+// reach the installers through ipam.WarmIPsAnnotation on the node, draining
+// nodes get none.
+func (p *Provisioner) RunWarmPoolController(ctx context.Context, interval time.Duration, minSize, maxSize int) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.logger.Info("Starting warm pool controller",
+		slog.Duration("interval", interval),
+		slog.Int("min", minSize),
+		slog.Int("max", maxSize),
+	)
+
+	for {
+		if err := p.sizeWarmPools(ctx, minSize, maxSize); err != nil {
+			p.logger.Error("Warm pool sizing failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) sizeWarmPools(ctx context.Context, minSize, maxSize int) error {
+	nodes, err := p.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list nodes: %w", err)
+	}
+	pods, err := p.kubeClient.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase=Pending",
+	})
+	if err != nil {
+		return fmt.Errorf("list pending pods: %w", err)
+	}
+
+	waiting, unscheduled := pendingPods(pods.Items)
+	schedulable := func(node *corev1.Node) bool { return nodeReady(node) && !node.Spec.Unschedulable }
+	ready := 0
+	for i := range nodes.Items {
+		if schedulable(&nodes.Items[i]) {
+			ready++
+		}
+	}
+	spread := 0
+	if ready > 0 {
+		spread = (unscheduled + ready - 1) / ready
+	}
+
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		want := minSize + waiting[node.Name]
+		if schedulable(node) {
+			want += spread
+		}
+		want = max(minSize, min(want, maxSize))
+		if nodeDraining(node) {
+			// The installer returns the buffer before the instance goes away
+			want = 0
+		}
+
+		value := strconv.Itoa(want)
+		if node.Annotations[ipam.WarmIPsAnnotation] == value {
+			continue
+		}
+		patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": map[string]string{ipam.WarmIPsAnnotation: value}}})
+		if err != nil {
+			return fmt.Errorf("marshal warm pool patch: %w", err)
+		}
+		if _, err := p.kubeClient.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			p.logger.Error("Failed to resize warm pool",
+				slog.String("node", node.Name),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		p.logger.Info("Resized warm pool",
+			slog.String("node", node.Name),
+			slog.Int("size", want),
+			slog.Int("waiting", waiting[node.Name]),
+			slog.Int("unscheduled", unscheduled),
+		)
+	}
+	return nil
+}
+
+// pendingPods counts the pending pods needing a pod IP per node they are
+// scheduled to, and those not scheduled yet
+func pendingPods(pods []corev1.Pod) (map[string]int, int) {
+	waiting := map[string]int{}
+	unscheduled := 0
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Spec.HostNetwork || pod.DeletionTimestamp != nil || pod.Status.PodIP != "" {
+			continue
+		}
+		if pod.Spec.NodeName == "" {
+			unscheduled++
+			continue
+		}
+		waiting[pod.Spec.NodeName]++
+	}
+	return waiting, unscheduled
+}
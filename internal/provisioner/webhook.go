@@ -0,0 +1,160 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// maxReviewSize bounds the AdmissionReview bodies the webhook reads
+const maxReviewSize = 4 << 20
+
+// RunAdmissionWebhook serves the pod admission webhook on addr with the TLS
+// certificate and key in certFile and keyFile until ctx is done. Pods whose IP
+// annotations the plugin's ADD would fail on are rejected at creation, instead
+// of getting stuck in ContainerCreating on a node. Pods admitted through
+// /mutate-pods get PodCleanupFinalizer.
+func (p *Provisioner) RunAdmissionWebhook(ctx context.Context, addr, certFile, keyFile string) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           p.webhookHandler(ipam.NewAllocator(p.dynamicClient)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	p.logger.Info("Starting admission webhook", slog.String("address", addr))
+	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve admission webhook: %w", err)
+	}
+	return ctx.Err()
+}
+
+func (p *Provisioner) webhookHandler(allocator *ipam.Allocator) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate-pods", func(w http.ResponseWriter, r *http.Request) {
+		p.serveReview(w, r, func(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+			return p.validatePod(r.Context(), allocator, req)
+		})
+	})
+	mux.HandleFunc("/mutate-pods", func(w http.ResponseWriter, r *http.Request) {
+		p.serveReview(w, r, addCleanupFinalizer)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+func (p *Provisioner) serveReview(w http.ResponseWriter, r *http.Request, admit func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxReviewSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = admit(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		p.logger.Error("Failed to write admission response", slog.String("error", err.Error()))
+	}
+}
+
+func (p *Provisioner) validatePod(ctx context.Context, allocator *ipam.Allocator, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	allowed := &admissionv1.AdmissionResponse{Allowed: true}
+
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		return deny(fmt.Sprintf("decode pod: %v", err))
+	}
+	if !ipam.HasIPAnnotations(pod.Annotations) {
+		return allowed
+	}
+
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		// The plugin checks again at ADD, so an unavailable API must not block pod creation
+		p.logger.Error("Admitting pod without validating IP annotations",
+			slog.String("pod", fmt.Sprintf("%s/%s", req.Namespace, pod.Name)),
+			slog.String("error", err.Error()),
+		)
+		return allowed
+	}
+
+	if err := ipam.ValidatePodAnnotations(pools, pod.Annotations); err != nil {
+		p.logger.Info("Rejected pod with invalid IP annotations",
+			slog.String("pod", fmt.Sprintf("%s/%s", req.Namespace, pod.Name)),
+			slog.String("error", err.Error()),
+		)
+		return deny(err.Error())
+	}
+	return allowed
+}
+
+// addCleanupFinalizer adds PodCleanupFinalizer to pods that get their IP from
+// the plugin, so they are only gone once their IP is released and detached
+func addCleanupFinalizer(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	allowed := &admissionv1.AdmissionResponse{Allowed: true}
+
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		return deny(fmt.Sprintf("decode pod: %v", err))
+	}
+	if pod.Spec.HostNetwork || slices.Contains(pod.Finalizers, PodCleanupFinalizer) {
+		return allowed
+	}
+
+	patch := []map[string]any{{"op": "add", "path": "/metadata/finalizers", "value": []string{PodCleanupFinalizer}}}
+	if len(pod.Finalizers) > 0 {
+		patch = []map[string]any{{"op": "add", "path": "/metadata/finalizers/-", "value": PodCleanupFinalizer}}
+	}
+	raw, err := json.Marshal(patch)
+	if err != nil {
+		return deny(fmt.Sprintf("marshal finalizer patch: %v", err))
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	allowed.Patch = raw
+	allowed.PatchType = &patchType
+	return allowed
+}
+
+func deny(message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: message,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
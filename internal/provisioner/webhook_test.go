@@ -0,0 +1,222 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// review posts an AdmissionReview of pod to path and returns the response
+func review(t *testing.T, handler http.Handler, path string, pod *corev1.Pod) *admissionv1.AdmissionResponse {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("review-uid"),
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	got := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Response == nil || got.Response.UID != "review-uid" {
+		t.Fatalf("response = %+v, want one for review-uid", got.Response)
+	}
+	return got.Response
+}
+
+func TestValidatePods(t *testing.T) {
+	pools := []*v1alpha1.IPPool{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+			Spec: v1alpha1.IPPoolSpec{
+				CIDR:               "10.8.0.0/24",
+				SecondaryRangeName: "pods",
+				Allocations: map[string]v1alpha1.IPAllocation{
+					"10.8.0.5": {PodName: "source", PodNamespace: "default", PodUID: "source-uid"},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "services"},
+			Spec:       v1alpha1.IPPoolSpec{CIDR: "10.9.0.0/24", SecondaryRangeName: "services", Class: v1alpha1.PoolClassService},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		// poolsErr makes the pools unreadable
+		poolsErr    error
+		wantAllowed bool
+	}{
+		{name: "no IP annotations", annotations: map[string]string{"app": "web"}, wantAllowed: true},
+		{name: "migrated IP", annotations: map[string]string{ipam.LiveIPAnnotation: "10.8.0.5"}, wantAllowed: true},
+		{name: "migrated IP with its original instance", annotations: map[string]string{ipam.LiveIPAnnotation: "10.8.0.5", ipam.OriginalInstanceAnnotation: "node-1"}, wantAllowed: true},
+		{name: "original instance without an IP", annotations: map[string]string{ipam.OriginalInstanceAnnotation: "node-1"}},
+		{name: "IP not allocated", annotations: map[string]string{ipam.LiveIPAnnotation: "10.8.0.6"}},
+		{name: "IP outside every pod pool", annotations: map[string]string{ipam.LiveIPAnnotation: "10.9.0.5"}},
+		{name: "gateway IP", annotations: map[string]string{ipam.LiveIPAnnotation: "10.8.0.1"}},
+		{name: "malformed IP", annotations: map[string]string{ipam.LiveIPAnnotation: "10.8.0"}},
+		{name: "IPv6", annotations: map[string]string{ipam.LiveIPAnnotation: "fd00::5"}},
+		{name: "secondary range", annotations: map[string]string{ipam.SecondaryRangeAnnotation: "pods"}, wantAllowed: true},
+		{name: "unknown secondary range", annotations: map[string]string{ipam.SecondaryRangeAnnotation: "other"}},
+		{name: "secondary range of a service pool", annotations: map[string]string{ipam.SecondaryRangeAnnotation: "services"}},
+		{name: "empty secondary range", annotations: map[string]string{ipam.SecondaryRangeAnnotation: ""}},
+		{name: "IP count", annotations: map[string]string{ipam.IPCountAnnotation: "3"}, wantAllowed: true},
+		{name: "zero IPs", annotations: map[string]string{ipam.IPCountAnnotation: "0"}},
+		{name: "too many IPs", annotations: map[string]string{ipam.IPCountAnnotation: "17"}},
+		{name: "IP count not a number", annotations: map[string]string{ipam.IPCountAnnotation: "three"}},
+		{
+			name:        "pools unreadable",
+			annotations: map[string]string{ipam.LiveIPAnnotation: "10.8.0.6"},
+			poolsErr:    errors.New("API server unavailable"),
+			wantAllowed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvisioner(t, pools)
+			if tt.poolsErr != nil {
+				p.dynamicClient.(*dynamicfake.FakeDynamicClient).PrependReactor("list", "ippools", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.poolsErr
+				})
+			}
+			handler := p.webhookHandler(ipam.NewAllocator(p.dynamicClient))
+
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: tt.annotations}}
+			resp := review(t, handler, "/validate-pods", pod)
+			if resp.Allowed != tt.wantAllowed {
+				t.Errorf("allowed = %v, want %v: %+v", resp.Allowed, tt.wantAllowed, resp.Result)
+			}
+			if !resp.Allowed && (resp.Result == nil || resp.Result.Message == "" || resp.Result.Code != http.StatusUnprocessableEntity) {
+				t.Errorf("denial result = %+v, want a 422 with the reason", resp.Result)
+			}
+		})
+	}
+}
+
+func TestMutatePods(t *testing.T) {
+	tests := []struct {
+		name           string
+		hostNetwork    bool
+		finalizers     []string
+		wantFinalizers []string
+	}{
+		{name: "no finalizers", wantFinalizers: []string{PodCleanupFinalizer}},
+		{name: "other finalizers", finalizers: []string{"other"}, wantFinalizers: []string{"other", PodCleanupFinalizer}},
+		{name: "finalizer present", finalizers: []string{PodCleanupFinalizer}, wantFinalizers: []string{PodCleanupFinalizer}},
+		{name: "host network", hostNetwork: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvisioner(t, nil)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Finalizers: tt.finalizers},
+				Spec:       corev1.PodSpec{HostNetwork: tt.hostNetwork},
+			}
+			resp := review(t, p.webhookHandler(ipam.NewAllocator(p.dynamicClient)), "/mutate-pods", pod)
+			if !resp.Allowed {
+				t.Fatalf("pod denied: %+v", resp.Result)
+			}
+
+			finalizers := tt.finalizers
+			if resp.Patch != nil {
+				if resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch {
+					t.Fatalf("patch type = %v, want %s", resp.PatchType, admissionv1.PatchTypeJSONPatch)
+				}
+				finalizers = applyFinalizerPatch(t, finalizers, resp.Patch)
+			}
+			if !slices.Equal(finalizers, tt.wantFinalizers) {
+				t.Errorf("finalizers = %v, want %v", finalizers, tt.wantFinalizers)
+			}
+		})
+	}
+}
+
+// applyFinalizerPatch applies the finalizer operations of a JSON patch
+func applyFinalizerPatch(t *testing.T, finalizers []string, patch []byte) []string {
+	t.Helper()
+	var ops []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		t.Fatal(err)
+	}
+	finalizers = slices.Clone(finalizers)
+	for _, op := range ops {
+		switch {
+		case op.Op == "add" && op.Path == "/metadata/finalizers":
+			finalizers = nil
+			if err := json.Unmarshal(op.Value, &finalizers); err != nil {
+				t.Fatal(err)
+			}
+		case op.Op == "add" && op.Path == "/metadata/finalizers/-":
+			var finalizer string
+			if err := json.Unmarshal(op.Value, &finalizer); err != nil {
+				t.Fatal(err)
+			}
+			finalizers = append(finalizers, finalizer)
+		default:
+			t.Fatalf("unexpected patch operation %s %s", op.Op, op.Path)
+		}
+	}
+	return finalizers
+}
+
+func TestServeReviewRejectsMalformedRequests(t *testing.T) {
+	p := newTestProvisioner(t, nil)
+	handler := p.webhookHandler(ipam.NewAllocator(p.dynamicClient))
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+	}{
+		{name: "not a POST", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+		{name: "not JSON", method: http.MethodPost, body: "pod", wantStatus: http.StatusBadRequest},
+		{name: "no request", method: http.MethodPost, body: `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, "/validate-pods", bytes.NewReader([]byte(tt.body))))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package quota
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// DefaultPath holds the GCE quota consumption of plugin invocations on the node
+const DefaultPath = "/var/run/gcp-ipam-quota.json"
+
+// window is how many minutes of per-minute counts are kept for estimates
+const window = 60
+
+// Bucket is a GCE API rate quota a request is charged to
+type Bucket string
+
+const (
+	BucketRead       Bucket = "read"       // read requests per minute
+	BucketMutate     Bucket = "mutate"     // write requests per minute
+	BucketOperations Bucket = "operations" // operation read requests per minute
+)
+
+// Buckets lists all buckets in a stable order
+var Buckets = []Bucket{BucketRead, BucketMutate, BucketOperations}
+
+// Classify returns the quota bucket GCE charges the request to
+func Classify(req *http.Request) Bucket {
+	// operations.wait is a POST but GCE charges it like an operation read
+	if strings.Contains(req.URL.Path, "/operations/") {
+		return BucketOperations
+	}
+	if req.Method != http.MethodGet {
+		return BucketMutate
+	}
+	return BucketRead
+}
+
+// Counter counts the GCE API requests of a single plugin invocation
+type Counter struct {
+	mu        sync.Mutex
+	calls     map[Bucket]int
+	throttled map[Bucket]int
+}
+
+func NewCounter() *Counter {
+	return &Counter{
+		calls:     map[Bucket]int{},
+		throttled: map[Bucket]int{},
+	}
+}
+
+// Transport wraps base so every request made through it is counted
+func (c *Counter) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base, counter: c}
+}
+
+func (c *Counter) add(bucket Bucket, throttled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls[bucket]++
+	if throttled {
+		c.throttled[bucket]++
+	}
+}
+
+// Calls returns the number of requests charged to bucket
+func (c *Counter) Calls(bucket Bucket) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[bucket]
+}
+
+type transport struct {
+	base    http.RoundTripper
+	counter *Counter
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	t.counter.add(Classify(req), resp != nil && isThrottled(resp))
+	return resp, err
+}
+
+// isThrottled reports whether GCE rejected the request for a rate quota. GCE
+// uses 403 with a rate limit reason as well as 429, so 403 bodies are peeked.
+func isThrottled(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return false
+		}
+		return bytes.Contains(body, []byte("rateLimitExceeded")) || bytes.Contains(body, []byte("quotaExceeded"))
+	default:
+		return false
+	}
+}
+
+// BucketUsage is the consumption of a bucket since the node started counting
+type BucketUsage struct {
+	Calls     int `json:"calls"`
+	Throttled int `json:"throttled"`
+}
+
+// Minute is the number of requests per bucket made within one minute
+type Minute struct {
+	Start time.Time      `json:"start"`
+	Calls map[Bucket]int `json:"calls"`
+}
+
+// Usage is the GCE quota consumption of all plugin invocations on the node
+type Usage struct {
+	Since   time.Time              `json:"since"`
+	Totals  map[Bucket]BucketUsage `json:"totals"`
+	Minutes []Minute               `json:"minutes,omitempty"`
+}
+
+// Estimate is the per-minute consumption of a bucket by this node. GCE rate
+// quotas are per project, so the project total is roughly the sum over nodes.
+type Estimate struct {
+	LastMinute    int     `json:"lastMinute"`
+	PeakPerMinute int     `json:"peakPerMinute"`
+	AvgPerMinute  float64 `json:"avgPerMinute"`
+}
+
+// Load reads the usage file at path, empty if there is none
+func Load(path string) (*Usage, error) {
+	usage := &Usage{Totals: map[Bucket]BucketUsage{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota usage: %w", err)
+	}
+	if err := json.Unmarshal(data, usage); err != nil {
+		return nil, fmt.Errorf("failed to parse quota usage: %w", err)
+	}
+	if usage.Totals == nil {
+		usage.Totals = map[Bucket]BucketUsage{}
+	}
+	return usage, nil
+}
+
+// Record adds the requests counted by c to the usage file at path. Several
+// invocations may hold a slot of the node mutation queue at once, so the file
+// is updated under a file lock next to it.
+func Record(path string, c *Counter, now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create quota usage directory: %w", err)
+	}
+	lock := flock.New(path + ".lock")
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("failed to lock quota usage: %w", err)
+	}
+	defer lock.Unlock()
+
+	usage, err := Load(path)
+	if err != nil {
+		// A corrupt file only costs the history
+		usage = &Usage{Totals: map[Bucket]BucketUsage{}}
+	}
+	usage.add(c, now)
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal quota usage: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write quota usage: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write quota usage: %w", err)
+	}
+	return nil
+}
+
+func (u *Usage) add(c *Counter, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if u.Since.IsZero() {
+		u.Since = now
+	}
+
+	start := now.Truncate(time.Minute)
+	if n := len(u.Minutes); n == 0 || !u.Minutes[n-1].Start.Equal(start) {
+		u.Minutes = append(u.Minutes, Minute{Start: start, Calls: map[Bucket]int{}})
+	}
+	minute := &u.Minutes[len(u.Minutes)-1]
+
+	for bucket, calls := range c.calls {
+		total := u.Totals[bucket]
+		total.Calls += calls
+		total.Throttled += c.throttled[bucket]
+		u.Totals[bucket] = total
+		minute.Calls[bucket] += calls
+	}
+
+	cutoff := start.Add(-window * time.Minute)
+	u.Minutes = dropBefore(u.Minutes, cutoff)
+}
+
+func dropBefore(minutes []Minute, cutoff time.Time) []Minute {
+	i := sort.Search(len(minutes), func(i int) bool {
+		return minutes[i].Start.After(cutoff)
+	})
+	return minutes[i:]
+}
+
+// Estimates returns the per-minute consumption of every bucket over the last hour
+func (u *Usage) Estimates(now time.Time) map[Bucket]Estimate {
+	start := now.Truncate(time.Minute)
+	minutes := dropBefore(u.Minutes, start.Add(-window*time.Minute))
+
+	// Average over the part of the window the node has been counting for
+	span := window
+	if !u.Since.IsZero() {
+		if counted := int(start.Sub(u.Since.Truncate(time.Minute))/time.Minute) + 1; counted < span {
+			span = counted
+		}
+	}
+
+	estimates := make(map[Bucket]Estimate, len(Buckets))
+	for _, bucket := range Buckets {
+		var e Estimate
+		total := 0
+		for _, m := range minutes {
+			calls := m.Calls[bucket]
+			total += calls
+			e.PeakPerMinute = max(e.PeakPerMinute, calls)
+			if m.Start.Equal(start) {
+				e.LastMinute = calls
+			}
+		}
+		if span > 0 {
+			e.AvgPerMinute = float64(total) / float64(span)
+		}
+		estimates[bucket] = e
+	}
+	return estimates
+}
+
+// WriteMetrics renders usage in the Prometheus text exposition format
+func WriteMetrics(w io.Writer, u *Usage, now time.Time) error {
+	estimates := u.Estimates(now)
+
+	var b strings.Builder
+	metric := func(name, kind, help string, value func(Bucket) string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, bucket := range Buckets {
+			fmt.Fprintf(&b, "%s{bucket=%q} %s\n", name, bucket, value(bucket))
+		}
+	}
+
+	metric("gcp_ipam_gce_requests_total", "counter", "GCE API requests made by gcp-ipam on this node by quota bucket",
+		func(bucket Bucket) string { return fmt.Sprint(u.Totals[bucket].Calls) })
+	metric("gcp_ipam_gce_throttled_total", "counter", "GCE API requests rejected for rate quotas by quota bucket",
+		func(bucket Bucket) string { return fmt.Sprint(u.Totals[bucket].Throttled) })
+	metric("gcp_ipam_gce_requests_last_minute", "gauge", "GCE API requests made in the current minute by quota bucket",
+		func(bucket Bucket) string { return fmt.Sprint(estimates[bucket].LastMinute) })
+	metric("gcp_ipam_gce_requests_peak_per_minute", "gauge", "Highest GCE API requests per minute over the last hour by quota bucket",
+		func(bucket Bucket) string { return fmt.Sprint(estimates[bucket].PeakPerMinute) })
+	metric("gcp_ipam_gce_requests_avg_per_minute", "gauge", "Average GCE API requests per minute over the last hour by quota bucket",
+		func(bucket Bucket) string { return fmt.Sprintf("%g", estimates[bucket].AvgPerMinute) })
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
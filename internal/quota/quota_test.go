@@ -0,0 +1,112 @@
+package quota
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCounterTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":{"errors":[{"reason":"rateLimitExceeded"}]}}`))
+		case strings.Contains(r.URL.Path, "/operations/"):
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	c := NewCounter()
+	client := &http.Client{Transport: c.Transport(nil)}
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/compute/v1/projects/p/zones/z/instances/i"},
+		{http.MethodGet, "/compute/v1/projects/p/regions/r/subnetworks/s"},
+		{http.MethodPost, "/compute/v1/projects/p/zones/z/instances/i/updateNetworkInterface"},
+		{http.MethodGet, "/compute/v1/projects/p/zones/z/operations/op"},
+	} {
+		r, err := http.NewRequest(req.method, server.URL+req.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	path := filepath.Join(t.TempDir(), "quota.json")
+	now := time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)
+	if err := Record(path, c, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := Record(path, c, now.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[Bucket]BucketUsage{
+		BucketRead:       {Calls: 4},
+		BucketMutate:     {Calls: 2, Throttled: 2},
+		BucketOperations: {Calls: 2, Throttled: 2},
+	}
+	for bucket, w := range want {
+		if got := usage.Totals[bucket]; got != w {
+			t.Errorf("Totals[%s] = %+v, want %+v", bucket, got, w)
+		}
+	}
+
+	e := usage.Estimates(now.Add(2 * time.Minute))[BucketRead]
+	if e.LastMinute != 2 || e.PeakPerMinute != 2 || e.AvgPerMinute != 4.0/3 {
+		t.Errorf("read estimate = %+v", e)
+	}
+
+	// Minutes older than the window no longer count towards estimates
+	e = usage.Estimates(now.Add(3 * time.Hour))[BucketRead]
+	if e.PeakPerMinute != 0 || e.AvgPerMinute != 0 {
+		t.Errorf("stale read estimate = %+v", e)
+	}
+}
+
+func TestRecordConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	now := time.Now()
+
+	// Invocations holding different slots of the mutation queue record at once
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := NewCounter()
+			c.add(BucketRead, false)
+			if err := Record(path, c, now); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	usage, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := usage.Totals[BucketRead].Calls; got != 20 {
+		t.Errorf("recorded %d reads, want every invocation's", got)
+	}
+	if leftovers, _ := filepath.Glob(path + ".*.tmp"); len(leftovers) > 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+}
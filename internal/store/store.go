@@ -0,0 +1,395 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultPath is the node-local allocation database on the host
+	DefaultPath = "/var/lib/gcp-cni/allocations.db"
+
+	openTimeout = 10 * time.Second
+)
+
+var (
+	attachmentsBucket  = []byte("attachments")
+	reservationsBucket = []byte("reservations")
+)
+
+// State is the lifecycle state of an attachment
+type State string
+
+const (
+	StateAllocated      State = "allocated"       // IP reserved in the IPPool
+	StateAttached       State = "attached"        // alias IP added to the instance
+	StateReleasing      State = "releasing"       // CNI DEL in progress
+	StateReleasePending State = "release-pending" // alias removed, pool release waits for the Kubernetes API
+	StateReleased       State = "released"        // alias removed and IP released
+	StateFailed         State = "failed"          // last operation failed, see Error
+)
+
+// Transition records a single state change of an attachment
+type Transition struct {
+	State State     `json:"state"`
+	At    time.Time `json:"at"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Attachment is everything the node knows about the IP given to a single
+// container interface. Buffered is set while the IP, taken from the node
+// reservations, is allocated in the pool to the node but not yet to the pod,
+// Protected whether the pod asked for its allocation to be protected once it is.
+// AttachOperation and DetachOperation are the GCE operations that attached the
+// alias of IP and detached it again. AttachPending is set while ADD left the
+// alias for the installer to attach asynchronously. AdditionalIPs are the IPs
+// the interface holds besides IP, attached as aliases from the same range.
+type Attachment struct {
+	ContainerID     string       `json:"containerID"`
+	IfName          string       `json:"ifName"`
+	Netns           string       `json:"netns,omitempty"`
+	IP              string       `json:"ip,omitempty"`
+	AdditionalIPs   []string     `json:"additionalIPs,omitempty"`
+	Pool            string       `json:"pool,omitempty"`
+	SecondaryRange  string       `json:"secondaryRange,omitempty"`
+	Routed          bool         `json:"routed,omitempty"`
+	PodNamespace    string       `json:"podNamespace,omitempty"`
+	PodName         string       `json:"podName,omitempty"`
+	PodUID          string       `json:"podUID,omitempty"`
+	Buffered        bool         `json:"buffered,omitempty"`
+	Protected       bool         `json:"protected,omitempty"`
+	AttachPending   bool         `json:"attachPending,omitempty"`
+	AttachOperation *Operation   `json:"attachOperation,omitempty"`
+	DetachOperation *Operation   `json:"detachOperation,omitempty"`
+	State           State        `json:"state"`
+	Error           string       `json:"error,omitempty"`
+	CreatedAt       time.Time    `json:"createdAt"`
+	UpdatedAt       time.Time    `json:"updatedAt"`
+	Transitions     []Transition `json:"transitions,omitempty"`
+}
+
+// Operation is a finished GCE operation, recorded to correlate an attachment
+// with the audit logs of the project
+type Operation struct {
+	Name     string    `json:"name"`
+	ID       uint64    `json:"id,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	DoneAt   time.Time `json:"doneAt"`
+}
+
+// Reservation is an IP the node pre-claimed in an IPPool, handed out by ADD
+// when the pool cannot be reached
+type Reservation struct {
+	IP             string    `json:"ip"`
+	Pool           string    `json:"pool"`
+	CIDR           string    `json:"cidr"`
+	SecondaryRange string    `json:"secondaryRange,omitempty"`
+	ReservedAt     time.Time `json:"reservedAt"`
+}
+
+// Store is the node-local allocation database. It is backed by bbolt, whose
+// file lock also serializes access between concurrent plugin invocations, so
+// it should be opened for the shortest time possible.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the database at path
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create allocation database directory: %w", err)
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open allocation database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(attachmentsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(reservationsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize allocation database: %w", err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+// OpenReadOnly opens an existing database without taking the write lock
+func OpenReadOnly(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open allocation database %s: %w", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close releases the database and its file lock
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the attachment of the container interface, or nil if unknown
+func (s *Store) Get(containerID, ifName string) (*Attachment, error) {
+	var attachment *Attachment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		attachment, err = get(tx, key(containerID, ifName))
+		return err
+	})
+	return attachment, err
+}
+
+// Update applies fn to the attachment of the container interface, creating it
+// if needed. When fn changes the state a transition is recorded.
+func (s *Store) Update(containerID, ifName string, fn func(a *Attachment)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return update(tx, containerID, ifName, fn)
+	})
+}
+
+// SetState moves the attachment to state, recording err if not nil
+func (s *Store) SetState(containerID, ifName string, state State, err error) error {
+	return s.Update(containerID, ifName, func(a *Attachment) {
+		a.State = state
+		a.Error = ""
+		if err != nil {
+			a.Error = err.Error()
+		}
+	})
+}
+
+// List returns all attachments
+func (s *Store) List() ([]Attachment, error) {
+	var attachments []Attachment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(attachmentsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var a Attachment
+			if err := json.Unmarshal(v, &a); err != nil {
+				return fmt.Errorf("failed to unmarshal attachment: %w", err)
+			}
+			attachments = append(attachments, a)
+			return nil
+		})
+	})
+	return attachments, err
+}
+
+// Prune removes released attachments last updated before cutoff
+func (s *Store) Prune(cutoff time.Time) (int, error) {
+	pruned := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(attachmentsBucket)
+		var stale [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var a Attachment
+			if err := json.Unmarshal(v, &a); err != nil {
+				return fmt.Errorf("failed to unmarshal attachment: %w", err)
+			}
+			if a.State == StateReleased && a.UpdatedAt.Before(cutoff) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(stale)
+		return nil
+	})
+	return pruned, err
+}
+
+// Reservations returns the IPs the node holds in reserve
+func (s *Store) Reservations() ([]Reservation, error) {
+	var reservations []Reservation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(reservationsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var r Reservation
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("failed to unmarshal reservation: %w", err)
+			}
+			reservations = append(reservations, r)
+			return nil
+		})
+	})
+	return reservations, err
+}
+
+// AddReservations records the reservations the node does not hold yet. IPs a
+// container took from the reservations are skipped while it uses them.
+func (s *Store) AddReservations(reservations []Reservation) (int, error) {
+	added := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		added = 0
+		taken := map[string]bool{}
+		err := tx.Bucket(attachmentsBucket).ForEach(func(_, v []byte) error {
+			var a Attachment
+			if err := json.Unmarshal(v, &a); err != nil {
+				return fmt.Errorf("failed to unmarshal attachment: %w", err)
+			}
+			if a.Buffered && a.State != StateReleased && a.State != StateFailed {
+				taken[a.Pool+"/"+a.IP] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket(reservationsBucket)
+		for _, r := range reservations {
+			k := reservationKey(r.Pool, r.IP)
+			if taken[string(k)] || b.Get(k) != nil {
+				continue
+			}
+			data, err := json.Marshal(r)
+			if err != nil {
+				return fmt.Errorf("failed to marshal reservation: %w", err)
+			}
+			if err := b.Put(k, data); err != nil {
+				return err
+			}
+			added++
+		}
+		return nil
+	})
+	return added, err
+}
+
+// RemoveReservation drops the reservation of ip in pool and reports whether
+// the node still held it, false once a container took it
+func (s *Store) RemoveReservation(pool, ip string) (bool, error) {
+	removed := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(reservationsBucket)
+		k := reservationKey(pool, ip)
+		if b.Get(k) == nil {
+			return nil
+		}
+		removed = true
+		return b.Delete(k)
+	})
+	return removed, err
+}
+
+// TakeReservation hands a reserved IP of pool to the container interface,
+// recording it on its attachment as buffered together with what fn sets.
+// It returns nil when the node holds no more than keep reservations of the pool.
+func (s *Store) TakeReservation(pool string, keep int, containerID, ifName string, fn func(a *Attachment)) (*Reservation, error) {
+	var reservation *Reservation
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		reservation = nil
+		c := tx.Bucket(reservationsBucket).Cursor()
+		prefix := reservationKey(pool, "")
+		held := 0
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && held <= keep; k, _ = c.Next() {
+			held++
+		}
+		if held <= keep {
+			return nil
+		}
+
+		_, v := c.Seek(prefix)
+
+		r := &Reservation{}
+		if err := json.Unmarshal(v, r); err != nil {
+			return fmt.Errorf("failed to unmarshal reservation: %w", err)
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		reservation = r
+		return update(tx, containerID, ifName, func(a *Attachment) {
+			a.IP = r.IP
+			a.Pool = r.Pool
+			a.SecondaryRange = r.SecondaryRange
+			a.Buffered = true
+			a.State = StateAllocated
+			a.Error = ""
+			fn(a)
+		})
+	})
+	return reservation, err
+}
+
+func update(tx *bolt.Tx, containerID, ifName string, fn func(a *Attachment)) error {
+	k := key(containerID, ifName)
+	attachment, err := get(tx, k)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if attachment == nil {
+		attachment = &Attachment{ContainerID: containerID, IfName: ifName, CreatedAt: now}
+	}
+
+	previous := attachment.State
+	fn(attachment)
+	attachment.UpdatedAt = now
+	if attachment.State != previous {
+		attachment.Transitions = append(attachment.Transitions, Transition{
+			State: attachment.State,
+			At:    now,
+			Error: attachment.Error,
+		})
+	}
+
+	data, err := json.Marshal(attachment)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attachment: %w", err)
+	}
+	return tx.Bucket(attachmentsBucket).Put(k, data)
+}
+
+func get(tx *bolt.Tx, k []byte) (*Attachment, error) {
+	b := tx.Bucket(attachmentsBucket)
+	if b == nil {
+		return nil, nil
+	}
+	data := b.Get(k)
+	if data == nil {
+		return nil, nil
+	}
+
+	a := &Attachment{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal attachment: %w", err)
+	}
+	return a, nil
+}
+
+func key(containerID, ifName string) []byte {
+	return []byte(containerID + "/" + ifName)
+}
+
+func reservationKey(pool, ip string) []byte {
+	return []byte(pool + "/" + ip)
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreLifecycle(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "allocations.db"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer s.Close()
+
+	err = s.Update("container", "eth0", func(a *Attachment) {
+		a.IP = "10.0.0.5"
+		a.Pool = "ippool-test"
+		a.State = StateAllocated
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if err := s.SetState("container", "eth0", StateAttached, nil); err != nil {
+		t.Fatalf("SetState() error = %v", err)
+	}
+	if err := s.SetState("container", "eth0", StateFailed, errors.New("boom")); err != nil {
+		t.Fatalf("SetState() error = %v", err)
+	}
+
+	a, err := s.Get("container", "eth0")
+	if err != nil || a == nil {
+		t.Fatalf("Get() = %v, %v", a, err)
+	}
+	if a.IP != "10.0.0.5" || a.State != StateFailed || a.Error != "boom" {
+		t.Errorf("Get() = %+v", a)
+	}
+	if len(a.Transitions) != 3 {
+		t.Errorf("Transitions = %d, want 3", len(a.Transitions))
+	}
+
+	if missing, err := s.Get("other", "eth0"); err != nil || missing != nil {
+		t.Errorf("Get(unknown) = %v, %v, want nil", missing, err)
+	}
+
+	// Only released attachments are pruned
+	if pruned, err := s.Prune(time.Now().Add(time.Hour)); err != nil || pruned != 0 {
+		t.Errorf("Prune() = %d, %v, want 0", pruned, err)
+	}
+	if err := s.SetState("container", "eth0", StateReleased, nil); err != nil {
+		t.Fatalf("SetState() error = %v", err)
+	}
+	if pruned, err := s.Prune(time.Now().Add(time.Hour)); err != nil || pruned != 1 {
+		t.Errorf("Prune() = %d, %v, want 1", pruned, err)
+	}
+
+	attachments, err := s.List()
+	if err != nil || len(attachments) != 0 {
+		t.Errorf("List() = %v, %v, want empty", attachments, err)
+	}
+}
+
+func TestReservations(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "allocations.db"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer s.Close()
+
+	reservations := []Reservation{
+		{IP: "10.0.0.5", Pool: "ippool-a", CIDR: "10.0.0.0/24"},
+		{IP: "10.0.0.6", Pool: "ippool-a", CIDR: "10.0.0.0/24"},
+		{IP: "10.1.0.5", Pool: "ippool-b", CIDR: "10.1.0.0/24"},
+	}
+	if added, err := s.AddReservations(reservations); err != nil || added != 3 {
+		t.Fatalf("AddReservations() = %d, %v, want 3", added, err)
+	}
+
+	// Reservations held back for others are not handed out
+	if r, err := s.TakeReservation("ippool-a", 2, "container", "eth0", func(*Attachment) {}); err != nil || r != nil {
+		t.Fatalf("TakeReservation() of kept buffer = %+v, %v, want nil", r, err)
+	}
+
+	r, err := s.TakeReservation("ippool-b", 0, "container", "eth0", func(a *Attachment) { a.PodUID = "uid" })
+	if err != nil || r == nil || r.IP != "10.1.0.5" {
+		t.Fatalf("TakeReservation() = %+v, %v, want 10.1.0.5", r, err)
+	}
+	a, err := s.Get("container", "eth0")
+	if err != nil || a == nil || a.IP != "10.1.0.5" || !a.Buffered || a.State != StateAllocated || a.PodUID != "uid" {
+		t.Fatalf("Get() after TakeReservation() = %+v, %v", a, err)
+	}
+	if r, err := s.TakeReservation("ippool-b", 0, "other", "eth0", func(*Attachment) {}); err != nil || r != nil {
+		t.Fatalf("TakeReservation() of empty buffer = %+v, %v, want nil", r, err)
+	}
+
+	// A taken IP is not buffered again while the container uses it
+	if added, err := s.AddReservations(reservations); err != nil || added != 0 {
+		t.Errorf("AddReservations() again = %d, %v, want 0", added, err)
+	}
+	if err := s.SetState("container", "eth0", StateFailed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if added, err := s.AddReservations(reservations); err != nil || added != 1 {
+		t.Errorf("AddReservations() after failed ADD = %d, %v, want 1", added, err)
+	}
+
+	if removed, err := s.RemoveReservation("ippool-a", "10.0.0.5"); err != nil || !removed {
+		t.Errorf("RemoveReservation() = %v, %v, want true", removed, err)
+	}
+	if removed, err := s.RemoveReservation("ippool-a", "10.0.0.5"); err != nil || removed {
+		t.Errorf("RemoveReservation() again = %v, %v, want false", removed, err)
+	}
+	if held, err := s.Reservations(); err != nil || len(held) != 2 {
+		t.Errorf("Reservations() = %+v, %v, want 2", held, err)
+	}
+}
@@ -0,0 +1,36 @@
+// Package subnetpool builds the IPPools of subnetwork secondary ranges the
+// plugin and the installer create when nothing was provisioned for them.
+package subnetpool
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/api/compute/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// Build returns the IPPool poolName of the secondary range rangeName of
+// subnetwork in project, as the provisioner would create it
+func Build(ctx context.Context, computeService *compute.Service, project, region, subnetwork, rangeName, poolName string) (*v1alpha1.IPPool, error) {
+	subnet, err := computeService.Subnetworks.Get(project, region, subnetwork).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subnetwork %s: %w", subnetwork, err)
+	}
+	for _, r := range subnet.SecondaryIpRanges {
+		if r.RangeName != rangeName {
+			continue
+		}
+		return &v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: poolName},
+			Spec: v1alpha1.IPPoolSpec{
+				CIDR:               r.IpCidrRange,
+				Subnet:             fmt.Sprintf("projects/%s/regions/%s/subnetworks/%s", project, region, subnetwork),
+				SecondaryRangeName: rangeName,
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("subnetwork %s has no secondary range %s", subnetwork, rangeName)
+}
@@ -0,0 +1,44 @@
+package subnetpool
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestBuild(t *testing.T) {
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/projects/host/regions/europe-west1/subnetworks/nodes" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&compute.Subnetwork{
+			Name:              "nodes",
+			SecondaryIpRanges: []*compute.SubnetworkSecondaryRange{{RangeName: "live-prod", IpCidrRange: "10.100.0.0/16"}},
+		})
+	}))
+	defer gce.Close()
+	computeService, err := compute.NewService(context.Background(), option.WithEndpoint(gce.URL), option.WithHTTPClient(gce.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := Build(context.Background(), computeService, "host", "europe-west1", "nodes", "live-prod", "ippool-nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.Name != "ippool-nodes" || pool.Spec.CIDR != "10.100.0.0/16" || pool.Spec.SecondaryRangeName != "live-prod" ||
+		pool.Spec.Subnet != "projects/host/regions/europe-west1/subnetworks/nodes" {
+		t.Errorf("Build() = %s %+v, want ippool-nodes of live-prod in the host project", pool.Name, pool.Spec)
+	}
+
+	if _, err := Build(context.Background(), computeService, "host", "europe-west1", "nodes", "other", "ippool-nodes"); err == nil {
+		t.Error("Build() of a missing secondary range succeeded")
+	}
+}
@@ -0,0 +1,41 @@
+package telemetry
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// WriteRetryMetrics renders the retries of pool and migration updates and how
+// often they were exhausted, summed per step over records, in the Prometheus
+// text exposition format
+func WriteRetryMetrics(w io.Writer, records []*Record) error {
+	retries, exhausted := map[string]int{}, map[string]int{}
+	for _, r := range records {
+		for step, n := range r.Retries {
+			retries[step] += n
+		}
+		for step, n := range r.Exhausted {
+			exhausted[step] += n
+		}
+	}
+
+	var b strings.Builder
+	metric := func(name, help string, counts map[string]int) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		steps := make([]string, 0, len(counts))
+		for step := range counts {
+			steps = append(steps, step)
+		}
+		sort.Strings(steps)
+		for _, step := range steps {
+			fmt.Fprintf(&b, "%s{step=%q} %d\n", name, step, counts[step])
+		}
+	}
+	metric("gcp_ipam_retries", "Retries of conflicting updates over the kept operation records by step", retries)
+	metric("gcp_ipam_retries_exhausted", "Updates that gave up after their last retry over the kept operation records by step", exhausted)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
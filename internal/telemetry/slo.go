@@ -0,0 +1,75 @@
+package telemetry
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// SLO is a latency objective for CNI ADD: Objective of the ADDs in a window
+// finish within Latency. Failed ADDs count against it like slow ones.
+type SLO struct {
+	Latency   time.Duration
+	Objective float64
+}
+
+// Burn is the error budget consumption of ADDs over a window
+type Burn struct {
+	Window time.Duration `json:"windowNs"`
+	Total  int           `json:"total"`
+	Bad    int           `json:"bad"`
+	// Rate is the fraction of bad ADDs relative to the budget, 1 spends the
+	// budget exactly over the SLO period
+	Rate float64 `json:"rate"`
+}
+
+// BurnRate evaluates slo over the ADD records started in the window before now
+func (slo SLO) BurnRate(records []*Record, window time.Duration, now time.Time) Burn {
+	burn := Burn{Window: window}
+	cutoff := now.Add(-window)
+	for _, r := range records {
+		if r.Operation != "ADD" || r.Start.Before(cutoff) {
+			continue
+		}
+		burn.Total++
+		if r.Error != "" || r.Duration > slo.Latency {
+			burn.Bad++
+		}
+	}
+	if burn.Total > 0 && slo.Objective < 1 {
+		burn.Rate = float64(burn.Bad) / float64(burn.Total) / (1 - slo.Objective)
+	}
+	return burn
+}
+
+// WriteBurnMetrics renders burns in the Prometheus text exposition format
+func WriteBurnMetrics(w io.Writer, slo SLO, burns []Burn, violating bool) error {
+	var b strings.Builder
+	gauge := func(name, help, value string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, value)
+	}
+	metric := func(name, help string, value func(Burn) string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, burn := range burns {
+			fmt.Fprintf(&b, "%s{window=%q} %s\n", name, burn.Window, value(burn))
+		}
+	}
+
+	gauge("gcp_ipam_add_latency_slo_seconds", "ADD latency objective of gcp-ipam on this node", fmt.Sprintf("%g", slo.Latency.Seconds()))
+	gauge("gcp_ipam_add_latency_slo_objective", "Fraction of ADDs that have to finish within the latency objective", fmt.Sprintf("%g", slo.Objective))
+	metric("gcp_ipam_add_operations", "ADDs started within the window",
+		func(burn Burn) string { return fmt.Sprint(burn.Total) })
+	metric("gcp_ipam_add_slo_violations", "ADDs within the window that failed or exceeded the latency objective",
+		func(burn Burn) string { return fmt.Sprint(burn.Bad) })
+	metric("gcp_ipam_add_slo_burn_rate", "Error budget burn rate of the ADD latency objective over the window",
+		func(burn Burn) string { return fmt.Sprintf("%g", burn.Rate) })
+	value := "0"
+	if violating {
+		value = "1"
+	}
+	gauge("gcp_ipam_add_slo_violating", "Whether the node burns its ADD latency error budget too fast in every window", value)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,232 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDir holds one record per plugin invocation on the host
+	DefaultDir = "/var/lib/gcp-cni/operations"
+
+	// DefaultMaxRecords bounds the records kept in DefaultDir, oldest go first
+	DefaultMaxRecords = 1000
+)
+
+// Causes of a failed invocation that are not a fault of the plugin itself
+const (
+	// CauseCapacity is a pool, node or instance out of IPs or alias ranges
+	CauseCapacity = "capacity"
+
+	// CauseQuota is GCE refusing a call for rate or quota limits
+	CauseQuota = "quota"
+)
+
+// Timing is a timed phase of a plugin invocation
+type Timing struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"durationNs"`
+}
+
+// Record is the machine-readable outcome of a single CNI ADD or DEL, written
+// whether or not debug logging is enabled so slow pod starts can be analyzed
+// after the fact
+type Record struct {
+	Operation     string         `json:"operation"`
+	PluginVersion string         `json:"pluginVersion,omitempty"`
+	ContainerID   string         `json:"containerID"`
+	IfName        string         `json:"ifName,omitempty"`
+	PodNamespace  string         `json:"podNamespace,omitempty"`
+	PodName       string         `json:"podName,omitempty"`
+	IP            string         `json:"ip,omitempty"`
+	Pool          string         `json:"pool,omitempty"`
+	Start         time.Time      `json:"start"`
+	Duration      time.Duration  `json:"durationNs"`
+	Phases        []Timing       `json:"phases,omitempty"`
+	Retries       map[string]int `json:"retries,omitempty"`
+	Exhausted     map[string]int `json:"retriesExhausted,omitempty"`
+	Error         string         `json:"error,omitempty"`
+	Cause         string         `json:"cause,omitempty"`
+
+	mu sync.Mutex
+}
+
+func NewRecord(operation, containerID, ifName string) *Record {
+	return &Record{
+		Operation:   operation,
+		ContainerID: containerID,
+		IfName:      ifName,
+		Start:       time.Now(),
+	}
+}
+
+// Phase records that the named step took d
+func (r *Record) Phase(name string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Phases = append(r.Phases, Timing{Name: name, Duration: d})
+}
+
+// Retry counts a retry of the named step
+func (r *Record) Retry(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Retries == nil {
+		r.Retries = map[string]int{}
+	}
+	r.Retries[name]++
+}
+
+// RetriesExhausted counts the named step giving up after its last retry
+func (r *Record) RetriesExhausted(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Exhausted == nil {
+		r.Exhausted = map[string]int{}
+	}
+	r.Exhausted[name]++
+}
+
+// Finish completes the record with the outcome of the invocation
+func (r *Record) Finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Duration = time.Since(r.Start)
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Write stores the record in dir and drops the oldest records beyond max
+func (r *Record) Write(dir string, max int) error {
+	r.mu.Lock()
+	data, err := json.Marshal(r)
+	name := fmt.Sprintf("%020d-%s-%s.json", r.Start.UnixNano(), strings.ToLower(r.Operation), shortID(r.ContainerID))
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal operation record: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create operation record directory: %w", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("failed to write operation record: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write operation record: %w", err)
+	}
+
+	return prune(dir, max)
+}
+
+// List returns up to limit records from dir, newest first. A limit of 0 returns all.
+func List(dir string, limit int) ([]*Record, error) {
+	names, err := recordNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*Record{}
+	for i := len(names) - 1; i >= 0 && (limit == 0 || len(records) < limit); i-- {
+		data, err := os.ReadFile(filepath.Join(dir, names[i]))
+		if err != nil {
+			// Pruned by a concurrent invocation
+			continue
+		}
+		record := &Record{}
+		if err := json.Unmarshal(data, record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// prune removes the oldest records so at most max remain
+func prune(dir string, max int) error {
+	names, err := recordNames(dir)
+	if err != nil {
+		return err
+	}
+	for len(names) > max {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to prune operation records: %w", err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// recordNames returns the record file names in dir, oldest first
+func recordNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read operation records: %w", err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func shortID(containerID string) string {
+	if len(containerID) > 12 {
+		return containerID[:12]
+	}
+	if containerID == "" {
+		return "unknown"
+	}
+	return containerID
+}
+
+type contextKey struct{}
+
+// NewContext returns ctx carrying r, so code deep in the call chain can add to it
+func NewContext(ctx context.Context, r *Record) context.Context {
+	return context.WithValue(ctx, contextKey{}, r)
+}
+
+// FromContext returns the record carried by ctx, if any
+func FromContext(ctx context.Context) (*Record, bool) {
+	r, ok := ctx.Value(contextKey{}).(*Record)
+	return r, ok
+}
+
+// Retry counts a retry of the named step on the record carried by ctx, if any
+func Retry(ctx context.Context, name string) {
+	if r, ok := FromContext(ctx); ok {
+		r.Retry(name)
+	}
+}
+
+// RetriesExhausted counts the named step giving up on the record carried by
+// ctx, if any
+func RetriesExhausted(ctx context.Context, name string) {
+	if r, ok := FromContext(ctx); ok {
+		r.RetriesExhausted(name)
+	}
+}
+
+// Phase records the named step on the record carried by ctx, if any
+func Phase(ctx context.Context, name string, d time.Duration) {
+	if r, ok := FromContext(ctx); ok {
+		r.Phase(name, d)
+	}
+}
@@ -0,0 +1,109 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordWriteBounded(t *testing.T) {
+	dir := t.TempDir()
+
+	for i, containerID := range []string{"first", "second", "third"} {
+		r := NewRecord("ADD", containerID, "eth0")
+		r.Start = r.Start.Add(time.Duration(i) * time.Second)
+
+		ctx := NewContext(context.Background(), r)
+		Phase(ctx, "allocate", time.Millisecond)
+		Retry(ctx, "pool-allocate")
+		Retry(ctx, "pool-allocate")
+
+		var err error
+		if containerID == "third" {
+			err = errors.New("pool exhausted")
+		}
+		r.Finish(err)
+		if err := r.Write(dir, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := List(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("kept %d records, want 2", len(records))
+	}
+
+	newest := records[0]
+	if newest.ContainerID != "third" || records[1].ContainerID != "second" {
+		t.Errorf("records = %s, %s, want newest first", newest.ContainerID, records[1].ContainerID)
+	}
+	if newest.Error != "pool exhausted" {
+		t.Errorf("Error = %q, want pool exhausted", newest.Error)
+	}
+	if newest.Retries["pool-allocate"] != 2 {
+		t.Errorf("Retries = %v, want 2 pool-allocate retries", newest.Retries)
+	}
+	if len(newest.Phases) != 1 || newest.Phases[0].Name != "allocate" {
+		t.Errorf("Phases = %+v, want allocate", newest.Phases)
+	}
+
+	if records, _ := List(dir, 1); len(records) != 1 {
+		t.Errorf("List() with limit 1 returned %d records", len(records))
+	}
+}
+
+func TestSLOBurnRate(t *testing.T) {
+	now := time.Now()
+	record := func(op string, age, d time.Duration, err string) *Record {
+		return &Record{Operation: op, Start: now.Add(-age), Duration: d, Error: err}
+	}
+	records := []*Record{
+		record("ADD", time.Minute, time.Second, ""),
+		record("ADD", 2*time.Minute, 10*time.Second, ""),
+		record("ADD", 3*time.Minute, time.Second, "pool exhausted"),
+		record("ADD", 4*time.Minute, time.Second, ""),
+		record("DEL", time.Minute, time.Minute, ""),
+		record("ADD", 2*time.Hour, time.Minute, ""),
+	}
+
+	slo := SLO{Latency: 5 * time.Second, Objective: 0.9}
+	burn := slo.BurnRate(records, time.Hour, now)
+	if burn.Total != 4 || burn.Bad != 2 {
+		t.Fatalf("BurnRate() = %+v, want 2 of 4 ADDs bad", burn)
+	}
+	if burn.Rate < 4.99 || burn.Rate > 5.01 {
+		t.Errorf("Rate = %g, want 5", burn.Rate)
+	}
+
+	if burn := slo.BurnRate(records, time.Second, now); burn.Total != 0 || burn.Rate != 0 {
+		t.Errorf("BurnRate() of an empty window = %+v, want no burn", burn)
+	}
+}
+
+func TestWriteRetryMetrics(t *testing.T) {
+	a := NewRecord("ADD", "a", "eth0")
+	a.Retry("pool-allocate")
+	a.Retry("pool-allocate")
+	a.RetriesExhausted("pool-allocate")
+	b := NewRecord("DEL", "b", "eth0")
+	b.Retry("pool-release")
+
+	var out strings.Builder
+	if err := WriteRetryMetrics(&out, []*Record{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`gcp_ipam_retries{step="pool-allocate"} 2`,
+		`gcp_ipam_retries{step="pool-release"} 1`,
+		`gcp_ipam_retries_exhausted{step="pool-allocate"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("WriteRetryMetrics() = %s, missing %s", out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Package validation checks the configuration of the whole stack for
+// consistency before it is rolled out: the CNI conflist, the plugin
+// configuration, the IPPools, the secondary ranges of their subnetworks and
+// the flags of the installer and provisioner.
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"sort"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/internal/installer"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/castai/gcp-cni/pkg/ipam"
+)
+
+// ipamType is the IPAM plugin type the conflist has to delegate to
+const ipamType = "gcp-ipam"
+
+// Severities of a Finding
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Finding is an inconsistency in the configuration. Errors break pods of
+// some nodes, warnings are likely mistakes.
+type Finding struct {
+	Severity string `json:"severity"`
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+// Subnetwork is the part of a GCE subnetwork the pools depend on, the CIDRs
+// of its secondary ranges by name
+type Subnetwork struct {
+	Name            string
+	SecondaryRanges map[string]string
+}
+
+// Stack is the configuration to validate. Parts left unset are not checked,
+// nor are the checks against them: without Pools the pools the conflist and
+// plugin configuration name are not looked up.
+type Stack struct {
+	// ConfList is the CNI conflist or .conf of the nodes
+	ConfList []byte
+	// PluginConfig is the plugin configuration of the ConfigMap
+	PluginConfig *config.Config
+	// Pools are the IPPools of the cluster
+	Pools []v1alpha1.IPPool
+	// Subnetworks are the subnetworks of the pools by name
+	Subnetworks map[string]Subnetwork
+
+	// PluginConfigPath is where the installer renders the plugin
+	// configuration, its --plugin-config-path
+	PluginConfigPath string
+	// SecondaryRangeName is the range the provisioner provisions pools from,
+	// its --secondary-range-name
+	SecondaryRangeName string
+}
+
+// Validate checks the stack and returns its findings, errors first
+func Validate(s Stack) []Finding {
+	v := &validator{stack: s}
+	if s.Pools != nil {
+		v.pools = map[string]*v1alpha1.IPPool{}
+		for i := range s.Pools {
+			v.pools[s.Pools[i].Name] = &s.Pools[i]
+		}
+	}
+
+	if s.ConfList != nil {
+		v.confList()
+	}
+	if s.PluginConfig != nil {
+		v.pluginConfig()
+	}
+	for i := range s.Pools {
+		v.pool(&s.Pools[i])
+	}
+	v.overlaps()
+
+	sort.SliceStable(v.findings, func(i, j int) bool {
+		return v.findings[i].Severity == SeverityError && v.findings[j].Severity != SeverityError
+	})
+	return v.findings
+}
+
+// HasErrors reports whether findings hold an error
+func HasErrors(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+type validator struct {
+	stack    Stack
+	pools    map[string]*v1alpha1.IPPool
+	findings []Finding
+}
+
+func (v *validator) errorf(source, format string, a ...any) {
+	v.findings = append(v.findings, Finding{Severity: SeverityError, Source: source, Message: fmt.Sprintf(format, a...)})
+}
+
+func (v *validator) warnf(source, format string, a ...any) {
+	v.findings = append(v.findings, Finding{Severity: SeverityWarning, Source: source, Message: fmt.Sprintf(format, a...)})
+}
+
+// poolMissing reports whether pools are known and name is not one of them
+func (v *validator) poolMissing(name string) bool {
+	if v.pools == nil {
+		return false
+	}
+	_, ok := v.pools[name]
+	return !ok
+}
+
+// netConf is the part of a network configuration delegating to gcp-ipam
+type netConf struct {
+	Type               string `json:"type"`
+	IPPoolName         string `json:"ipPoolName"`
+	SecondaryRangeName string `json:"secondaryRangeName"`
+	IPAM               struct {
+		Type       string `json:"type"`
+		ConfigPath string `json:"configPath"`
+	} `json:"ipam"`
+}
+
+func (v *validator) confList() {
+	const source = "conflist"
+	isList, err := installer.IsConfList(v.stack.ConfList)
+	if err != nil {
+		v.errorf(source, "does not parse: %v", err)
+		return
+	}
+	var plugins []netConf
+	if isList {
+		var list struct {
+			Plugins []netConf `json:"plugins"`
+		}
+		err = json.Unmarshal(v.stack.ConfList, &list)
+		plugins = list.Plugins
+	} else {
+		var conf netConf
+		err = json.Unmarshal(v.stack.ConfList, &conf)
+		plugins = []netConf{conf}
+	}
+	if err != nil {
+		v.errorf(source, "does not parse: %v", err)
+		return
+	}
+
+	delegated := false
+	for _, plugin := range plugins {
+		if plugin.IPAM.Type != ipamType {
+			continue
+		}
+		delegated = true
+		pluginSource := fmt.Sprintf("%s plugin %s", source, plugin.Type)
+
+		configPath := plugin.IPAM.ConfigPath
+		if configPath == "" {
+			configPath = config.DefaultPath
+		}
+		if v.stack.PluginConfigPath != "" && configPath != v.stack.PluginConfigPath {
+			v.errorf(pluginSource, "reads the plugin configuration from %s but the installer renders it to %s", configPath, v.stack.PluginConfigPath)
+		}
+		if plugin.IPPoolName != "" && v.poolMissing(plugin.IPPoolName) {
+			v.errorf(pluginSource, "ipPoolName %s does not exist", plugin.IPPoolName)
+		}
+		if plugin.SecondaryRangeName != "" && v.stack.SecondaryRangeName != "" && plugin.SecondaryRangeName != v.stack.SecondaryRangeName {
+			v.warnf(pluginSource, "secondaryRangeName %s differs from the range %s the provisioner provisions", plugin.SecondaryRangeName, v.stack.SecondaryRangeName)
+		}
+	}
+	if !delegated {
+		v.errorf(source, "no plugin delegates IPAM to %s", ipamType)
+	}
+}
+
+func (v *validator) pluginConfig() {
+	const source = "plugin configuration"
+	cfg := v.stack.PluginConfig
+
+	for subnetwork, pool := range cfg.PoolMappings {
+		if v.poolMissing(pool) {
+			v.errorf(source, "poolMappings maps subnetwork %s to IPPool %s, which does not exist", subnetwork, pool)
+		}
+	}
+	if cfg.MissingPool.Action == config.MissingPoolFallback && v.poolMissing(cfg.MissingPool.FallbackPool) {
+		v.errorf(source, "missingPool.fallbackPool %s does not exist", cfg.MissingPool.FallbackPool)
+	}
+	rangeName := cfg.ClusterRange(ipam.AliasRange(cfg.SecondaryRangeName))
+	if v.stack.SecondaryRangeName != "" && rangeName != v.stack.SecondaryRangeName {
+		v.warnf(source, "secondaryRangeName %s differs from the range %s the provisioner provisions", rangeName, v.stack.SecondaryRangeName)
+	}
+}
+
+func (v *validator) pool(pool *v1alpha1.IPPool) {
+	source := "IPPool " + pool.Name
+
+	ranges := pool.Spec.SecondaryRanges
+	if len(ranges) == 0 {
+		ranges = []v1alpha1.SecondaryRange{{Name: pool.Spec.SecondaryRangeName, CIDR: pool.Spec.CIDR}}
+	}
+	for _, r := range ranges {
+		prefix, err := ipam.ParsePrefix(r.CIDR)
+		if err != nil {
+			v.errorf(source, "CIDR %q of secondary range %s does not parse: %v", r.CIDR, ipam.AliasRange(r.Name), err)
+			continue
+		}
+		// The plugin hands pods the first address after the network address as gateway
+		gateway := prefix.Addr().Next()
+		if !prefix.Contains(gateway) || !prefix.Contains(gateway.Next()) {
+			v.errorf(source, "CIDR %s leaves no room for the gateway %s and pod IPs", r.CIDR, gateway)
+		}
+		if cfg := v.stack.PluginConfig; cfg != nil && !cfg.InClusterRange(ipam.AliasRange(r.Name)) {
+			v.errorf(source, "secondary range %s is not a range of cluster %s, the plugin refuses to attach from it", ipam.AliasRange(r.Name), cfg.ClusterID)
+		}
+		v.subnetworkRange(source, pool, ipam.AliasRange(r.Name), prefix)
+	}
+}
+
+// subnetworkRange checks that the subnetwork of the pool has the secondary
+// range rangeName with the CIDR of the pool
+func (v *validator) subnetworkRange(source string, pool *v1alpha1.IPPool, rangeName string, prefix netip.Prefix) {
+	if v.stack.Subnetworks == nil || pool.Spec.Subnet == "" {
+		return
+	}
+	name := ipam.SubnetworkName(pool.Spec.Subnet)
+	subnetwork, ok := v.stack.Subnetworks[name]
+	if !ok {
+		v.errorf(source, "subnetwork %s does not exist", name)
+		return
+	}
+	cidr, ok := subnetwork.SecondaryRanges[rangeName]
+	if !ok {
+		v.errorf(source, "subnetwork %s has no secondary range %s", name, rangeName)
+		return
+	}
+	if rangePrefix, err := ipam.ParsePrefix(cidr); err != nil || rangePrefix != prefix {
+		v.errorf(source, "CIDR %s does not match %s of secondary range %s of subnetwork %s", prefix, cidr, rangeName, name)
+	}
+}
+
+// overlaps reports pools handing out the same IPs
+func (v *validator) overlaps() {
+	type poolRange struct {
+		pool   string
+		prefix netip.Prefix
+	}
+	var ranges []poolRange
+	for _, pool := range v.stack.Pools {
+		cidrs := []string{pool.Spec.CIDR}
+		for _, r := range pool.Spec.SecondaryRanges {
+			cidrs = append(cidrs, r.CIDR)
+		}
+		for _, cidr := range cidrs {
+			if prefix, err := ipam.ParsePrefix(cidr); err == nil {
+				ranges = append(ranges, poolRange{pool: pool.Name, prefix: prefix})
+			}
+		}
+	}
+	for i := range ranges {
+		for j := i + 1; j < len(ranges); j++ {
+			a, b := ranges[i], ranges[j]
+			if a.pool != b.pool && a.prefix.Overlaps(b.prefix) {
+				v.errorf("IPPool "+a.pool, "CIDR %s overlaps %s of IPPool %s", a.prefix, b.prefix, b.pool)
+			}
+		}
+	}
+}
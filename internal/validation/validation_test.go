@@ -0,0 +1,113 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/internal/config"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestValidate(t *testing.T) {
+	confList := []byte(`{
+		"cniVersion": "1.0.0",
+		"name": "k8s-pod-network",
+		"plugins": [{"type": "ptp", "ipam": {"type": "gcp-ipam", "configPath": "/etc/gcp-cni/ipam.json"}}]
+	}`)
+	pool := func(name, subnet, cidr string) v1alpha1.IPPool {
+		return v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1alpha1.IPPoolSpec{CIDR: cidr, Subnet: "projects/p/regions/r/subnetworks/" + subnet, SecondaryRangeName: "live"},
+		}
+	}
+	// Range live of cluster eu-prod ends in -prod all the same
+	otherCluster := pool("ippool-nodes", "nodes", "10.8.0.0/20")
+	otherCluster.Spec.SecondaryRangeName = "live-eu-prod"
+	subnetworks := map[string]Subnetwork{
+		"nodes": {Name: "nodes", SecondaryRanges: map[string]string{"live": "10.8.0.0/20"}},
+	}
+
+	tests := []struct {
+		name  string
+		stack Stack
+		want  []string
+	}{
+		{
+			name: "consistent",
+			stack: Stack{
+				ConfList:           confList,
+				PluginConfig:       config.Default(),
+				Pools:              []v1alpha1.IPPool{pool("ippool-nodes", "nodes", "10.8.0.0/20")},
+				Subnetworks:        subnetworks,
+				PluginConfigPath:   config.DefaultPath,
+				SecondaryRangeName: "live",
+			},
+		},
+		{
+			name:  "conflist without gcp-ipam",
+			stack: Stack{ConfList: []byte(`{"cniVersion": "1.0.0", "name": "n", "plugins": [{"type": "ptp", "ipam": {"type": "host-local"}}]}`)},
+			want:  []string{"error conflist: no plugin delegates IPAM to gcp-ipam"},
+		},
+		{
+			name:  "config path differs from the installer",
+			stack: Stack{ConfList: confList, PluginConfigPath: "/etc/gcp-cni/other.json"},
+			want:  []string{"error conflist plugin ptp: reads the plugin configuration from /etc/gcp-cni/ipam.json but the installer renders it to /etc/gcp-cni/other.json"},
+		},
+		{
+			name: "mapped pool does not exist",
+			stack: Stack{
+				PluginConfig: &config.Config{PoolMappings: map[string]string{"nodes": "ippool-other"}},
+				Pools:        []v1alpha1.IPPool{},
+			},
+			want: []string{"error plugin configuration: poolMappings maps subnetwork nodes to IPPool ippool-other, which does not exist"},
+		},
+		{
+			name: "CIDR differs from the secondary range",
+			stack: Stack{
+				Pools:       []v1alpha1.IPPool{pool("ippool-nodes", "nodes", "10.9.0.0/20")},
+				Subnetworks: subnetworks,
+			},
+			want: []string{"error IPPool ippool-nodes: CIDR 10.9.0.0/20 does not match 10.8.0.0/20 of secondary range live of subnetwork nodes"},
+		},
+		{
+			name:  "no room for the gateway",
+			stack: Stack{Pools: []v1alpha1.IPPool{pool("ippool-nodes", "nodes", "10.8.0.0/31")}},
+			want:  []string{"error IPPool ippool-nodes: CIDR 10.8.0.0/31 leaves no room for the gateway 10.8.0.1 and pod IPs"},
+		},
+		{
+			name: "overlapping pools",
+			stack: Stack{Pools: []v1alpha1.IPPool{
+				pool("ippool-a", "a", "10.8.0.0/20"),
+				pool("ippool-b", "b", "10.8.4.0/24"),
+			}},
+			want: []string{"error IPPool ippool-a: CIDR 10.8.0.0/20 overlaps 10.8.4.0/24 of IPPool ippool-b"},
+		},
+		{
+			name:  "range name differs from the provisioner",
+			stack: Stack{PluginConfig: &config.Config{SecondaryRangeName: "pods"}, SecondaryRangeName: "live"},
+			want:  []string{"warning plugin configuration: secondaryRangeName pods differs from the range live the provisioner provisions"},
+		},
+		{
+			name: "pool range of another cluster",
+			stack: Stack{
+				PluginConfig:       &config.Config{ClusterID: "prod"},
+				Pools:              []v1alpha1.IPPool{otherCluster},
+				SecondaryRangeName: "live-prod",
+			},
+			want: []string{"error IPPool ippool-nodes: secondary range live-eu-prod is not a range of cluster prod, the plugin refuses to attach from it"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, f := range Validate(tt.stack) {
+				got = append(got, f.Severity+" "+f.Source+": "+f.Message)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Validate() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
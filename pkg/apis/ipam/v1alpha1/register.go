@@ -31,6 +31,12 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 	scheme.AddKnownTypes(SchemeGroupVersion,
 		&IPPool{},
 		&IPPoolList{},
+		&FloatingIP{},
+		&FloatingIPList{},
+		&PodIPMigration{},
+		&PodIPMigrationList{},
+		&NodeOnboarding{},
+		&NodeOnboardingList{},
 	)
 	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
 	return nil
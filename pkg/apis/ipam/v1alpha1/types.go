@@ -25,15 +25,137 @@ type IPPoolSpec struct {
 	// Subnet is the GCP subnetwork URL where this pool is allocated
 	Subnet string `json:"subnet"`
 
-	// SecondaryRangeName is the name of the secondary range on the subnet
+	// SecondaryRangeName is the name of the secondary range on the subnet,
+	// empty attaches aliases from the default range of the plugin configuration
 	// +optional
 	SecondaryRangeName string `json:"secondaryRangeName,omitempty"`
 
+	// Class is the reservation class of the pool: Pod pools are used by the
+	// CNI plugin, Service pools by the Service IP controller and Egress pools
+	// by the egress controller. Defaults to Pod.
+	// +optional
+	Class PoolClass `json:"class,omitempty"`
+
+	// SecondaryRanges lets the pool span several secondary ranges of the subnet,
+	// to work within the per-range size limits. When set, CIDR and
+	// SecondaryRangeName are ignored for new allocations.
+	// +optional
+	SecondaryRanges []SecondaryRange `json:"secondaryRanges,omitempty"`
+
+	// RangeStrategy decides how allocations are spread across SecondaryRanges
+	// +optional
+	RangeStrategy RangeStrategy `json:"rangeStrategy,omitempty"`
+
+	// LeaseDuration enables leases on allocations from this pool. Node agents
+	// renew the leases of live pods, allocations whose lease expired are
+	// reclaimed by the garbage collector.
+	// +optional
+	LeaseDuration *metav1.Duration `json:"leaseDuration,omitempty"`
+
+	// MaxIPsPerNode caps the IPs of this pool a single node may hold, so one
+	// node cannot take a disproportionate share of a small pool and stays
+	// under the GCE alias IP limit per network interface. 0 means no limit.
+	// +optional
+	MaxIPsPerNode int `json:"maxIPsPerNode,omitempty"`
+
+	// Draining stops new allocations from the whole pool and lets the
+	// renumbering controller move the pods holding its IPs elsewhere, e.g.
+	// after poolMappings point the subnetwork at a new pool
+	// +optional
+	Draining bool `json:"draining,omitempty"`
+
+	// ReclaimOnExhaustion lets an ADD finding the pool exhausted reclaim IPs
+	// whose pods completed, failed or are gone, verified against the API server
+	// and detached first, before it fails
+	// +optional
+	ReclaimOnExhaustion bool `json:"reclaimOnExhaustion,omitempty"`
+
+	// Vacating are CIDRs within the ranges of the pool no new allocations come
+	// from. Their pods are moved like those of draining ranges, so the pool
+	// can be shrunk or a range removed once nothing is left in them.
+	// +optional
+	Vacating []string `json:"vacating,omitempty"`
+
+	// Firewall names the VPC firewall rules and network tags traffic to and
+	// from the IPs of the pool depends on. The provisioner verifies they exist
+	// and reports the result in the FirewallReady condition.
+	// +optional
+	Firewall *FirewallReferences `json:"firewall,omitempty"`
+
 	// Allocations maps IP addresses to their allocation details
 	// +optional
 	Allocations map[string]IPAllocation `json:"allocations,omitempty"`
 }
 
+// FirewallReferences are the firewall rules and network tags an IPPool
+// expects to exist
+type FirewallReferences struct {
+	// Rules are names of VPC firewall rules that have to exist and be enabled
+	// +optional
+	Rules []string `json:"rules,omitempty"`
+
+	// Tags are network tags every node holding IPs of the pool has to carry,
+	// typically the target tags of Rules
+	// +optional
+	Tags []string `json:"tags,omitempty"`
+}
+
+// IPPoolFirewallReady is the IPPool condition reporting whether the firewall
+// rules and network tags of the pool exist
+const IPPoolFirewallReady = "FirewallReady"
+
+// IPPoolDeletionBlocked is the IPPool condition of a deleted pool whose
+// deletion waits for the IPs it still allocates to be released
+const IPPoolDeletionBlocked = "DeletionBlocked"
+
+// PoolClass is the reservation class of an IPPool
+type PoolClass string
+
+const (
+	// PoolClassPod pools hand out pod IPs attached as alias IPs
+	PoolClassPod PoolClass = "Pod"
+
+	// PoolClassService pools hand out stable internal load balancer IPs
+	PoolClassService PoolClass = "Service"
+
+	// PoolClassEgress pools hand out per-namespace egress IPs attached as
+	// alias IPs to egress gateway nodes
+	PoolClassEgress PoolClass = "Egress"
+)
+
+// SecondaryRange is one secondary range backing an IPPool
+type SecondaryRange struct {
+	// Name is the name of the secondary range on the subnet
+	Name string `json:"name"`
+
+	// CIDR is the IP range of the secondary range
+	CIDR string `json:"cidr"`
+
+	// Weight is the share of allocations the range receives relative to the
+	// other ranges with the Weighted strategy, defaults to 1
+	// +optional
+	Weight int `json:"weight,omitempty"`
+
+	// Draining stops new allocations from the range and lets the renumbering
+	// controller move the pods holding its IPs to the other ranges, so the
+	// range can be removed or the pool consolidated
+	// +optional
+	Draining bool `json:"draining,omitempty"`
+}
+
+// RangeStrategy decides how allocations are spread across secondary ranges
+type RangeStrategy string
+
+const (
+	// RangeStrategyWeighted keeps each range's share of allocations
+	// proportional to its weight
+	RangeStrategyWeighted RangeStrategy = "Weighted"
+
+	// RangeStrategyFillFirst allocates from the ranges in order, moving to the
+	// next one only when the previous is full
+	RangeStrategyFillFirst RangeStrategy = "FillFirst"
+)
+
 // IPAllocation represents a single IP allocation
 type IPAllocation struct {
 	// PodName is the name of the pod using this IP
@@ -48,18 +170,84 @@ type IPAllocation struct {
 	// NodeName is the node where this IP is assigned
 	NodeName string `json:"nodeName"`
 
+	// ServiceNamespace is the namespace of the Service holding this IP, only
+	// set in Service class pools
+	// +optional
+	ServiceNamespace string `json:"serviceNamespace,omitempty"`
+
+	// ServiceName is the name of the Service holding this IP
+	// +optional
+	ServiceName string `json:"serviceName,omitempty"`
+
+	// ServiceUID is the unique identifier of the Service holding this IP
+	// +optional
+	ServiceUID string `json:"serviceUID,omitempty"`
+
+	// FloatingIP is the namespace/name of the FloatingIP holding this IP.
+	// NodeName is the node the IP is attached to.
+	// +optional
+	FloatingIP string `json:"floatingIP,omitempty"`
+
+	// EgressNamespace is the namespace whose egress traffic leaves with this
+	// IP, only set in Egress class pools. NodeName is the gateway node.
+	// +optional
+	EgressNamespace string `json:"egressNamespace,omitempty"`
+
+	// System marks an address the network itself uses, e.g. the gateway of
+	// a range. The allocator maintains these reservations, they are never
+	// handed out or released.
+	// +optional
+	System SystemReservation `json:"system,omitempty"`
+
+	// Buffered marks an IP NodeName pre-claimed for ADDs that cannot reach
+	// the IPPool. Once a pod took it, the installer of the node hands the
+	// allocation over to the pod.
+	// +optional
+	Buffered bool `json:"buffered,omitempty"`
+
+	// Protected keeps lease GC, drift repairs and node drains from reclaiming
+	// the allocation, only the DEL of its pod or an operator releases it
+	// +optional
+	Protected bool `json:"protected,omitempty"`
+
+	// Additional marks an IP the pod holds besides its primary one, when it
+	// asks for several IPs on its interface
+	// +optional
+	Additional bool `json:"additional,omitempty"`
+
 	// AllocatedAt is the timestamp when the IP was allocated
 	// +optional
 	AllocatedAt metav1.Time `json:"allocatedAt,omitempty"`
+
+	// LeaseExpiresAt is when the allocation becomes reclaimable unless renewed,
+	// only set when the pool has a LeaseDuration
+	// +optional
+	LeaseExpiresAt *metav1.Time `json:"leaseExpiresAt,omitempty"`
 }
 
+// SystemReservation is the role of an address reserved for the network
+type SystemReservation string
+
+const (
+	// SystemReservationNetwork is the first address of a range
+	SystemReservationNetwork SystemReservation = "Network"
+
+	// SystemReservationGateway is the first usable address of a range, the
+	// default gateway the plugin hands to pods
+	SystemReservationGateway SystemReservation = "Gateway"
+
+	// SystemReservationBroadcast is the last address of an IPv4 range
+	SystemReservationBroadcast SystemReservation = "Broadcast"
+)
+
 // IPPoolStatus represents the observed state of IPPool
 type IPPoolStatus struct {
-	// Capacity is the total number of IPs in the pool
+	// Capacity is the number of IPs in the pool available to workloads,
+	// system reservations excluded
 	// +optional
 	Capacity int `json:"capacity,omitempty"`
 
-	// Allocated is the number of currently allocated IPs
+	// Allocated is the number of IPs currently allocated to workloads
 	// +optional
 	Allocated int `json:"allocated,omitempty"`
 
@@ -67,9 +255,29 @@ type IPPoolStatus struct {
 	// +optional
 	Available int `json:"available,omitempty"`
 
+	// Draining is the number of allocations still held in draining ranges
+	// +optional
+	Draining int `json:"draining,omitempty"`
+
+	// AllocationsPerDay is the net growth of allocations per day the usage
+	// forecast of the provisioner observed
+	// +optional
+	AllocationsPerDay int `json:"allocationsPerDay,omitempty"`
+
+	// DaysUntilExhaustion is the number of days until the pool runs out of
+	// IPs at that growth, unset while allocations do not grow
+	// +optional
+	DaysUntilExhaustion *int `json:"daysUntilExhaustion,omitempty"`
+
 	// LastUpdated is the last time the status was updated
 	// +optional
 	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
+
+	// Conditions are the observations of the provisioner about the pool
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -81,3 +289,269 @@ type IPPoolList struct {
 
 	Items []IPPool `json:"items"`
 }
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// FloatingIP is an IP from a Pod class IPPool that is attached to one node at a
+// time and moved on demand, e.g. to follow the leader of an active/passive workload
+type FloatingIP struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   FloatingIPSpec   `json:"spec"`
+	Status FloatingIPStatus `json:"status,omitempty"`
+}
+
+// FloatingIPSpec defines the desired state of FloatingIP
+type FloatingIPSpec struct {
+	// Pool is the IPPool the IP is reserved in
+	Pool string `json:"pool"`
+
+	// IP is the address to reserve, the next free one when empty
+	// +optional
+	IP string `json:"ip,omitempty"`
+
+	// PodName is a pod in the FloatingIP's namespace the IP follows to its node.
+	// Takes precedence over NodeName.
+	// +optional
+	PodName string `json:"podName,omitempty"`
+
+	// NodeName is the node the IP should be attached to
+	// +optional
+	NodeName string `json:"nodeName,omitempty"`
+}
+
+// FloatingIPPhase is the lifecycle phase of a FloatingIP
+type FloatingIPPhase string
+
+const (
+	// FloatingIPPending means the IP is reserved but not attached anywhere
+	FloatingIPPending FloatingIPPhase = "Pending"
+
+	// FloatingIPMoving means the IP was fenced off its previous node and is
+	// being attached to the new one
+	FloatingIPMoving FloatingIPPhase = "Moving"
+
+	// FloatingIPAttached means the IP is attached to Status.NodeName
+	FloatingIPAttached FloatingIPPhase = "Attached"
+
+	// FloatingIPFailed means the last reconciliation failed, see Status.Message
+	FloatingIPFailed FloatingIPPhase = "Failed"
+)
+
+// FloatingIPStatus represents the observed state of FloatingIP
+type FloatingIPStatus struct {
+	// IP is the reserved address
+	// +optional
+	IP string `json:"ip,omitempty"`
+
+	// NodeName is the node the IP is attached to
+	// +optional
+	NodeName string `json:"nodeName,omitempty"`
+
+	// Phase is the lifecycle phase of the FloatingIP
+	// +optional
+	Phase FloatingIPPhase `json:"phase,omitempty"`
+
+	// Message explains the last failure
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastTransitionTime is when the phase last changed
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// FloatingIPList contains a list of FloatingIP
+type FloatingIPList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []FloatingIP `json:"items"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PodIPMigration hands the IP of a pod over to the pod replacing it on another
+// node. It lives in the namespace of both pods and is named after the target
+// pod. The target node claims it and moves the alias, the source node records
+// that the source pod let go of the IP, and the provisioner completes the
+// migration or rolls it back.
+type PodIPMigration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PodIPMigrationSpec   `json:"spec"`
+	Status PodIPMigrationStatus `json:"status,omitempty"`
+}
+
+// PodIPMigrationSpec defines the desired state of PodIPMigration
+type PodIPMigrationSpec struct {
+	// IP is the address that moves
+	IP string `json:"ip"`
+
+	// SourcePod is the pod giving up the IP
+	// +optional
+	SourcePod string `json:"sourcePod,omitempty"`
+
+	// SourceNode is the node the IP is attached to when the migration starts
+	SourceNode string `json:"sourceNode"`
+}
+
+// PodIPMigrationPhase is the lifecycle phase of a PodIPMigration
+type PodIPMigrationPhase string
+
+const (
+	// PodIPMigrationPending means no target node claimed the migration yet
+	PodIPMigrationPending PodIPMigrationPhase = "Pending"
+
+	// PodIPMigrationClaimed means the target node owns the migration
+	PodIPMigrationClaimed PodIPMigrationPhase = "Claimed"
+
+	// PodIPMigrationDetached means the alias was removed from the source node
+	PodIPMigrationDetached PodIPMigrationPhase = "Detached"
+
+	// PodIPMigrationAttached means the alias is attached to the target node and
+	// the allocation belongs to the target pod
+	PodIPMigrationAttached PodIPMigrationPhase = "Attached"
+
+	// PodIPMigrationCompleted means the source pod let go of the IP as well
+	PodIPMigrationCompleted PodIPMigrationPhase = "Completed"
+
+	// PodIPMigrationFailed means the target node gave up, see Status.Message.
+	// The provisioner rolls the migration back.
+	PodIPMigrationFailed PodIPMigrationPhase = "Failed"
+
+	// PodIPMigrationRolledBack means the IP was returned to the source node
+	PodIPMigrationRolledBack PodIPMigrationPhase = "RolledBack"
+)
+
+// PodIPMigrationStatus represents the observed state of PodIPMigration
+type PodIPMigrationStatus struct {
+	// Phase is the lifecycle phase of the migration
+	// +optional
+	Phase PodIPMigrationPhase `json:"phase,omitempty"`
+
+	// Pool is the IPPool the IP is allocated in, set by the target node
+	// +optional
+	Pool string `json:"pool,omitempty"`
+
+	// TargetNode is the node that claimed the migration
+	// +optional
+	TargetNode string `json:"targetNode,omitempty"`
+
+	// TargetPodUID is the UID of the target pod that claimed the migration
+	// +optional
+	TargetPodUID string `json:"targetPodUID,omitempty"`
+
+	// SourceReleased is set by the source node once the source pod is torn down
+	// +optional
+	SourceReleased bool `json:"sourceReleased,omitempty"`
+
+	// Message explains the last failure
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastTransitionTime is when the phase last changed
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PodIPMigrationList contains a list of PodIPMigration
+type PodIPMigrationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []PodIPMigration `json:"items"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// NodeOnboarding records how far gcp-ipam got setting a node up. It is
+// cluster-scoped, named after the node and owned by it. The installer reports
+// the plugin binary it installed and the self-test, the provisioner waits for
+// the IPs buffered for the node and then removes its startup taint.
+type NodeOnboarding struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status NodeOnboardingStatus `json:"status,omitempty"`
+}
+
+// NodeOnboardingPhase is the onboarding step a node is at
+type NodeOnboardingPhase string
+
+const (
+	// NodeOnboardingInstalling means the installer did not install the plugin
+	// binary yet
+	NodeOnboardingInstalling NodeOnboardingPhase = "Installing"
+
+	// NodeOnboardingSelfTesting means the binary is installed and the
+	// installer did not report a self-test of it yet
+	NodeOnboardingSelfTesting NodeOnboardingPhase = "SelfTesting"
+
+	// NodeOnboardingPreWarming means the self-test passed and the node waits
+	// for its buffered IPs
+	NodeOnboardingPreWarming NodeOnboardingPhase = "PreWarming"
+
+	// NodeOnboardingReady means the startup taint was removed
+	NodeOnboardingReady NodeOnboardingPhase = "Ready"
+
+	// NodeOnboardingFailed means the self-test failed, see Status.Message. The
+	// node continues once a later self-test passes.
+	NodeOnboardingFailed NodeOnboardingPhase = "Failed"
+)
+
+// NodeOnboardingStatus represents the observed state of NodeOnboarding
+type NodeOnboardingStatus struct {
+	// Phase is the onboarding step the node is at
+	// +optional
+	Phase NodeOnboardingPhase `json:"phase,omitempty"`
+
+	// InstalledVersion is the gcp-ipam release the installer activated
+	// +optional
+	InstalledVersion string `json:"installedVersion,omitempty"`
+
+	// SelfTestVersion is the release whose self-test passed on the node
+	// +optional
+	SelfTestVersion string `json:"selfTestVersion,omitempty"`
+
+	// SelfTestSkipped is set by installers activating releases without a
+	// self-test
+	// +optional
+	SelfTestSkipped bool `json:"selfTestSkipped,omitempty"`
+
+	// SelfTestError is the failure of the last self-test
+	// +optional
+	SelfTestError string `json:"selfTestError,omitempty"`
+
+	// WarmIPs is the number of IPs buffered for the node
+	// +optional
+	WarmIPs int `json:"warmIPs,omitempty"`
+
+	// Message explains the last failure
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastTransitionTime is when the phase last changed
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// NodeOnboardingList contains a list of NodeOnboarding
+type NodeOnboardingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []NodeOnboarding `json:"items"`
+}
@@ -21,13 +21,138 @@ limitations under the License.
 package v1alpha1
 
 import (
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FirewallReferences) DeepCopyInto(out *FirewallReferences) {
+	*out = *in
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FirewallReferences.
+func (in *FirewallReferences) DeepCopy() *FirewallReferences {
+	if in == nil {
+		return nil
+	}
+	out := new(FirewallReferences)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FloatingIP) DeepCopyInto(out *FloatingIP) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FloatingIP.
+func (in *FloatingIP) DeepCopy() *FloatingIP {
+	if in == nil {
+		return nil
+	}
+	out := new(FloatingIP)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *FloatingIP) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FloatingIPList) DeepCopyInto(out *FloatingIPList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]FloatingIP, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FloatingIPList.
+func (in *FloatingIPList) DeepCopy() *FloatingIPList {
+	if in == nil {
+		return nil
+	}
+	out := new(FloatingIPList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *FloatingIPList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FloatingIPSpec) DeepCopyInto(out *FloatingIPSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FloatingIPSpec.
+func (in *FloatingIPSpec) DeepCopy() *FloatingIPSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FloatingIPSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FloatingIPStatus) DeepCopyInto(out *FloatingIPStatus) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FloatingIPStatus.
+func (in *FloatingIPStatus) DeepCopy() *FloatingIPStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(FloatingIPStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IPAllocation) DeepCopyInto(out *IPAllocation) {
 	*out = *in
 	in.AllocatedAt.DeepCopyInto(&out.AllocatedAt)
+	if in.LeaseExpiresAt != nil {
+		in, out := &in.LeaseExpiresAt, &out.LeaseExpiresAt
+		*out = (*in).DeepCopy()
+	}
 	return
 }
 
@@ -105,6 +230,26 @@ func (in *IPPoolList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IPPoolSpec) DeepCopyInto(out *IPPoolSpec) {
 	*out = *in
+	if in.SecondaryRanges != nil {
+		in, out := &in.SecondaryRanges, &out.SecondaryRanges
+		*out = make([]SecondaryRange, len(*in))
+		copy(*out, *in)
+	}
+	if in.LeaseDuration != nil {
+		in, out := &in.LeaseDuration, &out.LeaseDuration
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Vacating != nil {
+		in, out := &in.Vacating, &out.Vacating
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Firewall != nil {
+		in, out := &in.Firewall, &out.Firewall
+		*out = new(FirewallReferences)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Allocations != nil {
 		in, out := &in.Allocations, &out.Allocations
 		*out = make(map[string]IPAllocation, len(*in))
@@ -128,7 +273,19 @@ func (in *IPPoolSpec) DeepCopy() *IPPoolSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IPPoolStatus) DeepCopyInto(out *IPPoolStatus) {
 	*out = *in
+	if in.DaysUntilExhaustion != nil {
+		in, out := &in.DaysUntilExhaustion, &out.DaysUntilExhaustion
+		*out = new(int)
+		**out = **in
+	}
 	in.LastUpdated.DeepCopyInto(&out.LastUpdated)
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -141,3 +298,190 @@ func (in *IPPoolStatus) DeepCopy() *IPPoolStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeOnboarding) DeepCopyInto(out *NodeOnboarding) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeOnboarding.
+func (in *NodeOnboarding) DeepCopy() *NodeOnboarding {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeOnboarding)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NodeOnboarding) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeOnboardingList) DeepCopyInto(out *NodeOnboardingList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]NodeOnboarding, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeOnboardingList.
+func (in *NodeOnboardingList) DeepCopy() *NodeOnboardingList {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeOnboardingList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NodeOnboardingList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeOnboardingStatus) DeepCopyInto(out *NodeOnboardingStatus) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeOnboardingStatus.
+func (in *NodeOnboardingStatus) DeepCopy() *NodeOnboardingStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeOnboardingStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodIPMigration) DeepCopyInto(out *PodIPMigration) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodIPMigration.
+func (in *PodIPMigration) DeepCopy() *PodIPMigration {
+	if in == nil {
+		return nil
+	}
+	out := new(PodIPMigration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *PodIPMigration) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodIPMigrationList) DeepCopyInto(out *PodIPMigrationList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]PodIPMigration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodIPMigrationList.
+func (in *PodIPMigrationList) DeepCopy() *PodIPMigrationList {
+	if in == nil {
+		return nil
+	}
+	out := new(PodIPMigrationList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *PodIPMigrationList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodIPMigrationSpec) DeepCopyInto(out *PodIPMigrationSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodIPMigrationSpec.
+func (in *PodIPMigrationSpec) DeepCopy() *PodIPMigrationSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PodIPMigrationSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodIPMigrationStatus) DeepCopyInto(out *PodIPMigrationStatus) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodIPMigrationStatus.
+func (in *PodIPMigrationStatus) DeepCopy() *PodIPMigrationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PodIPMigrationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecondaryRange) DeepCopyInto(out *SecondaryRange) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecondaryRange.
+func (in *SecondaryRange) DeepCopy() *SecondaryRange {
+	if in == nil {
+		return nil
+	}
+	out := new(SecondaryRange)
+	in.DeepCopyInto(out)
+	return out
+}
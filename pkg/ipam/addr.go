@@ -0,0 +1,45 @@
+package ipam
+
+import (
+	"net/netip"
+)
+
+// ParseAddr parses ip in its canonical form: IPv4-mapped IPv6 addresses such
+// as ::ffff:10.1.2.3 become plain IPv4 addresses and zones are dropped, so
+// one IP always has one representation
+func ParseAddr(ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// CanonicalIP returns ip in the form used as key of IPPool allocations,
+// unparsable input unchanged
+func CanonicalIP(ip string) string {
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	return addr.String()
+}
+
+// ParsePrefix parses cidr in its canonical form, masked and with
+// IPv4-mapped IPv6 prefixes turned into IPv4 prefixes
+func ParsePrefix(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// cidrContains reports whether the CIDR contains addr, false for invalid CIDRs
+func cidrContains(cidr string, addr netip.Addr) bool {
+	prefix, err := ParsePrefix(cidr)
+	return err == nil && prefix.Contains(addr)
+}
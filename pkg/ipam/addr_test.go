@@ -0,0 +1,52 @@
+package ipam
+
+import (
+	"testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestCanonicalIP(t *testing.T) {
+	tests := map[string]string{
+		"10.1.2.3":             "10.1.2.3",
+		"::ffff:10.1.2.3":      "10.1.2.3",
+		"FD00:0:0::1":          "fd00::1",
+		"fe80::1%eth0":         "fe80::1",
+		"not-an-ip":            "not-an-ip",
+		"::ffff:a01:203":       "10.1.2.3",
+		"0:0:0:0:0:ffff:a01:1": "10.1.0.1",
+	}
+	for in, want := range tests {
+		if got := CanonicalIP(in); got != want {
+			t.Errorf("CanonicalIP(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	if got := HostPrefix("::ffff:10.1.2.3"); got != "10.1.2.3/32" {
+		t.Errorf("HostPrefix() = %s, want 10.1.2.3/32", got)
+	}
+	if got := HostPrefix("fd00::1"); got != "fd00::1/128" {
+		t.Errorf("HostPrefix() = %s, want fd00::1/128", got)
+	}
+	if !OwnsAlias("10.1.2.3/32", "live", "::ffff:10.1.2.3", "live") {
+		t.Error("OwnsAlias() did not match the IPv4-mapped form of the alias IP")
+	}
+	if OwnsAlias("10.1.2.0/24", "live", "10.1.2.0", "live") {
+		t.Error("OwnsAlias() matched a range wider than a single address")
+	}
+}
+
+func TestAllocationKeysCanonical(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{
+		SecondaryRanges: []v1alpha1.SecondaryRange{
+			{Name: "a", CIDR: "10.1.0.0/24"},
+			{Name: "b", CIDR: "::ffff:10.2.0.0/120", Draining: true},
+		},
+	}}
+	if got := RangeName(pool, "::ffff:10.2.0.9"); got != "b" {
+		t.Errorf("RangeName() = %s, want b", got)
+	}
+	if !isDraining(pool, "10.2.0.9") {
+		t.Error("isDraining() = false for an IP in the IPv4-mapped draining range")
+	}
+}
@@ -0,0 +1,214 @@
+package ipam
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// DefaultAliasRange is the secondary range pod aliases are attached from when
+// the pool does not name one
+const DefaultAliasRange = "live"
+
+// AliasRange returns the secondary range the plugin attaches the alias of an
+// allocation from rangeName from
+func AliasRange(rangeName string) string {
+	if rangeName == "" {
+		return DefaultAliasRange
+	}
+	return rangeName
+}
+
+// ClusterRange returns the secondary range name rangeName takes in the
+// cluster with ID clusterID, suffixed with it unless it is already. An empty
+// clusterID keeps rangeName.
+func ClusterRange(rangeName, clusterID string) string {
+	if clusterID == "" || strings.HasSuffix(rangeName, "-"+clusterID) {
+		return rangeName
+	}
+	return rangeName + "-" + clusterID
+}
+
+// InClusterRange reports whether aliasRange is a secondary range of the
+// cluster with ID clusterID, whose known range names are names: one of them,
+// as ranges were named before the cluster had an ID, or one suffixed with
+// -<clusterID>. The suffix alone does not tell, live-eu-prod ends in -prod
+// but is range live of cluster eu-prod. Without an ID every range is.
+func InClusterRange(aliasRange, clusterID string, names ...string) bool {
+	if clusterID == "" {
+		return true
+	}
+	for _, name := range names {
+		if aliasRange == name || aliasRange == name+"-"+clusterID {
+			return true
+		}
+	}
+	return false
+}
+
+// SubnetworkName returns the name of the subnetwork from its URL or
+// partial path as GCE reports it on network interfaces and pools
+func SubnetworkName(subnetwork string) string {
+	return subnetwork[strings.LastIndex(subnetwork, "/")+1:]
+}
+
+// ParseSubnetwork returns the project, region and name of a subnetwork URL or
+// partial path, the parts it does not name are empty
+func ParseSubnetwork(subnetwork string) (project, region, name string) {
+	parts := strings.Split(subnetwork, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		switch parts[i] {
+		case "projects":
+			project = parts[i+1]
+		case "regions":
+			region = parts[i+1]
+		}
+	}
+	return project, region, SubnetworkName(subnetwork)
+}
+
+// OwnsAlias reports whether the alias IP range cidr attached from aliasRange
+// is the host prefix the plugin attached for ip from rangeName. Instances also carry
+// ranges managed by GKE and other tooling, those are never owned. An empty
+// rangeName, from records that predate it, matches the host prefix in any range.
+func OwnsAlias(cidr, aliasRange, ip, rangeName string) bool {
+	if ip == "" || !IsHostPrefix(cidr, ip) {
+		return false
+	}
+	return rangeName == "" || aliasRange == AliasRange(rangeName)
+}
+
+// HoldsAlias reports whether the alias IP range cidr attached from aliasRange
+// carries ip for the plugin to release. Beyond OwnsAlias that is a wider range
+// holding ip, as migrated or manually added aliases are, when it comes from
+// the named rangeName: ranges of unknown origin may be GKE's.
+func HoldsAlias(cidr, aliasRange, ip, rangeName string) bool {
+	if OwnsAlias(cidr, aliasRange, ip, rangeName) {
+		return true
+	}
+	return rangeName != "" && aliasRange == rangeName && AliasContains(cidr, ip)
+}
+
+// AliasContains reports whether the alias IP range cidr holds ip, whatever
+// its prefix length
+func AliasContains(cidr, ip string) bool {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil {
+		return false
+	}
+	addr, err := ParseAddr(ip)
+	return err == nil && prefix.Contains(addr)
+}
+
+// SplitAlias returns the prefixes covering the alias IP range cidr without
+// ip, largest first. They are empty for the host prefix of ip and nil when
+// cidr does not hold ip.
+func SplitAlias(cidr, ip string) []string {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil {
+		return nil
+	}
+	addr, err := ParseAddr(ip)
+	if err != nil || !prefix.Contains(addr) {
+		return nil
+	}
+
+	rest := []string{}
+	for bits := prefix.Bits() + 1; bits <= addr.BitLen(); bits++ {
+		// The half of the previous prefix that does not hold ip
+		sibling := netip.PrefixFrom(flipBit(addr, bits-1), bits).Masked()
+		rest = append(rest, sibling.String())
+	}
+	return rest
+}
+
+// flipBit returns addr with bit i, counted from the most significant, flipped
+func flipBit(addr netip.Addr, i int) netip.Addr {
+	if addr.Is4() {
+		b := addr.As4()
+		b[i/8] ^= 0x80 >> (i % 8)
+		return netip.AddrFrom4(b)
+	}
+	b := addr.As16()
+	b[i/8] ^= 0x80 >> (i % 8)
+	return netip.AddrFrom16(b)
+}
+
+// StaleAlias reports whether the alias IP range cidr attached to node from
+// aliasRange is of one of pools on subnetwork while none of their allocations
+// of the node falls in it, as aliases a reused instance kept from a previous
+// life are. Allocations naming no node count for every node. Pools naming no
+// secondary range attach from defaultRange. Aliases of ranges no pool of the
+// subnetwork attaches from are not the plugin's and never stale.
+func StaleAlias(pools []v1alpha1.IPPool, node, subnetwork, defaultRange, cidr, aliasRange string) bool {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil {
+		return false
+	}
+	owned := false
+	for i := range pools {
+		pool := &pools[i]
+		if pool.Spec.Subnet != "" && SubnetworkName(pool.Spec.Subnet) != subnetwork {
+			continue
+		}
+		rangeNames := []string{pool.Spec.SecondaryRangeName}
+		if len(pool.Spec.SecondaryRanges) > 0 {
+			rangeNames = rangeNames[:0]
+			for _, r := range pool.Spec.SecondaryRanges {
+				rangeNames = append(rangeNames, r.Name)
+			}
+		}
+		if !slices.ContainsFunc(rangeNames, func(name string) bool {
+			return name == aliasRange || (name == "" && defaultRange == aliasRange)
+		}) {
+			continue
+		}
+		owned = true
+		onNode := func(a v1alpha1.IPAllocation) bool { return a.NodeName == "" || a.NodeName == node }
+		if a, ok := pool.Spec.Allocations[prefix.Addr().String()]; ok && onNode(a) {
+			return false
+		}
+		if prefix.IsSingleIP() {
+			continue
+		}
+		for ip, a := range pool.Spec.Allocations {
+			if addr, err := ParseAddr(ip); err == nil && prefix.Contains(addr) && onNode(a) {
+				return false
+			}
+		}
+	}
+	return owned
+}
+
+// HostPrefix returns ip as the single address prefix of an alias IP range or
+// route, /32 for IPv4 and /128 for IPv6
+func HostPrefix(ip string) string {
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		return ip + "/32"
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()).String()
+}
+
+// HostIP returns the IP of a single address prefix and whether cidr is one
+func HostIP(cidr string) (string, bool) {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil || !prefix.IsSingleIP() {
+		return "", false
+	}
+	return prefix.Addr().String(), true
+}
+
+// IsHostPrefix reports whether cidr is the single address prefix of ip
+func IsHostPrefix(cidr, ip string) bool {
+	host, ok := HostIP(cidr)
+	return ok && host == CanonicalIP(ip)
+}
+
+// RouteName returns the name of the VPC route the plugin programs for ip when
+// the network interface of its node is out of alias IP ranges
+func RouteName(ip string) string {
+	return "gcp-cni-" + strings.NewReplacer(".", "-", ":", "-").Replace(CanonicalIP(ip))
+}
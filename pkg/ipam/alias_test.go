@@ -0,0 +1,189 @@
+package ipam
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestOwnsAlias(t *testing.T) {
+	tests := []struct {
+		name       string
+		cidr       string
+		aliasRange string
+		rangeName  string
+		want       bool
+	}{
+		{name: "pod alias from its range", cidr: "10.1.0.5/32", aliasRange: "pods-a", rangeName: "pods-a", want: true},
+		{name: "default range", cidr: "10.1.0.5/32", aliasRange: "live", want: true},
+		{name: "same IP from another range", cidr: "10.1.0.5/32", aliasRange: "other", rangeName: "pods-a", want: false},
+		{name: "GKE pod range", cidr: "10.1.0.0/24", aliasRange: "gke-pods", rangeName: "pods-a", want: false},
+		{name: "other IP", cidr: "10.1.0.6/32", aliasRange: "pods-a", rangeName: "pods-a", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := OwnsAlias(tt.cidr, tt.aliasRange, "10.1.0.5", tt.rangeName); got != tt.want {
+				t.Errorf("OwnsAlias(%q, %q) = %v, want %v", tt.cidr, tt.aliasRange, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHoldsAlias(t *testing.T) {
+	tests := []struct {
+		name       string
+		cidr       string
+		aliasRange string
+		rangeName  string
+		want       bool
+	}{
+		{name: "host prefix", cidr: "10.1.0.5/32", aliasRange: "live", want: true},
+		{name: "wider alias from its range", cidr: "10.1.0.4/31", aliasRange: "pods-a", rangeName: "pods-a", want: true},
+		{name: "wider alias of unknown range", cidr: "10.1.0.4/31", aliasRange: "live", want: false},
+		{name: "GKE pod range", cidr: "10.1.0.0/24", aliasRange: "gke-pods", rangeName: "pods-a", want: false},
+		{name: "other IPs", cidr: "10.1.0.6/31", aliasRange: "pods-a", rangeName: "pods-a", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HoldsAlias(tt.cidr, tt.aliasRange, "10.1.0.5", tt.rangeName); got != tt.want {
+				t.Errorf("HoldsAlias(%q, %q) = %v, want %v", tt.cidr, tt.aliasRange, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitAlias(t *testing.T) {
+	tests := []struct {
+		cidr string
+		ip   string
+		want []string
+	}{
+		{cidr: "10.1.0.5/32", ip: "10.1.0.5", want: []string{}},
+		{cidr: "10.1.0.4/31", ip: "10.1.0.5", want: []string{"10.1.0.4/32"}},
+		{cidr: "10.1.0.0/28", ip: "10.1.0.5", want: []string{"10.1.0.8/29", "10.1.0.0/30", "10.1.0.6/31", "10.1.0.4/32"}},
+		{cidr: "fd00::/126", ip: "fd00::3", want: []string{"fd00::/127", "fd00::2/128"}},
+		{cidr: "10.1.0.6/31", ip: "10.1.0.5", want: nil},
+	}
+
+	for _, tt := range tests {
+		got := SplitAlias(tt.cidr, tt.ip)
+		if !slices.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("SplitAlias(%q, %q) = %v, want %v", tt.cidr, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestClusterRange(t *testing.T) {
+	tests := []struct {
+		rangeName string
+		clusterID string
+		want      string
+	}{
+		{rangeName: "live", want: "live"},
+		{rangeName: "live", clusterID: "prod", want: "live-prod"},
+		{rangeName: "live-prod", clusterID: "prod", want: "live-prod"},
+	}
+	for _, tt := range tests {
+		got := ClusterRange(tt.rangeName, tt.clusterID)
+		if got != tt.want {
+			t.Errorf("ClusterRange(%q, %q) = %q, want %q", tt.rangeName, tt.clusterID, got, tt.want)
+		}
+		if !InClusterRange(got, tt.clusterID, "live") {
+			t.Errorf("InClusterRange(%q, %q) = false", got, tt.clusterID)
+		}
+	}
+}
+
+func TestInClusterRange(t *testing.T) {
+	tests := []struct {
+		aliasRange string
+		clusterID  string
+		want       bool
+	}{
+		{aliasRange: "gke-pods", want: true},
+		{aliasRange: "live-prod", clusterID: "prod", want: true},
+		{aliasRange: "live", clusterID: "prod", want: true},
+		{aliasRange: "eu-live-prod", clusterID: "prod", want: true},
+		{aliasRange: "live-staging", clusterID: "prod"},
+		{aliasRange: "live-eu-prod", clusterID: "prod"},
+		{aliasRange: "gke-pods-prod", clusterID: "prod"},
+	}
+	for _, tt := range tests {
+		if got := InClusterRange(tt.aliasRange, tt.clusterID, "live", "eu-live-prod"); got != tt.want {
+			t.Errorf("InClusterRange(%q, %q) = %v, want %v", tt.aliasRange, tt.clusterID, got, tt.want)
+		}
+	}
+}
+
+func TestStaleAlias(t *testing.T) {
+	pools := []v1alpha1.IPPool{{
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:   "10.8.0.0/20",
+			Subnet: "projects/p/regions/r/subnetworks/nodes",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.5": {PodName: "a", NodeName: "node-1"},
+				"10.8.0.9": {PodName: "b"},
+				"10.8.0.7": {PodName: "c", NodeName: "node-2"},
+				"10.8.0.1": {PodName: "d", NodeName: "node-2"},
+			},
+		},
+	}}
+
+	tests := []struct {
+		name       string
+		subnetwork string
+		cidr       string
+		aliasRange string
+		want       bool
+	}{
+		{name: "allocated", subnetwork: "nodes", cidr: "10.8.0.5/32", aliasRange: "live", want: false},
+		{name: "unallocated", subnetwork: "nodes", cidr: "10.8.0.6/32", aliasRange: "live", want: true},
+		{name: "allocated on another node", subnetwork: "nodes", cidr: "10.8.0.7/32", aliasRange: "live", want: true},
+		{name: "wider range holding an allocation of another node", subnetwork: "nodes", cidr: "10.8.0.0/30", aliasRange: "live", want: true},
+		{name: "wider range holding an allocation", subnetwork: "nodes", cidr: "10.8.0.8/30", aliasRange: "live", want: false},
+		{name: "wider range without allocations", subnetwork: "nodes", cidr: "10.8.0.12/30", aliasRange: "live", want: true},
+		{name: "range of no pool", subnetwork: "nodes", cidr: "10.9.0.0/24", aliasRange: "gke-pods", want: false},
+		{name: "other subnetwork", subnetwork: "other", cidr: "10.8.0.6/32", aliasRange: "live", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StaleAlias(pools, "node-1", tt.subnetwork, "live", tt.cidr, tt.aliasRange); got != tt.want {
+				t.Errorf("StaleAlias(%q, %q) = %v, want %v", tt.cidr, tt.aliasRange, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubnetworkName(t *testing.T) {
+	for subnetwork, want := range map[string]string{
+		"https://www.googleapis.com/compute/v1/projects/p/regions/r/subnetworks/pods": "pods",
+		"projects/p/regions/r/subnetworks/pods":                                       "pods",
+		"pods":                                                                        "pods",
+	} {
+		if got := SubnetworkName(subnetwork); got != want {
+			t.Errorf("SubnetworkName(%q) = %q, want %q", subnetwork, got, want)
+		}
+	}
+}
+
+func TestParseSubnetwork(t *testing.T) {
+	for subnetwork, want := range map[string][3]string{
+		"https://www.googleapis.com/compute/v1/projects/p/regions/r/subnetworks/pods": {"p", "r", "pods"},
+		"projects/p/regions/r/subnetworks/pods":                                       {"p", "r", "pods"},
+		"pods":                                                                        {"", "", "pods"},
+	} {
+		project, region, name := ParseSubnetwork(subnetwork)
+		if got := [3]string{project, region, name}; got != want {
+			t.Errorf("ParseSubnetwork(%q) = %v, want %v", subnetwork, got, want)
+		}
+	}
+}
+
+func TestRouteName(t *testing.T) {
+	if got, want := RouteName("10.8.0.17"), "gcp-cni-10-8-0-17"; got != want {
+		t.Errorf("RouteName() = %q, want %q", got, want)
+	}
+}
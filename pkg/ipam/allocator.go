@@ -2,27 +2,46 @@ package ipam
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
-	"net"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"path"
 	"time"
 
+	"github.com/castai/gcp-cni/internal/telemetry"
 	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 )
 
 const (
-	// MaxRetries is the maximum number of retries for allocation due to conflicts
+	// MaxRetries is the default number of attempts of a pool update that
+	// conflicts with concurrent ones
 	MaxRetries = 10
-	// RetryDelay is the base delay between retries (with exponential backoff)
+	// RetryDelay is the default base delay between retries (with exponential backoff and jitter)
 	RetryDelay = 100 * time.Millisecond
 )
 
+// RetryPolicy is the backoff of pool updates that conflict with concurrent
+// ones. The delay doubles with every attempt from BaseDelay up to MaxDelay.
+type RetryPolicy struct {
+	// Attempts is the number of tries of an update, at least 1
+	Attempts int
+	// BaseDelay is the delay after the first conflict
+	BaseDelay time.Duration
+	// MaxDelay caps the delay, 0 does not cap it
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is the backoff of allocators unless set otherwise
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{Attempts: MaxRetries, BaseDelay: RetryDelay}
+}
+
 var (
 	// IPPoolGVR is the GroupVersionResource for IPPool
 	IPPoolGVR = schema.GroupVersionResource{
@@ -30,48 +49,111 @@ var (
 		Version:  "v1alpha1",
 		Resource: "ippools",
 	}
+
+	// FloatingIPGVR is the GroupVersionResource for FloatingIP
+	FloatingIPGVR = schema.GroupVersionResource{
+		Group:    "ipam.gcp-cni.cast.ai",
+		Version:  "v1alpha1",
+		Resource: "floatingips",
+	}
+
+	// PodIPMigrationGVR is the GroupVersionResource for PodIPMigration
+	PodIPMigrationGVR = schema.GroupVersionResource{
+		Group:    "ipam.gcp-cni.cast.ai",
+		Version:  "v1alpha1",
+		Resource: "podipmigrations",
+	}
+
+	// NodeOnboardingGVR is the GroupVersionResource for NodeOnboarding
+	NodeOnboardingGVR = schema.GroupVersionResource{
+		Group:    "ipam.gcp-cni.cast.ai",
+		Version:  "v1alpha1",
+		Resource: "nodeonboardings",
+	}
 )
 
+// ErrNodeLimitReached is returned when the node already holds the pool's
+// MaxIPsPerNode IPs
+var ErrNodeLimitReached = fmt.Errorf("node IP limit of pool reached")
+
+// ErrPoolExhausted is returned when no range of the pool the allocation may
+// come from has a free IP
+var ErrPoolExhausted = fmt.Errorf("no available IPs")
+
 // Allocator handles IP allocation from IPPool resources
 type Allocator struct {
+	pools PoolStore
+	// client reaches the PodIPMigration and NodeOnboarding resources, which
+	// only exist in a cluster
 	client dynamic.Interface
+
+	// retry is the backoff between retries on conflicts
+	retry RetryPolicy
+
+	frozen       bool
+	freezeReason string
+
+	limiter PoolLimiter
 }
 
-// NewAllocator creates a new IP allocator
+// NewAllocator creates a new IP allocator of the IPPool resources and
+// migrations and onboardings the client reaches
 func NewAllocator(client dynamic.Interface) *Allocator {
-	return &Allocator{
-		client: client,
+	return New(NewDynamicPoolStore(client), WithClient(client))
+}
+
+// SetRetryPolicy sets the backoff of pool updates that conflict, unset fields
+// keep their defaults
+func (a *Allocator) SetRetryPolicy(policy RetryPolicy) {
+	defaults := DefaultRetryPolicy()
+	if policy.Attempts <= 0 {
+		policy.Attempts = defaults.Attempts
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = defaults.BaseDelay
 	}
+	a.retry = policy
 }
 
 // AllocationRequest contains the details needed to allocate an IP
 type AllocationRequest struct {
-	PoolName     string
-	PodName      string
-	PodNamespace string
-	PodUID       string
-	NodeName     string
-	RequestedIP  string // Optional: specific IP requested (for migration)
+	PoolName     string `json:"poolName"`
+	PodName      string `json:"podName,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodUID       string `json:"podUID,omitempty"`
+	NodeName     string `json:"nodeName,omitempty"`
+	RequestedIP  string `json:"requestedIP,omitempty"` // Optional: specific IP requested (for migration)
+	RangeName    string `json:"rangeName,omitempty"`   // Optional: secondary range to allocate from
+	Protected    bool   `json:"protected,omitempty"`   // Optional: keep GC and repairs from reclaiming the allocation
+	// Optional: address families the IP may be of, in order of preference
+	Families []corev1.IPFamily `json:"families,omitempty"`
 }
 
 // AllocationResult contains the allocated IP and related information
 type AllocationResult struct {
-	IP                 string
-	CIDR               string
-	Subnet             string
-	SecondaryRangeName string
+	IP                 string `json:"ip"`
+	CIDR               string `json:"cidr"`
+	Subnet             string `json:"subnet,omitempty"`
+	SecondaryRangeName string `json:"secondaryRangeName,omitempty"`
+	// Existing is set when the pod already held the IP on the node, e.g.
+	// when kubelet recreated its sandbox
+	Existing bool `json:"existing,omitempty"`
 }
 
 // Allocate allocates an IP address from the specified pool
 // It uses optimistic locking (resourceVersion) to handle concurrent allocations
 func (a *Allocator) Allocate(ctx context.Context, req *AllocationRequest) (*AllocationResult, error) {
+	release, err := a.acquirePool(ctx, req.PoolName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	var lastErr error
 
-	for i := 0; i < MaxRetries; i++ {
+	for i := 0; i < a.retry.Attempts; i++ {
 		if i > 0 {
-			// Exponential backoff
-			delay := RetryDelay * time.Duration(1<<uint(i-1))
-			time.Sleep(delay)
+			a.backoff(i)
 		}
 
 		result, err := a.tryAllocate(ctx, req)
@@ -81,6 +163,7 @@ func (a *Allocator) Allocate(ctx context.Context, req *AllocationRequest) (*Allo
 
 		// If it's a conflict error, retry
 		if errors.IsConflict(err) {
+			telemetry.Retry(ctx, "pool-allocate")
 			lastErr = err
 			continue
 		}
@@ -89,93 +172,135 @@ func (a *Allocator) Allocate(ctx context.Context, req *AllocationRequest) (*Allo
 		return nil, err
 	}
 
-	return nil, fmt.Errorf("failed to allocate IP after %d retries: %w", MaxRetries, lastErr)
+	telemetry.RetriesExhausted(ctx, "pool-allocate")
+	return nil, fmt.Errorf("failed to allocate IP after %d retries: %w", a.retry.Attempts, lastErr)
 }
 
 // tryAllocate attempts a single allocation with optimistic locking
 func (a *Allocator) tryAllocate(ctx context.Context, req *AllocationRequest) (*AllocationResult, error) {
-	// Get the current IPPool
-	poolUnstructured, err := a.client.Resource(IPPoolGVR).Get(ctx, req.PoolName, metav1.GetOptions{})
+	pool, err := a.getPool(ctx, req.PoolName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get IPPool %s: %w", req.PoolName, err)
-	}
-
-	// Convert to IPPool type
-	pool := &v1alpha1.IPPool{}
-	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(poolUnstructured.Object, pool); err != nil {
-		return nil, fmt.Errorf("failed to convert unstructured to IPPool: %w", err)
+		return nil, err
 	}
 
-	// Initialize allocations map if nil
-	if pool.Spec.Allocations == nil {
-		pool.Spec.Allocations = make(map[string]v1alpha1.IPAllocation)
-	}
-
-	var allocatedIP string
-
-	// If a specific IP is requested (migration case), try to allocate it
-	if req.RequestedIP != "" {
-		if _, exists := pool.Spec.Allocations[req.RequestedIP]; exists {
-			return nil, fmt.Errorf("requested IP %s is already allocated", req.RequestedIP)
-		}
-		allocatedIP = req.RequestedIP
-	} else {
-		// Find an available IP
-		availableIP, err := findAvailableIP(pool.Spec.CIDR, pool.Spec.Allocations)
-		if err != nil {
-			return nil, fmt.Errorf("failed to find available IP: %w", err)
-		}
-		allocatedIP = availableIP
+	result, err := a.choose(pool, req)
+	if err != nil || result.Existing {
+		return result, err
 	}
 
 	// Add the allocation
-	pool.Spec.Allocations[allocatedIP] = v1alpha1.IPAllocation{
+	allocation := v1alpha1.IPAllocation{
 		PodName:      req.PodName,
 		PodNamespace: req.PodNamespace,
 		PodUID:       req.PodUID,
 		NodeName:     req.NodeName,
+		Protected:    req.Protected,
 		AllocatedAt:  metav1.Now(),
 	}
+	if pool.Spec.LeaseDuration != nil {
+		allocation.LeaseExpiresAt = leaseExpiry(allocation.AllocatedAt.Time, pool.Spec.LeaseDuration.Duration)
+	}
+	pool.Spec.Allocations[result.IP] = allocation
 
 	// Update status
-	capacity := calculateCapacity(pool.Spec.CIDR)
-	pool.Status.Capacity = capacity
-	pool.Status.Allocated = len(pool.Spec.Allocations)
-	pool.Status.Available = capacity - pool.Status.Allocated
-	pool.Status.LastUpdated = metav1.Now()
-
-	// Convert back to unstructured
-	updatedUnstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert IPPool to unstructured: %w", err)
-	}
+	updatePoolStatus(pool)
 
 	// Update with optimistic locking (resourceVersion check)
-	_, err = a.client.Resource(IPPoolGVR).Update(ctx, &unstructured.Unstructured{Object: updatedUnstructured}, metav1.UpdateOptions{})
-	if err != nil {
+	if err := a.pools.UpdatePool(ctx, pool); err != nil {
 		return nil, err // Will be IsConflict error if another update happened
 	}
 
+	return result, nil
+}
+
+// PreviewAllocation returns the allocation Allocate would make for req right
+// now, without changing the pool
+func (a *Allocator) PreviewAllocation(ctx context.Context, req *AllocationRequest) (*AllocationResult, error) {
+	pool, err := a.getPool(ctx, req.PoolName)
+	if err != nil {
+		return nil, err
+	}
+	return a.choose(pool, req)
+}
+
+// choose picks the IP of pool for req: the one the pod already holds on the
+// node, the requested one or a free one. System IPs are reserved in pool.
+func (a *Allocator) choose(pool *v1alpha1.IPPool, req *AllocationRequest) (*AllocationResult, error) {
+	// Service and Egress class pools are managed by their controllers only
+	if pool.Spec.Class == v1alpha1.PoolClassService || pool.Spec.Class == v1alpha1.PoolClassEgress {
+		return nil, fmt.Errorf("IPPool %s is reserved for %s IPs", req.PoolName, pool.Spec.Class)
+	}
+
+	// A recreated sandbox of the pod gets the IP it already owns instead of
+	// leaking it
+	if req.RequestedIP == "" {
+		if ip, ok := podAllocation(pool, req.PodUID, req.NodeName); ok {
+			result := resultForIP(pool, ip)
+			result.Existing = true
+			return result, nil
+		}
+	}
+
+	// Migrations keep their IP, everything else has to go elsewhere
+	if pool.Spec.Draining && req.RequestedIP == "" {
+		return nil, fmt.Errorf("IPPool %s is draining", req.PoolName)
+	}
+	if pool.DeletionTimestamp != nil {
+		return nil, fmt.Errorf("IPPool %s is being deleted", req.PoolName)
+	}
+
+	if err := a.checkFrozen(); err != nil {
+		return nil, err
+	}
+
+	reserveSystemIPs(pool)
+
+	if limit := pool.Spec.MaxIPsPerNode; limit > 0 {
+		if held := nodeAllocations(pool, req.NodeName); held >= limit {
+			return nil, fmt.Errorf("%w: node %s holds %d IPs of pool %s, limit is %d", ErrNodeLimitReached, req.NodeName, held, req.PoolName, limit)
+		}
+	}
+
+	var allocatedIP string
+	var allocatedRange v1alpha1.SecondaryRange
+
+	// If a specific IP is requested (migration case), try to allocate it
+	if req.RequestedIP != "" {
+		allocatedIP = CanonicalIP(req.RequestedIP)
+		if _, exists := pool.Spec.Allocations[allocatedIP]; exists {
+			return nil, fmt.Errorf("requested IP %s is already allocated", allocatedIP)
+		}
+		if isVacating(pool, allocatedIP) {
+			return nil, fmt.Errorf("requested IP %s is in a vacating slice of IPPool %s", allocatedIP, req.PoolName)
+		}
+		allocatedRange = rangeForIP(pool, allocatedIP)
+	} else {
+		// Find an available IP, spreading allocations across the pool's ranges
+		family, err := chooseFamily(pool, req.Families)
+		if err != nil {
+			return nil, err
+		}
+		allocatedIP, allocatedRange, err = allocateFromFamilyRanges(pool, req.RangeName, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find available IP: %w", err)
+		}
+	}
+
 	return &AllocationResult{
 		IP:                 allocatedIP,
-		CIDR:               pool.Spec.CIDR,
+		CIDR:               allocatedRange.CIDR,
 		Subnet:             pool.Spec.Subnet,
-		SecondaryRangeName: pool.Spec.SecondaryRangeName,
+		SecondaryRangeName: allocatedRange.Name,
 	}, nil
 }
 
 // GetAllocation retrieves allocation information for an existing IP without modifying the pool
 func (a *Allocator) GetAllocation(ctx context.Context, poolName, ip string) (*AllocationResult, error) {
-	// Get the current IPPool
-	poolUnstructured, err := a.client.Resource(IPPoolGVR).Get(ctx, poolName, metav1.GetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get IPPool %s: %w", poolName, err)
-	}
+	ip = CanonicalIP(ip)
 
-	// Convert to IPPool type
-	pool := &v1alpha1.IPPool{}
-	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(poolUnstructured.Object, pool); err != nil {
-		return nil, fmt.Errorf("failed to convert unstructured to IPPool: %w", err)
+	pool, err := a.getPool(ctx, poolName)
+	if err != nil {
+		return nil, err
 	}
 
 	// Check if the IP is allocated
@@ -187,22 +312,23 @@ func (a *Allocator) GetAllocation(ctx context.Context, poolName, ip string) (*Al
 		return nil, fmt.Errorf("IP %s not found in pool %s", ip, poolName)
 	}
 
-	return &AllocationResult{
-		IP:                 ip,
-		CIDR:               pool.Spec.CIDR,
-		Subnet:             pool.Spec.Subnet,
-		SecondaryRangeName: pool.Spec.SecondaryRangeName,
-	}, nil
+	return resultForIP(pool, ip), nil
 }
 
 // Release releases an IP address back to the pool
 func (a *Allocator) Release(ctx context.Context, poolName, ip string) error {
+	ip = CanonicalIP(ip)
+	release, err := a.acquirePool(ctx, poolName)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	var lastErr error
 
-	for i := 0; i < MaxRetries; i++ {
+	for i := 0; i < a.retry.Attempts; i++ {
 		if i > 0 {
-			delay := RetryDelay * time.Duration(1<<uint(i-1))
-			time.Sleep(delay)
+			a.backoff(i)
 		}
 
 		err := a.tryRelease(ctx, poolName, ip)
@@ -211,6 +337,7 @@ func (a *Allocator) Release(ctx context.Context, poolName, ip string) error {
 		}
 
 		if errors.IsConflict(err) {
+			telemetry.Retry(ctx, "pool-release")
 			lastErr = err
 			continue
 		}
@@ -218,129 +345,289 @@ func (a *Allocator) Release(ctx context.Context, poolName, ip string) error {
 		return err
 	}
 
-	return fmt.Errorf("failed to release IP after %d retries: %w", MaxRetries, lastErr)
+	telemetry.RetriesExhausted(ctx, "pool-release")
+	return fmt.Errorf("failed to release IP after %d retries: %w", a.retry.Attempts, lastErr)
+}
+
+// ReleaseIfOwner releases the IP only while it is still allocated to the pod
+// with podUID, so a deferred release never frees an IP handed out again in the
+// meantime. It reports whether the IP was released.
+func (a *Allocator) ReleaseIfOwner(ctx context.Context, poolName, ip, podUID string) (bool, error) {
+	ip = CanonicalIP(ip)
+	released := false
+	err := a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		released = false
+		allocation, ok := pool.Spec.Allocations[ip]
+		if !ok || allocation.PodUID != podUID {
+			return errSkipUpdate
+		}
+		delete(pool.Spec.Allocations, ip)
+		released = true
+		return nil
+	})
+	return released, err
 }
 
 // tryRelease attempts a single IP release with optimistic locking
 func (a *Allocator) tryRelease(ctx context.Context, poolName, ip string) error {
-	// Get the current IPPool
-	poolUnstructured, err := a.client.Resource(IPPoolGVR).Get(ctx, poolName, metav1.GetOptions{})
+	pool, err := a.getPool(ctx, poolName)
 	if err != nil {
-		return fmt.Errorf("failed to get IPPool %s: %w", poolName, err)
-	}
-
-	// Convert to IPPool type
-	pool := &v1alpha1.IPPool{}
-	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(poolUnstructured.Object, pool); err != nil {
-		return fmt.Errorf("failed to convert unstructured to IPPool: %w", err)
+		return err
 	}
 
-	// Remove the allocation
-	if pool.Spec.Allocations != nil {
+	// Remove the allocation, system reservations stay
+	if allocation, ok := pool.Spec.Allocations[ip]; ok && allocation.System == "" {
 		delete(pool.Spec.Allocations, ip)
 	}
+	reserveSystemIPs(pool)
 
 	// Update status
-	capacity := calculateCapacity(pool.Spec.CIDR)
-	pool.Status.Capacity = capacity
-	pool.Status.Allocated = len(pool.Spec.Allocations)
-	pool.Status.Available = capacity - pool.Status.Allocated
-	pool.Status.LastUpdated = metav1.Now()
-
-	// Convert back to unstructured
-	updatedUnstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
-	if err != nil {
-		return fmt.Errorf("failed to convert IPPool to unstructured: %w", err)
-	}
+	updatePoolStatus(pool)
 
 	// Update with optimistic locking
-	_, err = a.client.Resource(IPPoolGVR).Update(ctx, &unstructured.Unstructured{Object: updatedUnstructured}, metav1.UpdateOptions{})
-	return err
+	return a.pools.UpdatePool(ctx, pool)
 }
 
-// findAvailableIP finds the first available IP in the CIDR range
-func findAvailableIP(cidr string, allocations map[string]v1alpha1.IPAllocation) (string, error) {
-	ip, ipNet, err := net.ParseCIDR(cidr)
+// modifyPool applies mutate to the current IPPool and writes it back, retrying
+// on conflicts like Allocate and Release do. Status is recalculated after the
+// mutation. When mutate returns errSkipUpdate the pool is left untouched.
+func (a *Allocator) modifyPool(ctx context.Context, poolName string, mutate func(pool *v1alpha1.IPPool) error) error {
+	release, err := a.acquirePool(ctx, poolName)
 	if err != nil {
-		return "", fmt.Errorf("invalid CIDR %s: %w", cidr, err)
+		return err
 	}
+	defer release()
 
-	// Start from the first IP in the range
-	currentIP := ip.Mask(ipNet.Mask)
+	var lastErr error
 
-	// Skip network address (first IP)
-	currentIP = nextIP(currentIP)
+	for i := 0; i < a.retry.Attempts; i++ {
+		if i > 0 {
+			a.backoff(i)
+		}
 
-	// Iterate through the range
-	for ipNet.Contains(currentIP) {
-		ipStr := currentIP.String()
+		err := a.tryModifyPool(ctx, poolName, mutate)
+		if err == nil || err == errSkipUpdate {
+			return nil
+		}
 
-		// Skip broadcast address (last IP in range)
-		if isBroadcast(currentIP, ipNet) {
-			break
+		if errors.IsConflict(err) {
+			telemetry.Retry(ctx, "pool-update")
+			lastErr = err
+			continue
 		}
 
-		// Check if this IP is available
-		if _, exists := allocations[ipStr]; !exists {
-			return ipStr, nil
+		return err
+	}
+
+	telemetry.RetriesExhausted(ctx, "pool-update")
+	return fmt.Errorf("failed to update IPPool %s after %d retries: %w", poolName, a.retry.Attempts, lastErr)
+}
+
+// backoff sleeps before retry attempt, exponentially longer with every
+// attempt up to the cap of the policy and jittered, so callers that
+// conflicted on the same pool do not retry in lockstep
+func (a *Allocator) backoff(attempt int) {
+	if delay := a.retry.delay(attempt); delay > 0 {
+		time.Sleep(rand.N(delay + 1))
+	}
+}
+
+// delay is the longest backoff before retry attempt. It is capped before
+// doubling, so large base delays and attempt counts do not overflow.
+func (r RetryPolicy) delay(attempt int) time.Duration {
+	limit := time.Duration(math.MaxInt64 - 1)
+	if r.MaxDelay > 0 {
+		limit = min(r.MaxDelay, limit)
+	}
+	delay := min(max(r.BaseDelay, 0), limit)
+	for i := 1; i < attempt && delay < limit; i++ {
+		if delay > limit/2 {
+			return limit
 		}
+		delay *= 2
+	}
+	return delay
+}
 
-		currentIP = nextIP(currentIP)
+// errSkipUpdate tells modifyPool that mutate made no changes
+var errSkipUpdate = fmt.Errorf("no changes to IPPool")
+
+func (a *Allocator) tryModifyPool(ctx context.Context, poolName string, mutate func(pool *v1alpha1.IPPool) error) error {
+	pool, err := a.getPool(ctx, poolName)
+	if err != nil {
+		return err
 	}
 
-	return "", fmt.Errorf("no available IPs in CIDR %s", cidr)
+	reserveSystemIPs(pool)
+
+	if err := mutate(pool); err != nil {
+		return err
+	}
+
+	updatePoolStatus(pool)
+
+	return a.pools.UpdatePool(ctx, pool)
+}
+
+// ListPools returns all IPPools in the cluster
+func (a *Allocator) ListPools(ctx context.Context) ([]v1alpha1.IPPool, error) {
+	pools, err := a.pools.ListPools(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IPPools: %w", err)
+	}
+	return pools, nil
 }
 
-// nextIP returns the next IP address
-func nextIP(ip net.IP) net.IP {
-	next := make(net.IP, len(ip))
-	copy(next, ip)
+// FindPoolForRange returns the name of the IPPool backed by the named secondary
+// range of the subnetwork
+func (a *Allocator) FindPoolForRange(ctx context.Context, subnetwork, rangeName string) (string, error) {
+	pools, err := a.ListPools(ctx)
+	if err != nil {
+		return "", err
+	}
 
-	for i := len(next) - 1; i >= 0; i-- {
-		next[i]++
-		if next[i] > 0 {
-			break
+	for _, pool := range pools {
+		if path.Base(pool.Spec.Subnet) != subnetwork {
+			continue
+		}
+		for _, r := range poolRanges(&pool) {
+			if r.Name == rangeName {
+				return pool.Name, nil
+			}
 		}
 	}
+	return "", fmt.Errorf("no IPPool for secondary range %s of subnetwork %s", rangeName, subnetwork)
+}
 
-	return next
+// PoolExists reports whether the named IPPool exists
+func (a *Allocator) PoolExists(ctx context.Context, poolName string) (bool, error) {
+	_, err := a.pools.GetPool(ctx, poolName)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get IPPool %s: %w", poolName, err)
+	}
+	return true, nil
 }
 
-// isBroadcast checks if an IP is the broadcast address for the network
-func isBroadcast(ip net.IP, ipNet *net.IPNet) bool {
-	broadcast := make(net.IP, len(ip))
-	for i := range ip {
-		broadcast[i] = ip[i] | ^ipNet.Mask[i]
+// CreatePool creates pool with its system IPs reserved and its status
+// calculated. The error of a pool that exists already satisfies
+// errors.IsAlreadyExists.
+func (a *Allocator) CreatePool(ctx context.Context, pool *v1alpha1.IPPool) error {
+	pool = pool.DeepCopy()
+	pool.TypeMeta = metav1.TypeMeta{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: "IPPool"}
+	if pool.Spec.Allocations == nil {
+		pool.Spec.Allocations = map[string]v1alpha1.IPAllocation{}
 	}
-	return ip.Equal(broadcast)
+	reserveSystemIPs(pool)
+	updatePoolStatus(pool)
+
+	if err := a.pools.CreatePool(ctx, pool); err != nil {
+		return fmt.Errorf("failed to create IPPool %s: %w", pool.Name, err)
+	}
+	return nil
 }
 
-// calculateCapacity calculates the total number of usable IPs in a CIDR range
-func calculateCapacity(cidr string) int {
-	_, ipNet, err := net.ParseCIDR(cidr)
+// getPool fetches and converts the named IPPool
+func (a *Allocator) getPool(ctx context.Context, poolName string) (*v1alpha1.IPPool, error) {
+	pool, err := a.pools.GetPool(ctx, poolName)
 	if err != nil {
-		return 0
+		return nil, fmt.Errorf("failed to get IPPool %s: %w", poolName, err)
+	}
+	return pool, nil
+}
+
+// maxCapacity caps IP counters, an IPv6 /64 alone holds 2^64 addresses
+const maxCapacity = math.MaxInt32
+
+// findAvailableIP finds the first available IP in the CIDR range
+func findAvailableIP(cidr string, allocations map[string]v1alpha1.IPAllocation) (string, error) {
+	return findAvailableIPOutside(cidr, allocations, nil)
+}
+
+// findAvailableIPOutside is findAvailableIP skipping the addresses of the
+// excluded CIDRs, e.g. the vacating slices of a pool
+func findAvailableIPOutside(cidr string, allocations map[string]v1alpha1.IPAllocation, excluded []string) (string, error) {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid CIDR %s: %w", cidr, err)
+	}
+	var skip []netip.Prefix
+	for _, e := range excluded {
+		if p, err := ParsePrefix(e); err == nil && p.Overlaps(prefix) {
+			skip = append(skip, p.Masked())
+		}
 	}
 
-	ones, bits := ipNet.Mask.Size()
-	// Total IPs = 2^(bits - ones)
-	// Usable IPs = Total - 2 (network and broadcast addresses)
-	totalIPs := 1 << uint(bits-ones)
+	// Stops after the last address of the range, or when it wraps at the end of the address space
+next:
+	for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+		if isReserved(addr, prefix) {
+			continue
+		}
+		for _, p := range skip {
+			if p.Contains(addr) {
+				addr = lastAddr(p)
+				continue next
+			}
+		}
+		if _, exists := allocations[addr.String()]; !exists {
+			return addr.String(), nil
+		}
+	}
 
-	// For /32, there's only 1 usable IP
-	if ones == bits {
-		return 1
+	return "", fmt.Errorf("no available IPs in CIDR %s", cidr)
+}
+
+// isReserved reports whether addr is an address findAvailableIP never hands
+// out: the network address (the subnet-router anycast address of IPv6), the
+// gateway right after it and the broadcast address of IPv4 ranges.
+// Point-to-point ranges (/31, /32, /127 and /128) use all of their addresses.
+func isReserved(addr netip.Addr, prefix netip.Prefix) bool {
+	if hostBits(prefix) < 2 {
+		return false
+	}
+	network := prefix.Masked().Addr()
+	if addr == network || addr == network.Next() {
+		return true
+	}
+	return addr.Is4() && addr == lastAddr(prefix)
+}
+
+// lastAddr returns the last address of the prefix, the broadcast address of IPv4 ranges
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
 	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
 
-	// For others, subtract network and broadcast addresses
-	return totalIPs - 2
+func hostBits(prefix netip.Prefix) int {
+	return prefix.Addr().BitLen() - prefix.Bits()
 }
 
-// ipToInt converts an IP address to uint32
-func ipToInt(ip net.IP) uint32 {
-	ip = ip.To4()
-	if ip == nil {
+// calculateCapacity calculates the number of usable IPs in a CIDR range,
+// capped at maxCapacity
+func calculateCapacity(cidr string) int {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil {
 		return 0
 	}
-	return binary.BigEndian.Uint32(ip)
+
+	bits := hostBits(prefix)
+	if bits > 31 {
+		return maxCapacity
+	}
+	total := 1 << bits
+	switch {
+	case bits < 2:
+		return total
+	case prefix.Addr().Is4():
+		return total - 3
+	default:
+		return total - 2
+	}
 }
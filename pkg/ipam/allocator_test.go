@@ -0,0 +1,219 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestAllocateMaxIPsPerNode(t *testing.T) {
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:          "10.0.0.0/28",
+			MaxIPsPerNode: 2,
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.0.0.2": {PodUID: "a", NodeName: "node-1"},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{IPPoolGVR: "IPPoolList"},
+		&unstructured.Unstructured{Object: obj})
+	allocator := NewAllocator(client)
+
+	allocate := func(uid, node string) error {
+		_, err := allocator.Allocate(context.Background(), &AllocationRequest{PoolName: "pool", PodUID: uid, NodeName: node})
+		return err
+	}
+
+	if err := allocate("b", "node-1"); err != nil {
+		t.Fatalf("allocation below the limit failed: %v", err)
+	}
+	if err := allocate("c", "node-1"); !errors.Is(err, ErrNodeLimitReached) {
+		t.Fatalf("allocation over the limit error = %v, want ErrNodeLimitReached", err)
+	}
+	if err := allocate("d", "node-2"); err != nil {
+		t.Fatalf("allocation on another node failed: %v", err)
+	}
+}
+
+func TestAllocateFrozen(t *testing.T) {
+	ctx := context.Background()
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.0.0.0/28",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.0.0.2": {PodUID: "a", NodeName: "node-1"},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{IPPoolGVR: "IPPoolList"},
+		&unstructured.Unstructured{Object: obj})
+	allocator := NewAllocator(client)
+	allocator.Freeze("incident 42")
+
+	_, err = allocator.Allocate(ctx, &AllocationRequest{PoolName: "pool", PodUID: "b", NodeName: "node-1"})
+	if !errors.Is(err, ErrFrozen) {
+		t.Fatalf("allocation while frozen error = %v, want ErrFrozen", err)
+	}
+	if released, err := allocator.ReleaseIfOwner(ctx, "pool", "10.0.0.2", "a"); err != nil || !released {
+		t.Fatalf("release while frozen = %v, %v, want released", released, err)
+	}
+
+	allocator.Unfreeze()
+	if _, err := allocator.Allocate(ctx, &AllocationRequest{PoolName: "pool", PodUID: "b", NodeName: "node-1"}); err != nil {
+		t.Fatalf("allocation after unfreeze failed: %v", err)
+	}
+}
+
+func TestPreviewAllocation(t *testing.T) {
+	ctx := context.Background()
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.0.0.0/28",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.0.0.2": {PodUID: "a", NodeName: "node-1"},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{IPPoolGVR: "IPPoolList"},
+		&unstructured.Unstructured{Object: obj})
+	allocator := NewAllocator(client)
+	req := &AllocationRequest{PoolName: "pool", PodUID: "b", NodeName: "node-1"}
+
+	preview, err := allocator.PreviewAllocation(ctx, req)
+	if err != nil {
+		t.Fatalf("PreviewAllocation() error = %v", err)
+	}
+	again, err := allocator.PreviewAllocation(ctx, req)
+	if err != nil || again.IP != preview.IP {
+		t.Fatalf("second PreviewAllocation() = %v, %v, want %s again as the pool is unchanged", again, err, preview.IP)
+	}
+	result, err := allocator.Allocate(ctx, req)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result.IP != preview.IP {
+		t.Errorf("Allocate() IP = %s, want the previewed %s", result.IP, preview.IP)
+	}
+
+	existing, err := allocator.PreviewAllocation(ctx, &AllocationRequest{PoolName: "pool", PodUID: "a", NodeName: "node-1"})
+	if err != nil || !existing.Existing || existing.IP != "10.0.0.2" {
+		t.Errorf("PreviewAllocation() of a pod holding an IP = %+v, %v, want its existing 10.0.0.2", existing, err)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{RetryPolicy{BaseDelay: 100 * time.Millisecond}, 1, 100 * time.Millisecond},
+		{RetryPolicy{BaseDelay: 100 * time.Millisecond}, 4, 800 * time.Millisecond},
+		{RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, 10, time.Second},
+		{RetryPolicy{BaseDelay: 5 * time.Second, MaxDelay: time.Second}, 1, time.Second},
+		{RetryPolicy{}, 50, 0},
+		// Doubling would overflow long before the attempt
+		{RetryPolicy{BaseDelay: time.Hour, MaxDelay: 24 * time.Hour}, 40, 24 * time.Hour},
+		{RetryPolicy{BaseDelay: time.Hour}, 100, math.MaxInt64 - 1},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.delay(tt.attempt); got != tt.want {
+			t.Errorf("%+v.delay(%d) = %v, want %v", tt.policy, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestFindAvailableIPv6(t *testing.T) {
+	allocations := map[string]v1alpha1.IPAllocation{"fd00::1": {}, "fd00::2": {}}
+	tests := []struct {
+		cidr string
+		want string
+	}{
+		// The subnet-router anycast address and the gateway are reserved, there is no broadcast
+		{"fd00::/120", "fd00::3"},
+		{"fd00::/127", "fd00::"},
+		{"fd00::1/128", ""},
+		{"fd00::ff/128", "fd00::ff"},
+		{"10.0.0.0/30", "10.0.0.2"},
+		{"10.0.0.7/32", "10.0.0.7"},
+	}
+	for _, tt := range tests {
+		got, err := findAvailableIP(tt.cidr, allocations)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("findAvailableIP(%s) = %s, want no available IP", tt.cidr, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("findAvailableIP(%s) = %s, %v, want %s", tt.cidr, got, err, tt.want)
+		}
+	}
+
+	full := map[string]v1alpha1.IPAllocation{"fd00::1": {}, "fd00::2": {}, "fd00::3": {}}
+	if got, err := findAvailableIP("fd00::/126", full); err == nil {
+		t.Errorf("findAvailableIP(fd00::/126) = %s on a full range, want an error", got)
+	}
+	if got, err := findAvailableIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffc/126", nil); err != nil || got != "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe" {
+		t.Errorf("findAvailableIP() at the end of the address space = %s, %v", got, err)
+	}
+}
+
+func TestCalculateCapacity(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want int
+	}{
+		{"10.0.0.0/24", 253},
+		{"10.0.0.0/31", 2},
+		{"10.0.0.1/32", 1},
+		{"fd00::/120", 254},
+		{"fd00::/127", 2},
+		{"fd00::/128", 1},
+		{"fd00::/98", 1<<30 - 2},
+		{"fd00::/96", maxCapacity},
+		{"fd00::/64", maxCapacity},
+		{"fd00::/0", maxCapacity},
+		{"invalid", 0},
+	}
+	for _, tt := range tests {
+		if got := calculateCapacity(tt.cidr); got != tt.want {
+			t.Errorf("calculateCapacity(%s) = %d, want %d", tt.cidr, got, tt.want)
+		}
+	}
+}
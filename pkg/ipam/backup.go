@@ -0,0 +1,184 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// Backup is a snapshot of IPPools to restore the address bookkeeping of the
+// cluster from after a pool was lost
+type Backup struct {
+	CreatedAt time.Time         `json:"createdAt"`
+	Pools     []v1alpha1.IPPool `json:"pools"`
+}
+
+// NewBackup snapshots pools, without the server-side metadata a restore
+// cannot carry over
+func NewBackup(pools []v1alpha1.IPPool, now time.Time) *Backup {
+	backup := &Backup{CreatedAt: now, Pools: make([]v1alpha1.IPPool, 0, len(pools))}
+	for _, pool := range pools {
+		backup.Pools = append(backup.Pools, v1alpha1.IPPool{
+			TypeMeta: metav1.TypeMeta{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: "IPPool"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        pool.Name,
+				Labels:      pool.Labels,
+				Annotations: pool.Annotations,
+			},
+			Spec: *pool.Spec.DeepCopy(),
+		})
+	}
+	return backup
+}
+
+// RestoreConflict is an allocation of a backup that is not restored, or an IP
+// in use the backup does not account for
+type RestoreConflict struct {
+	Pool     string `json:"pool"`
+	IP       string `json:"ip"`
+	Node     string `json:"node,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// RestorePlan is what a restore writes back to a pool
+type RestorePlan struct {
+	Pool string `json:"pool"`
+	// Create is set when the pool does not exist anymore
+	Create      bool                             `json:"create"`
+	Allocations map[string]v1alpha1.IPAllocation `json:"allocations"`
+	Conflicts   []RestoreConflict                `json:"conflicts,omitempty"`
+
+	backup *v1alpha1.IPPool
+}
+
+// PlanRestore plans restoring the allocations of the backed up pool into the
+// live one, nil when it was deleted. Allocations are checked against the IPs
+// attached to instances: one attached to another instance than its node is
+// not restored, and neither is one the live pool allocates by now. IPs of the
+// pool attached without an allocation in either are reported, gcpcnictl
+// verify takes them from there.
+func PlanRestore(backup, live *v1alpha1.IPPool, attached []AttachedIP) *RestorePlan {
+	plan := &RestorePlan{
+		Pool:        backup.Name,
+		Create:      live == nil,
+		Allocations: map[string]v1alpha1.IPAllocation{},
+		backup:      backup,
+	}
+	var current map[string]v1alpha1.IPAllocation
+	if live != nil {
+		current = live.Spec.Allocations
+	}
+
+	attachedTo := map[string]string{}
+	for _, a := range attached {
+		attachedTo[CanonicalIP(a.IP)] = a.Instance
+	}
+
+	ips := make([]string, 0, len(backup.Spec.Allocations))
+	for ip := range backup.Spec.Allocations {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return compareIPs(ips[i], ips[j]) < 0 })
+
+	for _, ip := range ips {
+		allocation := backup.Spec.Allocations[ip]
+		if allocation.System != "" {
+			continue
+		}
+		owner := allocationOwner(allocation)
+		if holder, ok := current[ip]; ok {
+			if allocationOwner(holder) != owner {
+				plan.Conflicts = append(plan.Conflicts, RestoreConflict{
+					Pool: backup.Name, IP: ip, Node: allocation.NodeName, Owner: owner,
+					Reason: fmt.Sprintf("allocated to %s since the backup", allocationOwner(holder)),
+				})
+			}
+			continue
+		}
+		if node := aliasNode(backup, allocation); node != "" {
+			if instance, ok := attachedTo[ip]; ok && instance != node {
+				plan.Conflicts = append(plan.Conflicts, RestoreConflict{
+					Pool: backup.Name, IP: ip, Node: node, Instance: instance, Owner: owner,
+					Reason: "attached to another instance than its node",
+				})
+				continue
+			}
+		}
+		plan.Allocations[ip] = allocation
+	}
+
+	for _, a := range attached {
+		ip := CanonicalIP(a.IP)
+		if poolContaining([]v1alpha1.IPPool{*backup}, ip) == nil {
+			continue
+		}
+		if _, ok := current[ip]; ok {
+			continue
+		}
+		if _, ok := backup.Spec.Allocations[ip]; ok {
+			// Restored or reported above
+			continue
+		}
+		plan.Conflicts = append(plan.Conflicts, RestoreConflict{
+			Pool: backup.Name, IP: ip, Instance: a.Instance,
+			Reason: "attached without an allocation in the backup",
+		})
+	}
+	return plan
+}
+
+// allocationOwner names who holds an allocation, for conflict reports
+func allocationOwner(allocation v1alpha1.IPAllocation) string {
+	switch {
+	case allocation.ServiceName != "":
+		return "service " + allocation.ServiceNamespace + "/" + allocation.ServiceName
+	case allocation.FloatingIP != "":
+		return "floating IP " + allocation.FloatingIP
+	case allocation.EgressNamespace != "":
+		return "egress of " + allocation.EgressNamespace
+	case allocation.PodUID != "":
+		return "pod " + podRef(allocation.PodNamespace, allocation.PodName) + " (" + allocation.PodUID + ")"
+	default:
+		return "node " + allocation.NodeName
+	}
+}
+
+// Restore writes the allocations of plan back. A deleted pool is created, an
+// existing one gets those it does not hold by now.
+func (a *Allocator) Restore(ctx context.Context, plan *RestorePlan) error {
+	if !plan.Create {
+		return a.modifyPool(ctx, plan.Pool, func(pool *v1alpha1.IPPool) error {
+			added := false
+			for ip, allocation := range plan.Allocations {
+				if _, ok := pool.Spec.Allocations[ip]; !ok {
+					pool.Spec.Allocations[ip] = allocation
+					added = true
+				}
+			}
+			if !added {
+				return errSkipUpdate
+			}
+			return nil
+		})
+	}
+
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: plan.Pool, Labels: plan.backup.Labels, Annotations: plan.backup.Annotations},
+		Spec:       *plan.backup.Spec.DeepCopy(),
+	}
+	pool.Spec.Allocations = maps.Clone(plan.Allocations)
+	err := a.CreatePool(ctx, pool)
+	if apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("IPPool %s was created during the restore, restore again to merge into it: %w", pool.Name, err)
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package ipam
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestPlanRestore(t *testing.T) {
+	backup := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "ippool-default"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/16",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.0":  {System: "network"},
+				"10.8.0.5":  {PodUID: "uid-web", NodeName: "node-a"},
+				"10.8.0.6":  {PodUID: "uid-db", NodeName: "node-a"},
+				"10.8.0.7":  {PodUID: "uid-moved", NodeName: "node-a"},
+				"10.8.0.8":  {PodUID: "uid-taken", NodeName: "node-b"},
+				"10.8.0.20": {PodUID: "uid-kept", NodeName: "node-b"},
+			},
+		},
+	}
+	live := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "ippool-default"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/16",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.8":  {PodNamespace: "default", PodName: "new", PodUID: "uid-new", NodeName: "node-c"},
+				"10.8.0.20": {PodUID: "uid-kept", NodeName: "node-b"},
+			},
+		},
+	}
+	attached := []AttachedIP{
+		{IP: "10.8.0.5", Instance: "node-a"},
+		{IP: "10.8.0.7", Instance: "node-c"},
+		{IP: "10.8.0.30", Instance: "node-d"},
+		// Outside the pool
+		{IP: "10.9.0.1", Instance: "node-d"},
+	}
+
+	plan := PlanRestore(backup, live, attached)
+	if plan.Create {
+		t.Error("PlanRestore() creates a pool that exists")
+	}
+	if len(plan.Allocations) != 2 || plan.Allocations["10.8.0.5"].PodUID != "uid-web" || plan.Allocations["10.8.0.6"].PodUID != "uid-db" {
+		t.Errorf("PlanRestore() allocations = %+v, want 10.8.0.5 and 10.8.0.6", plan.Allocations)
+	}
+
+	reasons := map[string]string{}
+	for _, c := range plan.Conflicts {
+		reasons[c.IP] = c.Reason
+	}
+	for ip, reason := range map[string]string{
+		"10.8.0.7":  "attached to another instance than its node",
+		"10.8.0.8":  "allocated to pod default/new (uid-new) since the backup",
+		"10.8.0.30": "attached without an allocation in the backup",
+	} {
+		if reasons[ip] != reason {
+			t.Errorf("conflict of %s = %q, want %q", ip, reasons[ip], reason)
+		}
+	}
+	if len(plan.Conflicts) != 3 {
+		t.Errorf("PlanRestore() conflicts = %+v, want 3", plan.Conflicts)
+	}
+
+	plan = PlanRestore(backup, nil, nil)
+	if !plan.Create || len(plan.Allocations) != 5 {
+		t.Errorf("PlanRestore() of a deleted pool = create %v with %d allocations, want create with 5", plan.Create, len(plan.Allocations))
+	}
+}
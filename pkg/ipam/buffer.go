@@ -0,0 +1,141 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// WarmIPsAnnotation on a node is the number of IPs per pool the provisioner
+// wants buffered on it, sized by the pods waiting for the node
+const WarmIPsAnnotation = "gcp-cni.cast.ai/warm-ips"
+
+// ReserveBuffer tops up the IPs of the pool buffered for nodeName to size and
+// returns all of them. Buffered IPs count against the pool like any other
+// allocation but not against maxIPsPerNode, which only leaves room for as
+// many as the node could still take. Draining and frozen pools keep the
+// buffer they have, a deleted pool takes it back so it does not hold up the
+// deletion. The leases of buffered IPs are renewed here, so buffers of nodes
+// that are gone expire.
+func (a *Allocator) ReserveBuffer(ctx context.Context, poolName, nodeName string, size int) ([]*AllocationResult, error) {
+	var buffered []*AllocationResult
+	err := a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		buffered = nil
+		if pool.Spec.Class != "" && pool.Spec.Class != v1alpha1.PoolClassPod {
+			return fmt.Errorf("IPPool %s is reserved for %s IPs", poolName, pool.Spec.Class)
+		}
+
+		if pool.DeletionTimestamp != nil {
+			changed := false
+			for ip, allocation := range pool.Spec.Allocations {
+				if allocation.Buffered && allocation.NodeName == nodeName {
+					delete(pool.Spec.Allocations, ip)
+					changed = true
+				}
+			}
+			if !changed {
+				return errSkipUpdate
+			}
+			return nil
+		}
+
+		now := time.Now()
+		changed := false
+		for ip, allocation := range pool.Spec.Allocations {
+			if !allocation.Buffered || allocation.NodeName != nodeName {
+				continue
+			}
+			buffered = append(buffered, resultForIP(pool, ip))
+			if duration := pool.Spec.LeaseDuration; duration != nil &&
+				(allocation.LeaseExpiresAt == nil || allocation.LeaseExpiresAt.Sub(now) <= duration.Duration/2) {
+				allocation.LeaseExpiresAt = leaseExpiry(now, duration.Duration)
+				pool.Spec.Allocations[ip] = allocation
+				changed = true
+			}
+		}
+
+		missing := size - len(buffered)
+		if limit := pool.Spec.MaxIPsPerNode; limit > 0 {
+			missing = min(missing, limit-nodeAllocations(pool, nodeName)-len(buffered))
+		}
+		if pool.Spec.Draining || a.checkFrozen() != nil {
+			missing = 0
+		}
+		for range missing {
+			ip, _, err := allocateFromRanges(pool, "")
+			if err != nil {
+				// A full pool keeps the buffer it could fill
+				break
+			}
+			allocation := v1alpha1.IPAllocation{
+				NodeName:    nodeName,
+				Buffered:    true,
+				AllocatedAt: metav1.NewTime(now),
+			}
+			if pool.Spec.LeaseDuration != nil {
+				allocation.LeaseExpiresAt = leaseExpiry(now, pool.Spec.LeaseDuration.Duration)
+			}
+			pool.Spec.Allocations[ip] = allocation
+			buffered = append(buffered, resultForIP(pool, ip))
+			changed = true
+		}
+
+		if !changed {
+			return errSkipUpdate
+		}
+		return nil
+	})
+	sort.Slice(buffered, func(i, j int) bool {
+		return compareIPs(buffered[i].IP, buffered[j].IP) < 0
+	})
+	return buffered, err
+}
+
+// ClaimBuffered hands the IP buffered for req.NodeName over to the pod in req,
+// which took it from the node buffer while the pool was unavailable. It
+// reports false when the IP is no longer buffered for the node, e.g. because
+// the pod was deleted and its IP released meanwhile, or when it is in a
+// vacating slice of the pool.
+func (a *Allocator) ClaimBuffered(ctx context.Context, poolName, ip string, req *AllocationRequest) (bool, error) {
+	ip = CanonicalIP(ip)
+	claimed := false
+	err := a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		claimed = false
+		allocation, ok := pool.Spec.Allocations[ip]
+		if ok && allocation.PodUID == req.PodUID && !allocation.Buffered {
+			claimed = true
+			return errSkipUpdate
+		}
+		if !ok || !allocation.Buffered || allocation.NodeName != req.NodeName || isVacating(pool, ip) {
+			return errSkipUpdate
+		}
+
+		allocation.Buffered = false
+		allocation.PodName = req.PodName
+		allocation.PodNamespace = req.PodNamespace
+		allocation.PodUID = req.PodUID
+		allocation.Protected = req.Protected
+		pool.Spec.Allocations[ip] = allocation
+		claimed = true
+		return nil
+	})
+	return claimed, err
+}
+
+// ReleaseBuffered releases the IP only while it is still buffered for nodeName
+func (a *Allocator) ReleaseBuffered(ctx context.Context, poolName, ip, nodeName string) error {
+	ip = CanonicalIP(ip)
+	return a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		allocation, ok := pool.Spec.Allocations[ip]
+		if !ok || !allocation.Buffered || allocation.NodeName != nodeName {
+			return errSkipUpdate
+		}
+		delete(pool.Spec.Allocations, ip)
+		return nil
+	})
+}
@@ -0,0 +1,96 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestReserveBuffer(t *testing.T) {
+	ctx := context.Background()
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:          "10.0.0.0/28",
+			MaxIPsPerNode: 3,
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.0.0.2": {PodUID: "a", NodeName: "node-1"},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{IPPoolGVR: "IPPoolList"},
+		&unstructured.Unstructured{Object: obj})
+	allocator := NewAllocator(client)
+
+	// The buffer is capped by what the node could still allocate
+	buffered, err := allocator.ReserveBuffer(ctx, "pool", "node-1", 5)
+	if err != nil {
+		t.Fatalf("ReserveBuffer() error = %v", err)
+	}
+	if len(buffered) != 2 {
+		t.Fatalf("ReserveBuffer() = %d IPs, want 2", len(buffered))
+	}
+
+	// Buffered IPs do not count against the node
+	for _, uid := range []string{"b", "c"} {
+		if _, err := allocator.Allocate(ctx, &AllocationRequest{PoolName: "pool", PodUID: uid, NodeName: "node-1"}); err != nil {
+			t.Fatalf("Allocate() next to a buffer error = %v", err)
+		}
+	}
+	if _, err := allocator.Allocate(ctx, &AllocationRequest{PoolName: "pool", PodUID: "e", NodeName: "node-1"}); !errors.Is(err, ErrNodeLimitReached) {
+		t.Fatalf("Allocate() over the limit error = %v, want ErrNodeLimitReached", err)
+	}
+	again, err := allocator.ReserveBuffer(ctx, "pool", "node-1", 5)
+	if err != nil || len(again) != 2 || again[0].IP != buffered[0].IP {
+		t.Fatalf("ReserveBuffer() again = %v, %v, want the same buffer", again, err)
+	}
+
+	// A pod that took a buffered IP while the pool was unavailable
+	req := &AllocationRequest{PoolName: "pool", PodName: "pod", PodNamespace: "default", PodUID: "d", NodeName: "node-2", Protected: true}
+	if claimed, err := allocator.ClaimBuffered(ctx, "pool", buffered[0].IP, req); err != nil || claimed {
+		t.Fatalf("ClaimBuffered() from another node = %v, %v, want false", claimed, err)
+	}
+	req.NodeName = "node-1"
+	if claimed, err := allocator.ClaimBuffered(ctx, "pool", buffered[0].IP, req); err != nil || !claimed {
+		t.Fatalf("ClaimBuffered() = %v, %v, want true", claimed, err)
+	}
+	if claimed, err := allocator.ClaimBuffered(ctx, "pool", buffered[0].IP, req); err != nil || !claimed {
+		t.Fatalf("ClaimBuffered() repeated = %v, %v, want true", claimed, err)
+	}
+	if result, err := allocator.GetAllocation(ctx, "pool", buffered[0].IP); err != nil || result.IP != buffered[0].IP {
+		t.Fatalf("GetAllocation() of claimed IP = %v, %v", result, err)
+	}
+
+	// Only the buffer of the node is released
+	if err := allocator.ReleaseBuffered(ctx, "pool", buffered[0].IP, "node-1"); err != nil {
+		t.Fatalf("ReleaseBuffered() of claimed IP error = %v", err)
+	}
+	if err := allocator.ReleaseBuffered(ctx, "pool", buffered[1].IP, "node-1"); err != nil {
+		t.Fatalf("ReleaseBuffered() error = %v", err)
+	}
+	pools, err := allocator.ListPools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocations := pools[0].Spec.Allocations
+	if allocation, ok := allocations[buffered[0].IP]; !ok || allocation.Buffered || allocation.PodUID != "d" || !allocation.Protected {
+		t.Errorf("claimed allocation = %+v, %v, want pod d protected", allocation, ok)
+	}
+	if _, ok := allocations[buffered[1].IP]; ok {
+		t.Errorf("released buffered IP %s is still allocated", buffered[1].IP)
+	}
+}
@@ -0,0 +1,121 @@
+package ipam
+
+import (
+	"sort"
+	"time"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// MaxAliasRanges is the GCE limit of alias IP ranges per network interface
+const MaxAliasRanges = 100
+
+// PoolCapacity is the usage of a single pool
+type PoolCapacity struct {
+	Pool      string `json:"pool"`
+	Capacity  int    `json:"capacity"`
+	Allocated int    `json:"allocated"`
+	Free      int    `json:"free"`
+	// Buffered counts the allocated IPs nodes hold as warm IPs
+	Buffered int `json:"buffered"`
+}
+
+// NodeAliases is the alias IP ranges of the instance of a node, counted on
+// the network interface carrying the most
+type NodeAliases struct {
+	Node        string `json:"node"`
+	AliasRanges int    `json:"aliasRanges"`
+}
+
+// NodeCapacity is the IPs a node holds and the alias IP ranges left on it
+type NodeCapacity struct {
+	Node string `json:"node"`
+	// Allocated counts the IPs of all pools allocated on the node
+	Allocated   int `json:"allocated"`
+	AliasRanges int `json:"aliasRanges"`
+	// Headroom is the alias IP ranges the node can still take before it hits
+	// MaxAliasRanges
+	Headroom int `json:"headroom"`
+}
+
+// NamespaceUsage counts the IPs held by a namespace
+type NamespaceUsage struct {
+	Namespace string `json:"namespace"`
+	IPs       int    `json:"ips"`
+}
+
+// CapacityReport is the IP usage across all pools and nodes
+type CapacityReport struct {
+	GeneratedAt time.Time        `json:"generatedAt"`
+	Capacity    int              `json:"capacity"`
+	Allocated   int              `json:"allocated"`
+	Free        int              `json:"free"`
+	Pools       []PoolCapacity   `json:"pools"`
+	Nodes       []NodeCapacity   `json:"nodes"`
+	Namespaces  []NamespaceUsage `json:"namespaces"`
+}
+
+// Capacity aggregates the usage of pools, system reservations aside, and the
+// alias headroom of nodes. Nodes are sorted by headroom, the least first,
+// and only the top namespaces by IPs held are listed, all of them when top is 0.
+func Capacity(pools []v1alpha1.IPPool, nodes []NodeAliases, top int, now time.Time) *CapacityReport {
+	report := &CapacityReport{GeneratedAt: now}
+	allocatedOnNode := map[string]int{}
+	byNamespace := map[string]int{}
+
+	sorted := make([]*v1alpha1.IPPool, len(pools))
+	for i := range pools {
+		sorted[i] = &pools[i]
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	for _, pool := range sorted {
+		usage := PoolCapacity{Pool: pool.Name, Capacity: poolCapacity(pool)}
+		for _, allocation := range userAllocations(pool) {
+			usage.Allocated++
+			if allocation.Buffered {
+				usage.Buffered++
+			}
+			if allocation.NodeName != "" {
+				allocatedOnNode[allocation.NodeName]++
+			}
+			if namespace := allocationNamespace(allocation); namespace != "" {
+				byNamespace[namespace]++
+			}
+		}
+		usage.Free = max(usage.Capacity-usage.Allocated, 0)
+		report.Capacity = min(report.Capacity+usage.Capacity, maxCapacity)
+		report.Allocated += usage.Allocated
+		report.Pools = append(report.Pools, usage)
+	}
+	report.Free = max(report.Capacity-report.Allocated, 0)
+
+	for _, node := range nodes {
+		report.Nodes = append(report.Nodes, NodeCapacity{
+			Node:        node.Node,
+			Allocated:   allocatedOnNode[node.Node],
+			AliasRanges: node.AliasRanges,
+			Headroom:    max(MaxAliasRanges-node.AliasRanges, 0),
+		})
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		if report.Nodes[i].Headroom != report.Nodes[j].Headroom {
+			return report.Nodes[i].Headroom < report.Nodes[j].Headroom
+		}
+		return report.Nodes[i].Node < report.Nodes[j].Node
+	})
+
+	for namespace, ips := range byNamespace {
+		report.Namespaces = append(report.Namespaces, NamespaceUsage{Namespace: namespace, IPs: ips})
+	}
+	sort.Slice(report.Namespaces, func(i, j int) bool {
+		if report.Namespaces[i].IPs != report.Namespaces[j].IPs {
+			return report.Namespaces[i].IPs > report.Namespaces[j].IPs
+		}
+		return report.Namespaces[i].Namespace < report.Namespaces[j].Namespace
+	})
+	if top > 0 && len(report.Namespaces) > top {
+		report.Namespaces = report.Namespaces[:top]
+	}
+	return report
+}
@@ -0,0 +1,45 @@
+package ipam
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestCapacity(t *testing.T) {
+	pools := []v1alpha1.IPPool{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "ippool-b"},
+			Spec: v1alpha1.IPPoolSpec{CIDR: "10.9.0.0/29", Allocations: map[string]v1alpha1.IPAllocation{
+				"10.9.0.0": {System: v1alpha1.SystemReservationNetwork},
+				"10.9.0.2": {PodNamespace: "db", PodUID: "uid-c", NodeName: "node-b"},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "ippool-a"},
+			Spec: v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/29", Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.2": {PodNamespace: "web", PodUID: "uid-a", NodeName: "node-a"},
+				"10.8.0.3": {PodNamespace: "web", PodUID: "uid-b", NodeName: "node-a"},
+				"10.8.0.4": {NodeName: "node-a", Buffered: true},
+			}},
+		},
+	}
+	nodes := []NodeAliases{{Node: "node-a", AliasRanges: 3}, {Node: "node-b", AliasRanges: 98}}
+
+	report := Capacity(pools, nodes, 1, time.Now())
+	if report.Capacity != 10 || report.Allocated != 4 || report.Free != 6 {
+		t.Errorf("Capacity() totals = %d/%d/%d, want 10 capacity, 4 allocated, 6 free", report.Capacity, report.Allocated, report.Free)
+	}
+	if len(report.Pools) != 2 || report.Pools[0] != (PoolCapacity{Pool: "ippool-a", Capacity: 5, Allocated: 3, Free: 2, Buffered: 1}) {
+		t.Errorf("Capacity() pools = %+v", report.Pools)
+	}
+	if len(report.Nodes) != 2 || report.Nodes[0] != (NodeCapacity{Node: "node-b", Allocated: 1, AliasRanges: 98, Headroom: 2}) {
+		t.Errorf("Capacity() nodes = %+v, want node-b with the least headroom first", report.Nodes)
+	}
+	if len(report.Namespaces) != 1 || report.Namespaces[0] != (NamespaceUsage{Namespace: "web", IPs: 2}) {
+		t.Errorf("Capacity() namespaces = %+v, want the top one web", report.Namespaces)
+	}
+}
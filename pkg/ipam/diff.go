@@ -0,0 +1,173 @@
+package ipam
+
+import (
+	"sort"
+	"time"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// AllocationChange is an allocation only one of two snapshots holds
+type AllocationChange struct {
+	Pool      string `json:"pool"`
+	IP        string `json:"ip"`
+	Namespace string `json:"namespace,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Owner     string `json:"owner"`
+}
+
+// PoolDiff is the churn of a pool between two snapshots
+type PoolDiff struct {
+	Pool     string `json:"pool"`
+	Capacity int    `json:"capacity"`
+	// Before and After count the allocations of the pool in each snapshot
+	Before  int                `json:"before"`
+	After   int                `json:"after"`
+	Added   []AllocationChange `json:"added,omitempty"`
+	Removed []AllocationChange `json:"removed,omitempty"`
+}
+
+// Churn counts the allocations added and removed for a namespace or node
+type Churn struct {
+	Name    string `json:"name"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+}
+
+// SnapshotDiff is the churn of the pools between two snapshots
+type SnapshotDiff struct {
+	From        time.Time  `json:"from"`
+	To          time.Time  `json:"to"`
+	Pools       []PoolDiff `json:"pools"`
+	ByNamespace []Churn    `json:"byNamespace"`
+	ByNode      []Churn    `json:"byNode"`
+}
+
+// DiffSnapshots compares the allocations of two snapshots of the pools. An IP
+// held by another owner in to than in from counts as removed and added, system
+// reservations are left out. Namespaces and nodes are sorted by churn.
+func DiffSnapshots(from, to *Backup) *SnapshotDiff {
+	diff := &SnapshotDiff{From: from.CreatedAt, To: to.CreatedAt}
+	pools := map[string][2]*v1alpha1.IPPool{}
+	for i := range from.Pools {
+		pair := pools[from.Pools[i].Name]
+		pair[0] = &from.Pools[i]
+		pools[from.Pools[i].Name] = pair
+	}
+	for i := range to.Pools {
+		pair := pools[to.Pools[i].Name]
+		pair[1] = &to.Pools[i]
+		pools[to.Pools[i].Name] = pair
+	}
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	byNamespace := map[string]*Churn{}
+	byNode := map[string]*Churn{}
+	count := func(churn map[string]*Churn, name string, added bool) {
+		if name == "" {
+			return
+		}
+		if churn[name] == nil {
+			churn[name] = &Churn{Name: name}
+		}
+		if added {
+			churn[name].Added++
+		} else {
+			churn[name].Removed++
+		}
+	}
+
+	for _, name := range names {
+		before, after := userAllocations(pools[name][0]), userAllocations(pools[name][1])
+		pool := pools[name][1]
+		if pool == nil {
+			pool = pools[name][0]
+		}
+		poolDiff := PoolDiff{Pool: name, Capacity: poolCapacity(pool), Before: len(before), After: len(after)}
+		for ip, allocation := range after {
+			if old, ok := before[ip]; !ok || allocationOwner(old) != allocationOwner(allocation) {
+				poolDiff.Added = append(poolDiff.Added, allocationChange(name, ip, allocation))
+			}
+		}
+		for ip, allocation := range before {
+			if current, ok := after[ip]; !ok || allocationOwner(current) != allocationOwner(allocation) {
+				poolDiff.Removed = append(poolDiff.Removed, allocationChange(name, ip, allocation))
+			}
+		}
+		sortChanges(poolDiff.Added)
+		sortChanges(poolDiff.Removed)
+		for _, change := range poolDiff.Added {
+			count(byNamespace, change.Namespace, true)
+			count(byNode, change.Node, true)
+		}
+		for _, change := range poolDiff.Removed {
+			count(byNamespace, change.Namespace, false)
+			count(byNode, change.Node, false)
+		}
+		diff.Pools = append(diff.Pools, poolDiff)
+	}
+
+	diff.ByNamespace = sortedChurn(byNamespace)
+	diff.ByNode = sortedChurn(byNode)
+	return diff
+}
+
+// userAllocations returns the allocations of pool that are not system
+// reservations, nil for a pool missing from a snapshot
+func userAllocations(pool *v1alpha1.IPPool) map[string]v1alpha1.IPAllocation {
+	if pool == nil {
+		return nil
+	}
+	allocations := map[string]v1alpha1.IPAllocation{}
+	for ip, allocation := range pool.Spec.Allocations {
+		if allocation.System == "" {
+			allocations[ip] = allocation
+		}
+	}
+	return allocations
+}
+
+func allocationChange(pool, ip string, allocation v1alpha1.IPAllocation) AllocationChange {
+	return AllocationChange{
+		Pool:      pool,
+		IP:        ip,
+		Namespace: allocationNamespace(allocation),
+		Node:      allocation.NodeName,
+		Owner:     allocationOwner(allocation),
+	}
+}
+
+// allocationNamespace returns the namespace of the pod, Service or egress
+// holding the allocation, empty for buffered IPs and floating IPs
+func allocationNamespace(allocation v1alpha1.IPAllocation) string {
+	switch {
+	case allocation.ServiceNamespace != "":
+		return allocation.ServiceNamespace
+	case allocation.EgressNamespace != "":
+		return allocation.EgressNamespace
+	}
+	return allocation.PodNamespace
+}
+
+func sortChanges(changes []AllocationChange) {
+	sort.Slice(changes, func(i, j int) bool { return compareIPs(changes[i].IP, changes[j].IP) < 0 })
+}
+
+func sortedChurn(churn map[string]*Churn) []Churn {
+	sorted := make([]Churn, 0, len(churn))
+	for _, c := range churn {
+		sorted = append(sorted, *c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].Added+sorted[i].Removed, sorted[j].Added+sorted[j].Removed
+		if a != b {
+			return a > b
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
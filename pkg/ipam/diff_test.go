@@ -0,0 +1,64 @@
+package ipam
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	pool := func(name string, allocations map[string]v1alpha1.IPAllocation) v1alpha1.IPPool {
+		return v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/24", Allocations: allocations},
+		}
+	}
+	from := &Backup{CreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Pools: []v1alpha1.IPPool{
+		pool("ippool-default", map[string]v1alpha1.IPAllocation{
+			"10.8.0.0": {System: "network"},
+			"10.8.0.5": {PodNamespace: "web", PodName: "a", PodUID: "uid-a", NodeName: "node-a"},
+			"10.8.0.6": {PodNamespace: "web", PodName: "b", PodUID: "uid-b", NodeName: "node-a"},
+			"10.8.0.7": {PodNamespace: "db", PodName: "c", PodUID: "uid-c", NodeName: "node-b"},
+		}),
+		pool("ippool-gone", map[string]v1alpha1.IPAllocation{
+			"10.8.0.9": {PodNamespace: "db", PodName: "d", PodUID: "uid-d", NodeName: "node-b"},
+		}),
+	}}
+	to := &Backup{CreatedAt: time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC), Pools: []v1alpha1.IPPool{
+		pool("ippool-default", map[string]v1alpha1.IPAllocation{
+			"10.8.0.0": {System: "network"},
+			"10.8.0.5": {PodNamespace: "web", PodName: "a", PodUID: "uid-a", NodeName: "node-a"},
+			"10.8.0.6": {PodNamespace: "web", PodName: "e", PodUID: "uid-e", NodeName: "node-a"},
+			"10.8.0.8": {PodNamespace: "web", PodName: "f", PodUID: "uid-f", NodeName: "node-c"},
+		}),
+	}}
+
+	diff := DiffSnapshots(from, to)
+	if len(diff.Pools) != 2 {
+		t.Fatalf("DiffSnapshots() pools = %+v, want ippool-default and ippool-gone", diff.Pools)
+	}
+	def, gone := diff.Pools[0], diff.Pools[1]
+	if def.Pool != "ippool-default" || def.Before != 3 || def.After != 3 || def.Capacity == 0 {
+		t.Errorf("DiffSnapshots() ippool-default = %+v, want 3 allocations before and after", def)
+	}
+	if len(def.Added) != 2 || def.Added[0].IP != "10.8.0.6" || def.Added[1].IP != "10.8.0.8" {
+		t.Errorf("DiffSnapshots() added = %+v, want 10.8.0.6 and 10.8.0.8", def.Added)
+	}
+	if len(def.Removed) != 2 || def.Removed[0].IP != "10.8.0.6" || def.Removed[1].IP != "10.8.0.7" {
+		t.Errorf("DiffSnapshots() removed = %+v, want 10.8.0.6 and 10.8.0.7", def.Removed)
+	}
+	if gone.Pool != "ippool-gone" || gone.After != 0 || len(gone.Removed) != 1 {
+		t.Errorf("DiffSnapshots() ippool-gone = %+v, want its allocation removed", gone)
+	}
+
+	if len(diff.ByNamespace) != 2 || diff.ByNamespace[0] != (Churn{Name: "web", Added: 2, Removed: 1}) ||
+		diff.ByNamespace[1] != (Churn{Name: "db", Removed: 2}) {
+		t.Errorf("DiffSnapshots() by namespace = %+v", diff.ByNamespace)
+	}
+	if len(diff.ByNode) != 3 || diff.ByNode[0] != (Churn{Name: "node-a", Added: 1, Removed: 1}) {
+		t.Errorf("DiffSnapshots() by node = %+v", diff.ByNode)
+	}
+}
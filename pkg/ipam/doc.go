@@ -0,0 +1,17 @@
+// Package ipam allocates IPs from IPPools, the address pools the CNI plugin,
+// the installer and the provisioner share.
+//
+// An Allocator reads a pool from its PoolStore, picks an IP, and writes the
+// pool back, retrying when a concurrent update got there first. It can be
+// embedded in other components without a CNI binary or a cluster:
+// NewAllocator works against the IPPool custom resources a dynamic client
+// reaches, New against any PoolStore, such as a MemoryPoolStore to plan
+// allocations offline. Options configure the retries and the pool update
+// limiter.
+//
+//	allocator := ipam.New(ipam.NewMemoryPoolStore(pool), ipam.WithRetryPolicy(policy))
+//	result, err := allocator.Allocate(ctx, &ipam.AllocationRequest{PoolName: pool.Name, NodeName: node})
+//
+// The exported API of this package is kept backward compatible. PodIPMigrations
+// and NodeOnboardings only exist in a cluster and need WithClient.
+package ipam
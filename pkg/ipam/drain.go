@@ -0,0 +1,53 @@
+package ipam
+
+import (
+	"context"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// UninstallTaint is the NoSchedule taint the installer puts on a node while it
+// uninstalls gcp-ipam from it, the provisioner evicts the pods holding its IPs
+const UninstallTaint = "gcp-cni.cast.ai/uninstalling"
+
+// isDraining reports whether ip is in a draining pool or range, or in a
+// vacating slice of the pool
+func isDraining(pool *v1alpha1.IPPool, ip string) bool {
+	if pool.Spec.Draining {
+		return true
+	}
+
+	if isVacating(pool, ip) {
+		return true
+	}
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, r := range pool.Spec.SecondaryRanges {
+		if cidrContains(r.CIDR, addr) {
+			return r.Draining
+		}
+	}
+	return false
+}
+
+// DrainingPodAllocations returns the pod allocations of the pool held in
+// draining ranges, keyed by IP. Floating IPs are left to their owners.
+func (a *Allocator) DrainingPodAllocations(ctx context.Context, poolName string) (map[string]v1alpha1.IPAllocation, error) {
+	pool, err := a.getPool(ctx, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	draining := make(map[string]v1alpha1.IPAllocation)
+	for ip, allocation := range pool.Spec.Allocations {
+		if allocation.PodUID == "" || allocation.FloatingIP != "" {
+			continue
+		}
+		if isDraining(pool, ip) {
+			draining[ip] = allocation
+		}
+	}
+	return draining, nil
+}
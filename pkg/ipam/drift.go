@@ -0,0 +1,342 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// ConflictPlaceholder is the pod name of allocations the plugin keeps for IPs
+// found in use elsewhere, so they are not handed out again
+const ConflictPlaceholder = "ip-conflict"
+
+// ConflictQuarantine is how long a conflicting IP stays with its placeholder
+// before lease collection gives it back to the pool
+const ConflictQuarantine = time.Hour
+
+// DriftKind names an inconsistency between IPPool allocations, the IPs
+// attached to GCE instances and the IPs of running pods
+type DriftKind string
+
+const (
+	// DriftMissingAlias is an allocation of a live owner whose IP is not
+	// attached to the node it is allocated on
+	DriftMissingAlias DriftKind = "MissingAlias"
+
+	// DriftOrphanAlias is an IP attached to an instance without an allocation
+	DriftOrphanAlias DriftKind = "OrphanAlias"
+
+	// DriftForeignAlias is an allocated IP attached to another instance than
+	// the node it is allocated on
+	DriftForeignAlias DriftKind = "ForeignAlias"
+
+	// DriftOrphanAllocation is a pod allocation whose pod no longer exists
+	DriftOrphanAllocation DriftKind = "OrphanAllocation"
+
+	// DriftUnallocatedPodIP is a pod using an IP of a pool without an allocation
+	DriftUnallocatedPodIP DriftKind = "UnallocatedPodIP"
+
+	// DriftPodMismatch is a pod using an IP allocated to another pod
+	DriftPodMismatch DriftKind = "PodMismatch"
+
+	// DriftDuplicatePodIP is an IP used by more than one pod
+	DriftDuplicatePodIP DriftKind = "DuplicatePodIP"
+)
+
+// RepairAction is the suggested fix of a drift
+type RepairAction string
+
+const (
+	// RepairDetachAlias removes the alias IP range or route from the instance
+	RepairDetachAlias RepairAction = "DetachAlias"
+
+	// RepairAttachAlias attaches the IP to the node it is allocated on
+	RepairAttachAlias RepairAction = "AttachAlias"
+
+	// RepairReleaseIP detaches the IP wherever it is attached and releases it
+	RepairReleaseIP RepairAction = "ReleaseIP"
+
+	// RepairRecordAllocation allocates the IP to the pod using it
+	RepairRecordAllocation RepairAction = "RecordAllocation"
+
+	// RepairTransferAllocation hands the allocation over to the pod using the IP
+	RepairTransferAllocation RepairAction = "TransferAllocation"
+
+	// RepairManual needs an operator, e.g. deleting one of two pods sharing an IP
+	RepairManual RepairAction = "Manual"
+)
+
+// Drift is a single inconsistency found by Verify
+type Drift struct {
+	Kind DriftKind `json:"kind"`
+	Pool string    `json:"pool,omitempty"`
+	IP   string    `json:"ip"`
+	// Node is the node the pool allocates the IP on
+	Node string `json:"node,omitempty"`
+	// Instance is the instance the IP is attached to
+	Instance string `json:"instance,omitempty"`
+	// Pod is the namespace/name of the pod involved
+	Pod    string       `json:"pod,omitempty"`
+	PodUID string       `json:"podUID,omitempty"`
+	Repair RepairAction `json:"repair"`
+	Detail string       `json:"detail"`
+	// Outcome is set when automatic repair handled the drift
+	Outcome string `json:"outcome,omitempty"`
+}
+
+// DriftReport is the outcome of a consistency check
+type DriftReport struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	Pools       int       `json:"pools"`
+	Attached    int       `json:"attached"`
+	Pods        int       `json:"pods"`
+	Drifts      []Drift   `json:"drifts"`
+}
+
+// AttachedIP is an IP attached to a GCE instance, as /32 alias IP range or as
+// VPC route with the instance as next hop
+type AttachedIP struct {
+	IP       string
+	Instance string
+	Routed   bool
+}
+
+// PodIP is the IP a pod uses
+type PodIP struct {
+	Namespace string
+	Name      string
+	UID       string
+	Node      string
+	IP        string
+	// AttachPending is set while the pod waits for the installer to attach
+	// its alias, through the AliasAttachedCondition readiness gate
+	AttachPending bool
+}
+
+// Verify cross-checks the allocations of the pools against the attached IPs
+// and the IPs of pods. Only attached IPs and pod IPs within a range of one of
+// the pools are considered, IPs in migrating are skipped since they are in
+// transit between nodes.
+func Verify(pools []v1alpha1.IPPool, attached []AttachedIP, pods []PodIP, migrating map[string]bool) []Drift {
+	var drifts []Drift
+
+	alive := map[string]bool{}
+	// Aliases the installer has yet to attach are not missing
+	pending := map[string]bool{}
+	// Every node runs the installer, a node without pods is gone
+	nodes := map[string]bool{}
+	podsByIP := map[string][]PodIP{}
+	for _, pod := range pods {
+		alive[pod.UID] = true
+		pending[pod.UID] = pod.AttachPending
+		nodes[pod.Node] = true
+		if pod.IP != "" {
+			pod.IP = CanonicalIP(pod.IP)
+			podsByIP[pod.IP] = append(podsByIP[pod.IP], pod)
+		}
+	}
+	attachedByIP := map[string][]AttachedIP{}
+	for _, a := range attached {
+		a.IP = CanonicalIP(a.IP)
+		attachedByIP[a.IP] = append(attachedByIP[a.IP], a)
+	}
+	canonicalMigrating := make(map[string]bool, len(migrating))
+	for ip, ok := range migrating {
+		canonicalMigrating[CanonicalIP(ip)] = ok
+	}
+	migrating = canonicalMigrating
+
+	for i := range pools {
+		pool := &pools[i]
+		podPool := pool.Spec.Class == "" || pool.Spec.Class == v1alpha1.PoolClassPod
+
+		for ip, allocation := range pool.Spec.Allocations {
+			if migrating[ip] || allocation.System != "" {
+				continue
+			}
+			podAllocation := podPool && allocation.PodUID != "" && allocation.FloatingIP == "" &&
+				allocation.PodName != ConflictPlaceholder
+			drift := Drift{
+				Pool:   pool.Name,
+				IP:     ip,
+				Node:   allocation.NodeName,
+				Pod:    podRef(allocation.PodNamespace, allocation.PodName),
+				PodUID: allocation.PodUID,
+			}
+
+			if allocation.Buffered {
+				// Warm IPs may be attached to their node before a pod takes them, but nowhere else
+				for _, a := range attachedByIP[ip] {
+					if a.Instance != allocation.NodeName {
+						foreign := drift
+						foreign.Kind, foreign.Repair, foreign.Instance = DriftForeignAlias, RepairDetachAlias, a.Instance
+						foreign.Detail = fmt.Sprintf("IP buffered for node %s is attached to instance %s", allocation.NodeName, a.Instance)
+						drifts = append(drifts, foreign)
+					}
+				}
+				if !nodes[allocation.NodeName] {
+					drift.Kind, drift.Repair = DriftOrphanAllocation, RepairReleaseIP
+					drift.Detail = fmt.Sprintf("node %s buffering the IP runs no pods", allocation.NodeName)
+					drifts = append(drifts, drift)
+				}
+				continue
+			}
+
+			if podAllocation && !alive[allocation.PodUID] {
+				if len(podsByIP[ip]) > 0 {
+					// Another pod took the IP over, reported as a pod mismatch below
+					continue
+				}
+				drift.Kind, drift.Repair = DriftOrphanAllocation, RepairReleaseIP
+				drift.Detail = fmt.Sprintf("pod %s holding the IP no longer exists", drift.Pod)
+				if allocation.Protected {
+					drift.Repair = RepairManual
+					drift.Detail += ", the allocation is protected"
+				}
+				drifts = append(drifts, drift)
+				continue
+			}
+
+			node := aliasNode(pool, allocation)
+			if node == "" {
+				continue
+			}
+			onNode := false
+			for _, a := range attachedByIP[ip] {
+				if a.Instance == node {
+					onNode = true
+					continue
+				}
+				foreign := drift
+				foreign.Kind, foreign.Repair, foreign.Instance = DriftForeignAlias, RepairDetachAlias, a.Instance
+				foreign.Detail = fmt.Sprintf("IP allocated on node %s is attached to instance %s", node, a.Instance)
+				drifts = append(drifts, foreign)
+			}
+			if !onNode && !(podAllocation && pending[allocation.PodUID]) {
+				drift.Kind, drift.Repair = DriftMissingAlias, RepairAttachAlias
+				drift.Detail = fmt.Sprintf("IP allocated on node %s is not attached to it", node)
+				drifts = append(drifts, drift)
+			}
+		}
+	}
+
+	for _, a := range attached {
+		if migrating[a.IP] {
+			continue
+		}
+		pool := poolContaining(pools, a.IP)
+		if pool == nil {
+			continue
+		}
+		if _, ok := pool.Spec.Allocations[a.IP]; ok {
+			continue
+		}
+		drifts = append(drifts, Drift{
+			Kind:     DriftOrphanAlias,
+			Pool:     pool.Name,
+			IP:       a.IP,
+			Instance: a.Instance,
+			Repair:   RepairDetachAlias,
+			Detail:   fmt.Sprintf("IP is attached to instance %s but not allocated", a.Instance),
+		})
+	}
+
+	for ip, holders := range podsByIP {
+		if migrating[ip] {
+			continue
+		}
+		pool := poolContaining(pools, ip)
+		if pool == nil || (pool.Spec.Class != "" && pool.Spec.Class != v1alpha1.PoolClassPod) {
+			continue
+		}
+		if len(holders) > 1 {
+			for _, pod := range holders {
+				drifts = append(drifts, Drift{
+					Kind:     DriftDuplicatePodIP,
+					Pool:     pool.Name,
+					IP:       ip,
+					Instance: pod.Node,
+					Pod:      podRef(pod.Namespace, pod.Name),
+					PodUID:   pod.UID,
+					Repair:   RepairManual,
+					Detail:   fmt.Sprintf("IP is used by %d pods", len(holders)),
+				})
+			}
+			continue
+		}
+
+		pod := holders[0]
+		allocation, ok := pool.Spec.Allocations[ip]
+		drift := Drift{
+			Pool:     pool.Name,
+			IP:       ip,
+			Node:     allocation.NodeName,
+			Instance: pod.Node,
+			Pod:      podRef(pod.Namespace, pod.Name),
+			PodUID:   pod.UID,
+		}
+		switch {
+		case !ok:
+			drift.Kind, drift.Repair = DriftUnallocatedPodIP, RepairRecordAllocation
+			drift.Detail = "pod uses an IP that is not allocated"
+		case allocation.System != "":
+			drift.Kind, drift.Repair = DriftPodMismatch, RepairManual
+			drift.Detail = fmt.Sprintf("pod uses the %s address of the range", allocation.System)
+		case allocation.Buffered && allocation.NodeName == pod.Node:
+			// Taken from the node buffer, the installer hands the allocation over
+			continue
+		case allocation.FloatingIP == "" && allocation.PodUID != pod.UID:
+			drift.Kind, drift.Repair = DriftPodMismatch, RepairTransferAllocation
+			drift.Detail = fmt.Sprintf("IP is allocated to pod %s", podRef(allocation.PodNamespace, allocation.PodName))
+		default:
+			continue
+		}
+		drifts = append(drifts, drift)
+	}
+
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].IP != drifts[j].IP {
+			return drifts[i].IP < drifts[j].IP
+		}
+		if drifts[i].Kind != drifts[j].Kind {
+			return drifts[i].Kind < drifts[j].Kind
+		}
+		return drifts[i].Instance < drifts[j].Instance
+	})
+	return drifts
+}
+
+// aliasNode returns the node the allocated IP has to be attached to, empty
+// for allocations that are not attached anywhere
+func aliasNode(pool *v1alpha1.IPPool, allocation v1alpha1.IPAllocation) string {
+	if pool.Spec.Class == v1alpha1.PoolClassService || allocation.ServiceUID != "" ||
+		allocation.PodName == ConflictPlaceholder {
+		return ""
+	}
+	return allocation.NodeName
+}
+
+// poolContaining returns the pool with a range containing ip
+func poolContaining(pools []v1alpha1.IPPool, ip string) *v1alpha1.IPPool {
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	for i := range pools {
+		for _, r := range poolRanges(&pools[i]) {
+			if cidrContains(r.CIDR, addr) {
+				return &pools[i]
+			}
+		}
+	}
+	return nil
+}
+
+func podRef(namespace, name string) string {
+	if name == "" {
+		return ""
+	}
+	return namespace + "/" + name
+}
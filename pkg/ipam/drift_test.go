@@ -0,0 +1,79 @@
+package ipam
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestVerify(t *testing.T) {
+	pools := []v1alpha1.IPPool{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.1.0.0/24",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.1.0.2":  {PodNamespace: "default", PodName: "ok", PodUID: "uid-ok", NodeName: "node-a"},
+				"10.1.0.3":  {PodNamespace: "default", PodName: "gone", PodUID: "uid-gone", NodeName: "node-a"},
+				"10.1.0.4":  {PodNamespace: "default", PodName: "unattached", PodUID: "uid-unattached", NodeName: "node-a"},
+				"10.1.0.5":  {PodNamespace: "default", PodName: "moved", PodUID: "uid-moved", NodeName: "node-a"},
+				"10.1.0.6":  {PodNamespace: "default", PodName: "old", PodUID: "uid-old", NodeName: "node-b"},
+				"10.1.0.7":  {PodName: ConflictPlaceholder, PodUID: ConflictPlaceholder + "-10.1.0.7", NodeName: "node-a"},
+				"10.1.0.8":  {PodNamespace: "default", PodName: "migrating", PodUID: "uid-migrating", NodeName: "node-a"},
+				"10.1.0.12": {PodNamespace: "default", PodName: "pending", PodUID: "uid-pending", NodeName: "node-a"},
+			},
+		},
+	}}
+	attached := []AttachedIP{
+		{IP: "10.1.0.2", Instance: "node-a"},
+		{IP: "10.1.0.3", Instance: "node-a"},
+		{IP: "10.1.0.5", Instance: "node-a"},
+		{IP: "10.1.0.5", Instance: "node-b", Routed: true},
+		{IP: "10.1.0.6", Instance: "node-b"},
+		{IP: "10.1.0.9", Instance: "node-b"},
+		{IP: "10.9.0.1", Instance: "node-b"},
+	}
+	pods := []PodIP{
+		{Namespace: "default", Name: "ok", UID: "uid-ok", Node: "node-a", IP: "10.1.0.2"},
+		{Namespace: "default", Name: "unattached", UID: "uid-unattached", Node: "node-a", IP: "10.1.0.4"},
+		{Namespace: "default", Name: "moved", UID: "uid-moved", Node: "node-a", IP: "10.1.0.5"},
+		{Namespace: "default", Name: "new", UID: "uid-new", Node: "node-b", IP: "10.1.0.6"},
+		{Namespace: "default", Name: "stray", UID: "uid-stray", Node: "node-b", IP: "10.1.0.10"},
+		{Namespace: "default", Name: "twin-a", UID: "uid-twin-a", Node: "node-a", IP: "10.1.0.11"},
+		{Namespace: "default", Name: "twin-b", UID: "uid-twin-b", Node: "node-b", IP: "10.1.0.11"},
+		{Namespace: "default", Name: "migrating", UID: "uid-migrating", Node: "node-b", IP: "10.1.0.8"},
+		{Namespace: "default", Name: "pending", UID: "uid-pending", Node: "node-a", IP: "10.1.0.12", AttachPending: true},
+	}
+
+	got := Verify(pools, attached, pods, map[string]bool{"10.1.0.8": true})
+
+	want := []struct {
+		kind   DriftKind
+		ip     string
+		repair RepairAction
+	}{
+		{DriftOrphanAllocation, "10.1.0.3", RepairReleaseIP},
+		{DriftMissingAlias, "10.1.0.4", RepairAttachAlias},
+		{DriftForeignAlias, "10.1.0.5", RepairDetachAlias},
+		{DriftPodMismatch, "10.1.0.6", RepairTransferAllocation},
+		{DriftOrphanAlias, "10.1.0.9", RepairDetachAlias},
+		{DriftUnallocatedPodIP, "10.1.0.10", RepairRecordAllocation},
+		{DriftDuplicatePodIP, "10.1.0.11", RepairManual},
+		{DriftDuplicatePodIP, "10.1.0.11", RepairManual},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Verify() found %d drifts, want %d: %+v", len(got), len(want), got)
+	}
+	for _, w := range want {
+		match := false
+		for _, d := range got {
+			if d.Kind == w.kind && d.IP == w.ip && d.Repair == w.repair {
+				match = true
+			}
+		}
+		if !match {
+			t.Errorf("Verify() did not report %s for %s with repair %s: %+v", w.kind, w.ip, w.repair, got)
+		}
+	}
+}
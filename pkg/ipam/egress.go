@@ -0,0 +1,66 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReserveEgressIP returns the egress IP of the namespace in an Egress class
+// pool, reserving one if the namespace has none yet, and records nodeName as
+// its gateway. previousNode is the gateway the IP was recorded on before, when
+// it changed, so the caller can detach it there.
+func (a *Allocator) ReserveEgressIP(ctx context.Context, poolName, namespace, nodeName string) (result *AllocationResult, previousNode string, err error) {
+	err = a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		result, previousNode = nil, ""
+		if pool.Spec.Class != v1alpha1.PoolClassEgress {
+			return fmt.Errorf("IPPool %s is not a %s class pool", poolName, v1alpha1.PoolClassEgress)
+		}
+
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.EgressNamespace != namespace {
+				continue
+			}
+			result = resultForIP(pool, ip)
+			if allocation.NodeName == nodeName {
+				return errSkipUpdate
+			}
+			previousNode = allocation.NodeName
+			allocation.NodeName = nodeName
+			pool.Spec.Allocations[ip] = allocation
+			return nil
+		}
+
+		if err := a.checkFrozen(); err != nil {
+			return err
+		}
+		ip, _, err := allocateFromRanges(pool, "")
+		if err != nil {
+			return fmt.Errorf("failed to find available IP: %w", err)
+		}
+		pool.Spec.Allocations[ip] = v1alpha1.IPAllocation{
+			EgressNamespace: namespace,
+			NodeName:        nodeName,
+			AllocatedAt:     metav1.Now(),
+		}
+		result = resultForIP(pool, ip)
+		return nil
+	})
+	return result, previousNode, err
+}
+
+// ReleaseEgressIP releases the egress IP of the namespace. The caller detaches
+// the alias from the gateway first.
+func (a *Allocator) ReleaseEgressIP(ctx context.Context, poolName, namespace string) error {
+	return a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.EgressNamespace == namespace {
+				delete(pool.Spec.Allocations, ip)
+				return nil
+			}
+		}
+		return errSkipUpdate
+	})
+}
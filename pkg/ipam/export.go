@@ -0,0 +1,247 @@
+package ipam
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// ExportFormat is an output format of Export
+type ExportFormat string
+
+const (
+	// ExportHosts is a hosts file (RFC 952), one allocated IP and its host name per line
+	ExportHosts ExportFormat = "hosts"
+
+	// ExportCSV is one row per allocated IP with a header row
+	ExportCSV ExportFormat = "csv"
+
+	// ExportNetBox is JSON for the NetBox prefixes and ip-addresses bulk APIs
+	ExportNetBox ExportFormat = "netbox"
+)
+
+// exportTag marks the objects of an export in IP address management databases
+const exportTag = "gcp-cni"
+
+// exportedIP is an allocation flattened for export
+type exportedIP struct {
+	pool  *v1alpha1.IPPool
+	ip    string
+	owner string
+	// namespace and name of the owner, uid only for pods and Services
+	namespace  string
+	name       string
+	uid        string
+	allocation v1alpha1.IPAllocation
+}
+
+// Export writes the allocations of the pools in format
+func Export(w io.Writer, pools []v1alpha1.IPPool, format ExportFormat) error {
+	ips := exportedIPs(pools)
+	switch format {
+	case ExportHosts:
+		return exportHosts(w, pools, ips)
+	case ExportCSV:
+		return exportCSV(w, ips)
+	case ExportNetBox:
+		return exportNetBox(w, pools, ips)
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+func exportedIPs(pools []v1alpha1.IPPool) []exportedIP {
+	var ips []exportedIP
+	for i := range pools {
+		pool := &pools[i]
+		for ip, allocation := range pool.Spec.Allocations {
+			e := exportedIP{pool: pool, ip: ip, allocation: allocation}
+			switch {
+			case allocation.ServiceUID != "" || allocation.ServiceName != "":
+				e.owner, e.namespace, e.name, e.uid = "Service", allocation.ServiceNamespace, allocation.ServiceName, allocation.ServiceUID
+			case allocation.FloatingIP != "":
+				e.owner = "FloatingIP"
+				e.namespace, e.name, _ = strings.Cut(allocation.FloatingIP, "/")
+			case allocation.EgressNamespace != "":
+				e.owner, e.name = "Egress", allocation.EgressNamespace
+			case allocation.PodName == ConflictPlaceholder:
+				e.owner = "Conflict"
+			case allocation.System != "":
+				e.owner, e.name = "System", string(allocation.System)
+			case allocation.Buffered:
+				e.owner, e.name = "Buffer", allocation.NodeName
+			default:
+				e.owner, e.namespace, e.name, e.uid = "Pod", allocation.PodNamespace, allocation.PodName, allocation.PodUID
+			}
+			ips = append(ips, e)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return compareIPs(ips[i].ip, ips[j].ip) < 0
+	})
+	return ips
+}
+
+// hostName returns a host name for the owner of the IP, unique within the
+// export since it is derived from the owner or the IP itself
+func (e exportedIP) hostName() string {
+	var labels []string
+	switch e.owner {
+	case "Pod":
+		labels = []string{e.name, e.namespace, "pod"}
+	case "Service":
+		labels = []string{e.name, e.namespace, "svc"}
+	case "FloatingIP":
+		labels = []string{e.name, e.namespace, "fip"}
+	case "Egress":
+		labels = []string{e.name, "egress"}
+	default:
+		labels = []string{"ip-" + strings.NewReplacer(".", "-", ":", "-").Replace(e.ip), "reserved"}
+	}
+	return strings.ToLower(strings.Join(labels, "."))
+}
+
+func (e exportedIP) description() string {
+	switch e.owner {
+	case "Egress":
+		return fmt.Sprintf("egress IP of namespace %s on node %s", e.name, e.allocation.NodeName)
+	case "Conflict":
+		return "quarantined after an address conflict"
+	case "System":
+		return strings.ToLower(e.name) + " address of the range"
+	case "Buffer":
+		return "buffered for node " + e.name
+	}
+	desc := fmt.Sprintf("%s %s/%s", strings.ToLower(e.owner), e.namespace, e.name)
+	if e.allocation.NodeName != "" {
+		desc += " on node " + e.allocation.NodeName
+	}
+	return desc
+}
+
+func exportHosts(w io.Writer, pools []v1alpha1.IPPool, ips []exportedIP) error {
+	fmt.Fprintf(w, "# gcp-cni allocations, %d pools, %d IPs\n", len(pools), len(ips))
+	for _, e := range ips {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t# %s\n", e.ip, e.hostName(), e.pool.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportCSV(w io.Writer, ips []exportedIP) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"pool", "subnet", "range", "ip", "owner", "namespace", "name", "uid", "node", "allocated_at", "lease_expires_at"})
+	for _, e := range ips {
+		r := rangeForIP(e.pool, e.ip)
+		var allocatedAt, leaseExpiresAt string
+		if !e.allocation.AllocatedAt.IsZero() {
+			allocatedAt = e.allocation.AllocatedAt.UTC().Format(time.RFC3339)
+		}
+		if e.allocation.LeaseExpiresAt != nil {
+			leaseExpiresAt = e.allocation.LeaseExpiresAt.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			e.pool.Name, SubnetworkName(e.pool.Spec.Subnet), r.Name, e.ip, e.owner,
+			e.namespace, e.name, e.uid, e.allocation.NodeName, allocatedAt, leaseExpiresAt,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// netBoxTag references a tag by name in NetBox bulk requests
+type netBoxTag struct {
+	Name string `json:"name"`
+}
+
+type netBoxPrefix struct {
+	Prefix      string      `json:"prefix"`
+	Status      string      `json:"status"`
+	Description string      `json:"description"`
+	Tags        []netBoxTag `json:"tags"`
+}
+
+type netBoxIPAddress struct {
+	Address     string      `json:"address"`
+	Status      string      `json:"status"`
+	Role        string      `json:"role,omitempty"`
+	DNSName     string      `json:"dns_name"`
+	Description string      `json:"description"`
+	Tags        []netBoxTag `json:"tags"`
+}
+
+// netBoxExport holds the request bodies for the ipam/prefixes and
+// ipam/ip-addresses endpoints
+type netBoxExport struct {
+	Prefixes    []netBoxPrefix    `json:"prefixes"`
+	IPAddresses []netBoxIPAddress `json:"ip_addresses"`
+}
+
+func exportNetBox(w io.Writer, pools []v1alpha1.IPPool, ips []exportedIP) error {
+	tags := []netBoxTag{{Name: exportTag}}
+	export := netBoxExport{
+		Prefixes:    []netBoxPrefix{},
+		IPAddresses: make([]netBoxIPAddress, 0, len(ips)),
+	}
+
+	for i := range pools {
+		pool := &pools[i]
+		for _, r := range poolRanges(pool) {
+			if r.CIDR == "" {
+				continue
+			}
+			status := "active"
+			if pool.Spec.Draining || r.Draining {
+				status = "deprecated"
+			}
+			export.Prefixes = append(export.Prefixes, netBoxPrefix{
+				Prefix:      r.CIDR,
+				Status:      status,
+				Description: fmt.Sprintf("IPPool %s, secondary range %s of subnetwork %s", pool.Name, r.Name, SubnetworkName(pool.Spec.Subnet)),
+				Tags:        tags,
+			})
+		}
+	}
+
+	for _, e := range ips {
+		address := netBoxIPAddress{
+			Address:     HostPrefix(e.ip),
+			Status:      "active",
+			DNSName:     e.hostName(),
+			Description: e.description(),
+			Tags:        tags,
+		}
+		switch e.owner {
+		case "Service", "FloatingIP":
+			address.Role = "vip"
+		case "Conflict", "System", "Buffer":
+			address.Status = "reserved"
+		}
+		export.IPAddresses = append(export.IPAddresses, address)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+// compareIPs orders IPs numerically, unparsable ones last
+func compareIPs(a, b string) int {
+	addrA, errA := ParseAddr(a)
+	addrB, errB := ParseAddr(b)
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return 1
+	case errB != nil:
+		return -1
+	}
+	return addrA.Compare(addrB)
+}
@@ -0,0 +1,67 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestExport(t *testing.T) {
+	pools := []v1alpha1.IPPool{{
+		ObjectMeta: metav1.ObjectMeta{Name: "ippool-nodes"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:               "10.1.0.0/24",
+			Subnet:             "projects/p/regions/r/subnetworks/nodes",
+			SecondaryRangeName: "live",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.1.0.10": {PodNamespace: "default", PodName: "web-1", PodUID: "uid-1", NodeName: "node-a"},
+				"10.1.0.9":  {ServiceNamespace: "default", ServiceName: "api", ServiceUID: "uid-2"},
+			},
+		},
+	}}
+
+	var hosts bytes.Buffer
+	if err := Export(&hosts, pools, ExportHosts); err != nil {
+		t.Fatalf("Export(hosts): %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(hosts.String()), "\n")
+	want := []string{
+		"10.1.0.9\tapi.default.svc\t# ippool-nodes",
+		"10.1.0.10\tweb-1.default.pod\t# ippool-nodes",
+	}
+	if len(lines) != 3 || lines[1] != want[0] || lines[2] != want[1] {
+		t.Errorf("Export(hosts) = %q, want header and %q", lines, want)
+	}
+
+	var csv bytes.Buffer
+	if err := Export(&csv, pools, ExportCSV); err != nil {
+		t.Fatalf("Export(csv): %v", err)
+	}
+	if !strings.Contains(csv.String(), "ippool-nodes,nodes,live,10.1.0.10,Pod,default,web-1,uid-1,node-a,") {
+		t.Errorf("Export(csv) misses pod row:\n%s", csv.String())
+	}
+
+	var netbox bytes.Buffer
+	if err := Export(&netbox, pools, ExportNetBox); err != nil {
+		t.Fatalf("Export(netbox): %v", err)
+	}
+	var got netBoxExport
+	if err := json.Unmarshal(netbox.Bytes(), &got); err != nil {
+		t.Fatalf("Export(netbox) is not JSON: %v", err)
+	}
+	if len(got.Prefixes) != 1 || got.Prefixes[0].Prefix != "10.1.0.0/24" {
+		t.Errorf("Export(netbox) prefixes = %+v", got.Prefixes)
+	}
+	if len(got.IPAddresses) != 2 || got.IPAddresses[0].Address != "10.1.0.9/32" || got.IPAddresses[0].Role != "vip" {
+		t.Errorf("Export(netbox) ip addresses = %+v", got.IPAddresses)
+	}
+
+	if err := Export(&bytes.Buffer{}, pools, "xml"); err == nil {
+		t.Error("Export(xml) succeeded, want error")
+	}
+}
@@ -0,0 +1,132 @@
+package ipam
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+const (
+	// IPFamiliesAnnotation lists the address families of the pod IPs,
+	// comma-separated like the ipFamilies of a Service: IPv4, IPv6 or both
+	IPFamiliesAnnotation = "gcp-cni.cast.ai/ip-families"
+
+	// IPFamilyPolicyAnnotation is the ipFamilyPolicy of the pod IPs, like
+	// that of a Service: SingleStack, PreferDualStack or RequireDualStack
+	IPFamilyPolicyAnnotation = "gcp-cni.cast.ai/ip-family-policy"
+)
+
+// ErrIPFamilyUnavailable is returned when the pool has no range of any of the
+// requested address families
+var ErrIPFamilyUnavailable = fmt.Errorf("requested IP family not available in pool")
+
+// FamilyRequest is the address families a pod asks for
+type FamilyRequest struct {
+	Policy corev1.IPFamilyPolicy
+	// Families in order of preference, empty when the pod takes any
+	Families []corev1.IPFamily
+}
+
+// PodIPFamilies returns the families the pod asks for with the
+// IPFamiliesAnnotation and IPFamilyPolicyAnnotation. Without them, or with
+// PreferDualStack and no families, the pod takes any family of the pool.
+func PodIPFamilies(annotations map[string]string) (FamilyRequest, error) {
+	request := FamilyRequest{Policy: corev1.IPFamilyPolicySingleStack}
+	if policy, ok := annotations[IPFamilyPolicyAnnotation]; ok {
+		request.Policy = corev1.IPFamilyPolicy(policy)
+		switch request.Policy {
+		case corev1.IPFamilyPolicySingleStack, corev1.IPFamilyPolicyPreferDualStack, corev1.IPFamilyPolicyRequireDualStack:
+		default:
+			return FamilyRequest{}, fmt.Errorf("annotation %s: %q is not SingleStack, PreferDualStack or RequireDualStack", IPFamilyPolicyAnnotation, policy)
+		}
+	}
+
+	if value, ok := annotations[IPFamiliesAnnotation]; ok {
+		for _, f := range strings.Split(value, ",") {
+			family := corev1.IPFamily(strings.TrimSpace(f))
+			if family != corev1.IPv4Protocol && family != corev1.IPv6Protocol {
+				return FamilyRequest{}, fmt.Errorf("annotation %s: %q is not IPv4 or IPv6", IPFamiliesAnnotation, f)
+			}
+			if slices.Contains(request.Families, family) {
+				return FamilyRequest{}, fmt.Errorf("annotation %s lists %s twice", IPFamiliesAnnotation, family)
+			}
+			request.Families = append(request.Families, family)
+		}
+	}
+
+	switch {
+	case request.Policy == corev1.IPFamilyPolicySingleStack && len(request.Families) > 1:
+		return FamilyRequest{}, fmt.Errorf("annotation %s lists two families, which needs a dual-stack %s", IPFamiliesAnnotation, IPFamilyPolicyAnnotation)
+	case request.Policy == corev1.IPFamilyPolicyRequireDualStack && len(request.Families) == 1:
+		return FamilyRequest{}, fmt.Errorf("policy %s needs both families in annotation %s", request.Policy, IPFamiliesAnnotation)
+	case request.Policy != corev1.IPFamilyPolicySingleStack && len(request.Families) == 1:
+		// PreferDualStack with one family names the preferred one
+		other := corev1.IPv6Protocol
+		if request.Families[0] == corev1.IPv6Protocol {
+			other = corev1.IPv4Protocol
+		}
+		request.Families = append(request.Families, other)
+	}
+	return request, nil
+}
+
+// IPFamily returns the address family of ip
+func IPFamily(ip string) (corev1.IPFamily, error) {
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		return "", err
+	}
+	if addr.Is4() {
+		return corev1.IPv4Protocol, nil
+	}
+	return corev1.IPv6Protocol, nil
+}
+
+// PoolFamilies returns the address families of the ranges of the pool, IPv4
+// first
+func PoolFamilies(pool *v1alpha1.IPPool) []corev1.IPFamily {
+	var families []corev1.IPFamily
+	for _, family := range []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol} {
+		if len(familyRanges(poolRanges(pool), family)) > 0 {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+// familyRanges returns the ranges of family, all of them when family is empty
+func familyRanges(ranges []v1alpha1.SecondaryRange, family corev1.IPFamily) []v1alpha1.SecondaryRange {
+	if family == "" {
+		return ranges
+	}
+	var matching []v1alpha1.SecondaryRange
+	for _, r := range ranges {
+		prefix, err := ParsePrefix(r.CIDR)
+		if err != nil {
+			continue
+		}
+		if prefix.Addr().Is4() == (family == corev1.IPv4Protocol) {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
+
+// chooseFamily returns the first of families the pool has a range of, empty
+// when families is
+func chooseFamily(pool *v1alpha1.IPPool, families []corev1.IPFamily) (corev1.IPFamily, error) {
+	if len(families) == 0 {
+		return "", nil
+	}
+	available := PoolFamilies(pool)
+	for _, family := range families {
+		if slices.Contains(available, family) {
+			return family, nil
+		}
+	}
+	return "", fmt.Errorf("%w: pool %s offers %v, pod asks for %v", ErrIPFamilyUnavailable, pool.Name, available, families)
+}
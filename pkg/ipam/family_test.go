@@ -0,0 +1,85 @@
+package ipam
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestPodIPFamilies(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []corev1.IPFamily
+		wantErr     bool
+	}{
+		{name: "none"},
+		{
+			name:        "single stack IPv6",
+			annotations: map[string]string{IPFamiliesAnnotation: "IPv6"},
+			want:        []corev1.IPFamily{corev1.IPv6Protocol},
+		},
+		{
+			name:        "prefer dual stack names the preferred family",
+			annotations: map[string]string{IPFamilyPolicyAnnotation: "PreferDualStack", IPFamiliesAnnotation: "IPv6"},
+			want:        []corev1.IPFamily{corev1.IPv6Protocol, corev1.IPv4Protocol},
+		},
+		{
+			name:        "require dual stack",
+			annotations: map[string]string{IPFamilyPolicyAnnotation: "RequireDualStack", IPFamiliesAnnotation: "IPv4, IPv6"},
+			want:        []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol},
+		},
+		{
+			name:        "two families single stack",
+			annotations: map[string]string{IPFamiliesAnnotation: "IPv4,IPv6"},
+			wantErr:     true,
+		},
+		{
+			name:        "unknown family",
+			annotations: map[string]string{IPFamiliesAnnotation: "IPv5"},
+			wantErr:     true,
+		},
+		{
+			name:        "unknown policy",
+			annotations: map[string]string{IPFamilyPolicyAnnotation: "DualStack"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PodIPFamilies(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PodIPFamilies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got.Families, tt.want) {
+				t.Errorf("PodIPFamilies() families = %v, want %v", got.Families, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseFamily(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{
+		SecondaryRanges: []v1alpha1.SecondaryRange{
+			{Name: "a", CIDR: "10.0.0.0/29"},
+			{Name: "b", CIDR: "fd00::/126"},
+		},
+		Allocations: map[string]v1alpha1.IPAllocation{},
+	}}
+	ip, _, err := allocateFromFamilyRanges(pool, "", corev1.IPv6Protocol)
+	if err != nil || ip != "fd00::2" {
+		t.Errorf("allocateFromFamilyRanges(IPv6) = %s, %v, want fd00::2", ip, err)
+	}
+
+	pool.Spec.SecondaryRanges = pool.Spec.SecondaryRanges[:1]
+	if family, err := chooseFamily(pool, []corev1.IPFamily{corev1.IPv6Protocol, corev1.IPv4Protocol}); err != nil || family != corev1.IPv4Protocol {
+		t.Errorf("chooseFamily() preferring IPv6 = %s, %v, want IPv4", family, err)
+	}
+	if _, err := chooseFamily(pool, []corev1.IPFamily{corev1.IPv6Protocol}); !errors.Is(err, ErrIPFamilyUnavailable) {
+		t.Errorf("chooseFamily(IPv6) of an IPv4 pool error = %v, want ErrIPFamilyUnavailable", err)
+	}
+}
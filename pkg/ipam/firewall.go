@@ -0,0 +1,111 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// Reasons of the v1alpha1.IPPoolFirewallReady condition
+const (
+	FirewallReasonVerified     = "Verified"
+	FirewallReasonRuleMissing  = "RuleMissing"
+	FirewallReasonRuleDisabled = "RuleDisabled"
+	FirewallReasonTagMissing   = "TagMissing"
+)
+
+// FirewallRule is the state of a VPC firewall rule pools may reference
+type FirewallRule struct {
+	Disabled bool
+}
+
+// CheckFirewall returns the FirewallReady condition of a pool with firewall
+// references: rules holds the firewall rules of the VPC by name, nodeTags the
+// network tags of the instances by name. Nodes holding IPs of the pool without
+// a known instance are not checked.
+func CheckFirewall(pool *v1alpha1.IPPool, rules map[string]FirewallRule, nodeTags map[string][]string) metav1.Condition {
+	refs := pool.Spec.Firewall
+	var reason string
+	var problems []string
+	problem := func(r, format string, a ...any) {
+		if reason == "" {
+			reason = r
+		}
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	for _, name := range refs.Rules {
+		rule, ok := rules[name]
+		switch {
+		case !ok:
+			problem(FirewallReasonRuleMissing, "firewall rule %s does not exist", name)
+		case rule.Disabled:
+			problem(FirewallReasonRuleDisabled, "firewall rule %s is disabled", name)
+		}
+	}
+
+	if len(refs.Tags) > 0 {
+		var nodes []string
+		for _, allocation := range pool.Spec.Allocations {
+			if allocation.NodeName != "" && allocation.System == "" && !slices.Contains(nodes, allocation.NodeName) {
+				nodes = append(nodes, allocation.NodeName)
+			}
+		}
+		slices.Sort(nodes)
+		for _, node := range nodes {
+			tags, ok := nodeTags[node]
+			if !ok {
+				continue
+			}
+			var missing []string
+			for _, tag := range refs.Tags {
+				if !slices.Contains(tags, tag) {
+					missing = append(missing, tag)
+				}
+			}
+			if len(missing) > 0 {
+				problem(FirewallReasonTagMissing, "node %s lacks network tags %s", node, strings.Join(missing, ", "))
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return metav1.Condition{
+			Type:               v1alpha1.IPPoolFirewallReady,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: pool.Generation,
+			Reason:             FirewallReasonVerified,
+			Message:            "Firewall rules and network tags exist",
+		}
+	}
+	return metav1.Condition{
+		Type:               v1alpha1.IPPoolFirewallReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: pool.Generation,
+		Reason:             reason,
+		Message:            strings.Join(problems, "; "),
+	}
+}
+
+// SetCondition sets condition in the status of the pool, or removes the
+// condition of its type when condition has no status
+func (a *Allocator) SetCondition(ctx context.Context, poolName string, condition metav1.Condition) error {
+	return a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		changed := false
+		if condition.Status == "" {
+			changed = meta.RemoveStatusCondition(&pool.Status.Conditions, condition.Type)
+		} else {
+			changed = meta.SetStatusCondition(&pool.Status.Conditions, condition)
+		}
+		if !changed {
+			return errSkipUpdate
+		}
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+package ipam
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestCheckFirewall(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{
+		Firewall: &v1alpha1.FirewallReferences{
+			Rules: []string{"allow-pods", "allow-health-checks"},
+			Tags:  []string{"pods"},
+		},
+		Allocations: map[string]v1alpha1.IPAllocation{
+			"10.0.0.1": {NodeName: "gateway", System: v1alpha1.SystemReservationGateway},
+			"10.0.0.5": {PodName: "a", NodeName: "node-a"},
+			"10.0.0.6": {PodName: "b", NodeName: "node-b"},
+			"10.0.0.7": {PodName: "c", NodeName: "node-gone"},
+		},
+	}}
+
+	tests := []struct {
+		name       string
+		rules      map[string]FirewallRule
+		nodeTags   map[string][]string
+		wantStatus metav1.ConditionStatus
+		wantReason string
+	}{
+		{
+			name:       "all present",
+			rules:      map[string]FirewallRule{"allow-pods": {}, "allow-health-checks": {}},
+			nodeTags:   map[string][]string{"node-a": {"pods"}, "node-b": {"pods", "web"}},
+			wantStatus: metav1.ConditionTrue,
+			wantReason: FirewallReasonVerified,
+		},
+		{
+			name:       "missing rule",
+			rules:      map[string]FirewallRule{"allow-pods": {}},
+			nodeTags:   map[string][]string{"node-a": {"pods"}, "node-b": {"pods"}},
+			wantStatus: metav1.ConditionFalse,
+			wantReason: FirewallReasonRuleMissing,
+		},
+		{
+			name:       "disabled rule",
+			rules:      map[string]FirewallRule{"allow-pods": {Disabled: true}, "allow-health-checks": {}},
+			nodeTags:   map[string][]string{"node-a": {"pods"}, "node-b": {"pods"}},
+			wantStatus: metav1.ConditionFalse,
+			wantReason: FirewallReasonRuleDisabled,
+		},
+		{
+			name:       "node without tag",
+			rules:      map[string]FirewallRule{"allow-pods": {}, "allow-health-checks": {}},
+			nodeTags:   map[string][]string{"node-a": {"pods"}, "node-b": {"web"}},
+			wantStatus: metav1.ConditionFalse,
+			wantReason: FirewallReasonTagMissing,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CheckFirewall(pool, tt.rules, tt.nodeTags)
+			if got.Type != v1alpha1.IPPoolFirewallReady || got.Status != tt.wantStatus || got.Reason != tt.wantReason {
+				t.Errorf("CheckFirewall() = %s %s %s (%s), want %s %s", got.Type, got.Status, got.Reason, got.Message, tt.wantStatus, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReserveFloatingIP returns the IP held by the FloatingIP ref (namespace/name)
+// in a Pod class pool, reserving requestedIP, or the next free IP when empty,
+// if it holds none yet. requestedIP has to be a usable address of the pool.
+func (a *Allocator) ReserveFloatingIP(ctx context.Context, poolName, ref, requestedIP string) (*AllocationResult, error) {
+	var result *AllocationResult
+	err := a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		result = nil
+		if pool.Spec.Class != "" && pool.Spec.Class != v1alpha1.PoolClassPod {
+			return fmt.Errorf("IPPool %s is not a %s class pool", poolName, v1alpha1.PoolClassPod)
+		}
+
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.FloatingIP == ref {
+				result = resultForIP(pool, ip)
+				return errSkipUpdate
+			}
+		}
+
+		if err := a.checkFrozen(); err != nil {
+			return err
+		}
+
+		ip := CanonicalIP(requestedIP)
+		if ip != "" {
+			if err := checkRequestedIP(pool, ip); err != nil {
+				return err
+			}
+			if _, exists := pool.Spec.Allocations[ip]; exists {
+				return fmt.Errorf("requested IP %s is already allocated", ip)
+			}
+		} else {
+			var err error
+			ip, _, err = allocateFromRanges(pool, "")
+			if err != nil {
+				return fmt.Errorf("failed to find available IP: %w", err)
+			}
+		}
+
+		pool.Spec.Allocations[ip] = v1alpha1.IPAllocation{
+			FloatingIP:  ref,
+			AllocatedAt: metav1.Now(),
+		}
+		result = resultForIP(pool, ip)
+		return nil
+	})
+	return result, err
+}
+
+// SetFloatingIPNode records the node the floating IP is attached to, empty
+// when it is attached nowhere
+func (a *Allocator) SetFloatingIPNode(ctx context.Context, poolName, ref, nodeName string) error {
+	return a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.FloatingIP != ref {
+				continue
+			}
+			if allocation.NodeName == nodeName {
+				return errSkipUpdate
+			}
+			allocation.NodeName = nodeName
+			pool.Spec.Allocations[ip] = allocation
+			return nil
+		}
+		return fmt.Errorf("floating IP %s not found in pool %s", ref, poolName)
+	})
+}
+
+// ReleaseFloatingIP releases the IP held by the FloatingIP ref. The caller
+// detaches the alias first.
+func (a *Allocator) ReleaseFloatingIP(ctx context.Context, poolName, ref string) error {
+	return a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.FloatingIP == ref {
+				delete(pool.Spec.Allocations, ip)
+				return nil
+			}
+		}
+		return errSkipUpdate
+	})
+}
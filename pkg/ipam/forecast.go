@@ -0,0 +1,63 @@
+package ipam
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// UsageSample is the number of IPs allocated in a pool at a point in time
+type UsageSample struct {
+	Time      time.Time
+	Allocated int
+}
+
+// ForecastExhaustion fits a line through the samples by least squares and
+// returns the net allocations per day it grows by, and the days until the
+// available IPs run out at that rate. ok is false while allocations do not grow.
+func ForecastExhaustion(samples []UsageSample, available int) (perDay, days float64, ok bool) {
+	if len(samples) < 2 {
+		return 0, 0, false
+	}
+
+	start := samples[0].Time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range samples {
+		x := sample.Time.Sub(start).Hours() / 24
+		y := float64(sample.Allocated)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, 0, false
+	}
+
+	perDay = (n*sumXY - sumX*sumY) / denominator
+	if perDay <= 0 {
+		return perDay, 0, false
+	}
+	return perDay, math.Max(float64(available), 0) / perDay, true
+}
+
+// SetForecast records the usage forecast in the status of the pool. A nil
+// daysUntilExhaustion clears it.
+func (a *Allocator) SetForecast(ctx context.Context, poolName string, allocationsPerDay int, daysUntilExhaustion *int) error {
+	return a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		current := pool.Status.DaysUntilExhaustion
+		if pool.Status.AllocationsPerDay == allocationsPerDay &&
+			(current == nil) == (daysUntilExhaustion == nil) &&
+			(current == nil || *current == *daysUntilExhaustion) {
+			return errSkipUpdate
+		}
+
+		pool.Status.AllocationsPerDay = allocationsPerDay
+		pool.Status.DaysUntilExhaustion = daysUntilExhaustion
+		return nil
+	})
+}
@@ -0,0 +1,69 @@
+package ipam
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestForecastExhaustion(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	samples := func(allocated ...int) []UsageSample {
+		var s []UsageSample
+		for i, n := range allocated {
+			s = append(s, UsageSample{Time: start.Add(time.Duration(i) * 12 * time.Hour), Allocated: n})
+		}
+		return s
+	}
+
+	tests := []struct {
+		name       string
+		samples    []UsageSample
+		available  int
+		wantPerDay float64
+		wantDays   float64
+		wantOK     bool
+	}{
+		{
+			name:       "steady growth",
+			samples:    samples(100, 105, 110, 115),
+			available:  100,
+			wantPerDay: 10,
+			wantDays:   10,
+			wantOK:     true,
+		},
+		{
+			name:       "noise around growth",
+			samples:    samples(100, 112, 118, 130),
+			available:  96,
+			wantPerDay: 19.2,
+			wantDays:   5,
+			wantOK:     true,
+		},
+		{
+			name:       "shrinking",
+			samples:    samples(120, 110, 100),
+			available:  10,
+			wantPerDay: -20,
+		},
+		{
+			name:       "flat",
+			samples:    samples(50, 50, 50),
+			available:  10,
+			wantPerDay: 0,
+		},
+		{
+			name:    "single sample",
+			samples: samples(50),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perDay, days, ok := ForecastExhaustion(tt.samples, tt.available)
+			if ok != tt.wantOK || math.Abs(perDay-tt.wantPerDay) > 1e-9 || math.Abs(days-tt.wantDays) > 1e-9 {
+				t.Errorf("ForecastExhaustion() = %v, %v, %v, want %v, %v, %v", perDay, days, ok, tt.wantPerDay, tt.wantDays, tt.wantOK)
+			}
+		})
+	}
+}
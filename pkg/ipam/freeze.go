@@ -0,0 +1,30 @@
+package ipam
+
+import "fmt"
+
+// ErrFrozen is returned for new allocations while the allocator is frozen
+var ErrFrozen = fmt.Errorf("IP allocation is frozen")
+
+// Freeze makes the allocator refuse new allocations, e.g. during incident
+// response or a GCP maintenance window. Reads, releases and allocations that
+// already exist keep working. reason is reported in the refusals.
+func (a *Allocator) Freeze(reason string) {
+	a.frozen = true
+	a.freezeReason = reason
+}
+
+// Unfreeze lifts a Freeze
+func (a *Allocator) Unfreeze() {
+	a.frozen = false
+	a.freezeReason = ""
+}
+
+func (a *Allocator) checkFrozen() error {
+	if !a.frozen {
+		return nil
+	}
+	if a.freezeReason == "" {
+		return ErrFrozen
+	}
+	return fmt.Errorf("%w: %s", ErrFrozen, a.freezeReason)
+}
@@ -0,0 +1,154 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// maxImportRangeBits bounds the host bits of the alias ranges PlanImport
+// reserves, wider ranges are skipped rather than filling the pool
+const maxImportRangeBits = 16
+
+// AttachedRange is an alias IP range attached to an instance, of any size
+type AttachedRange struct {
+	Instance string
+	CIDR     string
+}
+
+// ImportEntry is an allocation PlanImport seeds a pool with. Entries without
+// a pod are IPs of an alias range attached to Node that no pod uses, reserved
+// until the range is detached so the pool does not hand them to other nodes.
+type ImportEntry struct {
+	IP           string `json:"ip"`
+	Node         string `json:"node"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	PodUID       string `json:"podUID,omitempty"`
+}
+
+// ImportSkip is an IP in use that PlanImport leaves out of the pool
+type ImportSkip struct {
+	IP     string `json:"ip"`
+	Node   string `json:"node,omitempty"`
+	Pod    string `json:"pod,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ImportPlan is what an import adds to a pool
+type ImportPlan struct {
+	Pool        string        `json:"pool"`
+	Allocations []ImportEntry `json:"allocations"`
+	Skipped     []ImportSkip  `json:"skipped,omitempty"`
+}
+
+// PlanImport plans seeding the pool with the IPs clusters that used alias IPs
+// by other means already hand out: every pod IP within the pool becomes an
+// allocation of its pod, every other address of an alias range within the
+// pool a reservation on the instance it is attached to. IPs the pool already
+// allocates are skipped, so importing again only adds what changed.
+func PlanImport(pool *v1alpha1.IPPool, ranges []AttachedRange, pods []PodIP) *ImportPlan {
+	pool = pool.DeepCopy()
+	reserveSystemIPs(pool)
+
+	plan := &ImportPlan{Pool: pool.Name, Allocations: []ImportEntry{}}
+	planned := map[string]bool{}
+	inPool := func(addr string) bool {
+		return poolContaining([]v1alpha1.IPPool{*pool}, addr) != nil
+	}
+
+	for _, pod := range pods {
+		ip := CanonicalIP(pod.IP)
+		if ip == "" || !inPool(ip) {
+			continue
+		}
+		ref := podRef(pod.Namespace, pod.Name)
+		if allocation, ok := pool.Spec.Allocations[ip]; ok {
+			if allocation.PodUID != pod.UID {
+				plan.Skipped = append(plan.Skipped, ImportSkip{IP: ip, Node: pod.Node, Pod: ref, Reason: "allocated to another owner"})
+			}
+			continue
+		}
+		if planned[ip] {
+			plan.Skipped = append(plan.Skipped, ImportSkip{IP: ip, Node: pod.Node, Pod: ref, Reason: "used by more than one pod"})
+			continue
+		}
+		planned[ip] = true
+		plan.Allocations = append(plan.Allocations, ImportEntry{
+			IP:           ip,
+			Node:         pod.Node,
+			PodNamespace: pod.Namespace,
+			PodName:      pod.Name,
+			PodUID:       pod.UID,
+		})
+	}
+
+	for _, r := range ranges {
+		prefix, err := ParsePrefix(r.CIDR)
+		if err != nil {
+			continue
+		}
+		if hostBits(prefix) > maxImportRangeBits {
+			plan.Skipped = append(plan.Skipped, ImportSkip{IP: r.CIDR, Node: r.Instance, Reason: fmt.Sprintf("alias range wider than %d addresses", 1<<maxImportRangeBits)})
+			continue
+		}
+		for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+			ip := addr.String()
+			if planned[ip] || !inPool(ip) {
+				continue
+			}
+			if _, ok := pool.Spec.Allocations[ip]; ok {
+				continue
+			}
+			planned[ip] = true
+			plan.Allocations = append(plan.Allocations, ImportEntry{IP: ip, Node: r.Instance})
+		}
+	}
+
+	sort.Slice(plan.Allocations, func(i, j int) bool {
+		return compareIPs(plan.Allocations[i].IP, plan.Allocations[j].IP) < 0
+	})
+	return plan
+}
+
+// Import records the allocations of plan in its pool and returns how many it
+// added. IPs allocated since the plan was made are left alone. Reservations
+// use the ConflictPlaceholder owner without a lease, they are released by
+// hand once the alias range is detached.
+func (a *Allocator) Import(ctx context.Context, plan *ImportPlan) (int, error) {
+	added := 0
+	err := a.modifyPool(ctx, plan.Pool, func(pool *v1alpha1.IPPool) error {
+		added = 0
+		now := metav1.Now()
+		for _, entry := range plan.Allocations {
+			if _, ok := pool.Spec.Allocations[entry.IP]; ok {
+				continue
+			}
+
+			allocation := v1alpha1.IPAllocation{
+				PodName:      entry.PodName,
+				PodNamespace: entry.PodNamespace,
+				PodUID:       entry.PodUID,
+				NodeName:     entry.Node,
+				AllocatedAt:  now,
+			}
+			if entry.PodUID == "" {
+				allocation.PodName = ConflictPlaceholder
+				allocation.PodUID = ConflictPlaceholder + "-" + entry.IP
+			} else if pool.Spec.LeaseDuration != nil {
+				allocation.LeaseExpiresAt = leaseExpiry(now.Time, pool.Spec.LeaseDuration.Duration)
+			}
+			pool.Spec.Allocations[entry.IP] = allocation
+			added++
+		}
+		if added == 0 {
+			return errSkipUpdate
+		}
+		return nil
+	})
+	return added, err
+}
@@ -0,0 +1,72 @@
+package ipam
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestPlanImport(t *testing.T) {
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "ippool-default"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.8.0.0/16",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.8.0.9": {PodUID: "uid-known", NodeName: "node-a"},
+			},
+		},
+	}
+	ranges := []AttachedRange{
+		{Instance: "node-a", CIDR: "10.8.0.8/30"},
+		{Instance: "node-b", CIDR: "10.8.1.5/32"},
+		// Outside the pool
+		{Instance: "node-c", CIDR: "10.9.0.0/30"},
+		{Instance: "node-d", CIDR: "10.0.0.0/8"},
+	}
+	pods := []PodIP{
+		{Namespace: "default", Name: "web", UID: "uid-web", Node: "node-a", IP: "10.8.0.10"},
+		{Namespace: "default", Name: "known", UID: "uid-known", Node: "node-a", IP: "10.8.0.9"},
+		{Namespace: "default", Name: "impostor", UID: "uid-impostor", Node: "node-b", IP: "10.8.0.9"},
+		{Namespace: "default", Name: "twin", UID: "uid-twin", Node: "node-b", IP: "10.8.0.10"},
+		{Namespace: "default", Name: "host", UID: "uid-host", Node: "node-b"},
+	}
+
+	plan := PlanImport(pool, ranges, pods)
+
+	want := []ImportEntry{
+		{IP: "10.8.0.8", Node: "node-a"},
+		{IP: "10.8.0.10", Node: "node-a", PodNamespace: "default", PodName: "web", PodUID: "uid-web"},
+		{IP: "10.8.0.11", Node: "node-a"},
+		{IP: "10.8.1.5", Node: "node-b"},
+	}
+	if len(plan.Allocations) != len(want) {
+		t.Fatalf("PlanImport() allocations = %+v, want %+v", plan.Allocations, want)
+	}
+	for i := range want {
+		if plan.Allocations[i] != want[i] {
+			t.Errorf("allocation %d = %+v, want %+v", i, plan.Allocations[i], want[i])
+		}
+	}
+
+	reasons := map[string]string{}
+	for _, skip := range plan.Skipped {
+		reasons[skip.Pod+skip.IP] = skip.Reason
+	}
+	for key, reason := range map[string]string{
+		"default/impostor10.8.0.9": "allocated to another owner",
+		"default/twin10.8.0.10":    "used by more than one pod",
+		"10.0.0.0/8":               "alias range wider than 65536 addresses",
+	} {
+		if reasons[key] != reason {
+			t.Errorf("skip of %s = %q, want %q", key, reasons[key], reason)
+		}
+	}
+	if len(plan.Skipped) != 3 {
+		t.Errorf("PlanImport() skipped = %+v, want 3", plan.Skipped)
+	}
+	if _, ok := pool.Spec.Allocations["10.8.0.0"]; ok {
+		t.Errorf("PlanImport() modified the pool")
+	}
+}
@@ -0,0 +1,115 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RenewLeases extends the lease of every allocation on nodeName whose pod UID
+// is in alive. Leases with more than half of the duration left are not touched
+// to keep the write rate on the pool low. It returns the number of renewed leases.
+func (a *Allocator) RenewLeases(ctx context.Context, poolName, nodeName string, alive map[string]bool) (int, error) {
+	renewed := 0
+	err := a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		renewed = 0
+		if pool.Spec.LeaseDuration == nil {
+			return errSkipUpdate
+		}
+
+		now := time.Now()
+		duration := pool.Spec.LeaseDuration.Duration
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.NodeName != nodeName || !alive[allocation.PodUID] {
+				continue
+			}
+			if allocation.LeaseExpiresAt != nil && allocation.LeaseExpiresAt.Sub(now) > duration/2 {
+				continue
+			}
+			allocation.LeaseExpiresAt = leaseExpiry(now, duration)
+			pool.Spec.Allocations[ip] = allocation
+			renewed++
+		}
+
+		if renewed == 0 {
+			return errSkipUpdate
+		}
+		return nil
+	})
+	return renewed, err
+}
+
+// Quarantine hands the allocation of ip over to a ConflictPlaceholder owner on
+// nodeName whose lease expires ConflictQuarantine after now, in pools with
+// and without leases. The placeholder is never renewed, lease collection
+// releases the IP once it expired.
+func (a *Allocator) Quarantine(ctx context.Context, poolName, ip, nodeName string, now time.Time) error {
+	ip = CanonicalIP(ip)
+	return a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		allocation, ok := pool.Spec.Allocations[ip]
+		if !ok {
+			return fmt.Errorf("IP %s not found in pool %s", ip, poolName)
+		}
+		if allocation.System != "" {
+			return fmt.Errorf("IP %s is the %s address of pool %s", ip, allocation.System, poolName)
+		}
+
+		pool.Spec.Allocations[ip] = v1alpha1.IPAllocation{
+			PodName:        ConflictPlaceholder,
+			PodUID:         ConflictPlaceholder + "-" + ip,
+			NodeName:       nodeName,
+			AllocatedAt:    allocation.AllocatedAt,
+			LeaseExpiresAt: leaseExpiry(now, ConflictQuarantine),
+		}
+		return nil
+	})
+}
+
+// ExpiredLeases returns the allocations in the pool whose lease expired before now
+func (a *Allocator) ExpiredLeases(ctx context.Context, poolName string, now time.Time) (map[string]v1alpha1.IPAllocation, error) {
+	pool, err := a.getPool(ctx, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make(map[string]v1alpha1.IPAllocation)
+	for ip, allocation := range pool.Spec.Allocations {
+		if leaseExpired(allocation, now) {
+			expired[ip] = allocation
+		}
+	}
+	return expired, nil
+}
+
+// ReleaseExpired releases the IP only if its lease is still expired at now,
+// so a lease renewed after ExpiredLeases listed it is kept. It reports whether
+// the IP was released.
+func (a *Allocator) ReleaseExpired(ctx context.Context, poolName, ip string, now time.Time) (bool, error) {
+	ip = CanonicalIP(ip)
+	released := false
+	err := a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		released = false
+		allocation, ok := pool.Spec.Allocations[ip]
+		if !ok || !leaseExpired(allocation, now) {
+			return errSkipUpdate
+		}
+		delete(pool.Spec.Allocations, ip)
+		released = true
+		return nil
+	})
+	return released, err
+}
+
+// leaseExpired reports whether the allocation is reclaimable, protected ones
+// never are
+func leaseExpired(allocation v1alpha1.IPAllocation, now time.Time) bool {
+	return !allocation.Protected && allocation.LeaseExpiresAt != nil && allocation.LeaseExpiresAt.Time.Before(now)
+}
+
+func leaseExpiry(from time.Time, duration time.Duration) *metav1.Time {
+	expiry := metav1.NewTime(from.Add(duration))
+	return &expiry
+}
@@ -0,0 +1,130 @@
+package ipam
+
+import (
+	"context"
+	"sync"
+)
+
+// PoolLimiter bounds the updates of a pool in flight at once. Acquire blocks
+// until the update of pool may start and returns the function ending it.
+type PoolLimiter interface {
+	Acquire(ctx context.Context, pool string) (release func(), err error)
+}
+
+// SetPoolLimiter makes every update of a pool wait for limiter first,
+// including its retries on conflicts
+func (a *Allocator) SetPoolLimiter(limiter PoolLimiter) {
+	a.limiter = limiter
+}
+
+func (a *Allocator) acquirePool(ctx context.Context, poolName string) (func(), error) {
+	if a.limiter == nil {
+		return func() {}, nil
+	}
+	return a.limiter.Acquire(ctx, poolName)
+}
+
+// PoolSemaphore is the PoolLimiter of a single process. Updates beyond the
+// limit of a pool queue and start in arrival order.
+type PoolSemaphore struct {
+	mu       sync.Mutex
+	limit    int
+	inFlight map[string]int
+	waiting  map[string][]chan struct{}
+}
+
+// NewPoolSemaphore returns a PoolSemaphore letting limit updates of every pool
+// run at once, 0 is unlimited
+func NewPoolSemaphore(limit int) *PoolSemaphore {
+	return &PoolSemaphore{
+		limit:    limit,
+		inFlight: map[string]int{},
+		waiting:  map[string][]chan struct{}{},
+	}
+}
+
+// SetLimit changes the limit, starting queued updates it makes room for
+func (s *PoolSemaphore) SetLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	for pool := range s.waiting {
+		for len(s.waiting[pool]) > 0 && s.free(pool) {
+			s.inFlight[pool]++
+			s.next(pool)
+		}
+	}
+}
+
+func (s *PoolSemaphore) Acquire(ctx context.Context, pool string) (func(), error) {
+	release := func() { s.release(pool) }
+
+	s.mu.Lock()
+	if len(s.waiting[pool]) == 0 && s.free(pool) {
+		s.inFlight[pool]++
+		s.mu.Unlock()
+		return release, nil
+	}
+	ready := make(chan struct{})
+	s.waiting[pool] = append(s.waiting[pool], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-ready:
+		// Started while giving up, pass the slot on
+		s.inFlight[pool]--
+		if len(s.waiting[pool]) > 0 && s.free(pool) {
+			s.inFlight[pool]++
+			s.next(pool)
+		}
+	default:
+		queue := s.waiting[pool]
+		for i, waiter := range queue {
+			if waiter == ready {
+				s.waiting[pool] = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+	}
+	s.prune(pool)
+	return nil, ctx.Err()
+}
+
+func (s *PoolSemaphore) release(pool string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight[pool]--
+	if len(s.waiting[pool]) > 0 && s.free(pool) {
+		s.inFlight[pool]++
+		s.next(pool)
+	}
+	s.prune(pool)
+}
+
+// free reports whether another update of pool may start, the caller holds mu
+func (s *PoolSemaphore) free(pool string) bool {
+	return s.limit <= 0 || s.inFlight[pool] < s.limit
+}
+
+// next starts the update of pool queued first, the caller holds mu
+func (s *PoolSemaphore) next(pool string) {
+	close(s.waiting[pool][0])
+	s.waiting[pool] = s.waiting[pool][1:]
+}
+
+func (s *PoolSemaphore) prune(pool string) {
+	if len(s.waiting[pool]) == 0 {
+		delete(s.waiting, pool)
+	}
+	if s.inFlight[pool] <= 0 {
+		delete(s.inFlight, pool)
+	}
+}
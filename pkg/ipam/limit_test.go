@@ -0,0 +1,64 @@
+package ipam
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPoolSemaphore(t *testing.T) {
+	s := NewPoolSemaphore(1)
+	ctx := context.Background()
+
+	release, err := s.Acquire(ctx, "pool-a")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	// Other pools are not held up
+	releaseB, err := s.Acquire(ctx, "pool-b")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	releaseB()
+
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Acquire(timeout, "pool-a"); err == nil {
+		t.Fatalf("Acquire() succeeded beyond the limit")
+	}
+
+	// Queued updates start in arrival order once there is room
+	started := make(chan int, 2)
+	for i := range 2 {
+		go func() {
+			release, err := s.Acquire(ctx, "pool-a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			started <- i
+			release()
+		}()
+		for {
+			s.mu.Lock()
+			queued := len(s.waiting["pool-a"])
+			s.mu.Unlock()
+			if queued == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	release()
+	for want := range 2 {
+		if got := <-started; got != want {
+			t.Errorf("update %d started, want %d", got, want)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.inFlight) != 0 || len(s.waiting) != 0 {
+		t.Errorf("semaphore not empty: %v in flight, %v waiting", s.inFlight, s.waiting)
+	}
+}
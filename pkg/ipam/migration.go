@@ -0,0 +1,276 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ErrMigrationClaimed is returned when a PodIPMigration is owned by another
+// target pod or already finished
+var ErrMigrationClaimed = fmt.Errorf("migration claimed by another pod")
+
+// MigrationActive reports whether the migration still moves its IP, i.e. the
+// source pod must not release it
+func MigrationActive(m *v1alpha1.PodIPMigration) bool {
+	switch m.Status.Phase {
+	case v1alpha1.PodIPMigrationFailed, v1alpha1.PodIPMigrationRolledBack:
+		return false
+	default:
+		return true
+	}
+}
+
+// SetMigrationPhase moves the migration to phase, recording err as its message
+func SetMigrationPhase(m *v1alpha1.PodIPMigration, phase v1alpha1.PodIPMigrationPhase, err error) {
+	if m.Status.Phase != phase {
+		m.Status.LastTransitionTime = metav1.Now()
+	}
+	m.Status.Phase = phase
+	m.Status.Message = ""
+	if err != nil {
+		m.Status.Message = err.Error()
+	}
+}
+
+// GetMigration returns the PodIPMigration of the target pod name
+func (a *Allocator) GetMigration(ctx context.Context, namespace, name string) (*v1alpha1.PodIPMigration, error) {
+	resource, err := a.resource(PodIPMigrationGVR)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := resource.Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PodIPMigration %s/%s: %w", namespace, name, err)
+	}
+	return migrationFromUnstructured(obj)
+}
+
+// CreateMigration creates m in the Pending phase
+func (a *Allocator) CreateMigration(ctx context.Context, m *v1alpha1.PodIPMigration) (*v1alpha1.PodIPMigration, error) {
+	m.APIVersion = v1alpha1.SchemeGroupVersion.String()
+	m.Kind = "PodIPMigration"
+	m.Spec.IP = CanonicalIP(m.Spec.IP)
+	SetMigrationPhase(m, v1alpha1.PodIPMigrationPending, nil)
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert PodIPMigration to unstructured: %w", err)
+	}
+	resource, err := a.resource(PodIPMigrationGVR)
+	if err != nil {
+		return nil, err
+	}
+	created, err := resource.Namespace(m.Namespace).Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PodIPMigration %s/%s: %w", m.Namespace, m.Name, err)
+	}
+	return migrationFromUnstructured(created)
+}
+
+// ListMigrations returns the PodIPMigrations in namespace, all namespaces when empty
+func (a *Allocator) ListMigrations(ctx context.Context, namespace string) ([]v1alpha1.PodIPMigration, error) {
+	resource, err := a.resource(PodIPMigrationGVR)
+	if err != nil {
+		return nil, err
+	}
+	list, err := resource.Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PodIPMigrations: %w", err)
+	}
+
+	migrations := make([]v1alpha1.PodIPMigration, 0, len(list.Items))
+	for _, item := range list.Items {
+		m, err := migrationFromUnstructured(&item)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, *m)
+	}
+	return migrations, nil
+}
+
+// MigratingIPs returns the IPs of the active PodIPMigrations of every
+// namespace. Until TransferAllocation their allocations keep the UID of the
+// source pod, which looks gone or recreated once the target pod runs, so no
+// sweep may release them.
+func (a *Allocator) MigratingIPs(ctx context.Context) (map[string]bool, error) {
+	migrations, err := a.ListMigrations(ctx, metav1.NamespaceAll)
+	if err != nil {
+		return nil, err
+	}
+	migrating := make(map[string]bool)
+	for i := range migrations {
+		if MigrationActive(&migrations[i]) {
+			migrating[CanonicalIP(migrations[i].Spec.IP)] = true
+		}
+	}
+	return migrating, nil
+}
+
+// SourceMigration returns the active migration moving ip away from the source
+// pod, nil if there is none. Migrations created from annotations do not name
+// their source pod, any pod but the target created before the migration
+// qualifies then.
+func (a *Allocator) SourceMigration(ctx context.Context, pod metav1.Object, ip string) (*v1alpha1.PodIPMigration, error) {
+	ip = CanonicalIP(ip)
+	migrations, err := a.ListMigrations(ctx, pod.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	for i := range migrations {
+		m := &migrations[i]
+		if CanonicalIP(m.Spec.IP) != ip || !MigrationActive(m) || m.Status.TargetPodUID == string(pod.GetUID()) {
+			continue
+		}
+		if m.Spec.SourcePod == pod.GetName() {
+			return m, nil
+		}
+		if m.Spec.SourcePod == "" && pod.GetCreationTimestamp().Time.Before(m.CreationTimestamp.Time) {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// ModifyMigration applies mutate to the current PodIPMigration and writes it
+// back, retrying on conflicts like modifyPool. When mutate returns
+// errSkipUpdate the migration is left untouched. Concurrent writers see each
+// other's phase, so only one of them can claim or advance a migration.
+func (a *Allocator) ModifyMigration(ctx context.Context, namespace, name string, mutate func(m *v1alpha1.PodIPMigration) error) (*v1alpha1.PodIPMigration, error) {
+	var lastErr error
+
+	for i := 0; i < a.retry.Attempts; i++ {
+		if i > 0 {
+			a.backoff(i)
+		}
+
+		m, err := a.tryModifyMigration(ctx, namespace, name, mutate)
+		if err == nil {
+			return m, nil
+		}
+
+		if errors.IsConflict(err) {
+			telemetry.Retry(ctx, "migration-update")
+			lastErr = err
+			continue
+		}
+
+		return nil, err
+	}
+
+	telemetry.RetriesExhausted(ctx, "migration-update")
+	return nil, fmt.Errorf("failed to update PodIPMigration %s/%s after %d retries: %w", namespace, name, a.retry.Attempts, lastErr)
+}
+
+func (a *Allocator) tryModifyMigration(ctx context.Context, namespace, name string, mutate func(m *v1alpha1.PodIPMigration) error) (*v1alpha1.PodIPMigration, error) {
+	m, err := a.GetMigration(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mutate(m); err == errSkipUpdate {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert PodIPMigration to unstructured: %w", err)
+	}
+	resource, err := a.resource(PodIPMigrationGVR)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := resource.Namespace(namespace).Update(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return migrationFromUnstructured(updated)
+}
+
+// ClaimMigration makes the target pod the owner of the migration. A retried
+// ADD of the same pod gets the migration back in whatever phase it reached.
+func (a *Allocator) ClaimMigration(ctx context.Context, namespace, name, podUID, nodeName, poolName string) (*v1alpha1.PodIPMigration, error) {
+	return a.ModifyMigration(ctx, namespace, name, func(m *v1alpha1.PodIPMigration) error {
+		switch {
+		case m.Status.Phase == "" || m.Status.Phase == v1alpha1.PodIPMigrationPending:
+			m.Status.TargetNode = nodeName
+			m.Status.TargetPodUID = podUID
+			m.Status.Pool = poolName
+			SetMigrationPhase(m, v1alpha1.PodIPMigrationClaimed, nil)
+			return nil
+		case m.Status.TargetPodUID == podUID && m.Status.TargetNode == nodeName && MigrationActive(m):
+			return errSkipUpdate
+		default:
+			return fmt.Errorf("%w: %s is %s for pod %s on %s", ErrMigrationClaimed, name, m.Status.Phase, m.Status.TargetPodUID, m.Status.TargetNode)
+		}
+	})
+}
+
+// AdvanceMigration moves a migration claimed by the target pod to phase. It
+// fails when the migration was taken away from the pod, e.g. rolled back.
+func (a *Allocator) AdvanceMigration(ctx context.Context, namespace, name, podUID string, phase v1alpha1.PodIPMigrationPhase, cause error) (*v1alpha1.PodIPMigration, error) {
+	return a.ModifyMigration(ctx, namespace, name, func(m *v1alpha1.PodIPMigration) error {
+		if m.Status.TargetPodUID != podUID || !MigrationActive(m) {
+			return fmt.Errorf("%w: %s is %s for pod %s", ErrMigrationClaimed, name, m.Status.Phase, m.Status.TargetPodUID)
+		}
+		if m.Status.Phase == phase && cause == nil {
+			return errSkipUpdate
+		}
+		SetMigrationPhase(m, phase, cause)
+		return nil
+	})
+}
+
+// TransferAllocation hands the allocation of ip over to the pod in req, which
+// claimed the migration of the IP. It is a no-op when the pod already owns it.
+func (a *Allocator) TransferAllocation(ctx context.Context, poolName, ip string, req *AllocationRequest) error {
+	ip = CanonicalIP(ip)
+	return a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		allocation, ok := pool.Spec.Allocations[ip]
+		if !ok {
+			return fmt.Errorf("IP %s not found in pool %s", ip, poolName)
+		}
+		if allocation.System != "" {
+			return fmt.Errorf("IP %s is the %s address of pool %s", ip, allocation.System, poolName)
+		}
+		if allocation.PodUID == req.PodUID {
+			return errSkipUpdate
+		}
+
+		allocation.PodName = req.PodName
+		allocation.PodNamespace = req.PodNamespace
+		allocation.PodUID = req.PodUID
+		allocation.NodeName = req.NodeName
+		allocation.Protected = allocation.Protected || req.Protected
+		pool.Spec.Allocations[ip] = allocation
+		return nil
+	})
+}
+
+// AllocationOf returns the allocation of ip in the pool and whether there is one
+func (a *Allocator) AllocationOf(ctx context.Context, poolName, ip string) (v1alpha1.IPAllocation, bool, error) {
+	ip = CanonicalIP(ip)
+	pool, err := a.getPool(ctx, poolName)
+	if err != nil {
+		return v1alpha1.IPAllocation{}, false, err
+	}
+	allocation, ok := pool.Spec.Allocations[ip]
+	return allocation, ok, nil
+}
+
+func migrationFromUnstructured(obj *unstructured.Unstructured) (*v1alpha1.PodIPMigration, error) {
+	m := &v1alpha1.PodIPMigration{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, m); err != nil {
+		return nil, fmt.Errorf("failed to convert unstructured to PodIPMigration: %w", err)
+	}
+	return m, nil
+}
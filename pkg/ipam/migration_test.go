@@ -0,0 +1,94 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestMigrationHandshake(t *testing.T) {
+	ctx := context.Background()
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR: "10.0.0.0/28",
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.0.0.5": {PodName: "source", PodNamespace: "default", PodUID: "source-uid", NodeName: "node-a"},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{IPPoolGVR: "IPPoolList", PodIPMigrationGVR: "PodIPMigrationList"},
+		&unstructured.Unstructured{Object: obj})
+	allocator := NewAllocator(client)
+
+	_, err = allocator.CreateMigration(ctx, &v1alpha1.PodIPMigration{
+		ObjectMeta: metav1.ObjectMeta{Name: "target", Namespace: "default", CreationTimestamp: metav1.Now()},
+		Spec:       v1alpha1.PodIPMigrationSpec{IP: "10.0.0.5", SourcePod: "source", SourceNode: "node-a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := allocator.ClaimMigration(ctx, "default", "target", "target-uid", "node-b", "pool")
+	if err != nil {
+		t.Fatalf("claim failed: %v", err)
+	}
+	if m.Status.Phase != v1alpha1.PodIPMigrationClaimed || m.Status.TargetNode != "node-b" {
+		t.Fatalf("claimed migration = %+v", m.Status)
+	}
+	if _, err := allocator.ClaimMigration(ctx, "default", "target", "target-uid", "node-b", "pool"); err != nil {
+		t.Fatalf("retried claim of the same pod failed: %v", err)
+	}
+	if _, err := allocator.ClaimMigration(ctx, "default", "target", "other-uid", "node-c", "pool"); !errors.Is(err, ErrMigrationClaimed) {
+		t.Fatalf("second claim error = %v, want ErrMigrationClaimed", err)
+	}
+
+	source := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "source", Namespace: "default", UID: "source-uid",
+		CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+	}}
+	if m, err := allocator.SourceMigration(ctx, source, "10.0.0.5"); err != nil || m == nil {
+		t.Fatalf("SourceMigration() = %v, %v, want the migration", m, err)
+	}
+	target := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "target", Namespace: "default", UID: "target-uid"}}
+	if m, err := allocator.SourceMigration(ctx, target, "10.0.0.5"); err != nil || m != nil {
+		t.Fatalf("SourceMigration() of the target = %v, %v, want none", m, err)
+	}
+
+	if err := allocator.TransferAllocation(ctx, "pool", "10.0.0.5", &AllocationRequest{
+		PodName: "target", PodNamespace: "default", PodUID: "target-uid", NodeName: "node-b",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	allocation, held, err := allocator.AllocationOf(ctx, "pool", "10.0.0.5")
+	if err != nil || !held || allocation.PodUID != "target-uid" || allocation.NodeName != "node-b" {
+		t.Fatalf("allocation after transfer = %+v, %v, %v", allocation, held, err)
+	}
+
+	if _, err := allocator.AdvanceMigration(ctx, "default", "target", "target-uid", v1alpha1.PodIPMigrationFailed, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allocator.AdvanceMigration(ctx, "default", "target", "target-uid", v1alpha1.PodIPMigrationAttached, nil); !errors.Is(err, ErrMigrationClaimed) {
+		t.Fatalf("advancing a failed migration error = %v, want ErrMigrationClaimed", err)
+	}
+	if m, err := allocator.SourceMigration(ctx, source, "10.0.0.5"); err != nil || m != nil {
+		t.Fatalf("SourceMigration() of a failed migration = %v, %v, want none", m, err)
+	}
+}
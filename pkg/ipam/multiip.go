@@ -0,0 +1,99 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// MaxPodIPs bounds the IPs a single pod interface may ask for, each one takes
+// an alias IP range of the instance
+const MaxPodIPs = 16
+
+// PodIPCount returns the number of IPs the pod asks for with the
+// IPCountAnnotation, 1 when it does not
+func PodIPCount(annotations map[string]string) (int, error) {
+	value, ok := annotations[IPCountAnnotation]
+	if !ok {
+		return 1, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 || count > MaxPodIPs {
+		return 0, fmt.Errorf("annotation %s: %q is not a number of IPs between 1 and %d", IPCountAnnotation, value, MaxPodIPs)
+	}
+	return count, nil
+}
+
+// AllocateAdditional returns count IPs the pod of req holds on its node besides
+// its primary IP, allocating the missing ones from req.RangeName. A
+// recreated sandbox gets the additional IPs of the previous one back, sorted
+// by address. Additional IPs count against maxIPsPerNode like any other.
+func (a *Allocator) AllocateAdditional(ctx context.Context, req *AllocationRequest, count int) ([]string, error) {
+	var ips []string
+	err := a.modifyPool(ctx, req.PoolName, func(pool *v1alpha1.IPPool) error {
+		ips = additionalAllocations(pool, req.PodUID, req.NodeName)
+		if len(ips) >= count {
+			ips = ips[:count]
+			return errSkipUpdate
+		}
+
+		if pool.Spec.Draining {
+			return fmt.Errorf("IPPool %s is draining", req.PoolName)
+		}
+		if pool.DeletionTimestamp != nil {
+			return fmt.Errorf("IPPool %s is being deleted", req.PoolName)
+		}
+		if err := a.checkFrozen(); err != nil {
+			return err
+		}
+
+		for len(ips) < count {
+			if limit := pool.Spec.MaxIPsPerNode; limit > 0 {
+				if held := nodeAllocations(pool, req.NodeName); held >= limit {
+					return fmt.Errorf("%w: node %s holds %d IPs of pool %s, limit is %d", ErrNodeLimitReached, req.NodeName, held, req.PoolName, limit)
+				}
+			}
+			ip, _, err := allocateFromRanges(pool, req.RangeName)
+			if err != nil {
+				return fmt.Errorf("failed to find available IP: %w", err)
+			}
+			allocation := v1alpha1.IPAllocation{
+				PodName:      req.PodName,
+				PodNamespace: req.PodNamespace,
+				PodUID:       req.PodUID,
+				NodeName:     req.NodeName,
+				Protected:    req.Protected,
+				Additional:   true,
+				AllocatedAt:  metav1.Now(),
+			}
+			if pool.Spec.LeaseDuration != nil {
+				allocation.LeaseExpiresAt = leaseExpiry(allocation.AllocatedAt.Time, pool.Spec.LeaseDuration.Duration)
+			}
+			pool.Spec.Allocations[ip] = allocation
+			ips = append(ips, ip)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// additionalAllocations returns the additional IPs of the pool the pod holds
+// on the node, sorted by address
+func additionalAllocations(pool *v1alpha1.IPPool, podUID, nodeName string) []string {
+	var ips []string
+	for ip, allocation := range pool.Spec.Allocations {
+		if allocation.Additional && allocation.PodUID == podUID && allocation.NodeName == nodeName {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool { return compareIPs(ips[i], ips[j]) < 0 })
+	return ips
+}
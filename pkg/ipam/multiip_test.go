@@ -0,0 +1,69 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestPodIPCount(t *testing.T) {
+	for value, want := range map[string]int{"1": 1, "4": 4, "16": 16, "0": 0, "17": 0, "two": 0} {
+		got, err := PodIPCount(map[string]string{IPCountAnnotation: value})
+		if got != want || (err != nil) != (want == 0) {
+			t.Errorf("PodIPCount(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	if got, err := PodIPCount(nil); got != 1 || err != nil {
+		t.Errorf("PodIPCount() without annotation = %d, %v, want 1", got, err)
+	}
+}
+
+func TestAllocateAdditional(t *testing.T) {
+	ctx := context.Background()
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.0.0.0/28", MaxIPsPerNode: 4},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{IPPoolGVR: "IPPoolList"},
+		&unstructured.Unstructured{Object: obj})
+	allocator := NewAllocator(client)
+
+	req := &AllocationRequest{PoolName: "pool", PodName: "vm", PodNamespace: "default", PodUID: "vm-uid", NodeName: "node-1"}
+	primary, err := allocator.Allocate(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	additional, err := allocator.AllocateAdditional(ctx, req, 2)
+	if err != nil || len(additional) != 2 || slices.Contains(additional, primary.IP) {
+		t.Fatalf("AllocateAdditional() = %v, %v, want 2 IPs besides %s", additional, err, primary.IP)
+	}
+
+	// A recreated sandbox gets the same IPs back, the primary one included
+	again, err := allocator.Allocate(ctx, req)
+	if err != nil || again.IP != primary.IP || !again.Existing {
+		t.Fatalf("Allocate() again = %+v, %v, want existing %s", again, err, primary.IP)
+	}
+	if got, err := allocator.AllocateAdditional(ctx, req, 2); err != nil || !slices.Equal(got, additional) {
+		t.Fatalf("AllocateAdditional() again = %v, %v, want %v", got, err, additional)
+	}
+
+	// Additional IPs count against the node limit
+	if _, err := allocator.AllocateAdditional(ctx, req, 4); !errors.Is(err, ErrNodeLimitReached) {
+		t.Fatalf("AllocateAdditional() over the limit error = %v, want ErrNodeLimitReached", err)
+	}
+}
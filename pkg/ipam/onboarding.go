@@ -0,0 +1,185 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// SetOnboardingPhase moves the onboarding to phase with message
+func SetOnboardingPhase(o *v1alpha1.NodeOnboarding, phase v1alpha1.NodeOnboardingPhase, message string) {
+	if o.Status.Phase != phase {
+		o.Status.LastTransitionTime = metav1.Now()
+	}
+	o.Status.Phase = phase
+	o.Status.Message = message
+}
+
+// OnboardingPhase returns the phase of a node that is not Ready yet from what
+// its installer reported and the IPs buffered for it, of which it needs
+// warmIPs before its startup taint is removed
+func OnboardingPhase(o *v1alpha1.NodeOnboarding, warmIPs int) (v1alpha1.NodeOnboardingPhase, string) {
+	switch {
+	case o.Status.InstalledVersion == "":
+		return v1alpha1.NodeOnboardingInstalling, ""
+	case o.Status.SelfTestError != "":
+		return v1alpha1.NodeOnboardingFailed, o.Status.SelfTestError
+	case o.Status.SelfTestVersion != o.Status.InstalledVersion && !o.Status.SelfTestSkipped:
+		return v1alpha1.NodeOnboardingSelfTesting, ""
+	case o.Status.WarmIPs < warmIPs:
+		return v1alpha1.NodeOnboardingPreWarming, fmt.Sprintf("%d of %d IPs buffered", o.Status.WarmIPs, warmIPs)
+	default:
+		return v1alpha1.NodeOnboardingReady, ""
+	}
+}
+
+// GetOnboarding returns the NodeOnboarding of node name
+func (a *Allocator) GetOnboarding(ctx context.Context, name string) (*v1alpha1.NodeOnboarding, error) {
+	resource, err := a.resource(NodeOnboardingGVR)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := resource.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get NodeOnboarding %s: %w", name, err)
+	}
+	return onboardingFromUnstructured(obj)
+}
+
+// CreateOnboarding creates o in the Installing phase
+func (a *Allocator) CreateOnboarding(ctx context.Context, o *v1alpha1.NodeOnboarding) (*v1alpha1.NodeOnboarding, error) {
+	o.APIVersion = v1alpha1.SchemeGroupVersion.String()
+	o.Kind = "NodeOnboarding"
+	SetOnboardingPhase(o, v1alpha1.NodeOnboardingInstalling, "")
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert NodeOnboarding to unstructured: %w", err)
+	}
+	resource, err := a.resource(NodeOnboardingGVR)
+	if err != nil {
+		return nil, err
+	}
+	created, err := resource.Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NodeOnboarding %s: %w", o.Name, err)
+	}
+	return onboardingFromUnstructured(created)
+}
+
+// ListOnboardings returns all NodeOnboardings
+func (a *Allocator) ListOnboardings(ctx context.Context) ([]v1alpha1.NodeOnboarding, error) {
+	resource, err := a.resource(NodeOnboardingGVR)
+	if err != nil {
+		return nil, err
+	}
+	list, err := resource.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NodeOnboardings: %w", err)
+	}
+
+	onboardings := make([]v1alpha1.NodeOnboarding, 0, len(list.Items))
+	for _, item := range list.Items {
+		o, err := onboardingFromUnstructured(&item)
+		if err != nil {
+			return nil, err
+		}
+		onboardings = append(onboardings, *o)
+	}
+	return onboardings, nil
+}
+
+// ModifyOnboarding applies mutate to the current NodeOnboarding and writes it
+// back, retrying on conflicts like modifyPool. When mutate returns
+// errSkipUpdate the onboarding is left untouched.
+func (a *Allocator) ModifyOnboarding(ctx context.Context, name string, mutate func(o *v1alpha1.NodeOnboarding) error) error {
+	var lastErr error
+
+	for i := 0; i < a.retry.Attempts; i++ {
+		if i > 0 {
+			a.backoff(i)
+		}
+
+		err := a.tryModifyOnboarding(ctx, name, mutate)
+		if err == nil {
+			return nil
+		}
+		if errors.IsConflict(err) {
+			lastErr = err
+			continue
+		}
+		return err
+	}
+
+	return fmt.Errorf("failed to update NodeOnboarding %s after %d retries: %w", name, a.retry.Attempts, lastErr)
+}
+
+func (a *Allocator) tryModifyOnboarding(ctx context.Context, name string, mutate func(o *v1alpha1.NodeOnboarding) error) error {
+	o, err := a.GetOnboarding(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := mutate(o); err == errSkipUpdate {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(o)
+	if err != nil {
+		return fmt.Errorf("failed to convert NodeOnboarding to unstructured: %w", err)
+	}
+	resource, err := a.resource(NodeOnboardingGVR)
+	if err != nil {
+		return err
+	}
+	_, err = resource.Update(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	return err
+}
+
+// ReportOnboarding applies report to the status of the NodeOnboarding of
+// the node, creating it owned by the node when the onboarding controller did
+// not yet, so no report of an installer starting first is lost
+func (a *Allocator) ReportOnboarding(ctx context.Context, node metav1.OwnerReference, report func(status *v1alpha1.NodeOnboardingStatus)) error {
+	modify := func() error {
+		return a.ModifyOnboarding(ctx, node.Name, func(o *v1alpha1.NodeOnboarding) error {
+			before := o.Status
+			report(&o.Status)
+			if o.Status == before {
+				return errSkipUpdate
+			}
+			return nil
+		})
+	}
+	err := modify()
+	if !errors.IsNotFound(err) {
+		return err
+	}
+
+	o := &v1alpha1.NodeOnboarding{ObjectMeta: metav1.ObjectMeta{
+		Name:            node.Name,
+		OwnerReferences: []metav1.OwnerReference{node},
+	}}
+	report(&o.Status)
+	_, err = a.CreateOnboarding(ctx, o)
+	if errors.IsAlreadyExists(err) {
+		// The onboarding controller created it meanwhile
+		return modify()
+	}
+	return err
+}
+
+func onboardingFromUnstructured(obj *unstructured.Unstructured) (*v1alpha1.NodeOnboarding, error) {
+	o := &v1alpha1.NodeOnboarding{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, o); err != nil {
+		return nil, fmt.Errorf("failed to convert unstructured to NodeOnboarding: %w", err)
+	}
+	return o, nil
+}
@@ -0,0 +1,71 @@
+package ipam
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestOnboardingPhase(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status v1alpha1.NodeOnboardingStatus
+		want   v1alpha1.NodeOnboardingPhase
+	}{
+		{"nothing reported", v1alpha1.NodeOnboardingStatus{}, v1alpha1.NodeOnboardingInstalling},
+		{"installed", v1alpha1.NodeOnboardingStatus{InstalledVersion: "v2"}, v1alpha1.NodeOnboardingSelfTesting},
+		{"self-test of an earlier release", v1alpha1.NodeOnboardingStatus{InstalledVersion: "v2", SelfTestVersion: "v1"}, v1alpha1.NodeOnboardingSelfTesting},
+		{"self-test skipped", v1alpha1.NodeOnboardingStatus{InstalledVersion: "v2", SelfTestSkipped: true, WarmIPs: 2}, v1alpha1.NodeOnboardingReady},
+		{"self-test failed", v1alpha1.NodeOnboardingStatus{InstalledVersion: "v2", SelfTestError: "no token"}, v1alpha1.NodeOnboardingFailed},
+		{"waiting for IPs", v1alpha1.NodeOnboardingStatus{InstalledVersion: "v2", SelfTestVersion: "v2", WarmIPs: 1}, v1alpha1.NodeOnboardingPreWarming},
+		{"warm", v1alpha1.NodeOnboardingStatus{InstalledVersion: "v2", SelfTestVersion: "v2", WarmIPs: 2}, v1alpha1.NodeOnboardingReady},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, _ := OnboardingPhase(&v1alpha1.NodeOnboarding{Status: tc.status}, 2); got != tc.want {
+				t.Errorf("OnboardingPhase() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReportOnboarding(t *testing.T) {
+	ctx := context.Background()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{NodeOnboardingGVR: "NodeOnboardingList"})
+	allocator := NewAllocator(client)
+	node := metav1.OwnerReference{APIVersion: "v1", Kind: "Node", Name: "node-1", UID: "node-uid"}
+
+	// The installer starts before the onboarding controller created the onboarding
+	err := allocator.ReportOnboarding(ctx, node, func(status *v1alpha1.NodeOnboardingStatus) {
+		status.InstalledVersion = "v2"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := allocator.GetOnboarding(ctx, "node-1")
+	if err != nil {
+		t.Fatalf("onboarding not created: %v", err)
+	}
+	if o.Status.InstalledVersion != "v2" || len(o.OwnerReferences) != 1 || o.OwnerReferences[0].UID != "node-uid" {
+		t.Fatalf("created onboarding = %+v, want v2 owned by the node", o)
+	}
+
+	err = allocator.ReportOnboarding(ctx, node, func(status *v1alpha1.NodeOnboardingStatus) {
+		status.SelfTestVersion = "v2"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, err = allocator.GetOnboarding(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if o.Status.InstalledVersion != "v2" || o.Status.SelfTestVersion != "v2" {
+		t.Errorf("reported status = %+v, want both reports applied", o.Status)
+	}
+}
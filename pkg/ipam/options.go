@@ -0,0 +1,55 @@
+package ipam
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// Option configures an Allocator created by New
+type Option func(*Allocator)
+
+// WithClient lets the allocator manage PodIPMigrations and NodeOnboardings,
+// which only exist in a cluster. Their methods fail without it.
+func WithClient(client dynamic.Interface) Option {
+	return func(a *Allocator) {
+		a.client = client
+	}
+}
+
+// WithRetryPolicy sets the backoff of pool updates that conflict, see
+// SetRetryPolicy
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(a *Allocator) {
+		a.SetRetryPolicy(policy)
+	}
+}
+
+// WithPoolLimiter makes every update of a pool wait for limiter first, see
+// SetPoolLimiter
+func WithPoolLimiter(limiter PoolLimiter) Option {
+	return func(a *Allocator) {
+		a.limiter = limiter
+	}
+}
+
+// New creates an allocator of the IPPools in pools
+func New(pools PoolStore, opts ...Option) *Allocator {
+	a := &Allocator{
+		pools: pools,
+		retry: DefaultRetryPolicy(),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// resource returns the client of the cluster resources of gvr
+func (a *Allocator) resource(gvr schema.GroupVersionResource) (dynamic.NamespaceableResourceInterface, error) {
+	if a.client == nil {
+		return nil, fmt.Errorf("allocator has no cluster client for %s", gvr.Resource)
+	}
+	return a.client.Resource(gvr), nil
+}
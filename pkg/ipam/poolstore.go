@@ -0,0 +1,158 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+)
+
+// PoolStore persists the IPPools an Allocator hands out IPs from. The
+// Allocator reads a pool, changes it and writes it back, so UpdatePool has to
+// fail with an error satisfying errors.IsConflict of
+// k8s.io/apimachinery/pkg/api/errors when the pool changed since it was read,
+// and GetPool with one satisfying errors.IsNotFound when there is no such pool.
+type PoolStore interface {
+	GetPool(ctx context.Context, name string) (*v1alpha1.IPPool, error)
+	ListPools(ctx context.Context) ([]v1alpha1.IPPool, error)
+	CreatePool(ctx context.Context, pool *v1alpha1.IPPool) error
+	UpdatePool(ctx context.Context, pool *v1alpha1.IPPool) error
+}
+
+// dynamicPoolStore keeps IPPools as custom resources, relying on their
+// resourceVersion for the conflicts
+type dynamicPoolStore struct {
+	client dynamic.Interface
+}
+
+// NewDynamicPoolStore returns the PoolStore of the IPPool custom resources
+// the client reaches
+func NewDynamicPoolStore(client dynamic.Interface) PoolStore {
+	return &dynamicPoolStore{client: client}
+}
+
+func (s *dynamicPoolStore) GetPool(ctx context.Context, name string) (*v1alpha1.IPPool, error) {
+	obj, err := s.client.Resource(IPPoolGVR).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pool := &v1alpha1.IPPool{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, pool); err != nil {
+		return nil, fmt.Errorf("failed to convert unstructured to IPPool: %w", err)
+	}
+	return pool, nil
+}
+
+func (s *dynamicPoolStore) ListPools(ctx context.Context) ([]v1alpha1.IPPool, error) {
+	list, err := s.client.Resource(IPPoolGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pools := make([]v1alpha1.IPPool, 0, len(list.Items))
+	for _, item := range list.Items {
+		pool := v1alpha1.IPPool{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &pool); err != nil {
+			return nil, fmt.Errorf("failed to convert unstructured to IPPool: %w", err)
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+func (s *dynamicPoolStore) CreatePool(ctx context.Context, pool *v1alpha1.IPPool) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		return fmt.Errorf("failed to convert IPPool to unstructured: %w", err)
+	}
+	_, err = s.client.Resource(IPPoolGVR).Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	return err
+}
+
+func (s *dynamicPoolStore) UpdatePool(ctx context.Context, pool *v1alpha1.IPPool) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		return fmt.Errorf("failed to convert IPPool to unstructured: %w", err)
+	}
+	_, err = s.client.Resource(IPPoolGVR).Update(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	return err
+}
+
+// MemoryPoolStore keeps IPPools in memory, for allocators embedded without a
+// cluster to plan allocations against, and for tests. Like the API server it
+// rejects updates of a pool read before its last update.
+type MemoryPoolStore struct {
+	mu      sync.Mutex
+	pools   map[string]*v1alpha1.IPPool
+	version int
+}
+
+// NewMemoryPoolStore returns a MemoryPoolStore holding copies of pools
+func NewMemoryPoolStore(pools ...*v1alpha1.IPPool) *MemoryPoolStore {
+	s := &MemoryPoolStore{pools: map[string]*v1alpha1.IPPool{}}
+	for _, pool := range pools {
+		s.store(pool)
+	}
+	return s
+}
+
+func (s *MemoryPoolStore) GetPool(_ context.Context, name string) (*v1alpha1.IPPool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pool, ok := s.pools[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(IPPoolGVR.GroupResource(), name)
+	}
+	return pool.DeepCopy(), nil
+}
+
+func (s *MemoryPoolStore) ListPools(_ context.Context) ([]v1alpha1.IPPool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pools := make([]v1alpha1.IPPool, 0, len(s.pools))
+	for _, pool := range s.pools {
+		pools = append(pools, *pool.DeepCopy())
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	return pools, nil
+}
+
+func (s *MemoryPoolStore) CreatePool(_ context.Context, pool *v1alpha1.IPPool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pools[pool.Name]; ok {
+		return apierrors.NewAlreadyExists(IPPoolGVR.GroupResource(), pool.Name)
+	}
+	s.store(pool)
+	return nil
+}
+
+func (s *MemoryPoolStore) UpdatePool(_ context.Context, pool *v1alpha1.IPPool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.pools[pool.Name]
+	if !ok {
+		return apierrors.NewNotFound(IPPoolGVR.GroupResource(), pool.Name)
+	}
+	if pool.ResourceVersion != current.ResourceVersion {
+		return apierrors.NewConflict(IPPoolGVR.GroupResource(), pool.Name,
+			fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+	s.store(pool)
+	return nil
+}
+
+// store keeps a copy of pool under the next resourceVersion
+func (s *MemoryPoolStore) store(pool *v1alpha1.IPPool) {
+	s.version++
+	pool = pool.DeepCopy()
+	pool.ResourceVersion = strconv.Itoa(s.version)
+	s.pools[pool.Name] = pool
+}
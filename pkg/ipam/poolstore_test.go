@@ -0,0 +1,62 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestMemoryPoolStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryPoolStore(&v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.0.0.0/29"},
+	})
+
+	stale, err := store.GetPool(ctx, "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocator := New(store, WithRetryPolicy(RetryPolicy{Attempts: 1}))
+	if _, err := allocator.Allocate(ctx, &AllocationRequest{PoolName: "pool", PodUID: "uid-a", NodeName: "node-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdatePool(ctx, stale); !apierrors.IsConflict(err) {
+		t.Errorf("UpdatePool() of a stale pool error = %v, want a conflict", err)
+	}
+	if _, err := store.GetPool(ctx, "missing"); !apierrors.IsNotFound(err) {
+		t.Errorf("GetPool() of a missing pool error = %v, want not found", err)
+	}
+	if err := allocator.CreatePool(ctx, &v1alpha1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pool"}}); !apierrors.IsAlreadyExists(err) {
+		t.Errorf("CreatePool() of an existing pool error = %v, want already exists", err)
+	}
+	if _, err := allocator.ListMigrations(ctx, ""); err == nil {
+		t.Error("ListMigrations() without a cluster client succeeded")
+	}
+}
+
+func ExampleNew() {
+	ctx := context.Background()
+	allocator := New(NewMemoryPoolStore(&v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.0.0.0/28", MaxIPsPerNode: 8},
+	}))
+
+	result, err := allocator.Allocate(ctx, &AllocationRequest{
+		PoolName:     "pods",
+		PodName:      "web",
+		PodNamespace: "default",
+		PodUID:       "2b6e0c1e",
+		NodeName:     "node-1",
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(result.IP, result.CIDR)
+	// Output: 10.0.0.2 10.0.0.0/28
+}
@@ -0,0 +1,107 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// PoolProtectionFinalizer keeps a deleted IPPool around until none of its IPs
+// is allocated anymore
+const PoolProtectionFinalizer = "ipam.gcp-cni.cast.ai/pool-protection"
+
+// ForceDeleteAnnotation set to "true" on an IPPool lets its deletion go ahead
+// while it still allocates IPs
+const ForceDeleteAnnotation = "gcp-cni.cast.ai/force-delete"
+
+// ProtectedIPAnnotation set to "true" on a pod protects the allocation of its
+// IP, see v1alpha1.IPAllocation.Protected
+const ProtectedIPAnnotation = "gcp-cni.cast.ai/protected-ip"
+
+// Reason of the v1alpha1.IPPoolDeletionBlocked condition
+const DeletionReasonAllocationsExist = "AllocationsExist"
+
+// maxListedHolders bounds the holders the DeletionBlocked condition names
+const maxListedHolders = 10
+
+// PoolHolders returns who holds the IPs allocated from pool, system
+// reservations aside, sorted by IP
+func PoolHolders(pool *v1alpha1.IPPool) []string {
+	ips := make([]string, 0, len(pool.Spec.Allocations))
+	for ip, allocation := range pool.Spec.Allocations {
+		if allocation.System == "" {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool { return compareIPs(ips[i], ips[j]) < 0 })
+
+	holders := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		allocation := pool.Spec.Allocations[ip]
+		holder := allocationOwner(allocation)
+		if allocation.NodeName != "" && holder != "node "+allocation.NodeName {
+			holder += " on " + allocation.NodeName
+		}
+		holders = append(holders, ip+" "+holder)
+	}
+	return holders
+}
+
+// DeletionBlockedCondition returns the DeletionBlocked condition of a deleted
+// pool still allocating IPs to holders
+func DeletionBlockedCondition(pool *v1alpha1.IPPool, holders []string) metav1.Condition {
+	listed := holders[:min(len(holders), maxListedHolders)]
+	message := fmt.Sprintf("%d IPs are still allocated: %s", len(holders), strings.Join(listed, ", "))
+	if len(listed) < len(holders) {
+		message += fmt.Sprintf(" and %d more", len(holders)-len(listed))
+	}
+	return metav1.Condition{
+		Type:               v1alpha1.IPPoolDeletionBlocked,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: pool.Generation,
+		Reason:             DeletionReasonAllocationsExist,
+		Message:            message,
+	}
+}
+
+// SetFinalizer adds finalizer to the pool, or removes it when present is false
+func (a *Allocator) SetFinalizer(ctx context.Context, poolName, finalizer string, present bool) error {
+	return a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		if slices.Contains(pool.Finalizers, finalizer) == present {
+			return errSkipUpdate
+		}
+		if present {
+			pool.Finalizers = append(pool.Finalizers, finalizer)
+		} else {
+			pool.Finalizers = slices.DeleteFunc(pool.Finalizers, func(f string) bool { return f == finalizer })
+		}
+		return nil
+	})
+}
+
+// SetProtected protects the allocation of ip, or lifts its protection when
+// protected is false
+func (a *Allocator) SetProtected(ctx context.Context, poolName, ip string, protected bool) error {
+	ip = CanonicalIP(ip)
+	return a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		allocation, ok := pool.Spec.Allocations[ip]
+		if !ok {
+			return fmt.Errorf("IP %s is not allocated in pool %s", ip, poolName)
+		}
+		if allocation.System != "" {
+			return fmt.Errorf("IP %s is the %s address of pool %s", ip, allocation.System, poolName)
+		}
+		if allocation.Protected == protected {
+			return errSkipUpdate
+		}
+		allocation.Protected = protected
+		pool.Spec.Allocations[ip] = allocation
+		return nil
+	})
+}
@@ -0,0 +1,65 @@
+package ipam
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestPoolHolders(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{
+		CIDR: "10.8.0.0/24",
+		Allocations: map[string]v1alpha1.IPAllocation{
+			"10.8.0.1":  {System: v1alpha1.SystemReservationGateway},
+			"10.8.0.10": {PodNamespace: "web", PodName: "a", PodUID: "uid-a", NodeName: "node-a"},
+			"10.8.0.9":  {NodeName: "node-b", Buffered: true},
+		},
+	}}
+
+	want := []string{"10.8.0.9 node node-b", "10.8.0.10 pod web/a (uid-a) on node-a"}
+	if got := PoolHolders(pool); !slices.Equal(got, want) {
+		t.Errorf("PoolHolders() = %q, want %q", got, want)
+	}
+
+	var holders []string
+	for i := range 12 {
+		holders = append(holders, fmt.Sprintf("10.8.0.%d node node-a", i))
+	}
+	condition := DeletionBlockedCondition(pool, holders)
+	if condition.Type != v1alpha1.IPPoolDeletionBlocked || condition.Reason != DeletionReasonAllocationsExist ||
+		!strings.HasPrefix(condition.Message, "12 IPs are still allocated: 10.8.0.0 node node-a") ||
+		!strings.HasSuffix(condition.Message, "10.8.0.9 node node-a and 2 more") {
+		t.Errorf("DeletionBlockedCondition() = %+v", condition)
+	}
+}
+
+func TestProtectedAllocations(t *testing.T) {
+	now := time.Now()
+	expired := metav1.NewTime(now.Add(-time.Minute))
+	if leaseExpired(v1alpha1.IPAllocation{PodUID: "uid-a", LeaseExpiresAt: &expired, Protected: true}, now) {
+		t.Error("leaseExpired() = true for a protected allocation")
+	}
+
+	pool := v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "ippool-default"},
+		Spec: v1alpha1.IPPoolSpec{CIDR: "10.8.0.0/24", Allocations: map[string]v1alpha1.IPAllocation{
+			"10.8.0.5": {PodNamespace: "vm", PodName: "a", PodUID: "uid-a", NodeName: "node-a", Protected: true},
+			"10.8.0.6": {PodNamespace: "vm", PodName: "b", PodUID: "uid-b", NodeName: "node-a"},
+		}},
+	}
+	repairs := map[string]RepairAction{}
+	for _, d := range Verify([]v1alpha1.IPPool{pool}, nil, nil, nil) {
+		if d.Kind == DriftOrphanAllocation {
+			repairs[d.IP] = d.Repair
+		}
+	}
+	if repairs["10.8.0.5"] != RepairManual || repairs["10.8.0.6"] != RepairReleaseIP {
+		t.Errorf("Verify() orphan allocation repairs = %v, want manual for the protected one", repairs)
+	}
+}
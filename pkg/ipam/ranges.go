@@ -0,0 +1,211 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// poolRanges returns the secondary ranges backing the pool. Pools without
+// SecondaryRanges are backed by their single CIDR and SecondaryRangeName.
+func poolRanges(pool *v1alpha1.IPPool) []v1alpha1.SecondaryRange {
+	if len(pool.Spec.SecondaryRanges) > 0 {
+		return pool.Spec.SecondaryRanges
+	}
+	return []v1alpha1.SecondaryRange{{
+		Name: pool.Spec.SecondaryRangeName,
+		CIDR: pool.Spec.CIDR,
+	}}
+}
+
+// rangeForIP returns the range of the pool containing ip, falling back to the
+// first range for IPs outside all of them (e.g. IPs requested by migrations)
+func rangeForIP(pool *v1alpha1.IPPool, ip string) v1alpha1.SecondaryRange {
+	ranges := poolRanges(pool)
+	if addr, err := ParseAddr(ip); err == nil {
+		for _, r := range ranges {
+			if cidrContains(r.CIDR, addr) {
+				return r
+			}
+		}
+	}
+	return ranges[0]
+}
+
+// checkRequestedIP checks that the requested ip is a usable address of one
+// of the pool's ranges: not its network, gateway or broadcast address and
+// not in a vacating slice
+func checkRequestedIP(pool *v1alpha1.IPPool, ip string) error {
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("requested IP %q is not an IP address", ip)
+	}
+	for _, r := range poolRanges(pool) {
+		prefix, err := ParsePrefix(r.CIDR)
+		if err != nil || !prefix.Contains(addr) {
+			continue
+		}
+		if isReserved(addr, prefix) {
+			return fmt.Errorf("requested IP %s is the network, gateway or broadcast address of range %s of IPPool %s", addr, r.CIDR, pool.Name)
+		}
+		if isVacating(pool, addr.String()) {
+			return fmt.Errorf("requested IP %s is in a vacating slice of IPPool %s", addr, pool.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("requested IP %s is not in IPPool %s", addr, pool.Name)
+}
+
+// RangeName returns the name of the secondary range of the pool ip was
+// allocated from
+func RangeName(pool *v1alpha1.IPPool, ip string) string {
+	return rangeForIP(pool, ip).Name
+}
+
+// resultForIP describes ip as allocated from the pool
+func resultForIP(pool *v1alpha1.IPPool, ip string) *AllocationResult {
+	r := rangeForIP(pool, ip)
+	return &AllocationResult{
+		IP:                 ip,
+		CIDR:               r.CIDR,
+		Subnet:             pool.Spec.Subnet,
+		SecondaryRangeName: r.Name,
+	}
+}
+
+// poolCapacity returns the number of usable IPs across all ranges of the pool,
+// capped at maxCapacity
+func poolCapacity(pool *v1alpha1.IPPool) int {
+	capacity := 0
+	for _, r := range poolRanges(pool) {
+		capacity = min(capacity+calculateCapacity(r.CIDR), maxCapacity)
+	}
+	return capacity
+}
+
+// nodeAllocations returns the number of IPs of the pool held on the node, not
+// counting its buffer
+func nodeAllocations(pool *v1alpha1.IPPool, nodeName string) int {
+	held := 0
+	for _, allocation := range pool.Spec.Allocations {
+		if allocation.NodeName == nodeName && !allocation.Buffered {
+			held++
+		}
+	}
+	return held
+}
+
+// podAllocation returns the IP of the pool the pod already holds on the node
+func podAllocation(pool *v1alpha1.IPPool, podUID, nodeName string) (string, bool) {
+	if podUID == "" {
+		return "", false
+	}
+	for ip, allocation := range pool.Spec.Allocations {
+		if allocation.PodUID == podUID && allocation.NodeName == nodeName &&
+			!allocation.Buffered && !allocation.Additional && allocation.System == "" && allocation.FloatingIP == "" {
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+// updatePoolStatus recalculates the pool status from its allocations
+func updatePoolStatus(pool *v1alpha1.IPPool) {
+	capacity := poolCapacity(pool)
+	pool.Status.Capacity = capacity
+	pool.Status.Allocated = 0
+	pool.Status.Draining = 0
+	for ip, allocation := range pool.Spec.Allocations {
+		if allocation.System != "" {
+			continue
+		}
+		pool.Status.Allocated++
+		if isDraining(pool, ip) {
+			pool.Status.Draining++
+		}
+	}
+	pool.Status.Available = capacity - pool.Status.Allocated
+	pool.Status.LastUpdated = metav1.Now()
+}
+
+// allocateFromRanges finds an available IP, choosing the range according to
+// the pool's RangeStrategy. Full ranges are skipped. A non-empty rangeName
+// restricts the allocation to that range.
+func allocateFromRanges(pool *v1alpha1.IPPool, rangeName string) (string, v1alpha1.SecondaryRange, error) {
+	return allocateFromFamilyRanges(pool, rangeName, "")
+}
+
+// allocateFromFamilyRanges is allocateFromRanges restricted to the ranges of
+// family, unless it is empty
+func allocateFromFamilyRanges(pool *v1alpha1.IPPool, rangeName string, family corev1.IPFamily) (string, v1alpha1.SecondaryRange, error) {
+	ranges := familyRanges(poolRanges(pool), family)
+	if len(ranges) == 0 && family != "" {
+		return "", v1alpha1.SecondaryRange{}, fmt.Errorf("%w: pool %s has no %s range", ErrIPFamilyUnavailable, pool.Name, family)
+	}
+	if rangeName != "" {
+		ranges = lo.Filter(ranges, func(r v1alpha1.SecondaryRange, _ int) bool {
+			return r.Name == rangeName
+		})
+		if len(ranges) == 0 {
+			return "", v1alpha1.SecondaryRange{}, fmt.Errorf("pool %s has no secondary range %s", pool.Name, rangeName)
+		}
+	}
+
+	ranges = lo.Filter(ranges, func(r v1alpha1.SecondaryRange, _ int) bool {
+		return !r.Draining
+	})
+	if len(ranges) == 0 {
+		return "", v1alpha1.SecondaryRange{}, fmt.Errorf("all candidate ranges of pool %s are draining", pool.Name)
+	}
+
+	used := make([]int, len(ranges))
+	for ip := range pool.Spec.Allocations {
+		addr, err := ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+		for i, r := range ranges {
+			if cidrContains(r.CIDR, addr) {
+				used[i]++
+				break
+			}
+		}
+	}
+
+	for _, i := range rangeOrder(ranges, used, pool.Spec.RangeStrategy) {
+		ip, err := findAvailableIPOutside(ranges[i].CIDR, pool.Spec.Allocations, pool.Spec.Vacating)
+		if err == nil {
+			return ip, ranges[i], nil
+		}
+	}
+	return "", v1alpha1.SecondaryRange{}, fmt.Errorf("%w in any of the %d ranges of pool %s", ErrPoolExhausted, len(ranges), pool.Name)
+}
+
+// rangeOrder returns the indexes of ranges in the order they should be tried.
+// FillFirst keeps the configured order, Weighted tries the range furthest
+// below its weighted share first.
+func rangeOrder(ranges []v1alpha1.SecondaryRange, used []int, strategy v1alpha1.RangeStrategy) []int {
+	order := make([]int, len(ranges))
+	for i := range order {
+		order[i] = i
+	}
+	if strategy == v1alpha1.RangeStrategyFillFirst {
+		return order
+	}
+
+	weight := func(i int) int {
+		if ranges[i].Weight > 0 {
+			return ranges[i].Weight
+		}
+		return 1
+	}
+	// Compare used/weight ratios without division, ties keep the configured order
+	sort.SliceStable(order, func(a, b int) bool {
+		return used[order[a]]*weight(order[b]) < used[order[b]]*weight(order[a])
+	})
+	return order
+}
@@ -0,0 +1,99 @@
+package ipam
+
+import (
+	"testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestAllocateFromRanges(t *testing.T) {
+	ranges := []v1alpha1.SecondaryRange{
+		{Name: "a", CIDR: "10.0.0.0/29", Weight: 1},
+		{Name: "b", CIDR: "10.0.1.0/29", Weight: 2},
+	}
+
+	tests := []struct {
+		name      string
+		strategy  v1alpha1.RangeStrategy
+		rangeName string
+		allocated int
+		wantRange []string
+	}{
+		{
+			name:      "weighted spreads by weight",
+			strategy:  v1alpha1.RangeStrategyWeighted,
+			allocated: 6,
+			wantRange: []string{"a", "b", "b", "a", "b", "b"},
+		},
+		{
+			name:      "fill first exhausts ranges in order",
+			strategy:  v1alpha1.RangeStrategyFillFirst,
+			allocated: 8,
+			wantRange: []string{"a", "a", "a", "a", "a", "b", "b", "b"},
+		},
+		{
+			name:      "range name restricts allocation",
+			rangeName: "a",
+			allocated: 2,
+			wantRange: []string{"a", "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{
+				SecondaryRanges: ranges,
+				RangeStrategy:   tt.strategy,
+				Allocations:     map[string]v1alpha1.IPAllocation{},
+			}}
+
+			for i := 0; i < tt.allocated; i++ {
+				ip, r, err := allocateFromRanges(pool, tt.rangeName)
+				if err != nil {
+					t.Fatalf("allocation %d: %v", i, err)
+				}
+				if r.Name != tt.wantRange[i] {
+					t.Errorf("allocation %d from range %s, want %s", i, r.Name, tt.wantRange[i])
+				}
+				if got := rangeForIP(pool, ip); got.Name != r.Name {
+					t.Errorf("rangeForIP(%s) = %s, want %s", ip, got.Name, r.Name)
+				}
+				pool.Spec.Allocations[ip] = v1alpha1.IPAllocation{}
+			}
+		})
+	}
+
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{SecondaryRanges: ranges}}
+	if got := poolCapacity(pool); got != 10 {
+		t.Errorf("poolCapacity() = %d, want 10", got)
+	}
+}
+
+func TestAllocateSkipsDrainingRanges(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{
+		SecondaryRanges: []v1alpha1.SecondaryRange{
+			{Name: "old", CIDR: "10.0.0.0/29", Draining: true},
+			{Name: "new", CIDR: "10.0.1.0/29"},
+		},
+		Allocations: map[string]v1alpha1.IPAllocation{
+			"10.0.0.2": {PodUID: "a"},
+		},
+	}}
+
+	ip, r, err := allocateFromRanges(pool, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "new" {
+		t.Errorf("allocated %s from range %s, want new", ip, r.Name)
+	}
+	if _, _, err := allocateFromRanges(pool, "old"); err == nil {
+		t.Error("allocation restricted to a draining range succeeded")
+	}
+
+	pool.Spec.Allocations[ip] = v1alpha1.IPAllocation{PodUID: "b"}
+	updatePoolStatus(pool)
+	if pool.Status.Draining != 1 {
+		t.Errorf("Status.Draining = %d, want 1", pool.Status.Draining)
+	}
+}
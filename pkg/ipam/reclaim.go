@@ -0,0 +1,63 @@
+package ipam
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// ReclaimCandidate is a pod allocation of a pool that may have outlived its pod
+type ReclaimCandidate struct {
+	IP                 string
+	SecondaryRangeName string
+	v1alpha1.IPAllocation
+}
+
+// ReclaimCandidates returns the pod allocations of the pool that may be
+// reclaimed when it is exhausted, oldest first, none unless the pool sets
+// ReclaimOnExhaustion. Protected, buffered, floating and system IPs are not
+// candidates; the caller verifies each pod with StaleReason and
+// releases its IP with ReleaseIfOwner.
+func (a *Allocator) ReclaimCandidates(ctx context.Context, poolName string) ([]ReclaimCandidate, error) {
+	pool, err := a.getPool(ctx, poolName)
+	if err != nil || !pool.Spec.ReclaimOnExhaustion {
+		return nil, err
+	}
+
+	var candidates []ReclaimCandidate
+	for ip, allocation := range pool.Spec.Allocations {
+		if allocation.PodUID == "" || allocation.Protected || allocation.Buffered ||
+			allocation.System != "" || allocation.FloatingIP != "" || allocation.PodName == ConflictPlaceholder {
+			continue
+		}
+		candidates = append(candidates, ReclaimCandidate{
+			IP:                 ip,
+			SecondaryRangeName: rangeForIP(pool, ip).Name,
+			IPAllocation:       allocation,
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].AllocatedAt.Before(&candidates[j].AllocatedAt)
+	})
+	return candidates, nil
+}
+
+// StaleReason returns why the allocation outlived its pod, the pod of its
+// namespace and name or nil when there is none, and "" while the pod holding
+// it still runs
+func StaleReason(allocation v1alpha1.IPAllocation, pod *corev1.Pod) string {
+	switch {
+	case pod == nil:
+		return "pod deleted"
+	case string(pod.UID) != allocation.PodUID:
+		return "pod recreated"
+	case pod.Status.Phase == corev1.PodSucceeded:
+		return "pod completed"
+	case pod.Status.Phase == corev1.PodFailed:
+		return "pod failed"
+	}
+	return ""
+}
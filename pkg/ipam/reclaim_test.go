@@ -0,0 +1,71 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestReclaimCandidates(t *testing.T) {
+	ctx := context.Background()
+	old := metav1.NewTime(time.Now().Add(-time.Hour))
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{CIDR: "10.0.0.0/29", Allocations: map[string]v1alpha1.IPAllocation{
+			"10.0.0.2": {PodName: "web", PodNamespace: "default", PodUID: "web-uid", NodeName: "node-1", AllocatedAt: metav1.Now()},
+			"10.0.0.3": {PodName: "job", PodNamespace: "default", PodUID: "job-uid", NodeName: "node-2", AllocatedAt: old},
+			"10.0.0.4": {PodName: "db", PodNamespace: "default", PodUID: "db-uid", NodeName: "node-1", Protected: true},
+			"10.0.0.5": {NodeName: "node-1", Buffered: true},
+			"10.0.0.6": {NodeName: "node-2", Buffered: true},
+		}},
+	}
+	allocator := New(NewMemoryPoolStore(pool))
+
+	_, err := allocator.Allocate(ctx, &AllocationRequest{PoolName: "pool", PodUID: "new-uid", NodeName: "node-1"})
+	if !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("Allocate() from a full pool error = %v, want ErrPoolExhausted", err)
+	}
+	if candidates, err := allocator.ReclaimCandidates(ctx, "pool"); err != nil || len(candidates) != 0 {
+		t.Fatalf("ReclaimCandidates() without opting in = %v, %v, want none", candidates, err)
+	}
+
+	pool.Spec.ReclaimOnExhaustion = true
+	allocator = New(NewMemoryPoolStore(pool))
+	candidates, err := allocator.ReclaimCandidates(ctx, "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 || candidates[0].IP != "10.0.0.3" || candidates[1].IP != "10.0.0.2" {
+		t.Errorf("ReclaimCandidates() = %+v, want the pod allocations oldest first", candidates)
+	}
+}
+
+func TestStaleReason(t *testing.T) {
+	allocation := v1alpha1.IPAllocation{PodName: "web", PodNamespace: "default", PodUID: "web-uid"}
+	pod := func(uid string, phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: types.UID(uid)}, Status: corev1.PodStatus{Phase: phase}}
+	}
+
+	for _, tc := range []struct {
+		pod  *corev1.Pod
+		want string
+	}{
+		{nil, "pod deleted"},
+		{pod("other-uid", corev1.PodRunning), "pod recreated"},
+		{pod("web-uid", corev1.PodSucceeded), "pod completed"},
+		{pod("web-uid", corev1.PodFailed), "pod failed"},
+		{pod("web-uid", corev1.PodRunning), ""},
+		{pod("web-uid", corev1.PodPending), ""},
+	} {
+		if got := StaleReason(allocation, tc.pod); got != tc.want {
+			t.Errorf("StaleReason(%v) = %q, want %q", tc.pod, got, tc.want)
+		}
+	}
+}
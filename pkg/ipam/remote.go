@@ -0,0 +1,108 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// AllocationAPIGroup is the aggregated API the provisioner serves
+	// server-side allocations on
+	AllocationAPIGroup = "allocation.gcp-cni.cast.ai"
+
+	// AllocationAPIVersion is the version of AllocationAPIGroup
+	AllocationAPIVersion = "v1alpha1"
+)
+
+// Reasons of the Status the allocation API fails with when the pool refuses
+// the allocation, mapped back to the errors of Allocate
+const (
+	ReasonNodeLimitReached metav1.StatusReason = "NodeLimitReached"
+	ReasonFrozen           metav1.StatusReason = "Frozen"
+	ReasonPoolExhausted    metav1.StatusReason = "PoolExhausted"
+)
+
+// AllocationAPIPath is the path of the allocate subresource of the pool
+func AllocationAPIPath(poolName string) string {
+	return fmt.Sprintf("/apis/%s/%s/ippools/%s/allocate", AllocationAPIGroup, AllocationAPIVersion, poolName)
+}
+
+// AllocateRemote allocates an IP like Allocate, but has the allocation API of
+// the provisioner read and update the pool, so only the request and the
+// result cross the wire however large the pool is. client is any REST client
+// of the API server, which proxies the request to the provisioner.
+func AllocateRemote(ctx context.Context, client rest.Interface, req *AllocationRequest) (*AllocationResult, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal allocation request: %w", err)
+	}
+
+	raw, err := client.Post().
+		AbsPath(AllocationAPIPath(req.PoolName)).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		Do(ctx).
+		Raw()
+	if err != nil {
+		// Clients without a scheme for the group, like the discovery client,
+		// do not decode the Status, so the reason is read from the body
+		status := metav1.Status{}
+		if json.Unmarshal(raw, &status) != nil {
+			var apiStatus apierrors.APIStatus
+			if !errors.As(err, &apiStatus) {
+				return nil, err
+			}
+			status = apiStatus.Status()
+		}
+		switch status.Reason {
+		case ReasonNodeLimitReached:
+			return nil, fmt.Errorf("%w: allocation API: %s", ErrNodeLimitReached, status.Message)
+		case ReasonFrozen:
+			return nil, fmt.Errorf("%w: allocation API: %s", ErrFrozen, status.Message)
+		case ReasonPoolExhausted:
+			return nil, fmt.Errorf("%w: allocation API: %s", ErrPoolExhausted, status.Message)
+		}
+		return nil, err
+	}
+
+	result := &AllocationResult{}
+	if err := json.Unmarshal(raw, result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal allocation result: %w", err)
+	}
+	if result.IP == "" {
+		return nil, fmt.Errorf("allocation API returned no IP")
+	}
+	return result, nil
+}
+
+// AllocationStatus is the Status the allocation API answers a failed
+// allocation with
+func AllocationStatus(err error) *metav1.Status {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  err.Error(),
+	}
+	var apiStatus apierrors.APIStatus
+	switch {
+	case errors.Is(err, ErrNodeLimitReached):
+		status.Code, status.Reason = http.StatusUnprocessableEntity, ReasonNodeLimitReached
+	case errors.Is(err, ErrFrozen):
+		status.Code, status.Reason = http.StatusUnprocessableEntity, ReasonFrozen
+	case errors.Is(err, ErrPoolExhausted):
+		status.Code, status.Reason = http.StatusUnprocessableEntity, ReasonPoolExhausted
+	case errors.As(err, &apiStatus):
+		// Errors of the pool read and update, e.g. the pool is not found
+		status.Code, status.Reason, status.Details = apiStatus.Status().Code, apiStatus.Status().Reason, apiStatus.Status().Details
+	default:
+		status.Code, status.Reason = http.StatusInternalServerError, metav1.StatusReasonInternalError
+	}
+	return &status
+}
@@ -0,0 +1,55 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+func TestAllocateRemote(t *testing.T) {
+	var fail error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != AllocationAPIPath("pool") {
+			t.Errorf("request = %s %s, want POST %s", r.Method, r.URL.Path, AllocationAPIPath("pool"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if fail != nil {
+			status := AllocationStatus(fail)
+			w.WriteHeader(int(status.Code))
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&AllocationResult{IP: "10.0.0.2", CIDR: "10.0.0.2/32"})
+	}))
+	defer server.Close()
+
+	client, err := rest.UnversionedRESTClientFor(&rest.Config{
+		Host:          server.URL,
+		ContentConfig: rest.ContentConfig{NegotiatedSerializer: scheme.Codecs.WithoutConversion()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &AllocationRequest{PoolName: "pool", PodUID: "a", NodeName: "node-1"}
+
+	result, err := AllocateRemote(context.Background(), client, req)
+	if err != nil || result.IP != "10.0.0.2" {
+		t.Fatalf("AllocateRemote() = %v, %v, want 10.0.0.2", result, err)
+	}
+
+	// Refusals of the pool keep their errors across the wire
+	for _, want := range []error{ErrNodeLimitReached, ErrFrozen} {
+		fail = fmt.Errorf("%w: pool", want)
+		if _, err := AllocateRemote(context.Background(), client, req); !errors.Is(err, want) {
+			t.Errorf("AllocateRemote() error = %v, want %v", err, want)
+		}
+	}
+}
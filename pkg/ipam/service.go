@@ -0,0 +1,92 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ServiceRef identifies the Service holding a reserved IP
+type ServiceRef struct {
+	Namespace string
+	Name      string
+	UID       string
+}
+
+// ReserveServiceIP returns the IP reserved for the Service in a Service class
+// pool, reserving one if the Service has none yet. A non-empty requestedIP
+// (e.g. an IP already set on the Service) is reserved instead of the next free
+// one, it has to be a usable address of the pool.
+func (a *Allocator) ReserveServiceIP(ctx context.Context, poolName string, svc ServiceRef, requestedIP string) (string, error) {
+	var reservedIP string
+	err := a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		reservedIP = ""
+		if pool.Spec.Class != v1alpha1.PoolClassService {
+			return fmt.Errorf("IPPool %s is not a %s class pool", poolName, v1alpha1.PoolClassService)
+		}
+
+		for ip, allocation := range pool.Spec.Allocations {
+			if allocation.ServiceUID == svc.UID {
+				reservedIP = ip
+				return errSkipUpdate
+			}
+		}
+
+		if err := a.checkFrozen(); err != nil {
+			return err
+		}
+
+		ip := CanonicalIP(requestedIP)
+		if ip != "" {
+			if err := checkRequestedIP(pool, ip); err != nil {
+				return err
+			}
+			if _, exists := pool.Spec.Allocations[ip]; exists {
+				return fmt.Errorf("requested IP %s is already reserved", ip)
+			}
+		} else {
+			var err error
+			ip, _, err = allocateFromRanges(pool, "")
+			if err != nil {
+				return fmt.Errorf("failed to find available IP: %w", err)
+			}
+		}
+
+		pool.Spec.Allocations[ip] = v1alpha1.IPAllocation{
+			ServiceNamespace: svc.Namespace,
+			ServiceName:      svc.Name,
+			ServiceUID:       svc.UID,
+			AllocatedAt:      metav1.Now(),
+		}
+		reservedIP = ip
+		return nil
+	})
+	return reservedIP, err
+}
+
+// ReleaseServiceIPs releases the reservations of Services whose UID is not in
+// alive. It returns the number of released reservations.
+func (a *Allocator) ReleaseServiceIPs(ctx context.Context, poolName string, alive map[string]bool) (int, error) {
+	released := 0
+	err := a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		released = 0
+		if pool.Spec.Class != v1alpha1.PoolClassService {
+			return errSkipUpdate
+		}
+
+		for ip, allocation := range pool.Spec.Allocations {
+			if !alive[allocation.ServiceUID] {
+				delete(pool.Spec.Allocations, ip)
+				released++
+			}
+		}
+
+		if released == 0 {
+			return errSkipUpdate
+		}
+		return nil
+	})
+	return released, err
+}
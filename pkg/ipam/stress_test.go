@@ -0,0 +1,216 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/castai/gcp-cni/internal/telemetry"
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// conflictingClient returns a fake dynamic client serving the pools that, like
+// the API server, rejects updates carrying a stale resourceVersion. The fake
+// tracker alone accepts every update, so concurrent writers would silently
+// overwrite each other. The returned counter counts the rejected updates.
+func conflictingClient(t *testing.T, pools ...*v1alpha1.IPPool) (*dynamicfake.FakeDynamicClient, *atomic.Int64) {
+	t.Helper()
+	objects := make([]runtime.Object, 0, len(pools))
+	for _, pool := range pools {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, &unstructured.Unstructured{Object: obj})
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{IPPoolGVR: "IPPoolList"}, objects...)
+
+	var mu sync.Mutex
+	conflicts := &atomic.Int64{}
+	client.PrependReactor("update", IPPoolGVR.Resource, func(action clienttesting.Action) (bool, runtime.Object, error) {
+		obj := action.(clienttesting.UpdateAction).GetObject().(*unstructured.Unstructured).DeepCopy()
+
+		mu.Lock()
+		defer mu.Unlock()
+		current, err := client.Tracker().Get(IPPoolGVR, "", obj.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		currentMeta, err := meta.Accessor(current)
+		if err != nil {
+			return true, nil, err
+		}
+		if obj.GetResourceVersion() != currentMeta.GetResourceVersion() {
+			conflicts.Add(1)
+			return true, nil, apierrors.NewConflict(IPPoolGVR.GroupResource(), obj.GetName(),
+				fmt.Errorf("resourceVersion %q is stale", obj.GetResourceVersion()))
+		}
+		version, _ := strconv.Atoi(currentMeta.GetResourceVersion())
+		obj.SetResourceVersion(strconv.Itoa(version + 1))
+		return true, obj, client.Tracker().Update(IPPoolGVR, obj, "")
+	})
+	return client, conflicts
+}
+
+// slowClient adds a round trip latency to IPPool reads and writes, so
+// concurrent writers interleave between reading and updating a pool as they do
+// against a real API server, even on a single CPU
+type slowClient struct {
+	dynamic.Interface
+	latency time.Duration
+}
+
+func (c slowClient) Resource(gvr schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return slowResource{NamespaceableResourceInterface: c.Interface.Resource(gvr), latency: c.latency}
+}
+
+type slowResource struct {
+	dynamic.NamespaceableResourceInterface
+	latency time.Duration
+}
+
+func (r slowResource) Get(ctx context.Context, name string, options metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	time.Sleep(r.latency)
+	return r.NamespaceableResourceInterface.Get(ctx, name, options, subresources...)
+}
+
+func (r slowResource) Update(ctx context.Context, obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	time.Sleep(r.latency)
+	return r.NamespaceableResourceInterface.Update(ctx, obj, options, subresources...)
+}
+
+func TestConcurrentAllocateRelease(t *testing.T) {
+	const workers = 100
+
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec:       v1alpha1.IPPoolSpec{CIDR: "10.0.0.0/22"},
+	}
+	client, conflicts := conflictingClient(t, pool)
+	allocator := NewAllocator(slowClient{Interface: client, latency: time.Millisecond})
+	// Short enough to keep the test fast, long enough to spread the retries
+	// of hundreds of writers under the race detector
+	allocator.retry.BaseDelay = 50 * time.Millisecond
+
+	var mu sync.Mutex
+	held := map[string]string{} // pod UID -> IP
+	owners := map[string]string{}
+	maxRetries := 0
+
+	// Every worker allocates for one pod, half of them release right away and
+	// allocate for a second pod, so allocations race with releases
+	// call counts the retries of a single call in a telemetry record, as the plugin does
+	call := func(id string, f func(ctx context.Context) error) error {
+		record := telemetry.NewRecord("ADD", id, "eth0")
+		err := f(telemetry.NewContext(context.Background(), record))
+		mu.Lock()
+		defer mu.Unlock()
+		for _, n := range record.Retries {
+			maxRetries = max(maxRetries, n)
+		}
+		return err
+	}
+
+	run := func(i int) error {
+		allocate := func(uid string) (string, error) {
+			var result *AllocationResult
+			err := call(uid, func(ctx context.Context) (err error) {
+				result, err = allocator.Allocate(ctx, &AllocationRequest{
+					PoolName: "pool",
+					PodUID:   uid,
+					NodeName: fmt.Sprintf("node-%d", i%10),
+				})
+				return err
+			})
+			if err != nil {
+				return "", err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if owner, taken := owners[result.IP]; taken {
+				return "", fmt.Errorf("IP %s handed to %s while held by %s", result.IP, uid, owner)
+			}
+			owners[result.IP], held[uid] = uid, result.IP
+			return result.IP, nil
+		}
+
+		uid := fmt.Sprintf("pod-%d", i)
+		ip, err := allocate(uid)
+		if err != nil || i%2 == 1 {
+			return err
+		}
+
+		// Forget the owner first, the IP may be handed out again once released
+		mu.Lock()
+		delete(owners, ip)
+		delete(held, uid)
+		mu.Unlock()
+		if err := call(uid, func(ctx context.Context) error { return allocator.Release(ctx, "pool", ip) }); err != nil {
+			return err
+		}
+		_, err = allocate(uid + "-next")
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := run(i); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if conflicts.Load() == 0 {
+		t.Error("no update conflicted, the test does not exercise concurrent writers")
+	}
+	if maxRetries >= MaxRetries {
+		t.Errorf("a call retried %d times, want fewer than %d", maxRetries, MaxRetries)
+	}
+	t.Logf("%d conflicts, at most %d retries per call", conflicts.Load(), maxRetries)
+
+	final, err := allocator.getPool(context.Background(), "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workloads := 0
+	for ip, allocation := range final.Spec.Allocations {
+		if allocation.System != "" {
+			continue
+		}
+		workloads++
+		if held[allocation.PodUID] != ip {
+			t.Errorf("pool records %s for %s, the pod holds %s", ip, allocation.PodUID, held[allocation.PodUID])
+		}
+	}
+	if workloads != len(held) || workloads != workers {
+		t.Errorf("pool holds %d allocations, %d pods hold an IP, want %d", workloads, len(held), workers)
+	}
+	if final.Status.Allocated != workers {
+		t.Errorf("Status.Allocated = %d, want %d", final.Status.Allocated, workers)
+	}
+}
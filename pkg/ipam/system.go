@@ -0,0 +1,42 @@
+package ipam
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// systemReservations returns the addresses of the range the network itself
+// uses, see isReserved, keyed by IP
+func systemReservations(cidr string) map[string]v1alpha1.SystemReservation {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil || hostBits(prefix) < 2 {
+		return nil
+	}
+	network := prefix.Addr()
+	reservations := map[string]v1alpha1.SystemReservation{
+		network.String():        v1alpha1.SystemReservationNetwork,
+		network.Next().String(): v1alpha1.SystemReservationGateway,
+	}
+	if network.Is4() {
+		reservations[lastAddr(prefix).String()] = v1alpha1.SystemReservationBroadcast
+	}
+	return reservations
+}
+
+// reserveSystemIPs records the system reservations of all ranges of the pool
+// as allocations. An address a workload got before its range was reserved
+// stays with the workload until it is released.
+func reserveSystemIPs(pool *v1alpha1.IPPool) {
+	if pool.Spec.Allocations == nil {
+		pool.Spec.Allocations = make(map[string]v1alpha1.IPAllocation)
+	}
+	for _, r := range poolRanges(pool) {
+		for ip, role := range systemReservations(r.CIDR) {
+			if _, exists := pool.Spec.Allocations[ip]; exists {
+				continue
+			}
+			pool.Spec.Allocations[ip] = v1alpha1.IPAllocation{System: role, AllocatedAt: metav1.Now()}
+		}
+	}
+}
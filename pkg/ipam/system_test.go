@@ -0,0 +1,48 @@
+package ipam
+
+import (
+	"testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestReserveSystemIPs(t *testing.T) {
+	pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{
+		SecondaryRanges: []v1alpha1.SecondaryRange{
+			{Name: "a", CIDR: "10.0.0.0/29"},
+			{Name: "b", CIDR: "fd00::/126"},
+			{Name: "c", CIDR: "10.0.1.0/31"},
+		},
+		// Handed out before the gateway was reserved
+		Allocations: map[string]v1alpha1.IPAllocation{"10.0.0.1": {PodUID: "a"}},
+	}}
+
+	reserveSystemIPs(pool)
+
+	want := map[string]v1alpha1.SystemReservation{
+		"10.0.0.0": v1alpha1.SystemReservationNetwork,
+		"10.0.0.1": "",
+		"10.0.0.7": v1alpha1.SystemReservationBroadcast,
+		"fd00::":   v1alpha1.SystemReservationNetwork,
+		"fd00::1":  v1alpha1.SystemReservationGateway,
+	}
+	if len(pool.Spec.Allocations) != len(want) {
+		t.Errorf("reserveSystemIPs() left %d allocations, want %d: %+v", len(pool.Spec.Allocations), len(want), pool.Spec.Allocations)
+	}
+	for ip, role := range want {
+		if got := pool.Spec.Allocations[ip].System; got != role {
+			t.Errorf("allocation of %s is %q, want %q", ip, got, role)
+		}
+	}
+
+	updatePoolStatus(pool)
+	// 5 usable IPs in the /29, 2 in the /126 and 2 in the /31
+	if pool.Status.Capacity != 9 || pool.Status.Allocated != 1 || pool.Status.Available != 8 {
+		t.Errorf("Status = %+v, want capacity 9, allocated 1, available 8", pool.Status)
+	}
+
+	ip, _, err := allocateFromRanges(pool, "b")
+	if err != nil || ip != "fd00::2" {
+		t.Errorf("allocateFromRanges() = %s, %v, want fd00::2", ip, err)
+	}
+}
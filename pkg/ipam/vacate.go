@@ -0,0 +1,153 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+// Outcomes of the holders of a vacating slice
+const (
+	VacateEvicted     = "evicted"
+	VacateTerminating = "terminating"
+	VacateBlocked     = "blocked by disruption budget"
+	VacateFailed      = "eviction failed"
+	// VacateLeft holders are not pods, or protected ones, and are left to
+	// their owner or the operator
+	VacateLeft = "left to owner"
+)
+
+// SliceHolder is an allocation still held in a vacating slice
+type SliceHolder struct {
+	IP    string `json:"ip"`
+	Owner string `json:"owner"`
+	Node  string `json:"node,omitempty"`
+	// Outcome is what vacating did about the holder, empty when nothing was tried
+	Outcome    string                `json:"outcome,omitempty"`
+	Allocation v1alpha1.IPAllocation `json:"-"`
+}
+
+// VacateReport lists what still holds IPs of a vacating slice of a pool
+type VacateReport struct {
+	Pool string `json:"pool"`
+	CIDR string `json:"cidr"`
+	// Free is set once nothing holds IPs of the slice, so the pool can be
+	// shrunk or the range removed
+	Free    bool          `json:"free"`
+	Holders []SliceHolder `json:"holders,omitempty"`
+}
+
+// SetVacating stops allocations from cidr, a slice of the ranges of the pool,
+// or lets them resume, and returns the report of the allocations still held
+// in the slice. The IPs buffered for nodes in the slice are released.
+func (a *Allocator) SetVacating(ctx context.Context, poolName, cidr string, vacating bool) (*VacateReport, error) {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %s: %w", cidr, err)
+	}
+	cidr = prefix.Masked().String()
+
+	var report *VacateReport
+	err = a.modifyPool(ctx, poolName, func(pool *v1alpha1.IPPool) error {
+		marked := slices.Contains(pool.Spec.Vacating, cidr)
+		if !vacating {
+			report = vacateReport(pool, cidr)
+			if !marked {
+				return errSkipUpdate
+			}
+			pool.Spec.Vacating = slices.DeleteFunc(pool.Spec.Vacating, func(c string) bool { return c == cidr })
+			return nil
+		}
+
+		if !marked {
+			overlaps := false
+			for _, r := range poolRanges(pool) {
+				if p, err := ParsePrefix(r.CIDR); err == nil && p.Overlaps(prefix) {
+					overlaps = true
+				}
+			}
+			if !overlaps {
+				return fmt.Errorf("CIDR %s is outside the ranges of pool %s", cidr, poolName)
+			}
+			pool.Spec.Vacating = append(pool.Spec.Vacating, cidr)
+		}
+		// Warm IPs have no pod to evict, their installers drop the aliases
+		// once the pool no longer buffers them and buffer IPs elsewhere
+		released := releaseBufferedIn(pool, prefix.Masked())
+		report = vacateReport(pool, cidr)
+		if marked && !released {
+			return errSkipUpdate
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// releaseBufferedIn releases the IPs of the pool buffered for nodes in cidr
+// and reports whether there were any
+func releaseBufferedIn(pool *v1alpha1.IPPool, cidr netip.Prefix) bool {
+	released := false
+	for ip, allocation := range pool.Spec.Allocations {
+		if addr, err := ParseAddr(ip); err == nil && allocation.Buffered && cidr.Contains(addr) {
+			delete(pool.Spec.Allocations, ip)
+			released = true
+		}
+	}
+	return released
+}
+
+// isVacating reports whether ip is in a vacating slice of the pool
+func isVacating(pool *v1alpha1.IPPool, ip string) bool {
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, cidr := range pool.Spec.Vacating {
+		if cidrContains(cidr, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// vacateReport lists the allocations of the pool held in cidr, system
+// reservations aside, ordered by IP
+func vacateReport(pool *v1alpha1.IPPool, cidr string) *VacateReport {
+	report := &VacateReport{Pool: pool.Name, CIDR: cidr}
+	for ip, allocation := range userAllocations(pool) {
+		addr, err := ParseAddr(ip)
+		if err != nil || !cidrContains(cidr, addr) {
+			continue
+		}
+		report.Holders = append(report.Holders, SliceHolder{
+			IP:         ip,
+			Owner:      allocationOwner(allocation),
+			Node:       allocation.NodeName,
+			Allocation: allocation,
+		})
+	}
+	sort.Slice(report.Holders, func(i, j int) bool {
+		return compareIPs(report.Holders[i].IP, report.Holders[j].IP) < 0
+	})
+	report.Free = len(report.Holders) == 0
+	return report
+}
+
+// AllocationsOutside counts the allocations of the pool, system reservations
+// aside, that a pool narrowed to cidr would no longer contain
+func AllocationsOutside(pool *v1alpha1.IPPool, cidr string) int {
+	outside := 0
+	for ip := range userAllocations(pool) {
+		if addr, err := ParseAddr(ip); err == nil && !cidrContains(cidr, addr) {
+			outside++
+		}
+	}
+	return outside
+}
@@ -0,0 +1,117 @@
+package ipam
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestVacate(t *testing.T) {
+	ctx := context.Background()
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{CIDR: "10.0.0.0/28", Allocations: map[string]v1alpha1.IPAllocation{
+			"10.0.0.9":  {PodName: "web", PodNamespace: "default", PodUID: "web-uid", NodeName: "node-1"},
+			"10.0.0.10": {NodeName: "node-1", Buffered: true},
+		}},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{IPPoolGVR: "IPPoolList"},
+		&unstructured.Unstructured{Object: obj})
+	allocator := NewAllocator(client)
+
+	if _, err := allocator.SetVacating(ctx, "pool", "10.1.0.0/24", true); err == nil {
+		t.Error("SetVacating() outside the pool succeeded")
+	}
+	report, err := allocator.SetVacating(ctx, "pool", "10.0.0.1/29", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.CIDR != "10.0.0.0/29" || !report.Free || len(report.Holders) != 0 {
+		t.Errorf("SetVacating() = %+v, want a free 10.0.0.0/29", report)
+	}
+	report, err = allocator.SetVacating(ctx, "pool", "10.0.0.8/29", true)
+	if err != nil || report.Free || len(report.Holders) != 1 || report.Holders[0].IP != "10.0.0.9" {
+		t.Fatalf("SetVacating() = %+v, %v, want 10.0.0.9 held", report, err)
+	}
+	if _, allocated, err := allocator.AllocationOf(ctx, "pool", "10.0.0.10"); err != nil || allocated {
+		t.Errorf("IP buffered in the vacating slice is still allocated: %v", err)
+	}
+	if _, err := allocator.Allocate(ctx, &AllocationRequest{PoolName: "pool", PodName: "db", PodNamespace: "default", PodUID: "db-uid", NodeName: "node-1", RequestedIP: "10.0.0.11"}); err == nil {
+		t.Error("Allocate() of a requested IP in a vacating slice succeeded")
+	}
+
+	// The whole range is vacating, nothing is allocated from it
+	if _, err := allocator.Allocate(ctx, &AllocationRequest{PoolName: "pool", PodName: "db", PodNamespace: "default", PodUID: "db-uid", NodeName: "node-1"}); err == nil {
+		t.Error("Allocate() from a vacating slice succeeded")
+	}
+	draining, err := allocator.DrainingPodAllocations(ctx, "pool")
+	if err != nil || len(draining) != 1 {
+		t.Errorf("DrainingPodAllocations() = %v, %v, want the pod in the slice", draining, err)
+	}
+
+	if _, err := allocator.SetVacating(ctx, "pool", "10.0.0.0/29", false); err != nil {
+		t.Fatal(err)
+	}
+	result, err := allocator.Allocate(ctx, &AllocationRequest{PoolName: "pool", PodName: "db", PodNamespace: "default", PodUID: "db-uid", NodeName: "node-1"})
+	if err != nil || result.IP != "10.0.0.2" {
+		t.Errorf("Allocate() after lifting = %+v, %v, want 10.0.0.2", result, err)
+	}
+
+	if got, err := findAvailableIPOutside("10.0.0.0/28", nil, []string{"10.0.0.0/30", "10.0.0.4/31"}); err != nil || got != "10.0.0.6" {
+		t.Errorf("findAvailableIPOutside() = %s, %v, want 10.0.0.6", got, err)
+	}
+}
+
+func TestClaimBufferedVacating(t *testing.T) {
+	ctx := context.Background()
+	pool := &v1alpha1.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "ipam.gcp-cni.cast.ai/v1alpha1", Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			CIDR:     "10.0.0.0/28",
+			Vacating: []string{"10.0.0.8/29"},
+			Allocations: map[string]v1alpha1.IPAllocation{
+				"10.0.0.2": {NodeName: "node-1", Buffered: true},
+				"10.0.0.9": {NodeName: "node-1", Buffered: true},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{IPPoolGVR: "IPPoolList"},
+		&unstructured.Unstructured{Object: obj})
+	allocator := NewAllocator(client)
+
+	req := &AllocationRequest{PoolName: "pool", PodName: "web", PodNamespace: "default", PodUID: "web-uid", NodeName: "node-1"}
+	if claimed, err := allocator.ClaimBuffered(ctx, "pool", "10.0.0.9", req); err != nil || claimed {
+		t.Errorf("ClaimBuffered() in a vacating slice = %v, %v, want false", claimed, err)
+	}
+	if claimed, err := allocator.ClaimBuffered(ctx, "pool", "10.0.0.2", req); err != nil || !claimed {
+		t.Errorf("ClaimBuffered() outside the vacating slice = %v, %v, want true", claimed, err)
+	}
+
+	// Marking the slice again releases what is still buffered in it
+	report, err := allocator.SetVacating(ctx, "pool", "10.0.0.8/29", true)
+	if err != nil || !report.Free {
+		t.Fatalf("SetVacating() = %+v, %v, want a free slice", report, err)
+	}
+	if _, allocated, err := allocator.AllocationOf(ctx, "pool", "10.0.0.9"); err != nil || allocated {
+		t.Errorf("IP buffered in the vacating slice is still allocated: %v", err)
+	}
+}
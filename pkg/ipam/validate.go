@@ -0,0 +1,120 @@
+package ipam
+
+import (
+	"fmt"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+const (
+	// LiveIPAnnotation asks for the pod to keep an IP allocated to a previous
+	// incarnation, as done by live migrations
+	LiveIPAnnotation = "live.cast.ai/ip"
+
+	// OriginalInstanceAnnotation names the instance the live IP moves from
+	OriginalInstanceAnnotation = "live.cast.ai/original-instance"
+
+	// SecondaryRangeAnnotation selects the secondary range, and with it the
+	// IPPool, the pod IP is taken from
+	SecondaryRangeAnnotation = "gcp-cni.cast.ai/secondary-range"
+
+	// IPCountAnnotation is the number of IPs the pod gets on its interface,
+	// see PodIPCount
+	IPCountAnnotation = "gcp-cni.cast.ai/ip-count"
+
+	// AliasAttachedCondition is the pod condition the installer sets once the
+	// alias ADD left to attach asynchronously is attached. Pods opt into the
+	// asynchronous attach by listing it as a readiness gate.
+	AliasAttachedCondition = "gcp-cni.cast.ai/alias-attached"
+)
+
+// HasIPAnnotations reports whether the annotations ask anything of the IPAM plugin
+func HasIPAnnotations(annotations map[string]string) bool {
+	for _, key := range []string{LiveIPAnnotation, OriginalInstanceAnnotation, SecondaryRangeAnnotation, IPCountAnnotation, IPFamiliesAnnotation, IPFamilyPolicyAnnotation} {
+		if _, ok := annotations[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatePodAnnotations checks the IP annotations of a pod against the pod
+// class pools, so requests the plugin's ADD would fail on are caught when the
+// pod is created.
+func ValidatePodAnnotations(pools []v1alpha1.IPPool, annotations map[string]string) error {
+	pools = podPools(pools)
+
+	reqIP, hasIP := annotations[LiveIPAnnotation]
+	if _, ok := annotations[OriginalInstanceAnnotation]; ok && !hasIP {
+		return fmt.Errorf("annotation %s requires %s", OriginalInstanceAnnotation, LiveIPAnnotation)
+	}
+	if hasIP {
+		if err := validateRequestedIP(pools, reqIP); err != nil {
+			return err
+		}
+	}
+
+	if rangeName, ok := annotations[SecondaryRangeAnnotation]; ok {
+		if rangeName == "" {
+			return fmt.Errorf("annotation %s is empty", SecondaryRangeAnnotation)
+		}
+		if !hasRange(pools, rangeName) {
+			return fmt.Errorf("no IPPool for secondary range %s", rangeName)
+		}
+	}
+	if _, err := PodIPCount(annotations); err != nil {
+		return err
+	}
+	if _, err := PodIPFamilies(annotations); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateRequestedIP checks that ip is a usable address of a pod class pool
+// that is still allocated, since the plugin only moves allocated IPs
+func validateRequestedIP(pools []v1alpha1.IPPool, ip string) error {
+	addr, err := ParseAddr(ip)
+	if err != nil || !addr.Is4() {
+		return fmt.Errorf("annotation %s: %q is not an IPv4 address", LiveIPAnnotation, ip)
+	}
+	ip = addr.String()
+
+	for _, pool := range pools {
+		for _, r := range poolRanges(&pool) {
+			prefix, err := ParsePrefix(r.CIDR)
+			if err != nil || !prefix.Contains(addr) {
+				continue
+			}
+			if isReserved(addr, prefix) {
+				return fmt.Errorf("IP %s is the network, gateway or broadcast address of range %s of IPPool %s", ip, r.CIDR, pool.Name)
+			}
+			if _, ok := pool.Spec.Allocations[ip]; !ok {
+				return fmt.Errorf("IP %s is not allocated in IPPool %s", ip, pool.Name)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("IP %s is not in any pod IPPool", ip)
+}
+
+func hasRange(pools []v1alpha1.IPPool, rangeName string) bool {
+	for _, pool := range pools {
+		for _, r := range poolRanges(&pool) {
+			if r.Name == rangeName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func podPools(pools []v1alpha1.IPPool) []v1alpha1.IPPool {
+	var podPools []v1alpha1.IPPool
+	for _, pool := range pools {
+		if pool.Spec.Class == "" || pool.Spec.Class == v1alpha1.PoolClassPod {
+			podPools = append(podPools, pool)
+		}
+	}
+	return podPools
+}
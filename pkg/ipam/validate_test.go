@@ -0,0 +1,71 @@
+package ipam
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/castai/gcp-cni/pkg/apis/ipam/v1alpha1"
+)
+
+func TestValidatePodAnnotations(t *testing.T) {
+	pools := []v1alpha1.IPPool{
+		{
+			Spec: v1alpha1.IPPoolSpec{
+				SecondaryRanges: []v1alpha1.SecondaryRange{
+					{Name: "live", CIDR: "10.0.0.0/24"},
+					{Name: "extra", CIDR: "10.0.1.0/24"},
+				},
+				Allocations: map[string]v1alpha1.IPAllocation{
+					"10.0.0.5": {PodName: "a"},
+				},
+			},
+		},
+		{
+			Spec: v1alpha1.IPPoolSpec{
+				Class:              v1alpha1.PoolClassEgress,
+				CIDR:               "10.1.0.0/24",
+				SecondaryRangeName: "egress",
+				Allocations: map[string]v1alpha1.IPAllocation{
+					"10.1.0.5": {},
+				},
+			},
+		},
+	}
+	pools[0].Name = "pods"
+	pools[1].Name = "egress"
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErr     string
+	}{
+		{name: "no annotations"},
+		{name: "allocated live IP", annotations: map[string]string{LiveIPAnnotation: "10.0.0.5", OriginalInstanceAnnotation: "node-a"}},
+		{name: "known range", annotations: map[string]string{SecondaryRangeAnnotation: "extra"}},
+		{name: "malformed IP", annotations: map[string]string{LiveIPAnnotation: "10.0.0"}, wantErr: "not an IPv4 address"},
+		{name: "IPv6", annotations: map[string]string{LiveIPAnnotation: "fd00::5"}, wantErr: "not an IPv4 address"},
+		{name: "outside pools", annotations: map[string]string{LiveIPAnnotation: "10.2.0.5"}, wantErr: "not in any pod IPPool"},
+		{name: "egress pool", annotations: map[string]string{LiveIPAnnotation: "10.1.0.5"}, wantErr: "not in any pod IPPool"},
+		{name: "network address", annotations: map[string]string{LiveIPAnnotation: "10.0.1.0"}, wantErr: "gateway or broadcast"},
+		{name: "gateway address", annotations: map[string]string{LiveIPAnnotation: "10.0.0.1"}, wantErr: "gateway or broadcast"},
+		{name: "broadcast address", annotations: map[string]string{LiveIPAnnotation: "10.0.0.255"}, wantErr: "gateway or broadcast"},
+		{name: "unallocated IP", annotations: map[string]string{LiveIPAnnotation: "10.0.0.6"}, wantErr: "not allocated in IPPool pods"},
+		{name: "original instance without IP", annotations: map[string]string{OriginalInstanceAnnotation: "node-a"}, wantErr: "requires"},
+		{name: "unknown range", annotations: map[string]string{SecondaryRangeAnnotation: "egress"}, wantErr: "no IPPool for secondary range"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePodAnnotations(pools, tt.annotations)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
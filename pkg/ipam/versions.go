@@ -0,0 +1,13 @@
+package ipam
+
+// Annotations the installer keeps on its node, so nodes running another
+// release or configuration than the rest of the fleet can be found
+const (
+	// PluginVersionAnnotation is the gcp-ipam release the node runs
+	PluginVersionAnnotation = "gcp-cni.cast.ai/plugin-version"
+	// PluginConfigAnnotation is the SHA-256 of the effective configuration of
+	// the plugin on the node
+	PluginConfigAnnotation = "gcp-cni.cast.ai/plugin-config-sha256"
+	// InstallerVersionAnnotation is the release of the installer on the node
+	InstallerVersionAnnotation = "gcp-cni.cast.ai/installer-version"
+)